@@ -0,0 +1,90 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/roboll/helmfile/pkg/app"
+	"github.com/roboll/helmfile/pkg/helmexec"
+	"github.com/urfave/cli"
+)
+
+//go:embed autocomplete/helmfile_bash_autocomplete
+var bashCompletion string
+
+//go:embed autocomplete/helmfile_zsh_autocomplete
+var zshCompletion string
+
+var completionScripts = map[string]string{
+	"bash": bashCompletion,
+	"zsh":  zshCompletion,
+}
+
+// printCompletion prints the completion script for the shell given as the argument of `helmfile completion`
+func printCompletion(c *cli.Context) error {
+	shell := c.Args().First()
+
+	script, ok := completionScripts[shell]
+	if !ok {
+		return cli.NewExitError(fmt.Sprintf("unsupported shell %q: it must be one of bash or zsh", shell), 1)
+	}
+
+	_, err := fmt.Fprint(c.App.Writer, script)
+
+	return err
+}
+
+// completeSelectors completes the value of --selector with the labels of the releases defined in the state files,
+// like `name=myapp` and `tier=frontend`, and falls back to the default completion of the subcommands otherwise.
+// The state files are loaded without running helm, and the result is cached for a few seconds,
+// as the shell runs it on every key press.
+func completeSelectors(c *cli.Context) {
+	if !completingSelector(os.Args) {
+		cli.DefaultAppComplete(c)
+		return
+	}
+
+	// The logger isn't configured by cli.App.Before when completing. The logs would corrupt the completion
+	if c.App.Metadata == nil {
+		c.App.Metadata = map[string]interface{}{}
+	}
+	c.App.Metadata["logger"] = helmexec.NewLogger(io.Discard, "error")
+
+	conf, err := NewUrfaveCliConfigImpl(c)
+	if err != nil {
+		return
+	}
+
+	intro, err := app.New(conf).IntrospectCached()
+	if err != nil {
+		return
+	}
+
+	zsh := os.Getenv("_CLI_ZSH_AUTOCOMPLETE_HACK") == "1"
+
+	for _, s := range intro.Selectors() {
+		if zsh {
+			// zsh takes the part after `:` as the description of the candidate
+			s = strings.ReplaceAll(s, ":", `\:`)
+		}
+		fmt.Fprintln(c.App.Writer, s)
+	}
+}
+
+// completingSelector returns true when the shell is completing the value of --selector,
+// which is the last argument before --generate-bash-completion
+func completingSelector(args []string) bool {
+	if len(args) < 2 || args[len(args)-1] != "--"+cli.BashCompletionFlag.GetName() {
+		return false
+	}
+
+	switch args[len(args)-2] {
+	case "-l", "--selector", "-selector":
+		return true
+	}
+
+	return false
+}
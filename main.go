@@ -16,6 +16,13 @@ import (
 
 var logger *zap.SugaredLogger
 
+const (
+	// argsUsage is the usage of the --args flag of the commands running helm
+	argsUsage = "pass args to helm exec. The flags also generated by helmfile, like --timeout, override the generated ones, while --set and --values are added to them"
+	// extraArgsUsage is the usage of the --extra-args flag of the commands running helm
+	extraArgsUsage = "pass args to helm exec as is, appended after all the other args without removing any flag generated by helmfile"
+)
+
 func configureLogging(c *cli.Context) error {
 	// Valid levels:
 	// https://github.com/uber-go/zap/blob/7e7e266a8dbce911a49554b945538c5b950196b8/zapcore/level.go#L126
@@ -25,13 +32,26 @@ func configureLogging(c *cli.Context) error {
 	} else if c.GlobalBool("quiet") {
 		logLevel = "warn"
 	}
-	logger = helmexec.NewLogger(os.Stderr, logLevel)
+	var err error
+	logger, err = helmexec.NewLoggerWithFormat(os.Stderr, logLevel, c.GlobalString("log-format"))
+	if err != nil {
+		return err
+	}
+	var summaryLogger *zap.SugaredLogger
+	if c.GlobalBool("quiet") && !c.GlobalBool("debug") {
+		// The final summary is shown even with --quiet, which discards informational logs
+		summaryLogger, err = helmexec.NewLoggerWithFormat(os.Stderr, "info", c.GlobalString("log-format"))
+		if err != nil {
+			return err
+		}
+	}
 	if c.App.Metadata == nil {
 		// Auto-initialised in 1.19.0
 		// https://github.com/urfave/cli/blob/master/CHANGELOG.md#1190---2016-11-19
 		c.App.Metadata = make(map[string]interface{})
 	}
 	c.App.Metadata["logger"] = logger
+	c.App.Metadata["summaryLogger"] = summaryLogger
 	return nil
 }
 
@@ -42,6 +62,7 @@ func main() {
 	cliApp.Usage = ""
 	cliApp.Version = version.Version
 	cliApp.EnableBashCompletion = true
+	cliApp.BashComplete = completeSelectors
 	cliApp.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:  "helm-binary, b",
@@ -54,7 +75,7 @@ func main() {
 		},
 		cli.StringFlag{
 			Name:  "environment, e",
-			Usage: `specify the environment name. defaults to "default"`,
+			Usage: `specify the environment name. defaults to "default". "@<file>" reads the name from the file, and "@branch" uses the current git branch`,
 		},
 		cli.StringSliceFlag{
 			Name:  "state-values-set",
@@ -66,7 +87,7 @@ func main() {
 		},
 		cli.BoolFlag{
 			Name:  "quiet, q",
-			Usage: "Silence output. Equivalent to log-level warn",
+			Usage: "Silence output except errors and the final summary of affected releases. Equivalent to log-level warn, except that the summary is still shown",
 		},
 		cli.StringFlag{
 			Name:  "kube-context",
@@ -78,12 +99,22 @@ func main() {
 		},
 		cli.BoolFlag{
 			Name:  "no-color",
-			Usage: "Output without color",
+			Usage: "Output without color. Same as --color=never",
+		},
+		cli.StringFlag{
+			Name:  "color",
+			Value: app.ColorAuto,
+			Usage: "When to color the output of helmfile and helm-diff: auto, always, or never. auto colors it only when stdout is a terminal",
 		},
 		cli.StringFlag{
 			Name:  "log-level",
 			Usage: "Set log level, default info",
 		},
+		cli.StringFlag{
+			Name:  "log-format",
+			Usage: `Set log format, either "text" or "json". "json" prints a JSON object per line with structured fields like the release name, default text`,
+			Value: helmexec.LogFormatText,
+		},
 		cli.StringFlag{
 			Name:  "namespace, n",
 			Usage: "Set namespace. Uses the namespace set in the context by default, and is available in templates as {{ .Namespace }}",
@@ -92,12 +123,39 @@ func main() {
 			Name:  "chart, c",
 			Usage: "Set chart. Uses the chart set in release by default, and is available in template as {{ .Chart }}",
 		},
+		cli.StringSliceFlag{
+			Name:  "chart-override",
+			Usage: "Replace the chart of the releases whose chart matches CHART with the local chart at PATH, in the form of CHART=PATH like myrepo/mychart=../charts/mychart. CHART can be a glob pattern like myrepo/*. Can be specified multiple times",
+		},
+		cli.BoolFlag{
+			Name:  "global-needs",
+			Usage: "Resolve needs across all the state files, including sub-helmfiles, by the full IDs of the releases like KUBECONTEXT/NAMESPACE/NAME. The state files are loaded once more per group of the releases ordered by the needs",
+		},
 		cli.StringSliceFlag{
 			Name: "selector, l",
 			Usage: `Only run using the releases that match labels. Labels can take the form of foo=bar or foo!=bar.
 	A release must match all labels in a group in order to be used. Multiple groups can be specified at once.
 	--selector tier=frontend,tier!=proxy --selector tier=backend. Will match all frontend, non-proxy releases AND all backend releases.
 	The name of a release can be used as a label. --selector name=myrelease`,
+		},
+		cli.StringSliceFlag{
+			Name: "exclude-selector",
+			Usage: `Exclude the releases that match labels, in the same form as --selector, even when they match --selector.
+	Multiple groups can be specified at once. --exclude-selector name=foo --exclude-selector name=bar. Will exclude both foo and bar.
+	Releases needed by the selected releases are still run with --include-needs or --include-transitive-needs`,
+		},
+		cli.StringFlag{
+			Name:  "selector-file",
+			Usage: `Load selectors from the file, one per line in the same form as --selector. Lines starting with # are comments. Combined with the --selector flags`,
+		},
+		cli.StringFlag{
+			Name:  "merge-values-strategy",
+			Usage: `how helmfile merges the values and secrets files of each release before passing them to helm: "deep" deep-merges maps and replaces arrays like helm, "override" replaces each top-level key as a whole, and "append-arrays" deep-merges maps and appends arrays. Overrides mergeValuesStrategy in the state file. Defaults to "deep"`,
+		},
+		cli.StringFlag{
+			Name: "changed-since",
+			Usage: `Only run the releases whose local charts or values files have changed since the git ref, like origin/main, along with their needs. Combined with the --selector flags.
+	All the releases in a state file are run when the state file itself, its bases, or its environment values have changed`,
 		},
 		cli.BoolFlag{
 			Name:  "allow-no-matching-release",
@@ -107,6 +165,36 @@ func main() {
 			Name:  "interactive, i",
 			Usage: "Request confirmation before attempting to modify clusters",
 		},
+		cli.BoolFlag{
+			Name:  "no-hooks",
+			Usage: "Skip the helmfile hooks, and pass --no-hooks to helm upgrade, diff, and template to skip the chart hooks as well",
+		},
+		cli.BoolFlag{
+			Name:   "enable-exec-values",
+			Usage:  `Allow the values entries of releases like "exec://./gen-values.sh arg" to run the command and use its output as a values file. Disabled by default, as it runs arbitrary commands written in helmfiles`,
+			EnvVar: "HELMFILE_ENABLE_EXEC_VALUES",
+		},
+		cli.BoolFlag{
+			Name:  "timings",
+			Usage: "Print the time spent in each phase like repos, prepare, diff, sync, and hooks, and for each release, at the end of the run",
+		},
+		cli.StringFlag{
+			Name:  "dump-debug-bundle",
+			Usage: "Write the rendered state files, the generated values files, the helm commands run, and the stderr of the failed ones into the directory when helmfile fails, to be attached to a bug report. Secret values are redacted",
+		},
+		cli.BoolFlag{
+			Name:  "debug-bundle-show-secrets",
+			Usage: "Do not redact secret values in the debug bundle written by --dump-debug-bundle",
+		},
+		cli.StringFlag{
+			Name:  "timings-output",
+			Usage: "Write the timings to the file as JSON. Implies --timings",
+		},
+		cli.IntFlag{
+			Name:  "concurrency-per-context",
+			Value: 0,
+			Usage: "maximum number of concurrent helm processes to run against each kube context, in addition to --concurrency of each command. 0 is unlimited",
+		},
 	}
 
 	cliApp.Before = configureLogging
@@ -118,12 +206,22 @@ func main() {
 				cli.StringFlag{
 					Name:  "args",
 					Value: "",
-					Usage: "pass args to helm exec",
+					Usage: argsUsage,
+				},
+				cli.StringFlag{
+					Name:  "extra-args",
+					Value: "",
+					Usage: extraArgsUsage,
 				},
 				cli.BoolFlag{
 					Name:  "skip-repos",
 					Usage: `skip running "helm repo update" before running "helm dependency build"`,
 				},
+				cli.StringFlag{
+					Name:  "output-file",
+					Value: "",
+					Usage: "write the resolved dependencies to the file, instead of updating the lock files and the local charts",
+				},
 			},
 			Action: action(func(a *app.App, c configImpl) error {
 				return a.Deps(c)
@@ -136,13 +234,41 @@ func main() {
 				cli.StringFlag{
 					Name:  "args",
 					Value: "",
-					Usage: "pass args to helm exec",
+					Usage: argsUsage,
+				},
+				cli.StringFlag{
+					Name:  "extra-args",
+					Value: "",
+					Usage: extraArgsUsage,
 				},
 			},
 			Action: action(func(a *app.App, c configImpl) error {
 				return a.Repos(c)
 			}),
 		},
+		{
+			Name:  "lock",
+			Usage: `resolve the version constraints of releases into exact chart versions and write them to "<state file name>.versions.lock"`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "args",
+					Value: "",
+					Usage: argsUsage,
+				},
+				cli.StringFlag{
+					Name:  "extra-args",
+					Value: "",
+					Usage: extraArgsUsage,
+				},
+				cli.BoolFlag{
+					Name:  "skip-repos",
+					Usage: `skip running "helm repo update" before resolving versions with "helm search repo"`,
+				},
+			},
+			Action: action(func(a *app.App, c configImpl) error {
+				return a.Lock(c)
+			}),
+		},
 		{
 			Name:  "charts",
 			Usage: "DEPRECATED: sync releases from state file (helm upgrade --install)",
@@ -150,7 +276,12 @@ func main() {
 				cli.StringFlag{
 					Name:  "args",
 					Value: "",
-					Usage: "pass args to helm exec",
+					Usage: argsUsage,
+				},
+				cli.StringFlag{
+					Name:  "extra-args",
+					Value: "",
+					Usage: extraArgsUsage,
 				},
 				cli.StringSliceFlag{
 					Name:  "set",
@@ -177,20 +308,37 @@ func main() {
 				cli.StringFlag{
 					Name:  "args",
 					Value: "",
-					Usage: "pass args to helm exec",
+					Usage: argsUsage,
+				},
+				cli.StringFlag{
+					Name:  "extra-args",
+					Value: "",
+					Usage: extraArgsUsage,
 				},
 				cli.StringSliceFlag{
 					Name:  "set",
 					Usage: "additional values to be merged into the command",
 				},
+				cli.StringSliceFlag{
+					Name:  "set-string",
+					Usage: "additional string values to be merged into the command, passed to helm via --set-string",
+				},
+				cli.StringSliceFlag{
+					Name:  "set-file",
+					Usage: "additional values read from files to be merged into the command, passed to helm via --set-file",
+				},
 				cli.StringSliceFlag{
 					Name:  "values",
-					Usage: "additional value files to be merged into the command",
+					Usage: "additional value files to be merged into the command. Use - to read a values document from stdin, which takes precedence over the other value files",
 				},
 				cli.BoolFlag{
 					Name:  "skip-deps",
 					Usage: `skip running "helm repo update" and "helm dependency build"`,
 				},
+				cli.BoolFlag{
+					Name:  "skip-repos",
+					Usage: `skip running "helm repo add" and "helm repo update", while still running "helm dependency build" for local charts`,
+				},
 				cli.BoolFlag{
 					Name:  "detailed-exitcode",
 					Usage: "return a non-zero exit code when there are changes",
@@ -199,6 +347,14 @@ func main() {
 					Name:  "include-tests",
 					Usage: "enable the diffing of the helm test hooks",
 				},
+				cli.BoolFlag{
+					Name:  "include-crds",
+					Usage: "include CRDs in the diff by passing --include-crds to helm-diff",
+				},
+				cli.BoolFlag{
+					Name:  "skip-crds",
+					Usage: "exclude CRDs from the diff by passing --skip-crds to helm-diff",
+				},
 				cli.BoolTFlag{
 					Name:  "skip-needs",
 					Usage: `do not automatically include releases from the target release's "needs" when --selector/-l flag is provided. Does nothing when when --selector/-l flag is not provided. Defaults to true when --include-needs or --include-transitive-needs is not provided`,
@@ -207,6 +363,10 @@ func main() {
 					Name:  "include-needs",
 					Usage: `automatically include releases from the target release's "needs" when --selector/-l flag is provided. Does nothing when when --selector/-l flag is not provided`,
 				},
+				cli.BoolFlag{
+					Name:  "preflight",
+					Usage: "verify that the kube contexts of all the releases exist in the kubeconfig before running any helm command",
+				},
 				cli.BoolFlag{
 					Name:  "skip-diff-on-install",
 					Usage: "Skips running helm-diff on releases being newly installed on this apply. Useful when the release manifests are too huge to be reviewed, or it's too time-consuming to diff at all",
@@ -215,6 +375,14 @@ func main() {
 					Name:  "suppress",
 					Usage: "suppress specified Kubernetes objects in the output. Can be provided multiple times. For example: --suppress KeycloakClient --suppress VaultSecret",
 				},
+				cli.StringSliceFlag{
+					Name:  "suppress-output-line-regex",
+					Usage: "a regex to suppress diff output lines that match it. Can be provided multiple times. For example: --suppress-output-line-regex \"^# Source:\"",
+				},
+				cli.StringSliceFlag{
+					Name:  "suppress-release",
+					Usage: "suppress the whole diff output of the release with the ID. The release is still counted as changed. Can be provided multiple times. For example: --suppress-release default/kube-system/noisy",
+				},
 				cli.BoolFlag{
 					Name:  "suppress-secrets",
 					Usage: "suppress secrets in the output. highly recommended to specify on CI/CD use-cases",
@@ -228,10 +396,26 @@ func main() {
 					Value: 0,
 					Usage: "maximum number of concurrent helm processes to run, 0 is unlimited",
 				},
+				cli.BoolFlag{
+					Name:  "fail-fast",
+					Usage: "stop starting the remaining releases on the first release that failed. The releases already running are run to completion",
+				},
+				cli.BoolFlag{
+					Name:  "no-fail-fast",
+					Usage: "attempt all the releases and report all the failures, overriding --fail-fast. This is the default",
+				},
 				cli.BoolFlag{
 					Name:  "validate",
 					Usage: "validate your manifests against the Kubernetes cluster you are currently pointing at. Note that this requiers access to a Kubernetes cluster to obtain information necessary for validating, like the list of available API versions",
 				},
+				cli.BoolFlag{
+					Name:  "validate-dry-run-server",
+					Usage: `run helm-diff with "--dry-run=server" so that admission webhooks and defaulting are reflected in the diff, overriding releases[].serverSideDiff and helmDefaults.serverSideDiff. Requires helm 3.13.0 and helm-diff 3.9.0 or greater`,
+				},
+				cli.BoolFlag{
+					Name:  "validate-values",
+					Usage: "validate the merged values of each release against the chart's values.schema.json before running helm. Set releases[].validateValuesSchema to false to opt a release out",
+				},
 
 				cli.IntFlag{
 					Name:  "context",
@@ -243,6 +427,19 @@ func main() {
 					Value: "",
 					Usage: "output format for diff plugin",
 				},
+				cli.BoolFlag{
+					Name:  "values-only",
+					Usage: `compare the merged values of each release against the user-supplied values of the deployed release ("helm get values") instead of the rendered manifests`,
+				},
+				cli.StringFlag{
+					Name:  "output-summary",
+					Usage: "write a JSON summary of the diff result of each release and the exit code to the file",
+				},
+				cli.IntFlag{
+					Name:  "exit-code-on-error",
+					Value: 0,
+					Usage: "exit with the given code when any release failed to diff, so that it can be told apart from the exit code 2 of --detailed-exitcode. A failure wins over changes when both happened. 0 keeps the default exit code 1",
+				},
 			},
 			Action: action(func(a *app.App, c configImpl) error {
 				return a.Diff(c)
@@ -255,15 +452,28 @@ func main() {
 				cli.StringFlag{
 					Name:  "args",
 					Value: "",
-					Usage: "pass args to helm template",
+					Usage: "pass args to helm template. The flags also generated by helmfile, like --kube-version, override the generated ones, while --set and --values are added to them",
+				},
+				cli.StringFlag{
+					Name:  "extra-args",
+					Value: "",
+					Usage: "pass args to helm template as is, appended after all the other args without removing any flag generated by helmfile",
 				},
 				cli.StringSliceFlag{
 					Name:  "set",
 					Usage: "additional values to be merged into the command",
 				},
+				cli.StringSliceFlag{
+					Name:  "set-string",
+					Usage: "additional string values to be merged into the command, passed to helm via --set-string",
+				},
+				cli.StringSliceFlag{
+					Name:  "set-file",
+					Usage: "additional values read from files to be merged into the command, passed to helm via --set-file",
+				},
 				cli.StringSliceFlag{
 					Name:  "values",
-					Usage: "additional value files to be merged into the command",
+					Usage: "additional value files to be merged into the command. Use - to read a values document from stdin, which takes precedence over the other value files",
 				},
 				cli.StringFlag{
 					Name:  "output-dir",
@@ -273,6 +483,10 @@ func main() {
 					Name:  "output-dir-template",
 					Usage: "go text template for generating the output directory. Default: {{ .OutputDir }}/{{ .State.BaseName }}-{{ .State.AbsPathSHA1 }}-{{ .Release.Name}}",
 				},
+				cli.StringFlag{
+					Name:  "output-file-template",
+					Usage: "go text template for generating the output file that contains all the manifests of each release, like {{ .State.BaseName }}-{{ .State.AbsPathSHA1 }}/{{ .Release.Name }}.yaml. CRDs come first. Cannot be used with --output-dir or --output-dir-template",
+				},
 				cli.IntFlag{
 					Name:  "concurrency",
 					Value: 0,
@@ -280,7 +494,7 @@ func main() {
 				},
 				cli.BoolFlag{
 					Name:  "validate",
-					Usage: "validate your manifests against the Kubernetes cluster you are currently pointing at. Note that this requiers access to a Kubernetes cluster to obtain information necessary for validating, like the list of available API versions",
+					Usage: "validate your manifests against the Kubernetes cluster of the kube context of each release, or the one you are currently pointing at. Note that this requiers access to a Kubernetes cluster to obtain information necessary for validating, like the list of available API versions",
 				},
 				cli.BoolFlag{
 					Name:  "include-crds",
@@ -302,10 +516,26 @@ func main() {
 					Name:  "skip-deps",
 					Usage: `skip running "helm repo update" and "helm dependency build"`,
 				},
+				cli.BoolFlag{
+					Name:  "skip-repos",
+					Usage: `skip running "helm repo add" and "helm repo update", while still running "helm dependency build" for local charts`,
+				},
 				cli.BoolFlag{
 					Name:  "skip-cleanup",
 					Usage: "Stop cleaning up temporary values generated by helmfile and helm-secrets. Useful for debugging. Don't use in production for security",
 				},
+				cli.StringFlag{
+					Name:  "kube-version",
+					Usage: `override the kubeVersion of releases, which is passed to "helm template" as --kube-version to set Capabilities.KubeVersion`,
+				},
+				cli.StringSliceFlag{
+					Name:  "api-versions",
+					Usage: `override the apiVersions of releases, which are passed to "helm template" as --api-versions to set Capabilities.APIVersions. Can be specified multiple times`,
+				},
+				cli.StringFlag{
+					Name:  "capabilities-file",
+					Usage: "path to a YAML file listing sets of kubeVersion and apiVersions. Releases are templated once per set, into the subdirectory of --output-dir named after the set",
+				},
 			},
 			Action: action(func(a *app.App, c configImpl) error {
 				return a.Template(c)
@@ -348,7 +578,12 @@ func main() {
 				cli.StringFlag{
 					Name:  "args",
 					Value: "",
-					Usage: "pass args to helm exec",
+					Usage: argsUsage,
+				},
+				cli.StringFlag{
+					Name:  "extra-args",
+					Value: "",
+					Usage: extraArgsUsage,
 				},
 				cli.StringSliceFlag{
 					Name:  "set",
@@ -389,11 +624,36 @@ func main() {
 					Name:  "output-dir",
 					Usage: "directory to store charts (default: temporary directory which is deleted when the command terminates)",
 				},
+				cli.BoolFlag{
+					Name:  "untar",
+					Usage: "expand the fetched chart archives",
+				},
+				cli.StringFlag{
+					Name:  "verify-digest",
+					Usage: "path to the manifest of chart digests printed by a previous fetch. Fails when the sha256 digest of a fetched chart doesn't match the manifest",
+				},
 			},
 			Action: action(func(a *app.App, c configImpl) error {
 				return a.Fetch(c)
 			}),
 		},
+		{
+			Name:  "verify",
+			Usage: "verify the charts of the releases against their provenance files",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "skip-deps",
+					Usage: `skip running "helm repo update" and "helm dependency build"`,
+				},
+				cli.StringFlag{
+					Name:  "keyring",
+					Usage: "path to the keyring containing the public keys used to verify the charts (default: the default keyring of helm)",
+				},
+			},
+			Action: action(func(a *app.App, c configImpl) error {
+				return a.Verify(c)
+			}),
+		},
 		{
 			Name:  "sync",
 			Usage: "sync all resources from state file (repos, releases and chart deps)",
@@ -402,19 +662,40 @@ func main() {
 					Name:  "set",
 					Usage: "additional values to be merged into the command",
 				},
+				cli.StringSliceFlag{
+					Name:  "set-string",
+					Usage: "additional string values to be merged into the command, passed to helm via --set-string",
+				},
+				cli.StringSliceFlag{
+					Name:  "set-file",
+					Usage: "additional values read from files to be merged into the command, passed to helm via --set-file",
+				},
 				cli.StringSliceFlag{
 					Name:  "values",
-					Usage: "additional value files to be merged into the command",
+					Usage: "additional value files to be merged into the command. Use - to read a values document from stdin, which takes precedence over the other value files",
 				},
 				cli.IntFlag{
 					Name:  "concurrency",
 					Value: 0,
 					Usage: "maximum number of concurrent helm processes to run, 0 is unlimited",
 				},
+				cli.BoolFlag{
+					Name:  "fail-fast",
+					Usage: "stop starting the remaining releases on the first release that failed. The releases already running are run to completion",
+				},
+				cli.BoolFlag{
+					Name:  "no-fail-fast",
+					Usage: "attempt all the releases and report all the failures, overriding --fail-fast. This is the default",
+				},
 				cli.StringFlag{
 					Name:  "args",
 					Value: "",
-					Usage: "pass args to helm exec",
+					Usage: argsUsage,
+				},
+				cli.StringFlag{
+					Name:  "extra-args",
+					Value: "",
+					Usage: extraArgsUsage,
 				},
 				cli.BoolFlag{
 					Name:  "skip-crds",
@@ -424,6 +705,14 @@ func main() {
 					Name:  "skip-deps",
 					Usage: `skip running "helm repo update" and "helm dependency build"`,
 				},
+				cli.BoolFlag{
+					Name:  "skip-repos",
+					Usage: `skip running "helm repo add" and "helm repo update", while still running "helm dependency build" for local charts`,
+				},
+				cli.BoolFlag{
+					Name:  "validate-values",
+					Usage: "validate the merged values of each release against the chart's values.schema.json before running helm. Set releases[].validateValuesSchema to false to opt a release out",
+				},
 				cli.BoolTFlag{
 					Name:  "skip-needs",
 					Usage: `do not automatically include releases from the target release's "needs" when --selector/-l flag is provided. Does nothing when when --selector/-l flag is not provided. Defaults to true when --include-needs or --include-transitive-needs is not provided`,
@@ -444,6 +733,89 @@ func main() {
 					Name:  "wait-for-jobs",
 					Usage: `Override helmDefaults.waitForJobs setting "helm upgrade --install --wait-for-jobs"`,
 				},
+				cli.BoolFlag{
+					Name:  "atomic",
+					Usage: `Force "helm upgrade --install --atomic" on all the releases, overriding releases[].atomic and helmDefaults.atomic`,
+				},
+				cli.BoolFlag{
+					Name:  "cleanup-on-fail",
+					Usage: `Force "helm upgrade --install --cleanup-on-fail" on all the releases, overriding releases[].cleanupOnFail and helmDefaults.cleanupOnFail`,
+				},
+				cli.BoolFlag{
+					Name:  "no-create-namespace",
+					Usage: `Do not pass "--create-namespace" to "helm upgrade --install" for any release, overriding releases[].createNamespace and helmDefaults.createNamespace. Useful when namespaces are managed by something other than helm`,
+				},
+				cli.IntFlag{
+					Name:  "wait-retries",
+					Value: 0,
+					Usage: `the number of times "helm upgrade --install --wait" is run again when it timed out waiting for the resources, overriding releases[].waitRetries and helmDefaults.waitRetries`,
+				},
+				cli.IntFlag{
+					Name:  "history-max",
+					Usage: `limit the maximum number of revisions saved per release, overriding releases[].historyMax and helmDefaults.historyMax. Use 0 for no limit`,
+				},
+				cli.BoolFlag{
+					Name:  "post-sync-status",
+					Usage: `run "helm status" on each release after it is successfully upgraded, and show its status in the summary. Releases not reported as deployed are listed separately. Requires Helm 3`,
+				},
+				cli.StringFlag{
+					Name:  "record-reason, reason",
+					Usage: `record the reason of the change in the release revisions created by "helm upgrade", passed as --description so that it's shown in "helm history". For example: --record-reason "JIRA-123: bump image"`,
+				},
+				cli.BoolFlag{
+					Name:  "use-lock",
+					Usage: `use the chart versions locked by "helmfile lock" instead of resolving the version constraints of releases`,
+				},
+				cli.StringFlag{
+					Name:  "kube-version",
+					Usage: `override the kubeVersion of releases, which is passed to "helm template" as --kube-version to set Capabilities.KubeVersion`,
+				},
+				cli.StringSliceFlag{
+					Name:  "api-versions",
+					Usage: `override the apiVersions of releases, which are passed to "helm template" as --api-versions to set Capabilities.APIVersions. Can be specified multiple times`,
+				},
+				cli.BoolFlag{
+					Name:  "diff-on-sync",
+					Usage: "print the diff of releases before syncing them. Unlike apply, all the releases are synced regardless of the diff",
+				},
+				cli.BoolFlag{
+					Name:  "fail-on-diff-error",
+					Usage: "abort the sync when --diff-on-sync failed to diff releases. By default the error is logged and the sync continues",
+				},
+				cli.StringSliceFlag{
+					Name:  "suppress",
+					Usage: "suppress specified Kubernetes objects in the diff output of --diff-on-sync. Can be provided multiple times. For example: --suppress KeycloakClient --suppress VaultSecret",
+				},
+				cli.StringSliceFlag{
+					Name:  "suppress-output-line-regex",
+					Usage: "a regex to suppress diff output lines that match it. Can be provided multiple times. For example: --suppress-output-line-regex \"^# Source:\"",
+				},
+				cli.BoolFlag{
+					Name:  "suppress-secrets",
+					Usage: "suppress secrets in the diff output of --diff-on-sync. highly recommended to specify on CI/CD use-cases",
+				},
+				cli.BoolFlag{
+					Name:  "show-secrets",
+					Usage: "do not redact secret values in the diff output of --diff-on-sync. should be used for debug purpose only",
+				},
+				cli.IntFlag{
+					Name:  "diff-context, context",
+					Value: 0,
+					Usage: "output NUM lines of context around changes in the diff of --diff-on-sync",
+				},
+				cli.StringFlag{
+					Name:  "diff-output, output",
+					Value: "",
+					Usage: "output format for diff plugin in the diff of --diff-on-sync",
+				},
+				cli.BoolFlag{
+					Name:  "preflight",
+					Usage: "verify that the kube contexts of all the releases exist in the kubeconfig before running any helm command",
+				},
+				cli.BoolFlag{
+					Name:  "verbose-summary",
+					Usage: "show whether helm waited for each upgraded release and how long it took in the summary. Enabled by --timings too",
+				},
 			},
 			Action: action(func(a *app.App, c configImpl) error {
 				return a.Sync(c)
@@ -457,19 +829,43 @@ func main() {
 					Name:  "set",
 					Usage: "additional values to be merged into the command",
 				},
+				cli.StringSliceFlag{
+					Name:  "set-string",
+					Usage: "additional string values to be merged into the command, passed to helm via --set-string",
+				},
+				cli.StringSliceFlag{
+					Name:  "set-file",
+					Usage: "additional values read from files to be merged into the command, passed to helm via --set-file",
+				},
 				cli.StringSliceFlag{
 					Name:  "values",
-					Usage: "additional value files to be merged into the command",
+					Usage: "additional value files to be merged into the command. Use - to read a values document from stdin, which takes precedence over the other value files",
 				},
 				cli.IntFlag{
 					Name:  "concurrency",
 					Value: 0,
 					Usage: "maximum number of concurrent helm processes to run, 0 is unlimited",
 				},
+				cli.BoolFlag{
+					Name:  "fail-fast",
+					Usage: "stop starting the remaining releases on the first release that failed. The releases already running are run to completion",
+				},
+				cli.BoolFlag{
+					Name:  "no-fail-fast",
+					Usage: "attempt all the releases and report all the failures, overriding --fail-fast. This is the default",
+				},
 				cli.BoolFlag{
 					Name:  "validate",
 					Usage: "validate your manifests against the Kubernetes cluster you are currently pointing at. Note that this requiers access to a Kubernetes cluster to obtain information necessary for validating, like the list of available API versions",
 				},
+				cli.BoolFlag{
+					Name:  "validate-dry-run-server",
+					Usage: `run helm-diff with "--dry-run=server" so that admission webhooks and defaulting are reflected in the diff, overriding releases[].serverSideDiff and helmDefaults.serverSideDiff. Requires helm 3.13.0 and helm-diff 3.9.0 or greater`,
+				},
+				cli.BoolFlag{
+					Name:  "validate-values",
+					Usage: "validate the merged values of each release against the chart's values.schema.json before running helm. Set releases[].validateValuesSchema to false to opt a release out",
+				},
 				cli.IntFlag{
 					Name:  "context",
 					Value: 0,
@@ -487,7 +883,12 @@ func main() {
 				cli.StringFlag{
 					Name:  "args",
 					Value: "",
-					Usage: "pass args to helm exec",
+					Usage: argsUsage,
+				},
+				cli.StringFlag{
+					Name:  "extra-args",
+					Value: "",
+					Usage: extraArgsUsage,
 				},
 				cli.BoolFlag{
 					Name:  "retain-values-files",
@@ -499,7 +900,11 @@ func main() {
 				},
 				cli.BoolFlag{
 					Name:  "skip-crds",
-					Usage: "if set, no CRDs will be installed on sync. By default, CRDs are installed if not already present",
+					Usage: "if set, no CRDs will be installed on sync, and CRDs are excluded from the diff by passing --skip-crds to helm-diff. By default, CRDs are installed if not already present",
+				},
+				cli.BoolFlag{
+					Name:  "include-crds",
+					Usage: "include CRDs in the diff by passing --include-crds to helm-diff",
 				},
 				cli.BoolTFlag{
 					Name:  "skip-needs",
@@ -525,6 +930,14 @@ func main() {
 					Name:  "suppress",
 					Usage: "suppress specified Kubernetes objects in the diff output. Can be provided multiple times. For example: --suppress KeycloakClient --suppress VaultSecret",
 				},
+				cli.StringSliceFlag{
+					Name:  "suppress-output-line-regex",
+					Usage: "a regex to suppress diff output lines that match it. Can be provided multiple times. For example: --suppress-output-line-regex \"^# Source:\"",
+				},
+				cli.StringSliceFlag{
+					Name:  "suppress-release",
+					Usage: "suppress the whole diff output of the release with the ID. The release is still counted as changed. Can be provided multiple times. For example: --suppress-release default/kube-system/noisy",
+				},
 				cli.BoolFlag{
 					Name:  "suppress-secrets",
 					Usage: "suppress secrets in the diff output. highly recommended to specify on CI/CD use-cases",
@@ -541,6 +954,10 @@ func main() {
 					Name:  "skip-deps",
 					Usage: `skip running "helm repo update" and "helm dependency build"`,
 				},
+				cli.BoolFlag{
+					Name:  "skip-repos",
+					Usage: `skip running "helm repo add" and "helm repo update", while still running "helm dependency build" for local charts`,
+				},
 				cli.BoolFlag{
 					Name:  "wait",
 					Usage: `Override helmDefaults.wait setting "helm upgrade --install --wait"`,
@@ -549,6 +966,75 @@ func main() {
 					Name:  "wait-for-jobs",
 					Usage: `Override helmDefaults.waitForJobs setting "helm upgrade --install --wait-for-jobs"`,
 				},
+				cli.BoolFlag{
+					Name:  "atomic",
+					Usage: `Force "helm upgrade --install --atomic" on all the releases, overriding releases[].atomic and helmDefaults.atomic`,
+				},
+				cli.BoolFlag{
+					Name:  "cleanup-on-fail",
+					Usage: `Force "helm upgrade --install --cleanup-on-fail" on all the releases, overriding releases[].cleanupOnFail and helmDefaults.cleanupOnFail`,
+				},
+				cli.BoolFlag{
+					Name:  "no-create-namespace",
+					Usage: `Do not pass "--create-namespace" to "helm upgrade --install" for any release, overriding releases[].createNamespace and helmDefaults.createNamespace. Useful when namespaces are managed by something other than helm`,
+				},
+				cli.IntFlag{
+					Name:  "wait-retries",
+					Value: 0,
+					Usage: `the number of times "helm upgrade --install --wait" is run again when it timed out waiting for the resources, overriding releases[].waitRetries and helmDefaults.waitRetries`,
+				},
+				cli.IntFlag{
+					Name:  "history-max",
+					Usage: `limit the maximum number of revisions saved per release, overriding releases[].historyMax and helmDefaults.historyMax. Use 0 for no limit`,
+				},
+				cli.BoolFlag{
+					Name:  "post-sync-status",
+					Usage: `run "helm status" on each release after it is successfully upgraded, and show its status in the summary. Releases not reported as deployed are listed separately. Requires Helm 3`,
+				},
+				cli.StringFlag{
+					Name:  "record-reason, reason",
+					Usage: `record the reason of the change in the release revisions created by "helm upgrade", passed as --description so that it's shown in "helm history". For example: --record-reason "JIRA-123: bump image"`,
+				},
+				cli.BoolFlag{
+					Name:  "use-lock",
+					Usage: `use the chart versions locked by "helmfile lock" instead of resolving the version constraints of releases`,
+				},
+				cli.StringFlag{
+					Name:  "kube-version",
+					Usage: `override the kubeVersion of releases, which is passed to "helm template" as --kube-version to set Capabilities.KubeVersion`,
+				},
+				cli.StringSliceFlag{
+					Name:  "api-versions",
+					Usage: `override the apiVersions of releases, which are passed to "helm template" as --api-versions to set Capabilities.APIVersions. Can be specified multiple times`,
+				},
+				cli.BoolFlag{
+					Name:  "preflight",
+					Usage: "verify that the kube contexts of all the releases exist in the kubeconfig before running any helm command",
+				},
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "apply the changes to the resources of helmDefaults.guardedKinds and releases[].guardedKinds. Without it, apply fails when the diff contains such changes",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "diff the releases and show the releases that would be deleted and upgraded, in the order they would be processed, without changing anything in the cluster. Combine with --detailed-exitcode to exit with 2 when there are changes",
+				},
+				cli.BoolFlag{
+					Name:  "purge-orphans",
+					Usage: "delete the releases installed in the namespaces of the helmfile but not defined in it. Requires --purge-orphans-namespace",
+				},
+				cli.StringSliceFlag{
+					Name:  "purge-orphans-namespace",
+					Usage: "namespace to delete orphan releases from with --purge-orphans. Can be specified multiple times",
+				},
+				cli.BoolFlag{
+					Name:  "verbose-summary",
+					Usage: "show whether helm waited for each upgraded release and how long it took in the summary. Enabled by --timings too",
+				},
+				cli.StringFlag{
+					Name:  "junit-report",
+					Usage: "write the result of applying each release to the file as a JUnit XML report, for CI dashboards",
+				},
 			},
 			Action: action(func(a *app.App, c configImpl) error {
 				return a.Apply(c)
@@ -566,7 +1052,17 @@ func main() {
 				cli.StringFlag{
 					Name:  "args",
 					Value: "",
-					Usage: "pass args to helm exec",
+					Usage: argsUsage,
+				},
+				cli.StringFlag{
+					Name:  "extra-args",
+					Value: "",
+					Usage: extraArgsUsage,
+				},
+				cli.StringFlag{
+					Name:  "output",
+					Value: "",
+					Usage: "output releases status format. Supported: json",
 				},
 			},
 			Action: action(func(a *app.App, c configImpl) error {
@@ -585,7 +1081,12 @@ func main() {
 				cli.StringFlag{
 					Name:  "args",
 					Value: "",
-					Usage: "pass args to helm exec",
+					Usage: argsUsage,
+				},
+				cli.StringFlag{
+					Name:  "extra-args",
+					Value: "",
+					Usage: extraArgsUsage,
 				},
 				cli.BoolFlag{
 					Name:  "purge",
@@ -612,7 +1113,12 @@ func main() {
 				cli.StringFlag{
 					Name:  "args",
 					Value: "",
-					Usage: "pass args to helm exec",
+					Usage: argsUsage,
+				},
+				cli.StringFlag{
+					Name:  "extra-args",
+					Value: "",
+					Usage: extraArgsUsage,
 				},
 				cli.BoolFlag{
 					Name:  "skip-deps",
@@ -635,10 +1141,23 @@ func main() {
 					Name:  "logs",
 					Usage: "Dump the logs from test pods (this runs after all tests are complete, but before any cleanup)",
 				},
+				cli.StringFlag{
+					Name:  "filter",
+					Usage: `run only the test with the name in each release, passed to helm as "--filter name=<NAME>". Requires helm 3.6.0 or greater`,
+				},
+				cli.BoolFlag{
+					Name:  "parallel",
+					Usage: "run the tests of each release in parallel. Supported only by helm 2",
+				},
 				cli.StringFlag{
 					Name:  "args",
 					Value: "",
-					Usage: "pass additional args to helm exec",
+					Usage: argsUsage,
+				},
+				cli.StringFlag{
+					Name:  "extra-args",
+					Value: "",
+					Usage: extraArgsUsage,
 				},
 				cli.IntFlag{
 					Name:  "timeout",
@@ -663,10 +1182,19 @@ func main() {
 			Name:  "build",
 			Usage: "output compiled helmfile state(s) as YAML",
 			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output",
+					Value: "yaml",
+					Usage: "output format of the compiled states, one of \"yaml\", \"json\", and \"table\". \"json\" prints the array of the states, and \"table\" prints the summary of the releases",
+				},
 				cli.BoolFlag{
 					Name:  "embed-values",
 					Usage: "Read all the values files for every release and embed into the output helmfile.yaml",
 				},
+				cli.BoolFlag{
+					Name:  "embed-secrets-decrypted",
+					Usage: "Decrypt all the secrets files for every release and embed the decrypted values into the output helmfile.yaml. Requires --embed-values. DANGEROUS: the output contains secrets in plain text",
+				},
 			},
 			Action: action(func(a *app.App, c configImpl) error {
 				return a.PrintState(c)
@@ -679,7 +1207,11 @@ func main() {
 				cli.StringFlag{
 					Name:  "output",
 					Value: "",
-					Usage: "output releases list as a json string",
+					Usage: "output releases list as a json string with \"json\". \"wide\" adds the resolved chart version, the source of the namespace, and the helmfile path of each release, like \"wide\" or \"json,wide\"",
+				},
+				cli.BoolFlag{
+					Name:  "cluster-state",
+					Usage: "run \"helm list\" on each release and add the ACTUAL column showing its status in the cluster, like deployed, failed, or not-found, so that the drift from the INSTALLED column is visible",
 				},
 				cli.BoolFlag{
 					Name:  "keep-temp-dir",
@@ -692,7 +1224,7 @@ func main() {
 		},
 		{
 			Name:      "cache",
-			Usage:     "cache management",
+			Usage:     "cache management. Set HELMFILE_CACHE_HOME to relocate the cache directory",
 			ArgsUsage: "[command]",
 			Subcommands: []cli.Command{
 				{
@@ -704,13 +1236,19 @@ func main() {
 				},
 				{
 					Name:  "cleanup",
-					Usage: "clean up cache directory",
+					Usage: "clean up cache directory. Only the directories created by helmfile are removed from the directory relocated by HELMFILE_CACHE_HOME",
 					Action: action(func(a *app.App, c configImpl) error {
 						return a.CleanCacheDir(c)
 					}),
 				},
 			},
 		},
+		{
+			Name:      "completion",
+			Usage:     "print the shell completion script, which completes --selector with the labels of the releases. Run `source <(helmfile completion bash)` to enable it",
+			ArgsUsage: "bash|zsh",
+			Action:    printCompletion,
+		},
 		{
 			Name:      "version",
 			Usage:     "Show the version for Helmfile.",
@@ -732,7 +1270,9 @@ func main() {
 type configImpl struct {
 	c *cli.Context
 
-	set map[string]interface{}
+	set       map[string]interface{}
+	selectors []string
+	color     bool
 }
 
 func NewUrfaveCliConfigImpl(c *cli.Context) (configImpl, error) {
@@ -764,6 +1304,18 @@ func NewUrfaveCliConfigImpl(c *cli.Context) (configImpl, error) {
 		conf.set = set
 	}
 
+	selectors, err := app.LoadSelectors(c.GlobalStringSlice("selector"), c.GlobalString("selector-file"))
+	if err != nil {
+		return configImpl{}, err
+	}
+	conf.selectors = selectors
+
+	color, err := app.ResolveColor(c.GlobalString("color"), c.GlobalBool("no-color"), app.ColorTerminal)
+	if err != nil {
+		return configImpl{}, err
+	}
+	conf.color = color
+
 	return conf, nil
 }
 
@@ -771,6 +1323,14 @@ func (c configImpl) Set() []string {
 	return c.c.StringSlice("set")
 }
 
+func (c configImpl) SetString() []string {
+	return c.c.StringSlice("set-string")
+}
+
+func (c configImpl) SetFile() []string {
+	return c.c.StringSlice("set-file")
+}
+
 func (c configImpl) SkipRepos() bool {
 	return c.c.Bool("skip-repos")
 }
@@ -783,6 +1343,43 @@ func (c configImpl) WaitForJobs() bool {
 	return c.c.Bool("wait-for-jobs")
 }
 
+func (c configImpl) Atomic() bool {
+	return c.c.Bool("atomic")
+}
+
+func (c configImpl) WaitRetries() int {
+	return c.c.Int("wait-retries")
+}
+
+// HistoryMax returns nil unless --history-max is set, as 0 means no limit
+func (c configImpl) HistoryMax() *int {
+	if !c.c.IsSet("history-max") {
+		return nil
+	}
+	historyMax := c.c.Int("history-max")
+	return &historyMax
+}
+
+func (c configImpl) PostSyncStatus() bool {
+	return c.c.Bool("post-sync-status")
+}
+
+func (c configImpl) RecordReason() string {
+	return c.c.String("record-reason")
+}
+
+func (c configImpl) FailFast() bool {
+	return c.c.Bool("fail-fast") && !c.c.Bool("no-fail-fast")
+}
+
+func (c configImpl) CleanupOnFail() bool {
+	return c.c.Bool("cleanup-on-fail")
+}
+
+func (c configImpl) NoCreateNamespace() bool {
+	return c.c.Bool("no-create-namespace")
+}
+
 func (c configImpl) Values() []string {
 	return c.c.StringSlice("values")
 }
@@ -797,14 +1394,34 @@ func (c configImpl) Args() string {
 	return args
 }
 
+func (c configImpl) ExtraArgs() string {
+	return c.c.String("extra-args")
+}
+
 func (c configImpl) OutputDir() string {
 	return c.c.String("output-dir")
 }
 
+func (c configImpl) Untar() bool {
+	return c.c.Bool("untar")
+}
+
+func (c configImpl) VerifyDigest() string {
+	return c.c.String("verify-digest")
+}
+
+func (c configImpl) Keyring() string {
+	return c.c.String("keyring")
+}
+
 func (c configImpl) OutputDirTemplate() string {
 	return c.c.String("output-dir-template")
 }
 
+func (c configImpl) OutputFile() string {
+	return c.c.String("output-file")
+}
+
 func (c configImpl) OutputFileTemplate() string {
 	return c.c.String("output-file-template")
 }
@@ -813,6 +1430,14 @@ func (c configImpl) Validate() bool {
 	return c.c.Bool("validate")
 }
 
+func (c configImpl) ServerSideDiff() bool {
+	return c.c.Bool("validate-dry-run-server")
+}
+
+func (c configImpl) ValidateValues() bool {
+	return c.c.Bool("validate-values")
+}
+
 func (c configImpl) Concurrency() int {
 	return c.c.Int("concurrency")
 }
@@ -837,6 +1462,58 @@ func (c configImpl) IncludeTransitiveNeeds() bool {
 	return c.c.Bool("include-transitive-needs")
 }
 
+func (c configImpl) UseLock() bool {
+	return c.c.Bool("use-lock")
+}
+
+func (c configImpl) CapabilitiesFile() string {
+	return c.c.String("capabilities-file")
+}
+
+func (c configImpl) KubeVersion() string {
+	return c.c.String("kube-version")
+}
+
+func (c configImpl) ApiVersions() []string {
+	return c.c.StringSlice("api-versions")
+}
+
+func (c configImpl) Force() bool {
+	return c.c.Bool("force")
+}
+
+func (c configImpl) Preflight() bool {
+	return c.c.Bool("preflight")
+}
+
+func (c configImpl) VerboseSummary() bool {
+	return c.c.Bool("verbose-summary")
+}
+
+func (c configImpl) JUnitReport() string {
+	return c.c.String("junit-report")
+}
+
+func (c configImpl) DryRun() bool {
+	return c.c.Bool("dry-run")
+}
+
+func (c configImpl) PurgeOrphans() bool {
+	return c.c.Bool("purge-orphans")
+}
+
+func (c configImpl) PurgeOrphansNamespaces() []string {
+	return c.c.StringSlice("purge-orphans-namespace")
+}
+
+func (c configImpl) DiffOnSync() bool {
+	return c.c.Bool("diff-on-sync")
+}
+
+func (c configImpl) FailOnDiffError() bool {
+	return c.c.Bool("fail-on-diff-error")
+}
+
 // DiffConfig
 
 func (c configImpl) SkipDeps() bool {
@@ -859,6 +1536,14 @@ func (c configImpl) Suppress() []string {
 	return c.c.StringSlice("suppress")
 }
 
+func (c configImpl) SuppressOutputLineRegex() []string {
+	return c.c.StringSlice("suppress-output-line-regex")
+}
+
+func (c configImpl) SuppressRelease() []string {
+	return c.c.StringSlice("suppress-release")
+}
+
 func (c configImpl) SuppressSecrets() bool {
 	return c.c.Bool("suppress-secrets")
 }
@@ -871,6 +1556,18 @@ func (c configImpl) SuppressDiff() bool {
 	return c.c.Bool("suppress-diff")
 }
 
+func (c configImpl) ValuesOnly() bool {
+	return c.c.Bool("values-only")
+}
+
+func (c configImpl) OutputSummary() string {
+	return c.c.String("output-summary")
+}
+
+func (c configImpl) ExitCodeOnError() int {
+	return c.c.Int("exit-code-on-error")
+}
+
 // DeleteConfig
 
 func (c configImpl) Purge() bool {
@@ -887,6 +1584,14 @@ func (c configImpl) Logs() bool {
 	return c.c.Bool("logs")
 }
 
+func (c configImpl) TestFilter() string {
+	return c.c.String("filter")
+}
+
+func (c configImpl) Parallel() bool {
+	return c.c.Bool("parallel")
+}
+
 func (c configImpl) Timeout() int {
 	if !c.c.IsSet("timeout") {
 		return state.EmptyTimeout
@@ -896,6 +1601,10 @@ func (c configImpl) Timeout() int {
 
 // ListConfig
 
+func (c configImpl) ClusterState() bool {
+	return c.c.Bool("cluster-state")
+}
+
 func (c configImpl) Output() string {
 	return c.c.String("output")
 }
@@ -922,12 +1631,44 @@ func (c configImpl) Chart() string {
 	return c.c.GlobalString("chart")
 }
 
+func (c configImpl) ChartOverrides() []string {
+	return c.c.GlobalStringSlice("chart-override")
+}
+
+func (c configImpl) GlobalNeeds() bool {
+	return c.c.GlobalBool("global-needs")
+}
+
+func (c configImpl) DumpDebugBundle() string {
+	return c.c.GlobalString("dump-debug-bundle")
+}
+
+func (c configImpl) DebugBundleShowSecrets() bool {
+	return c.c.GlobalBool("debug-bundle-show-secrets")
+}
+
 func (c configImpl) FileOrDir() string {
 	return c.c.GlobalString("file")
 }
 
 func (c configImpl) Selectors() []string {
-	return c.c.GlobalStringSlice("selector")
+	return c.selectors
+}
+
+func (c configImpl) ExcludeSelectors() []string {
+	return c.c.GlobalStringSlice("exclude-selector")
+}
+
+func (c configImpl) MergeValuesStrategy() string {
+	return c.c.GlobalString("merge-values-strategy")
+}
+
+func (c configImpl) ChangedSince() string {
+	return c.c.GlobalString("changed-since")
+}
+
+func (c configImpl) ConcurrencyPerContext() int {
+	return c.c.GlobalInt("concurrency-per-context")
 }
 
 func (c configImpl) StateValuesSet() map[string]interface{} {
@@ -938,12 +1679,32 @@ func (c configImpl) StateValuesFiles() []string {
 	return c.c.GlobalStringSlice("state-values-file")
 }
 
+func (c configImpl) EnableExecValues() bool {
+	return c.c.GlobalBool("enable-exec-values")
+}
+
+func (c configImpl) NoHooks() bool {
+	return c.c.GlobalBool("no-hooks")
+}
+
+func (c configImpl) Timings() bool {
+	return c.c.GlobalBool("timings")
+}
+
+func (c configImpl) TimingsOutput() string {
+	return c.c.GlobalString("timings-output")
+}
+
 func (c configImpl) Interactive() bool {
 	return c.c.GlobalBool("interactive")
 }
 
 func (c configImpl) NoColor() bool {
-	return c.c.GlobalBool("no-color")
+	return !c.color
+}
+
+func (c configImpl) Color() bool {
+	return c.color
 }
 
 func (c configImpl) Context() int {
@@ -970,6 +1731,10 @@ func (c configImpl) EmbedValues() bool {
 	return c.c.Bool("embed-values")
 }
 
+func (c configImpl) EmbedSecretsDecrypted() bool {
+	return c.c.Bool("embed-secrets-decrypted")
+}
+
 func (c configImpl) IncludeCRDs() bool {
 	return c.c.Bool("include-crds")
 }
@@ -982,6 +1747,15 @@ func (c configImpl) Logger() *zap.SugaredLogger {
 	return c.c.App.Metadata["logger"].(*zap.SugaredLogger)
 }
 
+func (c configImpl) Quiet() bool {
+	return c.c.GlobalBool("quiet") && !c.c.GlobalBool("debug")
+}
+
+func (c configImpl) SummaryLogger() *zap.SugaredLogger {
+	l, _ := c.c.App.Metadata["summaryLogger"].(*zap.SugaredLogger)
+	return l
+}
+
 func (c configImpl) Env() string {
 	env := c.c.GlobalString("environment")
 	if env == "" {
@@ -1002,7 +1776,17 @@ func action(do func(*app.App, configImpl) error) func(*cli.Context) error {
 
 		a := app.New(conf)
 
-		if err := do(a, conf); err != nil {
+		err = do(a, conf)
+
+		if timingsErr := a.ReportTimings(os.Stderr); timingsErr != nil {
+			a.Logger.Warnf("unable to report timings: %v", timingsErr)
+		}
+
+		if bundleErr := a.CloseDebugBundle(err); bundleErr != nil {
+			a.Logger.Warnf("unable to write the debug bundle: %v", bundleErr)
+		}
+
+		if err != nil {
 			return toCliError(implCtx, err)
 		}
 
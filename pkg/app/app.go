@@ -2,7 +2,9 @@ package app
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -21,6 +23,7 @@ import (
 	"github.com/roboll/helmfile/pkg/state"
 	"github.com/variantdev/vals"
 	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
 )
 
 type App struct {
@@ -35,6 +38,34 @@ type App struct {
 	Args        string
 	ValuesFiles []string
 	Set         map[string]interface{}
+	NoHooks     bool
+	// EnableExecValues allows the `exec://` values entries of releases to run commands, which is disabled by default for security
+	EnableExecValues bool
+	// ChartOverrides are the values of --chart-override in the form of CHART=PATH
+	ChartOverrides []string
+	// GlobalNeeds makes `needs` resolved across all the state files, by ordering the releases of all the state files by their needs
+	GlobalNeeds bool
+	// ExcludeSelectors filter out the releases matching any of them from the ones matching Selectors, in all the state files
+	ExcludeSelectors []string
+	// ConcurrencyPerContext limits the number of the releases processed concurrently for each kube context, in all the state files
+	ConcurrencyPerContext int
+	// Quiet suppresses the informational messages like the affected releases and the groups of releases being processed,
+	// leaving only errors and the final summary
+	Quiet bool
+	// SummaryLogger, when set, is used instead of Logger to show the final summary when Quiet is set,
+	// so that the summary is shown even though Logger discards informational logs
+	SummaryLogger *zap.SugaredLogger
+	// ChangedSince is the git ref to select only the releases whose charts or values files have changed since, along with their needs
+	ChangedSince string
+	// MergeValuesStrategy overrides the strategy to merge the values files of releases with, in all the state files
+	MergeValuesStrategy string
+	// Color colors helmfile's own output like the summary of the affected releases
+	Color bool
+
+	// Timings records the time spent in each phase of the run, and is nil unless --timings is enabled
+	Timings *state.Timings
+	// TimingsOutput is the path to the file the timings are written to as JSON
+	TimingsOutput string
 
 	FileOrDir string
 
@@ -49,12 +80,42 @@ type App struct {
 	getwd func() (string, error)
 	chdir func(string) error
 
+	// gitBranch returns the current git branch, which is the environment name when Env is `@branch`
+	gitBranch func() (string, error)
+	// envSource is where Env was read from when it was given as `@branch` or `@<file>`, and empty otherwise
+	envSource string
+	// envDefined is set to true once a state file is loaded for Env, which means Env is defined in the state file
+	envDefined bool
+
+	// gitChangedFiles returns the absolute paths to the files changed since the git ref given as ChangedSince
+	gitChangedFiles func(string) ([]string, error)
+	// changedFiles is the set of the absolute paths returned by gitChangedFiles, and is nil unless ChangedSince is set
+	changedFiles map[string]bool
+
+	// stdin and stdout are where `--interactive` reads the answers and writes the prompts
+	stdin      io.Reader
+	stdout     io.Writer
+	isTerminal func() bool
+
 	remote *remote.Remote
 
+	// chartOverrides are ChartOverrides parsed, with the paths made absolute before changing the working directory
+	chartOverrides []state.ChartOverride
+
+	// debugBundle collects the debug bundle written on failure when --dump-debug-bundle is set, and is nil otherwise
+	debugBundle *debugBundle
+
+	// secretValues collects the decrypted values of the environment secrets in all the state files, to mask them in the debug logs
+	secretValues *state.SecretValues
+
 	valsRuntime vals.Evaluator
 
 	helms      map[helmKey]helmexec.Interface
 	helmsMutex sync.Mutex
+
+	// states caches the loaded state files, so that a sub-helmfile visited more than once is loaded once
+	states      map[stateCacheKey]*state.HelmState
+	statesMutex sync.Mutex
 }
 
 type HelmRelease struct {
@@ -65,21 +126,48 @@ type HelmRelease struct {
 	Labels    string `json:"labels"`
 	Chart     string `json:"chart"`
 	Version   string `json:"version"`
+	// ID is the release ID after applying the overrides, which can be referenced from `needs` of another release
+	ID string `json:"id"`
+
+	// The below fields are populated only with `helmfile list --output wide`
+
+	ResolvedVersion string `json:"resolvedVersion,omitempty"`
+	// NamespaceSource is where the namespace came from, either `release`, `override`, or `default`
+	NamespaceSource string `json:"namespaceSource,omitempty"`
+	Helmfile        string `json:"helmfile,omitempty"`
+
+	// Actual is the status of the release in the cluster, like `deployed` or `not-found`,
+	// populated only with `helmfile list --cluster-state`
+	Actual string `json:"actual,omitempty"`
 }
 
 func New(conf ConfigProvider) *App {
 	return Init(&App{
-		OverrideKubeContext: conf.KubeContext(),
-		OverrideHelmBinary:  conf.HelmBinary(),
-		Logger:              conf.Logger(),
-		Env:                 conf.Env(),
-		Namespace:           conf.Namespace(),
-		Chart:               conf.Chart(),
-		Selectors:           conf.Selectors(),
-		Args:                conf.Args(),
-		FileOrDir:           conf.FileOrDir(),
-		ValuesFiles:         conf.StateValuesFiles(),
-		Set:                 conf.StateValuesSet(),
+		OverrideKubeContext:   conf.KubeContext(),
+		OverrideHelmBinary:    conf.HelmBinary(),
+		Logger:                conf.Logger(),
+		Env:                   conf.Env(),
+		Namespace:             conf.Namespace(),
+		Chart:                 conf.Chart(),
+		Selectors:             conf.Selectors(),
+		ExcludeSelectors:      conf.ExcludeSelectors(),
+		ConcurrencyPerContext: conf.ConcurrencyPerContext(),
+		Quiet:                 conf.Quiet(),
+		SummaryLogger:         conf.SummaryLogger(),
+		ChangedSince:          conf.ChangedSince(),
+		MergeValuesStrategy:   conf.MergeValuesStrategy(),
+		Args:                  conf.Args(),
+		FileOrDir:             conf.FileOrDir(),
+		ValuesFiles:           conf.StateValuesFiles(),
+		Set:                   conf.StateValuesSet(),
+		NoHooks:               conf.NoHooks(),
+		EnableExecValues:      conf.EnableExecValues(),
+		Color:                 conf.Color(),
+		ChartOverrides:        conf.ChartOverrides(),
+		GlobalNeeds:           conf.GlobalNeeds(),
+		Timings:               newTimings(conf),
+		TimingsOutput:         conf.TimingsOutput(),
+		debugBundle:           newDebugBundleIfEnabled(conf),
 		//helmExecer: helmexec.New(conf.HelmBinary(), conf.Logger(), conf.KubeContext(), &helmexec.ShellRunner{
 		//	Logger: conf.Logger(),
 		//}),
@@ -93,9 +181,14 @@ func Init(app *App) *App {
 	app.abs = filepath.Abs
 	app.getwd = os.Getwd
 	app.chdir = os.Chdir
+	app.gitBranch = gitBranch
+	app.gitChangedFiles = gitChangedFiles
 	app.fileExistsAt = fileExistsAt
 	app.fileExists = fileExists
 	app.directoryExistsAt = directoryExistsAt
+	app.stdin = os.Stdin
+	app.stdout = os.Stdout
+	app.isTerminal = isTerminal
 
 	var err error
 	app.valsRuntime, err = plugins.ValsInstance()
@@ -106,7 +199,49 @@ func Init(app *App) *App {
 	return app
 }
 
+// infoLogger returns the logger for the informational messages like the affected releases and the groups of releases being processed,
+// which discards them when Quiet is set
+func (a *App) infoLogger() *zap.SugaredLogger {
+	if a.Quiet {
+		return zap.NewNop().Sugar()
+	}
+	return a.Logger
+}
+
+// summaryLogger returns the logger to show the final summary with, which is logger unless Quiet and SummaryLogger are set
+func (a *App) summaryLogger(logger *zap.SugaredLogger) *zap.SugaredLogger {
+	if a.Quiet && a.SummaryLogger != nil {
+		return a.SummaryLogger
+	}
+	return logger
+}
+
+func (a *App) parseChartOverrides() ([]state.ChartOverride, error) {
+	var overrides []state.ChartOverride
+
+	for _, s := range a.ChartOverrides {
+		o, err := state.ParseChartOverride(s)
+		if err != nil {
+			return nil, err
+		}
+
+		// The path is relative to the working directory, which is changed while loading helmfiles in other directories
+		o.Path, err = a.abs(o.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		overrides = append(overrides, *o)
+	}
+
+	return overrides, nil
+}
+
 func (a *App) Deps(c DepsConfigProvider) error {
+	if c.OutputFile() != "" {
+		return a.writeDeps(c)
+	}
+
 	return a.ForEachState(func(run *Run) (_ bool, errs []error) {
 		prepErr := run.withPreparedCharts("deps", state.ChartPrepareOptions{
 			SkipRepos:   c.SkipRepos(),
@@ -124,6 +259,48 @@ func (a *App) Deps(c DepsConfigProvider) error {
 	}, c.IncludeTransitiveNeeds(), SetFilter(true))
 }
 
+// writeDeps writes the resolved dependencies of each state file to the output file, keyed by the path to the state file,
+// without updating the lock files and the local charts.
+func (a *App) writeDeps(c DepsConfigProvider) error {
+	locks := map[string]*state.ChartLockedRequirements{}
+
+	err := a.ForEachState(func(run *Run) (_ bool, errs []error) {
+		prepErr := run.withPreparedCharts("deps", state.ChartPrepareOptions{
+			SkipRepos:   c.SkipRepos(),
+			SkipDeps:    true,
+			SkipResolve: true,
+		}, func() {
+			lock, err := run.LockDeps(c)
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			locks[run.state.FilePath] = lock
+		})
+
+		if prepErr != nil {
+			errs = append(errs, prepErr)
+		}
+
+		return
+	}, c.IncludeTransitiveNeeds(), SetFilter(true))
+
+	if err != nil {
+		return err
+	}
+
+	bs, err := yaml.Marshal(locks)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(c.OutputFile(), bs, 0644); err != nil {
+		return fmt.Errorf("writing the resolved dependencies to %s: %w", c.OutputFile(), err)
+	}
+
+	return nil
+}
+
 func (a *App) Repos(c ReposConfigProvider) error {
 	return a.ForEachState(func(run *Run) (_ bool, errs []error) {
 		reposErr := run.Repos(c)
@@ -136,6 +313,18 @@ func (a *App) Repos(c ReposConfigProvider) error {
 	}, c.IncludeTransitiveNeeds(), SetFilter(true))
 }
 
+func (a *App) Lock(c LockConfigProvider) error {
+	return a.ForEachState(func(run *Run) (_ bool, errs []error) {
+		lockErr := run.Lock(c)
+
+		if lockErr != nil {
+			errs = append(errs, lockErr)
+		}
+
+		return
+	}, c.IncludeTransitiveNeeds(), SetFilter(true))
+}
+
 func (a *App) DeprecatedSyncCharts(c DeprecatedChartsConfigProvider) error {
 	return a.ForEachState(func(run *Run) (_ bool, errs []error) {
 		err := run.withPreparedCharts("charts", state.ChartPrepareOptions{
@@ -153,12 +342,71 @@ func (a *App) DeprecatedSyncCharts(c DeprecatedChartsConfigProvider) error {
 	}, c.IncludeTransitiveNeeds(), SetFilter(true))
 }
 
+// DiffResult is the result of diffing releases, for Go programs that embed helmfile and
+// need the changes of each release without parsing the output of `helmfile diff`
+type DiffResult struct {
+	// Releases is the result of diffing each release, including the output of helm-diff
+	Releases []state.DiffSummaryRelease
+}
+
+// Changed returns true when any release has changes, or is being newly installed
+func (r *DiffResult) Changed() bool {
+	for _, rel := range r.Releases {
+		if rel.Changed() {
+			return true
+		}
+	}
+	return false
+}
+
+// Diff runs helm-diff on the releases and prints the diffs.
+// It writes the result to the file given to --output-summary when set.
 func (a *App) Diff(c DiffConfigProvider) error {
+	result, err := a.DiffWithResult(c)
+
+	if path := c.OutputSummary(); path != "" && result != nil {
+		summary := &state.DiffSummary{
+			ExitCode: exitCode(err),
+			Releases: result.Releases,
+		}
+
+		if writeErr := summary.WriteFile(path); writeErr != nil {
+			if err == nil {
+				return appError("", writeErr)
+			}
+			a.Logger.Warnf("%v", writeErr)
+		}
+	}
+
+	return err
+}
+
+// DiffWithResult runs helm-diff on the releases like Diff, and returns the result of each release along with the error.
+// The result is nil when the configuration is invalid.
+func (a *App) DiffWithResult(c DiffConfigProvider) (*DiffResult, error) {
+	if c.ExitCodeOnError() == 2 {
+		return nil, appError("", fmt.Errorf("--exit-code-on-error cannot be 2, which is reserved for --detailed-exitcode to indicate changes"))
+	}
+
+	if c.IncludeCRDs() && c.SkipCRDs() {
+		return nil, appError("", fmt.Errorf("--include-crds and --skip-crds are mutually exclusive"))
+	}
+
+	values, cleanup, err := a.readStdinValues(c.Values(), false)
+	if err != nil {
+		return nil, appError("", err)
+	}
+	defer cleanup()
+
+	c = diffConfigWithValues{DiffConfigProvider: c, values: values}
+
+	summary := &state.DiffSummary{}
+
 	var allDiffDetectedErrs []error
 
 	var affectedAny bool
 
-	err := a.ForEachState(func(run *Run) (bool, []error) {
+	err = a.ForEachState(func(run *Run) (bool, []error) {
 		var criticalErrs []error
 
 		var msg *string
@@ -169,17 +417,24 @@ func (a *App) Diff(c DiffConfigProvider) error {
 
 		includeCRDs := !c.SkipCRDs()
 
+		if c.Preflight() {
+			if err := a.preflightKubeContexts(run, c.SkipNeeds(), c.IncludeNeeds(), false); err != nil {
+				return false, []error{err}
+			}
+		}
+
 		prepErr := run.withPreparedCharts("diff", state.ChartPrepareOptions{
-			SkipRepos:   c.SkipDeps(),
-			SkipDeps:    c.SkipDeps(),
-			IncludeCRDs: &includeCRDs,
-			Validate:    c.Validate(),
+			SkipRepos:      c.SkipDeps() || c.SkipRepos(),
+			SkipDeps:       c.SkipDeps(),
+			IncludeCRDs:    &includeCRDs,
+			Validate:       c.Validate(),
+			ValidateValues: c.ValidateValues(),
 		}, func() {
-			msg, matched, affected, errs = a.diff(run, c)
+			msg, matched, affected, errs = a.diff(run, c, summary)
 		})
 
 		if msg != nil {
-			a.Logger.Info(*msg)
+			a.infoLogger().Info(*msg)
 		}
 
 		if prepErr != nil {
@@ -204,10 +459,19 @@ func (a *App) Diff(c DiffConfigProvider) error {
 		}
 
 		return matched, criticalErrs
-	}, false)
+	}, false, SetIncludeNeeds(c.IncludeNeeds()))
+
+	result := &DiffResult{Releases: summary.Releases}
 
 	if err != nil {
-		return err
+		// A failure wins over changes, even when some releases had changes and others failed to diff,
+		// so that a CI job can tell "a release failed to diff" apart from "there are changes".
+		if code := c.ExitCodeOnError(); code != 0 {
+			if _, ok := err.(*NoMatchingHelmfileError); !ok {
+				return result, &Error{Errors: []error{err}, code: &code}
+			}
+		}
+		return result, err
 	}
 
 	if c.DetailedExitcode() && (len(allDiffDetectedErrs) > 0 || affectedAny) {
@@ -219,13 +483,43 @@ func (a *App) Diff(c DiffConfigProvider) error {
 			msg:  "Identified at least one change",
 			code: &code,
 		}
-		return e
+		return result, e
 	}
 
-	return nil
+	return result, nil
 }
 
 func (a *App) Template(c TemplateConfigProvider) error {
+	if c.OutputFileTemplate() != "" && (c.OutputDir() != "" || c.OutputDirTemplate() != "") {
+		return appError("", fmt.Errorf("--output-file-template cannot be used with --output-dir or --output-dir-template"))
+	}
+
+	var capabilitySets []capabilitySet
+
+	if c.CapabilitiesFile() != "" {
+		if c.OutputDir() == "" {
+			return appError("", fmt.Errorf("--capabilities-file requires --output-dir"))
+		}
+
+		if c.KubeVersion() != "" || len(c.ApiVersions()) > 0 {
+			return appError("", fmt.Errorf("--capabilities-file cannot be used with --kube-version or --api-versions"))
+		}
+
+		var err error
+		capabilitySets, err = a.readCapabilitiesFile(c.CapabilitiesFile())
+		if err != nil {
+			return appError("", err)
+		}
+	}
+
+	values, cleanup, err := a.readStdinValues(c.Values(), c.SkipCleanup())
+	if err != nil {
+		return appError("", err)
+	}
+	defer cleanup()
+
+	c = templateConfigWithValues{TemplateConfigProvider: c, values: values}
+
 	return a.ForEachState(func(run *Run) (ok bool, errs []error) {
 		includeCRDs := c.IncludeCRDs()
 
@@ -233,13 +527,15 @@ func (a *App) Template(c TemplateConfigProvider) error {
 		// So, we set forceDownload=true for helm v2 only
 		prepErr := run.withPreparedCharts("template", state.ChartPrepareOptions{
 			ForceDownload: !run.helm.IsHelm3(),
-			SkipRepos:     c.SkipDeps(),
+			SkipRepos:     c.SkipDeps() || c.SkipRepos(),
 			SkipDeps:      c.SkipDeps(),
 			IncludeCRDs:   &includeCRDs,
 			SkipCleanup:   c.SkipCleanup(),
 			Validate:      c.Validate(),
+			KubeVersion:   c.KubeVersion(),
+			ApiVersions:   c.ApiVersions(),
 		}, func() {
-			ok, errs = a.template(run, c)
+			ok, errs = a.template(run, c, capabilitySets)
 		})
 
 		if prepErr != nil {
@@ -247,7 +543,7 @@ func (a *App) Template(c TemplateConfigProvider) error {
 		}
 
 		return
-	}, c.IncludeTransitiveNeeds())
+	}, c.IncludeTransitiveNeeds(), SetIncludeNeeds(c.IncludeNeeds()))
 }
 
 func (a *App) WriteValues(c WriteValuesConfigProvider) error {
@@ -336,12 +632,23 @@ func (a *App) Lint(c LintConfigProvider) error {
 }
 
 func (a *App) Fetch(c FetchConfigProvider) error {
-	return a.ForEachState(func(run *Run) (ok bool, errs []error) {
+	digests := &state.ChartDigests{}
+	if f := c.VerifyDigest(); f != "" {
+		var err error
+		digests, err = state.ReadChartDigests(f)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := a.ForEachState(func(run *Run) (ok bool, errs []error) {
 		prepErr := run.withPreparedCharts("pull", state.ChartPrepareOptions{
 			ForceDownload: true,
 			SkipRepos:     c.SkipDeps(),
 			SkipDeps:      c.SkipDeps(),
 			OutputDir:     c.OutputDir(),
+			Digests:       digests,
+			Untar:         c.Untar(),
 		}, func() {
 		})
 
@@ -351,19 +658,105 @@ func (a *App) Fetch(c FetchConfigProvider) error {
 
 		return
 	}, false, SetFilter(true))
+	if err != nil {
+		return err
+	}
+
+	if digests.Verifying() {
+		a.Logger.Infof("Verified the digests of %d chart(s) against %s", len(digests.Digests), c.VerifyDigest())
+		return nil
+	}
+
+	// Print the digests so that they can be recorded and given to --verify-digest later
+	out, err := digests.YAML()
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(out)
+
+	return nil
+}
+
+// Verify fetches the chart of each selected release along with its provenance file, and runs `helm verify` on it.
+// It reports the results of all the charts, and fails when any of them failed the verification.
+func (a *App) Verify(c VerifyConfigProvider) error {
+	var verifications []state.ChartVerification
+
+	err := a.ForEachState(func(run *Run) (ok bool, errs []error) {
+		prepErr := run.withPreparedCharts("verify", state.ChartPrepareOptions{
+			ForceDownload: true,
+			SkipRepos:     c.SkipDeps(),
+			SkipDeps:      c.SkipDeps(),
+			Digests:       &state.ChartDigests{},
+			Provenance:    true,
+		}, func() {
+			ok, errs = a.verify(run, c, &verifications)
+		})
+
+		if prepErr != nil {
+			errs = append(errs, prepErr)
+		}
+
+		return
+	}, false, SetFilter(true))
+
+	if err != nil {
+		return err
+	}
+
+	if err := FormatVerificationsAsTable(verifications); err != nil {
+		return err
+	}
+
+	var verifyErrs []error
+	for _, v := range verifications {
+		if v.Err != nil {
+			verifyErrs = append(verifyErrs, v.Err)
+		}
+	}
+
+	if len(verifyErrs) > 0 {
+		return &MultiError{Errors: verifyErrs}
+	}
+
+	return nil
 }
 
 func (a *App) Sync(c SyncConfigProvider) error {
+	values, cleanup, err := a.readStdinValues(c.Values(), false)
+	if err != nil {
+		return appError("", err)
+	}
+	defer cleanup()
+
+	c = syncConfigWithValues{SyncConfigProvider: c, values: values}
+
 	return a.ForEachState(func(run *Run) (ok bool, errs []error) {
+		if c.UseLock() {
+			if err := run.state.UseReleaseVersionLock(); err != nil {
+				return false, []error{err}
+			}
+		}
+
 		includeCRDs := !c.SkipCRDs()
 
+		if c.Preflight() {
+			if err := a.preflightKubeContexts(run, c.SkipNeeds(), c.IncludeNeeds(), c.IncludeTransitiveNeeds()); err != nil {
+				return false, []error{err}
+			}
+		}
+
 		prepErr := run.withPreparedCharts("sync", state.ChartPrepareOptions{
-			SkipRepos:              c.SkipDeps(),
+			SkipRepos:              c.SkipDeps() || c.SkipRepos(),
 			SkipDeps:               c.SkipDeps(),
 			Wait:                   c.Wait(),
 			WaitForJobs:            c.WaitForJobs(),
 			IncludeCRDs:            &includeCRDs,
 			IncludeTransitiveNeeds: c.IncludeTransitiveNeeds(),
+			KubeVersion:            c.KubeVersion(),
+			ApiVersions:            c.ApiVersions(),
+			ValidateValues:         c.ValidateValues(),
 		}, func() {
 			ok, errs = a.sync(run, c)
 		})
@@ -373,31 +766,84 @@ func (a *App) Sync(c SyncConfigProvider) error {
 		}
 
 		return
-	}, c.IncludeTransitiveNeeds())
+	}, c.IncludeTransitiveNeeds(), SetIncludeNeeds(c.IncludeNeeds()))
 }
 
-func (a *App) Apply(c ApplyConfigProvider) error {
+func (a *App) Apply(c ApplyConfigProvider) (err error) {
+	if c.IncludeCRDs() && c.SkipCRDs() {
+		return appError("", fmt.Errorf("--include-crds and --skip-crds are mutually exclusive"))
+	}
+
+	if c.PurgeOrphans() && len(c.PurgeOrphansNamespaces()) == 0 {
+		return appError("", fmt.Errorf("--purge-orphans requires --purge-orphans-namespace to specify the namespaces to delete releases from"))
+	}
+
+	values, cleanup, err := a.readStdinValues(c.Values(), c.RetainValuesFiles() || c.SkipCleanup())
+	if err != nil {
+		return appError("", err)
+	}
+	defer cleanup()
+
+	c = applyConfigWithValues{ApplyConfigProvider: c, values: values}
+
 	var any bool
 
 	mut := &sync.Mutex{}
 
 	var opts []LoadOption
 
-	opts = append(opts, SetRetainValuesFiles(c.RetainValuesFiles() || c.SkipCleanup()))
+	opts = append(opts, SetRetainValuesFiles(c.RetainValuesFiles() || c.SkipCleanup()), SetIncludeNeeds(c.IncludeNeeds()))
+
+	var orphans []orphanReleases
+
+	var report *junitReport
+	if path := c.JUnitReport(); path != "" {
+		report = &junitReport{}
+		defer func() {
+			err = a.writeJUnitReport(report, path, err)
+		}()
+	}
+
+	err = a.ForEachState(func(run *Run) (ok bool, errs []error) {
+		if c.UseLock() {
+			if err := run.state.UseReleaseVersionLock(); err != nil {
+				return false, []error{err}
+			}
+		}
+
+		if c.PurgeOrphans() {
+			// This needs to be done before apply, which narrows down the releases of the state to the selected ones
+			rs, err := run.state.DetectOrphanReleases(run.helm, c.PurgeOrphansNamespaces())
+			if err != nil {
+				return false, []error{err}
+			}
+
+			mut.Lock()
+			orphans = append(orphans, orphanReleases{run: run, defined: *run.state, releases: rs})
+			mut.Unlock()
+		}
 
-	err := a.ForEachState(func(run *Run) (ok bool, errs []error) {
 		includeCRDs := !c.SkipCRDs()
 
+		if c.Preflight() {
+			if err := a.preflightKubeContexts(run, c.SkipNeeds(), c.IncludeNeeds(), c.IncludeTransitiveNeeds()); err != nil {
+				return false, []error{err}
+			}
+		}
+
 		prepErr := run.withPreparedCharts("apply", state.ChartPrepareOptions{
-			SkipRepos:   c.SkipDeps(),
-			SkipDeps:    c.SkipDeps(),
-			Wait:        c.Wait(),
-			WaitForJobs: c.WaitForJobs(),
-			IncludeCRDs: &includeCRDs,
-			SkipCleanup: c.RetainValuesFiles() || c.SkipCleanup(),
-			Validate:    c.Validate(),
+			SkipRepos:      c.SkipDeps() || c.SkipRepos(),
+			SkipDeps:       c.SkipDeps(),
+			Wait:           c.Wait(),
+			WaitForJobs:    c.WaitForJobs(),
+			IncludeCRDs:    &includeCRDs,
+			SkipCleanup:    c.RetainValuesFiles() || c.SkipCleanup(),
+			Validate:       c.Validate(),
+			KubeVersion:    c.KubeVersion(),
+			ApiVersions:    c.ApiVersions(),
+			ValidateValues: c.ValidateValues(),
 		}, func() {
-			matched, updated, es := a.apply(run, c)
+			matched, updated, es := a.apply(run, c, report)
 
 			mut.Lock()
 			any = any || updated
@@ -417,6 +863,15 @@ func (a *App) Apply(c ApplyConfigProvider) error {
 		return err
 	}
 
+	if c.PurgeOrphans() {
+		purged, errs := a.purgeOrphans(orphans, c)
+		if len(errs) > 0 {
+			return appError("", &MultiError{Errors: errs})
+		}
+
+		any = any || purged
+	}
+
 	if c.DetailedExitcode() && any {
 		code := 2
 
@@ -427,12 +882,22 @@ func (a *App) Apply(c ApplyConfigProvider) error {
 }
 
 func (a *App) Status(c StatusesConfigProvider) error {
-	return a.ForEachState(func(run *Run) (ok bool, errs []error) {
+	var statuses *[]state.ReleaseStatus
+
+	switch c.Output() {
+	case "":
+	case "json":
+		statuses = &[]state.ReleaseStatus{}
+	default:
+		return fmt.Errorf("unsupported output format %q: it must be one of json", c.Output())
+	}
+
+	err := a.ForEachState(func(run *Run) (ok bool, errs []error) {
 		err := run.withPreparedCharts("status", state.ChartPrepareOptions{
 			SkipRepos: true,
 			SkipDeps:  true,
 		}, func() {
-			ok, errs = a.status(run, c)
+			ok, errs = a.status(run, c, statuses)
 		})
 
 		if err != nil {
@@ -441,6 +906,16 @@ func (a *App) Status(c StatusesConfigProvider) error {
 
 		return
 	}, false, SetFilter(true))
+
+	if err != nil {
+		return err
+	}
+
+	if statuses != nil {
+		return FormatStatusesAsJson(*statuses)
+	}
+
+	return nil
 }
 
 func (a *App) Delete(c DeleteConfigProvider) error {
@@ -501,11 +976,30 @@ func (a *App) Test(c TestConfigProvider) error {
 }
 
 func (a *App) PrintState(c StateConfigProvider) error {
-	return a.ForEachState(func(run *Run) (_ bool, errs []error) {
+	if c.EmbedSecretsDecrypted() && !c.EmbedValues() {
+		return appError("", fmt.Errorf("--embed-secrets-decrypted requires --embed-values"))
+	}
+
+	output := c.Output()
+
+	switch output {
+	case "", "yaml", "json", "table":
+	default:
+		return appError("", fmt.Errorf("unsupported output format %q: it must be one of \"yaml\", \"json\" or \"table\"", output))
+	}
+
+	var (
+		jsonStates []json.RawMessage
+		rows       []string
+	)
+
+	err := a.ForEachState(func(run *Run) (_ bool, errs []error) {
 		err := run.withPreparedCharts("build", state.ChartPrepareOptions{
 			SkipRepos: true,
 			SkipDeps:  true,
 		}, func() {
+			var header string
+
 			if c.EmbedValues() {
 				for i := range run.state.Releases {
 					r := run.state.Releases[i]
@@ -516,25 +1010,59 @@ func (a *App) PrintState(c StateConfigProvider) error {
 						return
 					}
 
-					run.state.Releases[i].Values = values
+					if c.EmbedSecretsDecrypted() {
+						// Decrypted secrets are appended to values so that they take precedence over values, as secrets do
+						secrets, err := run.state.LoadDecryptedSecretsForEmbedding(run.helm, &r)
+						if err != nil {
+							errs = []error{err}
+							return
+						}
 
-					secrets, err := run.state.LoadYAMLForEmbedding(&r, r.Secrets, r.MissingFileHandler, r.ValuesPathPrefix)
-					if err != nil {
-						errs = []error{err}
-						return
+						run.state.Releases[i].Values = append(values, secrets...)
+						run.state.Releases[i].Secrets = nil
+					} else {
+						// Secrets are embedded as encrypted, never decrypted
+						secrets, err := run.state.LoadYAMLForEmbedding(&r, r.Secrets, r.MissingFileHandler, r.ValuesPathPrefix)
+						if err != nil {
+							errs = []error{err}
+							return
+						}
+
+						run.state.Releases[i].Values = values
+						run.state.Releases[i].Secrets = secrets
 					}
+				}
 
-					run.state.Releases[i].Secrets = secrets
+				if c.EmbedSecretsDecrypted() {
+					header = "#  Secrets: decrypted and embedded into values in plain text. Do not commit or share this output\n"
+				} else {
+					header = "#  Secrets: embedded as encrypted. Vals expressions like ref+vault:// are embedded verbatim without being resolved\n"
 				}
 			}
 
-			stateYaml, err := run.state.ToYaml()
-			if err != nil {
-				errs = []error{err}
-				return
-			}
+			switch output {
+			case "json":
+				stateJson, err := run.state.ToJson()
+				if err != nil {
+					errs = []error{err}
+					return
+				}
+
+				jsonStates = append(jsonStates, stateJson)
+			case "table":
+				for _, r := range run.state.Releases {
+					installed := r.Installed == nil || *r.Installed
+					rows = append(rows, fmt.Sprintf("%s\t%s\t%s\t%s\t%t\t%s", r.Name, r.Namespace, r.Chart, r.Version, installed, run.state.FilePath))
+				}
+			default:
+				stateYaml, err := run.state.ToYaml()
+				if err != nil {
+					errs = []error{err}
+					return
+				}
 
-			fmt.Printf("---\n#  Source: %s\n\n%+v", run.state.FilePath, stateYaml)
+				fmt.Printf("---\n#  Source: %s\n%s\n%+v", run.state.FilePath, header, stateYaml)
+			}
 
 			errs = []error{}
 		})
@@ -545,16 +1073,74 @@ func (a *App) PrintState(c StateConfigProvider) error {
 
 		return
 	}, false, SetFilter(true))
+
+	if err != nil {
+		return err
+	}
+
+	switch output {
+	case "json":
+		if jsonStates == nil {
+			jsonStates = []json.RawMessage{}
+		}
+
+		bs, err := json.MarshalIndent(jsonStates, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(bs))
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 1, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tNAMESPACE\tCHART\tVERSION\tINSTALLED\tHELMFILE")
+		for _, row := range rows {
+			fmt.Fprintln(w, row)
+		}
+
+		return w.Flush()
+	}
+
+	return nil
 }
 
 func (a *App) ListReleases(c ListConfigProvider) error {
 	var releases []*HelmRelease
 
+	var jsonOutput, wide bool
+	for _, o := range strings.Split(c.Output(), ",") {
+		switch strings.TrimSpace(o) {
+		case "json":
+			jsonOutput = true
+		case "wide":
+			wide = true
+		}
+	}
+
 	err := a.ForEachState(func(run *Run) (_ bool, errs []error) {
+		var versions, statuses map[string]string
+
 		err := run.withPreparedCharts("list", state.ChartPrepareOptions{
-			SkipRepos: true,
+			// Repositories are needed to resolve chart versions with `helm search repo`
+			SkipRepos: !wide,
 			SkipDeps:  true,
 		}, func() {
+			if wide {
+				var err error
+				versions, err = run.state.ResolveReleaseVersions(run.helm)
+				if err != nil {
+					errs = append(errs, err)
+					return
+				}
+			}
+
+			if c.ClusterState() {
+				var es []error
+				statuses, es = run.state.GetActualReleaseStatuses(run.helm, 0)
+				if len(es) > 0 {
+					errs = append(errs, es...)
+					return
+				}
+			}
 
 			//var releases m
 			for _, r := range run.state.Releases {
@@ -563,7 +1149,9 @@ func (a *App) ListReleases(c ListConfigProvider) error {
 					r.Labels = map[string]string{}
 				}
 				for k, v := range run.state.CommonLabels {
-					r.Labels[k] = v
+					if _, ok := r.Labels[k]; !ok {
+						r.Labels[k] = v
+					}
 				}
 
 				var keys []string
@@ -584,7 +1172,12 @@ func (a *App) ListReleases(c ListConfigProvider) error {
 				}
 
 				installed := r.Installed == nil || *r.Installed
-				releases = append(releases, &HelmRelease{
+
+				// The ID needs to be computed in the same way as the dependency resolver does for `needs`
+				overridden := r
+				run.state.ApplyOverrides(&overridden)
+
+				release := &HelmRelease{
 					Name:      r.Name,
 					Namespace: r.Namespace,
 					Installed: installed,
@@ -592,7 +1185,29 @@ func (a *App) ListReleases(c ListConfigProvider) error {
 					Labels:    labels,
 					Chart:     r.Chart,
 					Version:   r.Version,
-				})
+					ID:        state.ReleaseToID(&overridden),
+				}
+
+				if statuses != nil {
+					release.Actual = statuses[release.ID]
+				}
+
+				if wide {
+					release.ResolvedVersion = versions[state.ReleaseToID(&r)]
+					release.Helmfile = run.state.FilePath
+
+					switch {
+					case run.state.OverrideNamespace != "":
+						release.Namespace = run.state.OverrideNamespace
+						release.NamespaceSource = "override"
+					case r.Namespace != "":
+						release.NamespaceSource = "release"
+					default:
+						release.NamespaceSource = "default"
+					}
+				}
+
+				releases = append(releases, release)
 			}
 		})
 
@@ -607,10 +1222,12 @@ func (a *App) ListReleases(c ListConfigProvider) error {
 		return err
 	}
 
-	if c.Output() == "json" {
+	if jsonOutput {
 		err = FormatAsJson(releases)
+	} else if wide {
+		err = FormatAsWideTable(releases, c.ClusterState())
 	} else {
-		err = FormatAsTable(releases)
+		err = FormatAsTable(releases, c.ClusterState())
 	}
 
 	return err
@@ -692,6 +1309,20 @@ func (a *App) loadDesiredStateFromYaml(file string, opts ...LoadOpts) (*state.He
 		op = opts[0]
 	}
 
+	key, err := a.stateCacheKey(file, op)
+	if err != nil {
+		return nil, err
+	}
+
+	if st, ok := a.cachedState(key); ok {
+		a.Logger.Debugf("using the cached state for %s", key.path)
+		return st, nil
+	}
+
+	if a.secretValues == nil {
+		a.secretValues = state.NewSecretValues()
+	}
+
 	ld := &desiredStateLoader{
 		readFile:          a.readFile,
 		deleteFile:        a.deleteFile,
@@ -700,6 +1331,11 @@ func (a *App) loadDesiredStateFromYaml(file string, opts ...LoadOpts) (*state.He
 		env:               a.Env,
 		namespace:         a.Namespace,
 		chart:             a.Chart,
+		noHooks:           a.NoHooks,
+		enableExecValues:  a.EnableExecValues,
+		timings:           a.Timings,
+		chartOverrides:    a.chartOverrides,
+		debugFiles:        a.debugFiles(),
 		logger:            a.Logger,
 		abs:               a.abs,
 		remote:            a.remote,
@@ -709,9 +1345,17 @@ func (a *App) loadDesiredStateFromYaml(file string, opts ...LoadOpts) (*state.He
 		glob:                a.glob,
 		getHelm:             a.getHelm,
 		valsRuntime:         a.valsRuntime,
+		secretValues:        a.secretValues,
 	}
 
-	return ld.Load(file, op)
+	st, err := ld.Load(file, op)
+	if err != nil {
+		return nil, err
+	}
+
+	a.cacheState(key, st)
+
+	return st, nil
 }
 
 type helmKey struct {
@@ -745,9 +1389,13 @@ func (a *App) getHelm(st *state.HelmState) helmexec.Interface {
 	key := createHelmKey(bin, kubectx)
 
 	if _, ok := a.helms[key]; !ok {
-		a.helms[key] = helmexec.New(bin, a.Logger, kubectx, &helmexec.ShellRunner{
+		var runner helmexec.Runner = &helmexec.ShellRunner{
 			Logger: a.Logger,
-		})
+		}
+		if a.debugBundle != nil {
+			runner = &helmexec.RecordingRunner{Runner: runner, Recorder: a.debugBundle.commands}
+		}
+		a.helms[key] = helmexec.New(bin, a.Logger, kubectx, runner)
 	}
 
 	return a.helms[key]
@@ -797,7 +1445,13 @@ func (a *App) visitStates(fileOrDir string, defOpts LoadOpts, converge func(*sta
 				return ctx.wrapErrs(err)
 			}
 		}
+		a.envDefined = true
 		st.Selectors = opts.Selectors
+		st.ExcludeSelectors = a.ExcludeSelectors
+		st.ConcurrencyPerContext = a.ConcurrencyPerContext
+		if a.MergeValuesStrategy != "" {
+			st.MergeValuesStrategy = a.MergeValuesStrategy
+		}
 
 		visitSubHelmfiles := func() error {
 			if len(st.Helmfiles) > 0 {
@@ -844,6 +1498,14 @@ func (a *App) visitStates(fileOrDir string, defOpts LoadOpts, converge func(*sta
 			return appError(fmt.Sprintf("failed executing release templates in \"%s\"", f), tmplErr)
 		}
 
+		if a.changedFiles != nil {
+			if err := a.selectChangedReleases(templated); err != nil {
+				return appError(fmt.Sprintf("failed selecting the releases changed since %s in \"%s\"", a.ChangedSince, f), err)
+			}
+		}
+
+		a.debugBundle.addState(templated)
+
 		processed, errs := converge(templated)
 		noMatchInHelmfiles = noMatchInHelmfiles && !processed
 
@@ -888,9 +1550,19 @@ var (
 			o.Filter = f
 		}
 	}
+
+	SetIncludeNeeds = func(i bool) func(o *LoadOpts) {
+		return func(o *LoadOpts) {
+			o.IncludeNeeds = i
+		}
+	}
 )
 
 func (a *App) ForEachState(do func(*Run) (bool, []error), includeTransitiveNeeds bool, o ...LoadOption) error {
+	if a.GlobalNeeds {
+		return a.forEachStateWithGlobalNeeds(do, includeTransitiveNeeds, o...)
+	}
+
 	ctx := NewContext()
 	err := a.visitStatesWithSelectorsAndRemoteSupport(a.FileOrDir, func(st *state.HelmState) (bool, []error) {
 		helm := a.getHelm(st)
@@ -975,6 +1647,14 @@ type Opts struct {
 }
 
 func (a *App) visitStatesWithSelectorsAndRemoteSupport(fileOrDir string, converge func(*state.HelmState) (bool, []error), includeTransitiveNeeds bool, opt ...LoadOption) error {
+	err := a.visitStatesWithoutNoMatchHandling(fileOrDir, converge, includeTransitiveNeeds, opt...)
+
+	return a.handleNoMatchingHelmfile(err)
+}
+
+// visitStatesWithoutNoMatchHandling is visitStatesWithSelectorsAndRemoteSupport returning NoMatchingHelmfileError as is,
+// for the callers visiting the state files more than once to decide whether any release matched in the end.
+func (a *App) visitStatesWithoutNoMatchHandling(fileOrDir string, converge func(*state.HelmState) (bool, []error), includeTransitiveNeeds bool, opt ...LoadOption) error {
 	opts := LoadOpts{
 		Selectors: a.Selectors,
 	}
@@ -1001,6 +1681,24 @@ func (a *App) visitStatesWithSelectorsAndRemoteSupport(fileOrDir string, converg
 
 	a.remote = remote.NewRemote(a.Logger, "", a.readFile, a.directoryExistsAt, a.fileExistsAt)
 
+	if err := a.resolveEnv(); err != nil {
+		return appError("", err)
+	}
+
+	chartOverrides, err := a.parseChartOverrides()
+	if err != nil {
+		return appError("", err)
+	}
+	a.chartOverrides = chartOverrides
+
+	if err := a.loadChangedFiles(); err != nil {
+		return appError("", err)
+	}
+
+	if err := state.ValidateMergeValuesStrategy(a.MergeValuesStrategy); err != nil {
+		return appError("", fmt.Errorf("--merge-values-strategy: %w", err))
+	}
+
 	f := converge
 	if opts.Filter {
 		f = func(st *state.HelmState) (bool, []error) {
@@ -1015,8 +1713,23 @@ func (a *App) visitStatesWithSelectorsAndRemoteSupport(fileOrDir string, converg
 	return a.visitStates(fileOrDir, opts, f)
 }
 
+// handleNoMatchingHelmfile turns NoMatchingHelmfileError into the error of the undefined environment when it's read from a file,
+// or into no error with --changed-since, as no release having changed isn't an error
+func (a *App) handleNoMatchingHelmfile(err error) error {
+	if _, ok := err.(*NoMatchingHelmfileError); ok && a.envSource != "" && !a.envDefined {
+		return appError("", fmt.Errorf("environment %q read from %s is not defined in any helmfile", a.Env, a.envSource))
+	}
+
+	if _, ok := err.(*NoMatchingHelmfileError); ok && a.changedFiles != nil {
+		a.Logger.Infof("no releases changed since %s", a.ChangedSince)
+		return nil
+	}
+
+	return err
+}
+
 func processFilteredReleases(st *state.HelmState, helm helmexec.Interface, converge func(st *state.HelmState) []error, includeTransitiveNeeds bool) (bool, []error) {
-	if len(st.Selectors) > 0 {
+	if st.HasSelectors() {
 		err := st.FilterReleases(includeTransitiveNeeds)
 		if err != nil {
 			return false, []error{err}
@@ -1216,12 +1929,50 @@ func (a *App) getSelectedReleases(r *Run, includeTransitiveNeeds bool) ([]state.
 		extra = " matching " + strings.Join(r.state.Selectors, ",")
 	}
 
+	if len(r.state.ExcludeSelectors) > 0 {
+		extra += " excluding " + strings.Join(r.state.ExcludeSelectors, ",")
+	}
+
 	a.Logger.Debugf("%d release(s)%s found in %s\n", len(selected), extra, r.state.FilePath)
 
 	return selected, deduplicated, nil
 }
 
-func (a *App) apply(r *Run, c ApplyConfigProvider) (bool, bool, []error) {
+// preflightKubeContexts verifies the kube contexts of the selected releases, and the releases they need when included,
+// before the charts are prepared, so that a misconfigured kubeContext fails before any helm command runs for the state.
+func (a *App) preflightKubeContexts(r *Run, skipNeeds, includeNeeds, includeTransitiveNeeds bool) error {
+	selected, deduplicated, err := a.getSelectedReleases(r, includeTransitiveNeeds)
+	if err != nil || len(selected) == 0 {
+		return err
+	}
+
+	st := r.state
+
+	releases := st.Releases
+	defer func() {
+		st.Releases = releases
+	}()
+
+	st.Releases = deduplicated
+
+	plan, err := st.PlanReleases(state.PlanOptions{SelectedReleases: selected, SkipNeeds: skipNeeds, IncludeNeeds: includeNeeds, IncludeTransitiveNeeds: includeTransitiveNeeds})
+	if err != nil {
+		return err
+	}
+
+	var toCheck []state.ReleaseSpec
+	for _, rs := range plan {
+		for _, r := range rs {
+			toCheck = append(toCheck, r.ReleaseSpec)
+		}
+	}
+
+	st.Releases = toCheck
+
+	return st.PreflightKubeContexts()
+}
+
+func (a *App) apply(r *Run, c ApplyConfigProvider, report *junitReport) (bool, bool, []error) {
 	st := r.state
 	helm := r.helm
 
@@ -1264,15 +2015,32 @@ func (a *App) apply(r *Run, c ApplyConfigProvider) (bool, bool, []error) {
 		Context:           c.Context(),
 		Output:            c.DiffOutput(),
 		Set:               c.Set(),
+		SetString:         c.SetString(),
+		SetFile:           c.SetFile(),
 		SkipCleanup:       c.RetainValuesFiles() || c.SkipCleanup(),
 		SkipDiffOnInstall: c.SkipDiffOnInstall(),
+		ServerSideDiff:    c.ServerSideDiff(),
+		IncludeCRDs:       diffIncludeCRDs(c.IncludeCRDs(), c.SkipCRDs()),
+		FailFast:          c.FailFast(),
+
+		SuppressOutputLineRegex: c.SuppressOutputLineRegex(),
+		SuppressReleases:        c.SuppressRelease(),
+
+		GuardedChanges: &state.GuardedChanges{},
 	}
 
 	infoMsg, releasesToBeUpdated, releasesToBeDeleted, errs := r.diff(false, detailedExitCode, c, diffOpts)
 	if len(errs) > 0 {
+		report.addErrors(st, errs)
 		return false, false, errs
 	}
 
+	var guardedChanges []string
+	for _, g := range diffOpts.GuardedChanges.Changes {
+		guardedChanges = append(guardedChanges, "  "+g.String())
+	}
+	sort.Strings(guardedChanges)
+
 	var toDelete []state.ReleaseSpec
 	for _, r := range releasesToBeDeleted {
 		toDelete = append(toDelete, r)
@@ -1284,6 +2052,7 @@ func (a *App) apply(r *Run, c ApplyConfigProvider) (bool, bool, []error) {
 	}
 
 	releasesWithNoChange := map[string]state.ReleaseSpec{}
+	var unchanged []state.ReleaseSpec
 	for _, r := range toApplyWithNeeds {
 		release := r
 		id := state.ReleaseToID(&release)
@@ -1291,48 +2060,94 @@ func (a *App) apply(r *Run, c ApplyConfigProvider) (bool, bool, []error) {
 		_, updated := releasesToBeUpdated[id]
 		if !uninstalled && !updated {
 			releasesWithNoChange[id] = release
+			unchanged = append(unchanged, release)
 		}
 	}
 
-	for id := range releasesWithNoChange {
-		r := releasesWithNoChange[id]
-		if _, err := st.TriggerCleanupEvent(&r, "apply"); err != nil {
-			a.Logger.Warnf("warn: %v\n", err)
+	noChanges := releasesToBeDeleted == nil && releasesToBeUpdated == nil
+
+	var deletes string
+	if len(toDelete) > 0 {
+		ids := make([]string, 0, len(toDelete))
+		for i := range toDelete {
+			ids = append(ids, fmt.Sprintf("  %s", state.ReleaseToID(&toDelete[i])))
+		}
+		sort.Strings(ids)
+
+		deletes = fmt.Sprintf(`The following releases will be DELETED:
+%s
+
+`, strings.Join(ids, "\n"))
+	}
+
+	// --dry-run neither fails on guarded changes nor runs any hook, so that the plan can be reviewed before rerunning with --force
+	if c.DryRun() && !noChanges {
+		// Traverse DAG of all the releases so that we don't suffer from false-positive missing dependencies
+		st.Releases = selectedAndNeededReleases
+
+		report.addApplyResults(st, toUpdate, toDelete, unchanged, &state.AffectedReleases{}, nil)
+		return true, true, a.showApplyPlan(st, c, *infoMsg, deletes, guardedChanges, toDelete, toUpdate)
+	}
+
+	if len(guardedChanges) > 0 {
+		if !c.Force() {
+			return false, false, []error{fmt.Errorf("refusing to apply changes to guarded kinds. Review the diff, and rerun with --force to apply them:\n%s", strings.Join(guardedChanges, "\n"))}
 		}
+
+		a.Logger.Warnf("applying changes to guarded kinds as --force is set:\n%s", strings.Join(guardedChanges, "\n"))
 	}
 
-	if releasesToBeDeleted == nil && releasesToBeUpdated == nil {
-		if infoMsg != nil {
+	if !c.DryRun() {
+		for id := range releasesWithNoChange {
+			r := releasesWithNoChange[id]
+			if _, err := st.TriggerCleanupEvent(&r, "apply"); err != nil {
+				a.Logger.Warnf("warn: %v\n", err)
+			}
+		}
+	}
+
+	if noChanges {
+		if infoMsg != nil && !a.Quiet {
 			logger := c.Logger()
 			logger.Infof("")
 			logger.Infof(*infoMsg)
 		}
+		report.addApplyResults(st, nil, nil, unchanged, &state.AffectedReleases{}, nil)
 		return true, false, nil
 	}
 
 	confMsg := fmt.Sprintf(`%s
-Do you really want to apply?
+%sDo you really want to apply?
   Helmfile will apply all your changes, as shown above.
 
-`, *infoMsg)
+`, *infoMsg, deletes)
 	interactive := c.Interactive()
 	if !interactive {
-		a.Logger.Debug(*infoMsg)
+		a.infoLogger().Debug(*infoMsg)
+	}
+
+	confirmed := true
+	if interactive {
+		ok, err := r.askForConfirmation(confMsg, a.confirm)
+		if err != nil {
+			return false, false, []error{err}
+		}
+		confirmed = ok
 	}
 
 	syncErrs := []error{}
 
-	affectedReleases := state.AffectedReleases{}
+	affectedReleases := state.AffectedReleases{Verbose: c.VerboseSummary() || a.Timings != nil, Color: a.Color}
 
 	// Traverse DAG of all the releases so that we don't suffer from false-positive missing dependencies
 	st.Releases = selectedAndNeededReleases
 
-	if !interactive || interactive && r.askForConfirmation(confMsg) {
-		r.helm.SetExtraArgs(argparser.GetArgs(c.Args(), r.state)...)
+	if confirmed {
+		setHelmArgs(r.helm, r.state, c)
 
 		// We deleted releases by traversing the DAG in reverse order
 		if len(releasesToBeDeleted) > 0 {
-			_, deletionErrs := withDAG(st, helm, a.Logger, state.PlanOptions{Reverse: true, SelectedReleases: toDelete, SkipNeeds: true}, a.WrapWithoutSelector(func(subst *state.HelmState, helm helmexec.Interface) []error {
+			_, deletionErrs := withDAG(st, helm, a.infoLogger(), state.PlanOptions{Reverse: true, SelectedReleases: toDelete, SkipNeeds: true}, a.WrapWithoutSelector(func(subst *state.HelmState, helm helmexec.Interface) []error {
 				var rs []state.ReleaseSpec
 
 				for _, r := range subst.Releases {
@@ -1354,7 +2169,7 @@ Do you really want to apply?
 
 		// We upgrade releases by traversing the DAG
 		if len(releasesToBeUpdated) > 0 {
-			_, updateErrs := withDAG(st, helm, a.Logger, state.PlanOptions{SelectedReleases: toUpdate, Reverse: false, SkipNeeds: true, IncludeTransitiveNeeds: c.IncludeTransitiveNeeds()}, a.WrapWithoutSelector(func(subst *state.HelmState, helm helmexec.Interface) []error {
+			_, updateErrs := withDAG(st, helm, a.infoLogger(), state.PlanOptions{SelectedReleases: toUpdate, Reverse: false, SkipNeeds: true, IncludeTransitiveNeeds: c.IncludeTransitiveNeeds()}, a.WrapWithoutSelector(func(subst *state.HelmState, helm helmexec.Interface) []error {
 				var rs []state.ReleaseSpec
 
 				for _, r := range subst.Releases {
@@ -1367,11 +2182,21 @@ Do you really want to apply?
 				subst.Releases = rs
 
 				syncOpts := state.SyncOpts{
-					Set:         c.Set(),
-					SkipCleanup: c.RetainValuesFiles() || c.SkipCleanup(),
-					SkipCRDs:    c.SkipCRDs(),
-					Wait:        c.Wait(),
-					WaitForJobs: c.WaitForJobs(),
+					Set:               c.Set(),
+					SetString:         c.SetString(),
+					SetFile:           c.SetFile(),
+					SkipCleanup:       c.RetainValuesFiles() || c.SkipCleanup(),
+					SkipCRDs:          c.SkipCRDs(),
+					Wait:              c.Wait(),
+					WaitForJobs:       c.WaitForJobs(),
+					Atomic:            c.Atomic(),
+					CleanupOnFail:     c.CleanupOnFail(),
+					NoCreateNamespace: c.NoCreateNamespace(),
+					WaitRetries:       c.WaitRetries(),
+					HistoryMax:        c.HistoryMax(),
+					PostSyncStatus:    c.PostSyncStatus(),
+					FailFast:          c.FailFast(),
+					Reason:            c.RecordReason(),
 				}
 				return subst.SyncReleases(&affectedReleases, helm, c.Values(), c.Concurrency(), &syncOpts)
 			}))
@@ -1382,15 +2207,55 @@ Do you really want to apply?
 		}
 	}
 
-	affectedReleases.DisplayAffectedReleases(c.Logger())
+	report.addApplyResults(st, toUpdate, toDelete, unchanged, &affectedReleases, syncErrs)
+
+	affectedReleases.DisplayAffectedReleases(a.summaryLogger(c.Logger()))
 	return true, true, syncErrs
 }
 
+// showApplyPlan shows the changes apply would make, and the groups of releases in the order they would be deleted and upgraded in,
+// without deleting or upgrading any release. It's used for `apply --dry-run`.
+func (a *App) showApplyPlan(st *state.HelmState, c ApplyConfigProvider, infoMsg, deletes string, guardedChanges []string, toDelete, toUpdate []state.ReleaseSpec) []error {
+	var plan strings.Builder
+
+	plan.WriteString(infoMsg)
+	plan.WriteString("\n")
+	plan.WriteString(deletes)
+
+	if len(guardedChanges) > 0 {
+		fmt.Fprintf(&plan, "The following changes to guarded kinds would require --force:\n%s\n\n", strings.Join(guardedChanges, "\n"))
+	}
+
+	if len(toDelete) > 0 {
+		batches, err := st.PlanReleases(state.PlanOptions{Reverse: true, SelectedReleases: toDelete, SkipNeeds: true})
+		if err != nil {
+			return []error{err}
+		}
+
+		fmt.Fprintf(&plan, "The releases would be deleted in this order:\n%s\n", printBatches(batches))
+	}
+
+	if len(toUpdate) > 0 {
+		batches, err := st.PlanReleases(state.PlanOptions{SelectedReleases: toUpdate, SkipNeeds: true, IncludeTransitiveNeeds: c.IncludeTransitiveNeeds()})
+		if err != nil {
+			return []error{err}
+		}
+
+		fmt.Fprintf(&plan, "The releases would be upgraded in this order:\n%s\n", printBatches(batches))
+	}
+
+	plan.WriteString("No releases were deleted or upgraded, as --dry-run is set.")
+
+	a.summaryLogger(c.Logger()).Info(plan.String())
+
+	return nil
+}
+
 func (a *App) delete(r *Run, purge bool, c DestroyConfigProvider) (bool, []error) {
 	st := r.state
 	helm := r.helm
 
-	affectedReleases := state.AffectedReleases{}
+	affectedReleases := state.AffectedReleases{Color: a.Color}
 
 	toSync, _, err := a.getSelectedReleases(r, false)
 	if err != nil {
@@ -1445,12 +2310,20 @@ Do you really want to delete?
   Helmfile will delete all your releases, as shown above.
 
 `, strings.Join(names, "\n"))
-	interactive := c.Interactive()
-	if !interactive || interactive && r.askForConfirmation(msg) {
-		r.helm.SetExtraArgs(argparser.GetArgs(c.Args(), r.state)...)
+	confirmed := true
+	if c.Interactive() {
+		ok, err := r.askForConfirmation(msg, a.confirm)
+		if err != nil {
+			return false, []error{err}
+		}
+		confirmed = ok
+	}
+
+	if confirmed {
+		setHelmArgs(r.helm, r.state, c)
 
 		if len(releasesToDelete) > 0 {
-			_, deletionErrs := withDAG(st, helm, a.Logger, state.PlanOptions{SelectedReleases: toDelete, Reverse: true, SkipNeeds: true}, a.WrapWithoutSelector(func(subst *state.HelmState, helm helmexec.Interface) []error {
+			_, deletionErrs := withDAG(st, helm, a.infoLogger(), state.PlanOptions{SelectedReleases: toDelete, Reverse: true, SkipNeeds: true}, a.WrapWithoutSelector(func(subst *state.HelmState, helm helmexec.Interface) []error {
 				return subst.DeleteReleases(&affectedReleases, helm, c.Concurrency(), purge)
 			}))
 
@@ -1459,11 +2332,20 @@ Do you really want to delete?
 			}
 		}
 	}
-	affectedReleases.DisplayAffectedReleases(c.Logger())
+	affectedReleases.DisplayAffectedReleases(a.summaryLogger(c.Logger()))
 	return true, errs
 }
 
-func (a *App) diff(r *Run, c DiffConfigProvider) (*string, bool, bool, []error) {
+// diffIncludeCRDs returns whether helm-diff includes CRDs in the diff as set by --include-crds or --skip-crds,
+// or nil to leave it to helm-diff
+func diffIncludeCRDs(includeCRDs, skipCRDs bool) *bool {
+	if !includeCRDs && !skipCRDs {
+		return nil
+	}
+	return &includeCRDs
+}
+
+func (a *App) diff(r *Run, c DiffConfigProvider, summary *state.DiffSummary) (*string, bool, bool, []error) {
 	st := r.state
 
 	selectedReleases, deduplicatedReleases, err := a.getSelectedReleases(r, false)
@@ -1475,14 +2357,25 @@ func (a *App) diff(r *Run, c DiffConfigProvider) (*string, bool, bool, []error)
 		return nil, false, false, nil
 	}
 
-	r.helm.SetExtraArgs(argparser.GetArgs(c.Args(), r.state)...)
+	setHelmArgs(r.helm, r.state, c)
 
 	opts := &state.DiffOpts{
 		Context:           c.Context(),
 		Output:            c.DiffOutput(),
 		NoColor:           c.NoColor(),
 		Set:               c.Set(),
+		SetString:         c.SetString(),
+		SetFile:           c.SetFile(),
 		SkipDiffOnInstall: c.SkipDiffOnInstall(),
+		ValuesOnly:        c.ValuesOnly(),
+		ExitCodeOnError:   c.ExitCodeOnError(),
+		ServerSideDiff:    c.ServerSideDiff(),
+		IncludeCRDs:       diffIncludeCRDs(c.IncludeCRDs(), c.SkipCRDs()),
+		FailFast:          c.FailFast(),
+		Summary:           summary,
+
+		SuppressOutputLineRegex: c.SuppressOutputLineRegex(),
+		SuppressReleases:        c.SuppressRelease(),
 	}
 
 	st.Releases = deduplicatedReleases
@@ -1511,11 +2404,42 @@ func (a *App) diff(r *Run, c DiffConfigProvider) (*string, bool, bool, []error)
 		Ask:   r.Ask,
 	}
 
-	infoMsg, updated, deleted, errs := filtered.diff(true, c.DetailedExitcode(), c, opts)
+	// helm-diff needs --detailed-exitcode to tell which releases have changes for the summary.
+	// It doesn't change the exit code of helmfile, which is still determined by c.DetailedExitcode().
+	detailedExitCode := c.DetailedExitcode() || summary != nil
+
+	infoMsg, updated, deleted, errs := filtered.diff(true, detailedExitCode, c, opts)
+
+	// helm-diff doesn't diff the releases marked `installed: false`, so tell the user they are going to be deleted
+	ids := make([]string, 0, len(deleted))
+	for id := range deleted {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		release := deleted[id]
+
+		fmt.Print(deletionNotice(&release))
+
+		if summary != nil {
+			summary.AddDeleted(&release)
+		}
+	}
 
 	return infoMsg, true, len(deleted) > 0 || len(updated) > 0, errs
 }
 
+// deletionNotice is the diff output for the installed release that is going to be deleted as it's marked `installed: false`
+func deletionNotice(r *state.ReleaseSpec) string {
+	var ns string
+	if r.Namespace != "" {
+		ns = fmt.Sprintf(" in namespace %q", r.Namespace)
+	}
+
+	return fmt.Sprintf("Release %q (%s)%s will be deleted, as it's installed but marked `installed: false`\n", r.Name, r.Chart, ns)
+}
+
 func (a *App) lint(r *Run, c LintConfigProvider) (bool, []error, []error) {
 	st := r.state
 	helm := r.helm
@@ -1555,11 +2479,12 @@ func (a *App) lint(r *Run, c LintConfigProvider) (bool, []error, []error) {
 	if len(args) > 0 {
 		helm.SetExtraArgs(args...)
 	}
+	helm.SetAppendArgs(argparser.SplitWords(c.ExtraArgs())...)
 
 	var deferredLintErrs []error
 
 	if len(toLint) > 0 {
-		_, templateErrs := withDAG(st, helm, a.Logger, state.PlanOptions{SelectedReleases: toLint, Reverse: false, SkipNeeds: true}, a.WrapWithoutSelector(func(subst *state.HelmState, helm helmexec.Interface) []error {
+		_, templateErrs := withDAG(st, helm, a.infoLogger(), state.PlanOptions{SelectedReleases: toLint, Reverse: false, SkipNeeds: true}, a.WrapWithoutSelector(func(subst *state.HelmState, helm helmexec.Interface) []error {
 			opts := &state.LintOpts{
 				Set:         c.Set(),
 				SkipCleanup: c.SkipCleanup(),
@@ -1585,7 +2510,31 @@ func (a *App) lint(r *Run, c LintConfigProvider) (bool, []error, []error) {
 	return true, deferredLintErrs, errs
 }
 
-func (a *App) status(r *Run, c StatusesConfigProvider) (bool, []error) {
+// verify appends the results of verifying the charts of the selected releases to `verifications`
+func (a *App) verify(r *Run, c VerifyConfigProvider, verifications *[]state.ChartVerification) (bool, []error) {
+	st := r.state
+
+	selectedReleases, _, err := a.getSelectedReleases(r, false)
+	if err != nil {
+		return false, []error{err}
+	}
+	if len(selectedReleases) == 0 {
+		return false, nil
+	}
+
+	allReleases := st.Releases
+	st.Releases = selectedReleases
+	defer func() {
+		st.Releases = allReleases
+	}()
+
+	*verifications = append(*verifications, st.VerifyCharts(r.helm, c.Keyring())...)
+
+	return true, nil
+}
+
+// status prints the status of each selected release, or appends the statuses to `statuses` when it is not nil
+func (a *App) status(r *Run, c StatusesConfigProvider, statuses *[]state.ReleaseStatus) (bool, []error) {
 	st := r.state
 	helm := r.helm
 
@@ -1624,9 +2573,15 @@ func (a *App) status(r *Run, c StatusesConfigProvider) (bool, []error) {
 	if len(args) > 0 {
 		helm.SetExtraArgs(args...)
 	}
+	helm.SetAppendArgs(argparser.SplitWords(c.ExtraArgs())...)
 
 	if len(toStatus) > 0 {
-		_, templateErrs := withDAG(st, helm, a.Logger, state.PlanOptions{SelectedReleases: toStatus, Reverse: false, SkipNeeds: true}, a.WrapWithoutSelector(func(subst *state.HelmState, helm helmexec.Interface) []error {
+		_, templateErrs := withDAG(st, helm, a.infoLogger(), state.PlanOptions{SelectedReleases: toStatus, Reverse: false, SkipNeeds: true}, a.WrapWithoutSelector(func(subst *state.HelmState, helm helmexec.Interface) []error {
+			if statuses != nil {
+				res, errs := subst.GetReleaseStatuses(helm, c.Concurrency())
+				*statuses = append(*statuses, res...)
+				return errs
+			}
 			return subst.ReleaseStatuses(helm, c.Concurrency())
 		}))
 
@@ -1736,19 +2691,33 @@ func (a *App) sync(r *Run, c SyncConfigProvider) (bool, []error) {
 %s
 `, strings.Join(names, "\n"))
 
-	a.Logger.Info(infoMsg)
+	a.infoLogger().Info(infoMsg)
 
 	var errs []error
 
-	r.helm.SetExtraArgs(argparser.GetArgs(c.Args(), r.state)...)
+	setHelmArgs(r.helm, r.state, c)
+
+	if c.DiffOnSync() && len(toUpdate) > 0 {
+		st.Releases = toUpdate
+
+		if diffErrs := a.diffOnSync(st, helm, c); len(diffErrs) > 0 {
+			if c.FailOnDiffError() {
+				return true, diffErrs
+			}
+
+			for _, err := range diffErrs {
+				a.Logger.Warnf("diff failed: %v. Continuing to sync as --fail-on-diff-error is not set", err)
+			}
+		}
+	}
 
 	// Traverse DAG of all the releases so that we don't suffer from false-positive missing dependencies
 	st.Releases = selectedAndNeededReleases
 
-	affectedReleases := state.AffectedReleases{}
+	affectedReleases := state.AffectedReleases{Verbose: c.VerboseSummary() || a.Timings != nil, Color: a.Color}
 
 	if len(releasesToDelete) > 0 {
-		_, deletionErrs := withDAG(st, helm, a.Logger, state.PlanOptions{Reverse: true, SelectedReleases: toDelete, SkipNeeds: true}, a.WrapWithoutSelector(func(subst *state.HelmState, helm helmexec.Interface) []error {
+		_, deletionErrs := withDAG(st, helm, a.infoLogger(), state.PlanOptions{Reverse: true, SelectedReleases: toDelete, SkipNeeds: true}, a.WrapWithoutSelector(func(subst *state.HelmState, helm helmexec.Interface) []error {
 			var rs []state.ReleaseSpec
 
 			for _, r := range subst.Releases {
@@ -1769,7 +2738,7 @@ func (a *App) sync(r *Run, c SyncConfigProvider) (bool, []error) {
 	}
 
 	if len(releasesToUpdate) > 0 {
-		_, syncErrs := withDAG(st, helm, a.Logger, state.PlanOptions{SelectedReleases: toUpdate, SkipNeeds: true, IncludeTransitiveNeeds: c.IncludeTransitiveNeeds()}, a.WrapWithoutSelector(func(subst *state.HelmState, helm helmexec.Interface) []error {
+		_, syncErrs := withDAG(st, helm, a.infoLogger(), state.PlanOptions{SelectedReleases: toUpdate, SkipNeeds: true, IncludeTransitiveNeeds: c.IncludeTransitiveNeeds()}, a.WrapWithoutSelector(func(subst *state.HelmState, helm helmexec.Interface) []error {
 			var rs []state.ReleaseSpec
 
 			for _, r := range subst.Releases {
@@ -1782,10 +2751,20 @@ func (a *App) sync(r *Run, c SyncConfigProvider) (bool, []error) {
 			subst.Releases = rs
 
 			opts := &state.SyncOpts{
-				Set:         c.Set(),
-				SkipCRDs:    c.SkipCRDs(),
-				Wait:        c.Wait(),
-				WaitForJobs: c.WaitForJobs(),
+				Set:               c.Set(),
+				SetString:         c.SetString(),
+				SetFile:           c.SetFile(),
+				SkipCRDs:          c.SkipCRDs(),
+				Wait:              c.Wait(),
+				WaitForJobs:       c.WaitForJobs(),
+				Atomic:            c.Atomic(),
+				CleanupOnFail:     c.CleanupOnFail(),
+				NoCreateNamespace: c.NoCreateNamespace(),
+				WaitRetries:       c.WaitRetries(),
+				HistoryMax:        c.HistoryMax(),
+				PostSyncStatus:    c.PostSyncStatus(),
+				FailFast:          c.FailFast(),
+				Reason:            c.RecordReason(),
 			}
 			return subst.SyncReleases(&affectedReleases, helm, c.Values(), c.Concurrency(), opts)
 		}))
@@ -1794,11 +2773,30 @@ func (a *App) sync(r *Run, c SyncConfigProvider) (bool, []error) {
 			errs = append(errs, syncErrs...)
 		}
 	}
-	affectedReleases.DisplayAffectedReleases(c.Logger())
+	affectedReleases.DisplayAffectedReleases(a.summaryLogger(c.Logger()))
 	return true, errs
 }
 
-func (a *App) template(r *Run, c TemplateConfigProvider) (bool, []error) {
+// diffOnSync prints the diff of the releases to be synced for the record.
+// Unlike apply, the diff never affects which releases are synced.
+func (a *App) diffOnSync(st *state.HelmState, helm helmexec.Interface, c SyncConfigProvider) []error {
+	opts := &state.DiffOpts{
+		Context:                 c.Context(),
+		Output:                  c.DiffOutput(),
+		Set:                     c.Set(),
+		SetString:               c.SetString(),
+		SetFile:                 c.SetFile(),
+		SuppressOutputLineRegex: c.SuppressOutputLineRegex(),
+	}
+
+	_, errs := st.DiffReleases(helm, c.Values(), c.Concurrency(), false, false, c.Suppress(), c.SuppressSecrets(), c.ShowSecrets(), false, false, opts)
+
+	return errs
+}
+
+// template runs `helm template` on the selected releases, once per capability set into the subdirectories of the output dir
+// when capabilitySets is not empty.
+func (a *App) template(r *Run, c TemplateConfigProvider, capabilitySets []capabilitySet) (bool, []error) {
 	st := r.state
 	helm := r.helm
 
@@ -1855,17 +2853,40 @@ func (a *App) template(r *Run, c TemplateConfigProvider) (bool, []error) {
 	if len(args) > 0 {
 		helm.SetExtraArgs(args...)
 	}
+	helm.SetAppendArgs(argparser.SplitWords(c.ExtraArgs())...)
 
 	if len(toRender) > 0 {
-		_, templateErrs := withDAG(st, helm, a.Logger, state.PlanOptions{SelectedReleases: toRender, Reverse: false, SkipNeeds: true, IncludeTransitiveNeeds: c.IncludeTransitiveNeeds()}, a.WrapWithoutSelector(func(subst *state.HelmState, helm helmexec.Interface) []error {
+		_, templateErrs := withDAG(st, helm, a.infoLogger(), state.PlanOptions{SelectedReleases: toRender, Reverse: false, SkipNeeds: true, IncludeTransitiveNeeds: c.IncludeTransitiveNeeds()}, a.WrapWithoutSelector(func(subst *state.HelmState, helm helmexec.Interface) []error {
 			opts := &state.TemplateOpts{
-				Set:               c.Set(),
-				IncludeCRDs:       c.IncludeCRDs(),
-				OutputDirTemplate: c.OutputDirTemplate(),
-				SkipCleanup:       c.SkipCleanup(),
-				SkipTests:         c.SkipTests(),
+				Set:                c.Set(),
+				SetString:          c.SetString(),
+				SetFile:            c.SetFile(),
+				IncludeCRDs:        c.IncludeCRDs(),
+				OutputDirTemplate:  c.OutputDirTemplate(),
+				OutputFileTemplate: c.OutputFileTemplate(),
+				SkipCleanup:        c.SkipCleanup(),
+				SkipTests:          c.SkipTests(),
+			}
+
+			if len(capabilitySets) == 0 {
+				return subst.TemplateReleases(helm, c.OutputDir(), c.Values(), args, c.Concurrency(), c.Validate(), opts)
+			}
+
+			var errs []error
+
+			for _, s := range capabilitySets {
+				setOpts := *opts
+				setOpts.KubeVersion = s.KubeVersion
+				setOpts.ApiVersions = s.ApiVersions
+
+				a.Logger.Debugf("Templating releases for capability set %q", s.dirName())
+
+				outputDir := filepath.Join(c.OutputDir(), s.dirName())
+
+				errs = append(errs, subst.TemplateReleases(helm, outputDir, c.Values(), args, c.Concurrency(), c.Validate(), &setOpts)...)
 			}
-			return subst.TemplateReleases(helm, c.OutputDir(), c.Values(), args, c.Concurrency(), c.Validate(), opts)
+
+			return errs
 		}))
 
 		if len(templateErrs) > 0 {
@@ -1895,9 +2916,9 @@ func (a *App) test(r *Run, c TestConfigProvider) []error {
 	// with conditions and selectors
 	st.Releases = toTest
 
-	r.helm.SetExtraArgs(argparser.GetArgs(c.Args(), r.state)...)
+	setHelmArgs(r.helm, r.state, c)
 
-	return st.TestReleases(r.helm, cleanup, timeout, concurrency, state.Logs(c.Logs()))
+	return st.TestReleases(r.helm, cleanup, timeout, concurrency, state.Logs(c.Logs()), state.Filter(c.TestFilter()), state.Parallel(c.Parallel()))
 }
 
 func (a *App) writeValues(r *Run, c WriteValuesConfigProvider) (bool, []error) {
@@ -2044,6 +3065,20 @@ func (e *Error) Code() int {
 	panic(fmt.Sprintf("[bug] assertion error: unexpected state: unable to handle errors: %v", e.Errors))
 }
 
+// exitCode returns the exit code of helmfile for the error returned by an App method
+func exitCode(err error) int {
+	switch e := err.(type) {
+	case nil:
+		return 0
+	case *NoMatchingHelmfileError:
+		return 3
+	case *Error:
+		return e.Code()
+	default:
+		return 1
+	}
+}
+
 func appError(msg string, err error) *Error {
 	return &Error{msg: msg, Errors: []error{err}}
 }
@@ -2091,12 +3126,12 @@ func (a *App) ShowCacheDir(c ListConfigProvider) error {
 	if !directoryExistsAt(remote.CacheDir()) {
 		return nil
 	}
-	dirs, err := os.ReadDir(remote.CacheDir())
+	entries, err := remote.CacheEntries()
 	if err != nil {
 		return err
 	}
-	for _, e := range dirs {
-		fmt.Printf("- %s\n", e.Name())
+	for _, e := range entries {
+		fmt.Printf("- %s\n", e)
 	}
 
 	return nil
@@ -2107,13 +3142,13 @@ func (a *App) CleanCacheDir(c ListConfigProvider) error {
 		return nil
 	}
 	fmt.Printf("Cleaning up cache directory: %s\n", remote.CacheDir())
-	dirs, err := os.ReadDir(remote.CacheDir())
+	entries, err := remote.CacheEntries()
 	if err != nil {
 		return err
 	}
-	for _, e := range dirs {
-		fmt.Printf("- %s\n", e.Name())
-		os.RemoveAll(filepath.Join(remote.CacheDir(), e.Name()))
+	for _, e := range entries {
+		fmt.Printf("- %s\n", e)
+		os.RemoveAll(filepath.Join(remote.CacheDir(), e))
 	}
 
 	return nil
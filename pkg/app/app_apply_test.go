@@ -4,7 +4,10 @@ import (
 	"bufio"
 	"bytes"
 	"io"
+	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"sync"
 	"testing"
 
@@ -1282,3 +1285,557 @@ releases:
 		})
 	})
 }
+
+func TestApply_InteractiveDelete(t *testing.T) {
+	testcases := []struct {
+		name       string
+		answer     string
+		terminal   bool
+		wantDelete bool
+		wantErr    string
+	}{
+		{
+			name:     "declined",
+			answer:   "n\n",
+			terminal: true,
+		},
+		{
+			name:       "confirmed",
+			answer:     "y\n",
+			terminal:   true,
+			wantDelete: true,
+		},
+		{
+			name:     "no terminal",
+			answer:   "y\n",
+			terminal: false,
+			wantErr:  "in ./helmfile.yaml: --interactive requires a terminal to ask for confirmation. Run it in a terminal, or without --interactive",
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			helm := &exectest.Helm{
+				FailOnUnexpectedList: true,
+				FailOnUnexpectedDiff: true,
+				Lists: map[exectest.ListKey]string{
+					{Filter: "^foo$", Flags: helmV2ListFlags}: `NAME	REVISION	UPDATED                 	STATUS  	CHART        	APP VERSION	NAMESPACE
+foo 	4       	Fri Nov  1 08:40:07 2019	DEPLOYED	raw-3.1.0	3.1.0      	default
+`,
+				},
+				Diffs: map[exectest.DiffKey]error{
+					{Name: "bar", Chart: "incubator/raw", Flags: "--kube-contextdefault--detailed-exitcode"}: helmexec.ExitError{Code: 2},
+				},
+				DiffMutex:     &sync.Mutex{},
+				ChartsMutex:   &sync.Mutex{},
+				ReleasesMutex: &sync.Mutex{},
+			}
+
+			valsRuntime, err := vals.New(vals.Options{CacheSize: 32})
+			if err != nil {
+				t.Fatalf("unexpected error creating vals runtime: %v", err)
+			}
+
+			out := &bytes.Buffer{}
+
+			app := appWithFs(&App{
+				OverrideHelmBinary:  DefaultHelmBinary,
+				OverrideKubeContext: "default",
+				Env:                 "default",
+				Logger:              helmexec.NewLogger(io.Discard, "debug"),
+				helms: map[helmKey]helmexec.Interface{
+					createHelmKey("helm", "default"): helm,
+				},
+				valsRuntime: valsRuntime,
+				stdin:       bytes.NewBufferString(tc.answer),
+				stdout:      out,
+				isTerminal:  func() bool { return tc.terminal },
+			}, map[string]string{
+				"/path/to/helmfile.yaml": `
+releases:
+- name: foo
+  chart: incubator/raw
+  installed: false
+- name: bar
+  chart: incubator/raw
+`,
+			})
+
+			err = app.Apply(applyConfig{
+				concurrency: 1,
+				interactive: true,
+				logger:      app.Logger,
+			})
+
+			var gotErr string
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != tc.wantErr {
+				t.Fatalf("unexpected error: want %q, got %q", tc.wantErr, gotErr)
+			}
+
+			if tc.terminal && !strings.Contains(out.String(), "The following releases will be DELETED:\n  default//foo\n") {
+				t.Errorf("the prompt doesn't list the releases to be deleted:\n%s", out.String())
+			}
+
+			if tc.wantDelete {
+				if len(helm.Deleted) != 1 || helm.Deleted[0].Name != "foo" {
+					t.Errorf("unexpected deletes: %v", helm.Deleted)
+				}
+				if len(helm.Releases) != 1 || helm.Releases[0].Name != "bar" {
+					t.Errorf("unexpected upgrades: %v", helm.Releases)
+				}
+			} else if len(helm.Deleted) > 0 || len(helm.Releases) > 0 {
+				t.Errorf("unexpected deletes %v and upgrades %v", helm.Deleted, helm.Releases)
+			}
+		})
+	}
+}
+
+func TestApply_GuardedKinds(t *testing.T) {
+	testcases := []struct {
+		name        string
+		diff        string
+		force       bool
+		dryRun      bool
+		wantUpgrade bool
+		wantErr     string
+		wantLog     string
+	}{
+		{
+			name: "guarded kinds changed",
+			diff: `default, data, PersistentVolumeClaim (v1) has changed:
+-     storage: 1Gi
++     storage: 2Gi
+`,
+			wantErr: "in ./helmfile.yaml: refusing to apply changes to guarded kinds. Review the diff, and rerun with --force to apply them:\n  default//bar: PersistentVolumeClaim default/data",
+		},
+		{
+			name: "guarded kinds changed with --force",
+			diff: `default, data, PersistentVolumeClaim (v1) has changed:
+-     storage: 1Gi
++     storage: 2Gi
+`,
+			force:       true,
+			wantUpgrade: true,
+		},
+		{
+			name: "guarded kinds changed with --dry-run",
+			diff: `default, data, PersistentVolumeClaim (v1) has changed:
+-     storage: 1Gi
++     storage: 2Gi
+`,
+			dryRun:  true,
+			wantLog: "The following changes to guarded kinds would require --force:\n  default//bar: PersistentVolumeClaim default/data\n",
+		},
+		{
+			name: "guarded kinds untouched",
+			diff: `default, web, Deployment (apps) has changed:
+-         image: web:1.0
++         image: web:1.1
+`,
+			wantUpgrade: true,
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			helm := &exectest.Helm{
+				FailOnUnexpectedList: true,
+				FailOnUnexpectedDiff: true,
+				Diffs: map[exectest.DiffKey]error{
+					{Name: "bar", Chart: "incubator/raw", Flags: "--kube-contextdefault--detailed-exitcode"}: helmexec.ExitError{Code: 2},
+				},
+				DiffOutputs: map[string]string{
+					"bar": tc.diff,
+				},
+				DiffMutex:     &sync.Mutex{},
+				ChartsMutex:   &sync.Mutex{},
+				ReleasesMutex: &sync.Mutex{},
+			}
+
+			valsRuntime, err := vals.New(vals.Options{CacheSize: 32})
+			if err != nil {
+				t.Fatalf("unexpected error creating vals runtime: %v", err)
+			}
+
+			var log bytes.Buffer
+
+			app := appWithFs(&App{
+				OverrideHelmBinary:  DefaultHelmBinary,
+				OverrideKubeContext: "default",
+				Env:                 "default",
+				Logger:              helmexec.NewLogger(&log, "debug"),
+				helms: map[helmKey]helmexec.Interface{
+					createHelmKey("helm", "default"): helm,
+				},
+				valsRuntime: valsRuntime,
+			}, map[string]string{
+				"/path/to/helmfile.yaml": `
+helmDefaults:
+  guardedKinds:
+  - PersistentVolumeClaim
+  - CustomResourceDefinition
+
+releases:
+- name: bar
+  chart: incubator/raw
+`,
+			})
+
+			err = app.Apply(applyConfig{
+				concurrency: 1,
+				force:       tc.force,
+				dryRun:      tc.dryRun,
+				logger:      app.Logger,
+			})
+
+			var gotErr string
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != tc.wantErr {
+				t.Fatalf("unexpected error: want %q, got %q", tc.wantErr, gotErr)
+			}
+
+			if !strings.Contains(log.String(), tc.wantLog) {
+				t.Errorf("expected the log to contain %q, got:\n%s", tc.wantLog, log.String())
+			}
+
+			if tc.wantUpgrade {
+				if len(helm.Releases) != 1 || helm.Releases[0].Name != "bar" {
+					t.Errorf("unexpected upgrades: %v", helm.Releases)
+				}
+			} else if len(helm.Releases) > 0 {
+				t.Errorf("unexpected upgrades: %v", helm.Releases)
+			}
+		})
+	}
+}
+
+func TestApply_Quiet(t *testing.T) {
+	testcases := []struct {
+		name        string
+		quiet       bool
+		wantLogs    []string
+		notWantLogs []string
+	}{
+		{
+			name: "not quiet",
+			wantLogs: []string{
+				"processing 2 groups of releases in this order",
+				"processing releases in group 1/2: default//bar",
+				"Affected releases are:",
+				"UPDATED RELEASES:",
+			},
+		},
+		{
+			name:  "quiet",
+			quiet: true,
+			wantLogs: []string{
+				"UPDATED RELEASES:",
+			},
+			notWantLogs: []string{
+				"processing 2 groups of releases in this order",
+				"processing releases in group",
+				"Affected releases are:",
+			},
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			helm := &exectest.Helm{
+				FailOnUnexpectedList: true,
+				FailOnUnexpectedDiff: true,
+				Diffs: map[exectest.DiffKey]error{
+					{Name: "foo", Chart: "incubator/raw", Flags: "--kube-contextdefault--detailed-exitcode"}: helmexec.ExitError{Code: 2},
+					{Name: "bar", Chart: "incubator/raw", Flags: "--kube-contextdefault--detailed-exitcode"}: helmexec.ExitError{Code: 2},
+				},
+				DiffMutex:     &sync.Mutex{},
+				ChartsMutex:   &sync.Mutex{},
+				ReleasesMutex: &sync.Mutex{},
+			}
+
+			bs := &bytes.Buffer{}
+
+			func() {
+				t.Helper()
+
+				logReader, logWriter := io.Pipe()
+
+				logFlushed := &sync.WaitGroup{}
+				// Ensure all the log is consumed into `bs` by calling `logWriter.Close()` followed by `logFlushed.Wait()`
+				logFlushed.Add(1)
+				go func() {
+					scanner := bufio.NewScanner(logReader)
+					for scanner.Scan() {
+						bs.Write(scanner.Bytes())
+						bs.WriteString("\n")
+					}
+					logFlushed.Done()
+				}()
+
+				defer func() {
+					// This is here to avoid data-trace on bytes buffer `bs` to capture logs
+					if err := logWriter.Close(); err != nil {
+						panic(err)
+					}
+					logFlushed.Wait()
+				}()
+
+				// The debug level ensures the informational messages are suppressed by --quiet rather than the log level
+				logger := helmexec.NewLogger(logWriter, "debug")
+
+				valsRuntime, err := vals.New(vals.Options{CacheSize: 32})
+				if err != nil {
+					t.Fatalf("unexpected error creating vals runtime: %v", err)
+				}
+
+				app := appWithFs(&App{
+					OverrideHelmBinary:  DefaultHelmBinary,
+					OverrideKubeContext: "default",
+					Env:                 "default",
+					Logger:              logger,
+					Quiet:               tc.quiet,
+					helms: map[helmKey]helmexec.Interface{
+						createHelmKey("helm", "default"): helm,
+					},
+					valsRuntime: valsRuntime,
+				}, map[string]string{
+					"/path/to/helmfile.yaml": `
+releases:
+- name: foo
+  chart: incubator/raw
+  needs:
+  - bar
+- name: bar
+  chart: incubator/raw
+`,
+				})
+
+				if err := app.Apply(applyConfig{
+					concurrency: 1,
+					logger:      logger,
+				}); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}()
+
+			if len(helm.Releases) != 2 {
+				t.Errorf("unexpected upgrades: %v", helm.Releases)
+			}
+
+			log := bs.String()
+			for _, want := range tc.wantLogs {
+				if !strings.Contains(log, want) {
+					t.Errorf("expected the log to contain %q, got:\n%s", want, log)
+				}
+			}
+			for _, notWant := range tc.notWantLogs {
+				if strings.Contains(log, notWant) {
+					t.Errorf("expected the log not to contain %q, got:\n%s", notWant, log)
+				}
+			}
+		})
+	}
+}
+
+func TestApply_DryRun(t *testing.T) {
+	helm := &exectest.Helm{
+		FailOnUnexpectedList: true,
+		FailOnUnexpectedDiff: true,
+		Lists: map[exectest.ListKey]string{
+			{Filter: "^baz$", Flags: helmV2ListFlags}: `NAME	REVISION	UPDATED                 	STATUS  	CHART        	APP VERSION	NAMESPACE
+baz 	4       	Fri Nov  1 08:40:07 2019	DEPLOYED	raw-3.1.0	3.1.0      	default
+`,
+		},
+		Diffs: map[exectest.DiffKey]error{
+			{Name: "foo", Chart: "incubator/raw", Flags: "--kube-contextdefault--detailed-exitcode"}: helmexec.ExitError{Code: 2},
+			{Name: "bar", Chart: "incubator/raw", Flags: "--kube-contextdefault--detailed-exitcode"}: helmexec.ExitError{Code: 2},
+		},
+		DiffMutex:     &sync.Mutex{},
+		ChartsMutex:   &sync.Mutex{},
+		ReleasesMutex: &sync.Mutex{},
+	}
+
+	bs := &bytes.Buffer{}
+
+	var err error
+
+	func() {
+		t.Helper()
+
+		logReader, logWriter := io.Pipe()
+
+		logFlushed := &sync.WaitGroup{}
+		// Ensure all the log is consumed into `bs` by calling `logWriter.Close()` followed by `logFlushed.Wait()`
+		logFlushed.Add(1)
+		go func() {
+			scanner := bufio.NewScanner(logReader)
+			for scanner.Scan() {
+				bs.Write(scanner.Bytes())
+				bs.WriteString("\n")
+			}
+			logFlushed.Done()
+		}()
+
+		defer func() {
+			// This is here to avoid data-trace on bytes buffer `bs` to capture logs
+			if err := logWriter.Close(); err != nil {
+				panic(err)
+			}
+			logFlushed.Wait()
+		}()
+
+		logger := helmexec.NewLogger(logWriter, "info")
+
+		valsRuntime, vErr := vals.New(vals.Options{CacheSize: 32})
+		if vErr != nil {
+			t.Fatalf("unexpected error creating vals runtime: %v", vErr)
+		}
+
+		app := appWithFs(&App{
+			OverrideHelmBinary:  DefaultHelmBinary,
+			OverrideKubeContext: "default",
+			Env:                 "default",
+			Logger:              logger,
+			helms: map[helmKey]helmexec.Interface{
+				createHelmKey("helm", "default"): helm,
+			},
+			valsRuntime: valsRuntime,
+			// --interactive is ignored with --dry-run, as there's nothing to confirm
+			isTerminal: func() bool { return false },
+		}, map[string]string{
+			"/path/to/helmfile.yaml": `
+releases:
+- name: foo
+  chart: incubator/raw
+  needs:
+  - bar
+- name: bar
+  chart: incubator/raw
+- name: baz
+  chart: incubator/raw
+  installed: false
+`,
+		})
+
+		err = app.Apply(applyConfig{
+			concurrency:      1,
+			interactive:      true,
+			detailedExitcode: true,
+			dryRun:           true,
+			logger:           logger,
+		})
+	}()
+
+	appErr, ok := err.(*Error)
+	if !ok || appErr.Code() != 2 {
+		t.Fatalf("expected the exit code 2 for the detected changes, got %v", err)
+	}
+
+	if len(helm.Releases) > 0 || len(helm.Deleted) > 0 {
+		t.Errorf("unexpected upgrades %v and deletes %v", helm.Releases, helm.Deleted)
+	}
+
+	log := bs.String()
+	for _, want := range []string{
+		"Affected releases are:",
+		"The following releases will be DELETED:\n  default//baz\n",
+		"The releases would be deleted in this order:\nGROUP RELEASES\n1     default//baz\n",
+		"The releases would be upgraded in this order:\nGROUP RELEASES\n1     default//bar\n2     default//foo\n",
+		"No releases were deleted or upgraded, as --dry-run is set.",
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("expected the log to contain %q, got:\n%s", want, log)
+		}
+	}
+}
+
+func TestApply_JUnitReport(t *testing.T) {
+	helm := &exectest.Helm{
+		FailOnUnexpectedList: true,
+		FailOnUnexpectedDiff: true,
+		Lists:                map[exectest.ListKey]string{},
+		Diffs: map[exectest.DiffKey]error{
+			{Name: "foo", Chart: "incubator/raw", Flags: "--kube-contextdefault--detailed-exitcode"}:   helmexec.ExitError{Code: 2},
+			{Name: "error", Chart: "incubator/raw", Flags: "--kube-contextdefault--detailed-exitcode"}: helmexec.ExitError{Code: 2},
+			{Name: "baz", Chart: "incubator/raw", Flags: "--kube-contextdefault--detailed-exitcode"}:   nil,
+		},
+		DiffMutex:     &sync.Mutex{},
+		ChartsMutex:   &sync.Mutex{},
+		ReleasesMutex: &sync.Mutex{},
+	}
+
+	logger := helmexec.NewLogger(io.Discard, "info")
+
+	valsRuntime, err := vals.New(vals.Options{CacheSize: 32})
+	if err != nil {
+		t.Fatalf("unexpected error creating vals runtime: %v", err)
+	}
+
+	app := appWithFs(&App{
+		OverrideHelmBinary:  DefaultHelmBinary,
+		OverrideKubeContext: "default",
+		Env:                 "default",
+		Logger:              logger,
+		helms: map[helmKey]helmexec.Interface{
+			createHelmKey("helm", "default"): helm,
+		},
+		valsRuntime: valsRuntime,
+	}, map[string]string{
+		"/path/to/helmfile.yaml": `
+releases:
+- name: foo
+  chart: incubator/raw
+- name: error
+  chart: incubator/raw
+- name: baz
+  chart: incubator/raw
+`,
+	})
+
+	report := filepath.Join(t.TempDir(), "junit.xml")
+
+	err = app.Apply(applyConfig{
+		concurrency: 1,
+		junitReport: report,
+		logger:      logger,
+	})
+	if err == nil {
+		t.Fatal("expected an error for the failed release")
+	}
+
+	bs, err := os.ReadFile(report)
+	if err != nil {
+		t.Fatalf("unexpected error reading the report: %v", err)
+	}
+
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites tests="3" failures="1" skipped="1">
+  <testsuite name="helmfile apply" tests="3" failures="1" skipped="1">
+    <testcase name="default//baz" classname="helmfile.yaml">
+      <skipped message="no changes"></skipped>
+    </testcase>
+    <testcase name="default//error" classname="helmfile.yaml">
+      <failure message="failed processing release error: error" type="upgrade">failed processing release error: error</failure>
+    </testcase>
+    <testcase name="default//foo" classname="helmfile.yaml" time="0.000"></testcase>
+  </testsuite>
+</testsuites>
+`
+	// The time spent in upgrading the release varies by run
+	got := regexp.MustCompile(`time="[0-9.]+"`).ReplaceAllString(string(bs), `time="0.000"`)
+
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("unexpected report: want (-), got (+):\n%s", d)
+	}
+}
@@ -3,6 +3,7 @@ package app
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"io"
 	"path/filepath"
 	"sync"
@@ -27,6 +28,12 @@ func TestSync(t *testing.T) {
 		ns                string
 		concurrency       int
 		skipDiffOnInstall bool
+		diffOnSync        bool
+		failOnDiffError   bool
+		diffContext       int
+		diffOutput        string
+		diffs             map[exectest.DiffKey]error
+		diffed            []exectest.Release
 		error             string
 		files             map[string]string
 		selectors         []string
@@ -46,6 +53,7 @@ func TestSync(t *testing.T) {
 			FailOnUnexpectedList: true,
 			FailOnUnexpectedDiff: true,
 			Lists:                tc.lists,
+			Diffs:                tc.diffs,
 			DiffMutex:            &sync.Mutex{},
 			ChartsMutex:          &sync.Mutex{},
 			ReleasesMutex:        &sync.Mutex{},
@@ -114,6 +122,10 @@ func TestSync(t *testing.T) {
 				skipNeeds:              tc.fields.skipNeeds,
 				includeNeeds:           tc.fields.includeNeeds,
 				includeTransitiveNeeds: tc.fields.includeTransitiveNeeds,
+				diffOnSync:             tc.diffOnSync,
+				failOnDiffError:        tc.failOnDiffError,
+				context:                tc.diffContext,
+				diffOutput:             tc.diffOutput,
 			})
 
 			var gotErr string
@@ -125,6 +137,12 @@ func TestSync(t *testing.T) {
 				t.Fatalf("unexpected error: want (-), got (+): %s", d)
 			}
 
+			if tc.diffed != nil {
+				if d := cmp.Diff(tc.diffed, helm.Diffed); d != "" {
+					t.Errorf("unexpected diffs: want (-), got (+): %s", d)
+				}
+			}
+
 			if len(wantUpgrades) > len(helm.Releases) {
 				t.Fatalf("insufficient number of upgrades: got %d, want %d", len(helm.Releases), len(wantUpgrades))
 			}
@@ -907,4 +925,85 @@ merged environment: &{default map[] map[]}
 `,
 		})
 	})
+
+	t.Run("diff-on-sync", func(t *testing.T) {
+		check(t, testcase{
+			files: map[string]string{
+				"/path/to/helmfile.yaml": `
+releases:
+- name: foo
+  chart: incubator/raw
+  namespace: default
+- name: bar
+  chart: incubator/raw
+  namespace: default
+`,
+			},
+			diffOnSync: true,
+			diffs: map[exectest.DiffKey]error{
+				{Name: "foo", Chart: "incubator/raw", Flags: "--kube-contextdefault--namespacedefault"}: nil,
+				{Name: "bar", Chart: "incubator/raw", Flags: "--kube-contextdefault--namespacedefault"}: errors.New("diff failed"),
+			},
+			lists: map[exectest.ListKey]string{},
+			diffed: []exectest.Release{
+				{Name: "foo", Flags: []string{"--kube-context", "default", "--namespace", "default"}},
+				{Name: "bar", Flags: []string{"--kube-context", "default", "--namespace", "default"}},
+			},
+			// The diff error is logged and doesn't prevent the releases from being synced
+			upgraded: []exectest.Release{
+				{Name: "foo", Flags: []string{"--kube-context", "default", "--namespace", "default"}},
+				{Name: "bar", Flags: []string{"--kube-context", "default", "--namespace", "default"}},
+			},
+			concurrency: 1,
+		})
+	})
+
+	t.Run("diff-on-sync with fail-on-diff-error", func(t *testing.T) {
+		check(t, testcase{
+			files: map[string]string{
+				"/path/to/helmfile.yaml": `
+releases:
+- name: foo
+  chart: incubator/raw
+  namespace: default
+`,
+			},
+			diffOnSync:      true,
+			failOnDiffError: true,
+			diffs: map[exectest.DiffKey]error{
+				{Name: "foo", Chart: "incubator/raw", Flags: "--kube-contextdefault--namespacedefault"}: errors.New("diff failed"),
+			},
+			lists:       map[exectest.ListKey]string{},
+			upgraded:    []exectest.Release{},
+			error:       "in ./helmfile.yaml: diff failed",
+			concurrency: 1,
+		})
+	})
+
+	t.Run("diff-on-sync with context and output", func(t *testing.T) {
+		check(t, testcase{
+			files: map[string]string{
+				"/path/to/helmfile.yaml": `
+releases:
+- name: foo
+  chart: incubator/raw
+  namespace: default
+`,
+			},
+			diffOnSync:  true,
+			diffContext: 3,
+			diffOutput:  "simple",
+			diffs: map[exectest.DiffKey]error{
+				{Name: "foo", Chart: "incubator/raw", Flags: "--kube-contextdefault--namespacedefault--context3--outputsimple"}: nil,
+			},
+			lists: map[exectest.ListKey]string{},
+			diffed: []exectest.Release{
+				{Name: "foo", Flags: []string{"--kube-context", "default", "--namespace", "default", "--context", "3", "--output", "simple"}},
+			},
+			upgraded: []exectest.Release{
+				{Name: "foo", Flags: []string{"--kube-context", "default", "--namespace", "default"}},
+			},
+			concurrency: 1,
+		})
+	})
 }
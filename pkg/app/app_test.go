@@ -3,6 +3,7 @@ package app
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -30,6 +31,7 @@ import (
 	"github.com/roboll/helmfile/pkg/testhelper"
 
 	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
 	"gotest.tools/v3/env"
 )
 
@@ -1631,6 +1633,186 @@ helmDefaults:
 	}
 }
 
+func TestLoadDesiredStateFromYaml_ValuesFrom(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+	yamlContent := `bases:
+- ../base.yaml
+
+releases:
+- name: foo
+  chart: mychart1
+  valuesFrom:
+  - "@shared/common-values"
+  values:
+  - foo.yaml
+- name: bar
+  chart: mychart2
+  valuesFrom:
+  - "@shared/common-values"
+  - "@monitoring"
+- name: baz
+  chart: mychart3
+  values:
+  - baz.yaml
+`
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: yamlContent,
+		"/path/to/base.yaml": `valueBundles:
+  shared/common-values:
+  - common.yaml
+  - replicas: 2
+  monitoring:
+  - monitoring.yaml
+`,
+	})
+	app := &App{
+		OverrideHelmBinary:  DefaultHelmBinary,
+		OverrideKubeContext: "default",
+		readFile:            testFs.ReadFile,
+		glob:                testFs.Glob,
+		abs:                 testFs.Abs,
+		directoryExistsAt:   testFs.DirectoryExistsAt,
+		fileExistsAt:        testFs.FileExistsAt,
+		fileExists:          testFs.FileExists,
+		Env:                 "default",
+		Logger:              helmexec.NewLogger(os.Stderr, "debug"),
+	}
+	app.remote = remote.NewRemote(app.Logger, "", app.readFile, app.directoryExistsAt, app.fileExistsAt)
+
+	expectNoCallsToHelm(app)
+
+	st, err := app.loadDesiredStateFromYaml(yamlFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := map[string][]interface{}{
+		"foo": {"common.yaml", map[interface{}]interface{}{"replicas": 2}, "foo.yaml"},
+		"bar": {"common.yaml", map[interface{}]interface{}{"replicas": 2}, "monitoring.yaml"},
+		"baz": {"baz.yaml"},
+	}
+
+	for _, r := range st.Releases {
+		if d := cmp.Diff(want[r.Name], r.Values); d != "" {
+			t.Errorf("unexpected values of release %s: want (-), got (+):\n%s", r.Name, d)
+		}
+		if len(r.ValuesFrom) > 0 {
+			t.Errorf("unexpected valuesFrom of release %s: %v", r.Name, r.ValuesFrom)
+		}
+	}
+}
+
+func TestLoadDesiredStateFromYaml_ValuesFrom_UndefinedBundle(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: `releases:
+- name: foo
+  chart: mychart1
+  valuesFrom:
+  - "@missing"
+`,
+	})
+	app := &App{
+		OverrideHelmBinary:  DefaultHelmBinary,
+		OverrideKubeContext: "default",
+		readFile:            testFs.ReadFile,
+		glob:                testFs.Glob,
+		abs:                 testFs.Abs,
+		directoryExistsAt:   testFs.DirectoryExistsAt,
+		fileExistsAt:        testFs.FileExistsAt,
+		fileExists:          testFs.FileExists,
+		Env:                 "default",
+		Logger:              helmexec.NewLogger(os.Stderr, "debug"),
+	}
+	app.remote = remote.NewRemote(app.Logger, "", app.readFile, app.directoryExistsAt, app.fileExistsAt)
+
+	expectNoCallsToHelm(app)
+
+	_, err := app.loadDesiredStateFromYaml(yamlFile)
+
+	want := `valuesFrom entry "@missing" of release "foo" references the value bundle "missing", which is not defined in valueBundles`
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatalf("unexpected error: want %q, got %v", want, err)
+	}
+}
+
+func TestLoadDesiredStateFromYaml_ChartAndVersionFromValues(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+	// The values are declared after the releases referencing the nested keys of them
+	yamlContent := `releases:
+- name: foo
+  namespace: {{ .Values.apps.namespace }}
+  chart: {{ .Values.charts.repo }}/foo
+  version: {{ .Values.charts.version }}
+- name: bar
+  namespace: '{{` + "`{{ .Values.apps.namespace }}`" + `}}'
+  chart: '{{` + "`{{ .Values.charts.repo }}/{{ .Release.Name }}`" + `}}'
+  version: '{{` + "`{{ .Environment.Values.bar.version }}`" + `}}'
+  needs:
+  - '{{` + "`{{ .Values.apps.namespace }}`" + `}}/foo'
+
+values:
+- charts:
+    repo: myrepo
+    version: 1.2.3
+  apps:
+    namespace: apps
+
+environments:
+  default:
+    values:
+    - bar:
+        version: 2.0.0
+`
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: yamlContent,
+	})
+	app := &App{
+		OverrideHelmBinary:  DefaultHelmBinary,
+		OverrideKubeContext: "default",
+		readFile:            testFs.ReadFile,
+		glob:                testFs.Glob,
+		abs:                 testFs.Abs,
+		directoryExistsAt:   testFs.DirectoryExistsAt,
+		fileExistsAt:        testFs.FileExistsAt,
+		fileExists:          testFs.FileExists,
+		Env:                 "default",
+		Logger:              helmexec.NewLogger(os.Stderr, "debug"),
+	}
+	app.remote = remote.NewRemote(app.Logger, "", app.readFile, app.directoryExistsAt, app.fileExistsAt)
+
+	expectNoCallsToHelm(app)
+
+	st, err := app.loadDesiredStateFromYaml(yamlFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	st, err = st.ExecuteTemplates()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	type release struct {
+		Name, Namespace, Chart, Version string
+		Needs                           []string
+	}
+
+	var got []release
+	for _, r := range st.Releases {
+		got = append(got, release{Name: r.Name, Namespace: r.Namespace, Chart: r.Chart, Version: r.Version, Needs: r.Needs})
+	}
+
+	want := []release{
+		{Name: "foo", Namespace: "apps", Chart: "myrepo/foo", Version: "1.2.3"},
+		{Name: "bar", Namespace: "apps", Chart: "myrepo/bar", Version: "2.0.0", Needs: []string{"apps/foo"}},
+	}
+
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("unexpected releases: want (-), got (+):\n%s", d)
+	}
+}
+
 func TestLoadDesiredStateFromYaml_MultiPartTemplate(t *testing.T) {
 	yamlFile := "/path/to/yaml/file"
 	yamlContent := `bases:
@@ -2245,16 +2427,30 @@ services:
 type configImpl struct {
 	selectors   []string
 	set         []string
+	setString   []string
+	setFile     []string
 	output      string
 	includeCRDs bool
 	skipCleanup bool
 	skipCRDs    bool
 	skipDeps    bool
+	skipRepos   bool
 	skipTests   bool
 
 	skipNeeds              bool
 	includeNeeds           bool
 	includeTransitiveNeeds bool
+
+	kubeVersion      string
+	apiVersions      []string
+	capabilitiesFile string
+
+	outputFileTemplate string
+
+	embedValues           bool
+	embedSecretsDecrypted bool
+
+	clusterState bool
 }
 
 func (a configImpl) Selectors() []string {
@@ -2265,6 +2461,14 @@ func (c configImpl) Set() []string {
 	return c.set
 }
 
+func (c configImpl) SetString() []string {
+	return c.setString
+}
+
+func (c configImpl) SetFile() []string {
+	return c.setFile
+}
+
 func (c configImpl) Values() []string {
 	return []string{}
 }
@@ -2273,6 +2477,10 @@ func (c configImpl) Args() string {
 	return "some args"
 }
 
+func (c configImpl) ExtraArgs() string {
+	return ""
+}
+
 func (c configImpl) Validate() bool {
 	return true
 }
@@ -2289,6 +2497,10 @@ func (c configImpl) SkipDeps() bool {
 	return c.skipDeps
 }
 
+func (c configImpl) SkipRepos() bool {
+	return c.skipRepos
+}
+
 func (c configImpl) SkipNeeds() bool {
 	return c.skipNeeds
 }
@@ -2313,6 +2525,10 @@ func (c configImpl) OutputDirTemplate() string {
 	return ""
 }
 
+func (c configImpl) OutputFileTemplate() string {
+	return c.outputFileTemplate
+}
+
 func (c configImpl) IncludeCRDs() bool {
 	return c.includeCRDs
 }
@@ -2322,46 +2538,118 @@ func (c configImpl) Concurrency() int {
 }
 
 func (c configImpl) EmbedValues() bool {
-	return false
+	return c.embedValues
+}
+
+func (c configImpl) EmbedSecretsDecrypted() bool {
+	return c.embedSecretsDecrypted
 }
 
 func (c configImpl) Output() string {
 	return c.output
 }
 
+func (c configImpl) ClusterState() bool {
+	return c.clusterState
+}
+
+func (c configImpl) KubeVersion() string {
+	return c.kubeVersion
+}
+
+func (c configImpl) ApiVersions() []string {
+	return c.apiVersions
+}
+
+func (c configImpl) CapabilitiesFile() string {
+	return c.capabilitiesFile
+}
+
 type applyConfig struct {
-	args                   string
-	values                 []string
-	retainValuesFiles      bool
-	set                    []string
-	validate               bool
-	skipCleanup            bool
-	skipCRDs               bool
-	skipDeps               bool
-	skipNeeds              bool
-	includeNeeds           bool
-	includeTransitiveNeeds bool
-	includeTests           bool
-	suppress               []string
-	suppressSecrets        bool
-	showSecrets            bool
-	suppressDiff           bool
-	noColor                bool
-	context                int
-	diffOutput             string
-	concurrency            int
-	detailedExitcode       bool
-	interactive            bool
-	skipDiffOnInstall      bool
-	logger                 *zap.SugaredLogger
-	wait                   bool
-	waitForJobs            bool
+	args                    string
+	extraArgs               string
+	values                  []string
+	retainValuesFiles       bool
+	set                     []string
+	setString               []string
+	setFile                 []string
+	validate                bool
+	serverSideDiff          bool
+	validateValues          bool
+	skipCleanup             bool
+	skipCRDs                bool
+	includeCRDs             bool
+	skipDeps                bool
+	skipRepos               bool
+	skipNeeds               bool
+	includeNeeds            bool
+	includeTransitiveNeeds  bool
+	includeTests            bool
+	suppress                []string
+	suppressOutputLineRegex []string
+	suppressRelease         []string
+	suppressSecrets         bool
+	showSecrets             bool
+	suppressDiff            bool
+	noColor                 bool
+	context                 int
+	diffOutput              string
+	concurrency             int
+	detailedExitcode        bool
+	interactive             bool
+	skipDiffOnInstall       bool
+	valuesOnly              bool
+	exitCodeOnError         int
+	outputSummary           string
+	useLock                 bool
+	preflight               bool
+	force                   bool
+	waitRetries             int
+	historyMax              *int
+	postSyncStatus          bool
+	failFast                bool
+	recordReason            string
+	kubeVersion             string
+	apiVersions             []string
+	diffOnSync              bool
+	failOnDiffError         bool
+	logger                  *zap.SugaredLogger
+	wait                    bool
+	waitForJobs             bool
+	atomic                  bool
+	cleanupOnFail           bool
+	noCreateNamespace       bool
+	purgeOrphans            bool
+	purgeOrphansNamespaces  []string
+	verboseSummary          bool
+	dryRun                  bool
+	junitReport             string
 }
 
 func (a applyConfig) Args() string {
 	return a.args
 }
 
+func (a applyConfig) ExtraArgs() string {
+	return a.extraArgs
+}
+
+func (a applyConfig) VerboseSummary() bool {
+	return a.verboseSummary
+}
+
+func (a applyConfig) JUnitReport() string {
+	return a.junitReport
+}
+
+func (a applyConfig) PurgeOrphans() bool {
+	return a.purgeOrphans
+}
+
+func (a applyConfig) PurgeOrphansNamespaces() []string {
+	return a.purgeOrphansNamespaces
+}
+
 func (a applyConfig) Wait() bool {
 	return a.wait
 }
@@ -2370,6 +2658,18 @@ func (a applyConfig) WaitForJobs() bool {
 	return a.waitForJobs
 }
 
+func (a applyConfig) Atomic() bool {
+	return a.atomic
+}
+
+func (a applyConfig) CleanupOnFail() bool {
+	return a.cleanupOnFail
+}
+
+func (a applyConfig) NoCreateNamespace() bool {
+	return a.noCreateNamespace
+}
+
 func (a applyConfig) Values() []string {
 	return a.values
 }
@@ -2378,10 +2678,26 @@ func (a applyConfig) Set() []string {
 	return a.set
 }
 
+func (a applyConfig) SetString() []string {
+	return a.setString
+}
+
+func (a applyConfig) SetFile() []string {
+	return a.setFile
+}
+
 func (a applyConfig) Validate() bool {
 	return a.validate
 }
 
+func (a applyConfig) ServerSideDiff() bool {
+	return a.serverSideDiff
+}
+
+func (a applyConfig) ValidateValues() bool {
+	return a.validateValues
+}
+
 func (a applyConfig) SkipCleanup() bool {
 	return a.skipCleanup
 }
@@ -2390,10 +2706,18 @@ func (a applyConfig) SkipCRDs() bool {
 	return a.skipCRDs
 }
 
+func (a applyConfig) IncludeCRDs() bool {
+	return a.includeCRDs
+}
+
 func (a applyConfig) SkipDeps() bool {
 	return a.skipDeps
 }
 
+func (a applyConfig) SkipRepos() bool {
+	return a.skipRepos
+}
+
 func (c applyConfig) SkipNeeds() bool {
 	return c.skipNeeds
 }
@@ -2414,6 +2738,14 @@ func (a applyConfig) Suppress() []string {
 	return a.suppress
 }
 
+func (a applyConfig) SuppressOutputLineRegex() []string {
+	return a.suppressOutputLineRegex
+}
+
+func (a applyConfig) SuppressRelease() []string {
+	return a.suppressRelease
+}
+
 func (a applyConfig) SuppressSecrets() bool {
 	return a.suppressSecrets
 }
@@ -2462,9 +2794,74 @@ func (a applyConfig) SkipDiffOnInstall() bool {
 	return a.skipDiffOnInstall
 }
 
+func (a applyConfig) ValuesOnly() bool {
+	return a.valuesOnly
+}
+
+func (a applyConfig) ExitCodeOnError() int {
+	return a.exitCodeOnError
+}
+
+func (a applyConfig) OutputSummary() string {
+	return a.outputSummary
+}
+
+func (a applyConfig) UseLock() bool {
+	return a.useLock
+}
+
+func (a applyConfig) PostSyncStatus() bool {
+	return a.postSyncStatus
+}
+
+func (a applyConfig) FailFast() bool {
+	return a.failFast
+}
+
+func (a applyConfig) RecordReason() string {
+	return a.recordReason
+}
+
+func (a applyConfig) HistoryMax() *int {
+	return a.historyMax
+}
+
+func (a applyConfig) WaitRetries() int {
+	return a.waitRetries
+}
+
+func (a applyConfig) Force() bool {
+	return a.force
+}
+
+func (a applyConfig) DryRun() bool {
+	return a.dryRun
+}
+
+func (a applyConfig) Preflight() bool {
+	return a.preflight
+}
+
+func (a applyConfig) KubeVersion() string {
+	return a.kubeVersion
+}
+
+func (a applyConfig) ApiVersions() []string {
+	return a.apiVersions
+}
+
+func (a applyConfig) DiffOnSync() bool {
+	return a.diffOnSync
+}
+
+func (a applyConfig) FailOnDiffError() bool {
+	return a.failOnDiffError
+}
+
 type depsConfig struct {
 	skipRepos              bool
 	includeTransitiveNeeds bool
+	outputFile             string
 }
 
 func (d depsConfig) SkipRepos() bool {
@@ -2475,10 +2872,18 @@ func (d depsConfig) IncludeTransitiveNeeds() bool {
 	return d.includeTransitiveNeeds
 }
 
+func (d depsConfig) OutputFile() string {
+	return d.outputFile
+}
+
 func (d depsConfig) Args() string {
 	return ""
 }
 
+func (d depsConfig) ExtraArgs() string {
+	return ""
+}
+
 // Mocking the command-line runner
 
 type mockRunner struct {
@@ -2502,6 +2907,7 @@ func MockExecer(logger *zap.SugaredLogger, kubeContext string) helmexec.Interfac
 type mockHelmExec struct {
 	templated []mockTemplates
 	repos     []mockRepo
+	depsBuilt []string
 }
 
 type mockTemplates struct {
@@ -2531,11 +2937,14 @@ func (helm *mockHelmExec) UpdateDeps(chart string) error {
 }
 
 func (helm *mockHelmExec) BuildDeps(name, chart string) error {
+	helm.depsBuilt = append(helm.depsBuilt, chart)
 	return nil
 }
 
 func (helm *mockHelmExec) SetExtraArgs(args ...string) {
 }
+func (helm *mockHelmExec) SetAppendArgs(args ...string) {
+}
 func (helm *mockHelmExec) SetHelmBinary(bin string) {
 }
 func (helm *mockHelmExec) AddRepo(name, repository, cafile, certfile, keyfile, username, password string, managed string, passCredentials string, skipTLSVerify string) error {
@@ -2557,6 +2966,9 @@ func (helm *mockHelmExec) DiffRelease(context helmexec.HelmContext, name, chart
 func (helm *mockHelmExec) ReleaseStatus(context helmexec.HelmContext, release string, flags ...string) error {
 	return nil
 }
+func (helm *mockHelmExec) GetReleaseStatus(context helmexec.HelmContext, release string, flags ...string) (string, error) {
+	return "", nil
+}
 func (helm *mockHelmExec) DeleteRelease(context helmexec.HelmContext, name string, flags ...string) error {
 	return nil
 }
@@ -2568,12 +2980,21 @@ func (helm *mockHelmExec) List(context helmexec.HelmContext, filter string, flag
 func (helm *mockHelmExec) DecryptSecret(context helmexec.HelmContext, name string, flags ...string) (string, error) {
 	return "", nil
 }
+func (helm *mockHelmExec) GetValues(context helmexec.HelmContext, name string, flags ...string) (string, error) {
+	return "", nil
+}
+func (helm *mockHelmExec) SearchRepo(chart string, flags ...string) (string, error) {
+	return "", nil
+}
 func (helm *mockHelmExec) TestRelease(context helmexec.HelmContext, name string, flags ...string) error {
 	return nil
 }
 func (helm *mockHelmExec) Fetch(chart string, flags ...string) error {
 	return nil
 }
+func (helm *mockHelmExec) VerifyChart(chart string, flags ...string) error {
+	return nil
+}
 func (helm *mockHelmExec) Lint(name, chart string, flags ...string) error {
 	return nil
 }
@@ -2589,6 +3010,10 @@ func (helm *mockHelmExec) IsVersionAtLeast(versionStr string) bool {
 	return false
 }
 
+func (helm *mockHelmExec) IsDiffPluginVersionAtLeast(versionStr string) bool {
+	return false
+}
+
 func TestTemplate_SingleStateFile(t *testing.T) {
 	files := map[string]string{
 		"/path/to/helmfile.yaml": `
@@ -2603,6 +3028,9 @@ releases:
   chart: stable/mychart1
   labels:
     group: one
+  setString:
+  - name: image.tag
+    value: "0123"
 - name: myrelease2
   chart: stable/mychart2
   labels:
@@ -2614,8 +3042,8 @@ releases:
 
 	var helm = &mockHelmExec{}
 	var wantReleases = []mockTemplates{
-		{name: "myrelease1", chart: "stable/mychart1", flags: []string{"--namespace", "testNamespace", "--set", "foo=a", "--set", "bar=b", "--output-dir", "output/subdir/helmfile-[a-z0-9]{8}-myrelease1"}},
-		{name: "myrelease2", chart: "stable/mychart2", flags: []string{"--namespace", "testNamespace", "--set", "foo=a", "--set", "bar=b", "--output-dir", "output/subdir/helmfile-[a-z0-9]{8}-myrelease2"}},
+		{name: "myrelease1", chart: "stable/mychart1", flags: []string{"--namespace", "testNamespace", "--set-string", "image.tag=0123", "--set", "foo=a", "--set", "bar=b", "--set-string", "baz=01", "--set-file", "qux=path/to/qux.txt", "--output-dir", "output/subdir/helmfile-[a-z0-9]{8}-myrelease1"}},
+		{name: "myrelease2", chart: "stable/mychart2", flags: []string{"--namespace", "testNamespace", "--set", "foo=a", "--set", "bar=b", "--set-string", "baz=01", "--set-file", "qux=path/to/qux.txt", "--output-dir", "output/subdir/helmfile-[a-z0-9]{8}-myrelease2"}},
 	}
 
 	var wantRepos = []mockRepo{
@@ -2648,7 +3076,7 @@ releases:
 		},
 	}, files)
 
-	if err := app.Template(configImpl{set: []string{"foo=a", "bar=b"}, skipDeps: false}); err != nil {
+	if err := app.Template(configImpl{set: []string{"foo=a", "bar=b"}, setString: []string{"baz=01"}, setFile: []string{"qux=path/to/qux.txt"}, skipDeps: false}); err != nil {
 		t.Fatalf("%v", err)
 	}
 
@@ -2664,7 +3092,7 @@ releases:
 			t.Errorf("chart = [%v], want %v", helm.templated[i].chart, wantReleases[i].chart)
 		}
 		for j := range wantReleases[i].flags {
-			if j == 7 {
+			if j == len(wantReleases[i].flags)-1 {
 				matched, _ := regexp.Match(wantReleases[i].flags[j], []byte(helm.templated[i].flags[j]))
 				if !matched {
 					t.Errorf("HelmState.TemplateReleases() = [%v], want %v", helm.templated[i].flags[j], wantReleases[i].flags[j])
@@ -2676,28 +3104,236 @@ releases:
 	}
 }
 
-func TestTemplate_ApiVersionsAndKubeVersion(t *testing.T) {
+func TestTemplate_SkipRepos(t *testing.T) {
 	files := map[string]string{
 		"/path/to/helmfile.yaml": `
-apiVersions:
-- helmfile.test/v1
-- helmfile.test/v2
-
-kubeVersion: v1.21
+repositories:
+- name: stable
+  url: https://kubernetes-charts.storage.googleapis.com
 
 releases:
-- name: myrelease1
+- name: remote
   chart: stable/mychart1
+- name: local
+  chart: ./charts/local
 `,
+		"/path/to/charts/local/Chart.yaml": `name: local`,
 	}
 
-	var helm = &mockHelmExec{}
-	var wantReleases = []mockTemplates{
-		{name: "myrelease1", chart: "stable/mychart1", flags: []string{"--api-versions", "helmfile.test/v1", "--api-versions", "helmfile.test/v2", "--kube-version", "v1.21", "--namespace", "testNamespace", "--output-dir", "output/subdir/helmfile-[a-z0-9]{8}-myrelease1"}},
+	testcases := []struct {
+		name      string
+		skipRepos bool
+		wantRepos []mockRepo
+	}{
+		{
+			name:      "repos are added by default",
+			wantRepos: []mockRepo{{Name: "stable"}},
+		},
+		{
+			name:      "skip-repos",
+			skipRepos: true,
+		},
 	}
 
-	var buffer bytes.Buffer
-	logger := helmexec.NewLogger(&buffer, "debug")
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			helm := &mockHelmExec{}
+
+			valsRuntime, err := vals.New(vals.Options{CacheSize: 32})
+			if err != nil {
+				t.Fatalf("unexpected error creating vals runtime: %v", err)
+			}
+
+			app := appWithFs(&App{
+				OverrideHelmBinary:  DefaultHelmBinary,
+				glob:                filepath.Glob,
+				abs:                 filepath.Abs,
+				OverrideKubeContext: "default",
+				Env:                 "default",
+				Logger:              helmexec.NewLogger(io.Discard, "debug"),
+				helms: map[helmKey]helmexec.Interface{
+					createHelmKey("helm", "default"): helm,
+				},
+				valsRuntime: valsRuntime,
+			}, files)
+
+			if err := app.Template(configImpl{skipRepos: tc.skipRepos}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if d := cmp.Diff(tc.wantRepos, helm.repos); d != "" {
+				t.Errorf("unexpected repos: want (-), got (+):\n%s", d)
+			}
+
+			if d := cmp.Diff([]string{"charts/local"}, helm.depsBuilt); d != "" {
+				t.Errorf("unexpected dependency builds: want (-), got (+):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestTemplate_ValidateWithKubeContext(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+helmDefaults:
+  kubeContext: default
+
+releases:
+- name: foo
+  chart: stable/mychart1
+  kubeContext: prod
+- name: bar
+  chart: stable/mychart2
+`,
+	}
+
+	helm := &mockHelmExec{}
+
+	valsRuntime, err := vals.New(vals.Options{CacheSize: 32})
+	if err != nil {
+		t.Fatalf("unexpected error creating vals runtime: %v", err)
+	}
+
+	app := appWithFs(&App{
+		OverrideHelmBinary: DefaultHelmBinary,
+		glob:               filepath.Glob,
+		abs:                filepath.Abs,
+		Env:                "default",
+		Logger:             helmexec.NewLogger(io.Discard, "debug"),
+		helms: map[helmKey]helmexec.Interface{
+			createHelmKey("helm", "default"): helm,
+		},
+		valsRuntime: valsRuntime,
+	}, files)
+
+	// configImpl enables --validate
+	if err := app.Template(configImpl{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := map[string][]string{
+		"foo": {"--validate", "--kube-context", "prod"},
+		"bar": {"--validate", "--kube-context", "default"},
+	}
+
+	if len(helm.templated) != len(want) {
+		t.Fatalf("unexpected number of templated releases: want %d, got %d", len(want), len(helm.templated))
+	}
+
+	for _, r := range helm.templated {
+		flags := r.flags
+		if len(flags) > 3 {
+			flags = flags[len(flags)-3:]
+		}
+
+		if d := cmp.Diff(want[r.name], flags); d != "" {
+			t.Errorf("unexpected flags for %s: want (-), got (+):\n%s", r.name, d)
+		}
+	}
+}
+
+func TestTemplate_SubchartPath(t *testing.T) {
+	testcases := []struct {
+		name         string
+		subchartPath string
+		wantChart    string
+		wantErr      string
+	}{
+		{
+			name:         "existing subchart",
+			subchartPath: "charts/subapp",
+			wantChart:    "charts/umbrella/charts/subapp",
+		},
+		{
+			name:         "missing subchart",
+			subchartPath: "charts/missing",
+			wantErr:      `in ./helmfile.yaml: [release "myrelease": subchartPath "charts/missing" not found in chart "./charts/umbrella": charts/umbrella/charts/missing does not contain Chart.yaml]`,
+		},
+		{
+			name:         "subchart outside of the chart",
+			subchartPath: "../other",
+			wantErr:      `in ./helmfile.yaml: [release "myrelease": subchartPath "../other" must be a relative path within the chart]`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			files := map[string]string{
+				"/path/to/helmfile.yaml": fmt.Sprintf(`
+releases:
+- name: myrelease
+  chart: ./charts/umbrella
+  subchartPath: %s
+`, tc.subchartPath),
+				"/path/to/charts/umbrella/Chart.yaml":               "name: umbrella",
+				"/path/to/charts/umbrella/charts/subapp/Chart.yaml": "name: subapp",
+				"/path/to/charts/other/Chart.yaml":                  "name: other",
+			}
+
+			var helm = &mockHelmExec{}
+
+			valsRuntime, err := vals.New(vals.Options{CacheSize: 32})
+			if err != nil {
+				t.Fatalf("unexpected error creating vals runtime: %v", err)
+			}
+
+			app := appWithFs(&App{
+				OverrideHelmBinary:  DefaultHelmBinary,
+				glob:                filepath.Glob,
+				abs:                 filepath.Abs,
+				OverrideKubeContext: "default",
+				Env:                 "default",
+				Logger:              helmexec.NewLogger(io.Discard, "debug"),
+				helms: map[helmKey]helmexec.Interface{
+					createHelmKey("helm", "default"): helm,
+				},
+				valsRuntime: valsRuntime,
+			}, files)
+
+			err = app.Template(configImpl{skipDeps: true})
+
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("unexpected error: want %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(helm.templated) != 1 || helm.templated[0].chart != tc.wantChart {
+				t.Errorf("unexpected templated charts: want %s, got %v", tc.wantChart, helm.templated)
+			}
+		})
+	}
+}
+
+func TestTemplate_ApiVersionsAndKubeVersion(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+apiVersions:
+- helmfile.test/v1
+- helmfile.test/v2
+
+kubeVersion: v1.21
+
+releases:
+- name: myrelease1
+  chart: stable/mychart1
+`,
+	}
+
+	var helm = &mockHelmExec{}
+	var wantReleases = []mockTemplates{
+		{name: "myrelease1", chart: "stable/mychart1", flags: []string{"--api-versions", "helmfile.test/v1", "--api-versions", "helmfile.test/v2", "--kube-version", "v1.21", "--namespace", "testNamespace", "--output-dir", "output/subdir/helmfile-[a-z0-9]{8}-myrelease1"}},
+	}
+
+	var buffer bytes.Buffer
+	logger := helmexec.NewLogger(&buffer, "debug")
 
 	valsRuntime, err := vals.New(vals.Options{CacheSize: 32})
 	if err != nil {
@@ -2718,28 +3354,457 @@ releases:
 		valsRuntime: valsRuntime,
 	}, files)
 
-	if err := app.Template(configImpl{}); err != nil {
-		t.Fatalf("%v", err)
-	}
+	if err := app.Template(configImpl{}); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for i := range wantReleases {
+		if wantReleases[i].name != helm.templated[i].name {
+			t.Errorf("name = [%v], want %v", helm.templated[i].name, wantReleases[i].name)
+		}
+		if !strings.Contains(helm.templated[i].chart, wantReleases[i].chart) {
+			t.Errorf("chart = [%v], want %v", helm.templated[i].chart, wantReleases[i].chart)
+		}
+		for j := range wantReleases[i].flags {
+			if j == 9 {
+				matched, _ := regexp.Match(wantReleases[i].flags[j], []byte(helm.templated[i].flags[j]))
+				if !matched {
+					t.Errorf("HelmState.TemplateReleases() = [%v], want %v", helm.templated[i].flags[j], wantReleases[i].flags[j])
+				}
+			} else if wantReleases[i].flags[j] != helm.templated[i].flags[j] {
+				t.Errorf("HelmState.TemplateReleases() = [%v], want %v", helm.templated[i].flags[j], wantReleases[i].flags[j])
+			}
+		}
+
+	}
+}
+
+func TestTemplate_ApiVersionsAndKubeVersionOverride(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+apiVersions:
+- helmfile.test/v1
+
+kubeVersion: v1.21
+
+releases:
+- name: myrelease1
+  chart: stable/mychart1
+- name: myrelease2
+  chart: stable/mychart2
+  apiVersions:
+  - helmfile.test/v2
+  kubeVersion: v1.22
+`,
+	}
+
+	testcases := []struct {
+		name         string
+		config       configImpl
+		wantReleases []mockTemplates
+	}{
+		{
+			name:   "release over state",
+			config: configImpl{},
+			wantReleases: []mockTemplates{
+				{name: "myrelease1", chart: "stable/mychart1", flags: []string{"--api-versions", "helmfile.test/v1", "--kube-version", "v1.21"}},
+				{name: "myrelease2", chart: "stable/mychart2", flags: []string{"--api-versions", "helmfile.test/v2", "--kube-version", "v1.22"}},
+			},
+		},
+		{
+			name:   "cli over release",
+			config: configImpl{kubeVersion: "v1.23", apiVersions: []string{"helmfile.test/v3", "helmfile.test/v4"}},
+			wantReleases: []mockTemplates{
+				{name: "myrelease1", chart: "stable/mychart1", flags: []string{"--api-versions", "helmfile.test/v3", "--api-versions", "helmfile.test/v4", "--kube-version", "v1.23"}},
+				{name: "myrelease2", chart: "stable/mychart2", flags: []string{"--api-versions", "helmfile.test/v3", "--api-versions", "helmfile.test/v4", "--kube-version", "v1.23"}},
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var helm = &mockHelmExec{}
+
+			var buffer bytes.Buffer
+			logger := helmexec.NewLogger(&buffer, "debug")
+
+			valsRuntime, err := vals.New(vals.Options{CacheSize: 32})
+			if err != nil {
+				t.Errorf("unexpected error creating vals runtime: %v", err)
+			}
+
+			app := appWithFs(&App{
+				OverrideHelmBinary:  DefaultHelmBinary,
+				glob:                filepath.Glob,
+				abs:                 filepath.Abs,
+				OverrideKubeContext: "default",
+				Env:                 "default",
+				Logger:              logger,
+				helms: map[helmKey]helmexec.Interface{
+					createHelmKey("helm", "default"): helm,
+				},
+				Namespace:   "testNamespace",
+				valsRuntime: valsRuntime,
+			}, files)
+
+			if err := app.Template(tc.config); err != nil {
+				t.Fatalf("%v", err)
+			}
+
+			if len(helm.templated) != len(tc.wantReleases) {
+				t.Fatalf("unexpected number of templated releases: want %d, got %d", len(tc.wantReleases), len(helm.templated))
+			}
+
+			for i, want := range tc.wantReleases {
+				got := helm.templated[i]
+				if want.name != got.name {
+					t.Errorf("name = [%v], want %v", got.name, want.name)
+				}
+				if !strings.Contains(got.chart, want.chart) {
+					t.Errorf("chart = [%v], want %v", got.chart, want.chart)
+				}
+				if len(got.flags) < len(want.flags) {
+					t.Fatalf("flags = %v, want prefix %v", got.flags, want.flags)
+				}
+				if d := cmp.Diff(want.flags, got.flags[:len(want.flags)]); d != "" {
+					t.Errorf("unexpected flags: want (-), got (+):\n%s", d)
+				}
+			}
+		})
+	}
+}
+
+func TestTemplate_CapabilitiesFile(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+apiVersions:
+- helmfile.test/v1
+
+kubeVersion: v1.21
+
+releases:
+- name: myrelease1
+  chart: stable/mychart1
+`,
+		"/path/to/capabilities.yaml": `
+- kubeVersion: v1.26.0
+- name: next
+  kubeVersion: v1.27.0
+  apiVersions:
+  - helmfile.test/v2
+`,
+	}
+
+	var helm = &mockHelmExec{}
+
+	var buffer bytes.Buffer
+	logger := helmexec.NewLogger(&buffer, "debug")
+
+	valsRuntime, err := vals.New(vals.Options{CacheSize: 32})
+	if err != nil {
+		t.Errorf("unexpected error creating vals runtime: %v", err)
+	}
+
+	app := appWithFs(&App{
+		OverrideHelmBinary:  DefaultHelmBinary,
+		glob:                filepath.Glob,
+		abs:                 filepath.Abs,
+		OverrideKubeContext: "default",
+		Env:                 "default",
+		Logger:              logger,
+		helms: map[helmKey]helmexec.Interface{
+			createHelmKey("helm", "default"): helm,
+		},
+		Namespace:   "testNamespace",
+		valsRuntime: valsRuntime,
+	}, files)
+
+	if err := app.Template(configImpl{capabilitiesFile: "capabilities.yaml"}); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	wantFlags := [][]string{
+		{"--api-versions", "helmfile.test/v1", "--kube-version", "v1.26.0"},
+		{"--api-versions", "helmfile.test/v2", "--kube-version", "v1.27.0"},
+	}
+	wantOutputDirs := []string{"output/subdir/kube-v1.26.0/", "output/subdir/next/"}
+
+	if len(helm.templated) != len(wantFlags) {
+		t.Fatalf("unexpected number of templated releases: want %d, got %d", len(wantFlags), len(helm.templated))
+	}
+
+	for i, want := range wantFlags {
+		got := helm.templated[i]
+		if got.name != "myrelease1" {
+			t.Errorf("name = [%v], want myrelease1", got.name)
+		}
+		if len(got.flags) < len(want) {
+			t.Fatalf("flags = %v, want prefix %v", got.flags, want)
+		}
+		if d := cmp.Diff(want, got.flags[:len(want)]); d != "" {
+			t.Errorf("unexpected flags: want (-), got (+):\n%s", d)
+		}
+
+		var outputDir string
+		for j, f := range got.flags {
+			if f == "--output-dir" && j+1 < len(got.flags) {
+				outputDir = got.flags[j+1]
+			}
+		}
+		if !strings.HasPrefix(outputDir, wantOutputDirs[i]) {
+			t.Errorf("output dir = [%v], want prefix %v", outputDir, wantOutputDirs[i])
+		}
+	}
+}
+
+func TestTemplate_CapabilitiesFileWithKubeVersion(t *testing.T) {
+	app := appWithFs(&App{
+		OverrideHelmBinary: DefaultHelmBinary,
+		glob:               filepath.Glob,
+		abs:                filepath.Abs,
+		Env:                "default",
+		Logger:             helmexec.NewLogger(os.Stderr, "debug"),
+	}, map[string]string{})
+
+	err := app.Template(configImpl{capabilitiesFile: "capabilities.yaml", kubeVersion: "v1.23"})
+
+	want := "--capabilities-file cannot be used with --kube-version or --api-versions"
+	if err == nil || err.Error() != want {
+		t.Errorf("unexpected error: want %q, got %v", want, err)
+	}
+}
+
+func TestTemplate_OutputFileTemplateWithOutputDir(t *testing.T) {
+	app := appWithFs(&App{
+		OverrideHelmBinary: DefaultHelmBinary,
+		glob:               filepath.Glob,
+		abs:                filepath.Abs,
+		Env:                "default",
+		Logger:             helmexec.NewLogger(os.Stderr, "debug"),
+	}, map[string]string{})
+
+	err := app.Template(configImpl{outputFileTemplate: "{{ .Release.Name }}.yaml"})
+
+	want := "--output-file-template cannot be used with --output-dir or --output-dir-template"
+	if err == nil || err.Error() != want {
+		t.Errorf("unexpected error: want %q, got %v", want, err)
+	}
+}
+
+func TestSync_EnvRepositories(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+environments:
+  default:
+  prod:
+    repositories:
+    - name: stable
+      url: https://mirror.example.com/stable
+      username: mirror-user
+---
+repositories:
+- name: stable
+  url: https://charts.helm.sh/stable
+
+releases:
+- name: myapp
+  chart: stable/myapp
+`,
+	}
+
+	testcases := []struct {
+		env  string
+		want []string
+	}{
+		{
+			env:  "default",
+			want: []string{"stable", "https://charts.helm.sh/stable", "", "", "", "", "", "", "", ""},
+		},
+		{
+			env:  "prod",
+			want: []string{"stable", "https://mirror.example.com/stable", "", "", "", "mirror-user", "", "", "", ""},
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(tc.env, func(t *testing.T) {
+			helm := &exectest.Helm{
+				Helm3:         true,
+				DiffMutex:     &sync.Mutex{},
+				ChartsMutex:   &sync.Mutex{},
+				ReleasesMutex: &sync.Mutex{},
+			}
+
+			logger := helmexec.NewLogger(io.Discard, "debug")
+
+			valsRuntime, err := vals.New(vals.Options{CacheSize: 32})
+			if err != nil {
+				t.Fatalf("unexpected error creating vals runtime: %v", err)
+			}
+
+			app := appWithFs(&App{
+				OverrideHelmBinary:  DefaultHelmBinary,
+				glob:                filepath.Glob,
+				abs:                 filepath.Abs,
+				OverrideKubeContext: "default",
+				Env:                 tc.env,
+				Logger:              logger,
+				helms: map[helmKey]helmexec.Interface{
+					createHelmKey("helm", "default"): helm,
+				},
+				valsRuntime: valsRuntime,
+			}, files)
+
+			if err := app.Sync(applyConfig{
+				concurrency: 1,
+				logger:      logger,
+			}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if d := cmp.Diff(tc.want, helm.Repo); d != "" {
+				t.Errorf("unexpected repository added: want (-), got (+): %s", d)
+			}
+		})
+	}
+}
+
+func TestSync_ExcludeSelectors(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+releases:
+- name: frontend
+  chart: incubator/raw
+  labels:
+    tier: app
+- name: backend
+  chart: incubator/raw
+  labels:
+    tier: app
+  needs:
+  - database
+- name: database
+  chart: incubator/raw
+  labels:
+    tier: data
+`,
+	}
+
+	testcases := []struct {
+		name             string
+		selectors        []string
+		excludeSelectors []string
+		skipNeeds        bool
+		includeNeeds     bool
+		upgraded         []string
+	}{
+		{
+			name:             "exclude wins over include",
+			selectors:        []string{"tier=app"},
+			excludeSelectors: []string{"name=frontend"},
+			skipNeeds:        true,
+			upgraded:         []string{"backend"},
+		},
+		{
+			name:             "include needs pulls the excluded release",
+			selectors:        []string{"name=backend"},
+			excludeSelectors: []string{"tier=data"},
+			includeNeeds:     true,
+			upgraded:         []string{"database", "backend"},
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			helm := &exectest.Helm{
+				Helm3:         true,
+				DiffMutex:     &sync.Mutex{},
+				ChartsMutex:   &sync.Mutex{},
+				ReleasesMutex: &sync.Mutex{},
+			}
+
+			logger := helmexec.NewLogger(io.Discard, "debug")
+
+			valsRuntime, err := vals.New(vals.Options{CacheSize: 32})
+			if err != nil {
+				t.Fatalf("unexpected error creating vals runtime: %v", err)
+			}
+
+			app := appWithFs(&App{
+				OverrideHelmBinary:  DefaultHelmBinary,
+				glob:                filepath.Glob,
+				abs:                 filepath.Abs,
+				OverrideKubeContext: "default",
+				Env:                 "default",
+				Logger:              logger,
+				Selectors:           tc.selectors,
+				ExcludeSelectors:    tc.excludeSelectors,
+				helms: map[helmKey]helmexec.Interface{
+					createHelmKey("helm", "default"): helm,
+				},
+				valsRuntime: valsRuntime,
+			}, files)
+
+			if err := app.Sync(applyConfig{
+				concurrency:  1,
+				skipNeeds:    tc.skipNeeds,
+				includeNeeds: tc.includeNeeds,
+				logger:       logger,
+			}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var upgraded []string
+			for _, r := range helm.Releases {
+				upgraded = append(upgraded, r.Name)
+			}
+
+			if d := cmp.Diff(tc.upgraded, upgraded); d != "" {
+				t.Errorf("unexpected upgrades: want (-), got (+): %s", d)
+			}
+		})
+	}
+}
+
+func TestSync_NeedsCycle(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+repositories:
+- name: stable
+  url: https://charts.helm.sh/stable
+releases:
+- name: a
+  chart: stable/a
+  needs:
+  - b
+- name: b
+  chart: stable/b
+  needs:
+  - a
+`,
+	}
+
+	app := appWithFs(&App{
+		OverrideHelmBinary:  DefaultHelmBinary,
+		glob:                filepath.Glob,
+		abs:                 filepath.Abs,
+		OverrideKubeContext: "default",
+		Env:                 "default",
+		Logger:              helmexec.NewLogger(os.Stderr, "debug"),
+	}, files)
+
+	// The cycle must be detected before adding the repository, which would panic
+	expectNoCallsToHelm(app)
 
-	for i := range wantReleases {
-		if wantReleases[i].name != helm.templated[i].name {
-			t.Errorf("name = [%v], want %v", helm.templated[i].name, wantReleases[i].name)
-		}
-		if !strings.Contains(helm.templated[i].chart, wantReleases[i].chart) {
-			t.Errorf("chart = [%v], want %v", helm.templated[i].chart, wantReleases[i].chart)
-		}
-		for j := range wantReleases[i].flags {
-			if j == 9 {
-				matched, _ := regexp.Match(wantReleases[i].flags[j], []byte(helm.templated[i].flags[j]))
-				if !matched {
-					t.Errorf("HelmState.TemplateReleases() = [%v], want %v", helm.templated[i].flags[j], wantReleases[i].flags[j])
-				}
-			} else if wantReleases[i].flags[j] != helm.templated[i].flags[j] {
-				t.Errorf("HelmState.TemplateReleases() = [%v], want %v", helm.templated[i].flags[j], wantReleases[i].flags[j])
-			}
-		}
+	err := app.Sync(applyConfig{concurrency: 1})
 
+	want := "in ./helmfile.yaml: cycle detected: default//a -> default//b -> default//a"
+	if err == nil || err.Error() != want {
+		t.Errorf("unexpected error: want %q, got %v", want, err)
 	}
 }
 
@@ -4785,6 +5850,303 @@ releases:
 		"state should contain source helmfile name:\n%s\n", out)
 }
 
+func TestPrint_Output(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+releases:
+- name: myrelease1
+  chart: mychart1
+  version: 1.0.0
+  setString:
+  - name: foo
+    value: "1"
+- name: myrelease2
+  chart: mychart2
+  installed: false
+  labels:
+    tier: backend
+`,
+	}
+
+	type compiledState struct {
+		Releases []state.ReleaseSpec `yaml:"releases"`
+	}
+
+	printState := func(t *testing.T, output string) (string, error) {
+		t.Helper()
+
+		app := appWithFs(&App{
+			OverrideHelmBinary:  DefaultHelmBinary,
+			glob:                filepath.Glob,
+			abs:                 filepath.Abs,
+			OverrideKubeContext: "default",
+			Env:                 "default",
+			Logger:              helmexec.NewLogger(io.Discard, "debug"),
+			Namespace:           "testNamespace",
+		}, files)
+
+		expectNoCallsToHelm(app)
+
+		var err error
+		out := captureStdout(func() {
+			err = app.PrintState(configImpl{output: output})
+		})
+
+		return out, err
+	}
+
+	yamlOut, err := printState(t, "yaml")
+	assert.NilError(t, err)
+
+	var fromYaml compiledState
+	if err := yaml.Unmarshal([]byte(yamlOut), &fromYaml); err != nil {
+		t.Fatalf("unexpected error parsing yaml output: %v\n%s", err, yamlOut)
+	}
+
+	jsonOut, err := printState(t, "json")
+	assert.NilError(t, err)
+
+	var raw []json.RawMessage
+	if err := json.Unmarshal([]byte(jsonOut), &raw); err != nil {
+		t.Fatalf("unexpected error parsing json output: %v\n%s", err, jsonOut)
+	}
+
+	if len(raw) != 1 {
+		t.Fatalf("unexpected number of states: want 1, got %d", len(raw))
+	}
+
+	// JSON is a subset of YAML, so that the state in JSON can be read in the same way as helmfile reads helmfile.yaml
+	var fromJson compiledState
+	if err := yaml.Unmarshal(raw[0], &fromJson); err != nil {
+		t.Fatalf("unexpected error parsing json output: %v\n%s", err, jsonOut)
+	}
+
+	if len(fromJson.Releases) != 2 {
+		t.Fatalf("unexpected number of releases: want 2, got %d", len(fromJson.Releases))
+	}
+
+	if d := cmp.Diff(fromYaml.Releases, fromJson.Releases, cmp.AllowUnexported(state.ReleaseSpec{})); d != "" {
+		t.Errorf("unexpected releases in json output: want (-), got (+):\n%s", d)
+	}
+
+	tableOut, err := printState(t, "table")
+	assert.NilError(t, err)
+
+	wantTable := `NAME        NAMESPACE  CHART     VERSION  INSTALLED  HELMFILE
+myrelease1             mychart1  1.0.0    true       helmfile.yaml
+myrelease2             mychart2           false      helmfile.yaml
+`
+	if d := cmp.Diff(wantTable, tableOut); d != "" {
+		t.Errorf("unexpected table output: want (-), got (+):\n%s", d)
+	}
+
+	_, err = printState(t, "xml")
+	if err == nil || err.Error() != `unsupported output format "xml": it must be one of "yaml", "json" or "table"` {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+type decryptingHelmExec struct {
+	*mockHelmExec
+}
+
+func (helm *decryptingHelmExec) DecryptSecret(context helmexec.HelmContext, name string, flags ...string) (string, error) {
+	return name + ".dec", nil
+}
+
+func TestPrint_EmbedSecrets(t *testing.T) {
+	testcases := []struct {
+		name       string
+		config     configImpl
+		wantErr    string
+		wantOut    []string
+		notWantOut []string
+	}{
+		{
+			name:   "encrypted",
+			config: configImpl{embedValues: true},
+			wantOut: []string{
+				"#  Secrets: embedded as encrypted",
+				"replicas: 2",
+				"secrets:",
+				"password: ENC[AES256_GCM,data:abc]",
+			},
+			notWantOut: []string{"password: decrypted"},
+		},
+		{
+			name:   "decrypted",
+			config: configImpl{embedValues: true, embedSecretsDecrypted: true},
+			wantOut: []string{
+				"#  Secrets: decrypted and embedded into values in plain text",
+				"replicas: 2",
+				"password: decrypted",
+			},
+			notWantOut: []string{"secrets:", "ENC["},
+		},
+		{
+			name:    "decrypted without embedding values",
+			config:  configImpl{embedSecretsDecrypted: true},
+			wantErr: "--embed-secrets-decrypted requires --embed-values",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			files := map[string]string{
+				"/path/to/helmfile.yaml": `
+releases:
+- name: myrelease1
+  chart: mychart1
+  values:
+  - values.yaml
+  secrets:
+  - secrets.yaml
+`,
+				"/path/to/values.yaml":      "replicas: 2",
+				"/path/to/secrets.yaml":     "password: ENC[AES256_GCM,data:abc]",
+				"/path/to/secrets.yaml.dec": "password: decrypted",
+			}
+
+			app := appWithFs(&App{
+				OverrideHelmBinary:  DefaultHelmBinary,
+				glob:                filepath.Glob,
+				abs:                 filepath.Abs,
+				OverrideKubeContext: "default",
+				Env:                 "default",
+				Logger:              helmexec.NewLogger(io.Discard, "debug"),
+				helms: map[helmKey]helmexec.Interface{
+					createHelmKey("helm", "default"): &decryptingHelmExec{mockHelmExec: &mockHelmExec{}},
+				},
+				Namespace: "testNamespace",
+			}, files)
+
+			var err error
+			out := captureStdout(func() {
+				err = app.PrintState(tc.config)
+			})
+
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("unexpected error: want %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			for _, w := range tc.wantOut {
+				if !strings.Contains(out, w) {
+					t.Errorf("output should contain %q:\n%s", w, out)
+				}
+			}
+
+			for _, w := range tc.notWantOut {
+				if strings.Contains(out, w) {
+					t.Errorf("output should not contain %q:\n%s", w, out)
+				}
+			}
+		})
+	}
+}
+
+func TestVisitDesiredStatesWithReleasesFiltered_EnvironmentSecrets(t *testing.T) {
+	testcases := []struct {
+		name    string
+		backend string
+		secrets string
+	}{
+		{
+			name:    "helm-secrets",
+			secrets: "dbPassword: ENC[AES256_GCM,data:abc]",
+		},
+		{
+			name:    "vals",
+			backend: "vals",
+			secrets: "dbPassword: ref+echo://s3cr3t-password",
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			files := map[string]string{
+				"/path/to/helmfile.yaml": `
+environments:
+  default:
+    values:
+    - dbPassword: overridden-by-secrets
+      dbUser: app
+    secrets:
+    - secrets.yaml
+    secretsBackend: ` + tc.backend + `
+
+releases:
+- name: myapp
+  chart: mychart
+  set:
+  - name: db.user
+    value: {{ .Values.dbUser }}
+  - name: db.password
+    value: {{ .Environment.Values.dbPassword }}
+  - name: db.passwordFromValues
+    value: {{ .Values.dbPassword }}
+`,
+				"/path/to/secrets.yaml":     tc.secrets,
+				"/path/to/secrets.yaml.dec": "dbPassword: s3cr3t-password",
+			}
+
+			valsRuntime, err := vals.New(vals.Options{CacheSize: 32})
+			if err != nil {
+				t.Fatalf("unexpected error creating vals runtime: %v", err)
+			}
+
+			var logs bytes.Buffer
+
+			app := appWithFs(&App{
+				OverrideHelmBinary:  DefaultHelmBinary,
+				OverrideKubeContext: "default",
+				Env:                 "default",
+				Logger:              helmexec.NewLogger(&logs, "debug"),
+				FileOrDir:           "helmfile.yaml",
+				helms: map[helmKey]helmexec.Interface{
+					createHelmKey("helm", ""):        &decryptingHelmExec{mockHelmExec: &mockHelmExec{}},
+					createHelmKey("helm", "default"): &decryptingHelmExec{mockHelmExec: &mockHelmExec{}},
+				},
+				valsRuntime: valsRuntime,
+			}, files)
+			app.deleteFile = func(string) error { return nil }
+
+			var sets []state.SetValue
+
+			err = app.ForEachState(func(run *Run) (bool, []error) {
+				for _, r := range run.state.Releases {
+					sets = append(sets, r.SetValues...)
+				}
+				return true, nil
+			}, false, SetFilter(true))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			want := []state.SetValue{
+				{Name: "db.user", Value: "app"},
+				{Name: "db.password", Value: "s3cr3t-password"},
+				{Name: "db.passwordFromValues", Value: "s3cr3t-password"},
+			}
+			if d := cmp.Diff(want, sets); d != "" {
+				t.Errorf("unexpected set values: want (-), got (+):\n%s", d)
+			}
+
+			if strings.Contains(logs.String(), "s3cr3t-password") {
+				t.Errorf("the decrypted secret should not appear in the logs:\n%s", logs.String())
+			}
+		})
+	}
+}
+
 func TestList(t *testing.T) {
 	files := map[string]string{
 		"/path/to/helmfile.d/first.yaml": `
@@ -4839,16 +6201,94 @@ releases:
 		assert.NilError(t, err)
 	})
 
-	expected := `NAME      	NAMESPACE	ENABLED	INSTALLED	LABELS                    	CHART   	VERSION
-myrelease1	         	true   	false    	common:label,id:myrelease1	mychart1	       
-myrelease2	         	false  	true     	common:label              	mychart1	       
-myrelease3	         	true   	true     	                          	mychart1	       
-myrelease4	         	true   	true     	id:myrelease1             	mychart1	       
+	expected := `NAME      	NAMESPACE	ENABLED	INSTALLED	LABELS                    	CHART   	VERSION	ID                              
+myrelease1	         	true   	false    	common:label,id:myrelease1	mychart1	       	default/testNamespace/myrelease1
+myrelease2	         	false  	true     	common:label              	mychart1	       	default/testNamespace/myrelease2
+myrelease3	         	true   	true     	                          	mychart1	       	default/testNamespace/myrelease3
+myrelease4	         	true   	true     	id:myrelease1             	mychart1	       	default/testNamespace/myrelease4
 `
 
 	assert.Equal(t, expected, out)
 }
 
+func TestListWithWideOutput(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.d/first.yaml": `
+releases:
+- name: myrelease1
+  chart: mychart1
+  version: 1.2.3
+- name: myrelease2
+  namespace: ns2
+  chart: stable/mychart2
+  version: ~2.0
+`,
+		"/path/to/helmfile.d/first.versions.lock": `
+version: v0.0.0
+releases:
+- id: default/ns2/myrelease2
+  chart: stable/mychart2
+  versionConstraint: ~2.0
+  version: 2.0.5
+`,
+		"/path/to/helmfile.d/second.yaml": `
+namespace: ns3
+releases:
+- name: myrelease3
+  chart: ./mychart3
+`,
+	}
+
+	testcases := []struct {
+		output   string
+		expected string
+	}{
+		{
+			output: "wide",
+			expected: `NAME      	NAMESPACE	NAMESPACE SOURCE	ENABLED	INSTALLED	LABELS	CHART          	VERSION	RESOLVED VERSION	ID                    	HELMFILE   
+myrelease1	         	default         	true   	true     	      	mychart1       	1.2.3  	1.2.3           	default//myrelease1   	first.yaml 
+myrelease2	ns2      	release         	true   	true     	      	stable/mychart2	~2.0   	2.0.5           	default/ns2/myrelease2	first.yaml 
+myrelease3	ns3      	override        	true   	true     	      	./mychart3     	       	                	default/ns3/myrelease3	second.yaml
+`,
+		},
+		{
+			output: "json,wide",
+			expected: `[{"name":"myrelease1","namespace":"","enabled":true,"installed":true,"labels":"","chart":"mychart1","version":"1.2.3","id":"default//myrelease1","resolvedVersion":"1.2.3","namespaceSource":"default","helmfile":"first.yaml"},{"name":"myrelease2","namespace":"ns2","enabled":true,"installed":true,"labels":"","chart":"stable/mychart2","version":"~2.0","id":"default/ns2/myrelease2","resolvedVersion":"2.0.5","namespaceSource":"release","helmfile":"first.yaml"},{"name":"myrelease3","namespace":"ns3","enabled":true,"installed":true,"labels":"","chart":"./mychart3","version":"","id":"default/ns3/myrelease3","namespaceSource":"override","helmfile":"second.yaml"}]
+`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.output, func(t *testing.T) {
+			stdout := os.Stdout
+			defer func() { os.Stdout = stdout }()
+
+			var buffer bytes.Buffer
+			logger := helmexec.NewLogger(&buffer, "debug")
+
+			app := appWithFs(&App{
+				OverrideHelmBinary:  DefaultHelmBinary,
+				glob:                filepath.Glob,
+				abs:                 filepath.Abs,
+				OverrideKubeContext: "default",
+				Env:                 "default",
+				Logger:              logger,
+			}, files)
+
+			expectNoCallsToHelmVersion(app, true)
+
+			out := captureStdout(func() {
+				err := app.ListReleases(configImpl{
+					output: tc.output,
+				})
+				assert.NilError(t, err)
+			})
+
+			assert.Equal(t, tc.expected, out)
+		})
+	}
+}
+
 func TestListWithJsonOutput(t *testing.T) {
 	files := map[string]string{
 		"/path/to/helmfile.d/first.yaml": `
@@ -4903,8 +6343,74 @@ releases:
 		assert.NilError(t, err)
 	})
 
-	expected := `[{"name":"myrelease1","namespace":"","enabled":true,"installed":false,"labels":"id:myrelease1","chart":"mychart1","version":""},{"name":"myrelease2","namespace":"","enabled":false,"installed":true,"labels":"","chart":"mychart1","version":""},{"name":"myrelease3","namespace":"","enabled":true,"installed":true,"labels":"","chart":"mychart1","version":""},{"name":"myrelease4","namespace":"","enabled":true,"installed":true,"labels":"id:myrelease1","chart":"mychart1","version":""}]
+	expected := `[{"name":"myrelease1","namespace":"","enabled":true,"installed":false,"labels":"id:myrelease1","chart":"mychart1","version":"","id":"default/testNamespace/myrelease1"},{"name":"myrelease2","namespace":"","enabled":false,"installed":true,"labels":"","chart":"mychart1","version":"","id":"default/testNamespace/myrelease2"},{"name":"myrelease3","namespace":"","enabled":true,"installed":true,"labels":"","chart":"mychart1","version":"","id":"default/testNamespace/myrelease3"},{"name":"myrelease4","namespace":"","enabled":true,"installed":true,"labels":"id:myrelease1","chart":"mychart1","version":"","id":"default/testNamespace/myrelease4"}]
+`
+	assert.Equal(t, expected, out)
+}
+
+func TestListWithClusterState(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+releases:
+- name: foo
+  chart: mychart1
+  labels:
+    group: a
+- name: bar
+  chart: mychart1
+  labels:
+    group: a
+- name: baz
+  chart: mychart1
+  installed: false
+  labels:
+    group: a
+- name: qux
+  chart: mychart1
+  labels:
+    group: b
+`,
+	}
+
+	helm := &exectest.Helm{
+		FailOnUnexpectedList: true,
+		Lists: map[exectest.ListKey]string{
+			{Filter: "^foo$", Flags: helmV2ListFlags}: `NAME	REVISION	UPDATED                 	STATUS  	CHART        	APP VERSION	NAMESPACE
+foo 	4       	Fri Nov  1 08:40:07 2019	DEPLOYED	mychart1-3.1.0	3.1.0      	default
+`,
+			{Filter: "^bar$", Flags: helmV2ListFlags}: ``,
+			{Filter: "^baz$", Flags: helmV2ListFlags}: `NAME	REVISION	UPDATED                 	STATUS  	CHART        	APP VERSION	NAMESPACE
+baz 	2       	Fri Nov  1 08:40:07 2019	FAILED	mychart1-3.1.0	3.1.0      	default
+`,
+		},
+		ListsMutex: &sync.Mutex{},
+	}
+
+	app := appWithFs(&App{
+		OverrideHelmBinary:  DefaultHelmBinary,
+		OverrideKubeContext: "default",
+		Env:                 "default",
+		Logger:              helmexec.NewLogger(io.Discard, "debug"),
+		// qux is not listed, as it doesn't match the selector
+		Selectors: []string{"group=a"},
+		helms: map[helmKey]helmexec.Interface{
+			createHelmKey("helm", "default"): helm,
+		},
+	}, files)
+
+	out := captureStdout(func() {
+		err := app.ListReleases(configImpl{
+			clusterState: true,
+		})
+		assert.NilError(t, err)
+	})
+
+	expected := `NAME	NAMESPACE	ENABLED	INSTALLED	ACTUAL   	LABELS                                    	CHART   	VERSION	ID          
+foo 	         	true   	true     	deployed 	chart:mychart1,group:a,name:foo,namespace:	mychart1	       	default//foo
+bar 	         	true   	true     	not-found	chart:mychart1,group:a,name:bar,namespace:	mychart1	       	default//bar
+baz 	         	true   	false    	failed   	chart:mychart1,group:a,name:baz,namespace:	mychart1	       	default//baz
 `
+
 	assert.Equal(t, expected, out)
 }
 
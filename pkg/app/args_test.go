@@ -0,0 +1,152 @@
+package app
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+	"github.com/variantdev/vals"
+)
+
+// helm3Runner succeeds any helm command, reporting helm 3 for `helm version`
+type helm3Runner struct{}
+
+func (r *helm3Runner) Execute(cmd string, args []string, env map[string]string) ([]byte, error) {
+	for _, a := range args {
+		if a == "version" {
+			return []byte("v3.8.0+gd141386"), nil
+		}
+	}
+	return []byte{}, nil
+}
+
+func (r *helm3Runner) ExecuteStdIn(cmd string, args []string, env map[string]string, stdin io.Reader) ([]byte, error) {
+	return r.Execute(cmd, args, env)
+}
+
+func TestSync_Args(t *testing.T) {
+	const releases = `
+releases:
+- name: myapp
+  chart: incubator/raw
+  namespace: default
+  timeout: 300
+  set:
+  - name: replicas
+    value: 2
+`
+
+	testcases := []struct {
+		name         string
+		helmDefaults string
+		args         string
+		extraArgs    string
+		want         string
+	}{
+		{
+			name: "no args",
+			want: "upgrade --install --reset-values myapp incubator/raw --timeout 300s --create-namespace --kube-context default --namespace default --set replicas=2 --history-max 10",
+		},
+		{
+			name: "args override the timeout of the release",
+			args: "--timeout 600s",
+			want: "upgrade --install --reset-values myapp incubator/raw --create-namespace --kube-context default --namespace default --set replicas=2 --history-max 10 --timeout 600s",
+		},
+		{
+			name: "args override the timeout of the release with =",
+			args: "--timeout=600s",
+			want: "upgrade --install --reset-values myapp incubator/raw --create-namespace --kube-context default --namespace default --set replicas=2 --history-max 10 --timeout=600s",
+		},
+		{
+			name: "args add to the values of the release",
+			args: "--set image.tag=v2",
+			want: "upgrade --install --reset-values myapp incubator/raw --timeout 300s --create-namespace --kube-context default --namespace default --set replicas=2 --history-max 10 --set image.tag=v2",
+		},
+		{
+			name:      "extra args are appended as is",
+			extraArgs: "--timeout 600s",
+			want:      "upgrade --install --reset-values myapp incubator/raw --timeout 300s --create-namespace --kube-context default --namespace default --set replicas=2 --history-max 10 --timeout 600s",
+		},
+		{
+			name:      "extra args are appended as shell words",
+			extraArgs: `-f values.yaml --set-string a=1 --set-string b=2 --description "deployed by ci"`,
+			want:      "upgrade --install --reset-values myapp incubator/raw --timeout 300s --create-namespace --kube-context default --namespace default --set replicas=2 --history-max 10 -f values.yaml --set-string a=1 --set-string b=2 --description deployed by ci",
+		},
+		{
+			name: "helmDefaults.args override the timeout of the release",
+			helmDefaults: `
+helmDefaults:
+  args:
+  - --timeout=600s
+`,
+			want: "upgrade --install --reset-values myapp incubator/raw --create-namespace --kube-context default --namespace default --set replicas=2 --history-max 10 --timeout=600s",
+		},
+		{
+			name: "args take precedence over helmDefaults.args",
+			helmDefaults: `
+helmDefaults:
+  args:
+  - --timeout=600s
+`,
+			args: "--timeout 900s",
+			want: "upgrade --install --reset-values myapp incubator/raw --create-namespace --kube-context default --namespace default --set replicas=2 --history-max 10 --timeout 900s",
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			logger := helmexec.NewLogger(io.Discard, "debug")
+
+			valsRuntime, err := vals.New(vals.Options{CacheSize: 32})
+			if err != nil {
+				t.Fatalf("unexpected error creating vals runtime: %v", err)
+			}
+
+			recorder := &helmexec.CommandRecorder{}
+
+			app := appWithFs(&App{
+				OverrideHelmBinary:  DefaultHelmBinary,
+				glob:                filepath.Glob,
+				abs:                 filepath.Abs,
+				OverrideKubeContext: "default",
+				Env:                 "default",
+				Logger:              logger,
+				helms: map[helmKey]helmexec.Interface{
+					createHelmKey("helm", "default"): helmexec.New("helm", logger, "default", &helmexec.RecordingRunner{
+						Runner:   &helm3Runner{},
+						Recorder: recorder,
+					}),
+				},
+				valsRuntime: valsRuntime,
+			}, map[string]string{
+				"/path/to/helmfile.yaml": tc.helmDefaults + releases,
+			})
+
+			if err := app.Sync(applyConfig{
+				args:        tc.args,
+				extraArgs:   tc.extraArgs,
+				concurrency: 1,
+				logger:      logger,
+			}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var upgrades []string
+			for _, r := range recorder.Records() {
+				line := strings.Join(r.Args, " ")
+				if strings.Contains(line, " upgrade ") {
+					upgrades = append(upgrades, line)
+				}
+			}
+
+			want := "--kube-context default " + tc.want
+			if len(upgrades) != 1 || upgrades[0] != want {
+				t.Errorf("unexpected helm upgrade: want %q, got %q", want, upgrades)
+			}
+		})
+	}
+}
@@ -2,32 +2,65 @@ package app
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"strings"
+
+	"github.com/mattn/go-isatty"
 )
 
 // Copyright (c) 2017 Roland Singer [roland.singer@desertbit.com]
 //
 // Shamelessly borrowed from @r0l1's awesome work that is available at https://gist.github.com/r0l1/3dcbb0c8f6cfe9c66ab8008f55f8f28b
 func AskForConfirmation(s string) bool {
-	reader := bufio.NewReader(os.Stdin)
+	confirmed, err := askForConfirmation(os.Stdin, os.Stdout, s)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return confirmed
+}
+
+func askForConfirmation(in io.Reader, out io.Writer, s string) (bool, error) {
+	reader := bufio.NewReader(in)
 
 	for {
-		fmt.Printf("%s [y/n]: ", s)
+		fmt.Fprintf(out, "%s [y/n]: ", s)
 
 		response, err := reader.ReadString('\n')
-		if err != nil {
-			log.Fatal(err)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return false, err
 		}
 
 		response = strings.ToLower(strings.TrimSpace(response))
 
 		if response == "y" || response == "yes" {
-			return true
+			return true, nil
 		} else if response == "n" || response == "no" {
-			return false
+			return false, nil
+		}
+
+		if err != nil {
+			return false, errors.New("no answer was given to the confirmation prompt")
 		}
 	}
 }
+
+// confirm asks the user for confirmation, reading the answer from the stdin of the app.
+// It returns an error when stdout isn't a terminal, instead of waiting for an answer that may never come.
+func (a *App) confirm(msg string) (bool, error) {
+	if !a.isTerminal() {
+		return false, errors.New("--interactive requires a terminal to ask for confirmation. Run it in a terminal, or without --interactive")
+	}
+
+	return askForConfirmation(a.stdin, a.stdout, msg)
+}
+
+func isTerminal() bool {
+	fd := os.Stdout.Fd()
+
+	return isatty.IsTerminal(fd) || isatty.IsCygwinTerminal(fd)
+}
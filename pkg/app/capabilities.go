@@ -0,0 +1,65 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// capabilitySet is an entry of the YAML list in the file given to `helmfile template --capabilities-file`,
+// like `{name: k8s-1.27, kubeVersion: v1.27.0, apiVersions: [monitoring.coreos.com/v1]}`.
+// The releases are templated once per capability set, into the subdirectory of --output-dir named after the set.
+type capabilitySet struct {
+	Name        string   `yaml:"name,omitempty"`
+	KubeVersion string   `yaml:"kubeVersion,omitempty"`
+	ApiVersions []string `yaml:"apiVersions,omitempty"`
+}
+
+// dirName returns the name of the subdirectory of --output-dir the releases are templated into for the set
+func (s capabilitySet) dirName() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return "kube-" + s.KubeVersion
+}
+
+func (a *App) readCapabilitiesFile(path string) ([]capabilitySet, error) {
+	bs, err := a.readFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading capabilities file %s: %w", path, err)
+	}
+
+	var sets []capabilitySet
+	if err := yaml.UnmarshalStrict(bs, &sets); err != nil {
+		return nil, fmt.Errorf("parsing capabilities file %s: %w", path, err)
+	}
+
+	if len(sets) == 0 {
+		return nil, fmt.Errorf("capabilities file %s defines no capability set", path)
+	}
+
+	seen := map[string]bool{}
+
+	for i, s := range sets {
+		if s.KubeVersion == "" && len(s.ApiVersions) == 0 {
+			return nil, fmt.Errorf("capabilities file %s: entry %d has neither kubeVersion nor apiVersions", path, i)
+		}
+
+		if s.Name == "" && s.KubeVersion == "" {
+			return nil, fmt.Errorf("capabilities file %s: entry %d needs a name as it has no kubeVersion", path, i)
+		}
+
+		dir := s.dirName()
+		if strings.ContainsAny(dir, `/\`) || dir == "." || dir == ".." {
+			return nil, fmt.Errorf("capabilities file %s: entry %d: %q can't be used as a directory name", path, i, dir)
+		}
+
+		if seen[dir] {
+			return nil, fmt.Errorf("capabilities file %s: entry %d: duplicate capability set %q", path, i, dir)
+		}
+		seen[dir] = true
+	}
+
+	return sets, nil
+}
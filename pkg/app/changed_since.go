@@ -0,0 +1,142 @@
+package app
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/roboll/helmfile/pkg/state"
+)
+
+// loadChangedFiles lists the files changed since a.ChangedSince once, so that the releases in every state file are selected by them.
+// It does nothing when a.ChangedSince is empty.
+func (a *App) loadChangedFiles() error {
+	if a.ChangedSince == "" || a.changedFiles != nil {
+		return nil
+	}
+
+	files, err := a.gitChangedFiles(a.ChangedSince)
+	if err != nil {
+		return fmt.Errorf("listing the files changed since %s: %w", a.ChangedSince, err)
+	}
+
+	a.changedFiles = map[string]bool{}
+	for _, f := range files {
+		a.changedFiles[filepath.Clean(f)] = true
+	}
+
+	a.Logger.Debugf("%d files changed since %s", len(files), a.ChangedSince)
+
+	return nil
+}
+
+// selectChangedReleases augments the selectors of the templated state so that only the releases whose local chart or
+// values files have changed since a.ChangedSince are selected, along with their needs.
+// All the releases are left selected when any file the whole state depends on, like the state file itself, has changed.
+func (a *App) selectChangedReleases(st *state.HelmState) error {
+	stateFiles, err := st.StateSourceFiles()
+	if err != nil {
+		return err
+	}
+
+	changed, err := a.changedSourceFile(stateFiles)
+	if err != nil {
+		return err
+	}
+	if changed != "" {
+		a.Logger.Debugf("selecting all the releases in %s, as %s has changed since %s", st.FilePath, changed, a.ChangedSince)
+		return nil
+	}
+
+	var changedSelectors []string
+
+	for _, r := range st.GetReleasesWithOverrides() {
+		release := r
+
+		files, err := st.ReleaseSourceFiles(&release)
+		if err != nil {
+			return err
+		}
+
+		changed, err := a.changedSourceFile(files)
+		if err != nil {
+			return err
+		}
+		if changed != "" {
+			a.Logger.Debugf("selecting release %s, as %s has changed since %s", state.ReleaseToID(&release), changed, a.ChangedSince)
+			changedSelectors = append(changedSelectors, releaseSelector(&release))
+		}
+	}
+
+	if len(changedSelectors) == 0 {
+		// The releases are deselected rather than removed, so that --purge-orphans doesn't take them for orphans
+		st.Selectors = []string{noReleaseSelector}
+		return nil
+	}
+
+	// The needs of the changed releases are selected as well, as the changed releases may not be installable without them
+	withNeeds := *st
+	withNeeds.Selectors = changedSelectors
+	withNeeds.ExcludeSelectors = nil
+
+	selected, err := withNeeds.GetSelectedReleasesWithOverrides(true)
+	if err != nil {
+		return err
+	}
+
+	var selectors []string
+	for _, r := range selected {
+		release := r
+		selector := releaseSelector(&release)
+
+		if len(st.Selectors) == 0 {
+			selectors = append(selectors, selector)
+			continue
+		}
+
+		// The changed releases are further narrowed down by --selector
+		for _, s := range st.Selectors {
+			selectors = append(selectors, s+","+selector)
+		}
+	}
+
+	st.Selectors = selectors
+
+	return nil
+}
+
+// changedSourceFile returns the first of the files that has changed, or contains a changed file when it's a directory,
+// or "" when none of them has changed
+func (a *App) changedSourceFile(files []string) (string, error) {
+	for _, f := range files {
+		abs, err := a.abs(f)
+		if err != nil {
+			return "", err
+		}
+
+		if a.changedFiles[abs] {
+			return f, nil
+		}
+
+		dir := abs + string(filepath.Separator)
+		for changed := range a.changedFiles {
+			if strings.HasPrefix(changed, dir) {
+				return f, nil
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// noReleaseSelector is the selector matching no release, as no label can be both equal and not equal to the same value
+const noReleaseSelector = "name=none,name!=none"
+
+// releaseSelector returns the selector matching the release by its name and namespace
+func releaseSelector(r *state.ReleaseSpec) string {
+	selector := "name=" + r.Name
+	if r.Namespace != "" {
+		selector += ",namespace=" + r.Namespace
+	}
+	return selector
+}
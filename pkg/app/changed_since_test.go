@@ -0,0 +1,148 @@
+package app
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+func TestVisitDesiredStatesWithReleasesFiltered_ChangedSince(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+environments:
+  default:
+    values:
+    - env/default.yaml
+
+releases:
+- name: frontend
+  namespace: web
+  chart: stable/frontend
+  values:
+  - values/frontend.yaml
+  needs:
+  - data/backend
+- name: backend
+  namespace: data
+  chart: ./charts/backend
+  values:
+  - values/{{ "{{" }} .Environment.Name {{ "}}" }}/backend.yaml
+- name: zipkin
+  chart: stable/zipkin
+  secrets:
+  - secrets/zipkin.yaml
+`,
+		"/path/to/env/default.yaml":            "{}",
+		"/path/to/values/frontend.yaml":        "{}",
+		"/path/to/values/default/backend.yaml": "{}",
+		"/path/to/secrets/zipkin.yaml":         "{}",
+	}
+
+	testcases := []struct {
+		name      string
+		changed   []string
+		gitErr    error
+		selectors []string
+		want      []string
+		wantErr   string
+	}{
+		{
+			name:    "values file of a release with needs",
+			changed: []string{"/path/to/values/frontend.yaml"},
+			want:    []string{"frontend", "backend"},
+		},
+		{
+			name:    "templated values file",
+			changed: []string{"/path/to/values/default/backend.yaml"},
+			want:    []string{"backend"},
+		},
+		{
+			name:    "file in local chart",
+			changed: []string{"/path/to/charts/backend/templates/deployment.yaml"},
+			want:    []string{"backend"},
+		},
+		{
+			name:    "secrets file",
+			changed: []string{"/path/to/secrets/zipkin.yaml"},
+			want:    []string{"zipkin"},
+		},
+		{
+			name:    "environment values file shared by all the releases",
+			changed: []string{"/path/to/env/default.yaml"},
+			want:    []string{"frontend", "backend", "zipkin"},
+		},
+		{
+			name:    "state file",
+			changed: []string{"/path/to/helmfile.yaml"},
+			want:    []string{"frontend", "backend", "zipkin"},
+		},
+		{
+			name:    "unrelated file",
+			changed: []string{"/path/to/README.md", "/path/to/charts/backend-v2/Chart.yaml"},
+		},
+		{
+			name:      "narrowed by selector",
+			changed:   []string{"/path/to/values/frontend.yaml"},
+			selectors: []string{"name=frontend"},
+			want:      []string{"frontend"},
+		},
+		{
+			name:    "git failure",
+			gitErr:  errors.New("bad revision"),
+			wantErr: "listing the files changed since origin/main: bad revision",
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			app := appWithFs(&App{
+				OverrideHelmBinary:  DefaultHelmBinary,
+				OverrideKubeContext: "default",
+				Logger:              helmexec.NewLogger(os.Stderr, "debug"),
+				Selectors:           tc.selectors,
+				Env:                 "default",
+				FileOrDir:           "helmfile.yaml",
+				ChangedSince:        "origin/main",
+			}, files)
+
+			app.gitChangedFiles = func(ref string) ([]string, error) {
+				if ref != "origin/main" {
+					t.Errorf("unexpected ref: %s", ref)
+				}
+				return tc.changed, tc.gitErr
+			}
+
+			expectNoCallsToHelm(app)
+
+			var releases []string
+
+			err := app.ForEachState(func(run *Run) (bool, []error) {
+				for _, r := range run.state.Releases {
+					releases = append(releases, r.Name)
+				}
+				return len(run.state.Releases) > 0, nil
+			}, false, SetFilter(true))
+
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("unexpected error: want %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if d := cmp.Diff(tc.want, releases); d != "" {
+				t.Errorf("unexpected releases: want (-), got (+):\n%s", d)
+			}
+		})
+	}
+}
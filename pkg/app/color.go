@@ -0,0 +1,42 @@
+package app
+
+import (
+	"fmt"
+	"os"
+)
+
+const (
+	// ColorAuto colors the output only when stdout is a terminal
+	ColorAuto = "auto"
+	// ColorAlways colors the output even when it is redirected to a file or a pipe
+	ColorAlways = "always"
+	// ColorNever never colors the output
+	ColorNever = "never"
+)
+
+// ResolveColor tells whether the output of helmfile and helm-diff should be colored for the value of --color.
+// noColor is the value of --no-color, which is the same as `--color never` and takes precedence over --color.
+// `auto` colors the output only when stdout is a terminal other than a dumb one, and NO_COLOR is not set.
+func ResolveColor(mode string, noColor bool, isTerminal func() bool) (bool, error) {
+	switch mode {
+	case "", ColorAuto:
+		if noColor {
+			return false, nil
+		}
+		if _, ok := os.LookupEnv("NO_COLOR"); ok || os.Getenv("TERM") == "dumb" {
+			return false, nil
+		}
+		return isTerminal(), nil
+	case ColorAlways:
+		return !noColor, nil
+	case ColorNever:
+		return false, nil
+	}
+
+	return false, fmt.Errorf("unsupported color %q: it must be one of %s, %s, or %s", mode, ColorAuto, ColorAlways, ColorNever)
+}
+
+// ColorTerminal is the isTerminal func given to ResolveColor to tell whether stdout is a terminal
+func ColorTerminal() bool {
+	return isTerminal()
+}
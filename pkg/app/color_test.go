@@ -0,0 +1,57 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestResolveColor(t *testing.T) {
+	testcases := []struct {
+		mode     string
+		noColor  bool
+		terminal bool
+		env      map[string]string
+		want     bool
+		wantErr  string
+	}{
+		{mode: "", terminal: true, want: true},
+		{mode: "auto", terminal: true, want: true},
+		{mode: "auto", terminal: false, want: false},
+		{mode: "auto", terminal: true, noColor: true, want: false},
+		{mode: "auto", terminal: true, env: map[string]string{"NO_COLOR": "1"}, want: false},
+		{mode: "auto", terminal: true, env: map[string]string{"TERM": "dumb"}, want: false},
+		{mode: "always", terminal: false, want: true},
+		{mode: "always", terminal: false, noColor: true, want: false},
+		{mode: "never", terminal: true, want: false},
+		{mode: "sometimes", wantErr: `unsupported color "sometimes": it must be one of auto, always, or never`},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(fmt.Sprintf("%d: %s", i, tc.mode), func(t *testing.T) {
+			t.Setenv("TERM", "xterm")
+			t.Setenv("NO_COLOR", "")
+			os.Unsetenv("NO_COLOR")
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+
+			got, err := ResolveColor(tc.mode, tc.noColor, func() bool { return tc.terminal })
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("unexpected error: want %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.want {
+				t.Errorf("unexpected result: want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
@@ -10,10 +10,25 @@ type ConfigProvider interface {
 	KubeContext() string
 	Namespace() string
 	Chart() string
+	ChartOverrides() []string
+	GlobalNeeds() bool
+	DumpDebugBundle() string
+	DebugBundleShowSecrets() bool
 	Selectors() []string
+	ExcludeSelectors() []string
+	ConcurrencyPerContext() int
+	Quiet() bool
+	SummaryLogger() *zap.SugaredLogger
+	ChangedSince() string
+	MergeValuesStrategy() string
 	StateValuesSet() map[string]interface{}
 	StateValuesFiles() []string
 	Env() string
+	NoHooks() bool
+	EnableExecValues() bool
+	Color() bool
+	Timings() bool
+	TimingsOutput() string
 
 	loggingConfig
 }
@@ -28,28 +43,53 @@ type DeprecatedChartsConfigProvider interface {
 
 type DepsConfigProvider interface {
 	Args() string
+	ExtraArgs() string
 	SkipRepos() bool
 	IncludeTransitiveNeeds() bool
+	OutputFile() string
 }
 
 type ReposConfigProvider interface {
 	Args() string
+	ExtraArgs() string
+	IncludeTransitiveNeeds() bool
+}
+
+type LockConfigProvider interface {
+	Args() string
+	ExtraArgs() string
+	SkipRepos() bool
 	IncludeTransitiveNeeds() bool
 }
 
 type ApplyConfigProvider interface {
 	Args() string
+	ExtraArgs() string
 
 	Values() []string
 	Set() []string
+	SetString() []string
+	SetFile() []string
 	SkipCRDs() bool
+	IncludeCRDs() bool
 	SkipDeps() bool
+	SkipRepos() bool
 	Wait() bool
 	WaitForJobs() bool
+	Atomic() bool
+	CleanupOnFail() bool
+	NoCreateNamespace() bool
+	WaitRetries() int
+	HistoryMax() *int
+	PostSyncStatus() bool
+	FailFast() bool
+	RecordReason() string
 
 	IncludeTests() bool
 
 	Suppress() []string
+	SuppressOutputLineRegex() []string
+	SuppressRelease() []string
 	SuppressSecrets() bool
 	ShowSecrets() bool
 	SuppressDiff() bool
@@ -59,9 +99,14 @@ type ApplyConfigProvider interface {
 	NoColor() bool
 	Context() int
 	DiffOutput() string
+	ValuesOnly() bool
+	ExitCodeOnError() int
+	OutputSummary() string
 
 	RetainValuesFiles() bool
 	Validate() bool
+	ServerSideDiff() bool
+	ValidateValues() bool
 	SkipCleanup() bool
 	SkipDiffOnInstall() bool
 
@@ -69,6 +114,20 @@ type ApplyConfigProvider interface {
 	IncludeNeeds() bool
 	IncludeTransitiveNeeds() bool
 
+	UseLock() bool
+	Preflight() bool
+	Force() bool
+	DryRun() bool
+
+	PurgeOrphans() bool
+	PurgeOrphansNamespaces() []string
+
+	VerboseSummary() bool
+	JUnitReport() string
+
+	KubeVersion() string
+	ApiVersions() []string
+
 	concurrencyConfig
 	interactive
 	loggingConfig
@@ -76,34 +135,73 @@ type ApplyConfigProvider interface {
 
 type SyncConfigProvider interface {
 	Args() string
+	ExtraArgs() string
 
 	Values() []string
 	Set() []string
+	SetString() []string
+	SetFile() []string
 	SkipCRDs() bool
 	SkipDeps() bool
+	SkipRepos() bool
+	ValidateValues() bool
 	Wait() bool
 	WaitForJobs() bool
+	Atomic() bool
+	CleanupOnFail() bool
+	NoCreateNamespace() bool
+	WaitRetries() int
+	HistoryMax() *int
+	PostSyncStatus() bool
+	FailFast() bool
+	RecordReason() string
 
 	SkipNeeds() bool
 	IncludeNeeds() bool
 	IncludeTransitiveNeeds() bool
 
+	UseLock() bool
+	Preflight() bool
+
+	VerboseSummary() bool
+
+	KubeVersion() string
+	ApiVersions() []string
+
+	DiffOnSync() bool
+	FailOnDiffError() bool
+	Context() int
+	DiffOutput() string
+	Suppress() []string
+	SuppressOutputLineRegex() []string
+	SuppressSecrets() bool
+	ShowSecrets() bool
+
 	concurrencyConfig
 	loggingConfig
 }
 
 type DiffConfigProvider interface {
 	Args() string
+	ExtraArgs() string
 
 	Values() []string
 	Set() []string
+	SetString() []string
+	SetFile() []string
 	Validate() bool
+	ServerSideDiff() bool
+	ValidateValues() bool
 	SkipCRDs() bool
+	IncludeCRDs() bool
 	SkipDeps() bool
+	SkipRepos() bool
 
 	IncludeTests() bool
 
 	Suppress() []string
+	SuppressOutputLineRegex() []string
+	SuppressRelease() []string
 	SuppressSecrets() bool
 	ShowSecrets() bool
 	SuppressDiff() bool
@@ -112,16 +210,23 @@ type DiffConfigProvider interface {
 	SkipNeeds() bool
 	IncludeNeeds() bool
 
+	Preflight() bool
+
 	DetailedExitcode() bool
 	NoColor() bool
 	Context() int
 	DiffOutput() string
+	ValuesOnly() bool
+	ExitCodeOnError() int
+	OutputSummary() string
+	FailFast() bool
 
 	concurrencyConfig
 }
 
 type DeleteConfigProvider interface {
 	Args() string
+	ExtraArgs() string
 
 	Purge() bool
 	SkipDeps() bool
@@ -133,6 +238,7 @@ type DeleteConfigProvider interface {
 
 type DestroyConfigProvider interface {
 	Args() string
+	ExtraArgs() string
 
 	SkipDeps() bool
 
@@ -143,17 +249,21 @@ type DestroyConfigProvider interface {
 
 type TestConfigProvider interface {
 	Args() string
+	ExtraArgs() string
 
 	SkipDeps() bool
 	Timeout() int
 	Cleanup() bool
 	Logs() bool
+	TestFilter() string
+	Parallel() bool
 
 	concurrencyConfig
 }
 
 type LintConfigProvider interface {
 	Args() string
+	ExtraArgs() string
 
 	Values() []string
 	Set() []string
@@ -166,18 +276,30 @@ type LintConfigProvider interface {
 type FetchConfigProvider interface {
 	SkipDeps() bool
 	OutputDir() string
+	Untar() bool
+	VerifyDigest() string
 
 	concurrencyConfig
 }
 
+type VerifyConfigProvider interface {
+	SkipDeps() bool
+	Keyring() string
+}
+
 type TemplateConfigProvider interface {
 	Args() string
+	ExtraArgs() string
 
 	Values() []string
 	Set() []string
+	SetString() []string
+	SetFile() []string
 	OutputDirTemplate() string
+	OutputFileTemplate() string
 	Validate() bool
 	SkipDeps() bool
+	SkipRepos() bool
 	SkipCleanup() bool
 	SkipTests() bool
 	OutputDir() string
@@ -185,6 +307,10 @@ type TemplateConfigProvider interface {
 	IncludeNeeds() bool
 	IncludeTransitiveNeeds() bool
 
+	KubeVersion() string
+	ApiVersions() []string
+	CapabilitiesFile() string
+
 	concurrencyConfig
 }
 
@@ -199,12 +325,22 @@ type WriteValuesConfigProvider interface {
 
 type StatusesConfigProvider interface {
 	Args() string
+	ExtraArgs() string
+	Output() string
 
 	concurrencyConfig
 }
 
 type StateConfigProvider interface {
 	EmbedValues() bool
+	EmbedSecretsDecrypted() bool
+	Output() string
+}
+
+// argsConfig is implemented by the configs of the commands accepting --args and --extra-args
+type argsConfig interface {
+	Args() string
+	ExtraArgs() string
 }
 
 type concurrencyConfig interface {
@@ -221,4 +357,5 @@ type interactive interface {
 
 type ListConfigProvider interface {
 	Output() string
+	ClusterState() bool
 }
@@ -1,22 +1,32 @@
 package app
 
 import (
+	"sync"
+
 	"github.com/roboll/helmfile/pkg/state"
 )
 
 type Context struct {
 	updatedRepos   map[string]bool
 	updatedReposV2 map[string]bool
+
+	// mu serializes SyncReposOnce so that each repository is added only once
+	// even when multiple sub-helmfiles are processed concurrently
+	mu *sync.Mutex
 }
 
 func NewContext() Context {
 	return Context{
 		updatedRepos:   map[string]bool{},
 		updatedReposV2: map[string]bool{},
+		mu:             &sync.Mutex{},
 	}
 }
 
 func (ctx Context) SyncReposOnce(st *state.HelmState, helm state.RepoUpdater) error {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
 	var (
 		updated []string
 		err     error
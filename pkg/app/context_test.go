@@ -0,0 +1,53 @@
+package app
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/roboll/helmfile/pkg/exectest"
+	"github.com/roboll/helmfile/pkg/state"
+)
+
+func TestContext_SyncReposOnce_Concurrent(t *testing.T) {
+	ctx := NewContext()
+
+	// Simulates sub-helmfiles sharing the same repository being processed concurrently
+	var helms []*exectest.Helm
+	for i := 0; i < 10; i++ {
+		helms = append(helms, &exectest.Helm{Helm3: true})
+	}
+
+	var wg sync.WaitGroup
+	for _, helm := range helms {
+		helm := helm
+
+		st := &state.HelmState{
+			ReleaseSetSpec: state.ReleaseSetSpec{
+				Repositories: []state.RepositorySpec{
+					{Name: "stable", URL: "https://charts.helm.sh/stable"},
+				},
+			},
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := ctx.SyncReposOnce(st, helm); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var added int
+	for _, helm := range helms {
+		if len(helm.Repo) > 0 {
+			added++
+		}
+	}
+
+	if added != 1 {
+		t.Errorf("the repository must be added only once: added %d times", added)
+	}
+}
@@ -0,0 +1,266 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+	"github.com/roboll/helmfile/pkg/state"
+)
+
+const redacted = "***"
+
+// sensitiveKey matches the keys of the values that are redacted in the debug bundle, like `password` and `clientSecret`
+var sensitiveKey = regexp.MustCompile(`(?i)(password|passwd|secret|token|apikey|api_key|credentials?|private_?key|secret_?key|access_?key)$`)
+
+// debugBundle collects what is needed to reproduce a failure of helmfile, and writes it into a directory
+// when --dump-debug-bundle is set:
+//
+// - error.txt: the error helmfile failed with
+// - states/: the rendered state files in the order of visits
+// - values/: the temporary values files generated for releases
+// - commands.txt: the helm commands run by helmfile, one per line
+// - stderr.txt: the stderr of the failed helm commands
+//
+// Secret values are redacted unless showSecrets is true.
+type debugBundle struct {
+	dir         string
+	showSecrets bool
+
+	files    *state.DebugFiles
+	commands *helmexec.CommandRecorder
+
+	mu     sync.Mutex
+	states []renderedState
+}
+
+type renderedState struct {
+	file string
+	yaml string
+}
+
+func newDebugBundle(dir string, showSecrets bool) *debugBundle {
+	return &debugBundle{
+		dir:         dir,
+		showSecrets: showSecrets,
+		files:       state.NewDebugFiles(),
+		commands:    &helmexec.CommandRecorder{},
+	}
+}
+
+func newDebugBundleIfEnabled(conf ConfigProvider) *debugBundle {
+	if conf.DumpDebugBundle() == "" {
+		return nil
+	}
+	return newDebugBundle(conf.DumpDebugBundle(), conf.DebugBundleShowSecrets())
+}
+
+// debugFiles returns the collector of the temporary files for the states, which is nil unless --dump-debug-bundle is set
+func (a *App) debugFiles() *state.DebugFiles {
+	if a.debugBundle == nil {
+		return nil
+	}
+	return a.debugBundle.files
+}
+
+// addState records the rendered state. It does nothing when the bundle is disabled.
+func (b *debugBundle) addState(st *state.HelmState) {
+	if b == nil {
+		return
+	}
+
+	out, err := st.ToYaml()
+	if err != nil {
+		out = fmt.Sprintf("# unable to render the state: %v\n", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.states = append(b.states, renderedState{file: st.FilePath, yaml: out})
+}
+
+// CloseDebugBundle writes the debug bundle into the directory given to --dump-debug-bundle when err is not nil,
+// and removes the temporary files retained for the bundle. It does nothing unless --dump-debug-bundle is set.
+func (a *App) CloseDebugBundle(err error) error {
+	b := a.debugBundle
+	if b == nil {
+		return nil
+	}
+
+	defer func() {
+		for _, f := range b.files.Files() {
+			if rmErr := os.Remove(f); rmErr != nil && !os.IsNotExist(rmErr) {
+				a.Logger.Warnf("Removing %s: %v", f, rmErr)
+			}
+		}
+	}()
+
+	if err == nil {
+		return nil
+	}
+
+	if writeErr := b.write(err); writeErr != nil {
+		return fmt.Errorf("writing the debug bundle into %s: %w", b.dir, writeErr)
+	}
+
+	a.Logger.Infof("Wrote the debug bundle into %s", b.dir)
+
+	return nil
+}
+
+func (b *debugBundle) write(runErr error) error {
+	for _, d := range []string{"states", "values"} {
+		if err := os.MkdirAll(filepath.Join(b.dir, d), 0755); err != nil {
+			return err
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(b.dir, "error.txt"), []byte(runErr.Error()+"\n"), 0644); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	states := append([]renderedState{}, b.states...)
+	b.mu.Unlock()
+
+	for i, s := range states {
+		content := []byte(s.yaml)
+		if !b.showSecrets {
+			content = redactYAML(content, false)
+		}
+
+		name := fmt.Sprintf("%03d-%s", i+1, filepath.Base(s.file))
+		header := fmt.Sprintf("# %s\n", s.file)
+		if err := os.WriteFile(filepath.Join(b.dir, "states", name), append([]byte(header), content...), 0644); err != nil {
+			return err
+		}
+	}
+
+	for i, f := range b.files.Files() {
+		content, err := os.ReadFile(f)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if !b.showSecrets {
+			content = redactYAML(content, b.files.IsSecret(f))
+		}
+
+		name := fmt.Sprintf("%03d-%s", i+1, filepath.Base(f))
+		if err := os.WriteFile(filepath.Join(b.dir, "values", name), content, 0644); err != nil {
+			return err
+		}
+	}
+
+	var commands, stderr strings.Builder
+
+	for _, r := range b.commands.Records() {
+		args := r.Args
+		if !b.showSecrets {
+			args = redactSetArgs(args)
+		}
+
+		line := strings.Join(append([]string{r.Command}, args...), " ")
+		commands.WriteString(line + "\n")
+
+		if r.Err != nil {
+			fmt.Fprintf(&stderr, "$ %s\n%s\n", line, strings.TrimSuffix(r.Stderr, "\n"))
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(b.dir, "commands.txt"), []byte(commands.String()), 0644); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(b.dir, "stderr.txt"), []byte(stderr.String()), 0644)
+}
+
+// setFlags are the helm flags whose values are comma-separated `key=value` pairs
+var setFlags = []string{"--set", "--set-string", "--set-file"}
+
+// redactSetArgs masks the values of the sensitive keys in the `--set`, `--set-string` and `--set-file` flags,
+// like `--set db.password=***`
+func redactSetArgs(args []string) []string {
+	out := make([]string, len(args))
+	for i, a := range args {
+		out[i] = a
+
+		for _, f := range setFlags {
+			switch {
+			case i > 0 && args[i-1] == f:
+				out[i] = redactSetValue(a)
+			case strings.HasPrefix(a, f+"="):
+				out[i] = f + "=" + redactSetValue(strings.TrimPrefix(a, f+"="))
+			}
+		}
+	}
+	return out
+}
+
+func redactSetValue(v string) string {
+	pairs := strings.Split(v, ",")
+	for i, p := range pairs {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) == 2 && sensitiveKey.MatchString(kv[0]) {
+			pairs[i] = kv[0] + "=" + redacted
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+// redactYAML masks the values of the sensitive keys in the YAML document, or all the values when all is true.
+// A document that can't be parsed is masked entirely when all is true, and returned as is otherwise.
+func redactYAML(content []byte, all bool) []byte {
+	var doc interface{}
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		if all {
+			return []byte("# redacted\n")
+		}
+		return content
+	}
+
+	out, err := yaml.Marshal(redactValue(doc, all))
+	if err != nil {
+		return []byte("# redacted\n")
+	}
+
+	return out
+}
+
+func redactValue(v interface{}, all bool) interface{} {
+	switch typed := v.(type) {
+	case map[interface{}]interface{}:
+		// The value of a `set` entry like `{name: db.password, value: ...}` is redacted by its name
+		name, _ := typed["name"].(string)
+		sensitiveSet := sensitiveKey.MatchString(name)
+
+		m := make(map[interface{}]interface{}, len(typed))
+		for k, val := range typed {
+			key := fmt.Sprintf("%v", k)
+			m[k] = redactValue(val, all || sensitiveKey.MatchString(key) || sensitiveSet && key == "value")
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(typed))
+		for i, val := range typed {
+			s[i] = redactValue(val, all)
+		}
+		return s
+	case nil:
+		return nil
+	default:
+		if all {
+			return redacted
+		}
+		return typed
+	}
+}
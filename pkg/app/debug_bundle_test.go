@@ -0,0 +1,176 @@
+package app
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/roboll/helmfile/pkg/helmexec"
+	"github.com/variantdev/vals"
+)
+
+// failingUpgradeRunner fails `helm upgrade` and succeeds any other helm command
+type failingUpgradeRunner struct{}
+
+func (r *failingUpgradeRunner) Execute(cmd string, args []string, env map[string]string) ([]byte, error) {
+	for _, a := range args {
+		switch a {
+		case "version":
+			return []byte("v3.8.0+gd141386"), nil
+		case "upgrade":
+			return nil, helmexec.ExitError{Message: "helm upgrade failed", Code: 1, Stderr: "Error: UPGRADE FAILED: timed out waiting for the condition\n"}
+		}
+	}
+	return []byte{}, nil
+}
+
+func (r *failingUpgradeRunner) ExecuteStdIn(cmd string, args []string, env map[string]string, stdin io.Reader) ([]byte, error) {
+	return r.Execute(cmd, args, env)
+}
+
+func TestSync_DumpDebugBundle(t *testing.T) {
+	testcases := []struct {
+		name        string
+		showSecrets bool
+		wantValues  string
+	}{
+		{
+			name:       "redacted",
+			wantValues: "db:\n  host: db.example.com\n  password: '***'\nreplicas: 2\n",
+		},
+		{
+			name:        "show secrets",
+			showSecrets: true,
+			wantValues:  "db:\n  host: db.example.com\n  password: hunter2\nreplicas: 2\n",
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			files := map[string]string{
+				"/path/to/helmfile.yaml": `
+repositories:
+- name: private
+  url: https://charts.example.com
+  username: me
+  password: s3cr3t
+
+releases:
+- name: myapp
+  chart: private/myapp
+  namespace: default
+  values:
+  - replicas: 2
+    db:
+      host: db.example.com
+      password: hunter2
+  set:
+  - name: db.password
+    value: hunter3
+  - name: image.tag
+    value: v1
+`,
+			}
+
+			dir := t.TempDir()
+
+			logger := helmexec.NewLogger(io.Discard, "debug")
+
+			valsRuntime, err := vals.New(vals.Options{CacheSize: 32})
+			if err != nil {
+				t.Fatalf("unexpected error creating vals runtime: %v", err)
+			}
+
+			bundle := newDebugBundle(dir, tc.showSecrets)
+
+			app := appWithFs(&App{
+				OverrideHelmBinary:  DefaultHelmBinary,
+				glob:                filepath.Glob,
+				abs:                 filepath.Abs,
+				OverrideKubeContext: "default",
+				Env:                 "default",
+				Logger:              logger,
+				debugBundle:         bundle,
+				helms: map[helmKey]helmexec.Interface{
+					createHelmKey("helm", "default"): helmexec.New("helm", logger, "default", &helmexec.RecordingRunner{
+						Runner:   &failingUpgradeRunner{},
+						Recorder: bundle.commands,
+					}),
+				},
+				valsRuntime: valsRuntime,
+			}, files)
+
+			syncErr := app.Sync(applyConfig{
+				concurrency: 1,
+				logger:      logger,
+			})
+			if syncErr == nil {
+				t.Fatal("expected error, got none")
+			}
+
+			retained := bundle.files.Files()
+			if len(retained) != 1 {
+				t.Fatalf("unexpected retained files: %v", retained)
+			}
+
+			if err := app.CloseDebugBundle(syncErr); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			read := func(name string) string {
+				t.Helper()
+
+				bs, err := os.ReadFile(filepath.Join(dir, name))
+				if err != nil {
+					t.Fatalf("unable to read %s in the bundle: %v", name, err)
+				}
+
+				return string(bs)
+			}
+
+			if got := read("error.txt"); got != syncErr.Error()+"\n" {
+				t.Errorf("unexpected error.txt: %s", got)
+			}
+
+			state := read("states/001-helmfile.yaml")
+			if !strings.Contains(state, "name: myapp") {
+				t.Errorf("the rendered state doesn't contain the release:\n%s", state)
+			}
+			if tc.showSecrets != strings.Contains(state, "s3cr3t") {
+				t.Errorf("unexpected redaction of the repository password:\n%s", state)
+			}
+
+			if d := cmp.Diff(tc.wantValues, read("values/001-"+filepath.Base(retained[0]))); d != "" {
+				t.Errorf("unexpected values file: want (-), got (+):\n%s", d)
+			}
+
+			commands := read("commands.txt")
+			if !strings.Contains(commands, "helm --kube-context default repo add private https://charts.example.com --force-update --username me --password ***\n") {
+				t.Errorf("the commands don't contain helm repo add with the password masked:\n%s", commands)
+			}
+			if !strings.Contains(commands, "helm --kube-context default upgrade --install --reset-values myapp private/myapp") {
+				t.Errorf("the commands don't contain helm upgrade:\n%s", commands)
+			}
+			if tc.showSecrets != strings.Contains(commands, "--set db.password=hunter3") || tc.showSecrets == strings.Contains(commands, "--set db.password=***") {
+				t.Errorf("unexpected redaction of the set value:\n%s", commands)
+			}
+			if !strings.Contains(commands, "--set image.tag=v1") {
+				t.Errorf("the commands don't contain the non-sensitive set value:\n%s", commands)
+			}
+
+			stderr := read("stderr.txt")
+			if !strings.HasPrefix(stderr, "$ helm --kube-context default upgrade --install") || !strings.HasSuffix(stderr, "\nError: UPGRADE FAILED: timed out waiting for the condition\n") {
+				t.Errorf("unexpected stderr.txt:\n%s", stderr)
+			}
+
+			if _, err := os.Stat(retained[0]); !os.IsNotExist(err) {
+				t.Errorf("the retained values file is not removed: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/roboll/helmfile/pkg/exectest"
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+// lockingHelm simulates `helm dependency update` by writing the lock file into the chart directory
+type lockingHelm struct {
+	*exectest.Helm
+
+	lock string
+}
+
+func (helm lockingHelm) UpdateDeps(chart string) error {
+	if err := helm.Helm.UpdateDeps(chart); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(chart, "Chart.lock"), []byte(helm.lock), 0644)
+}
+
+func TestDeps_OutputFile(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+repositories:
+- name: bitnami
+  url: https://charts.bitnami.com/bitnami
+releases:
+- name: foo
+  chart: bitnami/redis
+  version: ^16.0.0
+- name: bar
+  chart: /path/to/charts/bar
+`,
+		"/path/to/charts/bar/Chart.yaml": `name: bar`,
+	}
+
+	helm := lockingHelm{
+		Helm: &exectest.Helm{
+			Helm3:         true,
+			DiffMutex:     &sync.Mutex{},
+			ChartsMutex:   &sync.Mutex{},
+			ReleasesMutex: &sync.Mutex{},
+		},
+		lock: `dependencies:
+- name: redis
+  repository: https://charts.bitnami.com/bitnami
+  version: 16.13.2
+digest: sha256:4d5ac9f4fe1a5ab5c1ea8ab3e5e1d2ab9c1f0a0b0b2c3d4e5f60718293a4b5c6
+generated: "2022-07-01T00:00:00.000000+09:00"
+`,
+	}
+
+	outputFile := filepath.Join(t.TempDir(), "deps.yaml")
+
+	app := appWithFs(&App{
+		OverrideHelmBinary:  DefaultHelmBinary,
+		OverrideKubeContext: "default",
+		Env:                 "default",
+		Logger:              helmexec.NewLogger(os.Stderr, "debug"),
+		helms: map[helmKey]helmexec.Interface{
+			createHelmKey("helm", "default"): helm,
+		},
+	}, files)
+
+	if err := app.Deps(depsConfig{outputFile: outputFile}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	bs, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := `helmfile.yaml:
+  version: ""
+  dependencies:
+  - name: redis
+    repository: https://charts.bitnami.com/bitnami
+    version: 16.13.2
+  digest: sha256:4d5ac9f4fe1a5ab5c1ea8ab3e5e1d2ab9c1f0a0b0b2c3d4e5f60718293a4b5c6
+  generated: "2022-07-01T00:00:00.000000+09:00"
+`
+	if d := cmp.Diff(want, string(bs)); d != "" {
+		t.Errorf("unexpected output: want (-), got (+):\n%s", d)
+	}
+
+	// The local chart is left untouched, and only the temporary chart for the remote dependency is updated
+	if len(helm.Charts) != 1 || filepath.Dir(helm.Charts[0]) != os.TempDir() {
+		t.Errorf("unexpected charts updated: %v", helm.Charts)
+	}
+}
+
+func TestDeps_OutputFile_NoDependencies(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+releases:
+- name: bar
+  chart: /path/to/charts/bar
+`,
+		"/path/to/charts/bar/Chart.yaml": `name: bar`,
+	}
+
+	helm := &exectest.Helm{
+		Helm3:         true,
+		DiffMutex:     &sync.Mutex{},
+		ChartsMutex:   &sync.Mutex{},
+		ReleasesMutex: &sync.Mutex{},
+	}
+
+	outputFile := filepath.Join(t.TempDir(), "deps.yaml")
+
+	app := appWithFs(&App{
+		OverrideHelmBinary:  DefaultHelmBinary,
+		OverrideKubeContext: "default",
+		Env:                 "default",
+		Logger:              helmexec.NewLogger(os.Stderr, "debug"),
+		helms: map[helmKey]helmexec.Interface{
+			createHelmKey("helm", "default"): helm,
+		},
+	}, files)
+
+	if err := app.Deps(depsConfig{outputFile: outputFile}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	bs, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := `helmfile.yaml:
+  version: ""
+  dependencies: []
+  digest: ""
+  generated: ""
+`
+	if d := cmp.Diff(want, string(bs)); d != "" {
+		t.Errorf("unexpected output: want (-), got (+):\n%s", d)
+	}
+
+	if len(helm.Charts) != 0 {
+		t.Errorf("unexpected charts updated: %v", helm.Charts)
+	}
+}
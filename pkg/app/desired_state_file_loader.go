@@ -26,6 +26,14 @@ type desiredStateLoader struct {
 	env       string
 	namespace string
 	chart     string
+	noHooks   bool
+	// enableExecValues allows the `exec://` values entries of releases to run commands
+	enableExecValues bool
+	timings          *state.Timings
+	// debugFiles is set to the states when --dump-debug-bundle is set
+	debugFiles *state.DebugFiles
+
+	chartOverrides []state.ChartOverride
 
 	readFile          func(string) ([]byte, error)
 	deleteFile        func(string) error
@@ -38,6 +46,9 @@ type desiredStateLoader struct {
 	remote      *remote.Remote
 	logger      *zap.SugaredLogger
 	valsRuntime vals.Evaluator
+
+	// secretValues collects the decrypted environment secrets, which are masked in the debug logs of the rendering
+	secretValues *state.SecretValues
 }
 
 func (ld *desiredStateLoader) Load(f string, opts LoadOpts) (*state.HelmState, error) {
@@ -68,6 +79,11 @@ func (ld *desiredStateLoader) Load(f string, opts LoadOpts) (*state.HelmState, e
 		return nil, err
 	}
 
+	// This is done after the bases are merged, so that the releases can reference the value bundles defined in the bases
+	if err := st.ExpandValuesFrom(); err != nil {
+		return nil, err
+	}
+
 	if opts.Reverse {
 		st.Reverse()
 	}
@@ -96,6 +112,12 @@ func (ld *desiredStateLoader) Load(f string, opts LoadOpts) (*state.HelmState, e
 		st.OverrideChart = ld.chart
 	}
 
+	st.NoHooks = ld.noHooks
+	st.EnableExecValues = ld.enableExecValues
+	st.Timings = ld.timings
+	st.DebugFiles = ld.debugFiles
+	st.ChartOverrides = ld.chartOverrides
+
 	return st, nil
 }
 
@@ -168,6 +190,7 @@ func (a *desiredStateLoader) underlying() *state.StateCreator {
 	c := state.NewCreator(a.logger, a.readFile, a.fileExists, a.abs, a.glob, a.directoryExistsAt, a.valsRuntime, a.getHelm, a.overrideHelmBinary, a.remote)
 	c.DeleteFile = a.deleteFile
 	c.LoadFile = a.loadFile
+	c.SecretValues = a.secretValues
 	return c
 }
 
@@ -229,7 +252,7 @@ func (ld *desiredStateLoader) renderAndLoad(env, overrodeEnv *environment.Enviro
 		}
 
 		for i, r := range currentState.Releases {
-			if r.Chart == "" {
+			if r.Chart == "" && r.ChartTemplate == nil {
 				return nil, fmt.Errorf("error during %s parsing: encountered empty chart while reading release %q at index %d", id, r.Name, i)
 			}
 		}
@@ -246,8 +269,11 @@ func (ld *desiredStateLoader) renderAndLoad(env, overrodeEnv *environment.Enviro
 
 		env = &finalState.Env
 
-		ld.logger.Debugf("merged environment: %v", env)
+		ld.logger.Debug(ld.secretValues.Mask(fmt.Sprintf("merged environment: %v", env)))
 	}
 
+	// The repositories of a later part override the ones of the environment merged into an earlier part
+	finalState.ApplyEnvironmentRepositories()
+
 	return finalState, nil
 }
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"io"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 
@@ -35,6 +36,10 @@ func (d destroyConfig) Args() string {
 	return d.args
 }
 
+func (d destroyConfig) ExtraArgs() string {
+	return ""
+}
+
 func (d destroyConfig) Interactive() bool {
 	return d.interactive
 }
@@ -804,3 +809,104 @@ backend-v1
 		})
 	})
 }
+
+func TestDestroy_Interactive(t *testing.T) {
+	testcases := []struct {
+		name       string
+		answer     string
+		terminal   bool
+		wantDelete bool
+		wantErr    string
+	}{
+		{
+			name:     "declined",
+			answer:   "n\n",
+			terminal: true,
+		},
+		{
+			name:       "confirmed",
+			answer:     "y\n",
+			terminal:   true,
+			wantDelete: true,
+		},
+		{
+			name:     "no terminal",
+			answer:   "y\n",
+			terminal: false,
+			wantErr:  "in ./helmfile.yaml: --interactive requires a terminal to ask for confirmation. Run it in a terminal, or without --interactive",
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			helm := &exectest.Helm{
+				Helm3:                true,
+				FailOnUnexpectedList: true,
+				FailOnUnexpectedDiff: true,
+				Lists: map[exectest.ListKey]string{
+					{Filter: "^foo$", Flags: helmV3ListFlags}: `NAME	NAMESPACE	REVISION	UPDATED                             	STATUS  	CHART        	APP VERSION
+foo 	default  	4       	2021-01-01 00:00:00.000000 +0000 UTC	deployed	raw-3.1.0	3.1.0
+`,
+				},
+				DiffMutex:     &sync.Mutex{},
+				ChartsMutex:   &sync.Mutex{},
+				ReleasesMutex: &sync.Mutex{},
+			}
+
+			valsRuntime, err := vals.New(vals.Options{CacheSize: 32})
+			if err != nil {
+				t.Fatalf("unexpected error creating vals runtime: %v", err)
+			}
+
+			out := &bytes.Buffer{}
+
+			app := appWithFs(&App{
+				OverrideHelmBinary:  DefaultHelmBinary,
+				OverrideKubeContext: "default",
+				Env:                 "default",
+				Logger:              helmexec.NewLogger(io.Discard, "debug"),
+				helms: map[helmKey]helmexec.Interface{
+					createHelmKey("helm", "default"): helm,
+				},
+				valsRuntime: valsRuntime,
+				stdin:       bytes.NewBufferString(tc.answer),
+				stdout:      out,
+				isTerminal:  func() bool { return tc.terminal },
+			}, map[string]string{
+				"/path/to/helmfile.yaml": `
+releases:
+- name: foo
+  chart: incubator/raw
+`,
+			})
+
+			err = app.Destroy(destroyConfig{
+				concurrency: 1,
+				interactive: true,
+				logger:      app.Logger,
+			})
+
+			var gotErr string
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != tc.wantErr {
+				t.Fatalf("unexpected error: want %q, got %q", tc.wantErr, gotErr)
+			}
+
+			if tc.terminal && !strings.Contains(out.String(), "Do you really want to delete?") {
+				t.Errorf("the prompt isn't shown:\n%s", out.String())
+			}
+
+			if tc.wantDelete {
+				if len(helm.Deleted) != 1 || helm.Deleted[0].Name != "foo" {
+					t.Errorf("unexpected deletes: %v", helm.Deleted)
+				}
+			} else if len(helm.Deleted) > 0 {
+				t.Errorf("unexpected deletes: %v", helm.Deleted)
+			}
+		})
+	}
+}
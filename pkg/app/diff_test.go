@@ -3,7 +3,9 @@ package app
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"io"
+	"os"
 	"path/filepath"
 	"sync"
 	"testing"
@@ -11,40 +13,59 @@ import (
 	"github.com/google/go-cmp/cmp"
 	"github.com/roboll/helmfile/pkg/exectest"
 	"github.com/roboll/helmfile/pkg/helmexec"
+	"github.com/roboll/helmfile/pkg/state"
 	"github.com/roboll/helmfile/pkg/testhelper"
 	"github.com/variantdev/vals"
 	"go.uber.org/zap"
 )
 
 type diffConfig struct {
-	args              string
-	values            []string
-	retainValuesFiles bool
-	set               []string
-	validate          bool
-	skipCRDs          bool
-	skipDeps          bool
-	includeTests      bool
-	includeNeeds      bool
-	skipNeeds         bool
-	suppress          []string
-	suppressSecrets   bool
-	showSecrets       bool
-	suppressDiff      bool
-	noColor           bool
-	context           int
-	diffOutput        string
-	concurrency       int
-	detailedExitcode  bool
-	interactive       bool
-	skipDiffOnInstall bool
-	logger            *zap.SugaredLogger
+	args                    string
+	extraArgs               string
+	values                  []string
+	retainValuesFiles       bool
+	set                     []string
+	setString               []string
+	setFile                 []string
+	validate                bool
+	serverSideDiff          bool
+	validateValues          bool
+	skipCRDs                bool
+	includeCRDs             bool
+	skipDeps                bool
+	skipRepos               bool
+	includeTests            bool
+	includeNeeds            bool
+	skipNeeds               bool
+	preflight               bool
+	suppress                []string
+	suppressOutputLineRegex []string
+	suppressRelease         []string
+	suppressSecrets         bool
+	showSecrets             bool
+	suppressDiff            bool
+	noColor                 bool
+	context                 int
+	diffOutput              string
+	concurrency             int
+	detailedExitcode        bool
+	interactive             bool
+	skipDiffOnInstall       bool
+	valuesOnly              bool
+	exitCodeOnError         int
+	outputSummary           string
+	failFast                bool
+	logger                  *zap.SugaredLogger
 }
 
 func (a diffConfig) Args() string {
 	return a.args
 }
 
+func (a diffConfig) ExtraArgs() string {
+	return a.extraArgs
+}
+
 func (a diffConfig) Values() []string {
 	return a.values
 }
@@ -53,18 +74,42 @@ func (a diffConfig) Set() []string {
 	return a.set
 }
 
+func (a diffConfig) SetString() []string {
+	return a.setString
+}
+
+func (a diffConfig) SetFile() []string {
+	return a.setFile
+}
+
 func (a diffConfig) Validate() bool {
 	return a.validate
 }
 
+func (a diffConfig) ServerSideDiff() bool {
+	return a.serverSideDiff
+}
+
+func (a diffConfig) ValidateValues() bool {
+	return a.validateValues
+}
+
 func (a diffConfig) SkipCRDs() bool {
 	return a.skipCRDs
 }
 
+func (a diffConfig) IncludeCRDs() bool {
+	return a.includeCRDs
+}
+
 func (a diffConfig) SkipDeps() bool {
 	return a.skipDeps
 }
 
+func (a diffConfig) SkipRepos() bool {
+	return a.skipRepos
+}
+
 func (a diffConfig) IncludeTests() bool {
 	return a.includeTests
 }
@@ -73,6 +118,10 @@ func (a diffConfig) IncludeNeeds() bool {
 	return a.includeNeeds
 }
 
+func (a diffConfig) Preflight() bool {
+	return a.preflight
+}
+
 func (a diffConfig) SkipNeeds() bool {
 	return a.skipNeeds
 }
@@ -81,6 +130,14 @@ func (a diffConfig) Suppress() []string {
 	return a.suppress
 }
 
+func (a diffConfig) SuppressOutputLineRegex() []string {
+	return a.suppressOutputLineRegex
+}
+
+func (a diffConfig) SuppressRelease() []string {
+	return a.suppressRelease
+}
+
 func (a diffConfig) SuppressSecrets() bool {
 	return a.suppressSecrets
 }
@@ -121,6 +178,22 @@ func (a diffConfig) SkipDiffOnInstall() bool {
 	return a.skipDiffOnInstall
 }
 
+func (a diffConfig) ValuesOnly() bool {
+	return a.valuesOnly
+}
+
+func (a diffConfig) ExitCodeOnError() int {
+	return a.exitCodeOnError
+}
+
+func (a diffConfig) OutputSummary() string {
+	return a.outputSummary
+}
+
+func (a diffConfig) FailFast() bool {
+	return a.failFast
+}
+
 func (a diffConfig) Logger() *zap.SugaredLogger {
 	return a.logger
 }
@@ -131,7 +204,8 @@ func (a diffConfig) RetainValuesFiles() bool {
 
 func TestDiff(t *testing.T) {
 	type flags struct {
-		skipNeeds bool
+		skipNeeds       bool
+		exitCodeOnError int
 	}
 
 	testcases := []struct {
@@ -142,6 +216,7 @@ func TestDiff(t *testing.T) {
 		skipDiffOnInstall bool
 		detailedExitcode  bool
 		error             string
+		code              int
 		flags             flags
 		files             map[string]string
 		selectors         []string
@@ -1380,6 +1455,33 @@ merged environment: &{default map[] map[]}
 err: release "default//foo" depends on "default//bar" which does not match the selectors. Please add a selector like "--selector name=bar", or indicate whether to skip (--skip-needs) or include (--include-needs) these dependencies
 `,
 		},
+		{
+			name: "exit code on error wins over changes",
+			loc:  location(),
+			files: map[string]string{
+				"/path/to/helmfile.yaml": `
+releases:
+- name: foo
+  chart: mychart1
+- name: bar
+  chart: mychart2
+`,
+			},
+			detailedExitcode: true,
+			flags: flags{
+				exitCodeOnError: 3,
+			},
+			diffs: map[exectest.DiffKey]error{
+				exectest.DiffKey{Name: "foo", Chart: "mychart1", Flags: "--kube-contextdefault--detailed-exitcode"}: helmexec.ExitError{Code: 2},
+				exectest.DiffKey{Name: "bar", Chart: "mychart2", Flags: "--kube-contextdefault--detailed-exitcode"}: helmexec.ExitError{Message: "diff failed", Code: 1},
+			},
+			lists:       map[exectest.ListKey]string{},
+			upgraded:    []exectest.Release{},
+			deleted:     []exectest.Release{},
+			concurrency: 1,
+			error:       "in ./helmfile.yaml: diff failed",
+			code:        3,
+		},
 		{
 			name: "non-existent release in needs",
 			loc:  location(),
@@ -1520,6 +1622,7 @@ err: release(s) "default//foo" depend(s) on an undefined release "default//bar".
 					logger:           logger,
 					detailedExitcode: tc.detailedExitcode,
 					skipNeeds:        tc.flags.skipNeeds,
+					exitCodeOnError:  tc.flags.exitCodeOnError,
 				})
 
 				var diffErrStr string
@@ -1531,6 +1634,16 @@ err: release(s) "default//foo" depend(s) on an undefined release "default//bar".
 					t.Fatalf("invalid error: want (-), got (+): %s", d)
 				}
 
+				if tc.code != 0 {
+					e, ok := diffErr.(*Error)
+					if !ok {
+						t.Fatalf("unexpected type of error: want *Error, got %T", diffErr)
+					}
+					if e.Code() != tc.code {
+						t.Errorf("unexpected exit code: want %d, got %d", tc.code, e.Code())
+					}
+				}
+
 				if len(wantUpgrades) > len(helm.Releases) {
 					t.Fatalf("insufficient number of upgrades: got %d, want %d", len(helm.Releases), len(wantUpgrades))
 				}
@@ -1573,3 +1686,404 @@ err: release(s) "default//foo" depend(s) on an undefined release "default//bar".
 		})
 	}
 }
+
+func TestDiff_OutputSummary(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+releases:
+- name: foo
+  chart: mychart1
+- name: bar
+  namespace: ns1
+  chart: mychart2
+- name: baz
+  chart: mychart3
+`,
+	}
+
+	testcases := []struct {
+		name             string
+		detailedExitcode bool
+		diffs            map[exectest.DiffKey]error
+		wantExitCode     int
+		wantReleases     []state.DiffSummaryRelease
+	}{
+		{
+			name:             "changed and unchanged",
+			detailedExitcode: true,
+			diffs: map[exectest.DiffKey]error{
+				exectest.DiffKey{Name: "foo", Chart: "mychart1", Flags: "--kube-contextdefault--detailed-exitcode"}:               helmexec.ExitError{Code: 2},
+				exectest.DiffKey{Name: "bar", Chart: "mychart2", Flags: "--kube-contextdefault--namespacens1--detailed-exitcode"}: nil,
+				exectest.DiffKey{Name: "baz", Chart: "mychart3", Flags: "--kube-contextdefault--detailed-exitcode"}:               nil,
+			},
+			wantExitCode: 2,
+			wantReleases: []state.DiffSummaryRelease{
+				{ID: "default//foo", Name: "foo", KubeContext: "default", Chart: "mychart1", Status: state.DiffStatusChanged, ExitCode: 2},
+				{ID: "default/ns1/bar", Name: "bar", Namespace: "ns1", KubeContext: "default", Chart: "mychart2", Status: state.DiffStatusUnchanged},
+				{ID: "default//baz", Name: "baz", KubeContext: "default", Chart: "mychart3", Status: state.DiffStatusUnchanged},
+			},
+		},
+		{
+			name: "changes are detected without --detailed-exitcode",
+			diffs: map[exectest.DiffKey]error{
+				exectest.DiffKey{Name: "foo", Chart: "mychart1", Flags: "--kube-contextdefault--detailed-exitcode"}:               helmexec.ExitError{Code: 2},
+				exectest.DiffKey{Name: "bar", Chart: "mychart2", Flags: "--kube-contextdefault--namespacens1--detailed-exitcode"}: nil,
+				exectest.DiffKey{Name: "baz", Chart: "mychart3", Flags: "--kube-contextdefault--detailed-exitcode"}:               nil,
+			},
+			wantExitCode: 0,
+			wantReleases: []state.DiffSummaryRelease{
+				{ID: "default//foo", Name: "foo", KubeContext: "default", Chart: "mychart1", Status: state.DiffStatusChanged, ExitCode: 2},
+				{ID: "default/ns1/bar", Name: "bar", Namespace: "ns1", KubeContext: "default", Chart: "mychart2", Status: state.DiffStatusUnchanged},
+				{ID: "default//baz", Name: "baz", KubeContext: "default", Chart: "mychart3", Status: state.DiffStatusUnchanged},
+			},
+		},
+		{
+			name:             "error",
+			detailedExitcode: true,
+			diffs: map[exectest.DiffKey]error{
+				exectest.DiffKey{Name: "foo", Chart: "mychart1", Flags: "--kube-contextdefault--detailed-exitcode"}:               helmexec.ExitError{Code: 2},
+				exectest.DiffKey{Name: "bar", Chart: "mychart2", Flags: "--kube-contextdefault--namespacens1--detailed-exitcode"}: nil,
+				exectest.DiffKey{Name: "baz", Chart: "mychart3", Flags: "--kube-contextdefault--detailed-exitcode"}:               helmexec.ExitError{Message: "diff failed", Code: 1},
+			},
+			wantExitCode: 1,
+			wantReleases: []state.DiffSummaryRelease{
+				{ID: "default//foo", Name: "foo", KubeContext: "default", Chart: "mychart1", Status: state.DiffStatusChanged, ExitCode: 2},
+				{ID: "default/ns1/bar", Name: "bar", Namespace: "ns1", KubeContext: "default", Chart: "mychart2", Status: state.DiffStatusUnchanged},
+				{ID: "default//baz", Name: "baz", KubeContext: "default", Chart: "mychart3", Status: state.DiffStatusError, ExitCode: 1, Error: "diff failed"},
+			},
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			helm := &exectest.Helm{
+				FailOnUnexpectedList: true,
+				FailOnUnexpectedDiff: true,
+				Lists:                map[exectest.ListKey]string{},
+				Diffs:                tc.diffs,
+				DiffMutex:            &sync.Mutex{},
+				ChartsMutex:          &sync.Mutex{},
+				ReleasesMutex:        &sync.Mutex{},
+			}
+
+			logger := helmexec.NewLogger(io.Discard, "debug")
+
+			valsRuntime, err := vals.New(vals.Options{CacheSize: 32})
+			if err != nil {
+				t.Fatalf("unexpected error creating vals runtime: %v", err)
+			}
+
+			app := appWithFs(&App{
+				OverrideHelmBinary:  DefaultHelmBinary,
+				glob:                filepath.Glob,
+				abs:                 filepath.Abs,
+				OverrideKubeContext: "default",
+				Env:                 "default",
+				Logger:              logger,
+				helms: map[helmKey]helmexec.Interface{
+					createHelmKey("helm", "default"): helm,
+				},
+				valsRuntime: valsRuntime,
+			}, files)
+
+			summaryFile := filepath.Join(t.TempDir(), "summary.json")
+
+			_ = app.Diff(diffConfig{
+				concurrency:      1,
+				logger:           logger,
+				detailedExitcode: tc.detailedExitcode,
+				outputSummary:    summaryFile,
+			})
+
+			bs, err := os.ReadFile(summaryFile)
+			if err != nil {
+				t.Fatalf("unexpected error reading the summary: %v", err)
+			}
+
+			var got state.DiffSummary
+			if err := json.Unmarshal(bs, &got); err != nil {
+				t.Fatalf("unexpected error parsing the summary: %v", err)
+			}
+
+			if got.ExitCode != tc.wantExitCode {
+				t.Errorf("unexpected exit code: want %d, got %d", tc.wantExitCode, got.ExitCode)
+			}
+
+			if d := cmp.Diff(tc.wantReleases, got.Releases); d != "" {
+				t.Errorf("unexpected releases: want (-), got (+):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestDiffWithResult(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+releases:
+- name: foo
+  chart: mychart1
+- name: bar
+  namespace: ns1
+  chart: mychart2
+`,
+	}
+
+	fooDiff := `default, foo, ConfigMap (v1) has changed:
+-   key: old
++   key: new
+`
+
+	helm := &exectest.Helm{
+		FailOnUnexpectedList: true,
+		FailOnUnexpectedDiff: true,
+		Lists:                map[exectest.ListKey]string{},
+		Diffs: map[exectest.DiffKey]error{
+			exectest.DiffKey{Name: "foo", Chart: "mychart1", Flags: "--kube-contextdefault--detailed-exitcode"}:               helmexec.ExitError{Code: 2},
+			exectest.DiffKey{Name: "bar", Chart: "mychart2", Flags: "--kube-contextdefault--namespacens1--detailed-exitcode"}: nil,
+		},
+		DiffOutputs: map[string]string{
+			"foo": fooDiff,
+		},
+		DiffMutex:     &sync.Mutex{},
+		ChartsMutex:   &sync.Mutex{},
+		ReleasesMutex: &sync.Mutex{},
+	}
+
+	logger := helmexec.NewLogger(io.Discard, "debug")
+
+	valsRuntime, err := vals.New(vals.Options{CacheSize: 32})
+	if err != nil {
+		t.Fatalf("unexpected error creating vals runtime: %v", err)
+	}
+
+	app := appWithFs(&App{
+		OverrideHelmBinary:  DefaultHelmBinary,
+		glob:                filepath.Glob,
+		abs:                 filepath.Abs,
+		OverrideKubeContext: "default",
+		Env:                 "default",
+		Logger:              logger,
+		helms: map[helmKey]helmexec.Interface{
+			createHelmKey("helm", "default"): helm,
+		},
+		valsRuntime: valsRuntime,
+	}, files)
+
+	result, err := app.DiffWithResult(diffConfig{
+		concurrency:      1,
+		logger:           logger,
+		detailedExitcode: true,
+	})
+
+	if code := exitCode(err); code != 2 {
+		t.Errorf("unexpected exit code: want 2, got %d: %v", code, err)
+	}
+
+	if result == nil {
+		t.Fatal("missing result")
+	}
+
+	want := []state.DiffSummaryRelease{
+		{ID: "default//foo", Name: "foo", KubeContext: "default", Chart: "mychart1", Status: state.DiffStatusChanged, ExitCode: 2, Diff: fooDiff},
+		{ID: "default/ns1/bar", Name: "bar", Namespace: "ns1", KubeContext: "default", Chart: "mychart2", Status: state.DiffStatusUnchanged},
+	}
+
+	if d := cmp.Diff(want, result.Releases); d != "" {
+		t.Errorf("unexpected releases: want (-), got (+):\n%s", d)
+	}
+
+	if !result.Changed() {
+		t.Error("the result has no changes")
+	}
+}
+
+func TestDiff_SuppressRelease(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+releases:
+- name: foo
+  chart: mychart1
+- name: bar
+  namespace: ns1
+  chart: mychart2
+`,
+	}
+
+	fooDiff := `default, foo, ConfigMap (v1) has changed:
+-   key: old
++   key: new
+`
+	barDiff := `ns1, bar, ConfigMap (v1) has changed:
+-   noisy: old
++   noisy: new
+`
+
+	helm := &exectest.Helm{
+		FailOnUnexpectedList: true,
+		FailOnUnexpectedDiff: true,
+		Lists:                map[exectest.ListKey]string{},
+		Diffs: map[exectest.DiffKey]error{
+			exectest.DiffKey{Name: "foo", Chart: "mychart1", Flags: "--kube-contextdefault--detailed-exitcode"}:               helmexec.ExitError{Code: 2},
+			exectest.DiffKey{Name: "bar", Chart: "mychart2", Flags: "--kube-contextdefault--namespacens1--detailed-exitcode"}: helmexec.ExitError{Code: 2},
+		},
+		DiffOutputs: map[string]string{
+			"foo": fooDiff,
+			"bar": barDiff,
+		},
+		DiffMutex:     &sync.Mutex{},
+		ChartsMutex:   &sync.Mutex{},
+		ReleasesMutex: &sync.Mutex{},
+	}
+
+	logger := helmexec.NewLogger(io.Discard, "debug")
+
+	valsRuntime, err := vals.New(vals.Options{CacheSize: 32})
+	if err != nil {
+		t.Fatalf("unexpected error creating vals runtime: %v", err)
+	}
+
+	app := appWithFs(&App{
+		OverrideHelmBinary:  DefaultHelmBinary,
+		glob:                filepath.Glob,
+		abs:                 filepath.Abs,
+		OverrideKubeContext: "default",
+		Env:                 "default",
+		Logger:              logger,
+		helms: map[helmKey]helmexec.Interface{
+			createHelmKey("helm", "default"): helm,
+		},
+		valsRuntime: valsRuntime,
+	}, files)
+
+	var (
+		result  *DiffResult
+		diffErr error
+	)
+
+	out := captureStdout(func() {
+		result, diffErr = app.DiffWithResult(diffConfig{
+			concurrency:      1,
+			logger:           logger,
+			detailedExitcode: true,
+			suppressRelease:  []string{"default/ns1/bar"},
+		})
+	})
+
+	if code := exitCode(diffErr); code != 2 {
+		t.Errorf("unexpected exit code: want 2, got %d: %v", code, diffErr)
+	}
+
+	if d := cmp.Diff(fooDiff, out); d != "" {
+		t.Errorf("unexpected output: want (-), got (+):\n%s", d)
+	}
+
+	if result == nil {
+		t.Fatal("missing result")
+	}
+
+	var changed []string
+	for _, r := range result.Releases {
+		if r.Changed() {
+			changed = append(changed, r.ID)
+		}
+	}
+
+	if d := cmp.Diff([]string{"default//foo", "default/ns1/bar"}, changed); d != "" {
+		t.Errorf("unexpected changed releases: want (-), got (+):\n%s", d)
+	}
+}
+
+func TestDiff_InstalledFalse(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+releases:
+- name: foo
+  chart: mychart1
+- name: bar
+  namespace: ns1
+  chart: mychart2
+  installed: false
+- name: baz
+  chart: mychart3
+  installed: false
+`,
+	}
+
+	helm := &exectest.Helm{
+		FailOnUnexpectedList: true,
+		FailOnUnexpectedDiff: true,
+		Lists: map[exectest.ListKey]string{
+			exectest.ListKey{Filter: "^bar$", Flags: "--kube-contextdefault--namespacens1--uninstalling--deployed--failed--pending"}: `NAME	REVISION	UPDATED                 	STATUS  	CHART        	APP VERSION	NAMESPACE
+bar 	4       	Fri Nov  1 08:40:07 2019	DEPLOYED	mychart2-3.1.0	3.1.0      	ns1
+`,
+			exectest.ListKey{Filter: "^baz$", Flags: "--kube-contextdefault--uninstalling--deployed--failed--pending"}: "",
+		},
+		Diffs: map[exectest.DiffKey]error{
+			exectest.DiffKey{Name: "foo", Chart: "mychart1", Flags: "--kube-contextdefault--detailed-exitcode"}: nil,
+		},
+		DiffMutex:     &sync.Mutex{},
+		ChartsMutex:   &sync.Mutex{},
+		ReleasesMutex: &sync.Mutex{},
+		Helm3:         true,
+	}
+
+	logger := helmexec.NewLogger(io.Discard, "debug")
+
+	valsRuntime, err := vals.New(vals.Options{CacheSize: 32})
+	if err != nil {
+		t.Fatalf("unexpected error creating vals runtime: %v", err)
+	}
+
+	app := appWithFs(&App{
+		OverrideHelmBinary:  DefaultHelmBinary,
+		glob:                filepath.Glob,
+		abs:                 filepath.Abs,
+		OverrideKubeContext: "default",
+		Env:                 "default",
+		Logger:              logger,
+		helms: map[helmKey]helmexec.Interface{
+			createHelmKey("helm", "default"): helm,
+		},
+		valsRuntime: valsRuntime,
+	}, files)
+
+	var (
+		result  *DiffResult
+		diffErr error
+	)
+
+	out := captureStdout(func() {
+		result, diffErr = app.DiffWithResult(diffConfig{
+			concurrency:      1,
+			logger:           logger,
+			detailedExitcode: true,
+		})
+	})
+
+	if code := exitCode(diffErr); code != 2 {
+		t.Errorf("unexpected exit code: want 2, got %d: %v", code, diffErr)
+	}
+
+	if d := cmp.Diff("Release \"bar\" (mychart2) in namespace \"ns1\" will be deleted, as it's installed but marked `installed: false`\n", out); d != "" {
+		t.Errorf("unexpected output: want (-), got (+):\n%s", d)
+	}
+
+	if result == nil {
+		t.Fatal("missing result")
+	}
+
+	want := []state.DiffSummaryRelease{
+		{ID: "default//foo", Name: "foo", KubeContext: "default", Chart: "mychart1", Status: state.DiffStatusUnchanged},
+		{ID: "default/ns1/bar", Name: "bar", Namespace: "ns1", KubeContext: "default", Chart: "mychart2", Status: state.DiffStatusDeleted, ExitCode: 2},
+	}
+
+	if d := cmp.Diff(want, result.Releases); d != "" {
+		t.Errorf("unexpected releases: want (-), got (+):\n%s", d)
+	}
+
+	if !result.Changed() {
+		t.Error("the result has no changes")
+	}
+}
@@ -0,0 +1,58 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// envFromGitBranch is the value of --environment that makes the environment named after the current git branch
+	envFromGitBranch = "@branch"
+	// envFromFilePrefix is the prefix of the value of --environment like `@path/to/file` that makes the environment named after the content of the file
+	envFromFilePrefix = "@"
+)
+
+// resolveEnv replaces a.Env given as `@branch` or `@<file>` with the environment name read from the current git branch or the file,
+// so that the state files are loaded for the resolved environment.
+// It does nothing when a.Env is a plain environment name, or has already been resolved.
+func (a *App) resolveEnv() error {
+	if !strings.HasPrefix(a.Env, envFromFilePrefix) {
+		return nil
+	}
+
+	var name, source string
+
+	if a.Env == envFromGitBranch {
+		branch, err := a.gitBranch()
+		if err != nil {
+			return fmt.Errorf("resolving the environment from the git branch: %w", err)
+		}
+
+		name = strings.TrimSpace(branch)
+		if name == "HEAD" {
+			return fmt.Errorf("resolving the environment from the git branch: HEAD is detached")
+		}
+		source = "the git branch"
+	} else {
+		file := strings.TrimPrefix(a.Env, envFromFilePrefix)
+
+		bs, err := a.readFile(file)
+		if err != nil {
+			return fmt.Errorf("resolving the environment from %s: %w", file, err)
+		}
+
+		name = strings.TrimSpace(string(bs))
+		source = file
+	}
+
+	if name == "" {
+		return fmt.Errorf("resolving the environment from %s: the environment name is empty", source)
+	}
+
+	a.Logger.Debugf("resolved the environment %q from %s", name, source)
+
+	a.Env = name
+	a.envSource = source
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package app
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+func TestVisitDesiredStatesWithReleasesFiltered_EnvFromFileOrGitBranch(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+environments:
+  staging:
+  prod:
+
+releases:
+- name: zipkin-{{ .Environment.Name }}
+  chart: stable/zipkin
+`,
+		"/path/to/env":       "prod\n",
+		"/path/to/empty-env": "\n",
+		"/path/to/typo-env":  "prd\n",
+	}
+
+	testcases := []struct {
+		name      string
+		env       string
+		branch    string
+		branchErr error
+		wantEnv   string
+		wantErr   string
+	}{
+		{
+			name:    "plain",
+			env:     "staging",
+			wantEnv: "staging",
+		},
+		{
+			name:    "file",
+			env:     "@env",
+			wantEnv: "prod",
+		},
+		{
+			name:    "empty file",
+			env:     "@empty-env",
+			wantErr: "resolving the environment from empty-env: the environment name is empty",
+		},
+		{
+			name:    "missing file",
+			env:     "@missing",
+			wantErr: "resolving the environment from missing:",
+		},
+		{
+			name:    "undefined environment in file",
+			env:     "@typo-env",
+			wantErr: `environment "prd" read from typo-env is not defined in any helmfile`,
+		},
+		{
+			name:    "git branch",
+			env:     "@branch",
+			branch:  "staging\n",
+			wantEnv: "staging",
+		},
+		{
+			name:    "undefined environment for git branch",
+			env:     "@branch",
+			branch:  "feature-x\n",
+			wantErr: `environment "feature-x" read from the git branch is not defined in any helmfile`,
+		},
+		{
+			name:    "detached HEAD",
+			env:     "@branch",
+			branch:  "HEAD\n",
+			wantErr: "resolving the environment from the git branch: HEAD is detached",
+		},
+		{
+			name:      "git failure",
+			env:       "@branch",
+			branchErr: errors.New("not a git repository"),
+			wantErr:   "resolving the environment from the git branch: not a git repository",
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			app := appWithFs(&App{
+				OverrideHelmBinary:  DefaultHelmBinary,
+				OverrideKubeContext: "default",
+				Logger:              helmexec.NewLogger(os.Stderr, "debug"),
+				Selectors:           []string{},
+				Env:                 tc.env,
+				FileOrDir:           "helmfile.yaml",
+			}, files)
+
+			app.gitBranch = func() (string, error) {
+				return tc.branch, tc.branchErr
+			}
+
+			expectNoCallsToHelm(app)
+
+			var releases []string
+
+			err := app.ForEachState(func(run *Run) (bool, []error) {
+				for _, r := range run.state.Releases {
+					releases = append(releases, r.Name)
+				}
+				return true, nil
+			}, false, SetFilter(true))
+
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("unexpected error: want %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if app.Env != tc.wantEnv {
+				t.Errorf("unexpected environment: want %q, got %q", tc.wantEnv, app.Env)
+			}
+
+			if len(releases) != 1 || releases[0] != "zipkin-"+tc.wantEnv {
+				t.Errorf("unexpected releases: %v", releases)
+			}
+		})
+	}
+}
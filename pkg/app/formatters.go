@@ -5,14 +5,70 @@ import (
 	"fmt"
 
 	"github.com/gosuri/uitable"
+	"github.com/roboll/helmfile/pkg/state"
 )
 
-func FormatAsTable(releases []*HelmRelease) error {
+// FormatAsTable prints the releases as a table, with the ACTUAL column after INSTALLED when actual is true
+func FormatAsTable(releases []*HelmRelease, actual bool) error {
 	table := uitable.New()
-	table.AddRow("NAME", "NAMESPACE", "ENABLED", "INSTALLED", "LABELS", "CHART", "VERSION")
+	table.AddRow(withActualColumn(actual, 4, "ACTUAL", "NAME", "NAMESPACE", "ENABLED", "INSTALLED", "LABELS", "CHART", "VERSION", "ID")...)
 
 	for _, r := range releases {
-		table.AddRow(r.Name, r.Namespace, fmt.Sprintf("%t", r.Enabled), fmt.Sprintf("%t", r.Installed), r.Labels, r.Chart, r.Version)
+		table.AddRow(withActualColumn(actual, 4, r.Actual, r.Name, r.Namespace, fmt.Sprintf("%t", r.Enabled), fmt.Sprintf("%t", r.Installed), r.Labels, r.Chart, r.Version, r.ID)...)
+	}
+
+	fmt.Println(table.String())
+
+	return nil
+}
+
+// FormatAsWideTable prints the releases as a table with the wide columns, with the ACTUAL column after INSTALLED when actual is true
+func FormatAsWideTable(releases []*HelmRelease, actual bool) error {
+	table := uitable.New()
+	table.AddRow(withActualColumn(actual, 5, "ACTUAL", "NAME", "NAMESPACE", "NAMESPACE SOURCE", "ENABLED", "INSTALLED", "LABELS", "CHART", "VERSION", "RESOLVED VERSION", "ID", "HELMFILE")...)
+
+	for _, r := range releases {
+		table.AddRow(withActualColumn(actual, 5, r.Actual, r.Name, r.Namespace, r.NamespaceSource, fmt.Sprintf("%t", r.Enabled), fmt.Sprintf("%t", r.Installed), r.Labels, r.Chart, r.Version, r.ResolvedVersion, r.ID, r.Helmfile)...)
+	}
+
+	fmt.Println(table.String())
+
+	return nil
+}
+
+// withActualColumn inserts the cell of the ACTUAL column at the index of the row when actual is true
+func withActualColumn(actual bool, index int, cell string, row ...interface{}) []interface{} {
+	if !actual {
+		return row
+	}
+
+	return append(append(append([]interface{}{}, row[:index]...), cell), row[index:]...)
+}
+
+// FormatStatusesAsJson prints the statuses of releases as a JSON array
+func FormatStatusesAsJson(statuses []state.ReleaseStatus) error {
+	if statuses == nil {
+		statuses = []state.ReleaseStatus{}
+	}
+
+	output, err := json.Marshal(statuses)
+
+	if err != nil {
+		return fmt.Errorf("error generating json: %v", err)
+	}
+
+	fmt.Println(string(output))
+
+	return nil
+}
+
+// FormatVerificationsAsTable prints the results of `helmfile verify`
+func FormatVerificationsAsTable(verifications []state.ChartVerification) error {
+	table := uitable.New()
+	table.AddRow("RELEASE", "CHART", "RESULT")
+
+	for _, v := range verifications {
+		table.AddRow(v.ID, v.Chart, v.Result)
 	}
 
 	fmt.Println(table.String())
@@ -0,0 +1,49 @@
+package app
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// git runs git with the args in the working directory, and returns its stdout
+func git(args ...string) (string, error) {
+	out, err := exec.Command("git", args...).Output()
+	if err != nil {
+		cmd := strings.Join(append([]string{"git"}, args...), " ")
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("running %s: %w: %s", cmd, err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("running %s: %w", cmd, err)
+	}
+	return string(out), nil
+}
+
+// gitBranch returns the name of the git branch checked out in the working directory
+func gitBranch() (string, error) {
+	return git("rev-parse", "--abbrev-ref", "HEAD")
+}
+
+// gitChangedFiles returns the absolute paths to the files changed since the git ref, including the uncommitted changes
+func gitChangedFiles(ref string) ([]string, error) {
+	top, err := git("rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	top = strings.TrimSpace(top)
+
+	out, err := git("diff", "--name-only", ref, "--")
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, f := range strings.Split(out, "\n") {
+		if f = strings.TrimSpace(f); f != "" {
+			files = append(files, filepath.Join(top, f))
+		}
+	}
+
+	return files, nil
+}
@@ -0,0 +1,252 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/variantdev/dag/pkg/dag"
+
+	"github.com/roboll/helmfile/pkg/state"
+)
+
+// globalNeedsGraph is the dependency graph of the releases of all the state files visited by ForEachState.
+type globalNeedsGraph struct {
+	// ids are the IDs of all the releases in the order of visits
+	ids []string
+	// needs are the IDs of the releases needed by each release, keyed by the ID of the release
+	needs map[string][]string
+	// selected is the set of the IDs of the releases matching the selectors
+	selected map[string]bool
+	// levels are the indices of the groups of the releases, keyed by the ID of the release
+	levels map[string]int
+}
+
+func (g *globalNeedsGraph) add(needsByID map[string][]string, selected []state.ReleaseSpec) {
+	for i := range selected {
+		g.selected[state.ReleaseToID(&selected[i])] = true
+	}
+
+	var ids []string
+	for id := range needsByID {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		if _, ok := g.needs[id]; !ok {
+			g.ids = append(g.ids, id)
+		}
+		g.needs[id] = append(g.needs[id], needsByID[id]...)
+	}
+}
+
+// selectNeeds selects the releases needed by the selected releases as well, and their needs too when transitive is true
+func (g *globalNeedsGraph) selectNeeds(transitive bool) {
+	var queue []string
+	for _, id := range g.ids {
+		if g.selected[id] {
+			queue = append(queue, id)
+		}
+	}
+
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+
+		for _, n := range g.needs[id] {
+			if _, defined := g.needs[n]; !defined || g.selected[n] {
+				continue
+			}
+			g.selected[n] = true
+
+			if transitive {
+				queue = append(queue, n)
+			}
+		}
+	}
+}
+
+// plan groups the releases so that each release comes after all the releases it needs, and returns the number of the groups.
+// The needs on undefined releases are left to the state files defining the releases needing them, which fail with the usual error.
+func (g *globalNeedsGraph) plan() (int, error) {
+	d := dag.New()
+
+	for _, id := range g.ids {
+		var deps []string
+		for _, n := range g.needs[id] {
+			if _, defined := g.needs[n]; defined {
+				deps = append(deps, n)
+			}
+		}
+
+		d.Add(id, dag.Dependencies(deps))
+	}
+
+	plan, err := d.Plan()
+	if err != nil {
+		return 0, fmt.Errorf("unable to order the releases by the needs across the state files: %w", err)
+	}
+
+	g.levels = map[string]int{}
+	for i, group := range plan {
+		for _, node := range group {
+			g.levels[node.Id] = i
+		}
+	}
+
+	return len(plan), nil
+}
+
+// outside returns the IDs of the releases in the groups other than the level
+func (g *globalNeedsGraph) outside(level int) map[string]bool {
+	ids := map[string]bool{}
+	for _, id := range g.ids {
+		if g.levels[id] != level {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// narrow narrows down the releases of the state file to the ones in the group of the level, and selects the selected ones among them.
+// It returns false when the state file has no release in the group.
+func (g *globalNeedsGraph) narrow(st *state.HelmState, level int) (bool, error) {
+	ids := map[string]bool{}
+	for _, r := range st.GetReleasesWithOverrides() {
+		release := r
+		if id := state.ReleaseToID(&release); g.levels[id] == level {
+			ids[id] = true
+		}
+	}
+
+	if len(ids) == 0 {
+		return false, nil
+	}
+
+	if err := st.RetainReleases(ids); err != nil {
+		return false, err
+	}
+
+	st.RemoveNeeds(g.outside(level))
+
+	// The selection is made across the state files beforehand, and the releases are selected in the same way as --changed-since
+	var selectors []string
+	for i := range st.Releases {
+		release := st.Releases[i]
+		if g.selected[state.ReleaseToID(&release)] {
+			selectors = append(selectors, releaseSelector(&release))
+		}
+	}
+
+	if len(selectors) == 0 {
+		// The releases are deselected rather than removed, so that --purge-orphans doesn't take them for orphans
+		selectors = []string{noReleaseSelector}
+	}
+
+	st.Selectors = selectors
+	st.ExcludeSelectors = nil
+
+	return true, nil
+}
+
+// forEachStateWithGlobalNeeds is ForEachState with `needs` honored across state files.
+//
+// It visits all the state files once to build the dependency graph of the releases of all the state files,
+// and then visits all the state files once per group of the releases ordered by the graph,
+// running `do` on each state file narrowed down to its releases in the group.
+// The releases are selected by the selectors across the state files beforehand, along with their needs with IncludeNeeds or includeTransitiveNeeds.
+func (a *App) forEachStateWithGlobalNeeds(do func(*Run) (bool, []error), includeTransitiveNeeds bool, o ...LoadOption) error {
+	opts := LoadOpts{}
+	for _, f := range o {
+		f(&opts)
+	}
+
+	graph := &globalNeedsGraph{
+		needs:    map[string][]string{},
+		selected: map[string]bool{},
+	}
+
+	// The releases are filtered per group, after they are narrowed down to the group
+	visitOpts := append(append([]LoadOption{}, o...), SetFilter(false))
+
+	err := a.visitStatesWithoutNoMatchHandling(a.FileOrDir, func(st *state.HelmState) (bool, []error) {
+		needs, err := st.NeedsByReleaseID()
+		if err != nil {
+			return false, []error{err}
+		}
+
+		selected, err := st.GetSelectedReleasesWithOverrides(false)
+		if err != nil {
+			return false, []error{err}
+		}
+
+		graph.add(needs, selected)
+
+		return true, nil
+	}, includeTransitiveNeeds, visitOpts...)
+	if err != nil {
+		return a.handleNoMatchingHelmfile(err)
+	}
+
+	if opts.IncludeNeeds || includeTransitiveNeeds {
+		graph.selectNeeds(includeTransitiveNeeds)
+	}
+
+	numLevels, err := graph.plan()
+	if err != nil {
+		return appError("", err)
+	}
+
+	a.Logger.Debugf("processing %d groups of releases ordered by needs across the state files", numLevels)
+
+	ctx := NewContext()
+
+	var processed bool
+
+	// A tree of state files without releases is still visited once, as usual
+	for i := 0; i < numLevels || i == 0; i++ {
+		level := i
+		if opts.Reverse {
+			level = numLevels - 1 - i
+		}
+
+		err := a.visitStatesWithoutNoMatchHandling(a.FileOrDir, func(st *state.HelmState) (bool, []error) {
+			if len(st.Releases) > 0 {
+				ok, err := graph.narrow(st, level)
+				if err != nil {
+					return false, []error{err}
+				}
+				if !ok {
+					return false, nil
+				}
+			} else if i > 0 {
+				return false, nil
+			}
+
+			helm := a.getHelm(st)
+
+			if !opts.Filter {
+				return do(NewRun(st, helm, ctx))
+			}
+
+			return processFilteredReleases(st, helm, func(st *state.HelmState) []error {
+				_, errs := do(NewRun(st, helm, ctx))
+				return errs
+			}, includeTransitiveNeeds)
+		}, includeTransitiveNeeds, visitOpts...)
+
+		switch err.(type) {
+		case nil:
+			processed = true
+		case *NoMatchingHelmfileError:
+		default:
+			return err
+		}
+	}
+
+	if !processed {
+		return a.handleNoMatchingHelmfile(&NoMatchingHelmfileError{selectors: a.Selectors, env: a.Env})
+	}
+
+	return nil
+}
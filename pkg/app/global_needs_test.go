@@ -0,0 +1,244 @@
+package app
+
+import (
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/roboll/helmfile/pkg/exectest"
+	"github.com/roboll/helmfile/pkg/helmexec"
+	"github.com/variantdev/vals"
+)
+
+func TestSync_GlobalNeeds(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+helmfiles:
+- states/b.yaml
+- states/a.yaml
+`,
+		"/path/to/states/a.yaml": `
+releases:
+- name: database
+  chart: incubator/raw
+  namespace: data
+- name: cache
+  chart: incubator/raw
+  namespace: data
+  needs:
+  - data/database
+`,
+		"/path/to/states/b.yaml": `
+releases:
+- name: monitoring
+  chart: incubator/raw
+  namespace: ops
+- name: backend
+  chart: incubator/raw
+  namespace: app
+  needs:
+  - default/data/cache
+- name: frontend
+  chart: incubator/raw
+  namespace: app
+  needs:
+  - app/backend
+`,
+	}
+
+	testcases := []struct {
+		name                   string
+		globalNeeds            bool
+		files                  map[string]string
+		selectors              []string
+		includeNeeds           bool
+		includeTransitiveNeeds bool
+		changed                []string
+		upgraded               []string
+		error                  string
+	}{
+		{
+			name:        "needs across state files",
+			globalNeeds: true,
+			files:       files,
+			// monitoring needs nothing, and doesn't wait for the releases of a.yaml needed by the other releases of b.yaml
+			upgraded: []string{"monitoring", "database", "cache", "backend", "frontend"},
+		},
+		{
+			name:        "needs across state files with selectors",
+			globalNeeds: true,
+			files:       files,
+			selectors:   []string{"name=backend", "name=database"},
+			upgraded:    []string{"database", "backend"},
+		},
+		{
+			name:         "needs across state files with needs",
+			globalNeeds:  true,
+			files:        files,
+			selectors:    []string{"name=frontend"},
+			includeNeeds: true,
+			upgraded:     []string{"backend", "frontend"},
+		},
+		{
+			name:                   "needs across state files with transitive needs",
+			globalNeeds:            true,
+			files:                  files,
+			selectors:              []string{"name=frontend"},
+			includeTransitiveNeeds: true,
+			upgraded:               []string{"database", "cache", "backend", "frontend"},
+		},
+		{
+			name:        "needs across state files with no matching release",
+			globalNeeds: true,
+			files:       files,
+			selectors:   []string{"name=none"},
+			error:       "err: no releases found that matches specified selector(name=none) and environment(default), in any helmfile",
+		},
+		{
+			name:        "needs across state files with changed releases",
+			globalNeeds: true,
+			files:       files,
+			changed:     []string{"/path/to/states/a.yaml"},
+			upgraded:    []string{"database", "cache"},
+		},
+		{
+			name:        "needs across state files with no changed release",
+			globalNeeds: true,
+			files:       files,
+			changed:     []string{"/path/to/README.md"},
+		},
+		{
+			name:  "needs across state files without global needs",
+			files: files,
+			error: `in ./helmfile.yaml: in .helmfiles[0]: in /path/to/states/b.yaml: release(s) "default/app/backend" depend(s) on an undefined release "default/data/cache". Perhaps you made a typo in "needs" or forgot defining a release named "cache" with appropriate "namespace" and "kubeContext"?`,
+		},
+		{
+			name:        "state files needing releases of each other",
+			globalNeeds: true,
+			files: map[string]string{
+				"/path/to/helmfile.yaml": `
+helmfiles:
+- states/a.yaml
+- states/b.yaml
+`,
+				"/path/to/states/a.yaml": `
+releases:
+- name: database
+  chart: incubator/raw
+  namespace: data
+- name: cache
+  chart: incubator/raw
+  namespace: data
+  needs:
+  - app/backend
+`,
+				"/path/to/states/b.yaml": `
+releases:
+- name: backend
+  chart: incubator/raw
+  namespace: app
+  needs:
+  - data/database
+`,
+			},
+			upgraded: []string{"database", "backend", "cache"},
+		},
+		{
+			name:        "releases needing each other across state files",
+			globalNeeds: true,
+			files: map[string]string{
+				"/path/to/helmfile.yaml": `
+helmfiles:
+- states/a.yaml
+- states/b.yaml
+`,
+				"/path/to/states/a.yaml": `
+releases:
+- name: database
+  chart: incubator/raw
+  namespace: data
+  needs:
+  - app/backend
+`,
+				"/path/to/states/b.yaml": `
+releases:
+- name: backend
+  chart: incubator/raw
+  namespace: app
+  needs:
+  - data/database
+`,
+			},
+			error: `unable to order the releases by the needs across the state files: cycle detected: default/app/backend -> default/data/database -> default/app/backend`,
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			helm := &exectest.Helm{
+				Helm3:         true,
+				DiffMutex:     &sync.Mutex{},
+				ChartsMutex:   &sync.Mutex{},
+				ReleasesMutex: &sync.Mutex{},
+			}
+
+			logger := helmexec.NewLogger(io.Discard, "debug")
+
+			valsRuntime, err := vals.New(vals.Options{CacheSize: 32})
+			if err != nil {
+				t.Fatalf("unexpected error creating vals runtime: %v", err)
+			}
+
+			app := appWithFs(&App{
+				OverrideHelmBinary:  DefaultHelmBinary,
+				glob:                filepath.Glob,
+				abs:                 filepath.Abs,
+				OverrideKubeContext: "default",
+				Env:                 "default",
+				Logger:              logger,
+				Selectors:           tc.selectors,
+				GlobalNeeds:         tc.globalNeeds,
+				helms: map[helmKey]helmexec.Interface{
+					createHelmKey("helm", "default"): helm,
+				},
+				valsRuntime: valsRuntime,
+			}, tc.files)
+
+			if tc.changed != nil {
+				app.ChangedSince = "origin/main"
+				app.gitChangedFiles = func(string) ([]string, error) {
+					return tc.changed, nil
+				}
+			}
+
+			syncErr := app.Sync(applyConfig{
+				concurrency:            1,
+				includeNeeds:           tc.includeNeeds || tc.includeTransitiveNeeds,
+				includeTransitiveNeeds: tc.includeTransitiveNeeds,
+				logger:                 logger,
+			})
+
+			var gotErr string
+			if syncErr != nil {
+				gotErr = syncErr.Error()
+			}
+
+			if d := cmp.Diff(tc.error, gotErr); d != "" {
+				t.Fatalf("unexpected error: want (-), got (+): %s", d)
+			}
+
+			var upgraded []string
+			for _, r := range helm.Releases {
+				upgraded = append(upgraded, r.Name)
+			}
+
+			if d := cmp.Diff(tc.upgraded, upgraded); d != "" {
+				t.Errorf("unexpected upgrades: want (-), got (+): %s", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/roboll/helmfile/pkg/remote"
+	"github.com/roboll/helmfile/pkg/state"
+)
+
+// introspectionCacheTTL is how long the result of Introspect is reused by IntrospectCached.
+// Shell completion runs helmfile on every key press, which would otherwise render all the state files each time.
+const introspectionCacheTTL = 10 * time.Second
+
+// introspectionCacheDir is the directory within the cache directory the results of Introspect are cached in
+const introspectionCacheDir = "completion"
+
+// StateIntrospection is what the state files define, for completing the command line with the release names and the labels for --selector
+type StateIntrospection struct {
+	// Releases are the sorted names of all the releases
+	Releases []string `json:"releases"`
+	// Labels are the sorted values of each label key the selectors can match, including name, namespace and chart
+	Labels map[string][]string `json:"labels"`
+}
+
+// LabelKeys returns the sorted keys of the labels
+func (i *StateIntrospection) LabelKeys() []string {
+	keys := make([]string, 0, len(i.Labels))
+	for k := range i.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Selectors returns every `key=value` selector matching at least one release, sorted by the key and the value.
+// An empty value, like the namespace of a release without one, isn't worth completing and is skipped.
+func (i *StateIntrospection) Selectors() []string {
+	var selectors []string
+	for _, k := range i.LabelKeys() {
+		for _, v := range i.Labels[k] {
+			if v == "" {
+				continue
+			}
+			selectors = append(selectors, k+"="+v)
+		}
+	}
+	return selectors
+}
+
+// Introspect loads all the state files, and returns the names and the labels of all the releases defined in them.
+// It's lightweight compared to the other commands, as it only renders the state files.
+// helm isn't run, including `helm version`, unless the environment has secrets to decrypt.
+// --selector is ignored, so that all the releases are returned.
+func (a *App) Introspect() (*StateIntrospection, error) {
+	a.remote = remote.NewRemote(a.Logger, "", a.readFile, a.directoryExistsAt, a.fileExistsAt)
+
+	if err := a.resolveEnv(); err != nil {
+		return nil, err
+	}
+
+	releases := map[string]bool{}
+	labels := map[string]map[string]bool{}
+
+	err := a.visitStates(a.FileOrDir, LoadOpts{}, func(st *state.HelmState) (bool, []error) {
+		for _, r := range st.GetReleasesWithOverrides() {
+			release := r
+
+			releases[release.Name] = true
+
+			for k, v := range state.ReleaseSelectorLabels(&release, st.CommonLabels) {
+				if labels[k] == nil {
+					labels[k] = map[string]bool{}
+				}
+				labels[k][v] = true
+			}
+		}
+
+		return true, nil
+	})
+	if err != nil {
+		if _, ok := err.(*NoMatchingHelmfileError); !ok {
+			return nil, err
+		}
+	}
+
+	intro := &StateIntrospection{
+		Releases: sortedKeys(releases),
+		Labels:   map[string][]string{},
+	}
+
+	for k, vs := range labels {
+		intro.Labels[k] = sortedKeys(vs)
+	}
+
+	return intro, nil
+}
+
+// IntrospectCached returns the result of Introspect cached in the cache directory for introspectionCacheTTL,
+// keyed by the state file or directory and the environment.
+// A failure in reading or writing the cache is ignored, as the cache is only for speeding up the completion.
+func (a *App) IntrospectCached() (*StateIntrospection, error) {
+	path, err := a.introspectionCachePath()
+	if err != nil {
+		return a.Introspect()
+	}
+
+	if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) < introspectionCacheTTL {
+		if bs, err := os.ReadFile(path); err == nil {
+			var cached StateIntrospection
+			if err := json.Unmarshal(bs, &cached); err == nil {
+				return &cached, nil
+			}
+		}
+	}
+
+	intro, err := a.Introspect()
+	if err != nil {
+		return nil, err
+	}
+
+	if bs, err := json.Marshal(intro); err == nil {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+			_ = remote.MarkCacheEntry(remote.CacheDir(), introspectionCacheDir)
+			_ = os.WriteFile(path, bs, 0644)
+		}
+	}
+
+	return intro, nil
+}
+
+func (a *App) introspectionCachePath() (string, error) {
+	fileOrDir, err := a.abs(a.FileOrDir)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(fileOrDir + "\n" + a.Env))
+
+	return filepath.Join(remote.CacheDir(), introspectionCacheDir, hex.EncodeToString(sum[:])+".json"), nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
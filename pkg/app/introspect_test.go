@@ -0,0 +1,109 @@
+package app
+
+import (
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+func TestIntrospect(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+helmfiles:
+- helmfile.d/*.yaml
+
+commonLabels:
+  team: core
+
+releases:
+- name: frontend
+  namespace: web
+  chart: stable/nginx
+  labels:
+    tier: web
+- name: backend-{{ .Environment.Name }}
+  namespace: api
+  chart: mycharts/api
+  labels:
+    tier: api
+    team: backend
+`,
+		"/path/to/helmfile.d/db.yaml": `
+releases:
+- name: database
+  namespace: api
+  chart: bitnami/postgresql
+  labels:
+    tier: db
+- name: cache
+  chart: bitnami/redis
+`,
+	}
+
+	app := appWithFs(&App{
+		OverrideHelmBinary:  DefaultHelmBinary,
+		OverrideKubeContext: "default",
+		Logger:              helmexec.NewLogger(os.Stderr, "debug"),
+		// The selectors are ignored so that all the releases are completed
+		Selectors: []string{"name=frontend"},
+		Env:       "default",
+		FileOrDir: "helmfile.yaml",
+	}, files)
+
+	intro, err := app.Introspect()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if d := cmp.Diff([]string{"backend-default", "cache", "database", "frontend"}, intro.Releases); d != "" {
+		t.Errorf("unexpected releases: want (-), got (+):\n%s", d)
+	}
+
+	if d := cmp.Diff([]string{"chart", "name", "namespace", "team", "tier"}, intro.LabelKeys()); d != "" {
+		t.Errorf("unexpected label keys: want (-), got (+):\n%s", d)
+	}
+
+	wantLabels := map[string][]string{
+		"chart":     {"api", "nginx", "postgresql", "redis"},
+		"name":      {"backend-default", "cache", "database", "frontend"},
+		"namespace": {"", "api", "web"},
+		"team":      {"backend", "core"},
+		"tier":      {"api", "db", "web"},
+	}
+	if d := cmp.Diff(wantLabels, intro.Labels); d != "" {
+		t.Errorf("unexpected labels: want (-), got (+):\n%s", d)
+	}
+
+	// The empty namespace of cache isn't completed as `namespace=`
+	wantSelectors := []string{
+		"chart=api", "chart=nginx", "chart=postgresql", "chart=redis",
+		"name=backend-default", "name=cache", "name=database", "name=frontend",
+		"namespace=api", "namespace=web",
+		"team=backend", "team=core",
+		"tier=api", "tier=db", "tier=web",
+	}
+	if d := cmp.Diff(wantSelectors, intro.Selectors()); d != "" {
+		t.Errorf("unexpected selectors: want (-), got (+):\n%s", d)
+	}
+
+	if len(app.helms) > 0 {
+		t.Errorf("helm should not be run to introspect the state files: %v", app.helms)
+	}
+}
+
+func TestIntrospect_NoHelmfile(t *testing.T) {
+	app := appWithFs(&App{
+		OverrideHelmBinary:  DefaultHelmBinary,
+		OverrideKubeContext: "default",
+		Logger:              helmexec.NewLogger(os.Stderr, "debug"),
+		Env:                 "default",
+	}, map[string]string{})
+
+	intro, err := app.Introspect()
+	if err == nil {
+		t.Fatalf("expected an error for the missing helmfile, got %v", intro)
+	}
+}
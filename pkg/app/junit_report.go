@@ -0,0 +1,206 @@
+package app
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/roboll/helmfile/pkg/state"
+)
+
+// junitReport collects the result of applying each release, to be written as a JUnit XML report by `apply --junit-report`.
+// Each release is a test case, which fails when upgrading or deleting it errored, and is skipped when it has no changes.
+type junitReport struct {
+	cases []junitTestCase
+
+	mu sync.Mutex
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr,omitempty"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+const (
+	junitActionUpgrade = "upgrade"
+	junitActionDelete  = "delete"
+)
+
+// addApplyResults records the result of applying the releases of the state file.
+// toUpdate and toDelete are the releases apply tried to upgrade and delete, unchanged are the ones without changes,
+// and errs are the errors of upgrading and deleting them.
+// It does nothing when r is nil, which is the case unless --junit-report is set.
+func (r *junitReport) addApplyResults(st *state.HelmState, toUpdate, toDelete, unchanged []state.ReleaseSpec, affected *state.AffectedReleases, errs []error) {
+	if r == nil {
+		return
+	}
+
+	errMsgs := map[string]string{}
+	for _, err := range errs {
+		var relErr *state.ReleaseError
+		if errors.As(err, &relErr) && relErr.ReleaseSpec != nil {
+			errMsgs[state.ReleaseToID(relErr.ReleaseSpec)] = relErr.Error()
+		}
+	}
+
+	done := map[string]bool{}
+	for _, rs := range [][]*state.ReleaseSpec{affected.Upgraded, affected.Deleted} {
+		for _, release := range rs {
+			done[state.ReleaseToID(release)] = true
+		}
+	}
+
+	failed := map[string]bool{}
+	for _, release := range affected.Failed {
+		failed[state.ReleaseToID(release)] = true
+	}
+
+	var cases []junitTestCase
+
+	add := func(releases []state.ReleaseSpec, action string) {
+		for i := range releases {
+			release := &releases[i]
+			id := state.ReleaseToID(release)
+
+			c := junitTestCase{Name: id, ClassName: st.FilePath}
+
+			if md, ok := affected.Metadata[id]; ok {
+				c.Time = fmt.Sprintf("%.3f", md.Duration.Seconds())
+			}
+
+			msg, hasErr := errMsgs[id]
+			switch {
+			case hasErr || failed[id]:
+				if msg == "" {
+					msg = fmt.Sprintf("failed to %s release %s", action, id)
+				}
+				c.Failure = &junitFailure{Message: msg, Type: action, Text: msg}
+			case done[id]:
+			default:
+				c.Skipped = &junitSkipped{Message: fmt.Sprintf("release was not %sd", action)}
+			}
+
+			cases = append(cases, c)
+		}
+	}
+
+	add(toDelete, junitActionDelete)
+	add(toUpdate, junitActionUpgrade)
+
+	for i := range unchanged {
+		cases = append(cases, junitTestCase{
+			Name:      state.ReleaseToID(&unchanged[i]),
+			ClassName: st.FilePath,
+			Skipped:   &junitSkipped{Message: "no changes"},
+		})
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cases = append(r.cases, cases...)
+}
+
+// addErrors records the releases that failed before being applied, like the ones whose diff errored
+func (r *junitReport) addErrors(st *state.HelmState, errs []error) {
+	r.addApplyResults(st, releasesOfErrors(errs), nil, nil, &state.AffectedReleases{}, errs)
+}
+
+func releasesOfErrors(errs []error) []state.ReleaseSpec {
+	var releases []state.ReleaseSpec
+	for _, err := range errs {
+		var relErr *state.ReleaseError
+		if errors.As(err, &relErr) && relErr.ReleaseSpec != nil {
+			releases = append(releases, *relErr.ReleaseSpec)
+		}
+	}
+	return releases
+}
+
+// WriteFile writes the report as JUnit XML to the file at path
+func (r *junitReport) WriteFile(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cases := append([]junitTestCase{}, r.cases...)
+	// Make the output deterministic, as the state files and the releases are processed concurrently
+	sort.SliceStable(cases, func(i, j int) bool {
+		if cases[i].ClassName != cases[j].ClassName {
+			return cases[i].ClassName < cases[j].ClassName
+		}
+		return cases[i].Name < cases[j].Name
+	})
+
+	suite := junitTestSuite{Name: "helmfile apply", Tests: len(cases), Cases: cases}
+	for _, c := range cases {
+		if c.Failure != nil {
+			suite.Failures++
+		}
+		if c.Skipped != nil {
+			suite.Skipped++
+		}
+	}
+
+	suites := junitTestSuites{
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Skipped:  suite.Skipped,
+		Suites:   []junitTestSuite{suite},
+	}
+
+	bs, err := xml.MarshalIndent(suites, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshalling junit report: %w", err)
+	}
+
+	if err := os.WriteFile(path, append([]byte(xml.Header), append(bs, '\n')...), 0644); err != nil {
+		return fmt.Errorf("writing junit report to %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// writeJUnitReport writes the report to the file at path, and returns the error of apply.
+// The error of writing the report is returned only when apply succeeded, so that it never hides the error of apply.
+func (a *App) writeJUnitReport(report *junitReport, path string, err error) error {
+	if writeErr := report.WriteFile(path); writeErr != nil {
+		if err == nil {
+			return appError("", writeErr)
+		}
+		a.Logger.Warnf("%v", writeErr)
+	}
+
+	return err
+}
@@ -17,6 +17,9 @@ type LoadOpts struct {
 	Reverse bool
 
 	Filter bool
+
+	// IncludeNeeds makes --global-needs select the releases needed by the selected releases in all the state files
+	IncludeNeeds bool
 }
 
 func (o LoadOpts) DeepCopy() LoadOpts {
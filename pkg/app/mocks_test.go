@@ -43,6 +43,9 @@ func (helm *noCallHelmExec) BuildDeps(name, chart string) error {
 func (helm *noCallHelmExec) SetExtraArgs(args ...string) {
 	helm.doPanic()
 }
+func (helm *noCallHelmExec) SetAppendArgs(args ...string) {
+	helm.doPanic()
+}
 func (helm *noCallHelmExec) SetHelmBinary(bin string) {
 	helm.doPanic()
 }
@@ -84,6 +87,18 @@ func (helm *noCallHelmExec) DecryptSecret(context helmexec.HelmContext, name str
 	helm.doPanic()
 	return "", nil
 }
+func (helm *noCallHelmExec) GetReleaseStatus(context helmexec.HelmContext, name string, flags ...string) (string, error) {
+	helm.doPanic()
+	return "", nil
+}
+func (helm *noCallHelmExec) GetValues(context helmexec.HelmContext, name string, flags ...string) (string, error) {
+	helm.doPanic()
+	return "", nil
+}
+func (helm *noCallHelmExec) SearchRepo(chart string, flags ...string) (string, error) {
+	helm.doPanic()
+	return "", nil
+}
 func (helm *noCallHelmExec) TestRelease(context helmexec.HelmContext, name string, flags ...string) error {
 	helm.doPanic()
 	return nil
@@ -92,6 +107,10 @@ func (helm *noCallHelmExec) Fetch(chart string, flags ...string) error {
 	helm.doPanic()
 	return nil
 }
+func (helm *noCallHelmExec) VerifyChart(chart string, flags ...string) error {
+	helm.doPanic()
+	return nil
+}
 func (helm *noCallHelmExec) Lint(name, chart string, flags ...string) error {
 	helm.doPanic()
 	return nil
@@ -110,3 +129,8 @@ func (helm *noCallHelmExec) IsVersionAtLeast(versionStr string) bool {
 	helm.doPanic()
 	return false
 }
+
+func (helm *noCallHelmExec) IsDiffPluginVersionAtLeast(versionStr string) bool {
+	helm.doPanic()
+	return false
+}
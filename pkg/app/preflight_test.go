@@ -0,0 +1,101 @@
+package app
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/variantdev/vals"
+
+	"github.com/roboll/helmfile/pkg/exectest"
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+func TestPreflight_BeforePreparingCharts(t *testing.T) {
+	t.Setenv("KUBECONFIG", "/path/to/kubeconfig")
+
+	files := map[string]string{
+		"/path/to/kubeconfig": `
+current-context: dev
+contexts:
+- name: dev
+  context:
+    cluster: dev
+`,
+		"/path/to/helmfile.yaml": `
+repositories:
+- name: stable
+  url: https://charts.example.com
+
+releases:
+- name: foo
+  chart: stable/mychart
+  kubeContext: prod
+`,
+	}
+
+	testcases := []struct {
+		name string
+		run  func(app *App) error
+	}{
+		{
+			name: "apply",
+			run: func(app *App) error {
+				return app.Apply(applyConfig{concurrency: 1, preflight: true, logger: app.Logger})
+			},
+		},
+		{
+			name: "sync",
+			run: func(app *App) error {
+				return app.Sync(applyConfig{concurrency: 1, preflight: true, logger: app.Logger})
+			},
+		},
+		{
+			name: "diff",
+			run: func(app *App) error {
+				return app.Diff(diffConfig{concurrency: 1, preflight: true, logger: app.Logger})
+			},
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			helm := &exectest.Helm{
+				FailOnUnexpectedList: true,
+				FailOnUnexpectedDiff: true,
+				DiffMutex:            &sync.Mutex{},
+				ChartsMutex:          &sync.Mutex{},
+				ReleasesMutex:        &sync.Mutex{},
+			}
+
+			valsRuntime, err := vals.New(vals.Options{CacheSize: 32})
+			if err != nil {
+				t.Fatalf("unexpected error creating vals runtime: %v", err)
+			}
+
+			app := appWithFs(&App{
+				OverrideHelmBinary: DefaultHelmBinary,
+				Env:                "default",
+				Logger:             helmexec.NewLogger(io.Discard, "debug"),
+				helms: map[helmKey]helmexec.Interface{
+					createHelmKey("helm", ""): helm,
+				},
+				valsRuntime: valsRuntime,
+			}, files)
+
+			err = tc.run(app)
+
+			want := `preflight: kube context "prod" of releases foo does not exist in the kubeconfig`
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Fatalf("unexpected error: want %q, got %v", want, err)
+			}
+
+			if helm.Repo != nil || len(helm.Charts) > 0 {
+				t.Errorf("unexpected helm commands before the preflight check: repo %v, charts %v", helm.Repo, helm.Charts)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/roboll/helmfile/pkg/state"
+)
+
+// orphanReleases is the releases installed in the namespaces of a state file but not defined in it.
+type orphanReleases struct {
+	run *Run
+	// defined is the state before apply narrows down its releases to the selected ones
+	defined  state.HelmState
+	releases []state.ReleaseSpec
+}
+
+// purgeOrphans deletes the releases that are installed in the namespaces of the state files but defined in none of them,
+// after the confirmation when --interactive is set.
+// With --dry-run, it only shows the releases that would be deleted.
+// It returns true when any release is deleted, or would be deleted with --dry-run.
+func (a *App) purgeOrphans(orphans []orphanReleases, c ApplyConfigProvider) (bool, []error) {
+	var (
+		ids     []string
+		targets []orphanReleases
+	)
+
+	// The same orphan is found by every state file deploying to its namespace, but it's deleted only once
+	seen := map[string]bool{}
+
+	for _, o := range orphans {
+		var rs []state.ReleaseSpec
+
+		for _, r := range o.releases {
+			id := state.ReleaseToID(&r)
+			if seen[id] || definedInAny(orphans, r) {
+				continue
+			}
+			seen[id] = true
+
+			rs = append(rs, r)
+			ids = append(ids, "  "+id)
+		}
+
+		if len(rs) > 0 {
+			targets = append(targets, orphanReleases{run: o.run, defined: o.defined, releases: rs})
+		}
+	}
+
+	if len(targets) == 0 {
+		a.Logger.Debugf("no orphan releases found in namespaces %s", strings.Join(c.PurgeOrphansNamespaces(), ", "))
+		return false, nil
+	}
+
+	sort.Strings(ids)
+
+	if c.DryRun() {
+		a.summaryLogger(c.Logger()).Infof("The following releases are not defined in any helmfile and would be DELETED:\n%s\n", strings.Join(ids, "\n"))
+		return true, nil
+	}
+
+	msg := fmt.Sprintf(`The following releases are not defined in any helmfile and will be DELETED:
+%s
+
+Do you really want to delete them?
+
+`, strings.Join(ids, "\n"))
+
+	if c.Interactive() {
+		ok, err := a.confirm(msg)
+		if err != nil {
+			return false, []error{err}
+		}
+		if !ok {
+			return false, nil
+		}
+	} else {
+		a.Logger.Debug(msg)
+	}
+
+	affectedReleases := state.AffectedReleases{Color: a.Color}
+
+	var errs []error
+
+	for _, t := range targets {
+		st := t.defined
+		st.Releases = t.releases
+
+		errs = append(errs, st.DeleteReleasesForSync(&affectedReleases, t.run.helm, c.Concurrency())...)
+	}
+
+	affectedReleases.DisplayAffectedReleases(a.summaryLogger(c.Logger()))
+
+	return true, errs
+}
+
+func definedInAny(orphans []orphanReleases, r state.ReleaseSpec) bool {
+	for _, o := range orphans {
+		if o.defined.DefinesRelease(r) {
+			return true
+		}
+	}
+
+	return false
+}
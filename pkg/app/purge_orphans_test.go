@@ -0,0 +1,270 @@
+package app
+
+import (
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/variantdev/vals"
+
+	"github.com/roboll/helmfile/pkg/exectest"
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+func TestApply_PurgeOrphans(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+releases:
+- name: foo
+  namespace: ns1
+  chart: stable/mychart1
+- name: bar
+  namespace: ns1
+  chart: stable/mychart2
+  installed: false
+- name: baz
+  namespace: ns2
+  chart: stable/mychart3
+`,
+	}
+
+	testcases := []struct {
+		name       string
+		namespaces []string
+		lists      map[exectest.ListKey]string
+		deleted    []exectest.Release
+		error      string
+	}{
+		{
+			name:       "extra release in the allowed namespace",
+			namespaces: []string{"ns1"},
+			lists: map[exectest.ListKey]string{
+				{Filter: ".*", Flags: "--kube-contextdefault--namespacens1--deployed--failed--pending"}: `foo	ns1	1	2021-01-01 00:00:00	deployed	mychart1-1.0.0	1.0.0
+bar	ns1	1	2021-01-01 00:00:00	deployed	mychart2-1.0.0	1.0.0
+orphan	ns1	1	2021-01-01 00:00:00	deployed	mychart4-1.0.0	1.0.0
+`,
+				{Filter: "^bar$", Flags: "--kube-contextdefault--namespacens1--uninstalling--deployed--failed--pending"}: `bar	ns1	1	2021-01-01 00:00:00	deployed	mychart2-1.0.0	1.0.0
+`,
+			},
+			deleted: []exectest.Release{
+				{Name: "bar", Flags: []string{"--namespace", "ns1", "--kube-context", "default"}},
+				{Name: "orphan", Flags: []string{"--namespace", "ns1", "--kube-context", "default"}},
+			},
+		},
+		{
+			name:       "namespace not in the allowlist",
+			namespaces: []string{"ns3"},
+			lists: map[exectest.ListKey]string{
+				{Filter: "^bar$", Flags: "--kube-contextdefault--namespacens1--uninstalling--deployed--failed--pending"}: ``,
+			},
+		},
+		{
+			name:  "no allowlist",
+			error: "--purge-orphans requires --purge-orphans-namespace to specify the namespaces to delete releases from",
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			helm := &exectest.Helm{
+				FailOnUnexpectedList: true,
+				Lists:                tc.lists,
+				Helm3:                true,
+				DiffMutex:            &sync.Mutex{},
+				ChartsMutex:          &sync.Mutex{},
+				ReleasesMutex:        &sync.Mutex{},
+			}
+
+			logger := helmexec.NewLogger(io.Discard, "debug")
+
+			valsRuntime, err := vals.New(vals.Options{CacheSize: 32})
+			if err != nil {
+				t.Fatalf("unexpected error creating vals runtime: %v", err)
+			}
+
+			app := appWithFs(&App{
+				OverrideHelmBinary:  DefaultHelmBinary,
+				glob:                filepath.Glob,
+				abs:                 filepath.Abs,
+				OverrideKubeContext: "default",
+				Env:                 "default",
+				Logger:              logger,
+				helms: map[helmKey]helmexec.Interface{
+					createHelmKey("helm", "default"): helm,
+				},
+				valsRuntime: valsRuntime,
+			}, files)
+
+			err = app.Apply(applyConfig{
+				concurrency:            1,
+				logger:                 logger,
+				purgeOrphans:           true,
+				purgeOrphansNamespaces: tc.namespaces,
+			})
+
+			if tc.error != "" {
+				if err == nil || err.Error() != tc.error {
+					t.Fatalf("unexpected error: want %q, got %v", tc.error, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if d := cmp.Diff(tc.deleted, helm.Deleted); d != "" {
+				t.Errorf("unexpected deletions: want (-), got (+):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestApply_PurgeOrphans_ChangedSince(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+helmfiles:
+- states/*.yaml
+`,
+		"/path/to/states/a.yaml": `
+releases:
+- name: foo
+  namespace: apps
+  chart: stable/mychart1
+  values:
+  - ../values/foo.yaml
+`,
+		"/path/to/states/b.yaml": `
+releases:
+- name: bar
+  namespace: apps
+  chart: stable/mychart2
+  values:
+  - ../values/bar.yaml
+`,
+		"/path/to/values/foo.yaml": "{}",
+		"/path/to/values/bar.yaml": "{}",
+	}
+
+	helm := &exectest.Helm{
+		FailOnUnexpectedList: true,
+		Lists: map[exectest.ListKey]string{
+			{Filter: ".*", Flags: "--kube-contextdefault--namespaceapps--deployed--failed--pending"}: `foo	apps	1	2021-01-01 00:00:00	deployed	mychart1-1.0.0	1.0.0
+bar	apps	1	2021-01-01 00:00:00	deployed	mychart2-1.0.0	1.0.0
+orphan	apps	1	2021-01-01 00:00:00	deployed	mychart4-1.0.0	1.0.0
+`,
+		},
+		Helm3:         true,
+		DiffMutex:     &sync.Mutex{},
+		ChartsMutex:   &sync.Mutex{},
+		ReleasesMutex: &sync.Mutex{},
+	}
+
+	logger := helmexec.NewLogger(io.Discard, "debug")
+
+	valsRuntime, err := vals.New(vals.Options{CacheSize: 32})
+	if err != nil {
+		t.Fatalf("unexpected error creating vals runtime: %v", err)
+	}
+
+	app := appWithFs(&App{
+		OverrideHelmBinary:  DefaultHelmBinary,
+		OverrideKubeContext: "default",
+		Env:                 "default",
+		Logger:              logger,
+		ChangedSince:        "main",
+		helms: map[helmKey]helmexec.Interface{
+			createHelmKey("helm", "default"): helm,
+		},
+		valsRuntime: valsRuntime,
+	}, files)
+
+	// Only the release in a.yaml has changed, so b.yaml selects none of its releases
+	app.gitChangedFiles = func(string) ([]string, error) {
+		return []string{"/path/to/values/foo.yaml"}, nil
+	}
+
+	err = app.Apply(applyConfig{
+		concurrency:            1,
+		logger:                 logger,
+		purgeOrphans:           true,
+		purgeOrphansNamespaces: []string{"apps"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// bar is unchanged but still defined in b.yaml, so it must not be taken for an orphan
+	deleted := []exectest.Release{
+		{Name: "orphan", Flags: []string{"--namespace", "apps", "--kube-context", "default"}},
+	}
+	if d := cmp.Diff(deleted, helm.Deleted); d != "" {
+		t.Errorf("unexpected deletions: want (-), got (+):\n%s", d)
+	}
+}
+
+func TestApply_PurgeOrphans_NamespaceOverride(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+releases:
+- name: foo
+  chart: stable/mychart1
+`,
+	}
+
+	helm := &exectest.Helm{
+		FailOnUnexpectedList: true,
+		Lists: map[exectest.ListKey]string{
+			{Filter: ".*", Flags: "--kube-contextdefault--namespacens1--deployed--failed--pending"}: `foo	ns1	1	2021-01-01 00:00:00	deployed	mychart1-1.0.0	1.0.0
+orphan	ns1	1	2021-01-01 00:00:00	deployed	mychart4-1.0.0	1.0.0
+`,
+		},
+		Helm3:         true,
+		DiffMutex:     &sync.Mutex{},
+		ChartsMutex:   &sync.Mutex{},
+		ReleasesMutex: &sync.Mutex{},
+	}
+
+	logger := helmexec.NewLogger(io.Discard, "debug")
+
+	valsRuntime, err := vals.New(vals.Options{CacheSize: 32})
+	if err != nil {
+		t.Fatalf("unexpected error creating vals runtime: %v", err)
+	}
+
+	app := appWithFs(&App{
+		OverrideHelmBinary:  DefaultHelmBinary,
+		glob:                filepath.Glob,
+		abs:                 filepath.Abs,
+		OverrideKubeContext: "default",
+		Namespace:           "ns1",
+		Env:                 "default",
+		Logger:              logger,
+		helms: map[helmKey]helmexec.Interface{
+			createHelmKey("helm", "default"): helm,
+		},
+		valsRuntime: valsRuntime,
+	}, files)
+
+	err = app.Apply(applyConfig{
+		concurrency:            1,
+		logger:                 logger,
+		purgeOrphans:           true,
+		purgeOrphansNamespaces: []string{"ns1"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []exectest.Release{
+		{Name: "orphan", Flags: []string{"--namespace", "ns1", "--kube-context", "default"}},
+	}
+
+	if d := cmp.Diff(want, helm.Deleted); d != "" {
+		t.Errorf("unexpected deletions: want (-), got (+):\n%s", d)
+	}
+}
@@ -4,11 +4,13 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 
 	"github.com/roboll/helmfile/pkg/argparser"
 	"github.com/roboll/helmfile/pkg/helmexec"
+	"github.com/roboll/helmfile/pkg/remote"
 	"github.com/roboll/helmfile/pkg/state"
 )
 
@@ -30,11 +32,34 @@ func NewRun(st *state.HelmState, helm helmexec.Interface, ctx Context) *Run {
 	return &Run{state: st, helm: helm, ctx: ctx}
 }
 
-func (r *Run) askForConfirmation(msg string) bool {
+// askForConfirmation asks the user for confirmation with Ask when it's set, or with confirm otherwise
+func (r *Run) askForConfirmation(msg string, confirm func(string) (bool, error)) (bool, error) {
 	if r.Ask != nil {
-		return r.Ask(msg)
+		return r.Ask(msg), nil
 	}
-	return AskForConfirmation(msg)
+	return confirm(msg)
+}
+
+// chartsTempDir creates the temporary directory to which charts are fetched.
+// It is created within the cache directory relocated by HELMFILE_CACHE_HOME, if any,
+// so that helmfile works even when the system temporary directory is read-only.
+func chartsTempDir() (string, error) {
+	if !remote.IsCacheDirRelocated() {
+		return ioutil.TempDir("", "helmfile*")
+	}
+
+	cacheDir := remote.CacheDir()
+	chartsDir := filepath.Join(cacheDir, "charts")
+
+	if err := os.MkdirAll(chartsDir, 0755); err != nil {
+		return "", err
+	}
+
+	if err := remote.MarkCacheEntry(cacheDir, "charts"); err != nil {
+		return "", err
+	}
+
+	return ioutil.TempDir(chartsDir, "helmfile*")
 }
 
 func (r *Run) withPreparedCharts(helmfileCommand string, opts state.ChartPrepareOptions, f func()) error {
@@ -42,9 +67,17 @@ func (r *Run) withPreparedCharts(helmfileCommand string, opts state.ChartPrepare
 		panic("Run.PrepareCharts can be called only once")
 	}
 
+	// Fail fast on a dependency cycle in `needs` before running any helm command
+	if err := r.state.CheckNeedsCycles(); err != nil {
+		return err
+	}
+
 	if !opts.SkipRepos {
 		ctx := r.ctx
-		if err := ctx.SyncReposOnce(r.state, r.helm); err != nil {
+		stopTiming := r.state.Timings.Track(state.TimingPhaseRepos)
+		err := ctx.SyncReposOnce(r.state, r.helm)
+		stopTiming()
+		if err != nil {
 			return err
 		}
 	}
@@ -52,7 +85,7 @@ func (r *Run) withPreparedCharts(helmfileCommand string, opts state.ChartPrepare
 	// Create tmp directory and bail immediately if it fails
 	var dir string
 	if len(opts.OutputDir) == 0 {
-		tempDir, err := ioutil.TempDir("", "helmfile*")
+		tempDir, err := chartsTempDir()
 		if err != nil {
 			return err
 		}
@@ -67,7 +100,9 @@ func (r *Run) withPreparedCharts(helmfileCommand string, opts state.ChartPrepare
 		return err
 	}
 
+	stopTiming := r.state.Timings.Track(state.TimingPhasePrepare)
 	releaseToChart, errs := r.state.PrepareCharts(r.helm, dir, 2, helmfileCommand, opts)
+	stopTiming()
 
 	if len(errs) > 0 {
 		return fmt.Errorf("%v", errs)
@@ -95,18 +130,42 @@ func (r *Run) withPreparedCharts(helmfileCommand string, opts state.ChartPrepare
 	return err
 }
 
+// setHelmArgs passes the args given with --args and --extra-args to helm
+func setHelmArgs(helm helmexec.Interface, st *state.HelmState, c argsConfig) {
+	helm.SetExtraArgs(argparser.GetArgs(c.Args(), st)...)
+	helm.SetAppendArgs(argparser.SplitWords(c.ExtraArgs())...)
+}
+
 func (r *Run) Deps(c DepsConfigProvider) []error {
-	r.helm.SetExtraArgs(argparser.GetArgs(c.Args(), r.state)...)
+	setHelmArgs(r.helm, r.state, c)
 
 	return r.state.UpdateDeps(r.helm, c.IncludeTransitiveNeeds())
 }
 
+func (r *Run) LockDeps(c DepsConfigProvider) (*state.ChartLockedRequirements, error) {
+	setHelmArgs(r.helm, r.state, c)
+
+	return r.state.LockDeps(r.helm)
+}
+
 func (r *Run) Repos(c ReposConfigProvider) error {
-	r.helm.SetExtraArgs(argparser.GetArgs(c.Args(), r.state)...)
+	setHelmArgs(r.helm, r.state, c)
 
 	return r.ctx.SyncReposOnce(r.state, r.helm)
 }
 
+func (r *Run) Lock(c LockConfigProvider) error {
+	setHelmArgs(r.helm, r.state, c)
+
+	if !c.SkipRepos() {
+		if err := r.ctx.SyncReposOnce(r.state, r.helm); err != nil {
+			return err
+		}
+	}
+
+	return r.state.LockReleaseVersions(r.helm)
+}
+
 func (r *Run) DeprecatedSyncCharts(c DeprecatedChartsConfigProvider) []error {
 	st := r.state
 	helm := r.helm
@@ -0,0 +1,53 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/roboll/helmfile/pkg/state"
+)
+
+// LoadSelectors returns the selectors given with --selector followed by the ones read from the --selector-file, if any.
+//
+// Each line of the file is a selector like `tier=frontend,tier!=proxy`, which is combined with the others
+// in the same way as multiple --selector flags are. Empty lines and comments starting with `#` are ignored.
+func LoadSelectors(selectors []string, file string) ([]string, error) {
+	if file == "" {
+		return selectors, nil
+	}
+
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading selector file: %w", err)
+	}
+
+	loaded := append([]string{}, selectors...)
+
+	scanner := bufio.NewScanner(bytes.NewReader(bs))
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if _, err := state.ParseLabels(line); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, n, err)
+		}
+
+		loaded = append(loaded, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading selector file %s: %w", file, err)
+	}
+
+	return loaded, nil
+}
@@ -0,0 +1,85 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLoadSelectors(t *testing.T) {
+	testcases := []struct {
+		name      string
+		selectors []string
+		content   string
+		want      []string
+		wantErr   string
+	}{
+		{
+			name:      "no file",
+			selectors: []string{"name=foo"},
+			want:      []string{"name=foo"},
+		},
+		{
+			name: "valid file",
+			content: `# frontend releases except the proxy
+tier=frontend,tier!=proxy
+
+  tier=backend   # and all the backend releases
+`,
+			want: []string{"tier=frontend,tier!=proxy", "tier=backend"},
+		},
+		{
+			name:      "combined with inline selectors",
+			selectors: []string{"name=foo", "app=bar"},
+			content:   "tier=backend\n",
+			want:      []string{"name=foo", "app=bar", "tier=backend"},
+		},
+		{
+			name:      "malformed label",
+			selectors: []string{"name=foo"},
+			content:   "# comment\ntier=backend\ntier==frontend\n",
+			wantErr:   "selectors.txt:3: malformed label: tier==frontend. Expected label in form k=v or k!=v",
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			var file string
+
+			if tc.content != "" {
+				file = filepath.Join(t.TempDir(), "selectors.txt")
+				if err := os.WriteFile(file, []byte(tc.content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := LoadSelectors(tc.selectors, file)
+
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != filepath.Join(filepath.Dir(file), tc.wantErr) {
+					t.Fatalf("unexpected error: want %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("unexpected selectors: want (-), got (+):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestLoadSelectors_MissingFile(t *testing.T) {
+	_, err := LoadSelectors(nil, filepath.Join(t.TempDir(), "missing.txt"))
+	if err == nil {
+		t.Fatal("expected an error, got none")
+	}
+}
@@ -0,0 +1,82 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/roboll/helmfile/pkg/state"
+	"gopkg.in/yaml.v2"
+)
+
+// stateCacheKey identifies a state file loaded with a specific set of options.
+// The same sub-helmfile is often visited more than once, like when it is referenced from multiple parent
+// helmfiles with different selectors, and the key lets it be rendered and loaded only once per process.
+type stateCacheKey struct {
+	// path is the absolute path to the state file
+	path string
+	// overrides is the hash of the environment and the override values the state file is loaded with
+	overrides string
+	reverse   bool
+}
+
+func (a *App) stateCacheKey(file string, opts LoadOpts) (stateCacheKey, error) {
+	path, err := a.abs(file)
+	if err != nil {
+		return stateCacheKey{}, err
+	}
+
+	overrides := map[string]interface{}{
+		"environment":    a.Env,
+		"overrideValues": opts.Environment.OverrideValues,
+	}
+
+	// Relative paths in the override values are relative to the callee
+	if len(opts.Environment.OverrideValues) > 0 {
+		overrides["calleePath"] = opts.CalleePath
+	}
+
+	bs, err := yaml.Marshal(overrides)
+	if err != nil {
+		return stateCacheKey{}, fmt.Errorf("hashing overrides for %s: %w", file, err)
+	}
+
+	sum := sha256.Sum256(bs)
+
+	return stateCacheKey{
+		path:      path,
+		overrides: hex.EncodeToString(sum[:]),
+		reverse:   opts.Reverse,
+	}, nil
+}
+
+// cachedState returns a copy of the cached state for the key, so that the caller can modify its releases
+// without affecting the later visits to the same state file.
+func (a *App) cachedState(key stateCacheKey) (*state.HelmState, bool) {
+	a.statesMutex.Lock()
+	defer a.statesMutex.Unlock()
+
+	st, ok := a.states[key]
+	if !ok {
+		return nil, false
+	}
+
+	return copyState(st), true
+}
+
+func (a *App) cacheState(key stateCacheKey, st *state.HelmState) {
+	a.statesMutex.Lock()
+	defer a.statesMutex.Unlock()
+
+	if a.states == nil {
+		a.states = map[stateCacheKey]*state.HelmState{}
+	}
+
+	a.states[key] = copyState(st)
+}
+
+func copyState(st *state.HelmState) *state.HelmState {
+	copied := *st
+	copied.Releases = append([]state.ReleaseSpec(nil), st.Releases...)
+	return &copied
+}
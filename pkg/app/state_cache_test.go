@@ -0,0 +1,91 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+	"github.com/roboll/helmfile/pkg/testhelper"
+)
+
+func TestVisitDesiredStates_CachedSubHelmfiles(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+helmfiles:
+- path: helmfile.d/a.yaml
+  selectors:
+  - name=foo
+- path: helmfile.d/a.yaml
+  selectors:
+  - name=bar
+- path: helmfile.d/a.yaml
+  values:
+  - ns: overridden
+`,
+		"/path/to/helmfile.d/a.yaml": `
+environments:
+  default:
+    values:
+    - ns: default
+releases:
+- name: foo
+  chart: stable/zipkin
+  namespace: {{ .Environment.Values.ns }}
+- name: bar
+  chart: stable/grafana
+  namespace: {{ .Environment.Values.ns }}
+`,
+	}
+
+	fs := testhelper.NewTestFs(files)
+	fs.Cwd = "/path/to"
+
+	app := injectFs(&App{
+		OverrideHelmBinary:  DefaultHelmBinary,
+		OverrideKubeContext: "default",
+		Logger:              helmexec.NewLogger(os.Stderr, "debug"),
+		Selectors:           []string{},
+		Env:                 "default",
+		FileOrDir:           "helmfile.yaml",
+	}, fs)
+
+	expectNoCallsToHelm(app)
+
+	var processed []string
+
+	collectReleases := func(run *Run) (bool, []error) {
+		for _, r := range run.state.Releases {
+			processed = append(processed, r.Name+"@"+r.Namespace)
+		}
+		return false, []error{}
+	}
+
+	err := app.ForEachState(
+		collectReleases,
+		false,
+		SetFilter(true),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{"foo@default", "bar@default", "foo@overridden", "bar@overridden"}
+	if d := cmp.Diff(want, processed); d != "" {
+		t.Errorf("unexpected releases: want (-), got (+):\n%s", d)
+	}
+
+	var reads int
+	for _, f := range fs.SuccessfulReads() {
+		if filepath.Base(f) == "a.yaml" {
+			reads++
+		}
+	}
+
+	// The sub-helmfile is loaded once with the default values, and once more with the override values
+	if reads != 2 {
+		t.Errorf("unexpected number of reads of the sub-helmfile: want 2, got %d: %v", reads, fs.SuccessfulReads())
+	}
+}
@@ -0,0 +1,118 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/yaml.v2"
+)
+
+// stdinValuesFile is the `--values` argument that makes helmfile read a values document from stdin
+const stdinValuesFile = "-"
+
+// readStdinValues replaces `-` in the values files with a temporary file containing the YAML document read from stdin.
+// The file is moved to the end of the values files, so that it takes precedence over every other values file.
+// The returned function removes the temporary file, unless skipCleanup is true.
+func (a *App) readStdinValues(values []string, skipCleanup bool) ([]string, func(), error) {
+	var (
+		resolved []string
+		found    bool
+	)
+
+	for _, v := range values {
+		if v != stdinValuesFile {
+			resolved = append(resolved, v)
+			continue
+		}
+
+		if found {
+			return nil, nil, fmt.Errorf("--values %s can be specified only once, as stdin can be read only once", stdinValuesFile)
+		}
+		found = true
+	}
+
+	if !found {
+		return values, func() {}, nil
+	}
+
+	bs, err := io.ReadAll(a.stdin)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading values from stdin: %w", err)
+	}
+
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(bs, &doc); err != nil {
+		return nil, nil, fmt.Errorf("parsing values from stdin: %w", err)
+	}
+
+	f, err := os.CreateTemp("", "helmfile-stdin-values-*.yaml")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	path := f.Name()
+
+	if _, err := f.Write(bs); err != nil {
+		_ = f.Close()
+		_ = os.Remove(path)
+		return nil, nil, fmt.Errorf("writing values from stdin to %s: %w", path, err)
+	}
+
+	if err := f.Close(); err != nil {
+		_ = os.Remove(path)
+		return nil, nil, err
+	}
+
+	a.Logger.Debugf("wrote the values read from stdin to %s", path)
+
+	cleanup := func() {
+		if skipCleanup {
+			a.Logger.Infof("retaining the values read from stdin in %s", path)
+			return
+		}
+		if err := os.Remove(path); err != nil {
+			a.Logger.Warnf("unable to remove the values read from stdin in %s: %v", path, err)
+		}
+	}
+
+	return append(resolved, path), cleanup, nil
+}
+
+// The below types override the values files of the commands with the ones resolved by readStdinValues
+
+type applyConfigWithValues struct {
+	ApplyConfigProvider
+	values []string
+}
+
+func (c applyConfigWithValues) Values() []string {
+	return c.values
+}
+
+type syncConfigWithValues struct {
+	SyncConfigProvider
+	values []string
+}
+
+func (c syncConfigWithValues) Values() []string {
+	return c.values
+}
+
+type diffConfigWithValues struct {
+	DiffConfigProvider
+	values []string
+}
+
+func (c diffConfigWithValues) Values() []string {
+	return c.values
+}
+
+type templateConfigWithValues struct {
+	TemplateConfigProvider
+	values []string
+}
+
+func (c templateConfigWithValues) Values() []string {
+	return c.values
+}
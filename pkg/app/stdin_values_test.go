@@ -0,0 +1,125 @@
+package app
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+func TestReadStdinValues(t *testing.T) {
+	testcases := []struct {
+		name        string
+		values      []string
+		stdin       string
+		skipCleanup bool
+		wantErr     string
+	}{
+		{
+			name:   "stdin values take precedence",
+			values: []string{"a.yaml", "-", "b.yaml"},
+			stdin:  "foo: bar\n",
+		},
+		{
+			name:        "retained with skip-cleanup",
+			values:      []string{"-"},
+			stdin:       "foo: bar\n",
+			skipCleanup: true,
+		},
+		{
+			name:    "stdin twice",
+			values:  []string{"-", "a.yaml", "-"},
+			stdin:   "foo: bar\n",
+			wantErr: "--values - can be specified only once, as stdin can be read only once",
+		},
+		{
+			name:    "invalid yaml",
+			values:  []string{"-"},
+			stdin:   "- foo\n- bar\n",
+			wantErr: "parsing values from stdin: yaml: unmarshal errors:\n  line 1: cannot unmarshal !!seq into map[string]interface {}",
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			app := &App{
+				Logger: helmexec.NewLogger(io.Discard, "debug"),
+				stdin:  strings.NewReader(tc.stdin),
+			}
+
+			values, cleanup, err := app.readStdinValues(tc.values, tc.skipCleanup)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("unexpected error: want %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			want := []string{}
+			for _, v := range tc.values {
+				if v != "-" {
+					want = append(want, v)
+				}
+			}
+
+			if len(values) != len(want)+1 {
+				t.Fatalf("unexpected values: %v", values)
+			}
+
+			path := values[len(values)-1]
+			if d := cmp.Diff(want, values[:len(values)-1]); d != "" {
+				t.Errorf("unexpected values: want (-), got (+):\n%s", d)
+			}
+
+			bs, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(bs) != tc.stdin {
+				t.Errorf("unexpected content of %s: want %q, got %q", path, tc.stdin, string(bs))
+			}
+
+			cleanup()
+
+			_, err = os.Stat(path)
+			if tc.skipCleanup {
+				if err != nil {
+					t.Errorf("the values file was removed despite skip-cleanup: %v", err)
+				}
+				os.Remove(path)
+			} else if !os.IsNotExist(err) {
+				t.Errorf("the values file was not removed: %v", err)
+			}
+		})
+	}
+}
+
+func TestReadStdinValues_NoStdin(t *testing.T) {
+	app := &App{
+		Logger: helmexec.NewLogger(io.Discard, "debug"),
+		stdin:  strings.NewReader("foo: bar\n"),
+	}
+
+	values, cleanup, err := app.readStdinValues([]string{"a.yaml"}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cleanup()
+
+	if d := cmp.Diff([]string{"a.yaml"}, values); d != "" {
+		t.Errorf("unexpected values: want (-), got (+):\n%s", d)
+	}
+
+	if rest, _ := io.ReadAll(app.stdin); string(rest) != "foo: bar\n" {
+		t.Errorf("stdin was read without --values -")
+	}
+}
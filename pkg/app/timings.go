@@ -0,0 +1,66 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/roboll/helmfile/pkg/state"
+)
+
+// newTimings returns the recorder of timings when --timings or --timings-output is given, and nil otherwise,
+// so that nothing is recorded by default.
+func newTimings(conf ConfigProvider) *state.Timings {
+	if !conf.Timings() && conf.TimingsOutput() == "" {
+		return nil
+	}
+	return state.NewTimings()
+}
+
+type timingsReport struct {
+	Phases []state.PhaseTiming `json:"phases"`
+}
+
+// ReportTimings prints the table of the recorded timings to w, and writes them to TimingsOutput as JSON if it is set.
+// It does nothing unless the timings are enabled.
+func (a *App) ReportTimings(w io.Writer) error {
+	if a.Timings == nil {
+		return nil
+	}
+
+	phases := a.Timings.Phases()
+
+	tw := tabwriter.NewWriter(w, 0, 2, 2, ' ', 0)
+	fmt.Fprintln(tw, "PHASE\tRELEASE\tDURATION")
+	for _, p := range phases {
+		fmt.Fprintf(tw, "%s\t\t%s\n", p.Phase, p.Duration.Round(time.Millisecond))
+		for _, r := range p.Releases {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", p.Phase, r.ID, r.Duration.Round(time.Millisecond))
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if a.TimingsOutput == "" {
+		return nil
+	}
+
+	if phases == nil {
+		phases = []state.PhaseTiming{}
+	}
+
+	bs, err := json.MarshalIndent(timingsReport{Phases: phases}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(a.TimingsOutput, bs, 0644); err != nil {
+		return fmt.Errorf("writing timings to %s: %w", a.TimingsOutput, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/variantdev/vals"
+
+	"github.com/roboll/helmfile/pkg/exectest"
+	"github.com/roboll/helmfile/pkg/helmexec"
+	"github.com/roboll/helmfile/pkg/state"
+)
+
+func TestApply_Timings(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+repositories:
+- name: stable
+  url: https://charts.helm.sh/stable
+
+releases:
+- name: foo
+  chart: stable/mychart1
+  hooks:
+  - events: ["presync"]
+    command: echo
+    args: ["foo"]
+- name: bar
+  chart: stable/mychart2
+`,
+	}
+
+	helm := &exectest.Helm{
+		FailOnUnexpectedList: true,
+		FailOnUnexpectedDiff: true,
+		Lists:                map[exectest.ListKey]string{},
+		Diffs: map[exectest.DiffKey]error{
+			exectest.DiffKey{Name: "foo", Chart: "stable/mychart1", Flags: "--kube-contextdefault--detailed-exitcode"}: helmexec.ExitError{Code: 2},
+			exectest.DiffKey{Name: "bar", Chart: "stable/mychart2", Flags: "--kube-contextdefault--detailed-exitcode"}: nil,
+		},
+		DiffMutex:     &sync.Mutex{},
+		ChartsMutex:   &sync.Mutex{},
+		ReleasesMutex: &sync.Mutex{},
+	}
+
+	logger := helmexec.NewLogger(io.Discard, "debug")
+
+	valsRuntime, err := vals.New(vals.Options{CacheSize: 32})
+	if err != nil {
+		t.Fatalf("unexpected error creating vals runtime: %v", err)
+	}
+
+	outputFile := filepath.Join(t.TempDir(), "timings.json")
+
+	app := appWithFs(&App{
+		OverrideHelmBinary:  DefaultHelmBinary,
+		glob:                filepath.Glob,
+		abs:                 filepath.Abs,
+		OverrideKubeContext: "default",
+		Env:                 "default",
+		Logger:              logger,
+		helms: map[helmKey]helmexec.Interface{
+			createHelmKey("helm", "default"): helm,
+		},
+		valsRuntime:   valsRuntime,
+		Timings:       state.NewTimings(),
+		TimingsOutput: outputFile,
+	}, files)
+
+	if err := app.Apply(applyConfig{concurrency: 1, logger: logger}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	releases := map[string][]string{}
+	for _, p := range app.Timings.Phases() {
+		releases[p.Phase] = []string{}
+		for _, r := range p.Releases {
+			releases[p.Phase] = append(releases[p.Phase], r.ID)
+		}
+	}
+
+	want := map[string][]string{
+		state.TimingPhaseRepos:   {},
+		state.TimingPhasePrepare: {},
+		state.TimingPhaseDiff:    {"default//foo", "default//bar"},
+		state.TimingPhaseSync:    {"default//foo"},
+		state.TimingPhaseHooks:   {"default//foo"},
+	}
+
+	if d := cmp.Diff(want, releases); d != "" {
+		t.Errorf("unexpected timings: want (-), got (+):\n%s", d)
+	}
+
+	var out bytes.Buffer
+	if err := app.ReportTimings(&out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.HasPrefix(out.String(), "PHASE") || !strings.Contains(out.String(), "default//foo") {
+		t.Errorf("unexpected table:\n%s", out.String())
+	}
+
+	bs, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var report timingsReport
+	if err := json.Unmarshal(bs, &report); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(report.Phases) != len(want) {
+		t.Errorf("unexpected number of phases in %s: want %d, got %d", outputFile, len(want), len(report.Phases))
+	}
+}
+
+func TestReportTimings_Disabled(t *testing.T) {
+	app := &App{}
+
+	var out bytes.Buffer
+	if err := app.ReportTimings(&out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if out.Len() != 0 {
+		t.Errorf("unexpected output: %q", out.String())
+	}
+}
@@ -21,13 +21,19 @@ func prependLineNumbers(text string) string {
 }
 
 func (r *desiredStateLoader) renderPrestate(firstPassEnv *environment.Environment, baseDir, filename string, content []byte) (*environment.Environment, *state.HelmState) {
-	tmplData := state.NewEnvironmentTemplateData(*firstPassEnv, r.namespace, map[string]interface{}{})
+	tmplData := state.NewEnvironmentTemplateData(firstPassEnv.DeepCopy(), r.namespace, map[string]interface{}{})
 	firstPassRenderer := tmpl.NewFirstPassRenderer(baseDir, tmplData)
 
+	// The values aren't known until the first pass completes, and a nested key like `.Values.charts.repo` would stop the rendering
+	// with a nil pointer error, before reaching the environments and values declared after it
+	if refs, err := firstPassRenderer.FieldRefs(content); err == nil {
+		stubFirstPassValues(tmplData, refs)
+	}
+
 	// parse as much as we can, tolerate errors, this is a preparse
 	yamlBuf, err := firstPassRenderer.RenderTemplateContentToBuffer(content)
 	if err != nil && r.logger != nil {
-		r.logger.Debugf("first-pass rendering input of \"%s\":\n%s", filename, prependLineNumbers(string(content)))
+		r.logger.Debug(r.secretValues.Mask(fmt.Sprintf("first-pass rendering input of \"%s\":\n%s", filename, prependLineNumbers(string(content)))))
 		r.logger.Debugf("template syntax error: %v", err)
 		if yamlBuf == nil { // we have a template syntax error, let the second parse report
 			return firstPassEnv, nil
@@ -35,7 +41,7 @@ func (r *desiredStateLoader) renderPrestate(firstPassEnv *environment.Environmen
 	}
 	yamlData := yamlBuf.String()
 	if r.logger != nil {
-		r.logger.Debugf("first-pass rendering output of \"%s\":\n%s", filename, prependLineNumbers(yamlData))
+		r.logger.Debug(r.secretValues.Mask(fmt.Sprintf("first-pass rendering output of \"%s\":\n%s", filename, prependLineNumbers(yamlData))))
 	}
 
 	// Work-around for https://github.com/golang/go/issues/24963
@@ -43,7 +49,7 @@ func (r *desiredStateLoader) renderPrestate(firstPassEnv *environment.Environmen
 
 	if len(yamlData) != len(sanitized) {
 		msg := "replaced <no value>s to workaround https://github.com/golang/go/issues/24963 to address https://github.com/roboll/helmfile/issues/553:\n%s"
-		r.logger.Debugf(msg, cmp.Diff(yamlData, sanitized))
+		r.logger.Debug(r.secretValues.Mask(fmt.Sprintf(msg, cmp.Diff(yamlData, sanitized))))
 	}
 
 	c := r.underlying()
@@ -55,7 +61,7 @@ func (r *desiredStateLoader) renderPrestate(firstPassEnv *environment.Environmen
 		case *state.StateLoadError:
 			r.logger.Debugf("could not deduce `environment:` block, configuring only .Environment.Name. error: %v", err)
 		}
-		r.logger.Debugf("error in first-pass rendering: result of \"%s\":\n%s", filename, prependLineNumbers(yamlBuf.String()))
+		r.logger.Debug(r.secretValues.Mask(fmt.Sprintf("error in first-pass rendering: result of \"%s\":\n%s", filename, prependLineNumbers(yamlBuf.String()))))
 	}
 
 	if prestate != nil {
@@ -65,6 +71,39 @@ func (r *desiredStateLoader) renderPrestate(firstPassEnv *environment.Environmen
 	return firstPassEnv, prestate
 }
 
+// stubFirstPassValues adds an empty map to the values of the first pass for each map referenced by the template,
+// so that the missing keys within it are rendered as zero values like the top-level keys are.
+// The values of the environment are stubbed only where missing, so that the ones inherited from the parent helmfile are kept.
+func stubFirstPassValues(tmplData *state.EnvironmentTemplateData, refs [][]string) {
+	for _, ref := range refs {
+		switch {
+		case len(ref) > 2 && (ref[0] == "Values" || ref[0] == "StateValues"):
+			stubMaps(tmplData.Values, ref[1:len(ref)-1])
+		case len(ref) > 3 && ref[0] == "Environment" && ref[1] == "Values":
+			if tmplData.Environment.Values == nil {
+				tmplData.Environment.Values = map[string]interface{}{}
+			}
+			stubMaps(tmplData.Environment.Values, ref[2:len(ref)-1])
+		}
+	}
+}
+
+func stubMaps(m map[string]interface{}, keys []string) {
+	for _, k := range keys {
+		v, ok := m[k]
+		if !ok {
+			v = map[string]interface{}{}
+			m[k] = v
+		}
+
+		next, ok := v.(map[string]interface{})
+		if !ok {
+			return
+		}
+		m = next
+	}
+}
+
 type RenderOpts struct {
 }
 
@@ -81,7 +120,7 @@ func (r *desiredStateLoader) renderTemplatesToYamlWithEnv(baseDir, filename stri
 func (r *desiredStateLoader) twoPassRenderTemplateToYaml(inherited, overrode *environment.Environment, baseDir, filename string, content []byte) (*bytes.Buffer, error) {
 	// try a first pass render. This will always succeed, but can produce a limited env
 	if r.logger != nil {
-		r.logger.Debugf("first-pass rendering starting for \"%s\": inherited=%v, overrode=%v", filename, inherited, overrode)
+		r.logger.Debug(r.secretValues.Mask(fmt.Sprintf("first-pass rendering starting for \"%s\": inherited=%v, overrode=%v", filename, inherited, overrode)))
 	}
 
 	initEnv, err := inherited.Merge(overrode)
@@ -90,13 +129,13 @@ func (r *desiredStateLoader) twoPassRenderTemplateToYaml(inherited, overrode *en
 	}
 
 	if r.logger != nil {
-		r.logger.Debugf("first-pass uses: %v", initEnv)
+		r.logger.Debug(r.secretValues.Mask(fmt.Sprintf("first-pass uses: %v", initEnv)))
 	}
 
 	renderedEnv, prestate := r.renderPrestate(initEnv, baseDir, filename, content)
 
 	if r.logger != nil {
-		r.logger.Debugf("first-pass produced: %v", renderedEnv)
+		r.logger.Debug(r.secretValues.Mask(fmt.Sprintf("first-pass produced: %v", renderedEnv)))
 	}
 
 	finalEnv, err := inherited.Merge(renderedEnv)
@@ -110,7 +149,7 @@ func (r *desiredStateLoader) twoPassRenderTemplateToYaml(inherited, overrode *en
 	}
 
 	if r.logger != nil {
-		r.logger.Debugf("first-pass rendering result of \"%s\": %v", filename, *finalEnv)
+		r.logger.Debug(r.secretValues.Mask(fmt.Sprintf("first-pass rendering result of \"%s\": %v", filename, *finalEnv)))
 	}
 
 	vals, err := finalEnv.GetMergedValues()
@@ -120,7 +159,7 @@ func (r *desiredStateLoader) twoPassRenderTemplateToYaml(inherited, overrode *en
 
 	if prestate != nil {
 		prestate.Env = *finalEnv
-		r.logger.Debugf("vals:\n%v\ndefaultVals:%v", vals, prestate.DefaultValues)
+		r.logger.Debug(r.secretValues.Mask(fmt.Sprintf("vals:\n%v\ndefaultVals:%v", vals, prestate.DefaultValues)))
 	}
 
 	tmplData := state.NewEnvironmentTemplateData(*finalEnv, r.namespace, vals)
@@ -128,12 +167,12 @@ func (r *desiredStateLoader) twoPassRenderTemplateToYaml(inherited, overrode *en
 	yamlBuf, err := secondPassRenderer.RenderTemplateContentToBuffer(content)
 	if err != nil {
 		if r.logger != nil {
-			r.logger.Debugf("second-pass rendering failed, input of \"%s\":\n%s", filename, prependLineNumbers(string(content)))
+			r.logger.Debug(r.secretValues.Mask(fmt.Sprintf("second-pass rendering failed, input of \"%s\":\n%s", filename, prependLineNumbers(string(content)))))
 		}
 		return nil, err
 	}
 	if r.logger != nil {
-		r.logger.Debugf("second-pass rendering result of \"%s\":\n%s", filename, prependLineNumbers(yamlBuf.String()))
+		r.logger.Debug(r.secretValues.Mask(fmt.Sprintf("second-pass rendering result of \"%s\":\n%s", filename, prependLineNumbers(yamlBuf.String()))))
 	}
 	return yamlBuf, nil
 }
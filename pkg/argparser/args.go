@@ -3,6 +3,7 @@ package argparser
 import (
 	"fmt"
 	"strings"
+	"unicode"
 
 	"github.com/roboll/helmfile/pkg/state"
 )
@@ -105,3 +106,54 @@ func GetArgs(args string, state *state.HelmState) []string {
 
 	return state.HelmDefaults.Args
 }
+
+// SplitWords splits the args given as a string, like the ones given with --extra-args, into words the way a shell does,
+// so that they can be passed to helm as is.
+// Words are separated by whitespace, which is kept in a word when it's quoted with `'` or `"`, or escaped with `\`.
+// An unterminated quote extends to the end of the string.
+func SplitWords(s string) []string {
+	var (
+		words   []string
+		word    strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+
+	for _, c := range s {
+		switch {
+		case escaped:
+			word.WriteRune(c)
+			escaped = false
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				escaped = true
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == '\\':
+			escaped = true
+			inWord = true
+		case unicode.IsSpace(c):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words
+}
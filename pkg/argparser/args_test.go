@@ -4,6 +4,8 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
+
 	"github.com/roboll/helmfile/pkg/state"
 )
 
@@ -44,6 +46,35 @@ func Test2(t *testing.T) {
 
 }
 
+func TestSplitWords(t *testing.T) {
+	testcases := []struct {
+		args string
+		want []string
+	}{
+		{
+			args: "",
+		},
+		{
+			args: "-f values.yaml  --set-string a=1 --set-string b=2 release",
+			want: []string{"-f", "values.yaml", "--set-string", "a=1", "--set-string", "b=2", "release"},
+		},
+		{
+			args: `--description "deployed by ci" --set 'a=b c' --set x=\"y\ z`,
+			want: []string{"--description", "deployed by ci", "--set", "a=b c", "--set", `x="y z`},
+		},
+		{
+			args: `--set a="" --set b=''`,
+			want: []string{"--set", "a=", "--set", "b="},
+		},
+	}
+
+	for _, tc := range testcases {
+		if d := cmp.Diff(tc.want, SplitWords(tc.args)); d != "" {
+			t.Errorf("unexpected words of %q: want (-), got (+):\n%s", tc.args, d)
+		}
+	}
+}
+
 func compareArgs(expectedArgs string, args []string) bool {
 	return strings.Compare(strings.Join(args, " "), expectedArgs) == 0
 }
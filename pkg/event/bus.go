@@ -31,6 +31,7 @@ type Bus struct {
 	BasePath      string
 	StateFilePath string
 	Namespace     string
+	KubeContext   string
 	Chart         string
 
 	Env environment.Environment
@@ -58,9 +59,24 @@ func (bus *Bus) Trigger(evt string, evtErr error, context map[string]interface{}
 			continue
 		}
 
-		var err error
+		data := map[string]interface{}{
+			"Environment": bus.Env,
+			"Namespace":   bus.Namespace,
+			"KubeContext": bus.KubeContext,
+			"Event": event{
+				Name:  evt,
+				Error: evtErr,
+			},
+		}
+		for k, v := range context {
+			data[k] = v
+		}
+		render := tmpl.NewTextRenderer(bus.ReadFile, bus.BasePath, data)
 
-		name := hook.Name
+		name, err := render.RenderTemplateText(hook.Name)
+		if err != nil {
+			return false, fmt.Errorf("hook[%s]: %v", hook.Name, err)
+		}
 		if name == "" {
 			if hook.Kubectl != nil {
 				name = "kubectlApply"
@@ -88,19 +104,6 @@ func (bus *Bus) Trigger(evt string, evtErr error, context map[string]interface{}
 
 		bus.Logger.Debugf("hook[%s]: stateFilePath=%s, basePath=%s\n", name, bus.StateFilePath, bus.BasePath)
 
-		data := map[string]interface{}{
-			"Environment": bus.Env,
-			"Namespace":   bus.Namespace,
-			"Event": event{
-				Name:  evt,
-				Error: evtErr,
-			},
-		}
-		for k, v := range context {
-			data[k] = v
-		}
-		render := tmpl.NewTextRenderer(bus.ReadFile, bus.BasePath, data)
-
 		bus.Logger.Debugf("hook[%s]: triggered by event \"%s\"\n", name, evt)
 
 		command, err := render.RenderTemplateText(hook.Command)
@@ -27,17 +27,24 @@ type Helm struct {
 	Releases             []Release
 	Deleted              []Release
 	Lists                map[ListKey]string
+	Listed               []ListKey
+	Values               map[string]string
+	Statuses             map[string]string
+	Searches             map[string]string
 	Diffs                map[DiffKey]error
+	DiffOutputs          map[string]string
 	Diffed               []Release
 	FailOnUnexpectedDiff bool
 	FailOnUnexpectedList bool
 	Version              *semver.Version
+	DiffPluginVersion    *semver.Version
 
 	UpdateDepsCallbacks map[string]func(string) error
 
 	DiffMutex     *sync.Mutex
 	ChartsMutex   *sync.Mutex
 	ReleasesMutex *sync.Mutex
+	ListsMutex    *sync.Mutex
 
 	Helm3 bool
 }
@@ -80,6 +87,8 @@ func (helm *Helm) BuildDeps(name, chart string) error {
 
 func (helm *Helm) SetExtraArgs(args ...string) {
 }
+func (helm *Helm) SetAppendArgs(args ...string) {
+}
 func (helm *Helm) SetHelmBinary(bin string) {
 }
 func (helm *Helm) AddRepo(name, repository, cafile, certfile, keyfile, username, password string, managed string, passCredentials string, skipTLSVerify string) error {
@@ -89,6 +98,9 @@ func (helm *Helm) AddRepo(name, repository, cafile, certfile, keyfile, username,
 func (helm *Helm) UpdateRepo() error {
 	return nil
 }
+func (helm *Helm) SearchRepo(chart string, flags ...string) (string, error) {
+	return helm.Searches[chart], nil
+}
 func (helm *Helm) RegistryLogin(name string, username string, password string) error {
 	return nil
 }
@@ -113,6 +125,11 @@ func (helm *Helm) DiffRelease(context helmexec.HelmContext, name, chart string,
 	if helm.DiffMutex != nil {
 		helm.DiffMutex.Unlock()
 	}
+	if out, ok := helm.DiffOutputs[name]; ok && context.Writer != nil {
+		if _, err := context.Writer.Write([]byte(out)); err != nil {
+			return err
+		}
+	}
 	key := DiffKey{Name: name, Chart: chart, Flags: strings.Join(flags, "")}
 	err, ok := helm.Diffs[key]
 	if !ok && helm.FailOnUnexpectedDiff {
@@ -127,6 +144,13 @@ func (helm *Helm) ReleaseStatus(context helmexec.HelmContext, release string, fl
 	helm.Releases = append(helm.Releases, Release{Name: release, Flags: flags})
 	return nil
 }
+func (helm *Helm) GetReleaseStatus(context helmexec.HelmContext, release string, flags ...string) (string, error) {
+	if strings.Contains(release, "error") {
+		return "", errors.New("error")
+	}
+	helm.Releases = append(helm.Releases, Release{Name: release, Flags: flags})
+	return helm.Statuses[release], nil
+}
 func (helm *Helm) DeleteRelease(context helmexec.HelmContext, name string, flags ...string) error {
 	if strings.Contains(name, "error") {
 		return errors.New("error")
@@ -136,6 +160,9 @@ func (helm *Helm) DeleteRelease(context helmexec.HelmContext, name string, flags
 }
 func (helm *Helm) List(context helmexec.HelmContext, filter string, flags ...string) (string, error) {
 	key := ListKey{Filter: filter, Flags: strings.Join(flags, "")}
+	helm.sync(helm.ListsMutex, func() {
+		helm.Listed = append(helm.Listed, key)
+	})
 	res, ok := helm.Lists[key]
 	if !ok && helm.FailOnUnexpectedList {
 		return "", fmt.Errorf("unexpected list key: %v", key)
@@ -145,6 +172,9 @@ func (helm *Helm) List(context helmexec.HelmContext, filter string, flags ...str
 func (helm *Helm) DecryptSecret(context helmexec.HelmContext, name string, flags ...string) (string, error) {
 	return "", nil
 }
+func (helm *Helm) GetValues(context helmexec.HelmContext, name string, flags ...string) (string, error) {
+	return helm.Values[name], nil
+}
 func (helm *Helm) TestRelease(context helmexec.HelmContext, name string, flags ...string) error {
 	if strings.Contains(name, "error") {
 		return errors.New("error")
@@ -155,6 +185,9 @@ func (helm *Helm) TestRelease(context helmexec.HelmContext, name string, flags .
 func (helm *Helm) Fetch(chart string, flags ...string) error {
 	return nil
 }
+func (helm *Helm) VerifyChart(chart string, flags ...string) error {
+	return nil
+}
 func (helm *Helm) Lint(name, chart string, flags ...string) error {
 	return nil
 }
@@ -188,6 +221,15 @@ func (helm *Helm) IsVersionAtLeast(versionStr string) bool {
 	return helm.Version.Equal(ver) || helm.Version.GreaterThan(ver)
 }
 
+func (helm *Helm) IsDiffPluginVersionAtLeast(versionStr string) bool {
+	if helm.DiffPluginVersion == nil {
+		return false
+	}
+
+	ver := semver.MustParse(versionStr)
+	return helm.DiffPluginVersion.Equal(ver) || helm.DiffPluginVersion.GreaterThan(ver)
+}
+
 func (helm *Helm) sync(m *sync.Mutex, f func()) {
 	if m != nil {
 		m.Lock()
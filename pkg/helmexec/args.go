@@ -0,0 +1,146 @@
+package helmexec
+
+import (
+	"strings"
+	"unicode"
+)
+
+// repeatableFlags are the helm flags that can be given multiple times to accumulate values.
+// They are never removed from the args generated by helmfile when the same flags are given in the extra args.
+var repeatableFlags = map[string]bool{
+	"--set":                true,
+	"--set-string":         true,
+	"--set-file":           true,
+	"--set-json":           true,
+	"--values":             true,
+	"-f":                   true,
+	"--api-versions":       true,
+	"-a":                   true,
+	"--post-renderer-args": true,
+	"--show-only":          true,
+	"-s":                   true,
+}
+
+// flagName returns the name of the flag like `--timeout` for `--timeout` and `--timeout=10m`, or "" if arg isn't a flag
+func flagName(arg string) string {
+	if len(arg) < 2 || !strings.HasPrefix(arg, "-") || arg == "--" {
+		return ""
+	}
+	return strings.SplitN(arg, "=", 2)[0]
+}
+
+// boolFlags are the helm and helm-diff flags that never take a value, so that the arg following one of them isn't taken for its value
+var boolFlags = map[string]bool{
+	"--all":                        true,
+	"--allow-unreleased":           true,
+	"--atomic":                     true,
+	"--cleanup-on-fail":            true,
+	"--create-namespace":           true,
+	"--debug":                      true,
+	"--dependency-update":          true,
+	"--deployed":                   true,
+	"--detailed-exitcode":          true,
+	"--devel":                      true,
+	"--disable-openapi-validation": true,
+	"--dry-run":                    true,
+	"--enable-dns":                 true,
+	"--failed":                     true,
+	"--force":                      true,
+	"--force-update":               true,
+	"--include-crds":               true,
+	"--insecure-skip-tls-verify":   true,
+	"--install":                    true,
+	"--keep-history":               true,
+	"--no-color":                   true,
+	"--no-hooks":                   true,
+	"--normalize-manifests":        true,
+	"--pass-credentials":           true,
+	"--pending":                    true,
+	"--plain-http":                 true,
+	"--purge":                      true,
+	"--render-subchart-notes":      true,
+	"--reset-values":               true,
+	"--reuse-values":               true,
+	"--show-secrets":               true,
+	"--skip-crds":                  true,
+	"--skip-refresh":               true,
+	"--skip-schema-validation":     true,
+	"--suppress-secrets":           true,
+	"--take-ownership":             true,
+	"--three-way-merge":            true,
+	"--uninstalling":               true,
+	"--validate":                   true,
+	"--verify":                     true,
+	"--wait":                       true,
+	"--wait-for-jobs":              true,
+}
+
+// hasSeparateValue returns true when args[i] is a flag given in the form of `--flag value`.
+// The following arg is taken for the value unless the flag is one of boolFlags or the arg looks like a flag,
+// so a value like `-1` can follow the flag, while a value like `--x` needs to be given as `--flag=--x`.
+func hasSeparateValue(args []string, i int) bool {
+	if strings.Contains(args[i], "=") || i+1 >= len(args) || boolFlags[flagName(args[i])] {
+		return false
+	}
+	return !looksLikeFlag(args[i+1])
+}
+
+// looksLikeFlag returns true when arg is a long flag like `--wait` or a short flag like `-f`
+func looksLikeFlag(arg string) bool {
+	if strings.HasPrefix(arg, "--") {
+		return true
+	}
+	return len(arg) == 2 && arg[0] == '-' && unicode.IsLetter(rune(arg[1]))
+}
+
+// hasNonBoolValue returns true when arg is in the form of `--flag=value` and the value is neither `true` nor `false`
+func hasNonBoolValue(arg string) bool {
+	kv := strings.SplitN(arg, "=", 2)
+	return len(kv) == 2 && kv[1] != "true" && kv[1] != "false"
+}
+
+// mergeExtraArgs returns args followed by extra, with the flags in args that are also given in extra removed,
+// so that the extra args given by the user with --args and helmDefaults.args take precedence over the flags generated by helmfile.
+// For example, the release's `--timeout 300s` is removed when extra contains `--timeout=600s`.
+//
+// Whether a flag in args has a value to be removed along with it is determined by the form of the flag in extra:
+// `--flag value` and `--flag=value` have values, while `--flag`, `--flag=true` and `--flag=false` don't.
+// A flag in boolFlags never has a value in the form of `--flag value`.
+// The repeatableFlags like --set are never removed, so that the values given in extra are merged with the generated ones.
+func mergeExtraArgs(args, extra []string) []string {
+	if len(extra) == 0 {
+		return args
+	}
+
+	// overrides is the set of the flags in extra, mapped to whether each flag has a value
+	overrides := map[string]bool{}
+	for i := 0; i < len(extra); i++ {
+		name := flagName(extra[i])
+		if name == "" || repeatableFlags[name] {
+			continue
+		}
+
+		hasValue := hasNonBoolValue(extra[i])
+		if hasSeparateValue(extra, i) {
+			hasValue = true
+			i++
+		}
+
+		overrides[name] = overrides[name] || hasValue
+	}
+
+	merged := make([]string, 0, len(args)+len(extra))
+	for i := 0; i < len(args); i++ {
+		hasValue, overridden := overrides[flagName(args[i])]
+		if !overridden {
+			merged = append(merged, args[i])
+			continue
+		}
+
+		if hasValue && hasSeparateValue(args, i) {
+			i++
+		}
+	}
+
+	return append(merged, extra...)
+}
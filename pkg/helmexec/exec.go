@@ -13,7 +13,6 @@ import (
 
 	"github.com/Masterminds/semver/v3"
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
 )
 
 type decryptedSecret struct {
@@ -22,6 +21,11 @@ type decryptedSecret struct {
 	err   error
 }
 
+// repoMutex serializes the helm commands that write the repository config and cache shared by all the execers,
+// like `helm repo add`, `helm repo update`, and `helm dependency build` which refreshes the repository cache, regardless of `--concurrency`.
+// Running them concurrently intermittently corrupts the repository cache.
+var repoMutex sync.Mutex
+
 type execer struct {
 	helmBinary           string
 	version              semver.Version
@@ -29,26 +33,21 @@ type execer struct {
 	logger               *zap.SugaredLogger
 	kubeContext          string
 	extra                []string
+	appended             []string
 	decryptedSecretMutex sync.Mutex
 	decryptedSecrets     map[string]*decryptedSecret
 	writeTempFile        func([]byte) (string, error)
+
+	diffPluginVersionOnce sync.Once
+	diffPluginVersion     *semver.Version
 }
 
 func NewLogger(writer io.Writer, logLevel string) *zap.SugaredLogger {
-	var cfg zapcore.EncoderConfig
-	cfg.MessageKey = "message"
-	out := zapcore.AddSync(writer)
-	var level zapcore.Level
-	err := level.Set(logLevel)
+	logger, err := NewLoggerWithFormat(writer, logLevel, LogFormatText)
 	if err != nil {
 		panic(err)
 	}
-	core := zapcore.NewCore(
-		zapcore.NewConsoleEncoder(cfg),
-		out,
-		level,
-	)
-	return zap.New(core).Sugar()
+	return logger
 }
 
 func parseHelmVersion(versionStr string) (semver.Version, error) {
@@ -100,15 +99,24 @@ func New(helmBinary string, logger *zap.SugaredLogger, kubeContext string, runne
 	}
 }
 
+// SetExtraArgs sets the args given by the user with --args, which take precedence over the same flags generated by helmfile
 func (helm *execer) SetExtraArgs(args ...string) {
 	helm.extra = args
 }
 
+// SetAppendArgs sets the args given by the user with --extra-args, which are appended to every helm command as is
+func (helm *execer) SetAppendArgs(args ...string) {
+	helm.appended = args
+}
+
 func (helm *execer) SetHelmBinary(bin string) {
 	helm.helmBinary = bin
 }
 
 func (helm *execer) AddRepo(name, repository, cafile, certfile, keyfile, username, password string, managed string, passCredentials string, skipTLSVerify string) error {
+	repoMutex.Lock()
+	defer repoMutex.Unlock()
+
 	var args []string
 	var out []byte
 	var err error
@@ -159,13 +167,25 @@ func (helm *execer) AddRepo(name, repository, cafile, certfile, keyfile, usernam
 }
 
 func (helm *execer) UpdateRepo() error {
+	repoMutex.Lock()
+	defer repoMutex.Unlock()
+
 	helm.logger.Info("Updating repo")
 	out, err := helm.exec([]string{"repo", "update"}, map[string]string{})
 	helm.info(out)
 	return err
 }
 
+func (helm *execer) SearchRepo(chart string, flags ...string) (string, error) {
+	helm.logger.Infof("Searching repositories for %v", chart)
+	out, err := helm.exec(append([]string{"search", "repo", chart, "--output", "yaml"}, flags...), map[string]string{})
+	return string(out), err
+}
+
 func (helm *execer) RegistryLogin(repository string, username string, password string) error {
+	repoMutex.Lock()
+	defer repoMutex.Unlock()
+
 	helm.logger.Info("Logging in to registry")
 	args := []string{
 		"registry",
@@ -183,6 +203,9 @@ func (helm *execer) RegistryLogin(repository string, username string, password s
 }
 
 func (helm *execer) BuildDeps(name, chart string) error {
+	repoMutex.Lock()
+	defer repoMutex.Unlock()
+
 	helm.logger.Infof("Building dependency release=%v, chart=%v", name, chart)
 	out, err := helm.exec([]string{"dependency", "build", chart}, map[string]string{})
 	helm.info(out)
@@ -190,6 +213,9 @@ func (helm *execer) BuildDeps(name, chart string) error {
 }
 
 func (helm *execer) UpdateDeps(chart string) error {
+	repoMutex.Lock()
+	defer repoMutex.Unlock()
+
 	helm.logger.Infof("Updating dependency %v", chart)
 	out, err := helm.exec([]string{"dependency", "update", chart}, map[string]string{})
 	helm.info(out)
@@ -221,6 +247,14 @@ func (helm *execer) ReleaseStatus(context HelmContext, name string, flags ...str
 	return err
 }
 
+func (helm *execer) GetReleaseStatus(context HelmContext, name string, flags ...string) (string, error) {
+	helm.logger.Infof("Getting status %v", name)
+	preArgs := context.GetTillerlessArgs(helm)
+	env := context.getTillerlessEnv()
+	out, err := helm.exec(append(append(preArgs, "status", name), flags...), env)
+	return string(out), err
+}
+
 func (helm *execer) List(context HelmContext, filter string, flags ...string) (string, error) {
 	helm.logger.Infof("Listing releases matching %v", filter)
 	preArgs := context.GetTillerlessArgs(helm)
@@ -248,6 +282,18 @@ func (helm *execer) List(context HelmContext, filter string, flags ...string) (s
 	return string(out), err
 }
 
+func (helm *execer) GetValues(context HelmContext, name string, flags ...string) (string, error) {
+	helm.logger.Infof("Getting values of release=%v", name)
+	preArgs := context.GetTillerlessArgs(helm)
+	env := context.getTillerlessEnv()
+	args := []string{"get", "values", name}
+	if helm.IsHelm3() {
+		args = append(args, "--output", "yaml")
+	}
+	out, err := helm.exec(append(append(preArgs, args...), flags...), env)
+	return string(out), err
+}
+
 func (helm *execer) DecryptSecret(context HelmContext, name string, flags ...string) (string, error) {
 	absPath, err := filepath.Abs(name)
 	if err != nil {
@@ -433,6 +479,13 @@ func (helm *execer) Fetch(chart string, flags ...string) error {
 	return err
 }
 
+func (helm *execer) VerifyChart(chart string, flags ...string) error {
+	helm.logger.Infof("Verifying %v", chart)
+	out, err := helm.exec(append([]string{"verify", chart}, flags...), map[string]string{})
+	helm.info(out)
+	return err
+}
+
 func (helm *execer) ChartPull(chart string, flags ...string) error {
 	helm.logger.Infof("Pulling %v", chart)
 	helm.logger.Infof("Exporting %v", chart)
@@ -493,28 +546,44 @@ func (helm *execer) TestRelease(context HelmContext, name string, flags ...strin
 }
 
 func (helm *execer) exec(args []string, env map[string]string) ([]byte, error) {
-	cmdargs := args
-	if len(helm.extra) > 0 {
-		cmdargs = append(cmdargs, helm.extra...)
+	cmdargs := mergeExtraArgs(args, helm.extra)
+	if len(helm.appended) > 0 {
+		cmdargs = append(cmdargs, helm.appended...)
 	}
 	if helm.kubeContext != "" {
 		cmdargs = append([]string{"--kube-context", helm.kubeContext}, cmdargs...)
 	}
-	cmd := fmt.Sprintf("exec: %s %s", helm.helmBinary, strings.Join(cmdargs, " "))
+	cmd := fmt.Sprintf("exec: %s %s", helm.helmBinary, strings.Join(redactArgs(cmdargs), " "))
 	helm.logger.Debug(cmd)
 	outBytes, err := helm.runner.Execute(helm.helmBinary, cmdargs, env)
 	return outBytes, err
 }
 
+// redactArgs returns a copy of the helm args whose passwords are masked so that they never appear in the logs
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	for i, a := range args {
+		switch {
+		case i > 0 && args[i-1] == "--password":
+			redacted[i] = "***"
+		case strings.HasPrefix(a, "--password="):
+			redacted[i] = "--password=***"
+		default:
+			redacted[i] = a
+		}
+	}
+	return redacted
+}
+
 func (helm *execer) execStdIn(args []string, env map[string]string, stdin io.Reader) ([]byte, error) {
-	cmdargs := args
-	if len(helm.extra) > 0 {
-		cmdargs = append(cmdargs, helm.extra...)
+	cmdargs := mergeExtraArgs(args, helm.extra)
+	if len(helm.appended) > 0 {
+		cmdargs = append(cmdargs, helm.appended...)
 	}
 	if helm.kubeContext != "" {
 		cmdargs = append([]string{"--kube-context", helm.kubeContext}, cmdargs...)
 	}
-	cmd := fmt.Sprintf("exec: %s %s", helm.helmBinary, strings.Join(cmdargs, " "))
+	cmd := fmt.Sprintf("exec: %s %s", helm.helmBinary, strings.Join(redactArgs(cmdargs), " "))
 	helm.logger.Debug(cmd)
 	outBytes, err := helm.runner.ExecuteStdIn(helm.helmBinary, cmdargs, env, stdin)
 	return outBytes, err
@@ -560,3 +629,30 @@ func (helm *execer) IsVersionAtLeast(versionStr string) bool {
 	ver := semver.MustParse(versionStr)
 	return helm.version.Equal(ver) || helm.version.GreaterThan(ver)
 }
+
+// IsDiffPluginVersionAtLeast returns true when the installed helm-diff plugin is of the version or greater.
+// The version is detected by `helm diff version` only once. It returns false when the version couldn't be detected.
+func (helm *execer) IsDiffPluginVersionAtLeast(versionStr string) bool {
+	helm.diffPluginVersionOnce.Do(func() {
+		out, err := helm.exec([]string{"diff", "version"}, map[string]string{})
+		if err != nil {
+			helm.logger.Debugf("detecting helm-diff version: %v", err)
+			return
+		}
+
+		ver, err := semver.NewVersion(strings.TrimSpace(string(out)))
+		if err != nil {
+			helm.logger.Debugf("parsing helm-diff version %q: %v", strings.TrimSpace(string(out)), err)
+			return
+		}
+
+		helm.diffPluginVersion = ver
+	})
+
+	if helm.diffPluginVersion == nil {
+		return false
+	}
+
+	ver := semver.MustParse(versionStr)
+	return helm.diffPluginVersion.Equal(ver) || helm.diffPluginVersion.GreaterThan(ver)
+}
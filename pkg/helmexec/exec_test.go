@@ -8,7 +8,9 @@ import (
 	"path"
 	"path/filepath"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 
@@ -31,6 +33,32 @@ func (mock *mockRunner) Execute(cmd string, args []string, env map[string]string
 	return mock.output, mock.err
 }
 
+// concurrencyRunner records the maximum number of commands run concurrently
+type concurrencyRunner struct {
+	mockRunner
+
+	mu      sync.Mutex
+	running int
+	max     int
+}
+
+func (r *concurrencyRunner) Execute(cmd string, args []string, env map[string]string) ([]byte, error) {
+	r.mu.Lock()
+	r.running++
+	if r.running > r.max {
+		r.max = r.running
+	}
+	r.mu.Unlock()
+
+	time.Sleep(time.Millisecond)
+
+	r.mu.Lock()
+	r.running--
+	r.mu.Unlock()
+
+	return r.mockRunner.Execute(cmd, args, env)
+}
+
 func MockExecer(logger *zap.SugaredLogger, kubeContext string) *execer {
 	execer := New("helm", logger, kubeContext, &mockRunner{})
 	return execer
@@ -172,7 +200,7 @@ exec: az acr helm repo add --name acrRepo:
 	buffer.Reset()
 	err = helm.AddRepo("myRepo", "https://repo.example.com/", "", "", "", "example_user", "example_password", "", "", "")
 	expected = `Adding repo myRepo https://repo.example.com/
-exec: helm --kube-context dev repo add myRepo https://repo.example.com/ --username example_user --password example_password
+exec: helm --kube-context dev repo add myRepo https://repo.example.com/ --username example_user --password ***
 `
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
@@ -196,7 +224,7 @@ exec: helm --kube-context dev repo add myRepo https://repo.example.com/ --userna
 	buffer.Reset()
 	err = helm.AddRepo("myRepo", "https://repo.example.com/", "", "", "", "example_user", "example_password", "", "true", "")
 	expected = `Adding repo myRepo https://repo.example.com/
-exec: helm --kube-context dev repo add myRepo https://repo.example.com/ --username example_user --password example_password --pass-credentials
+exec: helm --kube-context dev repo add myRepo https://repo.example.com/ --username example_user --password *** --pass-credentials
 `
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
@@ -523,6 +551,22 @@ exec: helm --kube-context dev status myRelease
 	}
 }
 
+func Test_GetReleaseStatus(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := NewLogger(&buffer, "debug")
+	helm := MockExecer(logger, "dev")
+	_, err := helm.GetReleaseStatus(HelmContext{}, "myRelease", "--output", "json")
+	expected := `Getting status myRelease
+exec: helm --kube-context dev status myRelease --output json
+`
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if buffer.String() != expected {
+		t.Errorf("helmexec.GetReleaseStatus()\nactual = %v\nexpect = %v", buffer.String(), expected)
+	}
+}
+
 func Test_exec(t *testing.T) {
 	var buffer bytes.Buffer
 	logger := NewLogger(&buffer, "debug")
@@ -593,6 +637,89 @@ func Test_exec(t *testing.T) {
 	}
 }
 
+func Test_exec_ExtraArgs(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := NewLogger(&buffer, "debug")
+	helm := MockExecer(logger, "dev")
+	helm.SetExtraArgs("--timeout", "600s", "--set", "b=2")
+	helm.SetAppendArgs("--timeout", "900s")
+	_, err := helm.exec([]string{"upgrade", "release", "chart", "--timeout", "300s", "--set", "a=1", "--wait"}, map[string]string{})
+	expected := `exec: helm --kube-context dev upgrade release chart --set a=1 --wait --timeout 600s --set b=2 --timeout 900s
+`
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if buffer.String() != expected {
+		t.Errorf("helmexec.exec()\nactual = %v\nexpect = %v", buffer.String(), expected)
+	}
+}
+
+func Test_mergeExtraArgs(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		extra []string
+		want  []string
+	}{
+		{
+			name: "no extra args",
+			args: []string{"upgrade", "--timeout", "300s"},
+			want: []string{"upgrade", "--timeout", "300s"},
+		},
+		{
+			name:  "flag with a value",
+			args:  []string{"upgrade", "--timeout", "300s", "--wait"},
+			extra: []string{"--timeout", "600s"},
+			want:  []string{"upgrade", "--wait", "--timeout", "600s"},
+		},
+		{
+			name:  "flag with a value after =",
+			args:  []string{"upgrade", "--timeout=300s", "--wait"},
+			extra: []string{"--timeout=600s"},
+			want:  []string{"upgrade", "--wait", "--timeout=600s"},
+		},
+		{
+			name:  "boolean flag doesn't remove the following arg",
+			args:  []string{"upgrade", "--install", "release", "chart"},
+			extra: []string{"--install"},
+			want:  []string{"upgrade", "release", "chart", "--install"},
+		},
+		{
+			name:  "boolean flag with a value",
+			args:  []string{"upgrade", "--wait", "release"},
+			extra: []string{"--wait=false"},
+			want:  []string{"upgrade", "release", "--wait=false"},
+		},
+		{
+			name:  "value starting with a dash",
+			args:  []string{"upgrade", "--history-max", "10", "--wait"},
+			extra: []string{"--history-max", "-1"},
+			want:  []string{"upgrade", "--wait", "--history-max", "-1"},
+		},
+		{
+			name:  "known boolean flag followed by a positional arg",
+			args:  []string{"upgrade", "--atomic", "--timeout", "300s", "release"},
+			extra: []string{"--atomic", "release2"},
+			want:  []string{"upgrade", "--timeout", "300s", "release", "--atomic", "release2"},
+		},
+		{
+			name:  "repeatable flags are added",
+			args:  []string{"upgrade", "--set", "a=1", "--values", "a.yaml"},
+			extra: []string{"--set", "b=2", "-f", "b.yaml"},
+			want:  []string{"upgrade", "--set", "a=1", "--values", "a.yaml", "--set", "b=2", "-f", "b.yaml"},
+		},
+	}
+
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			if d := cmp.Diff(tt.want, mergeExtraArgs(tt.args, tt.extra)); d != "" {
+				t.Errorf("unexpected args: want (-), got (+):\n%s", d)
+			}
+		})
+	}
+}
+
 func Test_Lint(t *testing.T) {
 	var buffer bytes.Buffer
 	logger := NewLogger(&buffer, "debug")
@@ -625,15 +752,69 @@ exec: helm --kube-context dev fetch chart --version 1.2.3 --untar --untardir /tm
 	}
 }
 
+func Test_VerifyChart(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := NewLogger(&buffer, "debug")
+	helm := MockExecer(logger, "dev")
+	err := helm.VerifyChart("/tmp/dir/chart-1.2.3.tgz", "--keyring", "/tmp/pubring.gpg")
+	expected := `Verifying /tmp/dir/chart-1.2.3.tgz
+exec: helm --kube-context dev verify /tmp/dir/chart-1.2.3.tgz --keyring /tmp/pubring.gpg
+`
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if buffer.String() != expected {
+		t.Errorf("helmexec.VerifyChart()\nactual = %v\nexpect = %v", buffer.String(), expected)
+	}
+}
+
 var logLevelTests = map[string]string{
 	"debug": `Adding repo myRepo https://repo.example.com/
-exec: helm repo add myRepo https://repo.example.com/ --username example_user --password example_password
+exec: helm repo add myRepo https://repo.example.com/ --username example_user --password ***
 `,
 	"info": `Adding repo myRepo https://repo.example.com/
 `,
 	"warn": ``,
 }
 
+func Test_RepoCommandsAreSerialized(t *testing.T) {
+	runner := &concurrencyRunner{}
+
+	var buffer bytes.Buffer
+	logger := NewLogger(&buffer, "debug")
+
+	// Simulates sub-helmfiles for different kube contexts, each having its own execer, syncing repositories concurrently
+	var helms []*execer
+	for i := 0; i < 10; i++ {
+		helms = append(helms, New("helm", logger, fmt.Sprintf("context%d", i), runner))
+	}
+
+	var wg sync.WaitGroup
+	for _, helm := range helms {
+		helm := helm
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := helm.AddRepo("myRepo", "https://repo.example.com/", "", "", "", "", "", "", "", ""); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if err := helm.UpdateRepo(); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if err := helm.BuildDeps("myRelease", "./chart"); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if runner.max != 1 {
+		t.Errorf("repo commands must not run concurrently: got %d concurrent commands", runner.max)
+	}
+}
+
 func Test_LogLevels(t *testing.T) {
 	var buffer bytes.Buffer
 	for logLevel, expected := range logLevelTests {
@@ -753,3 +934,28 @@ func Test_IsVersionAtLeast(t *testing.T) {
 		t.Error("helmexec.IsVersionAtLeast - 2.16.1 is atleast 3.2")
 	}
 }
+
+func Test_IsDiffPluginVersionAtLeast(t *testing.T) {
+	runner := mockRunner{output: []byte("v3.13.0+g825e86f\n")}
+	helm := New("helm", NewLogger(os.Stdout, "info"), "dev", &runner)
+
+	runner.output = []byte("3.9.2\n")
+
+	if !helm.IsDiffPluginVersionAtLeast("3.9.0") {
+		t.Error("helmexec.IsDiffPluginVersionAtLeast - 3.9.2 not atleast 3.9.0")
+	}
+
+	if helm.IsDiffPluginVersionAtLeast("3.10.0") {
+		t.Error("helmexec.IsDiffPluginVersionAtLeast - 3.9.2 is atleast 3.10.0")
+	}
+
+	noDiffRunner := mockRunner{output: []byte("v3.13.0+g825e86f\n")}
+	helm = New("helm", NewLogger(os.Stdout, "info"), "dev", &noDiffRunner)
+
+	noDiffRunner.output = []byte("Error: unknown command \"diff\" for \"helm\"")
+	noDiffRunner.err = fmt.Errorf("exit status 1")
+
+	if helm.IsDiffPluginVersionAtLeast("3.9.0") {
+		t.Error("helmexec.IsDiffPluginVersionAtLeast - should be false when helm-diff is not installed")
+	}
+}
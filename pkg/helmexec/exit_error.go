@@ -30,6 +30,7 @@ func newExitError(path string, args []string, exitStatus int, err error, stderr,
 	return ExitError{
 		Message: fmt.Sprintf("command %q exited with non-zero status:\n\n%s", path, out),
 		Code:    exitStatus,
+		Stderr:  stderr,
 	}
 }
 
@@ -60,6 +61,8 @@ func Indent(text, indent string) string {
 type ExitError struct {
 	Message string
 	Code    int
+	// Stderr is what the command wrote to stderr
+	Stderr string
 }
 
 func (e ExitError) Error() string {
@@ -10,10 +10,12 @@ type Version struct {
 // Interface for executing helm commands
 type Interface interface {
 	SetExtraArgs(args ...string)
+	SetAppendArgs(args ...string)
 	SetHelmBinary(bin string)
 
 	AddRepo(name, repository, cafile, certfile, keyfile, username, password string, managed string, passCredentials string, skipTLSVerify string) error
 	UpdateRepo() error
+	SearchRepo(chart string, flags ...string) (string, error)
 	RegistryLogin(name string, username string, password string) error
 	BuildDeps(name, chart string) error
 	UpdateDeps(chart string) error
@@ -21,17 +23,21 @@ type Interface interface {
 	DiffRelease(context HelmContext, name, chart string, suppressDiff bool, flags ...string) error
 	TemplateRelease(name, chart string, flags ...string) error
 	Fetch(chart string, flags ...string) error
+	VerifyChart(chart string, flags ...string) error
 	ChartPull(chart string, flags ...string) error
 	ChartExport(chart string, path string, flags ...string) error
 	Lint(name, chart string, flags ...string) error
 	ReleaseStatus(context HelmContext, name string, flags ...string) error
+	GetReleaseStatus(context HelmContext, name string, flags ...string) (string, error)
 	DeleteRelease(context HelmContext, name string, flags ...string) error
 	TestRelease(context HelmContext, name string, flags ...string) error
 	List(context HelmContext, filter string, flags ...string) (string, error)
 	DecryptSecret(context HelmContext, name string, flags ...string) (string, error)
+	GetValues(context HelmContext, name string, flags ...string) (string, error)
 	IsHelm3() bool
 	GetVersion() Version
 	IsVersionAtLeast(versionStr string) bool
+	IsDiffPluginVersionAtLeast(versionStr string) bool
 }
 
 type DependencyUpdater interface {
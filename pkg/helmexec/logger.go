@@ -0,0 +1,89 @@
+package helmexec
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	// LogFormatText is the default log format that prints human-oriented messages without any structured fields
+	LogFormatText = "text"
+	// LogFormatJSON is the log format that prints a JSON object per line with the level, the timestamp, the message,
+	// and structured fields like the release name
+	LogFormatJSON = "json"
+
+	// EventLoggerName is the name of the logger returned by EventLogger
+	EventLoggerName = "event"
+)
+
+// NewLoggerWithFormat is NewLogger that lets you choose the log format, either LogFormatText or LogFormatJSON
+func NewLoggerWithFormat(writer io.Writer, logLevel, logFormat string) (*zap.SugaredLogger, error) {
+	var level zapcore.Level
+	if err := level.Set(logLevel); err != nil {
+		return nil, err
+	}
+
+	out := zapcore.AddSync(writer)
+
+	var core zapcore.Core
+
+	switch logFormat {
+	case "", LogFormatText:
+		var cfg zapcore.EncoderConfig
+		cfg.MessageKey = "message"
+		core = textCore{Core: zapcore.NewCore(zapcore.NewConsoleEncoder(cfg), out, level)}
+	case LogFormatJSON:
+		cfg := zapcore.EncoderConfig{
+			TimeKey:        "ts",
+			LevelKey:       "level",
+			NameKey:        "logger",
+			MessageKey:     "msg",
+			LineEnding:     zapcore.DefaultLineEnding,
+			EncodeLevel:    zapcore.LowercaseLevelEncoder,
+			EncodeTime:     zapcore.ISO8601TimeEncoder,
+			EncodeDuration: zapcore.StringDurationEncoder,
+		}
+		core = zapcore.NewCore(zapcore.NewJSONEncoder(cfg), out, level)
+	default:
+		return nil, fmt.Errorf("unsupported log format %q: it must be either %q or %q", logFormat, LogFormatText, LogFormatJSON)
+	}
+
+	return zap.New(core).Sugar(), nil
+}
+
+// EventLogger returns the logger for structured events on releases, like the start and the result of syncing a release.
+//
+// The events are emitted only in the JSON log format, as the text log format already prints human-oriented messages
+// for the same operations.
+func EventLogger(logger *zap.SugaredLogger) *zap.SugaredLogger {
+	return logger.Named(EventLoggerName)
+}
+
+// textCore drops structured fields and events so that the text log format prints only the messages
+type textCore struct {
+	zapcore.Core
+}
+
+func (c textCore) With(fields []zapcore.Field) zapcore.Core {
+	return c
+}
+
+func (c textCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if ent.LoggerName == EventLoggerName || strings.HasSuffix(ent.LoggerName, "."+EventLoggerName) {
+		return ce
+	}
+
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+
+	return ce
+}
+
+func (c textCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	return c.Core.Write(ent, nil)
+}
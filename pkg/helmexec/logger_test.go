@@ -0,0 +1,70 @@
+package helmexec
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNewLoggerWithFormat_Text(t *testing.T) {
+	var buf bytes.Buffer
+
+	logger, err := NewLoggerWithFormat(&buf, "info", LogFormatText)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	logger.Infow("Upgrading release=foo", "release", "foo")
+	logger.With("namespace", "ns").Infof("Deleting %s", "foo")
+	EventLogger(logger).Infow("sync started", "release", "foo")
+	logger.Debugf("not printed")
+
+	want := "Upgrading release=foo\nDeleting foo\n"
+	if buf.String() != want {
+		t.Errorf("unexpected output:\nactual = %q\nexpect = %q", buf.String(), want)
+	}
+}
+
+func TestNewLoggerWithFormat_JSON(t *testing.T) {
+	var buf bytes.Buffer
+
+	logger, err := NewLoggerWithFormat(&buf, "info", LogFormatJSON)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	logger.Infof("Upgrading release=%s", "foo")
+	EventLogger(logger).Infow("sync started", "release", "foo", "namespace", "ns")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected number of lines: %d\n%s", len(lines), buf.String())
+	}
+
+	var entries []map[string]interface{}
+	for _, l := range lines {
+		var e map[string]interface{}
+		if err := json.Unmarshal([]byte(l), &e); err != nil {
+			t.Fatalf("unexpected error parsing %q: %v", l, err)
+		}
+		if _, ok := e["ts"]; !ok {
+			t.Errorf("missing ts in %q", l)
+		}
+		entries = append(entries, e)
+	}
+
+	if entries[0]["level"] != "info" || entries[0]["msg"] != "Upgrading release=foo" {
+		t.Errorf("unexpected entry: %v", entries[0])
+	}
+
+	if entries[1]["logger"] != EventLoggerName || entries[1]["msg"] != "sync started" || entries[1]["release"] != "foo" || entries[1]["namespace"] != "ns" {
+		t.Errorf("unexpected entry: %v", entries[1])
+	}
+}
+
+func TestNewLoggerWithFormat_Invalid(t *testing.T) {
+	if _, err := NewLoggerWithFormat(&bytes.Buffer{}, "info", "xml"); err == nil || err.Error() != `unsupported log format "xml": it must be either "text" or "json"` {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package helmexec
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// CommandRecord is a command run by a RecordingRunner
+type CommandRecord struct {
+	Command string
+	// Args are the arguments of the command, with the passwords masked
+	Args []string
+	// Err is the error of the command, or nil when it succeeded
+	Err error
+	// Stderr is what the command wrote to stderr when it failed
+	Stderr string
+}
+
+// CommandRecorder records the commands run by one or more RecordingRunners in the order they are run
+type CommandRecorder struct {
+	mu      sync.Mutex
+	records []CommandRecord
+}
+
+// Records returns the commands recorded so far
+func (r *CommandRecorder) Records() []CommandRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]CommandRecord{}, r.records...)
+}
+
+func (r *CommandRecorder) record(cmd string, args []string, err error) {
+	rec := CommandRecord{
+		Command: cmd,
+		Args:    redactArgs(args),
+		Err:     err,
+	}
+
+	var exitErr ExitError
+	if errors.As(err, &exitErr) {
+		rec.Stderr = exitErr.Stderr
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.records = append(r.records, rec)
+}
+
+// RecordingRunner is a Runner that records the commands run by the underlying Runner into the Recorder
+type RecordingRunner struct {
+	Runner   Runner
+	Recorder *CommandRecorder
+}
+
+func (r *RecordingRunner) Execute(cmd string, args []string, env map[string]string) ([]byte, error) {
+	out, err := r.Runner.Execute(cmd, args, env)
+	r.Recorder.record(cmd, args, err)
+	return out, err
+}
+
+func (r *RecordingRunner) ExecuteStdIn(cmd string, args []string, env map[string]string, stdin io.Reader) ([]byte, error) {
+	out, err := r.Runner.ExecuteStdIn(cmd, args, env, stdin)
+	r.Recorder.record(cmd, args, err)
+	return out, err
+}
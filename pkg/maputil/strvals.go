@@ -0,0 +1,362 @@
+package maputil
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// The below is a reimplementation of helm's strvals parser, so that helmfile can compute the values helm computes from
+// `--set`, `--set-string`, and `--set-file` without depending on helm as a library.
+//
+// Like helm, it applies an expression like `list[0].foo=bar` onto the existing values, replacing only the item at the index
+// of the existing list and keeping the other fields of the item.
+
+// maxSetIndex is the maximum index of a list helm accepts in a --set expression
+const maxSetIndex = 65536
+
+var errNotList = errors.New("not a list")
+
+// ParseSetInto parses the `--set` expression like `a.b[0].c=d,e={f,g}` and sets the typed values into dest.
+// `true` and `false` are parsed as booleans, `null` as nil, and integers without a leading zero as int64.
+func ParseSetInto(s string, dest map[string]interface{}) error {
+	return newSetParser(s, dest, func(rs []rune) (interface{}, error) {
+		return typedSetValue(string(rs)), nil
+	}).parse()
+}
+
+// ParseSetStringInto parses the `--set-string` expression and sets the values into dest as strings.
+func ParseSetStringInto(s string, dest map[string]interface{}) error {
+	return newSetParser(s, dest, func(rs []rune) (interface{}, error) {
+		return string(rs), nil
+	}).parse()
+}
+
+// ParseSetFileInto parses the `--set-file` expression like `a.b=path/to/file` and sets the content of the file into dest.
+func ParseSetFileInto(s string, dest map[string]interface{}, readFile func(string) ([]byte, error)) error {
+	return newSetParser(s, dest, func(rs []rune) (interface{}, error) {
+		bs, err := readFile(string(rs))
+		return string(bs), err
+	}).parse()
+}
+
+type setParser struct {
+	sc     *bytes.Buffer
+	data   map[string]interface{}
+	reader func([]rune) (interface{}, error)
+}
+
+func newSetParser(s string, dest map[string]interface{}, reader func([]rune) (interface{}, error)) *setParser {
+	return &setParser{
+		sc:     bytes.NewBufferString(s),
+		data:   dest,
+		reader: reader,
+	}
+}
+
+func (t *setParser) parse() error {
+	for {
+		err := t.key(t.data)
+		if err == nil {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+}
+
+func (t *setParser) key(data map[string]interface{}) error {
+	stop := runeSet('=', '[', ',', '.')
+	for {
+		switch k, last, err := runesUntil(t.sc, stop); {
+		case err != nil:
+			if len(k) == 0 {
+				return err
+			}
+			return fmt.Errorf("key %q has no value", string(k))
+		case last == '[':
+			// We are in a list index context, so we need to set an index.
+			i, err := t.keyIndex()
+			if err != nil {
+				return fmt.Errorf("error parsing index: %w", err)
+			}
+			kk := string(k)
+			// Find or create target list
+			list := []interface{}{}
+			if existing, ok := data[kk]; ok && existing != nil {
+				l, ok := existing.([]interface{})
+				if !ok {
+					return fmt.Errorf("key %q is not a list but %T", kk, existing)
+				}
+				list = l
+			}
+
+			// Now we need to get the value after the ].
+			list, err = t.listItem(list, i)
+			setKey(data, kk, list)
+			return err
+		case last == '=':
+			// End of key. Consume =, Get value.
+			vl, e := t.valList()
+			switch e {
+			case nil:
+				setKey(data, string(k), vl)
+				return nil
+			case io.EOF:
+				setKey(data, string(k), "")
+				return e
+			case errNotList:
+				rs, e := t.val()
+				if e != nil && e != io.EOF {
+					return e
+				}
+				v, err := t.reader(rs)
+				if err != nil {
+					return err
+				}
+				setKey(data, string(k), v)
+				return e
+			default:
+				return e
+			}
+		case last == ',':
+			// No value given. Set the value to empty string. Return error.
+			setKey(data, string(k), "")
+			return fmt.Errorf("key %q has no value (cannot end with ,)", string(k))
+		case last == '.':
+			// First, create or find the target map.
+			kk := string(k)
+			inner := map[string]interface{}{}
+			if existing, ok := data[kk]; ok && existing != nil {
+				m, ok := existing.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("key %q is not a map but %T", kk, existing)
+				}
+				inner = m
+			}
+
+			// Recurse
+			e := t.key(inner)
+			if len(inner) == 0 {
+				return fmt.Errorf("key map %q has no value", kk)
+			}
+			setKey(data, kk, inner)
+			return e
+		}
+	}
+}
+
+func (t *setParser) listItem(list []interface{}, i int) ([]interface{}, error) {
+	if i < 0 {
+		return list, fmt.Errorf("negative %d index not allowed", i)
+	}
+	stop := runeSet('[', '.', '=')
+	switch k, last, err := runesUntil(t.sc, stop); {
+	case len(k) > 0:
+		return list, fmt.Errorf("unexpected data at end of array index: %q", string(k))
+	case err != nil:
+		return list, err
+	case last == '=':
+		vl, e := t.valList()
+		switch e {
+		case nil:
+			return setIndex(list, i, vl)
+		case io.EOF:
+			return setIndex(list, i, "")
+		case errNotList:
+			rs, e := t.val()
+			if e != nil && e != io.EOF {
+				return list, e
+			}
+			v, e := t.reader(rs)
+			if e != nil {
+				return list, e
+			}
+			return setIndex(list, i, v)
+		default:
+			return list, e
+		}
+	case last == '[':
+		// now we have a nested list. Read the index and handle.
+		nextI, err := t.keyIndex()
+		if err != nil {
+			return list, fmt.Errorf("error parsing index: %w", err)
+		}
+		var crtList []interface{}
+		if len(list) > i && list[i] != nil {
+			// If nested list already exists, take the value of list to next cycle.
+			l, ok := list[i].([]interface{})
+			if !ok {
+				return list, fmt.Errorf("index %d is not a list but %T", i, list[i])
+			}
+			crtList = l
+		}
+		// Now we need to get the value after the ].
+		list2, err := t.listItem(crtList, nextI)
+		if err != nil {
+			return list, err
+		}
+		return setIndex(list, i, list2)
+	case last == '.':
+		// We have a nested object. Send to t.key
+		inner := map[string]interface{}{}
+		if len(list) > i {
+			var ok bool
+			inner, ok = list[i].(map[string]interface{})
+			if !ok {
+				// We have indices out of order. Initialize empty value.
+				inner = map[string]interface{}{}
+			}
+		}
+
+		// Recurse
+		e := t.key(inner)
+		if e != nil {
+			return list, e
+		}
+		return setIndex(list, i, inner)
+	default:
+		return nil, fmt.Errorf("parse error: unexpected token %v", last)
+	}
+}
+
+func (t *setParser) keyIndex() (int, error) {
+	// First, get the key.
+	v, _, err := runesUntil(t.sc, runeSet(']'))
+	if err != nil {
+		return 0, err
+	}
+	// v should be the index
+	return strconv.Atoi(string(v))
+}
+
+func (t *setParser) val() ([]rune, error) {
+	v, _, err := runesUntil(t.sc, runeSet(','))
+	return v, err
+}
+
+func (t *setParser) valList() ([]interface{}, error) {
+	r, _, e := t.sc.ReadRune()
+	if e != nil {
+		return []interface{}{}, e
+	}
+
+	if r != '{' {
+		if err := t.sc.UnreadRune(); err != nil {
+			return []interface{}{}, err
+		}
+		return []interface{}{}, errNotList
+	}
+
+	list := []interface{}{}
+	stop := runeSet(',', '}')
+	for {
+		switch rs, last, err := runesUntil(t.sc, stop); {
+		case err != nil:
+			if err == io.EOF {
+				err = errors.New("list must terminate with '}'")
+			}
+			return list, err
+		case last == '}':
+			// If this is followed by ',', consume it.
+			if r, _, e := t.sc.ReadRune(); e == nil && r != ',' {
+				if err := t.sc.UnreadRune(); err != nil {
+					return list, err
+				}
+			}
+			v, e := t.reader(rs)
+			list = append(list, v)
+			return list, e
+		case last == ',':
+			v, e := t.reader(rs)
+			if e != nil {
+				return list, e
+			}
+			list = append(list, v)
+		}
+	}
+}
+
+func runesUntil(in io.RuneReader, stop map[rune]bool) ([]rune, rune, error) {
+	v := []rune{}
+	for {
+		switch r, _, e := in.ReadRune(); {
+		case e != nil:
+			return v, r, e
+		case stop[r]:
+			return v, r, nil
+		case r == '\\':
+			next, _, e := in.ReadRune()
+			if e != nil {
+				return v, next, e
+			}
+			v = append(v, next)
+		default:
+			v = append(v, r)
+		}
+	}
+}
+
+func runeSet(r ...rune) map[rune]bool {
+	s := make(map[rune]bool, len(r))
+	for _, rr := range r {
+		s[rr] = true
+	}
+	return s
+}
+
+func setKey(data map[string]interface{}, key string, val interface{}) {
+	// If key is empty, don't set it.
+	if len(key) == 0 {
+		return
+	}
+	data[key] = val
+}
+
+func setIndex(list []interface{}, index int, val interface{}) ([]interface{}, error) {
+	if index < 0 {
+		return list, fmt.Errorf("negative %d index not allowed", index)
+	}
+	if index > maxSetIndex {
+		return list, fmt.Errorf("index of %d is greater than maximum supported index of %d", index, maxSetIndex)
+	}
+	if len(list) <= index {
+		newlist := make([]interface{}, index+1)
+		copy(newlist, list)
+		list = newlist
+	}
+	list[index] = val
+	return list, nil
+}
+
+func typedSetValue(val string) interface{} {
+	if strings.EqualFold(val, "true") {
+		return true
+	}
+
+	if strings.EqualFold(val, "false") {
+		return false
+	}
+
+	if strings.EqualFold(val, "null") {
+		return nil
+	}
+
+	if strings.EqualFold(val, "0") {
+		return int64(0)
+	}
+
+	// If this value does not start with zero, try parsing it to an int
+	if len(val) != 0 && val[0] != '0' {
+		if iv, err := strconv.ParseInt(val, 10, 64); err == nil {
+			return iv
+		}
+	}
+
+	return val
+}
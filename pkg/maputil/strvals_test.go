@@ -0,0 +1,150 @@
+package maputil
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseSetInto(t *testing.T) {
+	testcases := []struct {
+		expr    string
+		values  map[string]interface{}
+		want    map[string]interface{}
+		wantErr string
+	}{
+		{
+			expr: "list[0].foo=bar",
+			values: map[string]interface{}{
+				"list": []interface{}{
+					map[string]interface{}{"foo": "a", "bar": "b"},
+					map[string]interface{}{"foo": "c"},
+				},
+			},
+			want: map[string]interface{}{
+				"list": []interface{}{
+					map[string]interface{}{"foo": "bar", "bar": "b"},
+					map[string]interface{}{"foo": "c"},
+				},
+			},
+		},
+		{
+			expr: "list[2]=c",
+			values: map[string]interface{}{
+				"list": []interface{}{"a"},
+			},
+			want: map[string]interface{}{
+				"list": []interface{}{"a", nil, "c"},
+			},
+		},
+		{
+			expr: "list={c,d}",
+			values: map[string]interface{}{
+				"list": []interface{}{"a", "b", "e"},
+			},
+			want: map[string]interface{}{
+				"list": []interface{}{"c", "d"},
+			},
+		},
+		{
+			expr: "a.b=1,a.c=true,a.d=null,a.e=0123,a.f=0",
+			values: map[string]interface{}{
+				"a": map[string]interface{}{"g": "h"},
+			},
+			want: map[string]interface{}{
+				"a": map[string]interface{}{"b": int64(1), "c": true, "d": nil, "e": "0123", "f": int64(0), "g": "h"},
+			},
+		},
+		{
+			expr:   `a\.b=c\,d`,
+			values: map[string]interface{}{},
+			want: map[string]interface{}{
+				"a.b": "c,d",
+			},
+		},
+		{
+			expr:   "nested[0][1]=a",
+			values: map[string]interface{}{},
+			want: map[string]interface{}{
+				"nested": []interface{}{[]interface{}{nil, "a"}},
+			},
+		},
+		{
+			expr:    "a",
+			values:  map[string]interface{}{},
+			wantErr: `key "a" has no value`,
+		},
+		{
+			expr: "a[0]=b",
+			values: map[string]interface{}{
+				"a": "b",
+			},
+			wantErr: `key "a" is not a list but string`,
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(tc.expr, func(t *testing.T) {
+			err := ParseSetInto(tc.expr, tc.values)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("unexpected error: want %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if d := cmp.Diff(tc.want, tc.values); d != "" {
+				t.Errorf("unexpected values: want (-), got (+):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestParseSetStringInto(t *testing.T) {
+	values := map[string]interface{}{}
+
+	if err := ParseSetStringInto("a=1,b=true,c={2,null}", values); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := map[string]interface{}{
+		"a": "1",
+		"b": "true",
+		"c": []interface{}{"2", "null"},
+	}
+
+	if d := cmp.Diff(want, values); d != "" {
+		t.Errorf("unexpected values: want (-), got (+):\n%s", d)
+	}
+}
+
+func TestParseSetFileInto(t *testing.T) {
+	values := map[string]interface{}{
+		"list": []interface{}{map[string]interface{}{"a": "b"}},
+	}
+
+	readFile := func(f string) ([]byte, error) {
+		if f != "/path/to/file" {
+			return nil, fmt.Errorf("unexpected file: %s", f)
+		}
+		return []byte("content"), nil
+	}
+
+	if err := ParseSetFileInto("list[0].c=/path/to/file", values, readFile); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := map[string]interface{}{
+		"list": []interface{}{map[string]interface{}{"a": "b", "c": "content"}},
+	}
+
+	if d := cmp.Diff(want, values); d != "" {
+		t.Errorf("unexpected values: want (-), got (+):\n%s", d)
+	}
+}
@@ -4,9 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/hashicorp/go-getter"
 	"github.com/hashicorp/go-getter/helper/url"
@@ -15,7 +20,18 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
+// CacheHomeEnvVar is the environment variable to relocate the cache directory of helmfile, where remote charts and helmfiles are downloaded.
+const CacheHomeEnvVar = "HELMFILE_CACHE_HOME"
+
+// cacheMarkerFile is created in each top-level directory helmfile creates within the cache directory,
+// so that `helmfile cache cleanup` never removes anything else in a relocated cache directory that may be shared with other tools.
+const cacheMarkerFile = ".helmfile-cache"
+
 func CacheDir() string {
+	if dir := os.Getenv(CacheHomeEnvVar); dir != "" {
+		return dir
+	}
+
 	dir, err := os.UserCacheDir()
 	if err != nil {
 		// fall back to relative path with hidden directory
@@ -24,6 +40,59 @@ func CacheDir() string {
 	return filepath.Join(dir, "helmfile")
 }
 
+// IsCacheDirRelocated returns true when the cache directory is relocated by HELMFILE_CACHE_HOME.
+func IsCacheDirRelocated() bool {
+	return os.Getenv(CacheHomeEnvVar) != ""
+}
+
+// CacheEntries returns the names of the top-level directories within the cache directory.
+//
+// When the cache directory is relocated, only the directories created by helmfile are returned.
+// Otherwise the whole cache directory is owned by helmfile and all the entries are returned.
+func CacheEntries() ([]string, error) {
+	dir := CacheDir()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+
+	for _, e := range entries {
+		if IsCacheDirRelocated() {
+			if !e.IsDir() {
+				continue
+			}
+
+			if _, err := os.Stat(filepath.Join(dir, e.Name(), cacheMarkerFile)); err != nil {
+				continue
+			}
+		}
+
+		names = append(names, e.Name())
+	}
+
+	return names, nil
+}
+
+// MarkCacheEntry marks the top-level directory within the cache directory that contains the path as created by helmfile.
+// The path must be relative to the cache directory.
+func MarkCacheEntry(home, path string) error {
+	top := strings.Split(filepath.ToSlash(filepath.Clean(path)), "/")[0]
+	if top == "" || top == "." || top == ".." {
+		return nil
+	}
+
+	marker := filepath.Join(home, top, cacheMarkerFile)
+
+	if _, err := os.Stat(marker); err == nil {
+		return nil
+	}
+
+	return os.WriteFile(marker, []byte{}, 0644)
+}
+
 type Remote struct {
 	Logger *zap.SugaredLogger
 
@@ -38,6 +107,13 @@ type Remote struct {
 	ReadFile   func(string) ([]byte, error)
 	DirExists  func(string) bool
 	FileExists func(string) bool
+
+	// HTTPClient is used for fetching plain HTTP(S) files. If nil, http.DefaultClient is used
+	HTTPClient *http.Client
+
+	// httpFiles maps each URL fetched by FetchHTTPFile to the downloaded file, so that every URL is fetched at most once per run
+	httpFiles map[string]string
+	mu        sync.Mutex
 }
 
 func (r *Remote) Unmarshal(src string, dst interface{}) error {
@@ -111,6 +187,15 @@ func (e InvalidURLError) Error() string {
 	return e.err
 }
 
+// NotFoundError is returned by FetchHTTPFile when the server responded with 404
+type NotFoundError struct {
+	URL string
+}
+
+func (e NotFoundError) Error() string {
+	return fmt.Sprintf("%s: not found", e.URL)
+}
+
 type Source struct {
 	Getter, Scheme, User, Host, Dir, File, RawQuery string
 }
@@ -239,11 +324,118 @@ func (r *Remote) Fetch(goGetterSrc string, cacheDirOpt ...string) (string, error
 			}
 			return "", err
 		}
+
+		// Markers are needed only in a relocated cache directory, as the default one is owned by helmfile
+		if IsCacheDirRelocated() && r.Home == CacheDir() {
+			if err := MarkCacheEntry(r.Home, getterDst); err != nil {
+				return "", err
+			}
+		}
 	}
 
 	return filepath.Join(cacheDirPath, file), nil
 }
 
+// IsHTTPFile returns true when src is a plain HTTP(S) URL to a single file like `https://example.com/prod.yaml`.
+// Unlike go-getter URLs, it has neither the getter prefix nor `@` separating the directory and the file.
+func IsHTTPFile(src string) bool {
+	u, err := neturl.Parse(src)
+	if err != nil {
+		return false
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+
+	return !strings.Contains(u.Path, "@") && path.Base(u.Path) != "/" && path.Base(u.Path) != "."
+}
+
+// FetchHTTPFile downloads the file at the HTTP(S) URL into the cache directory and returns the path to the downloaded file.
+//
+// The request is sent with the given headers. The file is always downloaded on the first call for the URL,
+// and the subsequent calls for the same URL return the same file without sending a request.
+func (r *Remote) FetchHTTPFile(src string, headers map[string]string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if f, ok := r.httpFiles[src]; ok {
+		r.Logger.Debugf("using %s already fetched from %s", f, src)
+		return f, nil
+	}
+
+	u, err := neturl.Parse(src)
+	if err != nil {
+		return "", InvalidURLError{err: fmt.Sprintf("parse url: %v", err)}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, src, nil)
+	if err != nil {
+		return "", err
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	client := r.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	r.Logger.Debugf("downloading %s", src)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return "", NotFoundError{URL: src}
+	}
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return "", fmt.Errorf("fetching %s: unexpected status %s", src, res.Status)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", fmt.Errorf("fetching %s: %v", src, err)
+	}
+
+	replacer := strings.NewReplacer(":", "", "//", "_", "/", "_", ".", "_")
+	cacheKey := replacer.Replace(fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, path.Dir(u.Path)))
+	if len(u.RawQuery) > 0 {
+		cacheKey = fmt.Sprintf("%s.%s", cacheKey, strings.Replace(u.RawQuery, "&", "_", -1))
+	}
+
+	cacheDirPath := filepath.Join(r.Home, cacheKey)
+
+	if err := os.MkdirAll(cacheDirPath, 0755); err != nil {
+		return "", err
+	}
+
+	file := filepath.Join(cacheDirPath, path.Base(u.Path))
+
+	if err := ioutil.WriteFile(file, body, 0644); err != nil {
+		return "", err
+	}
+
+	if IsCacheDirRelocated() && r.Home == CacheDir() {
+		if err := MarkCacheEntry(r.Home, cacheKey); err != nil {
+			return "", err
+		}
+	}
+
+	if r.httpFiles == nil {
+		r.httpFiles = map[string]string{}
+	}
+	r.httpFiles[src] = file
+
+	return file, nil
+}
+
 type Getter interface {
 	Get(wd, src, dst string) error
 }
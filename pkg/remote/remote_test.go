@@ -2,6 +2,8 @@ package remote
 
 import (
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
@@ -237,3 +239,124 @@ type testGetter struct {
 func (t *testGetter) Get(wd, src, dst string) error {
 	return t.get(wd, src, dst)
 }
+
+func TestCacheEntries_Relocated(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv(CacheHomeEnvVar, home)
+
+	if CacheDir() != home {
+		t.Fatalf("unexpected cache dir: want %s, got %s", home, CacheDir())
+	}
+
+	for _, d := range []string{"ns1/myrelease/https_example_com_charts", "charts", "other-tool"} {
+		if err := os.MkdirAll(filepath.Join(home, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(home, "somefile"), []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"ns1/myrelease/https_example_com_charts", "charts"} {
+		if err := MarkCacheEntry(home, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := CacheEntries()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if d := cmp.Diff([]string{"charts", "ns1"}, got); d != "" {
+		t.Errorf("unexpected cache entries: want (-), got (+):\n%s", d)
+	}
+}
+
+func TestIsHTTPFile(t *testing.T) {
+	testcases := map[string]bool{
+		"https://config.example.com/prod.yaml":                                true,
+		"http://config.example.com/envs/prod.yaml.gotmpl?ref=v1":              true,
+		"https://config.example.com":                                          false,
+		"https://config.example.com/":                                         false,
+		"git::https://github.com/cloudposse/helmfiles.git@releases/kiam.yaml": false,
+		"https://github.com/cloudposse/helmfiles.git@releases/kiam.yaml":      false,
+		"s3::https://s3.amazonaws.com/bucket/dir@values.yaml":                 false,
+		"environments/prod.yaml":                                              false,
+	}
+
+	for input, want := range testcases {
+		if got := IsHTTPFile(input); got != want {
+			t.Errorf("unexpected result for %s: want %v, got %v", input, want, got)
+		}
+	}
+}
+
+func TestRemote_FetchHTTPFile(t *testing.T) {
+	requests := map[string]int{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+
+		if r.Header.Get("Authorization") != "Bearer mytoken" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/envs/prod.yaml":
+			fmt.Fprint(w, "foo: bar")
+		case "/envs/broken.yaml":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	home := t.TempDir()
+
+	remote := &Remote{
+		Logger: helmexec.NewLogger(os.Stderr, "debug"),
+		Home:   home,
+	}
+
+	headers := map[string]string{"Authorization": "Bearer mytoken"}
+
+	for i := 0; i < 2; i++ {
+		file, err := remote.FetchHTTPFile(srv.URL+"/envs/prod.yaml", headers)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if filepath.Base(file) != "prod.yaml" || filepath.Dir(filepath.Dir(file)) != home {
+			t.Errorf("unexpected file: %s", file)
+		}
+
+		content, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if string(content) != "foo: bar" {
+			t.Errorf("unexpected content: %s", content)
+		}
+	}
+
+	if requests["/envs/prod.yaml"] != 1 {
+		t.Errorf("unexpected number of requests: want 1, got %d", requests["/envs/prod.yaml"])
+	}
+
+	if _, err := remote.FetchHTTPFile(srv.URL+"/envs/missing.yaml", headers); err == nil {
+		t.Errorf("expected error not returned")
+	} else if _, ok := err.(NotFoundError); !ok {
+		t.Errorf("unexpected error: want NotFoundError, got %v", err)
+	}
+
+	if _, err := remote.FetchHTTPFile(srv.URL+"/envs/broken.yaml", headers); err == nil {
+		t.Errorf("expected error not returned")
+	} else if _, ok := err.(NotFoundError); ok {
+		t.Errorf("unexpected NotFoundError: %v", err)
+	}
+}
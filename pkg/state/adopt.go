@@ -0,0 +1,285 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	helmReleaseNameAnnotation      = "meta.helm.sh/release-name"
+	helmReleaseNamespaceAnnotation = "meta.helm.sh/release-namespace"
+)
+
+// adoptedResource is a Kubernetes resource rendered from the chart of a release
+type adoptedResource struct {
+	APIVersion string
+	Kind       string
+	Name       string
+	Namespace  string
+}
+
+// adoptedRef is an existing resource to be adopted, with the kubectl flags to select it
+type adoptedRef struct {
+	ref       string
+	namespace string
+	args      []string
+}
+
+// ref returns the reference to the resource accepted by kubectl, like `deployment.apps/myapp`
+func (r adoptedResource) ref() string {
+	kind := strings.ToLower(r.Kind)
+
+	if i := strings.Index(r.APIVersion, "/"); i >= 0 {
+		kind = kind + "." + r.APIVersion[:i]
+	}
+
+	return kind + "/" + r.Name
+}
+
+// adoptExistingResourcesWithLock runs adoptExistingResources with mu locked when the release has `adoptAll: true`,
+// and does nothing otherwise
+func (st *HelmState) adoptExistingResourcesWithLock(mu *sync.Mutex, helm helmexec.Interface, release *ReleaseSpec, workerIndex int) error {
+	if release.AdoptAll == nil || !*release.AdoptAll {
+		return nil
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	return st.adoptExistingResources(helm, release, workerIndex)
+}
+
+// adoptExistingResources labels and annotates the resources of the release that already exist in the cluster
+// with the helm ownership metadata, so that `helm upgrade --install` adopts them instead of failing with
+// `... exists and cannot be imported into the current release`.
+//
+// It does nothing when the release is already installed, as the resources owned by the release are already annotated.
+// It fails without changing any resource when any of them is owned by another release, as adopting it would break the other release.
+func (st *HelmState) adoptExistingResources(helm helmexec.Interface, release *ReleaseSpec, workerIndex int) error {
+	if !helm.IsHelm3() {
+		return errors.New("releases[].adoptAll requires Helm 3")
+	}
+
+	if release.Namespace == "" {
+		return errors.New("releases[].adoptAll requires releases[].namespace to be set")
+	}
+
+	installed, err := st.isReleaseInstalled(st.createHelmContext(release, workerIndex), helm, *release)
+	if err != nil {
+		return err
+	}
+
+	if installed {
+		return nil
+	}
+
+	resources, err := st.renderReleaseResources(helm, release, workerIndex)
+	if err != nil {
+		return fmt.Errorf("rendering resources to adopt: %v", err)
+	}
+
+	// The ownership of all the resources is checked before adopting any of them
+	var adopted []adoptedRef
+
+	for _, r := range resources {
+		ns := r.Namespace
+		if ns == "" {
+			ns = release.Namespace
+		}
+
+		args := []string{"--namespace", ns}
+		if kubeContext := st.kubeContext(release); kubeContext != "" {
+			args = append(args, "--context", kubeContext)
+		}
+
+		out, err := st.kubectl(append([]string{"get", r.ref(), "--ignore-not-found", "--output", "json"}, args...)...)
+		if err != nil {
+			return err
+		}
+
+		if strings.TrimSpace(string(out)) == "" {
+			continue
+		}
+
+		var existing struct {
+			Metadata struct {
+				Annotations map[string]string `json:"annotations"`
+			} `json:"metadata"`
+		}
+
+		if err := json.Unmarshal(out, &existing); err != nil {
+			return fmt.Errorf("parsing %s in namespace %s: %v", r.ref(), ns, err)
+		}
+
+		owner := existing.Metadata.Annotations[helmReleaseNameAnnotation]
+		ownerNamespace := existing.Metadata.Annotations[helmReleaseNamespaceAnnotation]
+
+		if owner != "" && (owner != release.Name || ownerNamespace != release.Namespace) {
+			return fmt.Errorf("%s in namespace %s is owned by release %q in namespace %q, and can't be adopted into release %q in namespace %q", r.ref(), ns, owner, ownerNamespace, release.Name, release.Namespace)
+		}
+
+		adopted = append(adopted, adoptedRef{ref: r.ref(), args: args, namespace: ns})
+	}
+
+	for _, r := range adopted {
+		st.logger.Infof("Adopting %s in namespace %s into release %q", r.ref, r.namespace, release.Name)
+
+		if _, err := st.kubectl(append([]string{"label", "--overwrite", r.ref, "app.kubernetes.io/managed-by=Helm"}, r.args...)...); err != nil {
+			return err
+		}
+
+		annotations := []string{
+			helmReleaseNameAnnotation + "=" + release.Name,
+			helmReleaseNamespaceAnnotation + "=" + release.Namespace,
+		}
+
+		if _, err := st.kubectl(append(append([]string{"annotate", "--overwrite", r.ref}, annotations...), r.args...)...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// renderReleaseResources runs `helm template` on the release and returns the resources rendered from the chart, excluding hooks.
+func (st *HelmState) renderReleaseResources(helm helmexec.Interface, release *ReleaseSpec, workerIndex int) ([]adoptedResource, error) {
+	tempDir := st.tempDir
+	if tempDir == nil {
+		tempDir = ioutil.TempDir
+	}
+
+	dir, err := tempDir("", "helmfile-adopt-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	flags, files, err := st.flagsForTemplate(helm, release, workerIndex)
+	defer st.removeFiles(files)
+	if err != nil {
+		return nil, err
+	}
+
+	flags = append(flags, "--output-dir", dir)
+
+	if err := helm.TemplateRelease(release.Name, normalizeChart(st.basePath, release.Chart), flags...); err != nil {
+		return nil, err
+	}
+
+	return readResources(dir)
+}
+
+// readResources reads all the resources from the manifests written by `helm template --output-dir` under dir
+func readResources(dir string) ([]adoptedResource, error) {
+	var paths []string
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() && (filepath.Ext(path) == ".yaml" || filepath.Ext(path) == ".yml") {
+			paths = append(paths, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(paths)
+
+	var resources []adoptedResource
+
+	for _, path := range paths {
+		bs, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		decoder := yaml.NewDecoder(bytes.NewReader(bs))
+
+		for {
+			var doc struct {
+				APIVersion string `yaml:"apiVersion"`
+				Kind       string `yaml:"kind"`
+				Metadata   struct {
+					Name        string            `yaml:"name"`
+					Namespace   string            `yaml:"namespace"`
+					Annotations map[string]string `yaml:"annotations"`
+				} `yaml:"metadata"`
+			}
+
+			if err := decoder.Decode(&doc); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("parsing %s: %v", path, err)
+			}
+
+			if doc.Kind == "" || doc.Metadata.Name == "" {
+				continue
+			}
+
+			// Hooks are never owned by the release
+			if _, ok := doc.Metadata.Annotations["helm.sh/hook"]; ok {
+				continue
+			}
+
+			resources = append(resources, adoptedResource{
+				APIVersion: doc.APIVersion,
+				Kind:       doc.Kind,
+				Name:       doc.Metadata.Name,
+				Namespace:  doc.Metadata.Namespace,
+			})
+		}
+	}
+
+	return resources, nil
+}
+
+// kubeContext returns the kube context the release is deployed to, or an empty string for the current context
+func (st *HelmState) kubeContext(release *ReleaseSpec) string {
+	if release.KubeContext != "" {
+		return release.KubeContext
+	} else if st.Environments[st.Env.Name].KubeContext != "" {
+		return st.Environments[st.Env.Name].KubeContext
+	}
+	return st.HelmDefaults.KubeContext
+}
+
+func (st *HelmState) kubectl(args ...string) ([]byte, error) {
+	return st.execute("kubectl", args...)
+}
+
+// execute runs the command other than helm with st.runner
+func (st *HelmState) execute(cmd string, args ...string) ([]byte, error) {
+	runner := st.runner
+	if runner == nil {
+		runner = helmexec.ShellRunner{
+			Dir:    st.basePath,
+			Logger: st.logger,
+		}
+	}
+
+	st.logger.Debugf("%s %s", cmd, strings.Join(args, " "))
+
+	out, err := runner.Execute(cmd, args, map[string]string{})
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %v", cmd, strings.Join(args, " "), err)
+	}
+
+	return out, nil
+}
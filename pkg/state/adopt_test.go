@@ -0,0 +1,201 @@
+package state
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/roboll/helmfile/pkg/exectest"
+)
+
+const adoptTestManifests = `---
+# Source: myapp/templates/configmap.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: myapp-config
+---
+# Source: myapp/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: myapp
+  namespace: other
+---
+# Source: myapp/templates/test.yaml
+apiVersion: v1
+kind: Pod
+metadata:
+  name: myapp-test
+  annotations:
+    helm.sh/hook: test
+`
+
+type adoptTestHelm struct {
+	*exectest.Helm
+}
+
+func (helm *adoptTestHelm) TemplateRelease(name, chart string, flags ...string) error {
+	for i, f := range flags {
+		if f == "--output-dir" {
+			dir := filepath.Join(flags[i+1], "myapp", "templates")
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+			return os.WriteFile(filepath.Join(dir, "all.yaml"), []byte(adoptTestManifests), 0644)
+		}
+	}
+	return nil
+}
+
+type adoptTestRunner struct {
+	// existing maps the refs of the existing resources to the names of the releases owning them
+	existing map[string]string
+	commands []string
+}
+
+func (r *adoptTestRunner) Execute(cmd string, args []string, env map[string]string) ([]byte, error) {
+	r.commands = append(r.commands, cmd+" "+strings.Join(args, " "))
+	if owner, ok := r.existing[args[1]]; ok && args[0] == "get" {
+		if owner == "" {
+			return []byte(`{"metadata":{"annotations":{}}}`), nil
+		}
+		return []byte(`{"metadata":{"annotations":{"meta.helm.sh/release-name":"` + owner + `","meta.helm.sh/release-namespace":"myns"}}}`), nil
+	}
+	return nil, nil
+}
+
+func (r *adoptTestRunner) ExecuteStdIn(cmd string, args []string, env map[string]string, stdin io.Reader) ([]byte, error) {
+	return r.Execute(cmd, args, env)
+}
+
+func TestReadResources(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(dir, "all.yaml"), []byte(adoptTestManifests), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "NOTES.txt"), []byte("kind: Ignored"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readResources(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []adoptedResource{
+		{APIVersion: "v1", Kind: "ConfigMap", Name: "myapp-config"},
+		{APIVersion: "apps/v1", Kind: "Deployment", Name: "myapp", Namespace: "other"},
+	}
+
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("unexpected resources: want (-), got (+):\n%s", d)
+	}
+
+	if got[1].ref() != "deployment.apps/myapp" {
+		t.Errorf("unexpected ref: %s", got[1].ref())
+	}
+}
+
+func TestHelmState_SyncReleases_AdoptAll(t *testing.T) {
+	testcases := []struct {
+		name         string
+		installed    bool
+		owner        string
+		wantErr      string
+		wantCommands []string
+	}{
+		{
+			name: "not installed",
+			wantCommands: []string{
+				"kubectl get configmap/myapp-config --ignore-not-found --output json --namespace myns --context myctx",
+				"kubectl get deployment.apps/myapp --ignore-not-found --output json --namespace other --context myctx",
+				"kubectl label --overwrite deployment.apps/myapp app.kubernetes.io/managed-by=Helm --namespace other --context myctx",
+				"kubectl annotate --overwrite deployment.apps/myapp meta.helm.sh/release-name=myapp meta.helm.sh/release-namespace=myns --namespace other --context myctx",
+			},
+		},
+		{
+			name:  "owned by the release",
+			owner: "myapp",
+			wantCommands: []string{
+				"kubectl get configmap/myapp-config --ignore-not-found --output json --namespace myns --context myctx",
+				"kubectl get deployment.apps/myapp --ignore-not-found --output json --namespace other --context myctx",
+				"kubectl label --overwrite deployment.apps/myapp app.kubernetes.io/managed-by=Helm --namespace other --context myctx",
+				"kubectl annotate --overwrite deployment.apps/myapp meta.helm.sh/release-name=myapp meta.helm.sh/release-namespace=myns --namespace other --context myctx",
+			},
+		},
+		{
+			name:    "owned by another release",
+			owner:   "otherapp",
+			wantErr: `deployment.apps/myapp in namespace other is owned by release "otherapp" in namespace "myns", and can't be adopted into release "myapp" in namespace "myns"`,
+			wantCommands: []string{
+				"kubectl get configmap/myapp-config --ignore-not-found --output json --namespace myns --context myctx",
+				"kubectl get deployment.apps/myapp --ignore-not-found --output json --namespace other --context myctx",
+			},
+		},
+		{
+			name:      "already installed",
+			installed: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			runner := &adoptTestRunner{existing: map[string]string{"deployment.apps/myapp": tc.owner}}
+
+			state := &HelmState{
+				ReleaseSetSpec: ReleaseSetSpec{
+					Releases: []ReleaseSpec{
+						{
+							Name:        "myapp",
+							Chart:       "stable/myapp",
+							Namespace:   "myns",
+							KubeContext: "myctx",
+							AdoptAll:    boolValue(true),
+						},
+					},
+				},
+				logger:         logger,
+				valsRuntime:    valsRuntime,
+				runner:         runner,
+				RenderedValues: map[string]interface{}{},
+			}
+
+			helm := &adoptTestHelm{Helm: &exectest.Helm{Helm3: true, Lists: map[exectest.ListKey]string{}}}
+			if tc.installed {
+				helm.Lists[exectest.ListKey{Filter: "^myapp$", Flags: "--kube-contextmyctx--namespacemyns--uninstalling--deployed--failed--pending"}] = "myapp"
+			}
+
+			errs := state.SyncReleases(&AffectedReleases{}, helm, []string{}, 1)
+
+			if d := cmp.Diff(tc.wantCommands, runner.commands); d != "" {
+				t.Errorf("unexpected kubectl commands: want (-), got (+):\n%s", d)
+			}
+
+			if tc.wantErr != "" {
+				if len(errs) != 1 || !strings.Contains(errs[0].Error(), tc.wantErr) {
+					t.Fatalf("unexpected errors: want %q, got %v", tc.wantErr, errs)
+				}
+
+				if len(helm.Releases) != 0 {
+					t.Errorf("unexpected releases: %v", helm.Releases)
+				}
+
+				return
+			}
+
+			if len(errs) > 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+
+			if len(helm.Releases) != 1 || helm.Releases[0].Name != "myapp" {
+				t.Errorf("unexpected releases: %v", helm.Releases)
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+package state
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+const digestPrefix = "sha256:"
+
+// ChartDigest is the sha256 digest of the archive of a chart version
+type ChartDigest struct {
+	Chart   string `yaml:"chart"`
+	Version string `yaml:"version"`
+	Digest  string `yaml:"digest"`
+}
+
+// ChartDigests records the digests of the charts fetched by `helmfile fetch`,
+// and verifies them against the expected digests, if any.
+//
+// Its YAML representation is the manifest given to `helmfile fetch --verify-digest`.
+type ChartDigests struct {
+	Digests []ChartDigest `yaml:"digests"`
+
+	expected map[string]string
+	mu       sync.Mutex
+}
+
+// NewChartDigests returns ChartDigests that verifies fetched charts against the expected digests.
+func NewChartDigests(expected []ChartDigest) *ChartDigests {
+	d := &ChartDigests{expected: map[string]string{}}
+
+	for _, e := range expected {
+		digest := e.Digest
+		if !strings.HasPrefix(digest, digestPrefix) {
+			digest = digestPrefix + digest
+		}
+		d.expected[chartDigestKey(e.Chart, e.Version)] = digest
+	}
+
+	return d
+}
+
+// ReadChartDigests reads the manifest of the expected chart digests from the file.
+func ReadChartDigests(path string) (*ChartDigests, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest ChartDigests
+	if err := yaml.UnmarshalStrict(bs, &manifest); err != nil {
+		return nil, fmt.Errorf("unable to parse chart digests in %s: %v", path, err)
+	}
+
+	return NewChartDigests(manifest.Digests), nil
+}
+
+// Verifying returns true when the fetched charts are verified against the expected digests.
+func (d *ChartDigests) Verifying() bool {
+	return d.expected != nil
+}
+
+// YAML returns the recorded digests in the format of the manifest.
+func (d *ChartDigests) YAML() (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	sort.Slice(d.Digests, func(i, j int) bool {
+		return chartDigestKey(d.Digests[i].Chart, d.Digests[i].Version) < chartDigestKey(d.Digests[j].Chart, d.Digests[j].Version)
+	})
+
+	bs, err := yaml.Marshal(d)
+	if err != nil {
+		return "", err
+	}
+
+	return string(bs), nil
+}
+
+func (d *ChartDigests) add(chart, version, digest string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := chartDigestKey(chart, version)
+
+	if d.expected != nil {
+		expected, ok := d.expected[key]
+		if !ok {
+			return fmt.Errorf("chart %q version %q: no digest is recorded in the manifest", chart, version)
+		}
+		if expected != digest {
+			return fmt.Errorf("chart %q version %q: digest mismatch: expected %s, got %s", chart, version, expected, digest)
+		}
+	}
+
+	for _, r := range d.Digests {
+		if chartDigestKey(r.Chart, r.Version) == key {
+			return nil
+		}
+	}
+
+	d.Digests = append(d.Digests, ChartDigest{Chart: chart, Version: version, Digest: digest})
+
+	return nil
+}
+
+func chartDigestKey(chart, version string) string {
+	return chart + "@" + version
+}
+
+// fetchChartArchive fetches the chart of the release as an archive, and records its digest.
+// It returns the path to the archive, or the path to the expanded chart when untar is true.
+// When prov is true, the provenance file of the chart is fetched next to the archive.
+func (st *HelmState) fetchChartArchive(helm helmexec.Interface, release *ReleaseSpec, dir string, digests *ChartDigests, untar bool, prov bool) (string, error) {
+	chartPath := fetchedChartPath(release, dir)
+	archivePattern := filepath.Join(chartPath, "*.tgz")
+
+	// Remove the archive and its provenance file fetched by a previous run, possibly of another version
+	stale, err := st.glob(archivePattern + "*")
+	if err != nil {
+		return "", err
+	}
+	for _, f := range stale {
+		if err := st.removeFile(f); err != nil {
+			return "", err
+		}
+	}
+
+	fetchFlags := st.chartVersionFlags(release)
+	fetchFlags = append(fetchFlags, "--destination", chartPath)
+	if prov {
+		fetchFlags = append(fetchFlags, "--prov")
+	}
+	if err := helm.Fetch(release.Chart, fetchFlags...); err != nil {
+		return "", err
+	}
+
+	archives, err := st.glob(archivePattern)
+	if err != nil {
+		return "", err
+	}
+
+	if len(archives) != 1 {
+		return "", fmt.Errorf("release %q: expected one chart archive in %s, but found %d", release.Name, chartPath, len(archives))
+	}
+
+	archive := archives[0]
+
+	digest, err := sha256File(archive)
+	if err != nil {
+		return "", err
+	}
+
+	// helm names the archive `<chart name>-<version>.tgz`
+	version := strings.TrimSuffix(filepath.Base(archive), ".tgz")
+	version = strings.TrimPrefix(version, path.Base(release.Chart)+"-")
+
+	if err := digests.add(release.Chart, version, digest); err != nil {
+		// Don't leave the unverified archive to be consumed later
+		_ = st.removeFile(archive)
+		return "", fmt.Errorf("release %q: %w", release.Name, err)
+	}
+
+	if !untar {
+		return archive, nil
+	}
+
+	if err := untarChart(archive, chartPath); err != nil {
+		return "", fmt.Errorf("release %q: expanding %s: %w", release.Name, archive, err)
+	}
+
+	if err := st.removeFile(archive); err != nil {
+		return "", err
+	}
+
+	// Set chartPath to be the path containing Chart.yaml, if found
+	fullChartPath, err := findChartDirectory(chartPath)
+	if err == nil {
+		chartPath = filepath.Dir(fullChartPath)
+	}
+
+	return chartPath, nil
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("computing the digest of %s: %w", path, err)
+	}
+
+	return digestPrefix + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// untarChart expands the chart archive into dir, in the same way as `helm fetch --untar`
+func untarChart(archive, dir string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(filepath.FromSlash(h.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("illegal file path in the archive: %s", h.Name)
+		}
+
+		dest := filepath.Join(dir, name)
+
+		switch h.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				return err
+			}
+
+			out, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+
+			_, err = io.Copy(out, tr)
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package state
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/roboll/helmfile/pkg/exectest"
+)
+
+// archiveTestHelm writes the chart archive to the destination of `helm fetch`
+type archiveTestHelm struct {
+	exectest.Helm
+
+	archive []byte
+}
+
+func (helm *archiveTestHelm) Fetch(chart string, flags ...string) error {
+	for i, f := range flags {
+		if f == "--destination" {
+			dir := flags[i+1]
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+			return os.WriteFile(filepath.Join(dir, "mychart-1.2.3.tgz"), helm.archive, 0644)
+		}
+	}
+	return fmt.Errorf("unexpected flags: %v", flags)
+}
+
+func newTestChartArchive(t *testing.T) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+
+	files := []struct{ name, content string }{
+		{"mychart/Chart.yaml", "apiVersion: v2\nname: mychart\nversion: 1.2.3\n"},
+		{"mychart/templates/cm.yaml", "kind: ConfigMap\n"},
+	}
+
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestHelmState_PrepareCharts_Digests(t *testing.T) {
+	archive := newTestChartArchive(t)
+
+	sum := sha256.Sum256(archive)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+
+	testcases := []struct {
+		name     string
+		expected []ChartDigest
+		untar    bool
+		wantErr  string
+		wantPath string
+	}{
+		{
+			name:     "record",
+			wantPath: "myapp/stable/mychart/~1.2/mychart-1.2.3.tgz",
+		},
+		{
+			name:     "matching digest",
+			expected: []ChartDigest{{Chart: "stable/mychart", Version: "1.2.3", Digest: digest}},
+			untar:    true,
+			wantPath: "myapp/stable/mychart/~1.2/mychart",
+		},
+		{
+			name:     "matching digest without prefix",
+			expected: []ChartDigest{{Chart: "stable/mychart", Version: "1.2.3", Digest: hex.EncodeToString(sum[:])}},
+			wantPath: "myapp/stable/mychart/~1.2/mychart-1.2.3.tgz",
+		},
+		{
+			name:     "mismatching digest",
+			expected: []ChartDigest{{Chart: "stable/mychart", Version: "1.2.3", Digest: "sha256:0000"}},
+			untar:    true,
+			wantErr:  fmt.Sprintf(`release "myapp": chart "stable/mychart" version "1.2.3": digest mismatch: expected sha256:0000, got %s`, digest),
+		},
+		{
+			name:     "missing digest",
+			expected: []ChartDigest{{Chart: "stable/mychart", Version: "1.2.2", Digest: digest}},
+			wantErr:  `release "myapp": chart "stable/mychart" version "1.2.3": no digest is recorded in the manifest`,
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			state := &HelmState{
+				basePath: dir,
+				FilePath: filepath.Join(dir, "helmfile.yaml"),
+				ReleaseSetSpec: ReleaseSetSpec{
+					Repositories: []RepositorySpec{{Name: "stable", URL: "https://example.com/stable"}},
+					Releases: []ReleaseSpec{
+						{Name: "myapp", Chart: "stable/mychart", Version: "~1.2"},
+					},
+				},
+				logger:            logger,
+				removeFile:        os.Remove,
+				glob:              filepath.Glob,
+				directoryExistsAt: directoryExistsAt,
+				RenderedValues:    map[string]interface{}{},
+			}
+
+			digests := &ChartDigests{}
+			if tc.expected != nil {
+				digests = NewChartDigests(tc.expected)
+			}
+
+			charts, errs := state.PrepareCharts(&archiveTestHelm{Helm: exectest.Helm{Helm3: true}, archive: archive}, dir, 1, "pull", ChartPrepareOptions{
+				ForceDownload: true,
+				SkipDeps:      true,
+				SkipResolve:   true,
+				Digests:       digests,
+				Untar:         tc.untar,
+			})
+
+			if tc.wantErr != "" {
+				if len(errs) != 1 || errs[0].Error() != tc.wantErr {
+					t.Fatalf("unexpected errors: want %q, got %v", tc.wantErr, errs)
+				}
+
+				archives, err := filepath.Glob(filepath.Join(dir, "myapp", "stable", "mychart", "~1.2", "*"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(archives) > 0 {
+					t.Errorf("the unverified chart is left: %v", archives)
+				}
+				return
+			}
+
+			if len(errs) > 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+
+			want := filepath.Join(dir, tc.wantPath)
+			if got := charts[PrepareChartKey{Name: "myapp"}]; got != want {
+				t.Errorf("unexpected chart path: want %s, got %s", want, got)
+			}
+
+			if tc.untar {
+				if _, err := os.Stat(filepath.Join(want, "templates", "cm.yaml")); err != nil {
+					t.Errorf("the chart isn't expanded: %v", err)
+				}
+			}
+
+			out, err := digests.YAML()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			wantYAML := fmt.Sprintf("digests:\n- chart: stable/mychart\n  version: 1.2.3\n  digest: %s\n", digest)
+			if d := cmp.Diff(wantYAML, out); d != "" {
+				t.Errorf("unexpected digests: want (-), got (+):\n%s", d)
+			}
+		})
+	}
+}
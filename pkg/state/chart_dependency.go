@@ -212,6 +212,37 @@ func (st *HelmState) updateDependenciesInTempDir(shell helmexec.DependencyUpdate
 	return updateDependencies(st, shell, unresolved, filename, d)
 }
 
+// lockDependenciesInTempDir is like updateDependenciesInTempDir, but returns the resolved dependencies instead of
+// writing them to the lock file.
+func (st *HelmState) lockDependenciesInTempDir(shell helmexec.DependencyUpdater, tempDir func(string, string) (string, error)) (*ChartLockedRequirements, error) {
+	filename, unresolved, err := getUnresolvedDependenciess(st)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(unresolved.deps) == 0 {
+		return &ChartLockedRequirements{
+			Version:              version.Version,
+			ResolvedDependencies: []ResolvedChartDependency{},
+		}, nil
+	}
+
+	d, err := tempDir("", "")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create dir: %v", err)
+	}
+	defer os.RemoveAll(d)
+
+	depMan := NewChartDependencyManager(filename, st.logger)
+
+	lockedReqs, err := depMan.Lock(shell, d, unresolved)
+	if err != nil {
+		return nil, fmt.Errorf("unable to lock %d deps: %v", len(unresolved.deps), err)
+	}
+
+	return lockedReqs, nil
+}
+
 func getUnresolvedDependenciess(st *HelmState) (string, *UnresolvedDependencies, error) {
 	repoToURL := map[string]string{}
 
@@ -284,13 +315,36 @@ func (m *chartDependencyManager) lockFileName() string {
 }
 
 func (m *chartDependencyManager) Update(shell helmexec.DependencyUpdater, wd string, unresolved *UnresolvedDependencies) (*ResolvedDependencies, error) {
+	lockedReqs, err := m.Lock(shell, wd, unresolved)
+	if err != nil {
+		return nil, err
+	}
+
+	updatedLockFileContent, err := yaml.Marshal(lockedReqs)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Commit the lock file if and only if everything looks ok
+	if err := m.writeBytes(m.lockFileName(), updatedLockFileContent); err != nil {
+		return nil, err
+	}
+
+	resolved, _, err := m.Resolve(unresolved)
+	return resolved, err
+}
+
+// Lock runs `helm dependency update` on a temporary local chart within wd and returns the resolved dependencies,
+// without writing the lock file.
+func (m *chartDependencyManager) Lock(shell helmexec.DependencyUpdater, wd string, unresolved *UnresolvedDependencies) (*ChartLockedRequirements, error) {
 	if shell.IsHelm3() {
-		return m.updateHelm3(shell, wd, unresolved)
+		return m.lockHelm3(shell, wd, unresolved)
 	}
-	return m.updateHelm2(shell, wd, unresolved)
+	return m.lockHelm2(shell, wd, unresolved)
 }
 
-func (m *chartDependencyManager) updateHelm3(shell helmexec.DependencyUpdater, wd string, unresolved *UnresolvedDependencies) (*ResolvedDependencies, error) {
+func (m *chartDependencyManager) lockHelm3(shell helmexec.DependencyUpdater, wd string, unresolved *UnresolvedDependencies) (*ChartLockedRequirements, error) {
 	// Generate `Chart.yaml` of the temporary local chart
 	chartMetaContent := fmt.Sprintf("name: %s\nversion: 1.0.0\napiVersion: v2\n", m.Name)
 
@@ -303,10 +357,10 @@ func (m *chartDependencyManager) updateHelm3(shell helmexec.DependencyUpdater, w
 		return nil, err
 	}
 
-	return m.doUpdate("Chart.lock", unresolved, shell, wd)
+	return m.doLock("Chart.lock", shell, wd)
 }
 
-func (m *chartDependencyManager) updateHelm2(shell helmexec.DependencyUpdater, wd string, unresolved *UnresolvedDependencies) (*ResolvedDependencies, error) {
+func (m *chartDependencyManager) lockHelm2(shell helmexec.DependencyUpdater, wd string, unresolved *UnresolvedDependencies) (*ChartLockedRequirements, error) {
 	// Generate `Chart.yaml` of the temporary local chart
 	if err := m.writeBytes(filepath.Join(wd, "Chart.yaml"), []byte(fmt.Sprintf("name: %s\nversion: 1.0.0\n", m.Name))); err != nil {
 		return nil, err
@@ -321,11 +375,10 @@ func (m *chartDependencyManager) updateHelm2(shell helmexec.DependencyUpdater, w
 		return nil, err
 	}
 
-	return m.doUpdate("requirements.lock", unresolved, shell, wd)
+	return m.doLock("requirements.lock", shell, wd)
 }
 
-func (m *chartDependencyManager) doUpdate(chartLockFile string, unresolved *UnresolvedDependencies, shell helmexec.DependencyUpdater, wd string) (*ResolvedDependencies, error) {
-
+func (m *chartDependencyManager) doLock(chartLockFile string, shell helmexec.DependencyUpdater, wd string) (*ChartLockedRequirements, error) {
 	// Generate `requirements.lock` of the temporary local chart by coping `<basename>.lock`
 	lockFile := m.lockFileName()
 
@@ -380,19 +433,7 @@ func (m *chartDependencyManager) doUpdate(chartLockFile string, unresolved *Unre
 
 	lockedReqs.Version = version.Version
 
-	updatedLockFileContent, err = yaml.Marshal(lockedReqs)
-
-	if err != nil {
-		return nil, err
-	}
-
-	// Commit the lock file if and only if everything looks ok
-	if err := m.writeBytes(lockFile, updatedLockFileContent); err != nil {
-		return nil, err
-	}
-
-	resolved, _, err := m.Resolve(unresolved)
-	return resolved, err
+	return lockedReqs, nil
 }
 
 func (m *chartDependencyManager) Resolve(unresolved *UnresolvedDependencies) (*ResolvedDependencies, bool, error) {
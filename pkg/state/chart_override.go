@@ -0,0 +1,42 @@
+package state
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ChartOverride replaces the chart of the releases whose chart matches Pattern with Path,
+// so that unreleased charts can be tested without editing helmfile.yaml.
+type ChartOverride struct {
+	// Pattern is the chart reference like `myrepo/mychart`, which may contain glob patterns like `myrepo/*`
+	Pattern string
+	// Path is the local chart directory to use instead
+	Path string
+}
+
+// ParseChartOverride parses the value of `--chart-override` in the form of `PATTERN=PATH`
+func ParseChartOverride(s string) (*ChartOverride, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+		return nil, fmt.Errorf("invalid chart override %q: it must be in the form of CHART=PATH, like myrepo/mychart=../charts/mychart", s)
+	}
+
+	if _, err := path.Match(kv[0], ""); err != nil {
+		return nil, fmt.Errorf("invalid chart override %q: %v", s, err)
+	}
+
+	return &ChartOverride{Pattern: kv[0], Path: kv[1]}, nil
+}
+
+// overrideChart returns the path of the first chart override that matches the chart of the release,
+// and the chart of the release as is when none matches.
+func (st *HelmState) overrideChart(release *ReleaseSpec) string {
+	for _, o := range st.ChartOverrides {
+		if matched, _ := path.Match(o.Pattern, release.Chart); matched {
+			return o.Path
+		}
+	}
+
+	return release.Chart
+}
@@ -0,0 +1,119 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/roboll/helmfile/pkg/exectest"
+)
+
+func TestPrepareCharts_ChartOverrides(t *testing.T) {
+	dir := t.TempDir()
+
+	chart := filepath.Join(dir, "charts", "mychart")
+	if err := os.MkdirAll(chart, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(chart, "Chart.yaml"), []byte("apiVersion: v2\nname: mychart\nversion: 0.1.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	state := &HelmState{
+		basePath: dir,
+		FilePath: filepath.Join(dir, "helmfile.yaml"),
+		ReleaseSetSpec: ReleaseSetSpec{
+			Releases: []ReleaseSpec{
+				{
+					Name:  "foo",
+					Chart: "myrepo/mychart",
+				},
+				{
+					Name:  "bar",
+					Chart: "stable/other",
+				},
+			},
+			ChartOverrides: []ChartOverride{
+				{Pattern: "myrepo/*", Path: chart},
+			},
+		},
+		logger:      logger,
+		valsRuntime: valsRuntime,
+		readFile:    os.ReadFile,
+		removeFile:  os.Remove,
+		glob:        filepath.Glob,
+		fileExists: func(f string) (bool, error) {
+			_, err := os.Stat(f)
+			return err == nil, nil
+		},
+		directoryExistsAt: directoryExistsAt,
+		RenderedValues:    map[string]interface{}{},
+	}
+
+	charts, errs := state.PrepareCharts(&exectest.Helm{Helm3: true}, dir, 1, "sync", ChartPrepareOptions{
+		SkipRepos: true,
+		SkipDeps:  true,
+	})
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	want := map[PrepareChartKey]string{
+		{Name: "foo"}: chart,
+		{Name: "bar"}: "stable/other",
+	}
+
+	if d := cmp.Diff(want, charts); d != "" {
+		t.Errorf("unexpected charts: want (-), got (+):\n%s", d)
+	}
+
+	if state.Releases[0].Chart != "myrepo/mychart" {
+		t.Errorf("the chart of the release should not be modified: got %q", state.Releases[0].Chart)
+	}
+}
+
+func TestParseChartOverride(t *testing.T) {
+	testcases := []struct {
+		input   string
+		want    *ChartOverride
+		wantErr string
+	}{
+		{
+			input: "myrepo/mychart=../charts/mychart",
+			want:  &ChartOverride{Pattern: "myrepo/mychart", Path: "../charts/mychart"},
+		},
+		{
+			input: "myrepo/*=charts/a=b",
+			want:  &ChartOverride{Pattern: "myrepo/*", Path: "charts/a=b"},
+		},
+		{
+			input:   "myrepo/mychart",
+			wantErr: `invalid chart override "myrepo/mychart": it must be in the form of CHART=PATH, like myrepo/mychart=../charts/mychart`,
+		},
+		{
+			input:   "myrepo/[=../charts/mychart",
+			wantErr: `invalid chart override "myrepo/[=../charts/mychart": syntax error in pattern`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.input, func(t *testing.T) {
+			got, err := ParseChartOverride(tc.input)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("unexpected error: want %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("unexpected result: want (-), got (+):\n%s", d)
+			}
+		})
+	}
+}
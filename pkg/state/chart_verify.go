@@ -0,0 +1,71 @@
+package state
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+const (
+	// ChartVerified is the result of a chart whose archive is verified against its provenance file
+	ChartVerified = "verified"
+	// ChartVerificationFailed is the result of a chart that failed `helm verify`
+	ChartVerificationFailed = "failed"
+	// ChartVerificationSkipped is the result of a chart that has no archive to be verified, like a local chart
+	ChartVerificationSkipped = "skipped"
+)
+
+// ChartVerification is the result of verifying the chart of a release reported by `helmfile verify`
+type ChartVerification struct {
+	ID     string
+	Chart  string
+	Result string
+	Err    error
+}
+
+// VerifyCharts runs `helm verify` on the chart archive of each release, which is fetched along with its provenance file
+// by PrepareCharts with Provenance enabled, and returns the results in the order of the releases.
+// It doesn't stop at the first failure so that the results of all the charts are reported.
+func (st *HelmState) VerifyCharts(helm helmexec.Interface, keyring string) []ChartVerification {
+	var flags []string
+	if keyring != "" {
+		flags = append(flags, "--keyring", keyring)
+	}
+
+	var results []ChartVerification
+
+	for i := range st.Releases {
+		release := st.Releases[i]
+
+		if !release.Desired() {
+			continue
+		}
+
+		v := ChartVerification{
+			ID:    ReleaseToID(&release),
+			Chart: release.Chart,
+		}
+
+		if !strings.HasSuffix(release.Chart, ".tgz") {
+			st.logger.Infof("Skipping the verification of release %q: chart %q isn't a chart archive", release.Name, release.Chart)
+			v.Result = ChartVerificationSkipped
+			results = append(results, v)
+			continue
+		}
+
+		v.Chart = filepath.Base(release.Chart)
+
+		if err := helm.VerifyChart(release.Chart, flags...); err != nil {
+			v.Result = ChartVerificationFailed
+			v.Err = fmt.Errorf("release %q: verifying chart %s: %w", release.Name, v.Chart, err)
+		} else {
+			v.Result = ChartVerified
+		}
+
+		results = append(results, v)
+	}
+
+	return results
+}
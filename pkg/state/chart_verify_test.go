@@ -0,0 +1,144 @@
+package state
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/roboll/helmfile/pkg/exectest"
+)
+
+// verifyTestHelm fetches the chart archive along with its provenance file, and fails `helm verify` on the charts in badCharts
+type verifyTestHelm struct {
+	archiveTestHelm
+
+	badCharts []string
+	verified  []string
+}
+
+func (helm *verifyTestHelm) Fetch(chart string, flags ...string) error {
+	if err := helm.archiveTestHelm.Fetch(chart, flags...); err != nil {
+		return err
+	}
+
+	for i, f := range flags {
+		if f == "--prov" {
+			dir := flags[i-1]
+			return os.WriteFile(filepath.Join(dir, "mychart-1.2.3.tgz.prov"), []byte("prov"), 0644)
+		}
+	}
+
+	return errors.New("the provenance file isn't requested")
+}
+
+func (helm *verifyTestHelm) VerifyChart(chart string, flags ...string) error {
+	helm.verified = append(helm.verified, strings.Join(append([]string{chart}, flags...), " "))
+
+	for _, bad := range helm.badCharts {
+		if strings.Contains(chart, bad) {
+			return errors.New("openpgp: invalid signature: hash tag doesn't match")
+		}
+	}
+
+	if _, err := os.Stat(chart + ".prov"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func TestHelmState_VerifyCharts(t *testing.T) {
+	dir := t.TempDir()
+
+	localChart := filepath.Join(dir, "charts", "local")
+	if err := os.MkdirAll(localChart, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(localChart, "Chart.yaml"), []byte("apiVersion: v2\nname: local\nversion: 0.1.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	disabled := false
+
+	state := &HelmState{
+		basePath: dir,
+		FilePath: filepath.Join(dir, "helmfile.yaml"),
+		ReleaseSetSpec: ReleaseSetSpec{
+			Repositories: []RepositorySpec{{Name: "stable", URL: "https://example.com/stable"}},
+			Releases: []ReleaseSpec{
+				{Name: "signed", Chart: "stable/mychart", Version: "1.2.3"},
+				{Name: "tampered", Chart: "stable/mychart", Version: "1.2.3", Namespace: "ns"},
+				{Name: "local", Chart: "./charts/local"},
+				{Name: "uninstalled", Chart: "stable/mychart", Installed: &disabled},
+			},
+		},
+		logger:     logger,
+		removeFile: os.Remove,
+		fileExists: func(f string) (bool, error) {
+			return fileExistsAt(f), nil
+		},
+		glob:              filepath.Glob,
+		directoryExistsAt: directoryExistsAt,
+		RenderedValues:    map[string]interface{}{},
+	}
+
+	helm := &verifyTestHelm{
+		archiveTestHelm: archiveTestHelm{Helm: exectest.Helm{Helm3: true}, archive: newTestChartArchive(t)},
+		badCharts:       []string{"tampered"},
+	}
+
+	charts, errs := state.PrepareCharts(helm, dir, 1, "verify", ChartPrepareOptions{
+		ForceDownload: true,
+		SkipDeps:      true,
+		SkipResolve:   true,
+		Digests:       &ChartDigests{},
+		Provenance:    true,
+	})
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	for i := range state.Releases {
+		r := &state.Releases[i]
+		if chart := charts[PrepareChartKey{Name: r.Name, Namespace: r.Namespace}]; chart != "" {
+			r.Chart = chart
+		}
+	}
+
+	results := state.VerifyCharts(helm, "/path/to/pubring.gpg")
+
+	var got []string
+	for _, r := range results {
+		got = append(got, r.ID+" "+r.Chart+" "+r.Result)
+	}
+
+	want := []string{
+		"signed mychart-1.2.3.tgz verified",
+		"ns/tampered mychart-1.2.3.tgz failed",
+		"local " + localChart + " skipped",
+	}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("unexpected results: want (-), got (+):\n%s", d)
+	}
+
+	if results[0].Err != nil {
+		t.Errorf("unexpected error: %v", results[0].Err)
+	}
+
+	wantErr := `release "tampered": verifying chart mychart-1.2.3.tgz: openpgp: invalid signature: hash tag doesn't match`
+	if results[1].Err == nil || results[1].Err.Error() != wantErr {
+		t.Errorf("unexpected error: want %q, got %v", wantErr, results[1].Err)
+	}
+
+	wantVerified := []string{
+		filepath.Join(dir, "signed", "stable", "mychart", "1.2.3", "mychart-1.2.3.tgz") + " --keyring /path/to/pubring.gpg",
+		filepath.Join(dir, "ns", "tampered", "stable", "mychart", "1.2.3", "mychart-1.2.3.tgz") + " --keyring /path/to/pubring.gpg",
+	}
+	if d := cmp.Diff(wantVerified, helm.verified); d != "" {
+		t.Errorf("unexpected helm verify calls: want (-), got (+):\n%s", d)
+	}
+}
@@ -60,6 +60,9 @@ type StateCreator struct {
 	overrideHelmBinary string
 
 	remote *remote.Remote
+
+	// SecretValues, when set, collects the decrypted values of the environment secrets, so that they can be masked in the logs
+	SecretValues *SecretValues
 }
 
 func NewCreator(logger *zap.SugaredLogger, readFile func(string) ([]byte, error), fileExists func(string) (bool, error), abs func(string) (string, error), glob func(string) ([]string, error), directoryExistsAt func(string) bool, valsRuntime vals.Evaluator, getHelm func(*HelmState) helmexec.Interface, overrideHelmBinary string, remote *remote.Remote) *StateCreator {
@@ -140,6 +143,7 @@ func (c *StateCreator) Parse(content []byte, baseDir, file string) (*HelmState,
 	state.glob = c.glob
 	state.directoryExistsAt = c.directoryExistsAt
 	state.valsRuntime = c.valsRuntime
+	state.installedReleases = newReleaseInstalledCache()
 
 	return &state, nil
 }
@@ -153,7 +157,7 @@ func (c *StateCreator) LoadEnvValues(target *HelmState, env string, ctxEnv *envi
 		return nil, &StateLoadError{fmt.Sprintf("failed to read %s", state.FilePath), err}
 	}
 
-	newDefaults, err := state.loadValuesEntries(nil, state.DefaultValues, c.remote, ctxEnv)
+	newDefaults, err := state.loadValuesEntries(nil, state.DefaultValues, nil, c.remote, ctxEnv)
 	if err != nil {
 		return nil, err
 	}
@@ -164,6 +168,8 @@ func (c *StateCreator) LoadEnvValues(target *HelmState, env string, ctxEnv *envi
 
 	state.Env = *e
 
+	state.ApplyEnvironmentRepositories()
+
 	return &state, nil
 }
 
@@ -224,10 +230,21 @@ func (c *StateCreator) loadBases(envValues *environment.Environment, st *HelmSta
 
 func (c *StateCreator) loadEnvValues(st *HelmState, name string, failOnMissingEnv bool, ctxEnv *environment.Environment, readFile func(string) ([]byte, error), glob func(string) ([]string, error)) (*environment.Environment, error) {
 	envVals := map[string]interface{}{}
-	envSpec, ok := st.Environments[name]
-	if ok {
-		var err error
-		envVals, err = st.loadValuesEntries(envSpec.MissingFileHandler, envSpec.Values, c.remote, ctxEnv)
+	if _, ok := st.Environments[name]; ok {
+		envSpec, err := st.inheritEnvironment(name)
+		if err != nil {
+			return nil, err
+		}
+		// Store the inherited spec so that e.g. the inherited kubeContext is used for releases.
+		// It has no `inherits` anymore, so that the inheritance is resolved only once.
+		st.Environments[name] = envSpec
+
+		headers, err := c.resolveValuesHeaders(envSpec.ValuesHeaders)
+		if err != nil {
+			return nil, fmt.Errorf("environment %q: failed to resolve valuesHeaders: %v", name, err)
+		}
+
+		envVals, err = st.loadValuesEntries(envSpec.MissingFileHandler, envSpec.Values, headers, c.remote, ctxEnv)
 		if err != nil {
 			return nil, err
 		}
@@ -246,7 +263,7 @@ func (c *StateCreator) loadEnvValues(st *HelmState, name string, failOnMissingEn
 
 				envSecretFiles = append(envSecretFiles, resolved...)
 			}
-			if err = c.scatterGatherEnvSecretFiles(st, envSecretFiles, envVals, readFile); err != nil {
+			if err = c.scatterGatherEnvSecretFiles(st, name, envSpec.SecretsBackend, envSecretFiles, envVals, readFile); err != nil {
 				return nil, err
 			}
 		}
@@ -269,7 +286,7 @@ func (c *StateCreator) loadEnvValues(st *HelmState, name string, failOnMissingEn
 	return newEnv, nil
 }
 
-func (c *StateCreator) scatterGatherEnvSecretFiles(st *HelmState, envSecretFiles []string, envVals map[string]interface{}, readFile func(string) ([]byte, error)) error {
+func (c *StateCreator) scatterGatherEnvSecretFiles(st *HelmState, envName, secretsBackend string, envSecretFiles []string, envVals map[string]interface{}, readFile func(string) ([]byte, error)) error {
 	var errs []error
 
 	helm := c.getHelm(st)
@@ -301,35 +318,41 @@ func (c *StateCreator) scatterGatherEnvSecretFiles(st *HelmState, envSecretFiles
 		func(id int) {
 			for secret := range secrets {
 				release := &ReleaseSpec{}
-				flags := st.appendConnectionFlags([]string{}, helm, release)
-				decFile, err := helm.DecryptSecret(st.createHelmContext(release, 0), secret.path, flags...)
+				decrypted, _, err := st.decryptSecretsFileWithBackend(helm, release, secretsBackend, fmt.Sprintf("environment %q", envName), secret.path, 0)
 				if err != nil {
 					results <- secretResult{secret.id, nil, err, secret.path}
 					continue
 				}
-				defer func() {
-					if err := c.DeleteFile(decFile); err != nil {
-						c.logger.Warnf("removing decrypted file %s: %w", decFile, err)
+
+				vals, ok := decrypted.(map[string]interface{})
+				if !ok {
+					// helm-secrets decrypts the file into another file, which is removed with DeleteFile rather than the returned func
+					decFile := decrypted.(string)
+					defer func() {
+						if err := c.DeleteFile(decFile); err != nil {
+							c.logger.Warnf("removing decrypted file %s: %w", decFile, err)
+						}
+					}()
+					bytes, err := readFile(decFile)
+					if err != nil {
+						results <- secretResult{secret.id, nil, fmt.Errorf("failed to load environment secrets file \"%s\": %v", secret.path, err), secret.path}
+						continue
+					}
+					m := map[string]interface{}{}
+					if err := yaml.Unmarshal(bytes, &m); err != nil {
+						results <- secretResult{secret.id, nil, fmt.Errorf("failed to load environment secrets file \"%s\": %v", secret.path, err), secret.path}
+						continue
+					}
+					// All the nested map key should be string. Otherwise we get strange errors due to that
+					// mergo or reflect is unable to merge map[interface{}]interface{} with map[string]interface{} or vice versa.
+					// See https://github.com/roboll/helmfile/issues/677
+					vals, err = maputil.CastKeysToStrings(m)
+					if err != nil {
+						results <- secretResult{secret.id, nil, fmt.Errorf("failed to load environment secrets file \"%s\": %v", secret.path, err), secret.path}
+						continue
 					}
-				}()
-				bytes, err := readFile(decFile)
-				if err != nil {
-					results <- secretResult{secret.id, nil, fmt.Errorf("failed to load environment secrets file \"%s\": %v", secret.path, err), secret.path}
-					continue
-				}
-				m := map[string]interface{}{}
-				if err := yaml.Unmarshal(bytes, &m); err != nil {
-					results <- secretResult{secret.id, nil, fmt.Errorf("failed to load environment secrets file \"%s\": %v", secret.path, err), secret.path}
-					continue
-				}
-				// All the nested map key should be string. Otherwise we get strange errors due to that
-				// mergo or reflect is unable to merge map[interface{}]interface{} with map[string]interface{} or vice versa.
-				// See https://github.com/roboll/helmfile/issues/677
-				vals, err := maputil.CastKeysToStrings(m)
-				if err != nil {
-					results <- secretResult{secret.id, nil, fmt.Errorf("failed to load environment secrets file \"%s\": %v", secret.path, err), secret.path}
-					continue
 				}
+				c.SecretValues.Add(vals)
 				results <- secretResult{secret.id, vals, nil, secret.path}
 			}
 		},
@@ -363,11 +386,38 @@ func (c *StateCreator) scatterGatherEnvSecretFiles(st *HelmState, envSecretFiles
 	return nil
 }
 
-func (st *HelmState) loadValuesEntries(missingFileHandler *string, entries []interface{}, remote *remote.Remote, ctxEnv *environment.Environment) (map[string]interface{}, error) {
+// resolveValuesHeaders resolves vals refs in the headers sent when fetching environment values files over HTTP(S)
+func (c *StateCreator) resolveValuesHeaders(headers map[string]string) (map[string]string, error) {
+	if len(headers) == 0 {
+		return nil, nil
+	}
+
+	names := make([]string, 0, len(headers))
+	values := make([]string, 0, len(headers))
+	for k, v := range headers {
+		names = append(names, k)
+		values = append(values, v)
+	}
+
+	rendered, err := renderValsSecrets(c.valsRuntime, values...)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := map[string]string{}
+	for i, k := range names {
+		resolved[k] = rendered[i]
+	}
+
+	return resolved, nil
+}
+
+func (st *HelmState) loadValuesEntries(missingFileHandler *string, entries []interface{}, headers map[string]string, remote *remote.Remote, ctxEnv *environment.Environment) (map[string]interface{}, error) {
 	var envVals map[string]interface{}
 
 	valuesEntries := append([]interface{}{}, entries...)
 	ld := NewEnvironmentValuesLoader(st.storage(), st.readFile, st.logger, remote)
+	ld.headers = headers
 	var err error
 	envVals, err = ld.LoadEnvironmentValues(missingFileHandler, valuesEntries, ctxEnv)
 	if err != nil {
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/roboll/helmfile/pkg/environment"
@@ -181,6 +182,162 @@ releaseNamespace: mynamespace
 	}
 }
 
+func TestReadFromYaml_InheritedEnv(t *testing.T) {
+	testEnv := stateTestEnv{
+		Files: map[string]string{
+			"/example/path/to/helmfile.yaml": `environments:
+  base:
+    kubeContext: base-context
+    values:
+    - base.yaml
+  monitoring:
+    values:
+    - replicas: 2
+      monitoring: true
+  production:
+    inherits:
+    - base
+    - monitoring
+    values:
+    - production.yaml
+
+releases:
+- name: myrelease
+  chart: mychart
+`,
+			"/example/path/to/base.yaml": `domain: example.com
+replicas: 1
+region: us-east-1
+`,
+			"/example/path/to/production.yaml": `region: eu-west-1
+`,
+		},
+		WorkDir: "/example/path/to",
+	}
+
+	state := testEnv.MustLoadState(t, "/example/path/to/helmfile.yaml", "production")
+
+	expected := map[string]interface{}{
+		"domain":     "example.com",
+		"replicas":   2,
+		"monitoring": true,
+		"region":     "eu-west-1",
+	}
+
+	if !reflect.DeepEqual(state.Env.Values, expected) {
+		t.Errorf("unexpected environment values: expected=%v, actual=%v", expected, state.Env.Values)
+	}
+
+	if kubeContext := state.kubeContext(&state.Releases[0]); kubeContext != "base-context" {
+		t.Errorf("unexpected kube context: expected=base-context, actual=%s", kubeContext)
+	}
+}
+
+func TestReadFromYaml_EnvRepositories(t *testing.T) {
+	testEnv := stateTestEnv{
+		Files: map[string]string{
+			"/example/path/to/helmfile.yaml": `environments:
+  default:
+  mirror:
+    repositories:
+    - name: stable
+      url: https://mirror.example.com/stable
+      username: mirror-user
+  production:
+    inherits:
+    - mirror
+    repositories:
+    - name: internal
+      url: https://charts.example.com/internal
+
+repositories:
+- name: stable
+  url: https://charts.helm.sh/stable
+- name: bitnami
+  url: https://charts.bitnami.com/bitnami
+
+releases:
+- name: myrelease
+  chart: stable/mychart
+`,
+		},
+		WorkDir: "/example/path/to",
+	}
+
+	testcases := []struct {
+		env  string
+		want []RepositorySpec
+	}{
+		{
+			env: "default",
+			want: []RepositorySpec{
+				{Name: "stable", URL: "https://charts.helm.sh/stable"},
+				{Name: "bitnami", URL: "https://charts.bitnami.com/bitnami"},
+			},
+		},
+		{
+			env: "production",
+			want: []RepositorySpec{
+				{Name: "stable", URL: "https://mirror.example.com/stable", Username: "mirror-user"},
+				{Name: "bitnami", URL: "https://charts.bitnami.com/bitnami"},
+				{Name: "internal", URL: "https://charts.example.com/internal"},
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		state := testEnv.MustLoadState(t, "/example/path/to/helmfile.yaml", tc.env)
+
+		if !reflect.DeepEqual(state.Repositories, tc.want) {
+			t.Errorf("unexpected repositories in %s: expected=%v, actual=%v", tc.env, tc.want, state.Repositories)
+		}
+	}
+}
+
+func TestReadFromYaml_InheritedEnvErrors(t *testing.T) {
+	testcases := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{
+			name: "cycle",
+			yaml: `environments:
+  base:
+    inherits:
+    - production
+  staging:
+    inherits:
+    - base
+  production:
+    inherits:
+    - staging
+`,
+			wantErr: `environment "production" inherits itself: production -> staging -> base -> production`,
+		},
+		{
+			name: "undefined",
+			yaml: `environments:
+  production:
+    inherits:
+    - base
+`,
+			wantErr: `environment "production" inherits undefined environment "base"`,
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := createFromYaml([]byte(tc.yaml), "/example/path/to/helmfile.yaml", "production", logger)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("unexpected error: want %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
 func TestReadFromYaml_OverrideNamespace(t *testing.T) {
 	yamlFile := "/example/path/to/helmfile.yaml"
 	yamlContent := []byte(`environments:
@@ -0,0 +1,50 @@
+package state
+
+import (
+	"sync"
+)
+
+// DebugFiles collects the temporary files generated for releases, like values files, instead of removing them,
+// so that they can be written into the debug bundle of `--dump-debug-bundle` before they are removed.
+type DebugFiles struct {
+	mu      sync.Mutex
+	files   []string
+	secrets map[string]bool
+}
+
+// NewDebugFiles returns DebugFiles that has collected no file yet
+func NewDebugFiles() *DebugFiles {
+	return &DebugFiles{secrets: map[string]bool{}}
+}
+
+// Files returns the paths to the collected files in the order they are collected
+func (d *DebugFiles) Files() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append([]string{}, d.files...)
+}
+
+// IsSecret returns true when the file contains decrypted secrets
+func (d *DebugFiles) IsSecret(file string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.secrets[file]
+}
+
+func (d *DebugFiles) retain(files []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.files = append(d.files, files...)
+}
+
+func (d *DebugFiles) markSecrets(files []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, f := range files {
+		d.secrets[f] = true
+	}
+}
@@ -0,0 +1,155 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+const (
+	DiffStatusChanged   = "changed"
+	DiffStatusUnchanged = "unchanged"
+	// DiffStatusSkipped is the status of a release being newly installed whose diff was skipped by --skip-diff-on-install
+	DiffStatusSkipped = "skipped"
+	DiffStatusError   = "error"
+	// DiffStatusDeleted is the status of an installed release being deleted as it's marked `installed: false`
+	DiffStatusDeleted = "deleted"
+)
+
+// DiffSummary is the machine-readable result of `helmfile diff`, written to the file given to `--output-summary`.
+type DiffSummary struct {
+	// ExitCode is the exit code of helmfile.
+	// It's 0 when there are no changes, 2 when there are changes and --detailed-exitcode is set, and any other non-zero code on error.
+	ExitCode int                  `json:"exitCode"`
+	Releases []DiffSummaryRelease `json:"releases"`
+
+	mu sync.Mutex
+}
+
+// DiffSummaryRelease is the result of diffing a release.
+type DiffSummaryRelease struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Namespace   string `json:"namespace"`
+	KubeContext string `json:"kubeContext"`
+	Chart       string `json:"chart"`
+	// Status is one of changed, unchanged, skipped, deleted, or error
+	Status string `json:"status"`
+	// ExitCode is 0 for an unchanged release, 2 for a changed, skipped or deleted release, and the exit code of the failed command otherwise.
+	ExitCode int    `json:"exitCode"`
+	Error    string `json:"error,omitempty"`
+	// Diff is the output of helm-diff for the release. It's omitted from the summary file, which is meant to be small
+	Diff string `json:"-"`
+}
+
+// Changed returns true when the release has changes, is being newly installed without being diffed, or is being deleted
+func (r DiffSummaryRelease) Changed() bool {
+	return r.Status == DiffStatusChanged || r.Status == DiffStatusSkipped || r.Status == DiffStatusDeleted
+}
+
+// AddDeleted records the release that is installed but marked `installed: false`, which is deleted by apply and sync
+func (s *DiffSummary) AddDeleted(release *ReleaseSpec) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Releases = append(s.Releases, DiffSummaryRelease{
+		ID:          ReleaseToID(release),
+		Name:        release.Name,
+		Namespace:   release.Namespace,
+		KubeContext: release.KubeContext,
+		Chart:       release.Chart,
+		Status:      DiffStatusDeleted,
+		ExitCode:    2,
+	})
+}
+
+func (s *DiffSummary) add(release *ReleaseSpec, skipped bool, relErr *ReleaseError, diff string) {
+	r := DiffSummaryRelease{
+		ID:          ReleaseToID(release),
+		Name:        release.Name,
+		Namespace:   release.Namespace,
+		KubeContext: release.KubeContext,
+		Chart:       release.Chart,
+		Status:      DiffStatusUnchanged,
+		Diff:        diff,
+	}
+
+	switch {
+	case relErr == nil:
+	case skipped:
+		r.Status = DiffStatusSkipped
+		r.ExitCode = relErr.Code
+	case relErr.Code == 2 && isDiffChangedError(relErr.err):
+		r.Status = DiffStatusChanged
+		r.ExitCode = relErr.Code
+	default:
+		r.Status = DiffStatusError
+		r.ExitCode = relErr.Code
+		if r.ExitCode == 0 {
+			r.ExitCode = 1
+		}
+		r.Error = relErr.err.Error()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Releases = append(s.Releases, r)
+}
+
+// isDiffChangedError returns true when the error only indicates that helm-diff detected changes
+func isDiffChangedError(err error) bool {
+	if err == nil {
+		return true
+	}
+
+	e, ok := err.(helmexec.ExitError)
+
+	return ok && e.ExitStatus() == 2
+}
+
+// WriteFile writes the summary as JSON to the file at path.
+// The file is written to a temporary file in the same directory first and then renamed,
+// so that a reader never sees a partially written summary.
+func (s *DiffSummary) WriteFile(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Releases == nil {
+		s.Releases = []DiffSummaryRelease{}
+	}
+
+	bs, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshalling diff summary: %w", err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("writing diff summary: %w", err)
+	}
+
+	tmp := f.Name()
+
+	if _, err := f.Write(append(bs, '\n')); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return fmt.Errorf("writing diff summary to %s: %w", tmp, err)
+	}
+
+	if err := f.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("writing diff summary to %s: %w", tmp, err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("writing diff summary to %s: %w", path, err)
+	}
+
+	return nil
+}
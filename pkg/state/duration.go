@@ -0,0 +1,53 @@
+package state
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Duration is a number of seconds.
+// In a helmfile.yaml it can be written either as an integer number of seconds like `300`,
+// which has been the only supported format before, or as a Go duration string like `5m` or `1h30m`.
+type Duration int
+
+// UnmarshalYAML implements yaml.Unmarshaler to accept both integers and duration strings
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var seconds int
+	if err := unmarshal(&seconds); err == nil {
+		*d = Duration(seconds)
+		return nil
+	}
+
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	parsed, err := ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = parsed
+
+	return nil
+}
+
+// ParseDuration parses either an integer number of seconds like "300" or a Go duration string like "5m" into a Duration.
+func ParseDuration(s string) (Duration, error) {
+	if seconds, err := strconv.Atoi(s); err == nil {
+		return Duration(seconds), nil
+	}
+
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q: it must be either a number of seconds like \"300\" or a duration like \"5m\" or \"1h30m\"", s)
+	}
+
+	if dur%time.Second != 0 {
+		return 0, fmt.Errorf("invalid duration %q: it must be a whole number of seconds", s)
+	}
+
+	return Duration(dur / time.Second), nil
+}
@@ -0,0 +1,156 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/roboll/helmfile/pkg/exectest"
+	"gopkg.in/yaml.v2"
+)
+
+func TestDuration_UnmarshalYAML(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Duration
+		err   string
+	}{
+		{input: `300`, want: 300},
+		{input: `"300"`, want: 300},
+		{input: `5m`, want: 300},
+		{input: `1h30m`, want: 5400},
+		{input: `1.5s`, err: `invalid duration "1.5s": it must be a whole number of seconds`},
+		{input: `five`, err: `invalid duration "five": it must be either a number of seconds like "300" or a duration like "5m" or "1h30m"`},
+	}
+
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.input, func(t *testing.T) {
+			var spec struct {
+				HelmDefaults HelmSpec      `yaml:"helmDefaults"`
+				Releases     []ReleaseSpec `yaml:"releases"`
+			}
+
+			err := yaml.Unmarshal([]byte("helmDefaults:\n  timeout: "+tt.input+"\nreleases:\n- name: foo\n  timeout: "+tt.input+"\n"), &spec)
+
+			var errMsg string
+			if err != nil {
+				errMsg = err.Error()
+			}
+			if d := cmp.Diff(tt.err, errMsg); d != "" {
+				t.Fatalf("unexpected error: want (-), got (+):\n%s", d)
+			}
+			if tt.err != "" {
+				return
+			}
+
+			if spec.HelmDefaults.Timeout != tt.want {
+				t.Errorf("unexpected helmDefaults.timeout: want %d, got %d", tt.want, spec.HelmDefaults.Timeout)
+			}
+			if spec.Releases[0].Timeout == nil || *spec.Releases[0].Timeout != tt.want {
+				t.Errorf("unexpected releases[0].timeout: want %d, got %v", tt.want, spec.Releases[0].Timeout)
+			}
+		})
+	}
+}
+
+func TestHelmState_timeoutFlags(t *testing.T) {
+	fiveMinutes := Duration(300)
+
+	tests := []struct {
+		name     string
+		helm3    bool
+		defaults HelmSpec
+		release  *ReleaseSpec
+		want     []string
+	}{
+		{
+			name:    "helm2",
+			release: &ReleaseSpec{Timeout: &fiveMinutes},
+			want:    []string{"--timeout", "300"},
+		},
+		{
+			name:    "helm3",
+			helm3:   true,
+			release: &ReleaseSpec{Timeout: &fiveMinutes},
+			want:    []string{"--timeout", "300s"},
+		},
+		{
+			name:     "helm3 from default",
+			helm3:    true,
+			defaults: HelmSpec{Timeout: 5400},
+			release:  &ReleaseSpec{},
+			want:     []string{"--timeout", "5400s"},
+		},
+		{
+			name:    "unset",
+			release: &ReleaseSpec{},
+			want:    nil,
+		},
+	}
+
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			st := &HelmState{
+				ReleaseSetSpec: ReleaseSetSpec{
+					HelmDefaults: tt.defaults,
+				},
+			}
+
+			got := st.timeoutFlags(&exectest.Helm{Helm3: tt.helm3}, tt.release)
+
+			if d := cmp.Diff(tt.want, got); d != "" {
+				t.Errorf("unexpected flags: want (-), got (+):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestHelmState_withWaitTimeout(t *testing.T) {
+	tenMinutes := Duration(600)
+
+	tests := []struct {
+		name     string
+		defaults HelmSpec
+		release  *ReleaseSpec
+		flags    []string
+		want     []string
+	}{
+		{
+			name:     "replaces timeout",
+			defaults: HelmSpec{Timeout: 123},
+			release:  &ReleaseSpec{WaitTimeout: &tenMinutes},
+			flags:    []string{"--timeout", "123s", "--namespace", "ns", "--wait"},
+			want:     []string{"--timeout", "600s", "--namespace", "ns", "--wait"},
+		},
+		{
+			name:    "appends timeout",
+			release: &ReleaseSpec{WaitTimeout: &tenMinutes},
+			flags:   []string{"--namespace", "ns", "--wait"},
+			want:    []string{"--namespace", "ns", "--wait", "--timeout", "600s"},
+		},
+		{
+			name:    "unset",
+			release: &ReleaseSpec{},
+			flags:   []string{"--namespace", "ns", "--wait"},
+			want:    []string{"--namespace", "ns", "--wait"},
+		},
+	}
+
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			st := &HelmState{
+				ReleaseSetSpec: ReleaseSetSpec{
+					HelmDefaults: tt.defaults,
+				},
+			}
+
+			got := st.withWaitTimeout(tt.flags, &exectest.Helm{Helm3: true}, tt.release)
+
+			if d := cmp.Diff(tt.want, got); d != "" {
+				t.Errorf("unexpected flags: want (-), got (+):\n%s", d)
+			}
+		})
+	}
+}
@@ -1,9 +1,22 @@
 package state
 
+import (
+	"fmt"
+	"strings"
+)
+
 type EnvironmentSpec struct {
-	Values      []interface{} `yaml:"values,omitempty"`
-	Secrets     []string      `yaml:"secrets,omitempty"`
-	KubeContext string        `yaml:"kubeContext,omitempty"`
+	// Inherits is the list of environments whose values and secrets are loaded before the ones of this environment,
+	// so that this environment can override them. kubeContext, missingFileHandler and valuesHeaders are inherited
+	// unless this environment sets them.
+	Inherits []string `yaml:"inherits,omitempty"`
+
+	Values  []interface{} `yaml:"values,omitempty"`
+	Secrets []string      `yaml:"secrets,omitempty"`
+	// SecretsBackend is the way to decrypt Secrets, either `helm-secrets`(default), `sops` or `vals`, like `releases[].secretsBackend`.
+	// It's inherited unless this environment sets it.
+	SecretsBackend string `yaml:"secretsBackend,omitempty"`
+	KubeContext    string `yaml:"kubeContext,omitempty"`
 
 	// MissingFileHandler instructs helmfile to fail when unable to find a environment values file listed
 	// under `environments.NAME.values`.
@@ -13,4 +26,113 @@ type EnvironmentSpec struct {
 	// Use "Warn", "Info", or "Debug" if you want helmfile to not fail when a values file is missing, while just leaving
 	// a message about the missing file at the log-level.
 	MissingFileHandler *string `yaml:"missingFileHandler,omitempty"`
+
+	// ValuesHeaders is the HTTP headers sent when fetching environment values files from HTTP(S) URLs listed
+	// under `environments.NAME.values`, like `Authorization: ref+vault://secret/config#/token`.
+	//
+	// Each header value can be a vals ref, which is resolved before fetching the files.
+	ValuesHeaders map[string]string `yaml:"valuesHeaders,omitempty"`
+
+	// Repositories override the repositories of the state file with the same names, and add the other ones, when this
+	// environment is selected. Each entry replaces the whole entry of the state file, including the credentials.
+	Repositories []RepositorySpec `yaml:"repositories,omitempty"`
+}
+
+// inheritEnvironment returns the spec of the environment with the values and secrets of the inherited environments
+// prepended to its own, in the order of `inherits`.
+func (st *HelmState) inheritEnvironment(name string) (EnvironmentSpec, error) {
+	return st.inheritEnvironmentFrom(name, nil)
+}
+
+func (st *HelmState) inheritEnvironmentFrom(name string, path []string) (EnvironmentSpec, error) {
+	for i, n := range path {
+		if n == name {
+			return EnvironmentSpec{}, fmt.Errorf("environment %q inherits itself: %s", name, strings.Join(append(path[i:], name), " -> "))
+		}
+	}
+
+	spec := st.Environments[name]
+	if len(spec.Inherits) == 0 {
+		return spec, nil
+	}
+
+	path = append(path, name)
+
+	var (
+		values       []interface{}
+		secrets      []string
+		repositories []RepositorySpec
+	)
+
+	resolved := spec
+	resolved.Inherits = nil
+
+	for _, parentName := range spec.Inherits {
+		if _, ok := st.Environments[parentName]; !ok {
+			return EnvironmentSpec{}, fmt.Errorf("environment %q inherits undefined environment %q", name, parentName)
+		}
+
+		parent, err := st.inheritEnvironmentFrom(parentName, path)
+		if err != nil {
+			return EnvironmentSpec{}, err
+		}
+
+		values = append(values, parent.Values...)
+		secrets = append(secrets, parent.Secrets...)
+		repositories = mergeRepositories(repositories, parent.Repositories)
+
+		if resolved.KubeContext == "" {
+			resolved.KubeContext = parent.KubeContext
+		}
+		if resolved.SecretsBackend == "" {
+			resolved.SecretsBackend = parent.SecretsBackend
+		}
+		if resolved.MissingFileHandler == nil {
+			resolved.MissingFileHandler = parent.MissingFileHandler
+		}
+		if resolved.ValuesHeaders == nil {
+			resolved.ValuesHeaders = parent.ValuesHeaders
+		}
+	}
+
+	resolved.Values = append(values, spec.Values...)
+	resolved.Secrets = append(secrets, spec.Secrets...)
+	resolved.Repositories = mergeRepositories(repositories, spec.Repositories)
+
+	return resolved, nil
+}
+
+// ApplyEnvironmentRepositories merges the repositories of the selected environment into the repositories of the state,
+// so that e.g. SyncRepos uses the URLs and credentials of the environment.
+// It is idempotent, so that it can be applied again after merging the parts of a multi-part state file.
+func (st *HelmState) ApplyEnvironmentRepositories() {
+	st.Repositories = mergeRepositories(st.Repositories, st.Environments[st.Env.Name].Repositories)
+}
+
+// mergeRepositories returns the repositories with the ones in overrides replacing the ones with the same names,
+// and the rest of overrides appended in order. It never modifies the given slices.
+func mergeRepositories(repos, overrides []RepositorySpec) []RepositorySpec {
+	if len(overrides) == 0 {
+		return repos
+	}
+
+	merged := make([]RepositorySpec, len(repos), len(repos)+len(overrides))
+	copy(merged, repos)
+
+	index := map[string]int{}
+	for i, r := range merged {
+		index[r.Name] = i
+	}
+
+	for _, o := range overrides {
+		if i, ok := index[o.Name]; ok {
+			merged[i] = o
+			continue
+		}
+
+		index[o.Name] = len(merged)
+		merged = append(merged, o)
+	}
+
+	return merged
 }
@@ -21,6 +21,9 @@ type EnvironmentValuesLoader struct {
 	logger *zap.SugaredLogger
 
 	remote *remote.Remote
+
+	// headers is sent when fetching values files from HTTP(S) URLs
+	headers map[string]string
 }
 
 func NewEnvironmentValuesLoader(storage *Storage, readFile func(string) ([]byte, error), logger *zap.SugaredLogger, remote *remote.Remote) *EnvironmentValuesLoader {
@@ -41,9 +44,19 @@ func (ld *EnvironmentValuesLoader) LoadEnvironmentValues(missingFileHandler *str
 		switch strOrMap := entry.(type) {
 		case string:
 			urlOrPath := strOrMap
-			localPath, err := ld.remote.Locate(urlOrPath)
-			if err == nil {
-				urlOrPath = localPath
+			if remote.IsHTTPFile(urlOrPath) {
+				localPath, err := ld.remote.FetchHTTPFile(urlOrPath, ld.headers)
+				if err == nil {
+					urlOrPath = localPath
+				} else if _, notFound := err.(remote.NotFoundError); !notFound {
+					return nil, fmt.Errorf("failed to fetch environment values file \"%s\": %v", urlOrPath, err)
+				}
+				// The URL that responded with 404 is left as-is so that it is handled as a missing file below
+			} else {
+				localPath, err := ld.remote.Locate(urlOrPath)
+				if err == nil {
+					urlOrPath = localPath
+				}
 			}
 
 			files, skipped, err := ld.storage.resolveFile(missingFileHandler, "environment values", urlOrPath)
@@ -1,7 +1,10 @@
 package state
 
 import (
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"path/filepath"
 	"testing"
 
@@ -119,3 +122,53 @@ func TestEnvValsLoad_OverwriteEmptyValue_Issue1168(t *testing.T) {
 		t.Errorf(diff)
 	}
 }
+
+func TestEnvValsLoad_HTTPFile(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer mytoken" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/prod.yaml":
+			fmt.Fprint(w, "region: us-east-1\nreplicas: 3\n")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	l := newLoader()
+	l.remote = remote.NewRemote(l.logger, t.TempDir(), ioutil.ReadFile, func(string) bool { return false }, func(string) bool { return false })
+	l.headers = map[string]string{"Authorization": "Bearer mytoken"}
+
+	actual, err := l.LoadEnvironmentValues(nil, []interface{}{srv.URL + "/prod.yaml", "testdata/values.5.yaml"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"affinity": map[string]interface{}{},
+		"region":   "us-east-1",
+		"replicas": 3,
+	}
+
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Errorf(diff)
+	}
+
+	warn := MissingFileHandlerWarn
+	if _, err := l.LoadEnvironmentValues(&warn, []interface{}{srv.URL + "/missing.yaml"}, nil); err != nil {
+		t.Errorf("unexpected error for the missing file with the Warn handler: %v", err)
+	}
+
+	if _, err := l.LoadEnvironmentValues(nil, []interface{}{srv.URL + "/missing.yaml"}, nil); err == nil {
+		t.Errorf("expected error not returned for the missing file")
+	}
+
+	l.headers = nil
+	if _, err := l.LoadEnvironmentValues(&warn, []interface{}{srv.URL + "/other.yaml"}, nil); err == nil {
+		t.Errorf("expected error not returned for the unauthorized request")
+	}
+}
@@ -0,0 +1,86 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+	"github.com/roboll/helmfile/pkg/maputil"
+	"gopkg.in/yaml.v2"
+)
+
+// execValuesPrefix is the prefix of the values entries like `exec://./gen-values.sh arg`,
+// whose command is run to produce the values file from its stdout
+const execValuesPrefix = "exec://"
+
+func isExecValues(entry string) bool {
+	return strings.HasPrefix(entry, execValuesPrefix)
+}
+
+// execValues runs the command of the `exec://` values entry of the release, and returns its stdout as the content of the values file.
+// The command is given the environment and the release in the HELMFILE_* environment variables.
+// It fails unless st.EnableExecValues is set, as helmfiles are otherwise never expected to run arbitrary commands while loading values.
+func (st *HelmState) execValues(release *ReleaseSpec, entry string) ([]byte, error) {
+	if !st.EnableExecValues {
+		return nil, fmt.Errorf("values entry %q of release %q runs a command, which is disabled by default. Set --enable-exec-values or HELMFILE_ENABLE_EXEC_VALUES=true to allow it", entry, release.Name)
+	}
+
+	args := strings.Fields(strings.TrimPrefix(entry, execValuesPrefix))
+	if len(args) == 0 {
+		return nil, fmt.Errorf("values entry %q of release %q has no command to run", entry, release.Name)
+	}
+
+	env, err := st.execValuesEnv(release)
+	if err != nil {
+		return nil, fmt.Errorf("values entry %q of release %q: %w", entry, release.Name, err)
+	}
+
+	runner := st.runner
+	if runner == nil {
+		runner = helmexec.ShellRunner{
+			Dir:    st.basePath,
+			Logger: st.logger,
+		}
+	}
+
+	st.logger.Debugf("running %s to generate values for release %q", strings.Join(args, " "), release.Name)
+
+	out, err := runner.Execute(args[0], args[1:], env)
+	if err != nil {
+		return nil, fmt.Errorf("values entry %q of release %q: %v", entry, release.Name, err)
+	}
+
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(out, &values); err != nil {
+		return nil, fmt.Errorf("values entry %q of release %q: the output is not a YAML map: %v", entry, release.Name, err)
+	}
+
+	return out, nil
+}
+
+// execValuesEnv returns the environment variables given to the commands of `exec://` values entries
+func (st *HelmState) execValuesEnv(release *ReleaseSpec) (map[string]string, error) {
+	merged, err := st.Env.GetMergedValues()
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := maputil.CastKeysToStrings(merged)
+	if err != nil {
+		return nil, err
+	}
+
+	bs, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{
+		"HELMFILE_ENVIRONMENT":        st.Env.Name,
+		"HELMFILE_ENVIRONMENT_VALUES": string(bs),
+		"HELMFILE_RELEASE_NAME":       release.Name,
+		"HELMFILE_RELEASE_NAMESPACE":  release.Namespace,
+		"HELMFILE_RELEASE_CHART":      release.Chart,
+	}, nil
+}
@@ -0,0 +1,146 @@
+package state
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/roboll/helmfile/pkg/environment"
+)
+
+type execValuesTestRunner struct {
+	output   string
+	commands []string
+	env      map[string]string
+}
+
+func (r *execValuesTestRunner) Execute(cmd string, args []string, env map[string]string) ([]byte, error) {
+	r.commands = append(r.commands, cmd+" "+strings.Join(args, " "))
+	r.env = env
+
+	return []byte(r.output), nil
+}
+
+func (r *execValuesTestRunner) ExecuteStdIn(cmd string, args []string, env map[string]string, stdin io.Reader) ([]byte, error) {
+	return r.Execute(cmd, args, env)
+}
+
+func TestHelmState_generateVanillaValuesFiles_ExecValues(t *testing.T) {
+	testcases := []struct {
+		name         string
+		enabled      bool
+		output       string
+		wantValues   []string
+		wantCommands []string
+		wantErr      string
+	}{
+		{
+			name:         "enabled",
+			enabled:      true,
+			output:       "generated: true\nreplicas: 3\n",
+			wantValues:   []string{"static: true\n", "generated: true\nreplicas: 3\n"},
+			wantCommands: []string{"./gen-values.sh --env prod"},
+		},
+		{
+			name:    "disabled",
+			output:  "generated: true\n",
+			wantErr: `values entry "exec://./gen-values.sh --env prod" of release "foo" runs a command, which is disabled by default. Set --enable-exec-values or HELMFILE_ENABLE_EXEC_VALUES=true to allow it`,
+		},
+		{
+			name:    "output not yaml",
+			enabled: true,
+			output:  "- not\n- a map\n",
+			wantErr: `values entry "exec://./gen-values.sh --env prod" of release "foo": the output is not a YAML map`,
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			if err := ioutil.WriteFile(filepath.Join(dir, "static.yaml"), []byte("static: true\n"), 0644); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			runner := &execValuesTestRunner{output: tc.output}
+
+			state := &HelmState{
+				basePath: dir,
+				FilePath: filepath.Join(dir, "helmfile.yaml"),
+				ReleaseSetSpec: ReleaseSetSpec{
+					Releases: []ReleaseSpec{
+						{
+							Name:      "foo",
+							Namespace: "bar",
+							Chart:     "stable/foo",
+							Values:    []interface{}{"static.yaml", "exec://./gen-values.sh --env prod"},
+						},
+					},
+					Env: environment.Environment{
+						Name:   "prod",
+						Values: map[string]interface{}{"region": "us-east-1"},
+					},
+					EnableExecValues: tc.enabled,
+				},
+				logger:            logger,
+				readFile:          ioutil.ReadFile,
+				removeFile:        os.Remove,
+				glob:              filepath.Glob,
+				directoryExistsAt: directoryExistsAt,
+				valsRuntime:       valsRuntime,
+				runner:            runner,
+				RenderedValues:    map[string]interface{}{},
+			}
+
+			files, err := state.generateVanillaValuesFiles(&state.Releases[0])
+			defer state.removeFiles(files)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("unexpected error: want %q, got %v", tc.wantErr, err)
+				}
+				if !tc.enabled && len(runner.commands) > 0 {
+					t.Errorf("unexpected commands: %v", runner.commands)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var values []string
+			for _, f := range files {
+				bs, err := ioutil.ReadFile(f)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				values = append(values, string(bs))
+			}
+
+			if d := cmp.Diff(tc.wantValues, values); d != "" {
+				t.Errorf("unexpected values: want (-), got (+):\n%s", d)
+			}
+
+			if d := cmp.Diff(tc.wantCommands, runner.commands); d != "" {
+				t.Errorf("unexpected commands: want (-), got (+):\n%s", d)
+			}
+
+			wantEnv := map[string]string{
+				"HELMFILE_ENVIRONMENT":        "prod",
+				"HELMFILE_ENVIRONMENT_VALUES": `{"region":"us-east-1"}`,
+				"HELMFILE_RELEASE_NAME":       "foo",
+				"HELMFILE_RELEASE_NAMESPACE":  "bar",
+				"HELMFILE_RELEASE_CHART":      "stable/foo",
+			}
+			if d := cmp.Diff(wantEnv, runner.env); d != "" {
+				t.Errorf("unexpected env: want (-), got (+):\n%s", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// clusterScopedKinds is the list of the well-known kinds of cluster-scoped resources.
+// releases[].forceNamespace never sets metadata.namespace of resources of these kinds.
+var clusterScopedKinds = map[string]bool{
+	"APIService":                     true,
+	"CSIDriver":                      true,
+	"CSINode":                        true,
+	"CertificateSigningRequest":      true,
+	"ClusterRole":                    true,
+	"ClusterRoleBinding":             true,
+	"ComponentStatus":                true,
+	"CustomResourceDefinition":       true,
+	"FlowSchema":                     true,
+	"IngressClass":                   true,
+	"MutatingWebhookConfiguration":   true,
+	"Namespace":                      true,
+	"Node":                           true,
+	"PersistentVolume":               true,
+	"PodSecurityPolicy":              true,
+	"PriorityClass":                  true,
+	"PriorityLevelConfiguration":     true,
+	"RuntimeClass":                   true,
+	"StorageClass":                   true,
+	"ValidatingWebhookConfiguration": true,
+	"VolumeAttachment":               true,
+}
+
+// unsetClusterScopedNamespaces removes metadata.namespace from the cluster-scoped resources contained in the chart
+// generated by chartify, so that releases[].forceNamespace doesn't break them.
+func unsetClusterScopedNamespaces(chartDir string) error {
+	for _, d := range []string{"templates", "charts", "crds"} {
+		dir := filepath.Join(chartDir, d)
+
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			continue
+		}
+
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if info.IsDir() || (filepath.Ext(path) != ".yaml" && filepath.Ext(path) != ".yml") {
+				return nil
+			}
+
+			return unsetClusterScopedNamespacesInFile(path)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func unsetClusterScopedNamespacesInFile(path string) error {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var docs []*yaml.Node
+
+	modified := false
+
+	dec := yaml.NewDecoder(bytes.NewReader(bs))
+	for {
+		doc := &yaml.Node{}
+
+		if err := dec.Decode(doc); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("parsing yaml from %s: %v", path, err)
+		}
+
+		if unsetClusterScopedNamespace(doc) {
+			modified = true
+		}
+
+		docs = append(docs, doc)
+	}
+
+	if !modified {
+		return nil
+	}
+
+	var buf bytes.Buffer
+
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+
+	for _, doc := range docs {
+		if err := enc.Encode(doc); err != nil {
+			return fmt.Errorf("marshalling yaml for %s: %v", path, err)
+		}
+	}
+
+	if err := enc.Close(); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// unsetClusterScopedNamespace removes metadata.namespace from the resource when it is of a cluster-scoped kind.
+// It returns true when the resource is modified.
+func unsetClusterScopedNamespace(doc *yaml.Node) bool {
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return false
+	}
+
+	resource := doc.Content[0]
+
+	var metadata *yaml.Node
+
+	clusterScoped := false
+
+	for i := 0; i+1 < len(resource.Content); i += 2 {
+		switch resource.Content[i].Value {
+		case "kind":
+			clusterScoped = clusterScopedKinds[resource.Content[i+1].Value]
+		case "metadata":
+			metadata = resource.Content[i+1]
+		}
+	}
+
+	if !clusterScoped || metadata == nil || metadata.Kind != yaml.MappingNode {
+		return false
+	}
+
+	for i := 0; i+1 < len(metadata.Content); i += 2 {
+		if metadata.Content[i].Value == "namespace" {
+			metadata.Content = append(metadata.Content[:i], metadata.Content[i+2:]...)
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,126 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/roboll/helmfile/pkg/exectest"
+)
+
+func TestHelmState_PrepareChartify_ForceNamespace(t *testing.T) {
+	state := &HelmState{
+		logger:            logger,
+		valsRuntime:       valsRuntime,
+		fileExists:        func(string) (bool, error) { return false, nil },
+		directoryExistsAt: func(string) bool { return false },
+		removeFile:        os.Remove,
+		RenderedValues:    map[string]interface{}{},
+	}
+
+	release := &ReleaseSpec{
+		Name:           "myapp",
+		Chart:          "stable/myapp",
+		Namespace:      "myns",
+		ForceNamespace: "forced",
+	}
+
+	c, clean, err := state.PrepareChartify(&exectest.Helm{Helm3: true}, release, release.Chart, 0)
+	defer clean()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if c == nil {
+		t.Fatal("expected chartify to run for the release with forceNamespace")
+	}
+
+	if c.Opts.OverrideNamespace != "forced" {
+		t.Errorf("unexpected OverrideNamespace: want %q, got %q", "forced", c.Opts.OverrideNamespace)
+	}
+}
+
+func TestUnsetClusterScopedNamespaces(t *testing.T) {
+	dir := t.TempDir()
+
+	templates := filepath.Join(dir, "templates")
+	if err := os.MkdirAll(templates, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	crds := filepath.Join(dir, "crds")
+	if err := os.MkdirAll(crds, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		filepath.Join(templates, "all.yaml"): `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: myapp
+  namespace: forced
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: myapp
+  namespace: forced
+rules: []
+`,
+		filepath.Join(templates, "deployment.yaml"): `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: myapp
+  namespace: forced
+`,
+		filepath.Join(crds, "crd.yaml"): `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: foos.example.com
+  namespace: forced
+`,
+	}
+
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := unsetClusterScopedNamespaces(dir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := map[string]string{
+		filepath.Join(templates, "all.yaml"): `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: myapp
+  namespace: forced
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: myapp
+rules: []
+`,
+		filepath.Join(templates, "deployment.yaml"): files[filepath.Join(templates, "deployment.yaml")],
+		filepath.Join(crds, "crd.yaml"): `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: foos.example.com
+`,
+	}
+
+	for path, w := range want {
+		bs, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if d := cmp.Diff(w, string(bs)); d != "" {
+			t.Errorf("unexpected content of %s: want (-), got (+):\n%s", path, d)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package state
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// GuardedChange is a change to a resource of one of the guardedKinds, found in the diff of a release
+type GuardedChange struct {
+	// ReleaseID is the ID of the release whose diff contains the change
+	ReleaseID string
+	// Kind is the guarded kind
+	Kind string
+	// Resource is the resource in the diff that contains the change, like `StatefulSet default/db`
+	Resource string
+}
+
+func (c GuardedChange) String() string {
+	if strings.HasPrefix(c.Resource, c.Kind+" ") {
+		return fmt.Sprintf("%s: %s", c.ReleaseID, c.Resource)
+	}
+	return fmt.Sprintf("%s: %s in %s", c.ReleaseID, c.Kind, c.Resource)
+}
+
+// GuardedChanges collects the changes to the guardedKinds found by DiffReleases
+type GuardedChanges struct {
+	Changes []GuardedChange
+
+	mu sync.Mutex
+}
+
+func (g *GuardedChanges) add(releaseID string, changes []GuardedChange) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, c := range changes {
+		c.ReleaseID = releaseID
+		g.Changes = append(g.Changes, c)
+	}
+}
+
+// guardedKinds returns the kinds of resources whose changes need --force to be applied to the release
+func (st *HelmState) guardedKinds(release *ReleaseSpec) []string {
+	if release.GuardedKinds != nil {
+		return release.GuardedKinds
+	}
+	return st.HelmDefaults.GuardedKinds
+}
+
+var (
+	ansiEscapeRegexp = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+	// diffHeaderRegexp matches the line of helm-diff that starts the diff of a resource, like
+	// `default, db, StatefulSet (apps) has changed:`
+	diffHeaderRegexp = regexp.MustCompile(`^(\S*), (\S+), (\S+) \([^)]*\) has (changed|been added|been removed):`)
+	// diffKindRegexp matches an added or removed `kind:` line in the diff of a resource
+	diffKindRegexp = regexp.MustCompile(`^[-+]\s*(?:- )?kind:\s*["']?([A-Za-z0-9]+)["']?\s*$`)
+)
+
+// findGuardedChanges scans the output of helm-diff for the resources of the guarded kinds that have changed,
+// and the added or removed `kind:` lines of the guarded kinds in any changed resource,
+// like the volumeClaimTemplates of a StatefulSet.
+func findGuardedChanges(diff string, kinds []string) []GuardedChange {
+	if len(kinds) == 0 {
+		return nil
+	}
+
+	guarded := map[string]bool{}
+	for _, k := range kinds {
+		guarded[k] = true
+	}
+
+	var (
+		changes  []GuardedChange
+		resource string
+		found    map[string]bool
+	)
+
+	scanner := bufio.NewScanner(strings.NewReader(ansiEscapeRegexp.ReplaceAllString(diff, "")))
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if m := diffHeaderRegexp.FindStringSubmatch(line); m != nil {
+			ns, name, kind := m[1], m[2], m[3]
+
+			resource = kind + " " + name
+			if ns != "" {
+				resource = kind + " " + ns + "/" + name
+			}
+			found = map[string]bool{}
+
+			if guarded[kind] {
+				found[kind] = true
+				changes = append(changes, GuardedChange{Kind: kind, Resource: resource})
+			}
+
+			continue
+		}
+
+		if resource == "" {
+			continue
+		}
+
+		if m := diffKindRegexp.FindStringSubmatch(line); m != nil {
+			kind := m[1]
+			if guarded[kind] && !found[kind] {
+				found[kind] = true
+				changes = append(changes, GuardedChange{Kind: kind, Resource: resource})
+			}
+		}
+	}
+
+	return changes
+}
@@ -0,0 +1,102 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFindGuardedChanges(t *testing.T) {
+	testcases := []struct {
+		name  string
+		diff  string
+		kinds []string
+		want  []GuardedChange
+	}{
+		{
+			name: "no guarded kinds",
+			diff: `default, data, PersistentVolumeClaim (v1) has changed:
+-     storage: 1Gi
++     storage: 2Gi
+`,
+		},
+		{
+			name: "untouched guarded kinds",
+			diff: `default, web, Deployment (apps) has changed:
+  # Source: web/templates/deployment.yaml
+  apiVersion: apps/v1
+  kind: Deployment
+-         image: web:1.0
++         image: web:1.1
+`,
+			kinds: []string{"PersistentVolumeClaim", "CustomResourceDefinition"},
+		},
+		{
+			name: "changed guarded kinds",
+			diff: "\x1b[33mdefault, data, PersistentVolumeClaim (v1) has changed:\x1b[0m\n" +
+				`  kind: PersistentVolumeClaim
+-     storage: 1Gi
++     storage: 2Gi
+default, web, Deployment (apps) has changed:
+-         image: web:1.0
++         image: web:1.1
+, foos.example.com, CustomResourceDefinition (apiextensions.k8s.io) has been added:
++ apiVersion: apiextensions.k8s.io/v1
++ kind: CustomResourceDefinition
+`,
+			kinds: []string{"PersistentVolumeClaim", "CustomResourceDefinition"},
+			want: []GuardedChange{
+				{Kind: "PersistentVolumeClaim", Resource: "PersistentVolumeClaim default/data"},
+				{Kind: "CustomResourceDefinition", Resource: "CustomResourceDefinition foos.example.com"},
+			},
+		},
+		{
+			name: "guarded kinds nested in a changed resource",
+			diff: `default, db, StatefulSet (apps) has changed:
+  kind: StatefulSet
+    volumeClaimTemplates:
+-   - kind: PersistentVolumeClaim
+-     metadata:
+-       name: data
++   - apiVersion: v1
++     kind: PersistentVolumeClaim
++     metadata:
++       name: data
+default, cache, StatefulSet (apps) has changed:
+    volumeClaimTemplates:
+    - kind: PersistentVolumeClaim
+-         image: redis:6
++         image: redis:7
+`,
+			kinds: []string{"PersistentVolumeClaim"},
+			want: []GuardedChange{
+				{Kind: "PersistentVolumeClaim", Resource: "StatefulSet default/db"},
+			},
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			got := findGuardedChanges(tc.diff, tc.kinds)
+
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("unexpected changes: want (-), got (+):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestGuardedChange_String(t *testing.T) {
+	testcases := map[string]GuardedChange{
+		"default//foo: PersistentVolumeClaim default/data":              {ReleaseID: "default//foo", Kind: "PersistentVolumeClaim", Resource: "PersistentVolumeClaim default/data"},
+		"default//foo: PersistentVolumeClaim in StatefulSet default/db": {ReleaseID: "default//foo", Kind: "PersistentVolumeClaim", Resource: "StatefulSet default/db"},
+	}
+
+	for want, c := range testcases {
+		if got := c.String(); got != want {
+			t.Errorf("unexpected string: want %q, got %q", want, got)
+		}
+	}
+}
@@ -37,6 +37,8 @@ func directoryExistsAt(path string) bool {
 type Chartify struct {
 	Opts  *chartify.ChartifyOpts
 	Clean func()
+	// Chart, when not empty, is the directory passed to chartify instead of the release's chart
+	Chart string
 }
 
 func (st *HelmState) downloadChartWithGoGetter(r *ReleaseSpec) (string, error) {
@@ -93,9 +95,15 @@ func (st *HelmState) PrepareChartify(helm helmexec.Interface, release *ReleaseSp
 	}
 
 	var filesNeedCleaning []string
+	var dirsNeedCleaning []string
 
 	clean := func() {
 		st.removeFiles(filesNeedCleaning)
+		for _, d := range dirsNeedCleaning {
+			if err := os.RemoveAll(d); err != nil {
+				st.logger.Warnf("Removing %s: %v", d, err)
+			}
+		}
 	}
 
 	var shouldRun bool
@@ -107,6 +115,34 @@ func (st *HelmState) PrepareChartify(helm helmexec.Interface, release *ReleaseSp
 		}
 	}
 
+	if opts := release.KustomizeOptions; opts != nil {
+		if !st.isKustomization(dir) {
+			return nil, clean, fmt.Errorf("release %q: kustomizeOptions requires chart %q to be a local directory containing a kustomization", release.Name, chart)
+		}
+
+		if err := opts.validate(); err != nil {
+			return nil, clean, fmt.Errorf("release %q: %v", release.Name, err)
+		}
+
+		if opts.EnableAlphaPlugins != nil {
+			c.Opts.EnableKustomizeAlphaPlugins = *opts.EnableAlphaPlugins
+		}
+
+		if opts.needsPrebuild() {
+			built, err := st.kustomizeBuild(release, dir, opts)
+			if built != "" {
+				dirsNeedCleaning = append(dirsNeedCleaning, built)
+			}
+			if err != nil {
+				return nil, clean, fmt.Errorf("release %q: %v", release.Name, err)
+			}
+
+			c.Chart = built
+		}
+
+		shouldRun = true
+	}
+
 	for _, d := range release.Dependencies {
 		chart := d.Chart
 		if st.directoryExistsAt(chart) {
@@ -188,10 +224,15 @@ func (st *HelmState) PrepareChartify(helm helmexec.Interface, release *ReleaseSp
 		filesNeedCleaning = append(filesNeedCleaning, generatedFiles...)
 
 		c.Opts.ValuesFiles = generatedFiles
-		setFlags, err := st.setFlags(release.SetValues)
+		setFlags, err := st.setFlags(release.SetValues, release.ValuesPathPrefix)
 		if err != nil {
 			return nil, clean, fmt.Errorf("rendering set value entry for release %s: %v", release.Name, err)
 		}
+		setStringFlags, err := st.setStringFlags(release.SetStringValues)
+		if err != nil {
+			return nil, clean, fmt.Errorf("rendering setString value entry for release %s: %v", release.Name, err)
+		}
+		setFlags = append(setFlags, setStringFlags...)
 		c.Opts.SetFlags = setFlags
 		c.Opts.TemplateData = st.newReleaseTemplateData(release)
 		c.Opts.TemplateFuncs = st.newReleaseTemplateFuncMap(dir)
@@ -0,0 +1,150 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/roboll/helmfile/pkg/environment"
+	"github.com/roboll/helmfile/pkg/exectest"
+)
+
+func TestHelmState_PrepareChartify_TemplatedPatches(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"patch.yaml.gotmpl": `- target:
+    version: v1
+    kind: ConfigMap
+    name: myapp
+  patch:
+  - op: replace
+    path: /data/env
+    value: {{ .Environment.Name }}
+`,
+		"merge.yaml.gotmpl": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Release.Name }}
+data:
+  replicas: "{{ .Values.replicas }}"
+`,
+		"transformer.yaml": `apiVersion: builtin
+kind: LabelTransformer
+metadata:
+  name: env
+labels:
+  env: "{{ .Environment.Name }}"
+`,
+	}
+
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	state := &HelmState{
+		basePath: dir,
+		ReleaseSetSpec: ReleaseSetSpec{
+			Env: environment.Environment{
+				Name:   "prod",
+				Values: map[string]interface{}{"replicas": 3},
+			},
+		},
+		logger:            logger,
+		valsRuntime:       valsRuntime,
+		readFile:          os.ReadFile,
+		glob:              filepath.Glob,
+		fileExists:        func(string) (bool, error) { return false, nil },
+		directoryExistsAt: directoryExistsAt,
+		removeFile:        os.Remove,
+		RenderedValues:    map[string]interface{}{"replicas": 3},
+	}
+
+	release := &ReleaseSpec{
+		Name:                  "myapp",
+		Chart:                 "stable/myapp",
+		JSONPatches:           []interface{}{"patch.yaml.gotmpl"},
+		StrategicMergePatches: []interface{}{"merge.yaml.gotmpl"},
+		Transformers:          []interface{}{"transformer.yaml"},
+	}
+
+	c, clean, err := state.PrepareChartify(&exectest.Helm{Helm3: true}, release, release.Chart, 0)
+	if err != nil {
+		clean()
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if c == nil {
+		clean()
+		t.Fatal("expected chartify to run for the release with patches")
+	}
+
+	testcases := []struct {
+		name  string
+		files []string
+		want  string
+	}{
+		{
+			name:  "jsonPatches",
+			files: c.Opts.JsonPatches,
+			want: `- target:
+    version: v1
+    kind: ConfigMap
+    name: myapp
+  patch:
+  - op: replace
+    path: /data/env
+    value: prod
+`,
+		},
+		{
+			name:  "strategicMergePatches",
+			files: c.Opts.StrategicMergePatches,
+			want: `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: myapp
+data:
+  replicas: "3"
+`,
+		},
+		{
+			// Files without the .gotmpl extension are passed as is, as before
+			name:  "transformers",
+			files: c.Opts.Transformers,
+			want:  files["transformer.yaml"],
+		},
+	}
+
+	var generated []string
+
+	for _, tc := range testcases {
+		if len(tc.files) != 1 {
+			t.Errorf("%s: unexpected files: %v", tc.name, tc.files)
+			continue
+		}
+
+		generated = append(generated, tc.files[0])
+
+		bs, err := os.ReadFile(tc.files[0])
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+
+		if d := cmp.Diff(tc.want, string(bs)); d != "" {
+			t.Errorf("%s: unexpected content: want (-), got (+):\n%s", tc.name, d)
+		}
+	}
+
+	clean()
+
+	for _, f := range generated {
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Errorf("the rendered file %s is not removed: %v", f, err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package state
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/roboll/helmfile/pkg/exectest"
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+// historyMaxTestHelm records the history max of the helm context each release is upgraded with
+type historyMaxTestHelm struct {
+	*exectest.Helm
+
+	mu         sync.Mutex
+	historyMax map[string]int
+}
+
+func (helm *historyMaxTestHelm) SyncRelease(context helmexec.HelmContext, name, chart string, flags ...string) error {
+	helm.mu.Lock()
+	helm.historyMax[name] = context.HistoryMax
+	helm.mu.Unlock()
+
+	return helm.Helm.SyncRelease(context, name, chart, flags...)
+}
+
+func TestHelmState_SyncReleases_HistoryMax(t *testing.T) {
+	zero, three, five := 0, 3, 5
+
+	tests := []struct {
+		name     string
+		defaults HelmSpec
+		releases []ReleaseSpec
+		opts     *SyncOpts
+		want     map[string]int
+	}{
+		{
+			name:     "built-in default",
+			releases: []ReleaseSpec{{Name: "foo", Chart: "foo"}},
+			want:     map[string]int{"foo": 10},
+		},
+		{
+			name:     "helmDefaults",
+			defaults: HelmSpec{HistoryMax: &five},
+			releases: []ReleaseSpec{{Name: "foo", Chart: "foo"}},
+			want:     map[string]int{"foo": 5},
+		},
+		{
+			name:     "release overrides helmDefaults",
+			defaults: HelmSpec{HistoryMax: &five},
+			releases: []ReleaseSpec{{Name: "foo", Chart: "foo", HistoryMax: &zero}},
+			want:     map[string]int{"foo": 0},
+		},
+		{
+			name:     "command-line overrides the release and helmDefaults",
+			defaults: HelmSpec{HistoryMax: &five},
+			releases: []ReleaseSpec{
+				{Name: "foo", Chart: "foo", HistoryMax: &zero},
+				{Name: "bar", Chart: "bar"},
+			},
+			opts: &SyncOpts{HistoryMax: &three},
+			want: map[string]int{"foo": 3, "bar": 3},
+		},
+		{
+			name:     "command-line 0 for no limit",
+			releases: []ReleaseSpec{{Name: "foo", Chart: "foo", HistoryMax: &five}},
+			opts:     &SyncOpts{HistoryMax: &zero},
+			want:     map[string]int{"foo": 0},
+		},
+	}
+
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			state := &HelmState{
+				ReleaseSetSpec: ReleaseSetSpec{
+					HelmDefaults: tt.defaults,
+					Releases:     tt.releases,
+				},
+				logger:         logger,
+				valsRuntime:    valsRuntime,
+				RenderedValues: map[string]interface{}{},
+			}
+
+			helm := &historyMaxTestHelm{
+				Helm: &exectest.Helm{
+					Lists: map[exectest.ListKey]string{},
+				},
+				historyMax: map[string]int{},
+			}
+
+			var opts []SyncOpt
+			if tt.opts != nil {
+				opts = append(opts, tt.opts)
+			}
+
+			if errs := state.SyncReleases(&AffectedReleases{}, helm, []string{}, 1, opts...); len(errs) > 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+
+			if d := cmp.Diff(tt.want, helm.historyMax); d != "" {
+				t.Errorf("unexpected history max: want (-), got (+):\n%s", d)
+			}
+		})
+	}
+}
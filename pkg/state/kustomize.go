@@ -0,0 +1,99 @@
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+const (
+	KustomizeLoadRestrictionsNone     = "LoadRestrictionsNone"
+	KustomizeLoadRestrictionsRootOnly = "LoadRestrictionsRootOnly"
+)
+
+// KustomizeOptions are the options used while running `kustomize build` on a release whose chart is a kustomization
+type KustomizeOptions struct {
+	// EnableHelm, when set to true, passes `--enable-helm` to `kustomize build` so that the kustomization can inflate helm charts
+	EnableHelm bool `yaml:"enableHelm,omitempty"`
+	// LoadRestrictor is passed to `kustomize build` via `--load-restrictor`.
+	// It is either LoadRestrictionsNone (default) or LoadRestrictionsRootOnly
+	LoadRestrictor string `yaml:"loadRestrictor,omitempty"`
+	// EnableAlphaPlugins, when set to false, stops passing `--enable-alpha-plugins` to `kustomize build` (default true)
+	EnableAlphaPlugins *bool `yaml:"enableAlphaPlugins,omitempty"`
+}
+
+func (o *KustomizeOptions) validate() error {
+	switch o.LoadRestrictor {
+	case "", KustomizeLoadRestrictionsNone, KustomizeLoadRestrictionsRootOnly:
+	default:
+		return fmt.Errorf("invalid kustomizeOptions.loadRestrictor %q: it must be either %s or %s", o.LoadRestrictor, KustomizeLoadRestrictionsNone, KustomizeLoadRestrictionsRootOnly)
+	}
+
+	return nil
+}
+
+// needsPrebuild returns true when the options can't be handled by chartify and therefore
+// helmfile needs to run `kustomize build` by itself before handing the rendered manifests to chartify
+func (o *KustomizeOptions) needsPrebuild() bool {
+	return o.EnableHelm || o.LoadRestrictor != ""
+}
+
+// isKustomization returns true when dir is a directory containing a kustomization file
+func (st *HelmState) isKustomization(dir string) bool {
+	if !st.directoryExistsAt(dir) {
+		return false
+	}
+
+	for _, f := range []string{"kustomization.yaml", "kustomization.yml", "Kustomization"} {
+		if exists, err := st.fileExists(filepath.Join(dir, f)); err == nil && exists {
+			return true
+		}
+	}
+
+	return false
+}
+
+// kustomizeBuild runs `kustomize build` on the kustomization in dir with the options and writes the rendered manifests
+// into a temporary directory. It returns the temporary directory, which is meant to be removed by the caller.
+func (st *HelmState) kustomizeBuild(release *ReleaseSpec, dir string, opts *KustomizeOptions) (string, error) {
+	tempDir := st.tempDir
+	if tempDir == nil {
+		tempDir = ioutil.TempDir
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	out, err := tempDir("", "helmfile-kustomize-")
+	if err != nil {
+		return "", err
+	}
+
+	loadRestrictor := opts.LoadRestrictor
+	if loadRestrictor == "" {
+		loadRestrictor = KustomizeLoadRestrictionsNone
+	}
+
+	args := []string{"build", abs, "--output", filepath.Join(out, "kustomized.yaml"), "--load-restrictor", loadRestrictor}
+
+	if opts.EnableAlphaPlugins == nil || *opts.EnableAlphaPlugins {
+		args = append(args, "--enable-alpha-plugins")
+	}
+
+	if opts.EnableHelm {
+		args = append(args, "--enable-helm")
+		if st.DefaultHelmBinary != "" {
+			args = append(args, "--helm-command", st.DefaultHelmBinary)
+		}
+	}
+
+	st.logger.Debugf("Building kustomization for release %q", release.Name)
+
+	if _, err := st.execute("kustomize", args...); err != nil {
+		return out, err
+	}
+
+	return out, nil
+}
@@ -0,0 +1,143 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/roboll/helmfile/pkg/exectest"
+)
+
+func TestHelmState_PrepareChartify_KustomizeOptions(t *testing.T) {
+	testcases := []struct {
+		name             string
+		kustomization    bool
+		opts             KustomizeOptions
+		wantErr          string
+		wantAlphaPlugins bool
+		wantCommand      string
+	}{
+		{
+			name:          "not a kustomization",
+			kustomization: false,
+			opts:          KustomizeOptions{EnableHelm: true},
+			wantErr:       `release "myapp": kustomizeOptions requires chart "%s" to be a local directory containing a kustomization`,
+		},
+		{
+			name:          "invalid load restrictor",
+			kustomization: true,
+			opts:          KustomizeOptions{LoadRestrictor: "none"},
+			wantErr:       `release "myapp": invalid kustomizeOptions.loadRestrictor "none": it must be either LoadRestrictionsNone or LoadRestrictionsRootOnly`,
+		},
+		{
+			name:             "alpha plugins disabled",
+			kustomization:    true,
+			opts:             KustomizeOptions{EnableAlphaPlugins: boolValue(false)},
+			wantAlphaPlugins: false,
+		},
+		{
+			name:             "enable helm",
+			kustomization:    true,
+			opts:             KustomizeOptions{EnableHelm: true},
+			wantAlphaPlugins: true,
+			wantCommand:      "kustomize build %s --output %s/kustomized.yaml --load-restrictor LoadRestrictionsNone --enable-alpha-plugins --enable-helm --helm-command helm",
+		},
+		{
+			name:             "load restrictor",
+			kustomization:    true,
+			opts:             KustomizeOptions{LoadRestrictor: KustomizeLoadRestrictionsRootOnly, EnableAlphaPlugins: boolValue(false)},
+			wantAlphaPlugins: false,
+			wantCommand:      "kustomize build %s --output %s/kustomized.yaml --load-restrictor LoadRestrictionsRootOnly",
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			chart := t.TempDir()
+			if tc.kustomization {
+				if err := os.WriteFile(filepath.Join(chart, "kustomization.yaml"), []byte("resources: []"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			builtDir := filepath.Join(t.TempDir(), "built")
+
+			runner := &adoptTestRunner{}
+
+			state := &HelmState{
+				ReleaseSetSpec: ReleaseSetSpec{
+					DefaultHelmBinary: "helm",
+				},
+				logger:      logger,
+				valsRuntime: valsRuntime,
+				runner:      runner,
+				fileExists: func(f string) (bool, error) {
+					_, err := os.Stat(f)
+					return err == nil, nil
+				},
+				directoryExistsAt: directoryExistsAt,
+				removeFile:        os.Remove,
+				tempDir: func(string, string) (string, error) {
+					return builtDir, os.MkdirAll(builtDir, 0755)
+				},
+				RenderedValues: map[string]interface{}{},
+			}
+
+			release := &ReleaseSpec{
+				Name:             "myapp",
+				Chart:            chart,
+				KustomizeOptions: &tc.opts,
+			}
+
+			c, clean, err := state.PrepareChartify(&exectest.Helm{Helm3: true}, release, chart, 0)
+			defer clean()
+
+			if tc.wantErr != "" {
+				want := tc.wantErr
+				if strings.Contains(want, "%s") {
+					want = strings.Replace(want, "%s", chart, 1)
+				}
+				if err == nil || err.Error() != want {
+					t.Fatalf("unexpected error: want %q, got %v", want, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if c == nil {
+				t.Fatalf("expected chartify to run")
+			}
+
+			if c.Opts.EnableKustomizeAlphaPlugins != tc.wantAlphaPlugins {
+				t.Errorf("unexpected EnableKustomizeAlphaPlugins: want %v, got %v", tc.wantAlphaPlugins, c.Opts.EnableKustomizeAlphaPlugins)
+			}
+
+			var wantCommands []string
+			wantChart := ""
+			if tc.wantCommand != "" {
+				wantCommands = []string{strings.Replace(strings.Replace(tc.wantCommand, "%s", chart, 1), "%s", builtDir, 1)}
+				wantChart = builtDir
+			}
+
+			if d := cmp.Diff(wantCommands, runner.commands); d != "" {
+				t.Errorf("unexpected commands: want (-), got (+):\n%s", d)
+			}
+
+			if c.Chart != wantChart {
+				t.Errorf("unexpected chart: want %q, got %q", wantChart, c.Chart)
+			}
+
+			clean()
+
+			if _, err := os.Stat(builtDir); tc.wantCommand != "" && !os.IsNotExist(err) {
+				t.Errorf("expected %s to be removed", builtDir)
+			}
+		})
+	}
+}
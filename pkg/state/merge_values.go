@@ -0,0 +1,130 @@
+package state
+
+import (
+	"fmt"
+
+	"github.com/imdario/mergo"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// MergeValuesStrategyDeep deep-merges maps and replaces arrays, the same way helm merges multiple `--values` files
+	MergeValuesStrategyDeep = "deep"
+	// MergeValuesStrategyOverride replaces each top-level key as a whole with the one in the later values file
+	MergeValuesStrategyOverride = "override"
+	// MergeValuesStrategyAppendArrays deep-merges maps like MergeValuesStrategyDeep, and appends arrays instead of replacing them
+	MergeValuesStrategyAppendArrays = "append-arrays"
+)
+
+var mergeValuesStrategies = []string{MergeValuesStrategyDeep, MergeValuesStrategyOverride, MergeValuesStrategyAppendArrays}
+
+// ValidateMergeValuesStrategy returns an error when the strategy is neither empty nor one of the supported strategies
+func ValidateMergeValuesStrategy(strategy string) error {
+	if strategy == "" {
+		return nil
+	}
+
+	for _, s := range mergeValuesStrategies {
+		if strategy == s {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unsupported merge values strategy %q: it must be one of %s, %s, or %s", strategy, MergeValuesStrategyDeep, MergeValuesStrategyOverride, MergeValuesStrategyAppendArrays)
+}
+
+// mergeValuesStrategy returns the strategy to merge the values and secrets files of each release with,
+// which defaults to MergeValuesStrategyDeep
+func (st *HelmState) mergeValuesStrategy() (string, error) {
+	if err := ValidateMergeValuesStrategy(st.MergeValuesStrategy); err != nil {
+		return "", fmt.Errorf("%s: %w", st.FilePath, err)
+	}
+
+	if st.MergeValuesStrategy == "" {
+		return MergeValuesStrategyDeep, nil
+	}
+
+	return st.MergeValuesStrategy, nil
+}
+
+// mergeValuesFilesWithStrategy merges the values files in order with the strategy
+func (st *HelmState) mergeValuesFilesWithStrategy(files []string, strategy string) (map[string]interface{}, error) {
+	merged := map[string]interface{}{}
+
+	for _, f := range files {
+		src := map[string]interface{}{}
+
+		srcBytes, err := st.readFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", f, err)
+		}
+
+		if err := yaml.Unmarshal(srcBytes, &src); err != nil {
+			return nil, fmt.Errorf("unmarshalling yaml %s: %w", f, err)
+		}
+
+		if err := mergeValues(merged, src, strategy); err != nil {
+			return nil, fmt.Errorf("merging %s: %w", f, err)
+		}
+	}
+
+	return merged, nil
+}
+
+func mergeValues(dst, src map[string]interface{}, strategy string) error {
+	switch strategy {
+	case MergeValuesStrategyOverride:
+		for k, v := range src {
+			dst[k] = v
+		}
+		return nil
+	case MergeValuesStrategyAppendArrays:
+		return mergo.Merge(&dst, &src, mergo.WithOverride, mergo.WithOverwriteWithEmptyValue, mergo.WithAppendSlice)
+	default:
+		return mergo.Merge(&dst, &src, mergo.WithOverride, mergo.WithOverwriteWithEmptyValue)
+	}
+}
+
+// mergeReleaseValuesFiles merges the values files generated for the release into one file with the merge values strategy,
+// so that helm is given the values merged the same way as `write-values` writes them.
+// It returns the files as is for MergeValuesStrategyDeep, as helm merges them the same way.
+// The given files are removed once merged, and the merged file is returned instead.
+func (st *HelmState) mergeReleaseValuesFiles(release *ReleaseSpec, files []string, secret bool) ([]string, error) {
+	strategy, err := st.mergeValuesStrategy()
+	if err != nil {
+		return files, err
+	}
+
+	if strategy == MergeValuesStrategyDeep || len(files) < 2 {
+		return files, nil
+	}
+
+	merged, err := st.mergeValuesFilesWithStrategy(files, strategy)
+	if err != nil {
+		return files, fmt.Errorf("merging values of release %q with the %s strategy: %w", release.Name, strategy, err)
+	}
+
+	// The files are removed before writing the merged one, which can be named the same as one of them with HELMFILE_TEMPDIR
+	st.removeFiles(files)
+
+	valfile, err := createTempValuesFile(release, merged)
+	if err != nil {
+		return nil, err
+	}
+	defer valfile.Close()
+
+	mergedFiles := []string{valfile.Name()}
+
+	encoder := yaml.NewEncoder(valfile)
+	defer encoder.Close()
+
+	if err := encoder.Encode(merged); err != nil {
+		return mergedFiles, err
+	}
+
+	if secret && st.DebugFiles != nil {
+		st.DebugFiles.markSecrets(mergedFiles)
+	}
+
+	return mergedFiles, nil
+}
@@ -0,0 +1,314 @@
+package state
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// ociTagCache caches the tags of OCI charts, so that the registry is queried at most once per chart
+// while charts are prepared concurrently.
+type ociTagCache struct {
+	mu   sync.Mutex
+	tags map[string][]string
+}
+
+func (c *ociTagCache) get(ref string, list func() ([]string, error)) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if tags, ok := c.tags[ref]; ok {
+		return tags, nil
+	}
+
+	tags, err := list()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.tags == nil {
+		c.tags = map[string][]string{}
+	}
+	c.tags[ref] = tags
+
+	return tags, nil
+}
+
+// isVersionConstraint returns true when the version is a constraint like `~1.2.0` or `>=1.0.0`,
+// rather than a version, including a non-strict one like `1.2` that may be an existing tag.
+func isVersionConstraint(v string) bool {
+	if v == "" || v == "latest" {
+		return false
+	}
+
+	_, err := semver.NewVersion(v)
+
+	return err != nil
+}
+
+// resolveOCIChartVersion returns the tag of the highest version of the OCI chart that satisfies the constraint.
+func (st *HelmState) resolveOCIChartVersion(cache *ociTagCache, repo *RepositorySpec, name, constraint string) (string, error) {
+	c, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return "", fmt.Errorf("invalid version constraint %q: %w", constraint, err)
+	}
+
+	ref := ociReference(repo, name)
+
+	tags, err := cache.get(ref, func() ([]string, error) {
+		return st.listOCITags(repo, name)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		highest    *semver.Version
+		highestTag string
+	)
+
+	for _, tag := range tags {
+		// Helm replaces `+` in the chart version with `_` in the tag, as `+` isn't allowed in OCI tags
+		v, err := semver.NewVersion(strings.ReplaceAll(tag, "_", "+"))
+		if err != nil {
+			continue
+		}
+
+		if c.Check(v) && (highest == nil || v.GreaterThan(highest)) {
+			highest = v
+			highestTag = tag
+		}
+	}
+
+	if highest == nil {
+		return "", fmt.Errorf("no version of the OCI chart %q satisfies the constraint %q. available tags are: %s", ref, constraint, strings.Join(tags, ", "))
+	}
+
+	st.logger.Debugf("resolved the version constraint %q of the OCI chart %q to %s", constraint, ref, highestTag)
+
+	return highestTag, nil
+}
+
+func ociReference(repo *RepositorySpec, name string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(repo.URL, "oci://"), "/") + "/" + name
+}
+
+type ociTagList struct {
+	Tags []string `json:"tags"`
+}
+
+// listOCITags lists the tags of the chart with the tag listing API of the OCI distribution spec,
+// which is the API helm's registry client uses.
+// The registry is authenticated with the credentials of the repository, in the same way as `helm registry login`.
+func (st *HelmState) listOCITags(repo *RepositorySpec, name string) ([]string, error) {
+	ref := ociReference(repo, name)
+
+	hostAndPath := strings.SplitN(ref, "/", 2)
+	if len(hostAndPath) != 2 {
+		return nil, fmt.Errorf("invalid OCI chart reference %q", ref)
+	}
+	host, path := hostAndPath[0], hostAndPath[1]
+
+	username, password, err := st.resolveRepositoryCredentials(*repo)
+	if err != nil {
+		return nil, err
+	}
+	username, password = gatherOCIUsernamePassword(repo.Name, username, password)
+
+	client := st.httpClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	if repo.SkipTLSVerify == "true" {
+		client = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		}
+	}
+
+	r := &ociRegistryRequester{client: client, username: username, password: password}
+
+	var tags []string
+
+	next := fmt.Sprintf("https://%s/v2/%s/tags/list", host, path)
+
+	for next != "" {
+		res, err := r.get(next)
+		if err != nil {
+			return nil, fmt.Errorf("listing tags of the OCI chart %q: %w", ref, err)
+		}
+
+		var list ociTagList
+
+		err = json.NewDecoder(res.Body).Decode(&list)
+		_ = res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("listing tags of the OCI chart %q: decoding the response from %s: %w", ref, next, err)
+		}
+
+		tags = append(tags, list.Tags...)
+
+		next, err = nextLink(next, res.Header.Get("Link"))
+		if err != nil {
+			return nil, fmt.Errorf("listing tags of the OCI chart %q: %w", ref, err)
+		}
+	}
+
+	return tags, nil
+}
+
+var linkNextRegexp = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="?next"?`)
+
+// nextLink returns the URL of the next page in the Link header, resolved against the current URL
+func nextLink(current, link string) (string, error) {
+	m := linkNextRegexp.FindStringSubmatch(link)
+	if m == nil {
+		return "", nil
+	}
+
+	base, err := url.Parse(current)
+	if err != nil {
+		return "", err
+	}
+
+	next, err := base.Parse(m[1])
+	if err != nil {
+		return "", fmt.Errorf("invalid Link header %q: %w", link, err)
+	}
+
+	return next.String(), nil
+}
+
+// ociRegistryRequester sends GET requests to an OCI registry.
+// It handles the bearer token authentication of registries like Docker Hub, GHCR and ECR in addition to the basic authentication.
+type ociRegistryRequester struct {
+	client             *http.Client
+	username, password string
+	token              string
+}
+
+var authChallengeParamRegexp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+func (r *ociRegistryRequester) get(u string) (*http.Response, error) {
+	res, err := r.do(u)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusUnauthorized && r.token == "" {
+		challenge := res.Header.Get("WWW-Authenticate")
+		_ = res.Body.Close()
+
+		if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+			if r.username == "" {
+				return nil, fmt.Errorf("GET %s: %s: the registry requires credentials. Set username and password of the repository", u, res.Status)
+			}
+			return nil, fmt.Errorf("GET %s: %s", u, res.Status)
+		}
+
+		if err := r.fetchToken(challenge); err != nil {
+			return nil, err
+		}
+
+		res, err = r.do(u)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		_ = res.Body.Close()
+		return nil, fmt.Errorf("GET %s: unexpected status %s", u, res.Status)
+	}
+
+	return res, nil
+}
+
+func (r *ociRegistryRequester) do(u string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	} else if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+
+	return r.client.Do(req)
+}
+
+// fetchToken obtains a bearer token from the authorization server given in the challenge
+func (r *ociRegistryRequester) fetchToken(challenge string) error {
+	params := map[string]string{}
+	for _, m := range authChallengeParamRegexp.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(m[1])] = m[2]
+	}
+
+	realm, ok := params["realm"]
+	if !ok {
+		return fmt.Errorf("missing realm in the authentication challenge %q", challenge)
+	}
+
+	tokenURL, err := url.Parse(realm)
+	if err != nil {
+		return fmt.Errorf("invalid realm in the authentication challenge %q: %w", challenge, err)
+	}
+
+	q := tokenURL.Query()
+	for _, k := range []string{"service", "scope"} {
+		if v, ok := params[k]; ok {
+			q.Set(k, v)
+		}
+	}
+	tokenURL.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+
+	res, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("fetching a token from %s: unexpected status %s", realm, res.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return fmt.Errorf("fetching a token from %s: %w", realm, err)
+	}
+
+	r.token = token.Token
+	if r.token == "" {
+		r.token = token.AccessToken
+	}
+
+	if r.token == "" {
+		return fmt.Errorf("fetching a token from %s: no token in the response", realm)
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newTestOCIRegistry starts a registry that serves the tags of charts/qux in two pages,
+// and requires a bearer token obtained with the username `user` and the password `pass`.
+func newTestOCIRegistry(t *testing.T, tags ...string) (*httptest.Server, *int32) {
+	t.Helper()
+
+	var listings int32
+
+	mux := http.NewServeMux()
+
+	srv := httptest.NewTLSServer(mux)
+	t.Cleanup(srv.Close)
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if !ok || u != "user" || p != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("scope") != "repository:charts/qux:pull" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": "t0k3n"})
+	})
+
+	mux.HandleFunc("/v2/charts/qux/tags/list", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer t0k3n" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry",scope="repository:charts/qux:pull"`, srv.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		page := tags[:len(tags)/2]
+		if r.URL.Query().Get("last") == "" {
+			atomic.AddInt32(&listings, 1)
+			w.Header().Set("Link", `</v2/charts/qux/tags/list?last=x&n=2>; rel="next"`)
+		} else {
+			page = tags[len(tags)/2:]
+		}
+
+		_ = json.NewEncoder(w).Encode(ociTagList{Tags: page})
+	})
+
+	return srv, &listings
+}
+
+func TestHelmState_ResolveOCIChartVersion(t *testing.T) {
+	srv, listings := newTestOCIRegistry(t, "1.0.0", "2.0.1", "2.0.3_build.1", "2.1.0", "latest")
+
+	repo := &RepositorySpec{
+		Name:     "myoci",
+		URL:      "oci://" + strings.TrimPrefix(srv.URL, "https://") + "/charts",
+		OCI:      true,
+		Username: "user",
+		Password: "pass",
+	}
+
+	st := &HelmState{
+		logger:     logger,
+		httpClient: srv.Client(),
+	}
+
+	cache := &ociTagCache{}
+
+	testcases := []struct {
+		constraint string
+		want       string
+		wantErr    string
+	}{
+		{constraint: "~2.0.0", want: "2.0.3_build.1"},
+		{constraint: "^2", want: "2.1.0"},
+		{constraint: "<2", want: "1.0.0"},
+		{
+			constraint: ">=3",
+			wantErr:    fmt.Sprintf(`no version of the OCI chart "%s/charts/qux" satisfies the constraint ">=3". available tags are: 1.0.0, 2.0.1, 2.0.3_build.1, 2.1.0, latest`, strings.TrimPrefix(srv.URL, "https://")),
+		},
+	}
+
+	for _, tc := range testcases {
+		got, err := st.resolveOCIChartVersion(cache, repo, "qux", tc.constraint)
+		if tc.wantErr != "" {
+			if err == nil || err.Error() != tc.wantErr {
+				t.Errorf("%s: unexpected error: want %q, got %v", tc.constraint, tc.wantErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.constraint, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: unexpected version: want %s, got %s", tc.constraint, tc.want, got)
+		}
+	}
+
+	if n := atomic.LoadInt32(listings); n != 1 {
+		t.Errorf("unexpected number of tag listings: want 1, got %d", n)
+	}
+}
+
+func TestHelmState_ResolveOCIChartVersion_Unauthorized(t *testing.T) {
+	srv, _ := newTestOCIRegistry(t, "1.0.0")
+
+	repo := &RepositorySpec{
+		Name: "myoci",
+		URL:  strings.TrimPrefix(srv.URL, "https://") + "/charts",
+		OCI:  true,
+	}
+
+	st := &HelmState{
+		logger:     logger,
+		httpClient: srv.Client(),
+	}
+
+	_, err := st.resolveOCIChartVersion(&ociTagCache{}, repo, "qux", "~1.0")
+
+	want := fmt.Sprintf(`listing tags of the OCI chart "%s/charts/qux": fetching a token from %s/token: unexpected status 401 Unauthorized`, strings.TrimPrefix(srv.URL, "https://"), srv.URL)
+	if err == nil || err.Error() != want {
+		t.Errorf("unexpected error: want %q, got %v", want, err)
+	}
+}
+
+func TestIsVersionConstraint(t *testing.T) {
+	testcases := map[string]bool{
+		"":        false,
+		"latest":  false,
+		"1.2.3":   false,
+		"1.2":     false,
+		"v1.2.3":  false,
+		"~1.2.0":  true,
+		"^1":      true,
+		">=1, <2": true,
+		"1.x":     true,
+	}
+
+	for v, want := range testcases {
+		if got := isVersionConstraint(v); got != want {
+			t.Errorf("isVersionConstraint(%q): want %v, got %v", v, want, got)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package state
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+type releaseLocation struct {
+	kubeContext string
+	namespace   string
+}
+
+// DetectOrphanReleases lists the helm releases installed in the namespaces of the releases defined in the state,
+// and returns the ones that are not defined in the state.
+//
+// Only the namespaces in the allowlist are looked into, and each of them only with the kube contexts the state
+// deploys releases to the namespace with. It never looks into a namespace helmfile has no release in.
+// Each returned release has the namespace and the kube context set, so that it can be deleted with DeleteReleasesForSync.
+func (st *HelmState) DetectOrphanReleases(helm helmexec.Interface, namespaces []string) ([]ReleaseSpec, error) {
+	allowed := map[string]bool{}
+	for _, ns := range namespaces {
+		allowed[ns] = true
+	}
+
+	var locations []releaseLocation
+
+	seen := map[releaseLocation]bool{}
+
+	// The namespace and the kube context can be overridden with --namespace and --kube-context
+	releases := st.GetReleasesWithOverrides()
+
+	for i := range releases {
+		r := &releases[i]
+
+		if r.Namespace == "" || !allowed[r.Namespace] {
+			continue
+		}
+
+		loc := releaseLocation{kubeContext: st.kubeContext(r), namespace: r.Namespace}
+		if seen[loc] {
+			continue
+		}
+		seen[loc] = true
+
+		locations = append(locations, loc)
+	}
+
+	var orphans []ReleaseSpec
+
+	for _, loc := range locations {
+		query := ReleaseSpec{Namespace: loc.namespace, KubeContext: loc.kubeContext}
+
+		flags := st.connectionFlags(helm, &query)
+		flags = append(flags, "--namespace", loc.namespace, "--deployed", "--failed", "--pending")
+
+		out, err := helm.List(st.createHelmContext(&query, 0), ".*", flags...)
+		if err != nil {
+			return nil, err
+		}
+
+		var names []string
+
+		for _, line := range strings.Split(out, "\n") {
+			fields := strings.Fields(line)
+			// Helm 2 prints the header along with the releases
+			if len(fields) == 0 || fields[0] == "NAME" {
+				continue
+			}
+
+			names = append(names, fields[0])
+		}
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			orphan := ReleaseSpec{Name: name, Namespace: loc.namespace, KubeContext: loc.kubeContext}
+
+			if st.DefinesRelease(orphan) {
+				continue
+			}
+
+			orphans = append(orphans, orphan)
+		}
+	}
+
+	return orphans, nil
+}
+
+// DefinesRelease returns true when the state defines the release of the same name in the same namespace and kube context,
+// regardless of whether it is marked `installed: false` or not.
+func (st *HelmState) DefinesRelease(release ReleaseSpec) bool {
+	releases := st.GetReleasesWithOverrides()
+
+	for i := range releases {
+		r := &releases[i]
+
+		if r.Name == release.Name && r.Namespace == release.Namespace && st.kubeContext(r) == release.KubeContext {
+			return true
+		}
+	}
+
+	return false
+}
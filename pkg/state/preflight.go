@@ -0,0 +1,135 @@
+package state
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// kubeconfig is the part of a kubeconfig file that is needed to check kube contexts
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Contexts       []struct {
+		Name string `yaml:"name"`
+	} `yaml:"contexts"`
+}
+
+// kubeconfigPaths returns the kubeconfig files in the same way as kubectl does,
+// that is $KUBECONFIG if set, or ~/.kube/config otherwise
+func kubeconfigPaths() ([]string, error) {
+	if env := os.Getenv("KUBECONFIG"); env != "" {
+		var paths []string
+		for _, p := range filepath.SplitList(env) {
+			if p != "" {
+				paths = append(paths, p)
+			}
+		}
+		return paths, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("unable to locate the kubeconfig: %w", err)
+	}
+
+	return []string{filepath.Join(home, ".kube", "config")}, nil
+}
+
+// PreflightKubeContexts verifies that the kube context of every release exists in the kubeconfig,
+// so that a misconfigured kubeContext fails fast with the list of the available contexts,
+// rather than with an error from helm in the middle of the deployment.
+// Each unique kube context is checked once.
+func (st *HelmState) PreflightKubeContexts() error {
+	releasesByContext := map[string][]string{}
+
+	for i := range st.Releases {
+		release := st.Releases[i]
+
+		st.ApplyOverrides(&release)
+
+		kubeContext := st.kubeContext(&release)
+		releasesByContext[kubeContext] = append(releasesByContext[kubeContext], release.Name)
+	}
+
+	if len(releasesByContext) == 0 {
+		return nil
+	}
+
+	paths, err := kubeconfigPaths()
+	if err != nil {
+		return err
+	}
+
+	var (
+		currentContext string
+		available      []string
+		found          []string
+	)
+
+	known := map[string]bool{}
+
+	for _, p := range paths {
+		bs, err := st.readFile(p)
+		if err != nil {
+			// kubectl ignores the missing files in $KUBECONFIG as well
+			if os.IsNotExist(err) {
+				continue
+			}
+			return fmt.Errorf("reading kubeconfig %s: %w", p, err)
+		}
+
+		found = append(found, p)
+
+		var conf kubeconfig
+		if err := yaml.Unmarshal(bs, &conf); err != nil {
+			return fmt.Errorf("parsing kubeconfig %s: %w", p, err)
+		}
+
+		// The first file to set current-context wins, as with kubectl
+		if currentContext == "" {
+			currentContext = conf.CurrentContext
+		}
+
+		for _, c := range conf.Contexts {
+			if !known[c.Name] {
+				known[c.Name] = true
+				available = append(available, c.Name)
+			}
+		}
+	}
+
+	if len(found) == 0 {
+		return fmt.Errorf("preflight: no kubeconfig found in %s", strings.Join(paths, ", "))
+	}
+
+	sort.Strings(available)
+
+	contexts := make([]string, 0, len(releasesByContext))
+	for c := range releasesByContext {
+		contexts = append(contexts, c)
+	}
+	sort.Strings(contexts)
+
+	for _, c := range contexts {
+		releases := releasesByContext[c]
+
+		if c == "" {
+			if currentContext == "" {
+				return fmt.Errorf("preflight: releases %s have no kubeContext and the kubeconfig has no current-context. available contexts are: %s", strings.Join(releases, ", "), strings.Join(available, ", "))
+			}
+			c = currentContext
+		}
+
+		if !known[c] {
+			return fmt.Errorf("preflight: kube context %q of releases %s does not exist in the kubeconfig %s. available contexts are: %s", c, strings.Join(releases, ", "), strings.Join(found, ", "), strings.Join(available, ", "))
+		}
+
+		st.logger.Debugf("preflight: found kube context %q for releases %s", c, strings.Join(releases, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHelmState_PreflightKubeContexts(t *testing.T) {
+	dir := t.TempDir()
+
+	kubeconfigs := map[string]string{
+		"config": `
+current-context: dev
+contexts:
+- name: dev
+  context:
+    cluster: dev
+- name: staging
+  context:
+    cluster: staging
+`,
+		"prod": `
+contexts:
+- name: prod
+  context:
+    cluster: prod
+`,
+	}
+
+	for name, content := range kubeconfigs {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := filepath.Join(dir, "config")
+
+	testcases := []struct {
+		name                string
+		kubeconfig          string
+		helmDefaults        HelmSpec
+		overrideKubeContext string
+		releases            []ReleaseSpec
+		wantErr             string
+	}{
+		{
+			name:       "existing contexts",
+			kubeconfig: config,
+			releases: []ReleaseSpec{
+				{Name: "foo", KubeContext: "staging"},
+				{Name: "bar"},
+			},
+		},
+		{
+			name:       "merged kubeconfigs",
+			kubeconfig: config + string(filepath.ListSeparator) + filepath.Join(dir, "missing") + string(filepath.ListSeparator) + filepath.Join(dir, "prod"),
+			releases: []ReleaseSpec{
+				{Name: "foo", KubeContext: "prod"},
+			},
+		},
+		{
+			name:         "missing context",
+			kubeconfig:   config,
+			helmDefaults: HelmSpec{KubeContext: "prod"},
+			releases: []ReleaseSpec{
+				{Name: "foo"},
+				{Name: "bar", KubeContext: "dev"},
+				{Name: "baz"},
+			},
+			wantErr: `preflight: kube context "prod" of releases foo, baz does not exist in the kubeconfig ` + config + `. available contexts are: dev, staging`,
+		},
+		{
+			name:                "missing override",
+			kubeconfig:          config,
+			overrideKubeContext: "qa",
+			releases: []ReleaseSpec{
+				{Name: "foo", KubeContext: "dev"},
+			},
+			wantErr: `preflight: kube context "qa" of releases foo does not exist in the kubeconfig ` + config + `. available contexts are: dev, staging`,
+		},
+		{
+			name:       "no current-context",
+			kubeconfig: filepath.Join(dir, "prod"),
+			releases: []ReleaseSpec{
+				{Name: "foo"},
+			},
+			wantErr: `preflight: releases foo have no kubeContext and the kubeconfig has no current-context. available contexts are: prod`,
+		},
+		{
+			name:       "no kubeconfig",
+			kubeconfig: filepath.Join(dir, "missing"),
+			releases: []ReleaseSpec{
+				{Name: "foo"},
+			},
+			wantErr: `preflight: no kubeconfig found in ` + filepath.Join(dir, "missing"),
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("KUBECONFIG", tc.kubeconfig)
+
+			st := &HelmState{
+				ReleaseSetSpec: ReleaseSetSpec{
+					HelmDefaults:        tc.helmDefaults,
+					Releases:            tc.releases,
+					OverrideKubeContext: tc.overrideKubeContext,
+				},
+				logger:   logger,
+				readFile: os.ReadFile,
+			}
+
+			err := st.PreflightKubeContexts()
+
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			if err == nil || err.Error() != tc.wantErr {
+				t.Errorf("unexpected error: want %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
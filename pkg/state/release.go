@@ -84,6 +84,24 @@ func (r ReleaseSpec) ExecuteTemplateExpressions(renderer *tmpl.FileRenderer) (*R
 		result.VerifyTemplate = &resultTmpl
 	}
 
+	if result.KubeContextTemplate != nil {
+		ts := *result.KubeContextTemplate
+		resultTmpl, err := renderer.RenderTemplateContentToString([]byte(ts))
+		if err != nil {
+			return nil, fmt.Errorf("failed executing template expressions in release \"%s\".kubeContextTemplate = \"%s\": %v", r.Name, ts, err)
+		}
+		result.KubeContextTemplate = &resultTmpl
+	}
+
+	if result.ChartTemplate != nil {
+		ts := *result.ChartTemplate
+		resultTmpl, err := renderer.RenderTemplateContentToString([]byte(ts))
+		if err != nil {
+			return nil, fmt.Errorf("failed executing template expressions in release \"%s\".chartTemplate = \"%s\": %v", r.Name, ts, err)
+		}
+		result.ChartTemplate = &resultTmpl
+	}
+
 	for key, val := range result.Labels {
 		ts := val
 		s, err := renderer.RenderTemplateContentToBuffer([]byte(ts))
@@ -0,0 +1,65 @@
+package state
+
+import (
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+const (
+	releaseEventStarted   = "started"
+	releaseEventSucceeded = "succeeded"
+	releaseEventChanged   = "changed"
+	releaseEventFailed    = "failed"
+)
+
+// logReleaseEvent logs the structured event on the operation like sync, diff, and delete on the release.
+// The event is emitted only in the JSON log format. See helmexec.EventLogger for more information.
+func (st *HelmState) logReleaseEvent(operation, status string, release *ReleaseSpec, err error) {
+	if st.logger == nil {
+		return
+	}
+
+	fields := []interface{}{
+		"operation", operation,
+		"status", status,
+		"release", release.Name,
+		"namespace", release.Namespace,
+		"kubeContext", st.kubeContext(release),
+		"chart", release.Chart,
+	}
+
+	if err != nil {
+		fields = append(fields, "error", err.Error())
+	}
+
+	helmexec.EventLogger(st.logger).Infow(operation+" "+status, fields...)
+}
+
+// deleteRelease runs `helm delete` on the release while logging the structured events on it
+func (st *HelmState) deleteRelease(context helmexec.HelmContext, helm helmexec.Interface, release *ReleaseSpec, flags ...string) error {
+	st.logReleaseEvent("delete", releaseEventStarted, release, nil)
+
+	err := helm.DeleteRelease(context, release.Name, flags...)
+	if err != nil {
+		st.logReleaseEvent("delete", releaseEventFailed, release, err)
+	} else {
+		st.logReleaseEvent("delete", releaseEventSucceeded, release, nil)
+	}
+
+	return err
+}
+
+// diffRelease runs helm-diff on the release while logging the structured events on it
+func (st *HelmState) diffRelease(context helmexec.HelmContext, helm helmexec.Interface, release *ReleaseSpec, suppressDiff bool, flags ...string) error {
+	st.logReleaseEvent("diff", releaseEventStarted, release, nil)
+
+	err := helm.DiffRelease(context, release.Name, normalizeChart(st.basePath, release.Chart), suppressDiff, flags...)
+	if e, ok := err.(helmexec.ExitError); ok && e.ExitStatus() == 2 {
+		st.logReleaseEvent("diff", releaseEventChanged, release, nil)
+	} else if err != nil {
+		st.logReleaseEvent("diff", releaseEventFailed, release, err)
+	} else {
+		st.logReleaseEvent("diff", releaseEventSucceeded, release, nil)
+	}
+
+	return err
+}
@@ -0,0 +1,80 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/roboll/helmfile/pkg/exectest"
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+func TestHelmState_SyncReleases_ReleaseEvents(t *testing.T) {
+	var buf bytes.Buffer
+
+	jsonLogger, err := helmexec.NewLoggerWithFormat(&buf, "info", helmexec.LogFormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := &HelmState{
+		ReleaseSetSpec: ReleaseSetSpec{
+			Releases: []ReleaseSpec{
+				{Name: "foo", Chart: "stable/foo", Namespace: "ns", KubeContext: "ctx"},
+				{Name: "bar-error", Chart: "stable/bar", Namespace: "ns"},
+			},
+		},
+		logger:         jsonLogger,
+		valsRuntime:    valsRuntime,
+		RenderedValues: map[string]interface{}{},
+	}
+
+	helm := &exectest.Helm{Lists: map[exectest.ListKey]string{}}
+
+	if errs := state.SyncReleases(&AffectedReleases{}, helm, []string{}, 1); len(errs) != 1 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	var got []map[string]interface{}
+	for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var e map[string]interface{}
+		if err := json.Unmarshal([]byte(l), &e); err != nil {
+			t.Fatalf("unexpected error parsing %q: %v", l, err)
+		}
+		if e["logger"] != helmexec.EventLoggerName {
+			continue
+		}
+		delete(e, "ts")
+		got = append(got, e)
+	}
+
+	event := func(msg, status, release, chart, kubeContext string) map[string]interface{} {
+		return map[string]interface{}{
+			"level":       "info",
+			"logger":      helmexec.EventLoggerName,
+			"msg":         msg,
+			"operation":   "sync",
+			"status":      status,
+			"release":     release,
+			"namespace":   "ns",
+			"kubeContext": kubeContext,
+			"chart":       chart,
+		}
+	}
+
+	failed := event("sync failed", "failed", "bar-error", "stable/bar", "")
+	failed["error"] = "error"
+
+	want := []map[string]interface{}{
+		event("sync started", "started", "foo", "stable/foo", "ctx"),
+		event("sync succeeded", "succeeded", "foo", "stable/foo", "ctx"),
+		event("sync started", "started", "bar-error", "stable/bar", ""),
+		failed,
+	}
+
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("unexpected events: want (-), got (+):\n%s", d)
+	}
+}
@@ -0,0 +1,75 @@
+package state
+
+import (
+	"sync"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+// releaseInstalledCache memoizes whether each release is installed or not,
+// so that a helmfile run doesn't run `helm list` for the same release in each of the diff, delete, and sync phases.
+//
+// It is safe for concurrent use. Concurrent lookups for the same release wait for the first one to complete
+// instead of running `helm list` on their own.
+// A nil cache caches nothing.
+type releaseInstalledCache struct {
+	mu      sync.Mutex
+	entries map[string]*releaseInstalledEntry
+}
+
+type releaseInstalledEntry struct {
+	done      chan struct{}
+	installed bool
+	err       error
+}
+
+func newReleaseInstalledCache() *releaseInstalledCache {
+	return &releaseInstalledCache{entries: map[string]*releaseInstalledEntry{}}
+}
+
+// releaseInstalledCacheKey returns the cache key for the release.
+// The tiller namespace is included as the same release ID may refer to different releases managed by different tillers.
+func releaseInstalledCacheKey(context helmexec.HelmContext, release *ReleaseSpec) string {
+	return context.TillerNamespace + "/" + ReleaseToID(release)
+}
+
+// get returns the cached installed state of the release, or calls isInstalled to populate the cache.
+// An error returned by isInstalled is not cached so that the next lookup retries.
+func (c *releaseInstalledCache) get(key string, isInstalled func() (bool, error)) (bool, error) {
+	if c == nil {
+		return isInstalled()
+	}
+
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if !ok {
+		e = &releaseInstalledEntry{done: make(chan struct{})}
+		c.entries[key] = e
+	}
+	c.mu.Unlock()
+
+	if ok {
+		<-e.done
+		return e.installed, e.err
+	}
+
+	e.installed, e.err = isInstalled()
+	if e.err != nil {
+		c.invalidate(key)
+	}
+	close(e.done)
+
+	return e.installed, e.err
+}
+
+// invalidate removes the cached installed state of the release so that the next lookup runs `helm list` again.
+// It must be called whenever helmfile installs or deletes the release.
+func (c *releaseInstalledCache) invalidate(key string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	delete(c.entries, key)
+	c.mu.Unlock()
+}
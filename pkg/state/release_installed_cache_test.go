@@ -0,0 +1,71 @@
+package state
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/roboll/helmfile/pkg/exectest"
+)
+
+func TestHelmState_isReleaseInstalled_Cache(t *testing.T) {
+	st := &HelmState{
+		ReleaseSetSpec: ReleaseSetSpec{
+			Releases: []ReleaseSpec{
+				{Name: "releaseA"},
+				{Name: "releaseB", Installed: boolValue(false)},
+				{Name: "releaseC", Installed: boolValue(false)},
+			},
+		},
+		logger:            logger,
+		installedReleases: newReleaseInstalledCache(),
+		RenderedValues:    map[string]interface{}{},
+	}
+
+	helm := &exectest.Helm{
+		Lists: map[exectest.ListKey]string{
+			{Filter: "^releaseA$", Flags: "--deleting--deployed--failed--pending"}: "releaseA",
+			{Filter: "^releaseB$", Flags: "--deleting--deployed--failed--pending"}: "releaseB",
+		},
+		ListsMutex: &sync.Mutex{},
+	}
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		for j := range st.Releases {
+			wg.Add(1)
+			go func(r ReleaseSpec) {
+				defer wg.Done()
+				if _, err := st.isReleaseInstalled(st.createHelmContext(&r, 0), helm, r); err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}(st.Releases[j])
+		}
+	}
+	wg.Wait()
+
+	deleted, err := st.DetectReleasesToBeDeletedForSync(helm, st.Releases)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(deleted) != 1 || deleted[0].Name != "releaseB" {
+		t.Errorf("unexpected releases to be deleted: %v", deleted)
+	}
+
+	if len(helm.Listed) != len(st.Releases) {
+		t.Errorf("helm list must be called once per release: want %d calls, got %d: %v", len(st.Releases), len(helm.Listed), helm.Listed)
+	}
+
+	if errs := st.DeleteReleases(&AffectedReleases{}, helm, 1, false); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	for _, r := range st.Releases {
+		if _, err := st.isReleaseInstalled(st.createHelmContext(&r, 0), helm, r); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if want := 2 * len(st.Releases); len(helm.Listed) != want {
+		t.Errorf("helm list must be called again after the deletion: want %d calls, got %d: %v", want, len(helm.Listed), helm.Listed)
+	}
+}
@@ -0,0 +1,298 @@
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/roboll/helmfile/pkg/app/version"
+	"github.com/roboll/helmfile/pkg/helmexec"
+	"gopkg.in/yaml.v2"
+)
+
+// ReleaseVersionLock is the content of the release version lock file written by `helmfile lock`.
+// It is distinct from the lock file written by `helmfile deps`, which is keyed by chart name rather than by release.
+type ReleaseVersionLock struct {
+	Version  string                 `yaml:"version"`
+	Releases []LockedReleaseVersion `yaml:"releases"`
+}
+
+// LockedReleaseVersion is the exact chart version resolved for a release's version constraint.
+type LockedReleaseVersion struct {
+	// ID is the release ID as computed by ReleaseToID
+	ID    string `yaml:"id"`
+	Chart string `yaml:"chart"`
+	// VersionConstraint is the `version` of the release at the time of locking. Empty means the latest version.
+	VersionConstraint string `yaml:"versionConstraint"`
+	Version           string `yaml:"version"`
+}
+
+type searchRepoResult struct {
+	Name    string `yaml:"name"`
+	Version string `yaml:"version"`
+}
+
+// ReleaseVersionLockFile returns the path to the release version lock file for the state file,
+// like `helmfile.versions.lock` for `helmfile.yaml`.
+func (st *HelmState) ReleaseVersionLockFile() string {
+	filename := filepath.Base(st.FilePath)
+	filename = strings.TrimSuffix(filename, ".gotmpl")
+	filename = strings.TrimSuffix(filename, ".yaml")
+	filename = strings.TrimSuffix(filename, ".yml")
+
+	return fmt.Sprintf("%s.versions.lock", filename)
+}
+
+// isExactVersion returns true when the version is a concrete version number rather than a constraint like `~1.2` or `>=1.0.0`.
+func isExactVersion(v string) bool {
+	_, err := semver.StrictNewVersion(strings.TrimPrefix(v, "v"))
+	return err == nil
+}
+
+// LockReleaseVersions resolves the version constraint of each release into the exact chart version
+// by running `helm search repo`, or by listing the tags of an OCI chart, and writes the results into the release version lock file.
+//
+// Local charts and releases that already specify an exact version are skipped.
+// Releases whose chart repository isn't defined in repositories are skipped with a warning, except for charts like `oci://HOST/PATH/CHART`.
+// The version is locked after the helmfile template has been rendered, so a templated `version` is locked as rendered.
+func (st *HelmState) LockReleaseVersions(helm helmexec.Interface) error {
+	if !helm.IsHelm3() {
+		return fmt.Errorf("helmfile lock requires Helm 3")
+	}
+
+	lock := &ReleaseVersionLock{Version: version.Version}
+
+	ociTags := &ociTagCache{}
+
+	for i := range st.Releases {
+		release := &st.Releases[i]
+
+		if isLocalChart(release.Chart) || isExactVersion(release.Version) {
+			continue
+		}
+
+		repo, chartName := st.lockedChartRepository(release.Chart)
+		if repo == nil {
+			st.logger.Warnf("not locking the version %q of release %q, as the repository of the chart %q isn't defined in repositories", release.Version, release.Name, release.Chart)
+			continue
+		}
+
+		var resolved string
+
+		if repo.OCI {
+			constraint := release.Version
+			if constraint == "" || constraint == "latest" {
+				constraint = "*"
+			}
+
+			v, err := st.resolveOCIChartVersion(ociTags, repo, chartName, constraint)
+			if err != nil {
+				return fmt.Errorf("release %q: %w", release.Name, err)
+			}
+			resolved = v
+		} else {
+			v, err := st.searchReleaseVersion(helm, release, repo, chartName)
+			if err != nil {
+				return err
+			}
+			resolved = v
+		}
+
+		lock.Releases = append(lock.Releases, LockedReleaseVersion{
+			ID:                ReleaseToID(release),
+			Chart:             release.Chart,
+			VersionConstraint: release.Version,
+			Version:           resolved,
+		})
+	}
+
+	sort.Slice(lock.Releases, func(i, j int) bool {
+		return lock.Releases[i].ID < lock.Releases[j].ID
+	})
+
+	bs, err := yaml.Marshal(lock)
+	if err != nil {
+		return err
+	}
+
+	filename := st.ReleaseVersionLockFile()
+
+	if err := ioutil.WriteFile(filename, bs, 0644); err != nil {
+		return err
+	}
+
+	st.logger.Infof("Locked %d release(s) in %s", len(lock.Releases), filename)
+
+	return nil
+}
+
+// lockedChartRepository returns the repository to resolve the version of the chart from, and the name of the chart in it.
+// A chart like `oci://registry.example.com/charts/mychart` is resolved from the registry without the repository defined in repositories.
+// It returns nil when the repository can't be determined.
+func (st *HelmState) lockedChartRepository(chart string) (*RepositorySpec, string) {
+	if repo, name := st.GetRepositoryAndNameFromChartName(chart); repo != nil {
+		return repo, name
+	}
+
+	if !strings.HasPrefix(chart, "oci://") {
+		return nil, chart
+	}
+
+	i := strings.LastIndex(chart, "/")
+	url, name := strings.TrimPrefix(chart[:i], "oci://"), chart[i+1:]
+
+	// The credentials of the OCI repository at the same URL are used, if any
+	for _, r := range st.Repositories {
+		if r.OCI && strings.TrimSuffix(strings.TrimPrefix(r.URL, "oci://"), "/") == url {
+			repo := r
+			return &repo, name
+		}
+	}
+
+	return &RepositorySpec{URL: url, OCI: true}, name
+}
+
+// searchReleaseVersion resolves the version constraint of the release into the exact chart version by running `helm search repo`
+func (st *HelmState) searchReleaseVersion(helm helmexec.Interface, release *ReleaseSpec, repo *RepositorySpec, chartName string) (string, error) {
+	flags := []string{}
+	if release.Version != "" {
+		flags = append(flags, "--version", release.Version)
+	}
+	if st.isDevelopment(release) {
+		flags = append(flags, "--devel")
+	}
+
+	out, err := helm.SearchRepo(release.Chart, flags...)
+	if err != nil {
+		return "", err
+	}
+
+	var results []searchRepoResult
+	if err := yaml.Unmarshal([]byte(out), &results); err != nil {
+		return "", fmt.Errorf("release %q: unable to parse the output of helm search repo: %v", release.Name, err)
+	}
+
+	for _, r := range results {
+		if r.Name == repo.Name+"/"+chartName {
+			return r.Version, nil
+		}
+	}
+
+	return "", fmt.Errorf("release %q: no version of the chart %q matches %q", release.Name, release.Chart, release.Version)
+}
+
+// readReleaseVersionLock reads the release version lock file, returning an error satisfying os.IsNotExist when it doesn't exist
+func (st *HelmState) readReleaseVersionLock() (*ReleaseVersionLock, error) {
+	filename := st.ReleaseVersionLockFile()
+
+	bs, err := st.readFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	lock := &ReleaseVersionLock{}
+	if err := yaml.Unmarshal(bs, lock); err != nil {
+		return nil, fmt.Errorf("unable to parse lock file %s: %v", filename, err)
+	}
+
+	return lock, nil
+}
+
+// UseReleaseVersionLock sets the version of each release to the one locked by `helmfile lock`,
+// so that the locked version is passed to helm via `--version` instead of resolving the constraint again.
+//
+// A locked version is ignored with a warning when the chart or the version constraint of the release has changed since it was locked.
+func (st *HelmState) UseReleaseVersionLock() error {
+	filename := st.ReleaseVersionLockFile()
+
+	lock, err := st.readReleaseVersionLock()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("lock file %s not found: run \"helmfile lock\" to create it", filename)
+		}
+		return err
+	}
+
+	locked := map[string]LockedReleaseVersion{}
+	for _, l := range lock.Releases {
+		locked[l.ID] = l
+	}
+
+	for i := range st.Releases {
+		release := &st.Releases[i]
+
+		l, ok := locked[ReleaseToID(release)]
+		if !ok {
+			continue
+		}
+
+		if l.Chart != release.Chart || l.VersionConstraint != release.Version {
+			st.logger.Warnf("ignoring the locked version %s of release %q as its chart or version has changed since locked. Run \"helmfile lock\" to update %s", l.Version, release.Name, filename)
+			continue
+		}
+
+		st.logger.Debugf("using the locked version %s of release %q for the version constraint %q", l.Version, release.Name, release.Version)
+
+		release.Version = l.Version
+	}
+
+	return nil
+}
+
+// ResolveReleaseVersions returns the exact chart version of each release keyed by the release ID, for auditing purposes.
+//
+// The version is taken from the release itself when it's exact, from the release version lock file when the release is locked,
+// or resolved by running `helm search repo` otherwise.
+// Releases whose version can't be resolved, like local and OCI charts, are omitted.
+func (st *HelmState) ResolveReleaseVersions(helm helmexec.Interface) (map[string]string, error) {
+	locked := map[string]LockedReleaseVersion{}
+
+	lock, err := st.readReleaseVersionLock()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if lock != nil {
+		for _, l := range lock.Releases {
+			locked[l.ID] = l
+		}
+	}
+
+	versions := map[string]string{}
+
+	for i := range st.Releases {
+		release := &st.Releases[i]
+		id := ReleaseToID(release)
+
+		if isExactVersion(release.Version) {
+			versions[id] = release.Version
+			continue
+		}
+
+		if l, ok := locked[id]; ok && l.Chart == release.Chart && l.VersionConstraint == release.Version {
+			versions[id] = l.Version
+			continue
+		}
+
+		if isLocalChart(release.Chart) || !helm.IsHelm3() {
+			continue
+		}
+
+		repo, chartName := st.GetRepositoryAndNameFromChartName(release.Chart)
+		if repo == nil || repo.OCI {
+			continue
+		}
+
+		resolved, err := st.searchReleaseVersion(helm, release, repo, chartName)
+		if err != nil {
+			return nil, err
+		}
+
+		versions[id] = resolved
+	}
+
+	return versions, nil
+}
@@ -0,0 +1,151 @@
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/roboll/helmfile/pkg/exectest"
+)
+
+func TestHelmState_LockReleaseVersions(t *testing.T) {
+	dir := t.TempDir()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Chdir(wd)
+	}()
+
+	newState := func() *HelmState {
+		return &HelmState{
+			FilePath: "helmfile.yaml",
+			ReleaseSetSpec: ReleaseSetSpec{
+				Repositories: []RepositorySpec{
+					{Name: "stable", URL: "https://example.com/stable"},
+					{Name: "myoci", URL: "registry.example.com/charts", OCI: true},
+				},
+				Releases: []ReleaseSpec{
+					{Name: "fuzzy", Namespace: "ns1", Chart: "stable/foo", Version: "~1.2.0"},
+					{Name: "latest", Chart: "stable/bar"},
+					{Name: "exact", Chart: "stable/foo", Version: "1.0.0"},
+					{Name: "local", Chart: "./charts/baz", Version: "~0.1"},
+					{Name: "oci-exact", Chart: "myoci/qux", Version: "2.0.0"},
+				},
+			},
+			logger:   logger,
+			readFile: ioutil.ReadFile,
+		}
+	}
+
+	helm := &exectest.Helm{
+		Helm3: true,
+		Searches: map[string]string{
+			"stable/foo": `- name: stable/foo
+  version: 1.2.5
+- name: stable/foo-bar
+  version: 9.9.9
+`,
+			"stable/bar": `- name: stable/bar
+  version: 3.0.1
+`,
+		},
+	}
+
+	st := newState()
+	if err := st.LockReleaseVersions(helm); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if st.ReleaseVersionLockFile() != "helmfile.versions.lock" {
+		t.Fatalf("unexpected lock file name: %s", st.ReleaseVersionLockFile())
+	}
+
+	st = newState()
+	st.Releases[1].Version = "^3"
+	if err := st.UseReleaseVersionLock(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, r := range st.Releases {
+		got = append(got, r.Version)
+	}
+
+	// The constraint of "latest" has changed since locked, so its locked version is ignored
+	want := []string{"1.2.5", "^3", "1.0.0", "~0.1", "2.0.0"}
+
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("unexpected versions: want (-), got (+):\n%s", d)
+	}
+}
+
+func TestHelmState_LockReleaseVersions_OCIConstraint(t *testing.T) {
+	srv, _ := newTestOCIRegistry(t, "2.0.1", "2.0.5", "2.1.0", "3.0.0")
+
+	st := &HelmState{
+		FilePath: "helmfile.yaml",
+		ReleaseSetSpec: ReleaseSetSpec{
+			Repositories: []RepositorySpec{
+				{Name: "myoci", URL: strings.TrimPrefix(srv.URL, "https://") + "/charts", OCI: true, Username: "user", Password: "pass"},
+			},
+			Releases: []ReleaseSpec{
+				{Name: "oci", Chart: "myoci/qux", Version: "~2.0"},
+				{Name: "oci-latest", Chart: "myoci/qux"},
+				{Name: "oci-none", Chart: "myoci/qux", Version: ">=4"},
+				{Name: "oci-url", Chart: "oci://" + strings.TrimPrefix(srv.URL, "https://") + "/charts/qux", Version: "~2.1"},
+				{Name: "undefined", Chart: "undefined/qux", Version: "~2.1"},
+			},
+		},
+		logger:     logger,
+		httpClient: srv.Client(),
+	}
+
+	err := st.LockReleaseVersions(&exectest.Helm{Helm3: true})
+
+	want := fmt.Sprintf(`release "oci-none": no version of the OCI chart "%s/charts/qux" satisfies the constraint ">=4". available tags are: 2.0.1, 2.0.5, 2.1.0, 3.0.0`, strings.TrimPrefix(srv.URL, "https://"))
+	if err == nil || err.Error() != want {
+		t.Fatalf("unexpected error: want %q, got %v", want, err)
+	}
+
+	st.Releases = append(st.Releases[:2], st.Releases[3:]...)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Chdir(wd)
+	}()
+
+	st.readFile = ioutil.ReadFile
+
+	if err := st.LockReleaseVersions(&exectest.Helm{Helm3: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := st.UseReleaseVersionLock(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, r := range st.Releases {
+		got = append(got, r.Version)
+	}
+
+	// The version of the release whose repository isn't defined is left as is
+	if d := cmp.Diff([]string{"2.0.5", "3.0.0", "2.1.0", "~2.1"}, got); d != "" {
+		t.Errorf("unexpected versions: want (-), got (+):\n%s", d)
+	}
+}
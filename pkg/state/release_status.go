@@ -0,0 +1,240 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+const (
+	// ReleaseStatusNotFound is the status of a release that is not installed in the cluster
+	ReleaseStatusNotFound = "not-found"
+	// ReleaseStatusDeployed is the status helm reports for a release whose latest revision is successfully deployed
+	ReleaseStatusDeployed = "deployed"
+	// ReleaseStatusUnknown is the status of a release whose status couldn't be retrieved from helm
+	ReleaseStatusUnknown = "unknown"
+)
+
+// ReleaseStatus is the status of a release reported by `helmfile status --output json`
+type ReleaseStatus struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Namespace    string `json:"namespace"`
+	Status       string `json:"status"`
+	Revision     int    `json:"revision,omitempty"`
+	LastDeployed string `json:"lastDeployed,omitempty"`
+	Chart        string `json:"chart,omitempty"`
+	ChartVersion string `json:"chartVersion,omitempty"`
+}
+
+// helmReleaseStatus is the subset of the output of `helm status --output json`
+type helmReleaseStatus struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Version   int    `json:"version"`
+	Info      struct {
+		LastDeployed string `json:"last_deployed"`
+		Status       string `json:"status"`
+	} `json:"info"`
+	Chart struct {
+		Metadata struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"metadata"`
+	} `json:"chart"`
+}
+
+// GetReleaseStatuses runs `helm status --output json` on the releases and returns their statuses in the order of the releases.
+// A release that is not installed is reported with the status `not-found` instead of failing.
+func (st *HelmState) GetReleaseStatuses(helm helmexec.Interface, workerLimit int) ([]ReleaseStatus, []error) {
+	if !helm.IsHelm3() {
+		return nil, []error{fmt.Errorf("status --output json requires Helm 3")}
+	}
+
+	var mu sync.Mutex
+
+	statuses := map[string]ReleaseStatus{}
+
+	errs := st.scatterGatherReleases(helm, workerLimit, func(release ReleaseSpec, workerIndex int) error {
+		if !release.Desired() {
+			return nil
+		}
+
+		st.ApplyOverrides(&release)
+
+		id := ReleaseToID(&release)
+		context := st.createHelmContext(&release, workerIndex)
+
+		status := ReleaseStatus{
+			ID:        id,
+			Name:      release.Name,
+			Namespace: release.Namespace,
+		}
+
+		installed, err := st.isReleaseInstalled(context, helm, release)
+		if err != nil {
+			return err
+		}
+
+		if installed {
+			s, err := st.getHelmReleaseStatus(context, helm, &release)
+			if err != nil {
+				return err
+			}
+
+			if s.Namespace != "" {
+				status.Namespace = s.Namespace
+			}
+			status.Status = s.Info.Status
+			status.Revision = s.Version
+			status.LastDeployed = s.Info.LastDeployed
+			status.Chart = s.Chart.Metadata.Name
+			status.ChartVersion = s.Chart.Metadata.Version
+		} else {
+			status.Status = ReleaseStatusNotFound
+		}
+
+		mu.Lock()
+		statuses[id] = status
+		mu.Unlock()
+
+		return nil
+	})
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	var result []ReleaseStatus
+
+	for _, release := range st.Releases {
+		st.ApplyOverrides(&release)
+
+		if s, ok := statuses[ReleaseToID(&release)]; ok {
+			result = append(result, s)
+		}
+	}
+
+	return result, nil
+}
+
+// GetActualReleaseStatuses runs `helm list` on the releases and returns the statuses helm reports for them by their IDs,
+// like `deployed`, `failed` and `pending-upgrade`, so that they can be compared against the declared ones.
+// The releases with `installed: false` are included, and a release that is not installed is reported as `not-found`.
+func (st *HelmState) GetActualReleaseStatuses(helm helmexec.Interface, workerLimit int) (map[string]string, []error) {
+	var mu sync.Mutex
+
+	statuses := map[string]string{}
+
+	errs := st.scatterGatherReleases(helm, workerLimit, func(release ReleaseSpec, workerIndex int) error {
+		st.ApplyOverrides(&release)
+
+		context := st.createHelmContext(&release, workerIndex)
+
+		out, err := st.listReleases(context, helm, &release)
+		if err != nil {
+			return err
+		}
+
+		var status string
+
+		if strings.TrimSpace(out) == "" {
+			status = ReleaseStatusNotFound
+		} else if helm.IsHelm3() {
+			// Helm 3 prints `helm list` without the header, so the status is taken from `helm status` instead
+			s, err := st.getHelmReleaseStatus(context, helm, &release)
+			if err != nil {
+				return err
+			}
+			status = s.Info.Status
+		} else {
+			status = listedReleaseStatus(out, release.Name)
+		}
+
+		mu.Lock()
+		statuses[ReleaseToID(&release)] = status
+		mu.Unlock()
+
+		return nil
+	})
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	return statuses, nil
+}
+
+// listedReleaseStatus returns the status of the release in the output of `helm list` of Helm 2, read from the STATUS column
+// of the row of the release, so that a release or namespace named like a status isn't mistaken for it.
+// Helm 2 shows the status in the upper-snake-case like `PENDING_UPGRADE`, which is converted to the lower-kebab-case of Helm 3.
+func listedReleaseStatus(out, name string) string {
+	col := -1
+
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "\t")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+
+		if col < 0 {
+			for i, f := range fields {
+				if f == "STATUS" {
+					col = i
+				}
+			}
+			continue
+		}
+
+		if fields[0] == name && col < len(fields) {
+			return strings.ReplaceAll(strings.ToLower(fields[col]), "_", "-")
+		}
+	}
+
+	return ReleaseStatusUnknown
+}
+
+// getHelmReleaseStatus runs `helm status --output json` on the installed release and parses the output
+func (st *HelmState) getHelmReleaseStatus(context helmexec.HelmContext, helm helmexec.Interface, release *ReleaseSpec) (*helmReleaseStatus, error) {
+	flags := []string{"--output", "json"}
+	if release.Namespace != "" {
+		flags = append(flags, "--namespace", release.Namespace)
+	}
+	flags = st.appendConnectionFlags(flags, helm, release)
+
+	out, err := helm.GetReleaseStatus(context, release.Name, flags...)
+	if err != nil {
+		return nil, err
+	}
+
+	var s helmReleaseStatus
+	if err := json.Unmarshal([]byte(out), &s); err != nil {
+		return nil, fmt.Errorf("unable to parse the output of helm status: %v", err)
+	}
+
+	return &s, nil
+}
+
+// postSyncStatus returns the status helm reports for the release right after it is upgraded, for --post-sync-status.
+// It never fails, as the upgrade has already succeeded, and returns `unknown` when the status can't be retrieved.
+func (st *HelmState) postSyncStatus(context helmexec.HelmContext, helm helmexec.Interface, release *ReleaseSpec) string {
+	if !helm.IsHelm3() {
+		st.logger.Warnf("skipping the status of release %q after sync: it requires Helm 3", release.Name)
+		return ReleaseStatusUnknown
+	}
+
+	s, err := st.getHelmReleaseStatus(context, helm, release)
+	if err != nil {
+		st.logger.Warnf("getting the status of release %q after sync failed: %v", release.Name, err)
+		return ReleaseStatusUnknown
+	}
+
+	if s.Info.Status != ReleaseStatusDeployed {
+		st.logger.Warnf("release %q was upgraded but helm reports its status as %q", release.Name, s.Info.Status)
+	}
+
+	return s.Info.Status
+}
@@ -0,0 +1,139 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/roboll/helmfile/pkg/exectest"
+)
+
+func TestHelmState_GetReleaseStatuses(t *testing.T) {
+	no := false
+
+	state := &HelmState{
+		ReleaseSetSpec: ReleaseSetSpec{
+			Releases: []ReleaseSpec{
+				{Name: "foo", Chart: "stable/foo", Namespace: "ns1"},
+				{Name: "bar", Chart: "stable/bar", Namespace: "ns2"},
+				{Name: "baz", Chart: "stable/baz", Installed: &no},
+			},
+		},
+		logger:         logger,
+		valsRuntime:    valsRuntime,
+		RenderedValues: map[string]interface{}{},
+	}
+
+	helm := &exectest.Helm{
+		Helm3: true,
+		Lists: map[exectest.ListKey]string{
+			{Filter: "^foo$", Flags: "--namespacens1--uninstalling--deployed--failed--pending"}: "foo",
+		},
+		Statuses: map[string]string{
+			"foo": `{"name":"foo","namespace":"ns1","version":3,"info":{"last_deployed":"2021-10-01T10:00:00Z","status":"deployed"},"chart":{"metadata":{"name":"foo","version":"1.2.3"}}}`,
+		},
+	}
+
+	statuses, errs := state.GetReleaseStatuses(helm, 1)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	want := []ReleaseStatus{
+		{
+			ID:           "ns1/foo",
+			Name:         "foo",
+			Namespace:    "ns1",
+			Status:       "deployed",
+			Revision:     3,
+			LastDeployed: "2021-10-01T10:00:00Z",
+			Chart:        "foo",
+			ChartVersion: "1.2.3",
+		},
+		{
+			ID:        "ns2/bar",
+			Name:      "bar",
+			Namespace: "ns2",
+			Status:    ReleaseStatusNotFound,
+		},
+	}
+
+	if d := cmp.Diff(want, statuses); d != "" {
+		t.Errorf("unexpected statuses: want (-), got (+):\n%s", d)
+	}
+
+	wantReleases := []exectest.Release{
+		{Name: "foo", Flags: []string{"--output", "json", "--namespace", "ns1"}},
+	}
+
+	if d := cmp.Diff(wantReleases, helm.Releases); d != "" {
+		t.Errorf("unexpected helm status calls: want (-), got (+):\n%s", d)
+	}
+}
+
+func TestHelmState_GetActualReleaseStatuses(t *testing.T) {
+	newState := func() *HelmState {
+		return &HelmState{
+			ReleaseSetSpec: ReleaseSetSpec{
+				Releases: []ReleaseSpec{
+					{Name: "foo", Chart: "stable/foo", Namespace: "failed"},
+					{Name: "deployed", Chart: "stable/bar", Namespace: "ns2"},
+					{Name: "baz", Chart: "stable/baz", Namespace: "ns3"},
+				},
+			},
+			logger:         logger,
+			valsRuntime:    valsRuntime,
+			RenderedValues: map[string]interface{}{},
+		}
+	}
+
+	want := map[string]string{
+		"failed/foo":   "deployed",
+		"ns2/deployed": "pending-install",
+		"ns3/baz":      ReleaseStatusNotFound,
+	}
+
+	t.Run("helm3", func(t *testing.T) {
+		helm := &exectest.Helm{
+			Helm3: true,
+			Lists: map[exectest.ListKey]string{
+				{Filter: "^foo$", Flags: "--namespacefailed--uninstalling--deployed--failed--pending"}:   "foo\tfailed\t1\t2021-10-01 10:00:00 +0000 UTC\tdeployed\tfoo-1.2.3\t1.2.3",
+				{Filter: "^deployed$", Flags: "--namespacens2--uninstalling--deployed--failed--pending"}: "deployed\tns2\t1\t2021-10-01 10:00:00 +0000 UTC\tpending-install\tbar-1.0.0\t1.0.0",
+			},
+			Statuses: map[string]string{
+				"foo":      `{"name":"foo","namespace":"failed","version":1,"info":{"status":"deployed"}}`,
+				"deployed": `{"name":"deployed","namespace":"ns2","version":1,"info":{"status":"pending-install"}}`,
+			},
+		}
+
+		statuses, errs := newState().GetActualReleaseStatuses(helm, 1)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+
+		if d := cmp.Diff(want, statuses); d != "" {
+			t.Errorf("unexpected statuses: want (-), got (+):\n%s", d)
+		}
+	})
+
+	t.Run("helm2", func(t *testing.T) {
+		helm := &exectest.Helm{
+			Lists: map[exectest.ListKey]string{
+				{Filter: "^foo$", Flags: "--deleting--deployed--failed--pending"}: `NAME	REVISION	UPDATED                 	STATUS  	CHART    	APP VERSION	NAMESPACE
+foo 	1       	Fri Oct  1 10:00:00 2021	DEPLOYED	foo-1.2.3	1.2.3      	failed
+`,
+				{Filter: "^deployed$", Flags: "--deleting--deployed--failed--pending"}: `NAME    	REVISION	UPDATED                 	STATUS         	CHART    	APP VERSION	NAMESPACE
+deployed	1       	Fri Oct  1 10:00:00 2021	PENDING_INSTALL	bar-1.0.0	1.0.0      	ns2
+`,
+			},
+		}
+
+		statuses, errs := newState().GetActualReleaseStatuses(helm, 1)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+
+		if d := cmp.Diff(want, statuses); d != "" {
+			t.Errorf("unexpected statuses: want (-), got (+):\n%s", d)
+		}
+	})
+}
@@ -0,0 +1,96 @@
+package state
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+// RepositoryCredentialsRef references the credentials of a helm or OCI repository stored in one of the vals backends.
+//
+// It can be either a single ref whose value is a YAML or JSON document containing `username` and `password`:
+//
+//	credentialsRef: ref+awssecrets://myrepo-credentials
+//
+// or a map of refs, one per field:
+//
+//	credentialsRef:
+//	  username: ref+vault://secret/myrepo#/user
+//	  password: ref+vault://secret/myrepo#/pass
+type RepositoryCredentialsRef struct {
+	Ref      string `yaml:"ref,omitempty"`
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+}
+
+func (r *RepositoryCredentialsRef) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var ref string
+	if err := unmarshal(&ref); err == nil {
+		r.Ref = ref
+		return nil
+	}
+
+	type credentialsRef RepositoryCredentialsRef
+
+	var m credentialsRef
+	if err := unmarshal(&m); err != nil {
+		return err
+	}
+
+	*r = RepositoryCredentialsRef(m)
+
+	return nil
+}
+
+// resolveRepositoryCredentials returns the username and password for the repository,
+// resolving `credentialsRef` via vals when it is set.
+//
+// The resolved credentials are never logged.
+func (st *HelmState) resolveRepositoryCredentials(repo RepositorySpec) (string, string, error) {
+	ref := repo.CredentialsRef
+	if ref == nil {
+		return repo.Username, repo.Password, nil
+	}
+
+	if repo.Username != "" || repo.Password != "" {
+		return "", "", fmt.Errorf("repository %q: credentialsRef cannot be used with username or password", repo.Name)
+	}
+
+	if ref.Ref != "" && (ref.Username != "" || ref.Password != "") {
+		return "", "", fmt.Errorf("repository %q: credentialsRef must be either a ref or a map of username and password refs", repo.Name)
+	}
+
+	var username, password string
+
+	if ref.Ref != "" {
+		rendered, err := renderValsSecrets(st.valsRuntime, ref.Ref)
+		if err != nil {
+			return "", "", fmt.Errorf("repository %q: failed to resolve credentialsRef: %v", repo.Name, err)
+		}
+
+		var creds struct {
+			Username string `yaml:"username"`
+			Password string `yaml:"password"`
+		}
+
+		// The error is not wrapped as it may contain the resolved value
+		if err := yaml.Unmarshal([]byte(rendered[0]), &creds); err != nil {
+			return "", "", fmt.Errorf("repository %q: the value of credentialsRef must be a YAML or JSON object containing username and password", repo.Name)
+		}
+
+		username, password = creds.Username, creds.Password
+	} else {
+		rendered, err := renderValsSecrets(st.valsRuntime, ref.Username, ref.Password)
+		if err != nil {
+			return "", "", fmt.Errorf("repository %q: failed to resolve credentialsRef: %v", repo.Name, err)
+		}
+
+		username, password = rendered[0], rendered[1]
+	}
+
+	if username == "" || password == "" {
+		return "", "", fmt.Errorf("repository %q: credentialsRef must resolve to non-empty username and password", repo.Name)
+	}
+
+	return username, password, nil
+}
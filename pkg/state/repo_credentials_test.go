@@ -0,0 +1,41 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"gopkg.in/yaml.v2"
+)
+
+func TestRepositoryCredentialsRef_UnmarshalYAML(t *testing.T) {
+	testcases := []struct {
+		input string
+		want  RepositoryCredentialsRef
+	}{
+		{
+			input: `credentialsRef: ref+vault://secret/myrepo`,
+			want:  RepositoryCredentialsRef{Ref: "ref+vault://secret/myrepo"},
+		},
+		{
+			input: `credentialsRef:
+  username: ref+vault://secret/myrepo#/user
+  password: ref+vault://secret/myrepo#/pass
+`,
+			want: RepositoryCredentialsRef{
+				Username: "ref+vault://secret/myrepo#/user",
+				Password: "ref+vault://secret/myrepo#/pass",
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		var repo RepositorySpec
+		if err := yaml.UnmarshalStrict([]byte(tc.input), &repo); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if d := cmp.Diff(tc.want, *repo.CredentialsRef); d != "" {
+			t.Errorf("unexpected credentialsRef: %s", d)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package state
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+const (
+	// DefaultRetryBackoff is the time in seconds to wait before the first retry of a failed release
+	DefaultRetryBackoff = 5
+)
+
+// DefaultRetryOn is the list of patterns matching the transient errors that are retried when neither
+// `releases[].retryOn` nor `helmDefaults.retryOn` is set
+var DefaultRetryOn = []string{
+	`connection refused`,
+	`connection reset by peer`,
+	`i/o timeout`,
+	`TLS handshake timeout`,
+	`context deadline exceeded`,
+	`the server is currently unable to handle the request`,
+	`etcdserver: request timed out`,
+}
+
+// waitTimeoutErrors are the patterns matching the errors of `helm upgrade --wait` that timed out waiting for the resources
+var waitTimeoutErrors = []*regexp.Regexp{
+	regexp.MustCompile(`timed out waiting for the condition`),
+	regexp.MustCompile(`context deadline exceeded`),
+}
+
+// syncReleaseWithRetries runs `helm upgrade --install` on the release, retrying it with an exponential backoff
+// as long as the error matches one of the retryOn patterns and the number of retries is not exhausted.
+// When the upgrade with `--wait` timed out waiting for the resources, it is run again with the same flags and values files
+// up to waitRetries times, without a backoff nor consuming the retries, so that a slow-starting release gets more time to become ready.
+func (st *HelmState) syncReleaseWithRetries(context helmexec.HelmContext, helm helmexec.Interface, release *ReleaseSpec, chart string, flags ...string) error {
+	retries := st.HelmDefaults.Retries
+	if release.Retries != nil {
+		retries = *release.Retries
+	}
+
+	backoff := st.HelmDefaults.RetryBackoff
+	if release.RetryBackoff != nil {
+		backoff = *release.RetryBackoff
+	}
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+
+	patterns := DefaultRetryOn
+	if len(release.RetryOn) > 0 {
+		patterns = release.RetryOn
+	} else if len(st.HelmDefaults.RetryOn) > 0 {
+		patterns = st.HelmDefaults.RetryOn
+	}
+
+	var retryOn []*regexp.Regexp
+	if retries > 0 {
+		var err error
+		retryOn, err = compileRegexps(patterns)
+		if err != nil {
+			return fmt.Errorf("invalid retryOn: %v", err)
+		}
+	}
+
+	waitRetries := st.HelmDefaults.WaitRetries
+	if release.WaitRetries != nil {
+		waitRetries = *release.WaitRetries
+	}
+	if !hasFlag(flags, "--wait") {
+		waitRetries = 0
+	}
+
+	sleep := st.sleep
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+
+	wait := time.Duration(backoff) * time.Second
+
+	st.logReleaseEvent("sync", releaseEventStarted, release, nil)
+
+	var attempt, waitAttempt int
+
+	for {
+		err := helm.SyncRelease(context, release.Name, chart, flags...)
+		if err == nil {
+			st.logReleaseEvent("sync", releaseEventSucceeded, release, nil)
+			return nil
+		}
+
+		if waitAttempt < waitRetries && matchesAny(err.Error(), waitTimeoutErrors) {
+			waitAttempt++
+
+			st.logger.Warnf("Waiting for release %q to become ready again (%d of %d), as it timed out: %v", release.Name, waitAttempt, waitRetries, err)
+
+			continue
+		}
+
+		if attempt >= retries || !matchesAny(err.Error(), retryOn) {
+			st.logReleaseEvent("sync", releaseEventFailed, release, err)
+			return err
+		}
+
+		attempt++
+
+		st.logger.Warnf("Retrying release %q in %v after a transient error (retry %d of %d): %v", release.Name, wait, attempt, retries, err)
+
+		sleep(wait)
+
+		wait *= 2
+	}
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,226 @@
+package state
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/roboll/helmfile/pkg/exectest"
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+// flakyHelm fails the first `failures` upgrades of each release with err
+type flakyHelm struct {
+	*exectest.Helm
+
+	failures int
+	err      error
+
+	mu       sync.Mutex
+	attempts map[string]int
+}
+
+func (helm *flakyHelm) SyncRelease(context helmexec.HelmContext, name, chart string, flags ...string) error {
+	helm.mu.Lock()
+	helm.attempts[name]++
+	attempt := helm.attempts[name]
+	helm.mu.Unlock()
+
+	if attempt <= helm.failures {
+		return helm.err
+	}
+
+	return helm.Helm.SyncRelease(context, name, chart, flags...)
+}
+
+func TestHelmState_SyncReleases_Retries(t *testing.T) {
+	one, two := 1, 2
+	yes := true
+	threeSeconds := Duration(3)
+
+	tests := []struct {
+		name         string
+		defaults     HelmSpec
+		release      ReleaseSpec
+		opts         *SyncOpts
+		failures     int
+		err          error
+		wantAttempts int
+		wantSleeps   []time.Duration
+		wantFailed   bool
+	}{
+		{
+			name:         "no retries by default",
+			release:      ReleaseSpec{Name: "foo", Chart: "foo"},
+			failures:     2,
+			err:          errors.New("dial tcp 10.0.0.1:443: connect: connection refused"),
+			wantAttempts: 1,
+			wantFailed:   true,
+		},
+		{
+			name:         "succeeds after two transient failures",
+			release:      ReleaseSpec{Name: "foo", Chart: "foo", Retries: &two},
+			failures:     2,
+			err:          errors.New("dial tcp 10.0.0.1:443: connect: connection refused"),
+			wantAttempts: 3,
+			wantSleeps:   []time.Duration{5 * time.Second, 10 * time.Second},
+		},
+		{
+			name:         "retries and backoff from helmDefaults",
+			defaults:     HelmSpec{Retries: 2, RetryBackoff: 1},
+			release:      ReleaseSpec{Name: "foo", Chart: "foo"},
+			failures:     2,
+			err:          errors.New("net/http: TLS handshake timeout"),
+			wantAttempts: 3,
+			wantSleeps:   []time.Duration{1 * time.Second, 2 * time.Second},
+		},
+		{
+			name:         "release backoff overrides helmDefaults",
+			defaults:     HelmSpec{Retries: 2, RetryBackoff: 1},
+			release:      ReleaseSpec{Name: "foo", Chart: "foo", RetryBackoff: &threeSeconds},
+			failures:     1,
+			err:          errors.New("i/o timeout"),
+			wantAttempts: 2,
+			wantSleeps:   []time.Duration{3 * time.Second},
+		},
+		{
+			name:         "fails when retries are exhausted",
+			defaults:     HelmSpec{Retries: 1},
+			release:      ReleaseSpec{Name: "foo", Chart: "foo"},
+			failures:     2,
+			err:          errors.New("context deadline exceeded"),
+			wantAttempts: 2,
+			wantSleeps:   []time.Duration{5 * time.Second},
+			wantFailed:   true,
+		},
+		{
+			name:         "does not retry template errors",
+			release:      ReleaseSpec{Name: "foo", Chart: "foo", Retries: &two},
+			failures:     2,
+			err:          errors.New("template: foo/templates/deployment.yaml:3:4: executing \"foo\" at <.Values.bar>: nil pointer"),
+			wantAttempts: 1,
+			wantFailed:   true,
+		},
+		{
+			name:         "custom retryOn",
+			release:      ReleaseSpec{Name: "foo", Chart: "foo", Retries: &two, RetryOn: []string{"another operation .* is in progress"}},
+			failures:     1,
+			err:          errors.New("another operation (install/upgrade/rollback) is in progress"),
+			wantAttempts: 2,
+			wantSleeps:   []time.Duration{5 * time.Second},
+		},
+		{
+			name:         "waits again after a wait timeout",
+			release:      ReleaseSpec{Name: "foo", Chart: "foo", Wait: &yes, WaitRetries: &one},
+			failures:     1,
+			err:          errors.New("UPGRADE FAILED: timed out waiting for the condition"),
+			wantAttempts: 2,
+		},
+		{
+			name:         "wait retries don't consume retries",
+			defaults:     HelmSpec{Wait: true, WaitRetries: 1, Retries: 1},
+			release:      ReleaseSpec{Name: "foo", Chart: "foo"},
+			failures:     2,
+			err:          errors.New("context deadline exceeded"),
+			wantAttempts: 3,
+			wantSleeps:   []time.Duration{5 * time.Second},
+		},
+		{
+			name:         "fails when wait retries are exhausted",
+			defaults:     HelmSpec{Wait: true, WaitRetries: 1},
+			release:      ReleaseSpec{Name: "foo", Chart: "foo"},
+			failures:     2,
+			err:          errors.New("timed out waiting for the condition"),
+			wantAttempts: 2,
+			wantFailed:   true,
+		},
+		{
+			name:         "no wait retries without --wait",
+			release:      ReleaseSpec{Name: "foo", Chart: "foo", WaitRetries: &two},
+			failures:     1,
+			err:          errors.New("timed out waiting for the condition"),
+			wantAttempts: 1,
+			wantFailed:   true,
+		},
+		{
+			name:         "wait retries from the command-line",
+			release:      ReleaseSpec{Name: "foo", Chart: "foo", WaitRetries: &one},
+			opts:         &SyncOpts{Wait: true, WaitRetries: 2},
+			failures:     2,
+			err:          errors.New("timed out waiting for the condition"),
+			wantAttempts: 3,
+		},
+		{
+			name:         "does not wait again on other errors",
+			release:      ReleaseSpec{Name: "foo", Chart: "foo", Wait: &yes, WaitRetries: &two},
+			failures:     1,
+			err:          errors.New("UPGRADE FAILED: cannot patch \"foo\" with kind Deployment"),
+			wantAttempts: 1,
+			wantFailed:   true,
+		},
+	}
+
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			var sleeps []time.Duration
+
+			state := &HelmState{
+				ReleaseSetSpec: ReleaseSetSpec{
+					HelmDefaults: tt.defaults,
+					Releases:     []ReleaseSpec{tt.release},
+				},
+				logger:         logger,
+				valsRuntime:    valsRuntime,
+				RenderedValues: map[string]interface{}{},
+				sleep: func(d time.Duration) {
+					sleeps = append(sleeps, d)
+				},
+			}
+
+			helm := &flakyHelm{
+				Helm: &exectest.Helm{
+					Lists: map[exectest.ListKey]string{},
+				},
+				failures: tt.failures,
+				err:      tt.err,
+				attempts: map[string]int{},
+			}
+
+			affectedReleases := AffectedReleases{}
+			var opts []SyncOpt
+			if tt.opts != nil {
+				opts = append(opts, tt.opts)
+			}
+
+			errs := state.SyncReleases(&affectedReleases, helm, []string{}, 1, opts...)
+
+			if tt.wantFailed {
+				if len(errs) == 0 {
+					t.Fatalf("expected an error, got none")
+				}
+				if len(affectedReleases.Failed) != 1 || len(affectedReleases.Upgraded) != 0 {
+					t.Errorf("unexpected affected releases: failed=%v upgraded=%v", affectedReleases.Failed, affectedReleases.Upgraded)
+				}
+			} else {
+				if len(errs) > 0 {
+					t.Fatalf("unexpected errors: %v", errs)
+				}
+				if len(affectedReleases.Upgraded) != 1 || len(affectedReleases.Failed) != 0 {
+					t.Errorf("unexpected affected releases: failed=%v upgraded=%v", affectedReleases.Failed, affectedReleases.Upgraded)
+				}
+			}
+
+			if got := helm.attempts[tt.release.Name]; got != tt.wantAttempts {
+				t.Errorf("unexpected number of attempts: want %d, got %d", tt.wantAttempts, got)
+			}
+
+			if d := cmp.Diff(tt.wantSleeps, sleeps); d != "" {
+				t.Errorf("unexpected sleeps: want (-), got (+):\n%s", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package state
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// secretValuesMask replaces each of the secret values in the logs
+const secretValuesMask = "***"
+
+// SecretValues collects the decrypted values of the environment secrets, so that they can be masked in the debug logs
+// that dump the environment values and the rendered state files.
+// Its methods are no-op on nil, so that masking is opt-in.
+type SecretValues struct {
+	mu     sync.Mutex
+	values map[string]struct{}
+}
+
+// NewSecretValues returns an empty SecretValues
+func NewSecretValues() *SecretValues {
+	return &SecretValues{values: map[string]struct{}{}}
+}
+
+// Add collects the non-empty string leaves of the decrypted values
+func (s *SecretValues) Add(values map[string]interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.add(values)
+}
+
+func (s *SecretValues) add(v interface{}) {
+	switch typed := v.(type) {
+	case map[string]interface{}:
+		for _, val := range typed {
+			s.add(val)
+		}
+	case []interface{}:
+		for _, val := range typed {
+			s.add(val)
+		}
+	case string:
+		if typed != "" {
+			s.values[typed] = struct{}{}
+		}
+	}
+}
+
+// Mask returns str with every secret value in it replaced with `***`
+func (s *SecretValues) Mask(str string) string {
+	if s == nil {
+		return str
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.values) == 0 {
+		return str
+	}
+
+	values := make([]string, 0, len(s.values))
+	for v := range s.values {
+		values = append(values, v)
+	}
+	// Longer values are replaced first, so that a value containing another one is masked as a whole
+	sort.Slice(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+
+	oldnew := make([]string, 0, len(values)*2)
+	for _, v := range values {
+		oldnew = append(oldnew, v, secretValuesMask)
+	}
+
+	return strings.NewReplacer(oldnew...).Replace(str)
+}
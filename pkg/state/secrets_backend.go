@@ -0,0 +1,116 @@
+package state
+
+import (
+	"fmt"
+	"os"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+	"github.com/roboll/helmfile/pkg/maputil"
+)
+
+// The values of `releases[].secretsBackend`
+const (
+	SecretsBackendHelmSecrets = "helm-secrets"
+	SecretsBackendSops        = "sops"
+	SecretsBackendVals        = "vals"
+)
+
+// decryptSecretsFile decrypts the secrets file at path with the secretsBackend of the release.
+//
+// The decrypted values are returned either as the path to the decrypted file, for helm-secrets,
+// or as a map, for sops and vals, so that they can be passed to generateTemporaryReleaseValuesFiles as is.
+// The decrypted file is removed by calling the returned func. The files generated from the decrypted values are
+// removed along with other values files, unless --skip-cleanup is set.
+func (st *HelmState) decryptSecretsFile(helm helmexec.Interface, release *ReleaseSpec, path string, workerIndex int) (interface{}, func(), error) {
+	return st.decryptSecretsFileWithBackend(helm, release, release.SecretsBackend, fmt.Sprintf("release %q", release.Name), path, workerIndex)
+}
+
+// decryptSecretsFileWithBackend is decryptSecretsFile for the secrets file of owner, like `environment "prod"`, decrypted with the backend.
+// The connection flags of helm-secrets are taken from release.
+func (st *HelmState) decryptSecretsFileWithBackend(helm helmexec.Interface, release *ReleaseSpec, backend, owner, path string, workerIndex int) (interface{}, func(), error) {
+	noop := func() {}
+
+	switch backend {
+	case "", SecretsBackendHelmSecrets:
+		decryptFlags := st.appendConnectionFlags([]string{}, helm, release)
+		decrypted, err := helm.DecryptSecret(st.createHelmContext(release, workerIndex), path, decryptFlags...)
+		if err != nil {
+			return nil, noop, err
+		}
+
+		return decrypted, func() {
+			_ = os.Remove(decrypted)
+		}, nil
+	case SecretsBackendSops:
+		// sops picks the key to decrypt the file with, like an age or PGP key, from the metadata of the file,
+		// so that files encrypted with different kinds of keys can be mixed in a release.
+		out, err := st.decryptWithSops(path)
+		if err != nil {
+			return nil, noop, fmt.Errorf("decrypting secrets file %q for %s: %v", path, owner, err)
+		}
+
+		values, err := unmarshalSecretValues(path, out)
+		if err != nil {
+			return nil, noop, err
+		}
+
+		return values, noop, nil
+	case SecretsBackendVals:
+		bs, err := st.readFile(path)
+		if err != nil {
+			return nil, noop, err
+		}
+
+		values, err := unmarshalSecretValues(path, bs)
+		if err != nil {
+			return nil, noop, err
+		}
+
+		rendered, err := st.valsRuntime.Eval(values)
+		if err != nil {
+			return nil, noop, fmt.Errorf("evaluating secrets file %q for %s: %v", path, owner, err)
+		}
+
+		return rendered, noop, nil
+	default:
+		return nil, noop, fmt.Errorf("unsupported secretsBackend %q for %s: it must be one of %q, %q or %q", backend, owner, SecretsBackendHelmSecrets, SecretsBackendSops, SecretsBackendVals)
+	}
+}
+
+// decryptWithSops runs `sops --decrypt` on the file and returns the decrypted content.
+// Unlike execute, it never logs the output of sops, which is the decrypted secrets.
+func (st *HelmState) decryptWithSops(path string) ([]byte, error) {
+	runner := st.runner
+	if runner == nil {
+		runner = helmexec.ShellRunner{
+			Dir:    st.basePath,
+			Logger: zap.NewNop().Sugar(),
+		}
+	}
+
+	st.logger.Debugf("sops --decrypt %s", path)
+
+	out, err := runner.Execute("sops", []string{"--decrypt", path}, map[string]string{})
+	if err != nil {
+		return nil, fmt.Errorf("sops --decrypt %s: %v", path, err)
+	}
+
+	return out, nil
+}
+
+func unmarshalSecretValues(path string, bs []byte) (map[string]interface{}, error) {
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(bs, &values); err != nil {
+		return nil, fmt.Errorf("failed to load decrypted secrets file \"%s\": %v", path, err)
+	}
+
+	converted, err := maputil.CastKeysToStrings(values)
+	if err != nil {
+		return nil, err
+	}
+
+	return converted, nil
+}
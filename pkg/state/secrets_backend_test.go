@@ -0,0 +1,162 @@
+package state
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/roboll/helmfile/pkg/exectest"
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+type secretsTestHelm struct {
+	*exectest.Helm
+
+	dir       string
+	decrypted []string
+}
+
+func (helm *secretsTestHelm) DecryptSecret(context helmexec.HelmContext, name string, flags ...string) (string, error) {
+	helm.decrypted = append(helm.decrypted, filepath.Base(name))
+
+	f := filepath.Join(helm.dir, "decrypted-"+filepath.Base(name))
+
+	return f, ioutil.WriteFile(f, []byte("decryptedBy: helm-secrets\n"), 0644)
+}
+
+type secretsTestRunner struct {
+	commands []string
+}
+
+func (r *secretsTestRunner) Execute(cmd string, args []string, env map[string]string) ([]byte, error) {
+	r.commands = append(r.commands, cmd+" "+strings.Join(args, " "))
+
+	return []byte("decryptedBy: sops\nnested:\n  key: value\n"), nil
+}
+
+func (r *secretsTestRunner) ExecuteStdIn(cmd string, args []string, env map[string]string, stdin io.Reader) ([]byte, error) {
+	return r.Execute(cmd, args, env)
+}
+
+func TestHelmState_generateSecretValuesFiles_SecretsBackend(t *testing.T) {
+	testcases := []struct {
+		backend      string
+		wantValues   string
+		wantDecrypts []string
+		wantCommands []string
+		wantErr      string
+	}{
+		{
+			backend:      "",
+			wantValues:   "decryptedBy: helm-secrets\n",
+			wantDecrypts: []string{"secrets.yaml"},
+		},
+		{
+			backend:      "helm-secrets",
+			wantValues:   "decryptedBy: helm-secrets\n",
+			wantDecrypts: []string{"secrets.yaml"},
+		},
+		{
+			backend:      "sops",
+			wantValues:   "decryptedBy: sops\nnested:\n  key: value\n",
+			wantCommands: []string{"sops --decrypt secrets.yaml"},
+		},
+		{
+			backend:    "vals",
+			wantValues: "decryptedBy: vals\npassword: mysecret\n",
+		},
+		{
+			backend: "unknown",
+			wantErr: `unsupported secretsBackend "unknown" for release "foo": it must be one of "helm-secrets", "sops" or "vals"`,
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(tc.backend, func(t *testing.T) {
+			dir := t.TempDir()
+
+			content := "decryptedBy: vals\npassword: ref+echo://mysecret\n"
+			if err := ioutil.WriteFile(filepath.Join(dir, "secrets.yaml"), []byte(content), 0644); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			runner := &secretsTestRunner{}
+
+			state := &HelmState{
+				basePath: dir,
+				FilePath: filepath.Join(dir, "helmfile.yaml"),
+				ReleaseSetSpec: ReleaseSetSpec{
+					Releases: []ReleaseSpec{
+						{
+							Name:           "foo",
+							Chart:          "stable/foo",
+							Secrets:        []interface{}{"secrets.yaml"},
+							SecretsBackend: tc.backend,
+						},
+					},
+				},
+				logger:            logger,
+				readFile:          ioutil.ReadFile,
+				removeFile:        os.Remove,
+				glob:              filepath.Glob,
+				directoryExistsAt: directoryExistsAt,
+				valsRuntime:       valsRuntime,
+				runner:            runner,
+				RenderedValues:    map[string]interface{}{},
+			}
+
+			helm := &secretsTestHelm{Helm: &exectest.Helm{Helm3: true}, dir: dir}
+
+			files, err := state.generateSecretValuesFiles(helm, &state.Releases[0], 0)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("unexpected error: want %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer state.removeFiles(files)
+
+			if len(files) != 1 {
+				t.Fatalf("unexpected number of values files: want 1, got %d", len(files))
+			}
+
+			bs, err := ioutil.ReadFile(files[0])
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if d := cmp.Diff(tc.wantValues, string(bs)); d != "" {
+				t.Errorf("unexpected values: want (-), got (+):\n%s", d)
+			}
+
+			if d := cmp.Diff(tc.wantDecrypts, helm.decrypted); d != "" {
+				t.Errorf("unexpected helm-secrets decryptions: want (-), got (+):\n%s", d)
+			}
+
+			var commands []string
+			for _, c := range runner.commands {
+				commands = append(commands, strings.ReplaceAll(c, dir+string(filepath.Separator), ""))
+			}
+
+			if d := cmp.Diff(tc.wantCommands, commands); d != "" {
+				t.Errorf("unexpected commands: want (-), got (+):\n%s", d)
+			}
+
+			if tc.backend == "" || tc.backend == "helm-secrets" {
+				if _, err := os.Stat(filepath.Join(dir, "decrypted-secrets.yaml")); !os.IsNotExist(err) {
+					t.Errorf("decrypted file is not removed: %v", err)
+				}
+			}
+		})
+	}
+}
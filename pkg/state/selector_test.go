@@ -195,3 +195,370 @@ func TestSelectReleasesWithOverridesWithIncludedTransitives(t *testing.T) {
 		}
 	}
 }
+
+func TestSelectReleasesWithExcludeSelectors(t *testing.T) {
+	type testcase struct {
+		subject                string
+		selector               []string
+		excludeSelector        []string
+		includeTransitiveNeeds bool
+		want                   []string
+	}
+
+	testcases := []testcase{
+		{
+			subject:         "exclude without include",
+			excludeSelector: []string{"name=frontend"},
+			want:            []string{"backend", "database", "cache"},
+		},
+		{
+			subject:         "exclude wins over include",
+			selector:        []string{"tier=app"},
+			excludeSelector: []string{"name=frontend"},
+			want:            []string{"backend"},
+		},
+		{
+			subject:         "multiple excludes",
+			excludeSelector: []string{"name=frontend", "tier=data,name!=database"},
+			want:            []string{"backend", "database"},
+		},
+		{
+			subject:         "exclude matching no release",
+			selector:        []string{"tier=data"},
+			excludeSelector: []string{"name=unknown"},
+			want:            []string{"database", "cache"},
+		},
+		{
+			subject:                "needs of selected releases are still included",
+			selector:               []string{"name=backend"},
+			excludeSelector:        []string{"tier=data"},
+			includeTransitiveNeeds: true,
+			want:                   []string{"backend", "database"},
+		},
+	}
+
+	example := []byte(`releases:
+- name: frontend
+  namespace: default
+  chart: stable/frontend
+  labels:
+    tier: app
+  needs:
+  - backend
+- name: backend
+  namespace: default
+  chart: stable/backend
+  labels:
+    tier: app
+  needs:
+  - database
+- name: database
+  namespace: default
+  chart: stable/database
+  labels:
+    tier: data
+- name: cache
+  namespace: default
+  chart: stable/cache
+  labels:
+    tier: data
+`)
+
+	state := stateTestEnv{
+		Files: map[string]string{
+			"/helmfile.yaml": string(example),
+		},
+		WorkDir: "/",
+	}.MustLoadState(t, "/helmfile.yaml", "default")
+
+	for _, tc := range testcases {
+		state.Selectors = tc.selector
+		state.ExcludeSelectors = tc.excludeSelector
+
+		rs, err := state.GetSelectedReleasesWithOverrides(tc.includeTransitiveNeeds)
+		if err != nil {
+			t.Fatalf("%s %s: %v", tc.excludeSelector, tc.subject, err)
+		}
+
+		var got []string
+
+		for _, r := range rs {
+			got = append(got, r.Name)
+		}
+
+		if d := cmp.Diff(tc.want, got); d != "" {
+			t.Errorf("%s %s: %s", tc.excludeSelector, tc.subject, d)
+		}
+	}
+}
+
+func TestSelectReleasesWithCommonLabels(t *testing.T) {
+	type testcase struct {
+		subject  string
+		selector []string
+		want     []string
+	}
+
+	testcases := []testcase{
+		{
+			subject:  "release label takes precedence over common label",
+			selector: []string{"app=foo"},
+			want:     []string{"foo"},
+		},
+		{
+			subject:  "common label of releases without the label",
+			selector: []string{"app=bar"},
+			want:     []string{"bar"},
+		},
+		{
+			subject:  "common label without release label of the same key",
+			selector: []string{"team=platform"},
+			want:     []string{"foo", "bar"},
+		},
+	}
+
+	example := []byte(`commonLabels:
+  app: bar
+  team: platform
+releases:
+- name: foo
+  namespace: default
+  chart: stable/foo
+  labels:
+    app: foo
+- name: bar
+  namespace: default
+  chart: stable/bar
+`)
+
+	state := stateTestEnv{
+		Files: map[string]string{
+			"/helmfile.yaml": string(example),
+		},
+		WorkDir: "/",
+	}.MustLoadState(t, "/helmfile.yaml", "default")
+
+	for _, tc := range testcases {
+		state.Selectors = tc.selector
+
+		rs, err := state.GetSelectedReleasesWithOverrides(false)
+		if err != nil {
+			t.Fatalf("%s %s: %v", tc.selector, tc.subject, err)
+		}
+
+		var got []string
+
+		for _, r := range rs {
+			got = append(got, r.Name)
+		}
+
+		if d := cmp.Diff(tc.want, got); d != "" {
+			t.Errorf("%s %s: %s", tc.selector, tc.subject, d)
+		}
+	}
+}
+
+func TestPlanReleasesWithNeedsSelectors(t *testing.T) {
+	example := []byte(`releases:
+- name: db1
+  namespace: data
+  chart: stable/db
+  labels:
+    tier: data
+- name: db2
+  namespace: data
+  chart: stable/db
+  labels:
+    tier: data
+- name: app
+  namespace: default
+  chart: stable/app
+  labels:
+    tier: web
+  needs:
+  - selector:tier=data
+- name: cache
+  namespace: data
+  chart: stable/cache
+  labels:
+    tier: data
+  needs:
+  - selector:tier=data,chart=db
+`)
+
+	state := stateTestEnv{
+		Files: map[string]string{
+			"/helmfile.yaml": string(example),
+		},
+		WorkDir: "/",
+	}.MustLoadState(t, "/helmfile.yaml", "default")
+
+	groups, err := state.PlanReleases(PlanOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got [][]string
+	for _, g := range groups {
+		var names []string
+		for _, r := range g {
+			names = append(names, r.Name)
+		}
+		got = append(got, names)
+	}
+
+	want := [][]string{{"db1", "db2"}, {"cache"}, {"app"}}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("unexpected groups: want (-), got (+):\n%s", d)
+	}
+
+	state.Selectors = []string{"name=app"}
+
+	rs, err := state.GetSelectedReleasesWithOverrides(true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var selected []string
+	for _, r := range rs {
+		selected = append(selected, r.Name)
+	}
+
+	if d := cmp.Diff([]string{"db1", "db2", "app", "cache"}, selected); d != "" {
+		t.Errorf("unexpected releases selected with transitive needs: want (-), got (+):\n%s", d)
+	}
+}
+
+func TestPlanReleasesWithNeedsSelectors_NoMatch(t *testing.T) {
+	example := []byte(`releases:
+- name: db
+  chart: stable/db
+  labels:
+    tier: data
+- name: app
+  chart: stable/app
+  needs:
+  - selector:tier=dta
+`)
+
+	state := stateTestEnv{
+		Files: map[string]string{
+			"/helmfile.yaml": string(example),
+		},
+		WorkDir: "/",
+	}.MustLoadState(t, "/helmfile.yaml", "default")
+
+	_, err := state.PlanReleases(PlanOptions{})
+
+	want := `release "app" needs "selector:tier=dta" but no release matches the selector. Perhaps you made a typo in "needs" or forgot labeling releases?`
+	if err == nil || err.Error() != want {
+		t.Errorf("unexpected error: want %q, got %v", want, err)
+	}
+}
+
+func TestPlanReleasesWithNeedsGlobs(t *testing.T) {
+	example := []byte(`releases:
+- name: db
+  namespace: infra
+  chart: stable/db
+- name: queue
+  namespace: infra
+  chart: stable/queue
+  needs:
+  - db
+- name: ingress
+  namespace: edge
+  chart: stable/ingress
+- name: app
+  namespace: default
+  chart: stable/app
+  needs:
+  - infra/*
+- name: frontend
+  namespace: web
+  chart: stable/frontend
+  needs:
+  - "*/app"
+- name: monitoring
+  namespace: infra
+  chart: stable/monitoring
+  needs:
+  - infra/*
+`)
+
+	state := stateTestEnv{
+		Files: map[string]string{
+			"/helmfile.yaml": string(example),
+		},
+		WorkDir: "/",
+	}.MustLoadState(t, "/helmfile.yaml", "default")
+
+	releases, err := expandNeedsSelectors(state.GetReleasesWithOverrides(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	needs := map[string][]string{}
+	for _, r := range releases {
+		needs[r.Name] = r.Needs
+	}
+
+	// A release never needs itself even when it matches its own pattern
+	wantNeeds := map[string][]string{
+		"queue":      {"infra/db"},
+		"app":        {"infra/db", "infra/queue", "infra/monitoring"},
+		"frontend":   {"default/app"},
+		"monitoring": {"infra/db", "infra/queue"},
+	}
+	for name, want := range wantNeeds {
+		if d := cmp.Diff(want, needs[name]); d != "" {
+			t.Errorf("unexpected needs of %s: want (-), got (+):\n%s", name, d)
+		}
+	}
+
+	groups, err := state.PlanReleases(PlanOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got [][]string
+	for _, g := range groups {
+		var names []string
+		for _, r := range g {
+			names = append(names, r.Name)
+		}
+		got = append(got, names)
+	}
+
+	want := [][]string{{"db", "ingress"}, {"queue"}, {"monitoring"}, {"app"}, {"frontend"}}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("unexpected groups: want (-), got (+):\n%s", d)
+	}
+}
+
+func TestPlanReleasesWithNeedsGlobs_NoMatch(t *testing.T) {
+	example := []byte(`releases:
+- name: db
+  namespace: infra
+  chart: stable/db
+- name: app
+  namespace: default
+  chart: stable/app
+  needs:
+  - infar/*
+`)
+
+	state := stateTestEnv{
+		Files: map[string]string{
+			"/helmfile.yaml": string(example),
+		},
+		WorkDir: "/",
+	}.MustLoadState(t, "/helmfile.yaml", "default")
+
+	_, err := state.PlanReleases(PlanOptions{})
+
+	want := `release "app" needs "infar/*" but no release matches the pattern. Perhaps you made a typo in "needs"?`
+	if err == nil || err.Error() != want {
+		t.Errorf("unexpected error: want %q, got %v", want, err)
+	}
+}
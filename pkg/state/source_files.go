@@ -0,0 +1,84 @@
+package state
+
+import "github.com/roboll/helmfile/pkg/remote"
+
+// StateSourceFiles returns the paths to the local files that every release in the state depends on,
+// that are the state file itself, its bases, the default values files, and the values and secrets files of the current environment.
+// Glob patterns are expanded, and remote files are omitted.
+func (st *HelmState) StateSourceFiles() ([]string, error) {
+	paths := []string{st.FilePath}
+	paths = append(paths, st.Bases...)
+	paths = append(paths, stringEntries(st.DefaultValues)...)
+
+	if env, ok := st.Environments[st.Env.Name]; ok {
+		paths = append(paths, stringEntries(env.Values)...)
+		paths = append(paths, env.Secrets...)
+	}
+
+	return st.expandSourceFiles(paths)
+}
+
+// ReleaseSourceFiles returns the paths to the local files and directories the release depends on,
+// that are the directory of the local chart, and the values, secrets and `set` files.
+// It's expected to be called on a templated release, so that templated paths are already rendered.
+// Glob patterns are expanded, and remote files and the commands of `exec://` values entries are omitted.
+func (st *HelmState) ReleaseSourceFiles(release *ReleaseSpec) ([]string, error) {
+	var paths []string
+
+	paths = append(paths, stringEntries(release.Values)...)
+	paths = append(paths, stringEntries(release.Secrets)...)
+
+	for _, set := range release.SetValues {
+		if set.File != "" {
+			paths = append(paths, set.File)
+		}
+	}
+
+	files, err := st.expandSourceFiles(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	if release.Chart != "" && isLocalChart(release.Chart) {
+		files = append(files, normalizeChart(st.basePath, release.Chart))
+	}
+
+	return files, nil
+}
+
+func (st *HelmState) expandSourceFiles(paths []string) ([]string, error) {
+	storage := st.storage()
+
+	var files []string
+
+	for _, p := range paths {
+		if p == "" || remote.IsRemote(p) || isExecValues(p) {
+			continue
+		}
+
+		matches, err := storage.ExpandPaths(p)
+		if err != nil {
+			return nil, err
+		}
+
+		// A file that no longer exists, like the one deleted in the change, is still a source of the state
+		if len(matches) == 0 {
+			matches = []string{storage.normalizePath(p)}
+		}
+
+		files = append(files, matches...)
+	}
+
+	return files, nil
+}
+
+// stringEntries returns the entries of values or secrets that are paths to files, omitting the inline values
+func stringEntries(entries []interface{}) []string {
+	var paths []string
+	for _, e := range entries {
+		if p, ok := e.(string); ok {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
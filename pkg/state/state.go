@@ -2,12 +2,14 @@ package state
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
@@ -17,13 +19,15 @@ import (
 	"strings"
 	"sync"
 	"text/template"
+	"time"
 
-	"github.com/imdario/mergo"
+	ghodssyaml "github.com/ghodss/yaml"
 	"github.com/variantdev/chartify"
 
 	"github.com/roboll/helmfile/pkg/environment"
 	"github.com/roboll/helmfile/pkg/event"
 	"github.com/roboll/helmfile/pkg/helmexec"
+	"github.com/roboll/helmfile/pkg/maputil"
 	"github.com/roboll/helmfile/pkg/remote"
 	"github.com/roboll/helmfile/pkg/tmpl"
 
@@ -60,6 +64,28 @@ type ReleaseSetSpec struct {
 	CommonLabels        map[string]string `yaml:"commonLabels,omitempty"`
 	Releases            []ReleaseSpec     `yaml:"releases,omitempty"`
 	Selectors           []string          `yaml:"-"`
+	// ExcludeSelectors are the selectors given via --exclude-selector. Releases matching any of them are filtered out
+	// even when they match Selectors.
+	ExcludeSelectors []string `yaml:"-"`
+
+	// ConcurrencyPerContext limits the number of the releases processed concurrently for each kube context, as set by
+	// --concurrency-per-context. There's no limit other than the global concurrency when it's 0.
+	ConcurrencyPerContext int `yaml:"-"`
+
+	// NoHooks skips the helmfile hooks and makes helm skip the chart hooks, as set by --no-hooks
+	NoHooks bool `yaml:"-"`
+
+	// EnableExecValues allows the values entries prefixed with `exec://` to run commands, as set by --enable-exec-values
+	EnableExecValues bool `yaml:"-"`
+
+	// ChartOverrides replace the charts of the matching releases with local charts, as set by --chart-override
+	ChartOverrides []ChartOverride `yaml:"-"`
+
+	// Timings records the time spent in each phase of the run when --timings is enabled, and nil otherwise
+	Timings *Timings `yaml:"-"`
+
+	// DebugFiles collects the temporary files instead of removing them when --dump-debug-bundle is set, and is nil otherwise
+	DebugFiles *DebugFiles `yaml:"-"`
 
 	// Capabilities.APIVersions
 	ApiVersions []string `yaml:"apiVersions,omitempty"`
@@ -72,8 +98,15 @@ type ReleaseSetSpec struct {
 
 	Templates map[string]TemplateSpec `yaml:"templates"`
 
+	// ValueBundles are the named lists of values entries shared by the releases that reference them in valuesFrom
+	ValueBundles map[string][]interface{} `yaml:"valueBundles,omitempty"`
+
 	Env environment.Environment `yaml:"-"`
 
+	// MergeValuesStrategy is the strategy to merge the values and secrets files of each release with,
+	// which is one of "deep", "override" and "append-arrays". Overridden by --merge-values-strategy
+	MergeValuesStrategy string `yaml:"mergeValuesStrategy,omitempty"`
+
 	// If set to "Error", return an error when a subhelmfile points to a
 	// non-existent path. The default behavior is to print a warning. Note the
 	// differing default compared to other MissingFileHandlers.
@@ -101,8 +134,20 @@ type HelmState struct {
 	tempDir           func(string, string) (string, error)
 	directoryExistsAt func(string) bool
 
+	// runner runs commands other than helm, like kubectl. ShellRunner is used when nil
+	runner helmexec.Runner
+
+	// sleep waits between retries of failed releases. time.Sleep is used when nil
+	sleep func(time.Duration)
+
+	// httpClient is used for querying OCI registries. http.DefaultClient is used when nil
+	httpClient *http.Client
+
 	valsRuntime vals.Evaluator
 
+	// installedReleases caches the result of `helm list` for each release across the diff, delete, and sync phases
+	installedReleases *releaseInstalledCache
+
 	// RenderedValues is the helmfile-wide values that is `.Values`
 	// which is accessible from within the whole helmfile go template.
 	// Note that this is usually computed by DesiredStateLoader from ReleaseSetSpec.Env
@@ -139,7 +184,10 @@ type HelmSpec struct {
 	// WaitForJobs, if set and --wait enabled, will wait until all Jobs have been completed before marking the release as successful. It will wait for as long as --timeout
 	WaitForJobs bool `yaml:"waitForJobs"`
 	// Timeout is the time in seconds to wait for any individual Kubernetes operation (like Jobs for hooks, and waits on pod/pvc/svc/deployment readiness) (default 300)
-	Timeout int `yaml:"timeout"`
+	// It can also be written as a duration string like `5m`.
+	Timeout Duration `yaml:"timeout"`
+	// WaitTimeout is the timeout used instead of Timeout when helm waits for the release to be ready with --wait, if it's larger than Timeout
+	WaitTimeout Duration `yaml:"waitTimeout,omitempty"`
 	// RecreatePods, when set to true, instruct helmfile to perform pods restart for the resource if applicable
 	RecreatePods bool `yaml:"recreatePods"`
 	// Force, when set to true, forces resource update through delete/recreate if needed
@@ -148,6 +196,26 @@ type HelmSpec struct {
 	Atomic bool `yaml:"atomic"`
 	// CleanupOnFail, when set to true, the --cleanup-on-fail helm flag is passed to the upgrade command
 	CleanupOnFail bool `yaml:"cleanupOnFail,omitempty"`
+	// TakeOwnership, when set to true, the --take-ownership helm flag is passed to the upgrade command
+	// so that helm adopts the existing resources of the release. Requires Helm 3.17.0 or greater
+	TakeOwnership bool `yaml:"takeOwnership,omitempty"`
+	// ReuseValues, when set to true, the --reuse-values helm flag is passed to the upgrade command
+	ReuseValues bool `yaml:"reuseValues,omitempty"`
+	// ResetValues, when set to true, the --reset-values helm flag is passed to the upgrade command
+	ResetValues bool `yaml:"resetValues,omitempty"`
+	// Retries is the number of times a failed `helm upgrade --install` is retried when the error looks transient (default 0)
+	Retries int `yaml:"retries,omitempty"`
+	// RetryBackoff is the time in seconds to wait before the first retry. It doubles on each subsequent retry (default 5)
+	RetryBackoff Duration `yaml:"retryBackoff,omitempty"`
+	// RetryOn is the list of regular expressions matched against the helm error to decide if it is retried.
+	// Defaults to connection and timeout errors
+	RetryOn []string `yaml:"retryOn,omitempty"`
+	// WaitRetries is the number of times `helm upgrade --install --wait` is run again to wait for the release to become ready,
+	// when it timed out waiting for the resources (default 0)
+	WaitRetries int `yaml:"waitRetries,omitempty"`
+	// GuardedKinds is the list of kinds of resources, like PersistentVolumeClaim, whose changes make `helmfile apply` fail
+	// unless `--force` is passed
+	GuardedKinds []string `yaml:"guardedKinds,omitempty"`
 	// HistoryMax, limit the maximum number of revisions saved per release. Use 0 for no limit (default 10)
 	HistoryMax *int `yaml:"historyMax,omitempty"`
 	// CreateNamespace, when set to true (default), --create-namespace is passed to helm3 on install/upgrade (ignored for helm2)
@@ -163,6 +231,13 @@ type HelmSpec struct {
 	TLSCert                  string `yaml:"tlsCert,omitempty"`
 	DisableValidation        *bool  `yaml:"disableValidation,omitempty"`
 	DisableOpenAPIValidation *bool  `yaml:"disableOpenAPIValidation,omitempty"`
+	// ServerSideDiff, when set to true, makes helm-diff run with `--dry-run=server`. Requires helm 3.13.0 and helm-diff 3.9.0 or greater
+	ServerSideDiff bool `yaml:"serverSideDiff,omitempty"`
+
+	// PostRenderer is the path to an executable passed to helm via `--post-renderer`. Requires Helm 3.1.0 or greater
+	PostRenderer string `yaml:"postRenderer,omitempty"`
+	// PostRendererArgs are the arguments passed to the post-renderer via `--post-renderer-args`. Requires Helm 3.7.0 or greater
+	PostRendererArgs []string `yaml:"postRendererArgs,omitempty"`
 }
 
 // RepositorySpec that defines values for a helm repo
@@ -178,6 +253,9 @@ type RepositorySpec struct {
 	OCI             bool   `yaml:"oci,omitempty"`
 	PassCredentials string `yaml:"passCredentials,omitempty"`
 	SkipTLSVerify   string `yaml:"skipTLSVerify,omitempty"`
+	// CredentialsRef is resolved via vals into Username and Password when the repository is added or logged in.
+	// See RepositoryCredentialsRef for the accepted forms.
+	CredentialsRef *RepositoryCredentialsRef `yaml:"credentialsRef,omitempty"`
 }
 
 // ReleaseSpec defines the structure of a helm release
@@ -187,6 +265,9 @@ type ReleaseSpec struct {
 	// Directory is an alias to Chart which may be of more fit when you want to use a local/remote directory containing
 	// K8s manifests or Kustomization as a chart
 	Directory string `yaml:"directory,omitempty"`
+	// SubchartPath is the path to the subchart within the chart, like `charts/subapp`.
+	// When set, the subchart is installed as the release instead of the chart itself.
+	SubchartPath string `yaml:"subchartPath,omitempty"`
 	// Version is the semver version or version constraint for the chart
 	Version string `yaml:"version,omitempty"`
 	// Verify enables signature verification on fetched chart.
@@ -199,7 +280,10 @@ type ReleaseSpec struct {
 	// WaitForJobs, if set and --wait enabled, will wait until all Jobs have been completed before marking the release as successful. It will wait for as long as --timeout
 	WaitForJobs *bool `yaml:"waitForJobs,omitempty"`
 	// Timeout is the time in seconds to wait for any individual Kubernetes operation (like Jobs for hooks, and waits on pod/pvc/svc/deployment readiness) (default 300)
-	Timeout *int `yaml:"timeout,omitempty"`
+	// It can also be written as a duration string like `5m`.
+	Timeout *Duration `yaml:"timeout,omitempty"`
+	// WaitTimeout is the timeout used instead of Timeout when helm waits for the release to be ready with --wait, if it's larger than Timeout
+	WaitTimeout *Duration `yaml:"waitTimeout,omitempty"`
 	// RecreatePods, when set to true, instruct helmfile to perform pods restart for the resource if applicable
 	RecreatePods *bool `yaml:"recreatePods,omitempty"`
 	// Force, when set to true, forces resource update through delete/recreate if needed
@@ -210,6 +294,25 @@ type ReleaseSpec struct {
 	Atomic *bool `yaml:"atomic,omitempty"`
 	// CleanupOnFail, when set to true, the --cleanup-on-fail helm flag is passed to the upgrade command
 	CleanupOnFail *bool `yaml:"cleanupOnFail,omitempty"`
+	// ReleaseLabels are set to the helm release via `helm upgrade --labels`, so that the release can be queried with `helm list -l`.
+	// Unlike Labels, which are used only by helmfile for selecting releases, they require Helm 3.13.0 or greater
+	ReleaseLabels map[string]string `yaml:"releaseLabels,omitempty"`
+	// ReuseValues, when set to true, the --reuse-values helm flag is passed to the upgrade command
+	ReuseValues *bool `yaml:"reuseValues,omitempty"`
+	// ResetValues, when set to true, the --reset-values helm flag is passed to the upgrade command
+	ResetValues *bool `yaml:"resetValues,omitempty"`
+	// Retries is the number of times a failed `helm upgrade --install` is retried when the error looks transient
+	Retries *int `yaml:"retries,omitempty"`
+	// RetryBackoff is the time in seconds to wait before the first retry. It doubles on each subsequent retry
+	RetryBackoff *Duration `yaml:"retryBackoff,omitempty"`
+	// RetryOn is the list of regular expressions matched against the helm error to decide if it is retried
+	RetryOn []string `yaml:"retryOn,omitempty"`
+	// WaitRetries is the number of times `helm upgrade --install --wait` is run again to wait for the release to become ready,
+	// when it timed out waiting for the resources
+	WaitRetries *int `yaml:"waitRetries,omitempty"`
+	// GuardedKinds is the list of kinds of resources whose changes make `helmfile apply` fail unless `--force` is passed.
+	// It overrides helmDefaults.guardedKinds
+	GuardedKinds []string `yaml:"guardedKinds,omitempty"`
 	// HistoryMax, limit the maximum number of revisions saved per release. Use 0 for no limit (default 10)
 	HistoryMax *int `yaml:"historyMax,omitempty"`
 	// Condition, when set, evaluate the mapping specified in this string to a boolean which decides whether or not to process the release
@@ -229,15 +332,39 @@ type ReleaseSpec struct {
 	// FYI, such diff without `--disable-validation` fails on first install because the K8s cluster doesn't have CRDs registered yet.
 	DisableValidation *bool `yaml:"disableValidation,omitempty"`
 
+	// PostRenderer is the path to an executable that helm runs via `--post-renderer` to modify the rendered manifests.
+	// A relative path is resolved relative to the helmfile.yaml, while a bare name is looked up in PATH by helm.
+	// It overrides helmDefaults.postRenderer.
+	PostRenderer string `yaml:"postRenderer,omitempty"`
+	// PostRendererArgs are the arguments passed to the post-renderer via `--post-renderer-args`
+	PostRendererArgs []string `yaml:"postRendererArgs,omitempty"`
+
 	// DisableValidationOnInstall disables the K8s API validation while running helm-diff on the release being newly installed on helmfile-apply.
 	// It is useful when any release contains custom resources for CRDs that is not yet installed onto the cluster.
 	DisableValidationOnInstall *bool `yaml:"disableValidationOnInstall,omitempty"`
 
+	// SkipDiffOnInstall skips running helm-diff on the release being newly installed, like --skip-diff-on-install does for all the releases.
+	// It is useful for a huge chart whose diff on the first install is too long to be useful.
+	SkipDiffOnInstall *bool `yaml:"skipDiffOnInstall,omitempty"`
+
+	// ServerSideDiff, when set to true, makes helm-diff render the release with `--dry-run=server`,
+	// so that admission webhooks and defaulting are reflected in the diff.
+	// It requires helm 3.13.0 and helm-diff 3.9.0 or greater. It's ignored with a warning on older versions.
+	ServerSideDiff *bool `yaml:"serverSideDiff,omitempty"`
+
+	// ValidateValuesSchema, when set to true, validates the merged values of the release against the chart's values.schema.json
+	// before running helm. It overrides the --validate-values flag.
+	ValidateValuesSchema *bool `yaml:"validateValuesSchema,omitempty"`
+
 	// MissingFileHandler is set to either "Error" or "Warn". "Error" instructs helmfile to fail when unable to find a values or secrets file. When "Warn", it prints the file and continues.
 	// The default value for MissingFileHandler is "Error".
 	MissingFileHandler *string `yaml:"missingFileHandler,omitempty"`
 	// Needs is the [TILLER_NS/][NS/]NAME representations of releases that this release depends on.
+	// An entry like `selector:tier=data` depends on all the releases matching the label selector.
 	Needs []string `yaml:"needs,omitempty"`
+	// After is the [TILLER_NS/][NS/]NAME representations of releases that this release should be processed after.
+	// Unlike Needs, it only orders the release after the ones selected along with it, and never requires them to be defined or selected.
+	After []string `yaml:"after,omitempty"`
 
 	// Hooks is a list of extension points paired with operations, that are executed in specific points of the lifecycle of releases defined in helmfile
 	Hooks []event.Hook `yaml:"hooks,omitempty"`
@@ -248,7 +375,14 @@ type ReleaseSpec struct {
 	Labels    map[string]string `yaml:"labels,omitempty"`
 	Values    []interface{}     `yaml:"values,omitempty"`
 	Secrets   []interface{}     `yaml:"secrets,omitempty"`
-	SetValues []SetValue        `yaml:"set,omitempty"`
+	// ValuesFrom references the valueBundles like `@name`, whose values entries are prepended to Values on load
+	ValuesFrom []string `yaml:"valuesFrom,omitempty"`
+	// SecretsBackend is the way to decrypt Secrets, either `helm-secrets`(default), `sops` or `vals`.
+	SecretsBackend string     `yaml:"secretsBackend,omitempty"`
+	SetValues      []SetValue `yaml:"set,omitempty"`
+	// SetStringValues are passed to helm via `--set-string` so that the values are never coerced into numbers or booleans.
+	// Each entry takes either `value` or `values`.
+	SetStringValues []SetValue `yaml:"setString,omitempty"`
 
 	ValuesTemplate    []interface{} `yaml:"valuesTemplate,omitempty"`
 	SetValuesTemplate []SetValue    `yaml:"setTemplate,omitempty"`
@@ -279,6 +413,11 @@ type ReleaseSpec struct {
 	VerifyTemplate     *string `yaml:"verifyTemplate,omitempty"`
 	WaitTemplate       *string `yaml:"waitTemplate,omitempty"`
 	InstalledTemplate  *string `yaml:"installedTemplate,omitempty"`
+	// KubeContextTemplate is rendered into the kubeContext of the release, so that it can be derived from the environment and values.
+	KubeContextTemplate *string `yaml:"kubeContextTemplate,omitempty"`
+	// ChartTemplate is rendered into the chart of the release, so that a complex expression computing the chart
+	// from the environment and values doesn't need to be inlined in `chart`. `chart` can be omitted when this is set.
+	ChartTemplate *string `yaml:"chartTemplate,omitempty"`
 
 	// These settings requires helm-x integration to work
 	Dependencies          []Dependency  `yaml:"dependencies,omitempty"`
@@ -292,6 +431,13 @@ type ReleaseSpec struct {
 	// See https://github.com/kubernetes-sigs/kustomize/blob/master/examples/configureBuiltinPlugin.md#configuring-the-builtin-plugins-instead for more information.
 	Transformers []interface{} `yaml:"transformers,omitempty"`
 	Adopt        []string      `yaml:"adopt,omitempty"`
+	// AdoptAll, when set to true, labels and annotates the resources of the release that already exist in the cluster
+	// with the helm ownership metadata before the first install, so that helm adopts them instead of failing
+	AdoptAll *bool `yaml:"adoptAll,omitempty"`
+	// TakeOwnership, when set to true, the --take-ownership helm flag is passed to the upgrade command,
+	// so that helm adopts the existing resources instead of failing. Unlike AdoptAll, it needs neither kubectl nor
+	// the RBAC permissions to get and patch the existing resources, but requires Helm 3.17.0 or greater. It overrides helmDefaults.takeOwnership
+	TakeOwnership *bool `yaml:"takeOwnership,omitempty"`
 
 	//version of the chart that has really been installed cause desired version may be fuzzy (~2.0.0)
 	installedVersion string
@@ -305,11 +451,18 @@ type ReleaseSpec struct {
 
 	// ForceNamespace is an experimental feature to set metadata.namespace in every K8s resource rendered by the chart,
 	// regardless of the template, even when it doesn't have `namespace: {{ .Namespace | quote }}`.
-	// This is only needed when you can't FIX your chart to have `namespace: {{ .Namespace }}` AND you're using `helmfile template`.
+	// It applies to `helmfile template`, `diff`, `apply`, and `sync` alike, as the chart is transformed by chartify before
+	// being rendered, diffed, or installed.
+	// Resources of well-known cluster-scoped kinds like ClusterRole and CustomResourceDefinition are left without namespace.
+	// This is only needed when you can't FIX your chart to have `namespace: {{ .Namespace }}`.
 	// In standard use-cases, `Namespace` should be sufficient.
 	// Use this only when you know what you want to do!
 	ForceNamespace string `yaml:"forceNamespace,omitempty"`
 
+	// KustomizeOptions are the options used while running `kustomize build` on the release's chart.
+	// It can be set only when the chart is a local directory containing a Kustomization.
+	KustomizeOptions *KustomizeOptions `yaml:"kustomizeOptions,omitempty"`
+
 	// SkipDeps disables running `helm dependency up` and `helm dependency build` on this release's chart.
 	// This is relevant only when your release uses a local chart or a directory containing K8s manifests or a Kustomization
 	// as a Helm chart.
@@ -335,6 +488,23 @@ type AffectedReleases struct {
 	Upgraded []*ReleaseSpec
 	Deleted  []*ReleaseSpec
 	Failed   []*ReleaseSpec
+
+	// Metadata is the metadata of the upgraded releases keyed by the release IDs.
+	// Wait and Duration are shown in the summary only when Verbose is set, and Status whenever it is recorded.
+	Metadata map[string]*ReleaseMetadata
+	Verbose  bool
+	// Color colors the headers of the summary with ANSI escape codes
+	Color bool
+}
+
+// ReleaseMetadata is how a release was upgraded
+type ReleaseMetadata struct {
+	// Wait is true when helm waited for the resources of the release to be ready
+	Wait bool
+	// Duration is the time spent in upgrading the release, including the retries
+	Duration time.Duration
+	// Status is the status helm reports for the release after the upgrade. It is recorded only with --post-sync-status.
+	Status string
 }
 
 const DefaultEnv = "default"
@@ -344,6 +514,15 @@ const MissingFileHandlerInfo = "Info"
 const MissingFileHandlerWarn = "Warn"
 const MissingFileHandlerDebug = "Debug"
 
+// needsSelectorPrefix is the prefix of `needs` entries that depend on releases by a label selector like `selector:tier=data`
+const needsSelectorPrefix = "selector:"
+
+// isNeedsGlob returns true when the `needs` entry is a glob pattern like `infra/*` or `*/database`,
+// which is never a valid release name
+func isNeedsGlob(n string) bool {
+	return strings.ContainsAny(n, "*?[")
+}
+
 func (st *HelmState) ApplyOverrides(spec *ReleaseSpec) {
 	if st.OverrideKubeContext != "" {
 		spec.KubeContext = st.OverrideKubeContext
@@ -354,52 +533,71 @@ func (st *HelmState) ApplyOverrides(spec *ReleaseSpec) {
 
 	var needs []string
 
-	// Since the representation differs between needs and id,
-	// correct it by prepending Namespace and KubeContext.
 	for i := 0; i < len(spec.Needs); i++ {
 		n := spec.Needs[i]
 
-		var kubecontext, ns, name string
+		// Label selectors are expanded into release IDs later, once all the releases are known
+		if strings.HasPrefix(n, needsSelectorPrefix) {
+			needs = append(needs, n)
+			continue
+		}
 
-		components := strings.Split(n, "/")
+		needs = append(needs, releaseRefToID(spec, n))
+	}
 
-		name = components[len(components)-1]
+	spec.Needs = needs
 
-		if len(components) > 1 {
-			ns = components[len(components)-2]
-		} else if spec.TillerNamespace != "" {
-			ns = spec.TillerNamespace
-		} else {
-			ns = spec.Namespace
-		}
+	var after []string
 
-		if len(components) > 2 {
-			kubecontext = components[len(components)-3]
-		} else {
-			kubecontext = spec.KubeContext
-		}
+	for _, a := range spec.After {
+		after = append(after, releaseRefToID(spec, a))
+	}
 
-		var componentsAfterOverride []string
+	spec.After = after
+}
 
-		if kubecontext != "" {
-			componentsAfterOverride = append(componentsAfterOverride, kubecontext)
-		}
+// releaseRefToID converts the [TILLER_NS/][NS/]NAME representation of a release referenced from spec, like an entry of `needs`,
+// into the release ID.
+// Since the representation differs between needs and id, correct it by prepending Namespace and KubeContext.
+func releaseRefToID(spec *ReleaseSpec, n string) string {
+	var kubecontext, ns, name string
 
-		// This is intentionally `kubecontext != "" || ns != ""`, but "ns != ""
-		// To avoid conflating kubecontext=,namespace=foo,name=bar and kubecontext=foo,namespace=,name=bar
-		// as they are both `foo/bar`, we explicitly differentiate each with `foo//bar` and `foo/bar`.
-		// Note that `foo//bar` is not always a equivalent to `foo/default/bar` as the default namespace is depedent on
-		// the user's kubeconfig.
-		if kubecontext != "" || ns != "" {
-			componentsAfterOverride = append(componentsAfterOverride, ns)
-		}
+	components := strings.Split(n, "/")
 
-		componentsAfterOverride = append(componentsAfterOverride, name)
+	name = components[len(components)-1]
 
-		needs = append(needs, strings.Join(componentsAfterOverride, "/"))
+	if len(components) > 1 {
+		ns = components[len(components)-2]
+	} else if spec.TillerNamespace != "" {
+		ns = spec.TillerNamespace
+	} else {
+		ns = spec.Namespace
 	}
 
-	spec.Needs = needs
+	if len(components) > 2 {
+		kubecontext = components[len(components)-3]
+	} else {
+		kubecontext = spec.KubeContext
+	}
+
+	var componentsAfterOverride []string
+
+	if kubecontext != "" {
+		componentsAfterOverride = append(componentsAfterOverride, kubecontext)
+	}
+
+	// This is intentionally `kubecontext != "" || ns != ""`, but "ns != ""
+	// To avoid conflating kubecontext=,namespace=foo,name=bar and kubecontext=foo,namespace=,name=bar
+	// as they are both `foo/bar`, we explicitly differentiate each with `foo//bar` and `foo/bar`.
+	// Note that `foo//bar` is not always a equivalent to `foo/default/bar` as the default namespace is depedent on
+	// the user's kubeconfig.
+	if kubecontext != "" || ns != "" {
+		componentsAfterOverride = append(componentsAfterOverride, ns)
+	}
+
+	componentsAfterOverride = append(componentsAfterOverride, name)
+
+	return strings.Join(componentsAfterOverride, "/")
 }
 
 type RepoUpdater interface {
@@ -416,14 +614,17 @@ func (st *HelmState) SyncRepos(helm RepoUpdater, shouldSkip map[string]bool) ([]
 		if shouldSkip[repo.Name] {
 			continue
 		}
-		var err error
+		username, password, err := st.resolveRepositoryCredentials(repo)
+		if err != nil {
+			return nil, err
+		}
 		if repo.OCI {
-			username, password := gatherOCIUsernamePassword(repo.Name, repo.Username, repo.Password)
+			username, password := gatherOCIUsernamePassword(repo.Name, username, password)
 			if username != "" && password != "" {
 				err = helm.RegistryLogin(repo.URL, username, password)
 			}
 		} else {
-			err = helm.AddRepo(repo.Name, repo.URL, repo.CaFile, repo.CertFile, repo.KeyFile, repo.Username, repo.Password, repo.Managed, repo.PassCredentials, repo.SkipTLSVerify)
+			err = helm.AddRepo(repo.Name, repo.URL, repo.CaFile, repo.CertFile, repo.KeyFile, username, password, repo.Managed, repo.PassCredentials, repo.SkipTLSVerify)
 		}
 
 		if err != nil {
@@ -510,6 +711,32 @@ func (st *HelmState) prepareSyncReleases(helm helmexec.Interface, additionalValu
 					continue
 				}
 
+				// The command-line flags take precedence over the release and helmDefaults settings
+				if opts.Atomic {
+					atomic := true
+					release.Atomic = &atomic
+				}
+
+				if opts.CleanupOnFail {
+					cleanupOnFail := true
+					release.CleanupOnFail = &cleanupOnFail
+				}
+
+				if opts.NoCreateNamespace {
+					createNamespace := false
+					release.CreateNamespace = &createNamespace
+				}
+
+				if opts.HistoryMax != nil {
+					historyMax := *opts.HistoryMax
+					release.HistoryMax = &historyMax
+				}
+
+				if opts.WaitRetries > 0 {
+					waitRetries := opts.WaitRetries
+					release.WaitRetries = &waitRetries
+				}
+
 				// TODO We need a long-term fix for this :)
 				// See https://github.com/roboll/helmfile/issues/737
 				mut.Lock()
@@ -536,11 +763,7 @@ func (st *HelmState) prepareSyncReleases(helm helmexec.Interface, additionalValu
 					flags = append(flags, "--values", valfile)
 				}
 
-				if opts.Set != nil {
-					for _, s := range opts.Set {
-						flags = append(flags, "--set", s)
-					}
-				}
+				flags = append(flags, cliSetFlags(opts.Set, opts.SetString, opts.SetFile)...)
 
 				if opts.SkipCRDs {
 					flags = append(flags, "--skip-crds")
@@ -548,12 +771,17 @@ func (st *HelmState) prepareSyncReleases(helm helmexec.Interface, additionalValu
 
 				if opts.Wait {
 					flags = append(flags, "--wait")
+					flags = st.withWaitTimeout(flags, helm, release)
 				}
 
 				if opts.WaitForJobs {
 					flags = append(flags, "--wait-for-jobs")
 				}
 
+				if opts.Reason != "" {
+					flags = append(flags, "--description", opts.Reason)
+				}
+
 				if len(errs) > 0 {
 					results <- syncPrepareResult{errors: errs, files: files}
 					continue
@@ -578,13 +806,15 @@ func (st *HelmState) prepareSyncReleases(helm helmexec.Interface, additionalValu
 }
 
 func (st *HelmState) isReleaseInstalled(context helmexec.HelmContext, helm helmexec.Interface, release ReleaseSpec) (bool, error) {
-	out, err := st.listReleases(context, helm, &release)
-	if err != nil {
-		return false, err
-	} else if out != "" {
-		return true, nil
-	}
-	return false, nil
+	return st.installedReleases.get(releaseInstalledCacheKey(context, &release), func() (bool, error) {
+		out, err := st.listReleases(context, helm, &release)
+		if err != nil {
+			return false, err
+		} else if out != "" {
+			return true, nil
+		}
+		return false, nil
+	})
 }
 
 func (st *HelmState) DetectReleasesToBeDeletedForSync(helm helmexec.Interface, releases []ReleaseSpec) ([]ReleaseSpec, error) {
@@ -625,10 +855,32 @@ func (st *HelmState) DetectReleasesToBeDeleted(helm helmexec.Interface, releases
 
 type SyncOpts struct {
 	Set         []string
+	SetString   []string
+	SetFile     []string
 	SkipCleanup bool
 	SkipCRDs    bool
 	Wait        bool
 	WaitForJobs bool
+	// Atomic and CleanupOnFail, when set to true, force the corresponding helm flags on every release
+	// regardless of `releases[].atomic`, `releases[].cleanupOnFail` and `helmDefaults`
+	Atomic        bool
+	CleanupOnFail bool
+	// NoCreateNamespace, when set to true, stops passing --create-namespace to every release
+	// regardless of `releases[].createNamespace` and `helmDefaults.createNamespace`
+	NoCreateNamespace bool
+	// WaitRetries, when greater than 0, overrides `releases[].waitRetries` and `helmDefaults.waitRetries`
+	WaitRetries int
+	// HistoryMax, when not nil, overrides `releases[].historyMax` and `helmDefaults.historyMax`
+	HistoryMax *int
+	// PostSyncStatus runs `helm status` on each release after it is successfully upgraded, to report its status in the summary
+	PostSyncStatus bool
+	// FailFast, when set to true, stops starting the remaining releases once any release failed.
+	// The releases already being synced are run to completion.
+	FailFast bool
+
+	// Reason, when not empty, is recorded as the description of the release revisions created by `helm upgrade`,
+	// which is shown in `helm history`
+	Reason string
 }
 
 type SyncOpt interface{ Apply(*SyncOpts) }
@@ -717,7 +969,7 @@ func (st *HelmState) DeleteReleasesForSync(affectedReleases *AffectedReleases, h
 					if _, err := st.triggerReleaseEvent("preuninstall", nil, release, "sync"); err != nil {
 						affectedReleases.Failed = append(affectedReleases.Failed, release)
 						relErr = newReleaseFailedError(release, err)
-					} else if err := helm.DeleteRelease(context, release.Name, deletionFlags...); err != nil {
+					} else if err := st.deleteRelease(context, helm, release, deletionFlags...); err != nil {
 						affectedReleases.Failed = append(affectedReleases.Failed, release)
 						relErr = newReleaseFailedError(release, err)
 					} else if _, err := st.triggerReleaseEvent("postuninstall", nil, release, "sync"); err != nil {
@@ -725,6 +977,7 @@ func (st *HelmState) DeleteReleasesForSync(affectedReleases *AffectedReleases, h
 						relErr = newReleaseFailedError(release, err)
 					} else {
 						affectedReleases.Deleted = append(affectedReleases.Deleted, release)
+						st.installedReleases.invalidate(releaseInstalledCacheKey(context, release))
 					}
 					m.Unlock()
 				}
@@ -769,6 +1022,8 @@ func (st *HelmState) SyncReleases(affectedReleases *AffectedReleases, helm helme
 		o.Apply(opts)
 	}
 
+	defer st.Timings.Track(TimingPhaseSync)()
+
 	preps, prepErrs := st.prepareSyncReleases(helm, additionalValues, workerLimit, opts)
 
 	if !opts.SkipCleanup {
@@ -791,6 +1046,14 @@ func (st *HelmState) SyncReleases(affectedReleases *AffectedReleases, helm helme
 	}
 
 	m := new(sync.Mutex)
+	// Rendering values files for `helm template` to adopt resources suffers from the same issue as flagsForUpgrade
+	adoptMu := new(sync.Mutex)
+
+	// ctx is canceled on the first failure with --fail-fast, so that the workers stop starting the remaining releases
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	semaphores := st.newKubeContextSemaphores()
 
 	st.scatterGather(
 		workerLimit,
@@ -804,10 +1067,17 @@ func (st *HelmState) SyncReleases(affectedReleases *AffectedReleases, helm helme
 		func(workerIndex int) {
 			for prep := range jobQueue {
 				release := prep.release
+				if ctx.Err() != nil {
+					st.logger.Infof("Skipping release %q as another release failed with --fail-fast", release.Name)
+					results <- syncResult{}
+					continue
+				}
+				done := semaphores.acquire(st.kubeContext(release))
 				flags := prep.flags
 				chart := normalizeChart(st.basePath, release.Chart)
 				var relErr *ReleaseError
 				context := st.createHelmContext(release, workerIndex)
+				stopTiming := st.Timings.TrackRelease(TimingPhaseSync, ReleaseToID(release))
 
 				if _, err := st.triggerPresyncEvent(release, "sync"); err != nil {
 					relErr = newReleaseFailedError(release, err)
@@ -827,7 +1097,7 @@ func (st *HelmState) SyncReleases(affectedReleases *AffectedReleases, helm helme
 						if _, err := st.triggerReleaseEvent("preuninstall", nil, release, "sync"); err != nil {
 							affectedReleases.Failed = append(affectedReleases.Failed, release)
 							relErr = newReleaseFailedError(release, err)
-						} else if err := helm.DeleteRelease(context, release.Name, deletionFlags...); err != nil {
+						} else if err := st.deleteRelease(context, helm, release, deletionFlags...); err != nil {
 							affectedReleases.Failed = append(affectedReleases.Failed, release)
 							relErr = newReleaseFailedError(release, err)
 						} else if _, err := st.triggerReleaseEvent("postuninstall", nil, release, "sync"); err != nil {
@@ -835,23 +1105,39 @@ func (st *HelmState) SyncReleases(affectedReleases *AffectedReleases, helm helme
 							relErr = newReleaseFailedError(release, err)
 						} else {
 							affectedReleases.Deleted = append(affectedReleases.Deleted, release)
+							st.installedReleases.invalidate(releaseInstalledCacheKey(context, release))
 						}
 						m.Unlock()
 					}
-				} else if err := helm.SyncRelease(context, release.Name, chart, flags...); err != nil {
+				} else if err := st.adoptExistingResourcesWithLock(adoptMu, helm, release, workerIndex); err != nil {
 					m.Lock()
 					affectedReleases.Failed = append(affectedReleases.Failed, release)
 					m.Unlock()
 					relErr = newReleaseFailedError(release, err)
 				} else {
-					m.Lock()
-					affectedReleases.Upgraded = append(affectedReleases.Upgraded, release)
-					m.Unlock()
-					installedVersion, err := st.getDeployedVersion(context, helm, release)
-					if err != nil { //err is not really impacting so just log it
-						st.logger.Debugf("getting deployed release version failed:%v", err)
+					start := time.Now()
+
+					if err := st.syncReleaseWithRetries(context, helm, release, chart, flags...); err != nil {
+						m.Lock()
+						affectedReleases.Failed = append(affectedReleases.Failed, release)
+						m.Unlock()
+						relErr = newReleaseFailedError(release, err)
 					} else {
-						release.installedVersion = installedVersion
+						metadata := &ReleaseMetadata{Wait: hasFlag(flags, "--wait"), Duration: time.Since(start)}
+						if opts.PostSyncStatus {
+							metadata.Status = st.postSyncStatus(context, helm, release)
+						}
+						m.Lock()
+						affectedReleases.Upgraded = append(affectedReleases.Upgraded, release)
+						affectedReleases.addMetadata(release, metadata)
+						m.Unlock()
+						st.installedReleases.invalidate(releaseInstalledCacheKey(context, release))
+						installedVersion, err := st.getDeployedVersion(context, helm, release)
+						if err != nil { //err is not really impacting so just log it
+							st.logger.Debugf("getting deployed release version failed:%v", err)
+						} else {
+							release.installedVersion = installedVersion
+						}
 					}
 				}
 
@@ -871,9 +1157,15 @@ func (st *HelmState) SyncReleases(affectedReleases *AffectedReleases, helm helme
 					}
 				}
 
+				stopTiming()
+				done()
+
 				if relErr == nil {
 					results <- syncResult{}
 				} else {
+					if opts.FailFast {
+						cancel()
+					}
 					results <- syncResult{errors: []*ReleaseError{relErr}}
 				}
 			}
@@ -955,6 +1247,20 @@ type ChartPrepareOptions struct {
 	WaitForJobs            bool
 	OutputDir              string
 	IncludeTransitiveNeeds bool
+	// KubeVersion and ApiVersions override the `kubeVersion` and `apiVersions` of all the releases when set.
+	// They are passed to helm-template run by chartify as well as `helmfile template`.
+	KubeVersion string
+	ApiVersions []string
+	// ValidateValues validates the merged values of each release against the chart's values.schema.json,
+	// unless the release has validateValuesSchema set to false.
+	ValidateValues bool
+	// Digests, when set, makes remote charts fetched as archives, and records the sha256 digest of each archive in it.
+	// The archives are verified against the expected digests, if any, and expanded only when Untar is set.
+	Digests *ChartDigests
+	Untar   bool
+	// Provenance makes the provenance file of each chart archive fetched along with it, so that the chart can be verified later.
+	// It takes effect only when Digests is set.
+	Provenance bool
 }
 
 type chartPrepareResult struct {
@@ -1001,9 +1307,11 @@ type PrepareChartKey struct {
 //
 // If exists, it will also patch resources by json patches, strategic-merge patches, and injectors.
 func (st *HelmState) PrepareCharts(helm helmexec.Interface, dir string, concurrency int, helmfileCommand string, opts ChartPrepareOptions) (map[PrepareChartKey]string, []error) {
+	st.overrideCapabilities(opts.KubeVersion, opts.ApiVersions)
+
 	var selected []ReleaseSpec
 
-	if len(st.Selectors) > 0 {
+	if st.HasSelectors() {
 		var err error
 
 		// This and releasesNeedCharts ensures that we run operations like helm-dep-build and prepare-hook calls only on
@@ -1046,6 +1354,8 @@ func (st *HelmState) PrepareCharts(helm helmexec.Interface, dir string, concurre
 	}()
 	go st.pullChartWorker(pullChan, helm)
 
+	ociTags := &ociTagCache{}
+
 	st.scatterGather(
 		concurrency,
 		len(releases),
@@ -1059,6 +1369,8 @@ func (st *HelmState) PrepareCharts(helm helmexec.Interface, dir string, concurre
 			for release := range jobQueue {
 				if st.OverrideChart != "" {
 					release.Chart = st.OverrideChart
+				} else {
+					release.Chart = st.overrideChart(release)
 				}
 				// Call user-defined `prepare` hooks to create/modify local charts to be used by
 				// the later process.
@@ -1080,7 +1392,7 @@ func (st *HelmState) PrepareCharts(helm helmexec.Interface, dir string, concurre
 				chartFetchedByGoGetter := chartPath != chartName
 
 				if !chartFetchedByGoGetter {
-					ociChartPath, err := st.getOCIChart(pullChan, release, dir, helm)
+					ociChartPath, err := st.getOCIChart(pullChan, ociTags, release, dir, helm)
 					if err != nil {
 						results <- &chartPrepareResult{err: fmt.Errorf("release %q: %w", release.Name, err)}
 
@@ -1092,8 +1404,21 @@ func (st *HelmState) PrepareCharts(helm helmexec.Interface, dir string, concurre
 					}
 				}
 
+				if release.SubchartPath != "" {
+					chartPath, err = st.locateSubchart(helm, release, dir, chartPath)
+					if err != nil {
+						results <- &chartPrepareResult{err: fmt.Errorf("release %q: %w", release.Name, err)}
+						return
+					}
+				}
+
 				isLocal := st.directoryExistsAt(normalizeChart(st.basePath, chartName))
 
+				validateValues := opts.ValidateValues
+				if release.ValidateValuesSchema != nil {
+					validateValues = *release.ValidateValuesSchema
+				}
+
 				chartification, clean, err := st.PrepareChartify(helm, release, chartPath, workerIndex)
 				if !opts.SkipCleanup {
 					defer clean()
@@ -1134,6 +1459,10 @@ func (st *HelmState) PrepareCharts(helm helmexec.Interface, dir string, concurre
 					chartifyOpts.KubeVersion = release.KubeVersion
 					chartifyOpts.ApiVersions = release.ApiVersions
 
+					if chartification.Chart != "" {
+						chartPath = chartification.Chart
+					}
+
 					out, err := c.Chartify(release.Name, chartPath, chartify.WithChartifyOpts(chartifyOpts))
 					if err != nil {
 						results <- &chartPrepareResult{err: err}
@@ -1142,6 +1471,13 @@ func (st *HelmState) PrepareCharts(helm helmexec.Interface, dir string, concurre
 						chartPath = out
 					}
 
+					if chartifyOpts.OverrideNamespace != "" {
+						if err := unsetClusterScopedNamespaces(chartPath); err != nil {
+							results <- &chartPrepareResult{err: fmt.Errorf("release %q: %w", release.Name, err)}
+							return
+						}
+					}
+
 					// Skip `helm dep build` and `helm dep up` altogether when the chart is from remote or the dep is
 					// explicitly skipped.
 					buildDeps = !skipDeps
@@ -1172,7 +1508,7 @@ func (st *HelmState) PrepareCharts(helm helmexec.Interface, dir string, concurre
 					chartPath = normalizedChart
 
 					buildDeps = !skipDeps
-				} else if !opts.ForceDownload {
+				} else if !opts.ForceDownload && (!validateValues || isLocalChart(chartPath)) {
 					// At this point, we are sure that either:
 					// 1. It is a local chart and we can use it in later process (helm upgrade/template/lint/etc)
 					//    without any modification, or
@@ -1184,46 +1520,26 @@ func (st *HelmState) PrepareCharts(helm helmexec.Interface, dir string, concurre
 					//    only on helm v3.
 					//    For helm 2, we `helm fetch` with the version flags and call `helm template`
 					//    WITHOUT the version flags.
-				} else {
-					pathElems := []string{
-						dir,
-					}
-
-					if release.TillerNamespace != "" {
-						pathElems = append(pathElems, release.TillerNamespace)
-					}
-
-					if release.Namespace != "" {
-						pathElems = append(pathElems, release.Namespace)
-					}
-
-					if release.KubeContext != "" {
-						pathElems = append(pathElems, release.KubeContext)
-					}
-
-					chartVersion := "latest"
-					if release.Version != "" {
-						chartVersion = release.Version
+					//
+					// A remote chart is fetched when its values are validated, as it needs the chart's values.schema.json.
+				} else if opts.Digests != nil {
+					chartPath, err = st.fetchChartArchive(helm, release, dir, opts.Digests, opts.Untar, opts.Provenance)
+					if err != nil {
+						results <- &chartPrepareResult{err: err}
+						return
 					}
-
-					pathElems = append(pathElems, release.Name, chartName, chartVersion)
-
-					chartPath = path.Join(pathElems...)
-
-					// only fetch chart if it is not already fetched
-					if _, err := os.Stat(chartPath); os.IsNotExist(err) {
-						fetchFlags := st.chartVersionFlags(release)
-						fetchFlags = append(fetchFlags, "--untar", "--untardir", chartPath)
-						if err := helm.Fetch(chartName, fetchFlags...); err != nil {
-							results <- &chartPrepareResult{err: err}
-							return
-						}
+				} else {
+					chartPath, err = st.fetchChart(helm, release, dir)
+					if err != nil {
+						results <- &chartPrepareResult{err: err}
+						return
 					}
+				}
 
-					// Set chartPath to be the path containing Chart.yaml, if found
-					fullChartPath, err := findChartDirectory(chartPath)
-					if err == nil {
-						chartPath = filepath.Dir(fullChartPath)
+				if validateValues {
+					if err := st.validateValuesSchema(helm, release, chartPath, workerIndex); err != nil {
+						results <- &chartPrepareResult{err: err}
+						return
 					}
 				}
 
@@ -1310,10 +1626,19 @@ func (st *HelmState) runHelmDepBuilds(helm helmexec.Interface, concurrency int,
 
 type TemplateOpts struct {
 	Set               []string
+	SetString         []string
+	SetFile           []string
 	SkipCleanup       bool
 	OutputDirTemplate string
-	IncludeCRDs       bool
-	SkipTests         bool
+	// OutputFileTemplate, when set, makes TemplateReleases write all the manifests of each release into a single file
+	// whose path is generated from the template, instead of a directory per release.
+	OutputFileTemplate string
+	IncludeCRDs        bool
+	SkipTests          bool
+	// KubeVersion and ApiVersions, when set, override the `kubeVersion` and `apiVersions` of all the releases
+	// for this run only, so that the releases can be templated once per set of capabilities.
+	KubeVersion string
+	ApiVersions []string
 }
 
 type TemplateOpt interface{ Apply(*TemplateOpts) }
@@ -1342,6 +1667,17 @@ func (st *HelmState) TemplateReleases(helm helmexec.Interface, outputDir string,
 
 		st.ApplyOverrides(release)
 
+		if opts.KubeVersion != "" || len(opts.ApiVersions) > 0 {
+			r := *release
+			if opts.KubeVersion != "" {
+				r.KubeVersion = opts.KubeVersion
+			}
+			if len(opts.ApiVersions) > 0 {
+				r.ApiVersions = opts.ApiVersions
+			}
+			release = &r
+		}
+
 		flags, files, err := st.flagsForTemplate(helm, release, 0)
 
 		if !opts.SkipCleanup {
@@ -1364,13 +1700,19 @@ func (st *HelmState) TemplateReleases(helm helmexec.Interface, outputDir string,
 			flags = append(flags, "--values", valfile)
 		}
 
-		if opts.Set != nil {
-			for _, s := range opts.Set {
-				flags = append(flags, "--set", s)
+		flags = append(flags, cliSetFlags(opts.Set, opts.SetString, opts.SetFile)...)
+
+		var combinedOutputDir string
+
+		if len(opts.OutputFileTemplate) > 0 {
+			// helm writes a file per template, which is combined into a single file after rendering
+			combinedOutputDir, err = ioutil.TempDir("", "helmfile-template-")
+			if err != nil {
+				errs = append(errs, err)
 			}
-		}
 
-		if len(outputDir) > 0 || len(opts.OutputDirTemplate) > 0 {
+			flags = append(flags, "--output-dir", combinedOutputDir)
+		} else if len(outputDir) > 0 || len(opts.OutputDirTemplate) > 0 {
 			releaseOutputDir, err := st.GenerateOutputDir(outputDir, release, opts.OutputDirTemplate)
 			if err != nil {
 				errs = append(errs, err)
@@ -1386,6 +1728,11 @@ func (st *HelmState) TemplateReleases(helm helmexec.Interface, outputDir string,
 
 		if validate {
 			flags = append(flags, "--validate")
+
+			// Validation is done against the cluster, so it must target the kube context of the release, as upgrade and diff do.
+			if kubeContext := st.kubeContext(release); kubeContext != "" {
+				flags = append(flags, "--kube-context", kubeContext)
+			}
 		}
 
 		if opts.IncludeCRDs {
@@ -1399,6 +1746,16 @@ func (st *HelmState) TemplateReleases(helm helmexec.Interface, outputDir string,
 		if len(errs) == 0 {
 			if err := helm.TemplateRelease(release.Name, release.Chart, flags...); err != nil {
 				errs = append(errs, err)
+			} else if combinedOutputDir != "" {
+				if err := st.writeCombinedReleaseManifests(release, combinedOutputDir, opts.OutputFileTemplate); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+
+		if combinedOutputDir != "" {
+			if err := os.RemoveAll(combinedOutputDir); err != nil {
+				st.logger.Warnf("warn: %v\n", err)
 			}
 		}
 
@@ -1473,23 +1830,14 @@ func (st *HelmState) WriteReleasesValues(helm helmexec.Interface, additionalValu
 
 		st.logger.Infof("Writing values file %s", outputValuesFile)
 
-		merged := map[string]interface{}{}
-
-		for _, f := range append(generatedFiles, additionalValues...) {
-			src := map[string]interface{}{}
-
-			srcBytes, err := st.readFile(f)
-			if err != nil {
-				return []error{fmt.Errorf("reading %s: %w", f, err)}
-			}
-
-			if err := yaml.Unmarshal(srcBytes, &src); err != nil {
-				return []error{fmt.Errorf("unmarshalling yaml %s: %w", f, err)}
-			}
+		merged, err := st.mergeValuesFiles(append(generatedFiles, additionalValues...))
+		if err != nil {
+			return []error{err}
+		}
 
-			if err := mergo.Merge(&merged, &src, mergo.WithOverride, mergo.WithOverwriteWithEmptyValue); err != nil {
-				return []error{fmt.Errorf("merging %s: %w", f, err)}
-			}
+		merged, err = st.applySetValues(merged, release, opts.Set)
+		if err != nil {
+			return []error{err}
 		}
 
 		var buf bytes.Buffer
@@ -1511,6 +1859,70 @@ func (st *HelmState) WriteReleasesValues(helm helmexec.Interface, additionalValu
 	return nil
 }
 
+// applySetValues applies the `set` and `setString` entries of the release and the `--set` flags onto the merged values,
+// the same way helm does, so that items of an existing list are replaced by index like `--set list[0].foo=bar`.
+func (st *HelmState) applySetValues(values map[string]interface{}, release *ReleaseSpec, set []string) (map[string]interface{}, error) {
+	var flags []string
+
+	if len(release.SetValues) > 0 {
+		setFlags, err := st.setFlags(release.SetValues, release.ValuesPathPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to render set value entry in %s for release %s: %v", st.FilePath, release.Name, err)
+		}
+		flags = append(flags, setFlags...)
+	}
+
+	if len(release.SetStringValues) > 0 {
+		setStringFlags, err := st.setStringFlags(release.SetStringValues)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to render setString value entry in %s for release %s: %v", st.FilePath, release.Name, err)
+		}
+		flags = append(flags, setStringFlags...)
+	}
+
+	flags = append(flags, cliSetFlags(set, nil, nil)...)
+
+	if len(flags) == 0 {
+		return values, nil
+	}
+
+	dest, err := maputil.CastKeysToStrings(values)
+	if err != nil {
+		return nil, err
+	}
+
+	// helm applies all the --set flags first, followed by the --set-string and --set-file flags, regardless of the order of the flags
+	for _, kind := range []string{"--set", "--set-string", "--set-file"} {
+		for i := 0; i+1 < len(flags); i += 2 {
+			if flags[i] != kind {
+				continue
+			}
+
+			var err error
+
+			switch kind {
+			case "--set":
+				err = maputil.ParseSetInto(flags[i+1], dest)
+			case "--set-string":
+				err = maputil.ParseSetStringInto(flags[i+1], dest)
+			case "--set-file":
+				err = maputil.ParseSetFileInto(flags[i+1], dest, st.readFile)
+			}
+
+			if err != nil {
+				return nil, fmt.Errorf("applying %s %s for release %s: %w", kind, flags[i+1], release.Name, err)
+			}
+		}
+	}
+
+	return dest, nil
+}
+
+// mergeValuesFiles merges the values files in order, the same way helm does when given multiple `--values` flags.
+func (st *HelmState) mergeValuesFiles(files []string) (map[string]interface{}, error) {
+	return st.mergeValuesFilesWithStrategy(files, MergeValuesStrategyDeep)
+}
+
 type LintOpts struct {
 	Set         []string
 	SkipCleanup bool
@@ -1593,7 +2005,8 @@ func (st *HelmState) LintReleases(helm helmexec.Interface, additionalValues []st
 type diffResult struct {
 	release *ReleaseSpec
 	err     *ReleaseError
-	buf     *bytes.Buffer
+	// buf is nil when the release was skipped due to --fail-fast
+	buf *bytes.Buffer
 }
 
 type diffPrepareResult struct {
@@ -1610,24 +2023,10 @@ func (st *HelmState) prepareDiffReleases(helm helmexec.Interface, additionalValu
 		o.Apply(opts)
 	}
 
-	mu := &sync.Mutex{}
-	installedReleases := map[string]bool{}
-
 	isInstalled := func(r *ReleaseSpec) bool {
-		mu.Lock()
-		defer mu.Unlock()
-
-		id := ReleaseToID(r)
-
-		if v, ok := installedReleases[id]; ok {
-			return v
-		}
-
 		v, err := st.isReleaseInstalled(st.createHelmContext(r, 0), helm, *r)
 		if err != nil {
 			st.logger.Warnf("confirming if the release is already installed or not: %v", err)
-		} else {
-			installedReleases[id] = v
 		}
 
 		return v
@@ -1669,7 +2068,8 @@ func (st *HelmState) prepareDiffReleases(helm helmexec.Interface, additionalValu
 
 				st.ApplyOverrides(release)
 
-				if opts.SkipDiffOnInstall && !isInstalled(release) {
+				skipDiffOnInstall := opts.SkipDiffOnInstall || release.SkipDiffOnInstall != nil && *release.SkipDiffOnInstall
+				if skipDiffOnInstall && !isInstalled(release) {
 					results <- diffPrepareResult{release: release, upgradeDueToSkippedDiff: true}
 					continue
 				}
@@ -1679,7 +2079,7 @@ func (st *HelmState) prepareDiffReleases(helm helmexec.Interface, additionalValu
 				// TODO We need a long-term fix for this :)
 				// See https://github.com/roboll/helmfile/issues/737
 				mut.Lock()
-				flags, files, err := st.flagsForDiff(helm, release, disableValidation, workerIndex)
+				flags, files, err := st.flagsForDiff(helm, release, disableValidation, opts.ServerSideDiff, opts.IncludeCRDs, workerIndex)
 				mut.Unlock()
 				if err != nil {
 					errs = append(errs, err)
@@ -1729,11 +2129,7 @@ func (st *HelmState) prepareDiffReleases(helm helmexec.Interface, additionalValu
 					flags = append(flags, "--output", opts.Output)
 				}
 
-				if opts.Set != nil {
-					for _, s := range opts.Set {
-						flags = append(flags, "--set", s)
-					}
-				}
+				flags = append(flags, cliSetFlags(opts.Set, opts.SetString, opts.SetFile)...)
 
 				if len(errs) > 0 {
 					rsErrs := make([]*ReleaseError, len(errs))
@@ -1807,8 +2203,35 @@ type DiffOpts struct {
 	Output            string
 	NoColor           bool
 	Set               []string
+	SetString         []string
+	SetFile           []string
 	SkipCleanup       bool
 	SkipDiffOnInstall bool
+	// ValuesOnly makes DiffReleases compare the values helmfile would pass to `helm upgrade`
+	// against the user-supplied values of the deployed release, instead of running helm-diff.
+	ValuesOnly bool
+	// ExitCodeOnError, when non-zero, is set as the ReleaseError.Code of every release that failed to diff,
+	// so that a failure is distinguishable from the exit status 2 of helm-diff that indicates changes.
+	ExitCodeOnError int
+	// SuppressOutputLineRegex is the list of regexes to filter out the matching lines from the diff output.
+	// Filtering is done only on the printed output, so that it doesn't affect the detection of changes.
+	SuppressOutputLineRegex []string
+	// SuppressReleases is the list of IDs of the releases whose diff output is omitted entirely.
+	// Like SuppressOutputLineRegex, it affects only the printed output, so the releases are still reported as changed.
+	SuppressReleases []string
+	// ServerSideDiff, when set to true, makes helm-diff run with `--dry-run=server` on every release,
+	// overriding releases[].serverSideDiff and helmDefaults.serverSideDiff
+	ServerSideDiff bool
+	// IncludeCRDs, when set, makes helm-diff include CRDs in the diff with `--include-crds` if true,
+	// or exclude them with `--skip-crds` if false. helm-diff's default is used when nil
+	IncludeCRDs *bool
+	// Summary, when set, receives the result of diffing each release
+	Summary *DiffSummary
+	// GuardedChanges, when set, receives the changes to the guardedKinds of each release found in the diff
+	GuardedChanges *GuardedChanges
+	// FailFast, when set to true, stops starting the remaining releases once any release failed to diff.
+	// Releases with changes aren't considered failed.
+	FailFast bool
 }
 
 func (o *DiffOpts) Apply(opts *DiffOpts) {
@@ -1831,6 +2254,13 @@ func (st *HelmState) DiffReleases(helm helmexec.Interface, additionalValues []st
 		o.Apply(opts)
 	}
 
+	defer st.Timings.Track(TimingPhaseDiff)()
+
+	suppressOutputLineRegexps, err := compileRegexps(opts.SuppressOutputLineRegex)
+	if err != nil {
+		return []ReleaseSpec{}, []error{fmt.Errorf("invalid suppress output line regex: %v", err)}
+	}
+
 	preps, prepErrs := st.prepareDiffReleases(helm, additionalValues, workerLimit, detailedExitCode, includeTests, suppress, suppressSecrets, showSecrets, opts)
 
 	if !opts.SkipCleanup {
@@ -1850,11 +2280,26 @@ func (st *HelmState) DiffReleases(helm helmexec.Interface, additionalValues []st
 
 	rs := []ReleaseSpec{}
 	outputs := map[string]*bytes.Buffer{}
+	releaseErrs := map[string]*ReleaseError{}
+	skipped := map[string]bool{}
 	errs := []error{}
 
 	// The exit code returned by helm-diff when it detected any changes
 	HelmDiffExitCodeChanged := 2
 
+	// ctx is canceled on the first failure with --fail-fast, so that the workers stop starting the remaining releases
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	semaphores := st.newKubeContextSemaphores()
+
+	send := func(res diffResult) {
+		if opts.FailFast && res.err != nil && res.err.Code != HelmDiffExitCodeChanged {
+			cancel()
+		}
+		results <- res
+	}
+
 	st.scatterGather(
 		workerLimit,
 		len(preps),
@@ -1868,22 +2313,45 @@ func (st *HelmState) DiffReleases(helm helmexec.Interface, additionalValues []st
 			for prep := range jobQueue {
 				flags := prep.flags
 				release := prep.release
+				if ctx.Err() != nil {
+					st.logger.Infof("Skipping release %q as another release failed with --fail-fast", release.Name)
+					send(diffResult{release, nil, nil})
+					continue
+				}
+				done := semaphores.acquire(st.kubeContext(release))
 				buf := &bytes.Buffer{}
+				stopTiming := st.Timings.TrackRelease(TimingPhaseDiff, ReleaseToID(release))
 				if prep.upgradeDueToSkippedDiff {
-					results <- diffResult{release, &ReleaseError{ReleaseSpec: release, err: nil, Code: HelmDiffExitCodeChanged}, buf}
-				} else if err := helm.DiffRelease(st.createHelmContextWithWriter(release, buf), release.Name, normalizeChart(st.basePath, release.Chart), suppressDiff, flags...); err != nil {
+					send(diffResult{release, &ReleaseError{ReleaseSpec: release, err: nil, Code: HelmDiffExitCodeChanged}, buf})
+				} else if opts.ValuesOnly {
+					changed, err := st.diffReleaseValues(helm, release, additionalValues, opts.Set, suppressSecrets, workerIndex, buf)
+					if err != nil {
+						send(diffResult{release, &ReleaseError{release, err, opts.ExitCodeOnError}, buf})
+					} else if changed && detailedExitCode {
+						send(diffResult{release, &ReleaseError{ReleaseSpec: release, err: nil, Code: HelmDiffExitCodeChanged}, buf})
+					} else {
+						send(diffResult{release, nil, buf})
+					}
+				} else if err := st.diffRelease(st.createHelmContextWithWriter(release, buf), helm, release, suppressDiff, flags...); err != nil {
 					switch e := err.(type) {
 					case helmexec.ExitError:
+						code := e.ExitStatus()
+						if code != HelmDiffExitCodeChanged && opts.ExitCodeOnError != 0 {
+							code = opts.ExitCodeOnError
+						}
 						// Propagate any non-zero exit status from the external command like `helm` that is failed under the hood
-						results <- diffResult{release, &ReleaseError{release, err, e.ExitStatus()}, buf}
+						send(diffResult{release, &ReleaseError{release, err, code}, buf})
 					default:
-						results <- diffResult{release, &ReleaseError{release, err, 0}, buf}
+						send(diffResult{release, &ReleaseError{release, err, opts.ExitCodeOnError}, buf})
 					}
 				} else {
 					// diff succeeded, found no changes
-					results <- diffResult{release, nil, buf}
+					send(diffResult{release, nil, buf})
 				}
 
+				stopTiming()
+				done()
+
 				if triggerCleanupEvents {
 					if _, err := st.TriggerCleanupEvent(prep.release, "diff"); err != nil {
 						st.logger.Warnf("warn: %v\n", err)
@@ -1894,6 +2362,10 @@ func (st *HelmState) DiffReleases(helm helmexec.Interface, additionalValues []st
 		func() {
 			for i := 0; i < len(preps); i++ {
 				res := <-results
+				if res.buf == nil {
+					skipped[ReleaseToID(res.release)] = true
+					continue
+				}
 				if res.err != nil {
 					errs = append(errs, res.err)
 					if res.err.Code == HelmDiffExitCodeChanged {
@@ -1902,22 +2374,81 @@ func (st *HelmState) DiffReleases(helm helmexec.Interface, additionalValues []st
 				}
 
 				outputs[ReleaseToID(res.release)] = res.buf
+				releaseErrs[ReleaseToID(res.release)] = res.err
 			}
 		},
 	)
 
+	suppressedReleases := map[string]bool{}
+	for _, id := range opts.SuppressReleases {
+		suppressedReleases[id] = true
+	}
+
 	for _, p := range preps {
 		id := ReleaseToID(p.release)
+		if skipped[id] {
+			continue
+		}
 		if stdout, ok := outputs[id]; ok {
-			fmt.Print(stdout.String())
+			if suppressedReleases[id] {
+				st.logger.Debugf("suppressed the diff output of release %s", id)
+			} else {
+				fmt.Print(filterOutputLines(stdout.String(), suppressOutputLineRegexps))
+			}
 		} else {
 			panic(fmt.Sprintf("missing output for release %s", id))
 		}
+
+		if opts.Summary != nil {
+			opts.Summary.add(p.release, p.upgradeDueToSkippedDiff, releaseErrs[id], outputs[id].String())
+		}
+
+		if opts.GuardedChanges != nil {
+			opts.GuardedChanges.add(id, findGuardedChanges(outputs[id].String(), st.guardedKinds(p.release)))
+		}
 	}
 
 	return rs, errs
 }
 
+func compileRegexps(exprs []string) ([]*regexp.Regexp, error) {
+	var regexps []*regexp.Regexp
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		regexps = append(regexps, re)
+	}
+	return regexps, nil
+}
+
+// filterOutputLines removes the lines matching any of the regexps from the output
+func filterOutputLines(output string, regexps []*regexp.Regexp) string {
+	if len(regexps) == 0 {
+		return output
+	}
+
+	var buf strings.Builder
+
+	for _, line := range strings.SplitAfter(output, "\n") {
+		if !matchesAny(strings.TrimSuffix(line, "\n"), regexps) {
+			buf.WriteString(line)
+		}
+	}
+
+	return buf.String()
+}
+
+func matchesAny(s string, regexps []*regexp.Regexp) bool {
+	for _, re := range regexps {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
 func (st *HelmState) ReleaseStatuses(helm helmexec.Interface, workerLimit int) []error {
 	return st.scatterGatherReleases(helm, workerLimit, func(release ReleaseSpec, workerIndex int) error {
 		if !release.Desired() {
@@ -1957,11 +2488,13 @@ func (st *HelmState) DeleteReleases(affectedReleases *AffectedReleases, helm hel
 			return err
 		}
 
-		if err := helm.DeleteRelease(context, release.Name, flags...); err != nil {
+		if err := st.deleteRelease(context, helm, &release, flags...); err != nil {
 			affectedReleases.Failed = append(affectedReleases.Failed, &release)
 			return err
 		}
 
+		st.installedReleases.invalidate(releaseInstalledCacheKey(context, &release))
+
 		if _, err := st.triggerReleaseEvent("postuninstall", nil, &release, "delete"); err != nil {
 			affectedReleases.Failed = append(affectedReleases.Failed, &release)
 			return err
@@ -1974,6 +2507,10 @@ func (st *HelmState) DeleteReleases(affectedReleases *AffectedReleases, helm hel
 
 type TestOpts struct {
 	Logs bool
+	// Filter is the name of the only test to run in each release. It requires helm 3.6.0 or greater
+	Filter string
+	// Parallel runs the tests of each release in parallel. It's supported only by helm 2
+	Parallel bool
 }
 
 type TestOption func(*TestOpts)
@@ -1984,14 +2521,34 @@ func Logs(v bool) func(*TestOpts) {
 	}
 }
 
-// TestReleases wrapper for executing helm test on the releases
-func (st *HelmState) TestReleases(helm helmexec.Interface, cleanup bool, timeout int, concurrency int, options ...TestOption) []error {
+func Filter(v string) func(*TestOpts) {
+	return func(o *TestOpts) {
+		o.Filter = v
+	}
+}
+
+func Parallel(v bool) func(*TestOpts) {
+	return func(o *TestOpts) {
+		o.Parallel = v
+	}
+}
+
+// TestReleases wrapper for executing helm test on the releases
+func (st *HelmState) TestReleases(helm helmexec.Interface, cleanup bool, timeout int, concurrency int, options ...TestOption) []error {
 	var opts TestOpts
 
 	for _, o := range options {
 		o(&opts)
 	}
 
+	if opts.Filter != "" && !(helm.IsHelm3() && helm.IsVersionAtLeast("3.6.0")) {
+		return []error{fmt.Errorf("--filter requires helm 3.6.0 or greater")}
+	}
+
+	if opts.Parallel && helm.IsHelm3() {
+		return []error{fmt.Errorf("--parallel is not supported by helm 3. Use --concurrency to test multiple releases concurrently instead")}
+	}
+
 	return st.scatterGatherReleases(helm, concurrency, func(release ReleaseSpec, workerIndex int) error {
 		if !release.Desired() {
 			return nil
@@ -2007,11 +2564,17 @@ func (st *HelmState) TestReleases(helm helmexec.Interface, cleanup bool, timeout
 		if opts.Logs {
 			flags = append(flags, "--logs")
 		}
+		if opts.Filter != "" {
+			flags = append(flags, "--filter", "name="+opts.Filter)
+		}
+		if opts.Parallel {
+			flags = append(flags, "--parallel")
+		}
 
 		if timeout == EmptyTimeout {
 			flags = append(flags, st.timeoutFlags(helm, &release)...)
 		} else {
-			duration := strconv.Itoa(timeout)
+			duration := strconv.Itoa(int(timeout))
 			if helm.IsHelm3() {
 				duration += "s"
 			}
@@ -2041,14 +2604,22 @@ func (st *HelmState) GetReleasesWithOverrides() []ReleaseSpec {
 
 func (st *HelmState) SelectReleasesWithOverrides(includeTransitiveNeeds bool) ([]Release, error) {
 	values := st.Values()
-	rs, err := markExcludedReleases(st.GetReleasesWithOverrides(), st.Selectors, st.CommonLabels, values, includeTransitiveNeeds)
+	rs, err := markExcludedReleases(st.GetReleasesWithOverrides(), st.Selectors, st.ExcludeSelectors, st.CommonLabels, values, includeTransitiveNeeds)
 	if err != nil {
 		return nil, err
 	}
 	return rs, nil
 }
 
-func markExcludedReleases(releases []ReleaseSpec, selectors []string, commonLabels map[string]string, values map[string]interface{}, includeTransitiveNeeds bool) ([]Release, error) {
+// markExcludedReleases marks the releases not matching any of selectors, or matching any of excludeSelectors, as filtered.
+// The exclusion takes precedence over the inclusion, but a release needed by a selected release is still unmarked
+// when includeTransitiveNeeds is true.
+func markExcludedReleases(releases []ReleaseSpec, selectors, excludeSelectors []string, commonLabels map[string]string, values map[string]interface{}, includeTransitiveNeeds bool) ([]Release, error) {
+	releases, err := expandNeedsSelectors(releases, commonLabels)
+	if err != nil {
+		return nil, err
+	}
+
 	var filteredReleases []Release
 	filters := []ReleaseFilter{}
 	for _, label := range selectors {
@@ -2058,6 +2629,14 @@ func markExcludedReleases(releases []ReleaseSpec, selectors []string, commonLabe
 		}
 		filters = append(filters, f)
 	}
+	excludeFilters := []ReleaseFilter{}
+	for _, label := range excludeSelectors {
+		f, err := ParseLabels(label)
+		if err != nil {
+			return nil, err
+		}
+		excludeFilters = append(excludeFilters, f)
+	}
 	for _, r := range releases {
 		if r.Labels == nil {
 			r.Labels = map[string]string{}
@@ -2068,9 +2647,11 @@ func markExcludedReleases(releases []ReleaseSpec, selectors []string, commonLabe
 		// Strip off just the last portion for the name stable/newrelic would give newrelic
 		chartSplit := strings.Split(r.Chart, "/")
 		r.Labels["chart"] = chartSplit[len(chartSplit)-1]
-		//Merge CommonLabels into release labels
+		//Merge CommonLabels into release labels. Release labels take precedence over common labels with the same key
 		for k, v := range commonLabels {
-			r.Labels[k] = v
+			if _, ok := r.Labels[k]; !ok {
+				r.Labels[k] = v
+			}
 		}
 		var filterMatch bool
 		for _, f := range filters {
@@ -2082,6 +2663,13 @@ func markExcludedReleases(releases []ReleaseSpec, selectors []string, commonLabe
 				break
 			}
 		}
+		var excludeMatch bool
+		for _, f := range excludeFilters {
+			if f.Match(r) {
+				excludeMatch = true
+				break
+			}
+		}
 		var conditionMatch bool
 		conditionMatch, err := ConditionEnabled(r, values)
 		if err != nil {
@@ -2089,7 +2677,7 @@ func markExcludedReleases(releases []ReleaseSpec, selectors []string, commonLabe
 		}
 		res := Release{
 			ReleaseSpec: r,
-			Filtered:    (len(filters) > 0 && !filterMatch) || (!conditionMatch),
+			Filtered:    (len(filters) > 0 && !filterMatch) || excludeMatch || (!conditionMatch),
 		}
 		filteredReleases = append(filteredReleases, res)
 	}
@@ -2160,6 +2748,133 @@ func collectNeedsWithTransitives(release ReleaseSpec, allReleases []ReleaseSpec,
 	}
 }
 
+// ReleaseSelectorLabels returns the labels of the release that selectors match against.
+// They are the labels of the release, the name, namespace and chart of the release, and the common labels not overridden by the release.
+func ReleaseSelectorLabels(r *ReleaseSpec, commonLabels map[string]string) map[string]string {
+	labels := map[string]string{}
+	for k, v := range r.Labels {
+		labels[k] = v
+	}
+	labels["name"] = r.Name
+	labels["namespace"] = r.Namespace
+	// Strip off just the last portion for the name stable/newrelic would give newrelic
+	chartSplit := strings.Split(r.Chart, "/")
+	labels["chart"] = chartSplit[len(chartSplit)-1]
+	for k, v := range commonLabels {
+		if _, ok := labels[k]; !ok {
+			labels[k] = v
+		}
+	}
+	return labels
+}
+
+// expandNeedsSelectors replaces each `selector:<labels>` entry in the needs of releases with the IDs of all the releases
+// matching the labels, in the order of definitions. The labels are matched in the same way as `--selector`,
+// including the built-in `name`, `namespace`, and `chart` labels and the common labels.
+//
+// Each glob entry like `infra/*` or `*/database`, which is already converted to a release ID pattern by ApplyOverrides,
+// is replaced in the same way with the IDs of all the releases matching the pattern.
+//
+// It is an error for a selector or a glob to match no release, so that a typo doesn't silently drop the dependency.
+// A release never depends on itself even when it matches its own selector or glob.
+func expandNeedsSelectors(releases []ReleaseSpec, commonLabels map[string]string) ([]ReleaseSpec, error) {
+	if !hasNeedsSelectors(releases) {
+		return releases, nil
+	}
+
+	labeled := make([]ReleaseSpec, len(releases))
+	for i, r := range releases {
+		r.Labels = ReleaseSelectorLabels(&r, commonLabels)
+		labeled[i] = r
+	}
+
+	expanded := make([]ReleaseSpec, len(releases))
+
+	for i, r := range releases {
+		var needs []string
+
+		seen := map[string]struct{}{}
+
+		add := func(id string) {
+			if _, ok := seen[id]; !ok {
+				seen[id] = struct{}{}
+				needs = append(needs, id)
+			}
+		}
+
+		releaseID := ReleaseToID(&r)
+
+		for _, n := range r.Needs {
+			if isNeedsGlob(n) {
+				var matched bool
+
+				for j := range releases {
+					candidateID := ReleaseToID(&releases[j])
+					if candidateID == releaseID {
+						continue
+					}
+					ok, err := path.Match(n, candidateID)
+					if err != nil {
+						return nil, fmt.Errorf("release %q: invalid needs %q: %v", r.Name, n, err)
+					}
+					if ok {
+						matched = true
+						add(candidateID)
+					}
+				}
+
+				if !matched {
+					return nil, fmt.Errorf("release %q needs %q but no release matches the pattern. Perhaps you made a typo in \"needs\"?", r.Name, n)
+				}
+
+				continue
+			}
+
+			if !strings.HasPrefix(n, needsSelectorPrefix) {
+				add(n)
+				continue
+			}
+
+			f, err := ParseLabels(strings.TrimPrefix(n, needsSelectorPrefix))
+			if err != nil {
+				return nil, fmt.Errorf("release %q: invalid needs %q: %v", r.Name, n, err)
+			}
+
+			var matched bool
+
+			for j := range labeled {
+				candidate := labeled[j]
+				candidateID := ReleaseToID(&candidate)
+				if candidateID == releaseID || !f.Match(candidate) {
+					continue
+				}
+				matched = true
+				add(candidateID)
+			}
+
+			if !matched {
+				return nil, fmt.Errorf("release %q needs %q but no release matches the selector. Perhaps you made a typo in \"needs\" or forgot labeling releases?", r.Name, n)
+			}
+		}
+
+		r.Needs = needs
+		expanded[i] = r
+	}
+
+	return expanded, nil
+}
+
+func hasNeedsSelectors(releases []ReleaseSpec) bool {
+	for _, r := range releases {
+		for _, n := range r.Needs {
+			if strings.HasPrefix(n, needsSelectorPrefix) || isNeedsGlob(n) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (st *HelmState) GetSelectedReleasesWithOverrides(includeTransitiveNeeds bool) ([]ReleaseSpec, error) {
 	filteredReleases, err := st.SelectReleasesWithOverrides(includeTransitiveNeeds)
 	if err != nil {
@@ -2175,6 +2890,11 @@ func (st *HelmState) GetSelectedReleasesWithOverrides(includeTransitiveNeeds boo
 	return releases, nil
 }
 
+// HasSelectors returns true when the releases are filtered by --selector or --exclude-selector
+func (st *HelmState) HasSelectors() bool {
+	return len(st.Selectors) > 0 || len(st.ExcludeSelectors) > 0
+}
+
 // FilterReleases allows for the execution of helm commands against a subset of the releases in the helmfile.
 func (st *HelmState) FilterReleases(includeTransitiveNeeds bool) error {
 	releases, err := st.GetSelectedReleasesWithOverrides(includeTransitiveNeeds)
@@ -2194,11 +2914,22 @@ func (st *HelmState) TriggerGlobalCleanupEvent(helmfileCommand string) (bool, er
 }
 
 func (st *HelmState) triggerGlobalReleaseEvent(evt string, evtErr error, helmfileCmd string) (bool, error) {
+	if st.NoHooks {
+		st.logger.Debugf("hooks for %q event are skipped due to --no-hooks", evt)
+		return false, nil
+	}
+
+	if len(st.Hooks) > 0 {
+		defer st.Timings.Track(TimingPhaseHooks)()
+	}
+
 	bus := &event.Bus{
+		Runner:        st.runner,
 		Hooks:         st.Hooks,
 		StateFilePath: st.FilePath,
 		BasePath:      st.basePath,
 		Namespace:     st.OverrideNamespace,
+		KubeContext:   st.kubeContext(&ReleaseSpec{}),
 		Chart:         st.OverrideChart,
 		Env:           st.Env,
 		Logger:        st.logger,
@@ -2227,11 +2958,28 @@ func (st *HelmState) triggerPostsyncEvent(r *ReleaseSpec, evtErr error, helmfile
 }
 
 func (st *HelmState) triggerReleaseEvent(evt string, evtErr error, r *ReleaseSpec, helmfileCmd string) (bool, error) {
+	if st.NoHooks {
+		st.logger.Debugf("hooks for %q event of release %q are skipped due to --no-hooks", evt, r.Name)
+		return false, nil
+	}
+
+	if len(r.Hooks) > 0 {
+		defer st.Timings.Track(TimingPhaseHooks)()
+		defer st.Timings.TrackRelease(TimingPhaseHooks, ReleaseToID(r))()
+	}
+
+	namespace := r.Namespace
+	if namespace == "" {
+		namespace = st.OverrideNamespace
+	}
+
 	bus := &event.Bus{
+		Runner:        st.runner,
 		Hooks:         r.Hooks,
 		StateFilePath: st.FilePath,
 		BasePath:      st.basePath,
-		Namespace:     st.OverrideNamespace,
+		Namespace:     namespace,
+		KubeContext:   st.kubeContext(r),
 		Chart:         st.OverrideChart,
 		Env:           st.Env,
 		Logger:        st.logger,
@@ -2240,6 +2988,7 @@ func (st *HelmState) triggerReleaseEvent(evt string, evtErr error, r *ReleaseSpe
 	vals := st.Values()
 	data := map[string]interface{}{
 		"Values":          vals,
+		"StateValues":     vals,
 		"Release":         r,
 		"HelmfileCommand": helmfileCmd,
 	}
@@ -2255,7 +3004,7 @@ func (st *HelmState) ResolveDeps() (*HelmState, error) {
 func (st *HelmState) UpdateDeps(helm helmexec.Interface, includeTransitiveNeeds bool) []error {
 	var selected []ReleaseSpec
 
-	if len(st.Selectors) > 0 {
+	if st.HasSelectors() {
 		var err error
 
 		// This and releasesNeedCharts ensures that we run operations like helm-dep-build and prepare-hook calls only on
@@ -2299,6 +3048,98 @@ func (st *HelmState) UpdateDeps(helm helmexec.Interface, includeTransitiveNeeds
 	return nil
 }
 
+// LockDeps resolves the dependencies on the remote charts of the releases, and returns them in the format of the lock file.
+// Unlike UpdateDeps, it neither writes the lock file nor updates the dependencies of the local charts.
+func (st *HelmState) LockDeps(helm helmexec.Interface) (*ChartLockedRequirements, error) {
+	tempDir := st.tempDir
+	if tempDir == nil {
+		tempDir = ioutil.TempDir
+	}
+	return st.lockDependenciesInTempDir(helm, tempDir)
+}
+
+// fetchChart fetches and untars the chart of the release from the chart repository into a directory under dir,
+// and returns the path to the directory containing Chart.yaml.
+func (st *HelmState) fetchChart(helm helmexec.Interface, release *ReleaseSpec, dir string) (string, error) {
+	chartPath := fetchedChartPath(release, dir)
+
+	// only fetch chart if it is not already fetched
+	if _, err := os.Stat(chartPath); os.IsNotExist(err) {
+		fetchFlags := st.chartVersionFlags(release)
+		fetchFlags = append(fetchFlags, "--untar", "--untardir", chartPath)
+		if err := helm.Fetch(release.Chart, fetchFlags...); err != nil {
+			return "", err
+		}
+	}
+
+	// Set chartPath to be the path containing Chart.yaml, if found
+	fullChartPath, err := findChartDirectory(chartPath)
+	if err == nil {
+		chartPath = filepath.Dir(fullChartPath)
+	}
+
+	return chartPath, nil
+}
+
+// fetchedChartPath returns the path to the directory within dir to which the chart of the release is fetched
+func fetchedChartPath(release *ReleaseSpec, dir string) string {
+	pathElems := []string{
+		dir,
+	}
+
+	if release.TillerNamespace != "" {
+		pathElems = append(pathElems, release.TillerNamespace)
+	}
+
+	if release.Namespace != "" {
+		pathElems = append(pathElems, release.Namespace)
+	}
+
+	if release.KubeContext != "" {
+		pathElems = append(pathElems, release.KubeContext)
+	}
+
+	chartVersion := "latest"
+	if release.Version != "" {
+		chartVersion = release.Version
+	}
+
+	pathElems = append(pathElems, release.Name, release.Chart, chartVersion)
+
+	return path.Join(pathElems...)
+}
+
+// locateSubchart returns the path to the directory of the subchart at `subchartPath` within the chart at chartPath.
+// The chart is fetched from the chart repository first when chartPath isn't a local directory.
+func (st *HelmState) locateSubchart(helm helmexec.Interface, release *ReleaseSpec, dir, chartPath string) (string, error) {
+	subchartPath := filepath.Clean(release.SubchartPath)
+	if filepath.IsAbs(subchartPath) || subchartPath == ".." || strings.HasPrefix(subchartPath, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("subchartPath %q must be a relative path within the chart", release.SubchartPath)
+	}
+
+	parent := normalizeChart(st.basePath, chartPath)
+	if !st.directoryExistsAt(parent) {
+		fetched, err := st.fetchChart(helm, release, dir)
+		if err != nil {
+			return "", err
+		}
+		parent = fetched
+	}
+
+	subchart := filepath.Join(parent, subchartPath)
+
+	exists, err := st.fileExists(filepath.Join(subchart, "Chart.yaml"))
+	if err != nil {
+		return "", err
+	}
+
+	if !exists {
+		return "", fmt.Errorf("subchartPath %q not found in chart %q: %s does not contain Chart.yaml", release.SubchartPath, release.Chart, subchart)
+	}
+
+	return subchart, nil
+}
+
 // find "Chart.yaml"
 func findChartDirectory(topLevelDir string) (string, error) {
 	var files []string
@@ -2384,14 +3225,19 @@ func (st *HelmState) connectionFlags(helm helmexec.Interface, release *ReleaseSp
 }
 
 func (st *HelmState) timeoutFlags(helm helmexec.Interface, release *ReleaseSpec) []string {
-	var flags []string
-
 	timeout := st.HelmDefaults.Timeout
 	if release.Timeout != nil {
 		timeout = *release.Timeout
 	}
+
+	return durationTimeoutFlags(helm, timeout)
+}
+
+func durationTimeoutFlags(helm helmexec.Interface, timeout Duration) []string {
+	var flags []string
+
 	if timeout != 0 {
-		duration := strconv.Itoa(timeout)
+		duration := strconv.Itoa(int(timeout))
 		if helm.IsHelm3() {
 			duration += "s"
 		}
@@ -2408,7 +3254,8 @@ func (st *HelmState) flagsForUpgrade(helm helmexec.Interface, release *ReleaseSp
 		flags = append(flags, "--verify")
 	}
 
-	if release.Wait != nil && *release.Wait || release.Wait == nil && st.HelmDefaults.Wait {
+	wait := release.Wait != nil && *release.Wait || release.Wait == nil && st.HelmDefaults.Wait
+	if wait {
 		flags = append(flags, "--wait")
 	}
 
@@ -2416,7 +3263,11 @@ func (st *HelmState) flagsForUpgrade(helm helmexec.Interface, release *ReleaseSp
 		flags = append(flags, "--wait-for-jobs")
 	}
 
-	flags = append(flags, st.timeoutFlags(helm, release)...)
+	if wait {
+		flags = append(flags, st.waitTimeoutFlags(helm, release)...)
+	} else {
+		flags = append(flags, st.timeoutFlags(helm, release)...)
+	}
 
 	if release.Force != nil && *release.Force || release.Force == nil && st.HelmDefaults.Force {
 		flags = append(flags, "--force")
@@ -2434,6 +3285,23 @@ func (st *HelmState) flagsForUpgrade(helm helmexec.Interface, release *ReleaseSp
 		flags = append(flags, "--cleanup-on-fail")
 	}
 
+	if release.TakeOwnership != nil && *release.TakeOwnership || release.TakeOwnership == nil && st.HelmDefaults.TakeOwnership {
+		if !helm.IsVersionAtLeast("3.17.0") {
+			return nil, nil, fmt.Errorf("releases[].takeOwnership requires Helm 3.17.0 or greater")
+		}
+		flags = append(flags, "--take-ownership")
+	}
+
+	reuseValuesFlags, err := st.reuseValuesFlags(release)
+	if err != nil {
+		return nil, nil, err
+	}
+	flags = append(flags, reuseValuesFlags...)
+
+	if st.NoHooks {
+		flags = append(flags, "--no-hooks")
+	}
+
 	if release.CreateNamespace != nil && *release.CreateNamespace ||
 		release.CreateNamespace == nil && (st.HelmDefaults.CreateNamespace == nil || *st.HelmDefaults.CreateNamespace) {
 		if helm.IsVersionAtLeast("3.2.0") {
@@ -2444,6 +3312,25 @@ func (st *HelmState) flagsForUpgrade(helm helmexec.Interface, release *ReleaseSp
 		}
 	}
 
+	if len(release.ReleaseLabels) > 0 {
+		if !helm.IsVersionAtLeast("3.13.0") {
+			return nil, nil, fmt.Errorf("releases[].releaseLabels requires Helm 3.13.0 or greater")
+		}
+
+		keys := make([]string, 0, len(release.ReleaseLabels))
+		for k := range release.ReleaseLabels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		labels := make([]string, 0, len(keys))
+		for _, k := range keys {
+			labels = append(labels, k+"="+release.ReleaseLabels[k])
+		}
+
+		flags = append(flags, "--labels", strings.Join(labels, ","))
+	}
+
 	if release.DisableOpenAPIValidation != nil && *release.DisableOpenAPIValidation ||
 		release.DisableOpenAPIValidation == nil && st.HelmDefaults.DisableOpenAPIValidation != nil && *st.HelmDefaults.DisableOpenAPIValidation {
 		flags = append(flags, "--disable-openapi-validation")
@@ -2451,7 +3338,11 @@ func (st *HelmState) flagsForUpgrade(helm helmexec.Interface, release *ReleaseSp
 
 	flags = st.appendConnectionFlags(flags, helm, release)
 
-	var err error
+	flags, err = st.appendPostRendererFlags(flags, helm, release)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	flags, err = st.appendHelmXFlags(flags, release)
 	if err != nil {
 		return nil, nil, err
@@ -2484,6 +3375,15 @@ func (st *HelmState) flagsForTemplate(helm helmexec.Interface, release *ReleaseS
 
 	flags = st.appendApiVersionsFlags(flags, release)
 
+	if st.NoHooks {
+		flags = append(flags, "--no-hooks")
+	}
+
+	flags, err = st.appendPostRendererFlags(flags, helm, release)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	common, files, err := st.namespaceAndValuesFlags(helm, release, workerIndex)
 	if err != nil {
 		return nil, files, err
@@ -2491,7 +3391,7 @@ func (st *HelmState) flagsForTemplate(helm helmexec.Interface, release *ReleaseS
 	return append(flags, common...), files, nil
 }
 
-func (st *HelmState) flagsForDiff(helm helmexec.Interface, release *ReleaseSpec, disableValidation bool, workerIndex int) ([]string, []string, error) {
+func (st *HelmState) flagsForDiff(helm helmexec.Interface, release *ReleaseSpec, disableValidation bool, serverSideDiff bool, includeCRDs *bool, workerIndex int) ([]string, []string, error) {
 	flags := st.chartVersionFlags(release)
 
 	disableOpenAPIValidation := false
@@ -2515,9 +3415,47 @@ func (st *HelmState) flagsForDiff(helm helmexec.Interface, release *ReleaseSpec,
 		flags = append(flags, "--disable-validation")
 	}
 
+	if !serverSideDiff {
+		if release.ServerSideDiff != nil {
+			serverSideDiff = *release.ServerSideDiff
+		} else {
+			serverSideDiff = st.HelmDefaults.ServerSideDiff
+		}
+	}
+
+	if serverSideDiff {
+		if helm.IsVersionAtLeast("3.13.0") && helm.IsDiffPluginVersionAtLeast("3.9.0") {
+			flags = append(flags, "--dry-run=server")
+		} else {
+			st.logger.Warnf("serverSideDiff is ignored for release %q: it requires helm 3.13.0 and helm-diff 3.9.0 or greater", release.Name)
+		}
+	}
+
+	reuseValuesFlags, err := st.reuseValuesFlags(release)
+	if err != nil {
+		return nil, nil, err
+	}
+	flags = append(flags, reuseValuesFlags...)
+
+	if st.NoHooks {
+		flags = append(flags, "--no-hooks")
+	}
+
+	if includeCRDs != nil {
+		if *includeCRDs {
+			flags = append(flags, "--include-crds")
+		} else {
+			flags = append(flags, "--skip-crds")
+		}
+	}
+
 	flags = st.appendConnectionFlags(flags, helm, release)
 
-	var err error
+	flags, err = st.appendPostRendererFlags(flags, helm, release)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	flags, err = st.appendHelmXFlags(flags, release)
 	if err != nil {
 		return nil, nil, err
@@ -2530,6 +3468,24 @@ func (st *HelmState) flagsForDiff(helm helmexec.Interface, release *ReleaseSpec,
 	return append(flags, common...), files, nil
 }
 
+// reuseValuesFlags returns --reuse-values or --reset-values for the release, so that
+// helm merges the values of the previous revision or resets them to the chart defaults.
+func (st *HelmState) reuseValuesFlags(release *ReleaseSpec) ([]string, error) {
+	reuseValues := release.ReuseValues != nil && *release.ReuseValues || release.ReuseValues == nil && st.HelmDefaults.ReuseValues
+	resetValues := release.ResetValues != nil && *release.ResetValues || release.ResetValues == nil && st.HelmDefaults.ResetValues
+
+	switch {
+	case reuseValues && resetValues:
+		return nil, fmt.Errorf("releases[].reuseValues and releases[].resetValues are mutually exclusive, but both are enabled for release %q", release.Name)
+	case reuseValues:
+		return []string{"--reuse-values"}, nil
+	case resetValues:
+		return []string{"--reset-values"}, nil
+	}
+
+	return nil, nil
+}
+
 func (st *HelmState) chartVersionFlags(release *ReleaseSpec) []string {
 	flags := []string{}
 
@@ -2550,12 +3506,64 @@ func (st *HelmState) appendApiVersionsFlags(flags []string, r *ReleaseSpec) []st
 	}
 
 	if r.KubeVersion != "" {
-		flags = append(flags, "--kube-version", st.KubeVersion)
+		flags = append(flags, "--kube-version", r.KubeVersion)
 	}
 
 	return flags
 }
 
+func (st *HelmState) appendPostRendererFlags(flags []string, helm helmexec.Interface, release *ReleaseSpec) ([]string, error) {
+	postRenderer := release.PostRenderer
+	postRendererArgs := release.PostRendererArgs
+
+	if postRenderer == "" {
+		postRenderer = st.HelmDefaults.PostRenderer
+	}
+	if postRendererArgs == nil {
+		postRendererArgs = st.HelmDefaults.PostRendererArgs
+	}
+
+	if postRenderer == "" {
+		return flags, nil
+	}
+
+	if !helm.IsVersionAtLeast("3.1.0") {
+		return nil, fmt.Errorf("releases[].postRenderer requires Helm 3.1.0 or greater")
+	}
+
+	// A bare name like `kustomize` is an executable in PATH, which must not be resolved relative to the helmfile.yaml
+	if strings.ContainsRune(postRenderer, '/') {
+		postRenderer = st.storage().normalizePath(postRenderer)
+	}
+
+	flags = append(flags, "--post-renderer", postRenderer)
+
+	if len(postRendererArgs) > 0 {
+		if !helm.IsVersionAtLeast("3.7.0") {
+			return nil, fmt.Errorf("releases[].postRendererArgs requires Helm 3.7.0 or greater")
+		}
+
+		for _, a := range postRendererArgs {
+			flags = append(flags, "--post-renderer-args", a)
+		}
+	}
+
+	return flags, nil
+}
+
+// overrideCapabilities overrides the kubeVersion and apiVersions of all the releases with the ones given via the command-line,
+// which takes precedence over the release-level and then the state-level ones.
+func (st *HelmState) overrideCapabilities(kubeVersion string, apiVersions []string) {
+	for i := range st.Releases {
+		if kubeVersion != "" {
+			st.Releases[i].KubeVersion = kubeVersion
+		}
+		if len(apiVersions) > 0 {
+			st.Releases[i].ApiVersions = apiVersions
+		}
+	}
+}
+
 func (st *HelmState) isDevelopment(release *ReleaseSpec) bool {
 	result := st.HelmDefaults.Devel
 	if release.Devel != nil {
@@ -2665,6 +3673,12 @@ func (st *HelmState) ExpandedHelmfiles() ([]SubHelmfileSpec, error) {
 }
 
 func (st *HelmState) removeFiles(files []string) {
+	if st.DebugFiles != nil {
+		// The files are removed after they are written into the debug bundle
+		st.DebugFiles.retain(files)
+		return
+	}
+
 	for _, f := range files {
 		if err := st.removeFile(f); err != nil {
 			st.logger.Warnf("Removing %s: %v", err)
@@ -2680,7 +3694,27 @@ func (st *HelmState) generateTemporaryReleaseValuesFiles(release *ReleaseSpec, v
 	for _, value := range values {
 		switch typedValue := value.(type) {
 		case string:
-			paths, skip, err := st.storage().resolveFile(missingFileHandler, "values", typedValue)
+			if isExecValues(typedValue) {
+				yamlBytes, err := st.execValues(release, typedValue)
+				if err != nil {
+					return generatedFiles, err
+				}
+
+				valfile, err := createTempValuesFile(release, yamlBytes)
+				if err != nil {
+					return generatedFiles, err
+				}
+				defer valfile.Close()
+
+				if _, err := valfile.Write(yamlBytes); err != nil {
+					return generatedFiles, fmt.Errorf("failed to write %s: %v", valfile.Name(), err)
+				}
+
+				generatedFiles = append(generatedFiles, valfile.Name())
+				continue
+			}
+
+			paths, skip, err := st.resolveValuesFiles(missingFileHandler, typedValue)
 			if err != nil {
 				return generatedFiles, err
 			}
@@ -2688,29 +3722,26 @@ func (st *HelmState) generateTemporaryReleaseValuesFiles(release *ReleaseSpec, v
 				continue
 			}
 
-			if len(paths) > 1 {
-				return generatedFiles, fmt.Errorf("glob patterns in release values and secrets is not supported yet. please submit a feature request if necessary")
-			}
-			path := paths[0]
-
-			yamlBytes, err := st.RenderReleaseValuesFileToBytes(release, path)
-			if err != nil {
-				return generatedFiles, fmt.Errorf("failed to render values files \"%s\": %v", typedValue, err)
-			}
+			for _, path := range paths {
+				yamlBytes, err := st.RenderReleaseValuesFileToBytes(release, path)
+				if err != nil {
+					return generatedFiles, fmt.Errorf("failed to render values files \"%s\": %v", typedValue, err)
+				}
 
-			valfile, err := createTempValuesFile(release, yamlBytes)
-			if err != nil {
-				return generatedFiles, err
-			}
-			defer valfile.Close()
+				valfile, err := createTempValuesFile(release, yamlBytes)
+				if err != nil {
+					return generatedFiles, err
+				}
+				defer valfile.Close()
 
-			if _, err := valfile.Write(yamlBytes); err != nil {
-				return generatedFiles, fmt.Errorf("failed to write %s: %v", valfile.Name(), err)
-			}
+				if _, err := valfile.Write(yamlBytes); err != nil {
+					return generatedFiles, fmt.Errorf("failed to write %s: %v", valfile.Name(), err)
+				}
 
-			st.logger.Debugf("Successfully generated the value file at %s. produced:\n%s", path, string(yamlBytes))
+				st.logger.Debugf("Successfully generated the value file at %s. produced:\n%s", path, string(yamlBytes))
 
-			generatedFiles = append(generatedFiles, valfile.Name())
+				generatedFiles = append(generatedFiles, valfile.Name())
+			}
 		case map[interface{}]interface{}, map[string]interface{}:
 			valfile, err := createTempValuesFile(release, typedValue)
 			if err != nil {
@@ -2738,6 +3769,11 @@ func (st *HelmState) generateVanillaValuesFiles(release *ReleaseSpec) ([]string,
 	for _, v := range release.Values {
 		switch typedValue := v.(type) {
 		case string:
+			if isExecValues(typedValue) {
+				// The command is run as is, instead of being read as a path
+				values = append(values, typedValue)
+				continue
+			}
 			path := st.storage().normalizePath(release.ValuesPathPrefix + typedValue)
 			values = append(values, path)
 		default:
@@ -2763,63 +3799,76 @@ func (st *HelmState) generateVanillaValuesFiles(release *ReleaseSpec) ([]string,
 	return generatedFiles, nil
 }
 
-func (st *HelmState) generateSecretValuesFiles(helm helmexec.Interface, release *ReleaseSpec, workerIndex int) ([]string, error) {
-	var generatedDecryptedFiles []interface{}
+// resolveSecretsFile returns the path to the encrypted secrets file for the entry of `releases[].secrets`.
+// An embedded secrets document is written to a temporary file, which is removed by calling the returned func.
+func (st *HelmState) resolveSecretsFile(release *ReleaseSpec, v interface{}) (string, func(), bool, error) {
+	cleanup := func() {}
 
-	for _, v := range release.Secrets {
+	var paths []string
+
+	switch value := v.(type) {
+	case string:
 		var (
-			paths []string
-			skip  bool
-			err   error
+			skip bool
+			err  error
 		)
+		paths, skip, err = st.storage().resolveFile(release.MissingFileHandler, "secrets", release.ValuesPathPrefix+value)
+		if err != nil {
+			return "", cleanup, false, err
+		}
+		if skip {
+			return "", cleanup, true, nil
+		}
+	default:
+		bs, err := yaml.Marshal(value)
+		if err != nil {
+			return "", cleanup, false, err
+		}
 
-		switch value := v.(type) {
-		case string:
-			paths, skip, err = st.storage().resolveFile(release.MissingFileHandler, "secrets", release.ValuesPathPrefix+value)
-			if err != nil {
-				return nil, err
-			}
-		default:
-			bs, err := yaml.Marshal(value)
-			if err != nil {
-				return nil, err
-			}
+		path, err := ioutil.TempFile(os.TempDir(), "helmfile-embdedded-secrets-*.yaml.enc")
+		if err != nil {
+			return "", cleanup, false, err
+		}
+		_ = path.Close()
+		cleanup = func() {
+			_ = os.Remove(path.Name())
+		}
 
-			path, err := ioutil.TempFile(os.TempDir(), "helmfile-embdedded-secrets-*.yaml.enc")
-			if err != nil {
-				return nil, err
-			}
-			_ = path.Close()
-			defer func() {
-				_ = os.Remove(path.Name())
-			}()
+		if err := ioutil.WriteFile(path.Name(), bs, 0644); err != nil {
+			return "", cleanup, false, err
+		}
 
-			if err := ioutil.WriteFile(path.Name(), bs, 0644); err != nil {
-				return nil, err
-			}
+		paths = []string{path.Name()}
+	}
 
-			paths = []string{path.Name()}
+	if len(paths) > 1 {
+		return "", cleanup, false, fmt.Errorf("glob patterns in release secret file is not supported yet. please submit a feature request if necessary")
+	}
+
+	return paths[0], cleanup, false, nil
+}
+
+func (st *HelmState) generateSecretValuesFiles(helm helmexec.Interface, release *ReleaseSpec, workerIndex int) ([]string, error) {
+	var generatedDecryptedFiles []interface{}
+
+	for _, v := range release.Secrets {
+		path, cleanup, skip, err := st.resolveSecretsFile(release, v)
+		defer cleanup()
+		if err != nil {
+			return nil, err
 		}
 
 		if skip {
 			continue
 		}
 
-		if len(paths) > 1 {
-			return nil, fmt.Errorf("glob patterns in release secret file is not supported yet. please submit a feature request if necessary")
-		}
-		path := paths[0]
-
-		decryptFlags := st.appendConnectionFlags([]string{}, helm, release)
-		valfile, err := helm.DecryptSecret(st.createHelmContext(release, workerIndex), path, decryptFlags...)
+		decrypted, removeDecrypted, err := st.decryptSecretsFile(helm, release, path, workerIndex)
 		if err != nil {
 			return nil, err
 		}
-		defer func() {
-			_ = os.Remove(valfile)
-		}()
+		defer removeDecrypted()
 
-		generatedDecryptedFiles = append(generatedDecryptedFiles, valfile)
+		generatedDecryptedFiles = append(generatedDecryptedFiles, decrypted)
 	}
 
 	generatedFiles, err := st.generateTemporaryReleaseValuesFiles(release, generatedDecryptedFiles, release.MissingFileHandler)
@@ -2827,6 +3876,10 @@ func (st *HelmState) generateSecretValuesFiles(helm helmexec.Interface, release
 		return nil, err
 	}
 
+	if st.DebugFiles != nil {
+		st.DebugFiles.markSecrets(generatedFiles)
+	}
+
 	return generatedFiles, nil
 }
 
@@ -2843,7 +3896,7 @@ func (st *HelmState) generateValuesFiles(helm helmexec.Interface, release *Relea
 
 	files := append(valuesFiles, secretValuesFiles...)
 
-	return files, nil
+	return st.mergeReleaseValuesFiles(release, files, len(secretValuesFiles) > 0)
 }
 
 func (st *HelmState) namespaceAndValuesFlags(helm helmexec.Interface, release *ReleaseSpec, workerIndex int) ([]string, []string, error) {
@@ -2866,7 +3919,7 @@ func (st *HelmState) namespaceAndValuesFlags(helm helmexec.Interface, release *R
 	}
 
 	if len(release.SetValues) > 0 {
-		setFlags, err := st.setFlags(release.SetValues)
+		setFlags, err := st.setFlags(release.SetValues, release.ValuesPathPrefix)
 		if err != nil {
 			return nil, files, fmt.Errorf("Failed to render set value entry in %s for release %s: %v", st.FilePath, release.Name, err)
 		}
@@ -2874,6 +3927,15 @@ func (st *HelmState) namespaceAndValuesFlags(helm helmexec.Interface, release *R
 		flags = append(flags, setFlags...)
 	}
 
+	if len(release.SetStringValues) > 0 {
+		setStringFlags, err := st.setStringFlags(release.SetStringValues)
+		if err != nil {
+			return nil, files, fmt.Errorf("Failed to render setString value entry in %s for release %s: %v", st.FilePath, release.Name, err)
+		}
+
+		flags = append(flags, setStringFlags...)
+	}
+
 	/***********
 	 * START 'env' section for backwards compatibility
 	 ***********/
@@ -2904,7 +3966,9 @@ func (st *HelmState) namespaceAndValuesFlags(helm helmexec.Interface, release *R
 	return flags, files, nil
 }
 
-func (st *HelmState) setFlags(setValues []SetValue) ([]string, error) {
+// setFlags returns the flags for the set entries of a release.
+// The path of a set entry with `file` is prefixed with the valuesPathPrefix of the release, like values files.
+func (st *HelmState) setFlags(setValues []SetValue, pathPrefix string) ([]string, error) {
 	var flags []string
 
 	for _, set := range setValues {
@@ -2915,7 +3979,7 @@ func (st *HelmState) setFlags(setValues []SetValue) ([]string, error) {
 			}
 			flags = append(flags, "--set", fmt.Sprintf("%s=%s", escape(set.Name), escape(renderedValue[0])))
 		} else if set.File != "" {
-			flags = append(flags, "--set-file", fmt.Sprintf("%s=%s", escape(set.Name), st.storage().normalizePath(set.File)))
+			flags = append(flags, "--set-file", fmt.Sprintf("%s=%s", escape(set.Name), st.storage().normalizePath(pathPrefix+set.File)))
 		} else if len(set.Values) > 0 {
 			renderedValues, err := renderValsSecrets(st.valsRuntime, set.Values...)
 			if err != nil {
@@ -2933,6 +3997,59 @@ func (st *HelmState) setFlags(setValues []SetValue) ([]string, error) {
 	return flags, nil
 }
 
+func (st *HelmState) setStringFlags(setValues []SetValue) ([]string, error) {
+	var flags []string
+
+	for _, set := range setValues {
+		if set.File != "" {
+			return nil, fmt.Errorf("setString %q: file is not supported. Use set instead", set.Name)
+		}
+
+		if len(set.Values) > 0 {
+			renderedValues, err := renderValsSecrets(st.valsRuntime, set.Values...)
+			if err != nil {
+				return nil, err
+			}
+			items := make([]string, len(renderedValues))
+			for i, raw := range renderedValues {
+				items[i] = escape(raw)
+			}
+			flags = append(flags, "--set-string", fmt.Sprintf("%s={%s}", escape(set.Name), strings.Join(items, ",")))
+			continue
+		}
+
+		renderedValue, err := renderValsSecrets(st.valsRuntime, set.Value)
+		if err != nil {
+			return nil, err
+		}
+		flags = append(flags, "--set-string", fmt.Sprintf("%s=%s", escape(set.Name), escape(renderedValue[0])))
+	}
+
+	return flags, nil
+}
+
+// cliSetFlags returns the flags for the values given via `--set`, `--set-string`, and `--set-file` on the command-line.
+//
+// Regardless of the order of flags, helm merges all the `--set` values first, then `--set-string`, and finally `--set-file`.
+// The flags are ordered in the same way so that the last one for the same key wins, as it does in helm.
+func cliSetFlags(set, setString, setFile []string) []string {
+	var flags []string
+
+	for _, s := range set {
+		flags = append(flags, "--set", s)
+	}
+
+	for _, s := range setString {
+		flags = append(flags, "--set-string", s)
+	}
+
+	for _, s := range setFile {
+		flags = append(flags, "--set-file", s)
+	}
+
+	return flags
+}
+
 // renderValsSecrets helper function which renders 'ref+.*' secrets
 func renderValsSecrets(e vals.Evaluator, input ...string) ([]string, error) {
 	output := make([]string, len(input))
@@ -2954,32 +4071,94 @@ func renderValsSecrets(e vals.Evaluator, input ...string) ([]string, error) {
 	return output, nil
 }
 
+func (ar *AffectedReleases) addMetadata(release *ReleaseSpec, metadata *ReleaseMetadata) {
+	if ar.Metadata == nil {
+		ar.Metadata = map[string]*ReleaseMetadata{}
+	}
+
+	ar.Metadata[ReleaseToID(release)] = metadata
+}
+
+// hasStatuses returns true when the status of any upgraded release is recorded by --post-sync-status
+func (ar *AffectedReleases) hasStatuses() bool {
+	for _, md := range ar.Metadata {
+		if md.Status != "" {
+			return true
+		}
+	}
+	return false
+}
+
 // DisplayAffectedReleases logs the upgraded, deleted and in error releases
 func (ar *AffectedReleases) DisplayAffectedReleases(logger *zap.SugaredLogger) {
 	if ar.Upgraded != nil && len(ar.Upgraded) > 0 {
-		logger.Info("\nUPDATED RELEASES:")
-		tbl, _ := prettytable.NewTable(prettytable.Column{Header: "NAME"},
-			prettytable.Column{Header: "CHART", MinWidth: 6},
-			prettytable.Column{Header: "VERSION", AlignRight: true},
-		)
+		logger.Info("\n" + ar.colorize(colorGreen, "UPDATED RELEASES:"))
+		columns := []prettytable.Column{
+			{Header: "NAME"},
+			{Header: "CHART", MinWidth: 6},
+			{Header: "VERSION", AlignRight: true},
+		}
+		if ar.Verbose {
+			columns = append(columns,
+				prettytable.Column{Header: "WAIT"},
+				prettytable.Column{Header: "DURATION", AlignRight: true},
+			)
+		}
+		withStatus := ar.hasStatuses()
+		if withStatus {
+			columns = append(columns, prettytable.Column{Header: "STATUS"})
+		}
+		tbl, _ := prettytable.NewTable(columns...)
 		tbl.Separator = "   "
+		var notDeployed []*ReleaseSpec
 		for _, release := range ar.Upgraded {
-			err := tbl.AddRow(release.Name, release.Chart, release.installedVersion)
+			row := []interface{}{release.Name, release.Chart, release.installedVersion}
+			md, hasMetadata := ar.Metadata[ReleaseToID(release)]
+			if ar.Verbose {
+				var wait, duration string
+				if hasMetadata {
+					wait = strconv.FormatBool(md.Wait)
+					duration = md.Duration.Round(time.Millisecond).String()
+				}
+				row = append(row, wait, duration)
+			}
+			if withStatus {
+				var status string
+				if hasMetadata {
+					status = md.Status
+				}
+				if status != "" && status != ReleaseStatusDeployed {
+					notDeployed = append(notDeployed, release)
+				}
+				row = append(row, status)
+			}
+			err := tbl.AddRow(row...)
 			if err != nil {
 				logger.Warn("Could not add row, %v", err)
 			}
 		}
 		logger.Info(tbl.String())
+		if len(notDeployed) > 0 {
+			logger.Info("\n" + ar.colorize(colorYellow, "UPDATED RELEASES NOT DEPLOYED:"))
+			tbl, _ := prettytable.NewTable(prettytable.Column{Header: "NAME"}, prettytable.Column{Header: "STATUS"})
+			tbl.Separator = "   "
+			for _, release := range notDeployed {
+				if err := tbl.AddRow(release.Name, ar.Metadata[ReleaseToID(release)].Status); err != nil {
+					logger.Warn("Could not add row, %v", err)
+				}
+			}
+			logger.Info(tbl.String())
+		}
 	}
 	if ar.Deleted != nil && len(ar.Deleted) > 0 {
-		logger.Info("\nDELETED RELEASES:")
+		logger.Info("\n" + ar.colorize(colorYellow, "DELETED RELEASES:"))
 		logger.Info("NAME")
 		for _, release := range ar.Deleted {
 			logger.Info(release.Name)
 		}
 	}
 	if ar.Failed != nil && len(ar.Failed) > 0 {
-		logger.Info("\nFAILED RELEASES:")
+		logger.Info("\n" + ar.colorize(colorRed, "FAILED RELEASES:"))
 		logger.Info("NAME")
 		for _, release := range ar.Failed {
 			logger.Info(release.Name)
@@ -2987,6 +4166,21 @@ func (ar *AffectedReleases) DisplayAffectedReleases(logger *zap.SugaredLogger) {
 	}
 }
 
+const (
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorReset  = "\x1b[0m"
+)
+
+// colorize wraps the text in the ANSI escape codes of the color when ar.Color is set
+func (ar *AffectedReleases) colorize(color, text string) string {
+	if !ar.Color {
+		return text
+	}
+	return color + text + colorReset
+}
+
 func escape(value string) string {
 	intermediate := strings.Replace(value, "{", "\\{", -1)
 	intermediate = strings.Replace(intermediate, "}", "\\}", -1)
@@ -3190,15 +4384,24 @@ func (st *HelmState) ToYaml() (string, error) {
 	}
 }
 
+// ToJson returns the state as JSON. It is converted from the YAML returned by ToYaml,
+// so that each field has the same key in JSON as in YAML.
+func (st *HelmState) ToJson() ([]byte, error) {
+	y, err := yaml.Marshal(st)
+	if err != nil {
+		return nil, err
+	}
+
+	return ghodssyaml.YAMLToJSON(y)
+}
+
 func (st *HelmState) LoadYAMLForEmbedding(release *ReleaseSpec, entries []interface{}, missingFileHandler *string, pathPrefix string) ([]interface{}, error) {
 	var result []interface{}
 
 	for _, v := range entries {
 		switch t := v.(type) {
 		case string:
-			var values map[string]interface{}
-
-			paths, skip, err := st.storage().resolveFile(missingFileHandler, "values", pathPrefix+t)
+			paths, skip, err := st.resolveValuesFiles(missingFileHandler, pathPrefix+t)
 			if err != nil {
 				return nil, err
 			}
@@ -3206,21 +4409,20 @@ func (st *HelmState) LoadYAMLForEmbedding(release *ReleaseSpec, entries []interf
 				continue
 			}
 
-			if len(paths) > 1 {
-				return nil, fmt.Errorf("glob patterns in release values and secrets is not supported yet. please submit a feature request if necessary")
-			}
-			yamlOrTemplatePath := paths[0]
+			for _, yamlOrTemplatePath := range paths {
+				var values map[string]interface{}
 
-			yamlBytes, err := st.RenderReleaseValuesFileToBytes(release, yamlOrTemplatePath)
-			if err != nil {
-				return nil, fmt.Errorf("failed to render values files \"%s\": %v", t, err)
-			}
+				yamlBytes, err := st.RenderReleaseValuesFileToBytes(release, yamlOrTemplatePath)
+				if err != nil {
+					return nil, fmt.Errorf("failed to render values files \"%s\": %v", t, err)
+				}
 
-			if err := yaml.Unmarshal(yamlBytes, &values); err != nil {
-				return nil, err
-			}
+				if err := yaml.Unmarshal(yamlBytes, &values); err != nil {
+					return nil, err
+				}
 
-			result = append(result, values)
+				result = append(result, values)
+			}
 		default:
 			result = append(result, v)
 		}
@@ -3229,6 +4431,50 @@ func (st *HelmState) LoadYAMLForEmbedding(release *ReleaseSpec, entries []interf
 	return result, nil
 }
 
+// LoadDecryptedSecretsForEmbedding decrypts the secrets files of the release and returns the decrypted values,
+// in the same format as LoadYAMLForEmbedding.
+func (st *HelmState) LoadDecryptedSecretsForEmbedding(helm helmexec.Interface, release *ReleaseSpec) ([]interface{}, error) {
+	var result []interface{}
+
+	for _, v := range release.Secrets {
+		path, cleanup, skip, err := st.resolveSecretsFile(release, v)
+		defer cleanup()
+		if err != nil {
+			return nil, err
+		}
+
+		if skip {
+			continue
+		}
+
+		decrypted, removeDecrypted, err := st.decryptSecretsFile(helm, release, path, 0)
+		if err != nil {
+			return nil, err
+		}
+		defer removeDecrypted()
+
+		decryptedFile, ok := decrypted.(string)
+		if !ok {
+			result = append(result, decrypted)
+			continue
+		}
+
+		yamlBytes, err := st.RenderReleaseValuesFileToBytes(release, decryptedFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render decrypted secrets file \"%s\": %v", path, err)
+		}
+
+		var values map[string]interface{}
+		if err := yaml.Unmarshal(yamlBytes, &values); err != nil {
+			return nil, fmt.Errorf("failed to load decrypted secrets file \"%s\": %v", path, err)
+		}
+
+		result = append(result, values)
+	}
+
+	return result, nil
+}
+
 func (st *HelmState) Reverse() {
 	for i, j := 0, len(st.Releases)-1; i < j; i, j = i+1, j-1 {
 		st.Releases[i], st.Releases[j] = st.Releases[j], st.Releases[i]
@@ -3239,7 +4485,7 @@ func (st *HelmState) Reverse() {
 	}
 }
 
-func (st *HelmState) getOCIChart(pullChan chan PullCommand, release *ReleaseSpec, tempDir string, helm helmexec.Interface) (*string, error) {
+func (st *HelmState) getOCIChart(pullChan chan PullCommand, ociTags *ociTagCache, release *ReleaseSpec, tempDir string, helm helmexec.Interface) (*string, error) {
 	repo, name := st.GetRepositoryAndNameFromChartName(release.Chart)
 	if repo == nil {
 		return nil, nil
@@ -3250,7 +4496,13 @@ func (st *HelmState) getOCIChart(pullChan chan PullCommand, release *ReleaseSpec
 	}
 
 	chartVersion := "latest"
-	if release.Version != "" {
+	if isVersionConstraint(release.Version) {
+		resolved, err := st.resolveOCIChartVersion(ociTags, repo, name, release.Version)
+		if err != nil {
+			return nil, err
+		}
+		chartVersion = resolved
+	} else if release.Version != "" {
 		chartVersion = release.Version
 	}
 
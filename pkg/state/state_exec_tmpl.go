@@ -3,6 +3,8 @@ package state
 import (
 	"fmt"
 	"reflect"
+	"strings"
+	"text/template"
 
 	"github.com/roboll/helmfile/pkg/tmpl"
 	"gopkg.in/yaml.v2"
@@ -84,52 +86,214 @@ func updateBoolTemplatedValues(r *ReleaseSpec) error {
 	return nil
 }
 
+func updateStringTemplatedValues(r *ReleaseSpec) {
+	if r.KubeContextTemplate != nil {
+		// An empty result leaves the kubeContext as is, so that the template can override it only for some environments
+		if kubeContext := strings.TrimSpace(*r.KubeContextTemplate); kubeContext != "" {
+			r.KubeContext = kubeContext
+		}
+		r.KubeContextTemplate = nil
+	}
+
+	if r.ChartTemplate != nil {
+		// Like kubeContextTemplate, an empty result leaves the chart as is
+		if chart := strings.TrimSpace(*r.ChartTemplate); chart != "" {
+			r.Chart = chart
+		}
+		r.ChartTemplate = nil
+	}
+}
+
 func (st *HelmState) ExecuteTemplates() (*HelmState, error) {
 	r := *st
 
-	vals := st.Values()
+	e := newReleaseTemplateExecutor(st)
 
-	for i, rt := range st.Releases {
-		release := rt
-		if release.KubeContext == "" {
-			release.KubeContext = r.HelmDefaults.KubeContext
+	for i := range st.Releases {
+		release, err := e.render(i)
+		if err != nil {
+			return nil, err
 		}
-		if release.Labels == nil {
-			release.Labels = map[string]string{}
+		st.Releases[i] = *release
+	}
+
+	return &r, nil
+}
+
+// releaseTemplateExecutor renders the template expressions in releases.
+// It renders the releases lazily, so that the `releaseValues` template function can render
+// the release it refers to, and compute its merged values, before the referencing release.
+type releaseTemplateExecutor struct {
+	st *HelmState
+
+	// releases are the releases as written in the state file
+	releases []ReleaseSpec
+	rendered map[int]*ReleaseSpec
+	values   map[int]map[string]interface{}
+
+	// rendering is the stack of the releases being rendered, to detect cyclic references
+	rendering []int
+}
+
+func newReleaseTemplateExecutor(st *HelmState) *releaseTemplateExecutor {
+	releases := make([]ReleaseSpec, len(st.Releases))
+	copy(releases, st.Releases)
+
+	return &releaseTemplateExecutor{
+		st:       st,
+		releases: releases,
+		rendered: map[int]*ReleaseSpec{},
+		values:   map[int]map[string]interface{}{},
+	}
+}
+
+func (e *releaseTemplateExecutor) render(i int) (*ReleaseSpec, error) {
+	if r, ok := e.rendered[i]; ok {
+		return r, nil
+	}
+
+	for j, k := range e.rendering {
+		if k == i {
+			var refs []string
+			for _, l := range append(e.rendering[j:], i) {
+				refs = append(refs, releaseValuesRef(&e.releases[l]))
+			}
+			return nil, fmt.Errorf("cyclic references between releases: %s", strings.Join(refs, " -> "))
 		}
-		for k, v := range st.CommonLabels {
+	}
+
+	e.rendering = append(e.rendering, i)
+	defer func() {
+		e.rendering = e.rendering[:len(e.rendering)-1]
+	}()
+
+	st := e.st
+	vals := st.Values()
+
+	release := e.releases[i]
+	if release.KubeContext == "" {
+		release.KubeContext = st.HelmDefaults.KubeContext
+	}
+	if release.Labels == nil {
+		release.Labels = map[string]string{}
+	}
+	for k, v := range st.CommonLabels {
+		if _, ok := release.Labels[k]; !ok {
 			release.Labels[k] = v
 		}
-		if len(release.ApiVersions) == 0 {
-			release.ApiVersions = st.ApiVersions
+	}
+	if len(release.ApiVersions) == 0 {
+		release.ApiVersions = st.ApiVersions
+	}
+	if release.KubeVersion == "" {
+		release.KubeVersion = st.KubeVersion
+	}
+
+	funcs := template.FuncMap{
+		"releaseValues": e.releaseValues,
+	}
+
+	for it, prev := 0, &release; it < 6; it++ {
+		tmplData := st.createReleaseTemplateData(prev, vals)
+		renderer := tmpl.NewFileRenderer(st.readFile, st.basePath, tmplData).WithFuncs(funcs)
+		r, err := release.ExecuteTemplateExpressions(renderer)
+		if err != nil {
+			return nil, fmt.Errorf("failed executing templates in release \"%s\".\"%s\": %v", st.FilePath, release.Name, err)
 		}
-		if release.KubeVersion == "" {
-			release.KubeVersion = st.KubeVersion
+		if reflect.DeepEqual(prev, r) {
+			if err := updateBoolTemplatedValues(r); err != nil {
+				return nil, fmt.Errorf("failed executing templates in release \"%s\".\"%s\": %v", st.FilePath, release.Name, err)
+			}
+			hasChartTemplate := r.ChartTemplate != nil
+			updateStringTemplatedValues(r)
+			if hasChartTemplate && r.Chart == "" {
+				return nil, fmt.Errorf("failed executing templates in release \"%s\".\"%s\": chartTemplate is rendered to an empty chart", st.FilePath, release.Name)
+			}
+			e.rendered[i] = r
+			return r, nil
 		}
+		prev = r
+	}
+
+	return nil, fmt.Errorf("failed executing templates in release \"%s\".\"%s\": %s", st.FilePath, release.Name,
+		"recursive references can't be resolved")
+}
+
+// releaseValues implements the `releaseValues` template function.
+// It returns the values of the release identified by `namespace/name`, or `name` for a release without namespace,
+// merged in the same way as `helmfile write-values` does.
+func (e *releaseTemplateExecutor) releaseValues(id string) (map[string]interface{}, error) {
+	for i := range e.releases {
+		var r *ReleaseSpec
 
-		successFlag := false
-		for it, prev := 0, &release; it < 6; it++ {
-			tmplData := st.createReleaseTemplateData(prev, vals)
-			renderer := tmpl.NewFileRenderer(st.readFile, st.basePath, tmplData)
-			r, err := release.ExecuteTemplateExpressions(renderer)
+		if rendered, ok := e.rendered[i]; ok {
+			r = rendered
+		} else if !strings.Contains(e.releases[i].Name, "{{") && !strings.Contains(e.releases[i].Namespace, "{{") {
+			r = &e.releases[i]
+		} else if e.isRendering(i) {
+			// The name of the release can't be known until its rendering completes
+			continue
+		} else {
+			var err error
+			r, err = e.render(i)
 			if err != nil {
-				return nil, fmt.Errorf("failed executing templates in release \"%s\".\"%s\": %v", st.FilePath, release.Name, err)
-			}
-			if reflect.DeepEqual(prev, r) {
-				successFlag = true
-				if err := updateBoolTemplatedValues(r); err != nil {
-					return nil, fmt.Errorf("failed executing templates in release \"%s\".\"%s\": %v", st.FilePath, release.Name, err)
-				}
-				st.Releases[i] = *r
-				break
+				return nil, err
 			}
-			prev = r
 		}
-		if !successFlag {
-			return nil, fmt.Errorf("failed executing templates in release \"%s\".\"%s\": %s", st.FilePath, release.Name,
-				"recursive references can't be resolved")
+
+		if releaseValuesRef(r) != id {
+			continue
 		}
+
+		return e.mergedValues(i)
 	}
 
-	return &r, nil
+	return nil, fmt.Errorf("releaseValues: release %q not found", id)
+}
+
+func (e *releaseTemplateExecutor) isRendering(i int) bool {
+	for _, j := range e.rendering {
+		if j == i {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *releaseTemplateExecutor) mergedValues(i int) (map[string]interface{}, error) {
+	if vals, ok := e.values[i]; ok {
+		return vals, nil
+	}
+
+	r, err := e.render(i)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := e.st.generateVanillaValuesFiles(r)
+	defer e.st.removeFiles(files)
+	if err != nil {
+		return nil, fmt.Errorf("releaseValues: generating values of release %q: %w", releaseValuesRef(r), err)
+	}
+
+	strategy, err := e.st.mergeValuesStrategy()
+	if err != nil {
+		return nil, fmt.Errorf("releaseValues: merging values of release %q: %w", releaseValuesRef(r), err)
+	}
+
+	vals, err := e.st.mergeValuesFilesWithStrategy(files, strategy)
+	if err != nil {
+		return nil, fmt.Errorf("releaseValues: merging values of release %q: %w", releaseValuesRef(r), err)
+	}
+
+	e.values[i] = vals
+
+	return vals, nil
+}
+
+func releaseValuesRef(r *ReleaseSpec) string {
+	if r.Namespace == "" {
+		return r.Name
+	}
+	return r.Namespace + "/" + r.Name
 }
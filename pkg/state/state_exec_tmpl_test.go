@@ -2,12 +2,15 @@ package state
 
 import (
 	"fmt"
+	"os"
 	"reflect"
 	"strings"
 	"testing"
 
 	"github.com/go-test/deep"
+	"github.com/google/go-cmp/cmp"
 	"github.com/roboll/helmfile/pkg/environment"
+	"github.com/roboll/helmfile/pkg/exectest"
 )
 
 func boolPtrToString(ptr *bool) string {
@@ -83,6 +86,36 @@ func TestHelmState_executeTemplates(t *testing.T) {
 				Tillerless: func(i bool) *bool { return &i }(true),
 			},
 		},
+		{
+			name: "Has template expressions in kube context",
+			input: ReleaseSpec{
+				Chart:               "test-chart",
+				Name:                "app",
+				Namespace:           "dev",
+				KubeContextTemplate: func(i string) *string { return &i }(`cluster-{{ .Environment.Name }}`),
+			},
+			want: ReleaseSpec{
+				Chart:       "test-chart",
+				Name:        "app",
+				Namespace:   "dev",
+				KubeContext: "cluster-test_env",
+			},
+		},
+		{
+			name: "Has kube context template rendered to empty",
+			input: ReleaseSpec{
+				Chart:               "test-chart",
+				Name:                "app",
+				Namespace:           "dev",
+				KubeContextTemplate: func(i string) *string { return &i }(`{{ if eq .Environment.Name "prod" }}cluster-prod{{ end }}`),
+			},
+			want: ReleaseSpec{
+				Chart:       "test-chart",
+				Name:        "app",
+				Namespace:   "dev",
+				KubeContext: "test_context",
+			},
+		},
 		{
 			name: "Has template in set-values",
 			input: ReleaseSpec{
@@ -173,6 +206,12 @@ func TestHelmState_executeTemplates(t *testing.T) {
 			if diff := deep.Equal(actual.Labels, tt.want.Labels); diff != nil && len(actual.Labels) > 0 {
 				t.Errorf("Labels differs \n%+v", strings.Join(diff, "\n"))
 			}
+			if tt.want.KubeContext != "" && actual.KubeContext != tt.want.KubeContext {
+				t.Errorf("expected KubeContext %+v, got %+v", tt.want.KubeContext, actual.KubeContext)
+			}
+			if actual.KubeContextTemplate != nil {
+				t.Errorf("expected KubeContextTemplate to be resolved, got %+v", *actual.KubeContextTemplate)
+			}
 			if !reflect.DeepEqual(actual.Version, tt.want.Version) {
 				t.Errorf("expected Version %+v, got %+v", tt.want.Version, actual.Version)
 			}
@@ -255,3 +294,243 @@ func TestHelmState_recursiveRefsTemplates(t *testing.T) {
 		})
 	}
 }
+
+func TestHelmState_executeTemplates_ChartTemplate(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   ReleaseSpec
+		want    string
+		wantErr string
+	}{
+		{
+			name: "assembled from values",
+			input: ReleaseSpec{
+				Name:          "app",
+				ChartTemplate: func(i string) *string { return &i }(`{{ .Values.chartsDir }}/app-{{ .Values.flavor }}`),
+			},
+			want: "../charts/app-minimal",
+		},
+		{
+			name: "overrides chart",
+			input: ReleaseSpec{
+				Name:          "app",
+				Chart:         "stable/app",
+				ChartTemplate: func(i string) *string { return &i }(`{{ if eq .Environment.Name "test_env" }}{{ .Values.chartsDir }}/app{{ end }}`),
+			},
+			want: "../charts/app",
+		},
+		{
+			name: "rendered to empty",
+			input: ReleaseSpec{
+				Name:          "app",
+				Chart:         "stable/app",
+				ChartTemplate: func(i string) *string { return &i }(`{{ if eq .Environment.Name "prod" }}{{ .Values.chartsDir }}/app{{ end }}`),
+			},
+			want: "stable/app",
+		},
+		{
+			name: "rendered to empty without chart",
+			input: ReleaseSpec{
+				Name:          "app",
+				ChartTemplate: func(i string) *string { return &i }(`{{ if eq .Environment.Name "prod" }}{{ .Values.chartsDir }}/app{{ end }}`),
+			},
+			wantErr: `failed executing templates in release "helmfile.yaml"."app": chartTemplate is rendered to an empty chart`,
+		},
+		{
+			name: "no chart without chartTemplate",
+			input: ReleaseSpec{
+				Name: "app",
+			},
+			want: "",
+		},
+	}
+
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			state := &HelmState{
+				basePath: ".",
+				FilePath: "helmfile.yaml",
+				ReleaseSetSpec: ReleaseSetSpec{
+					Env:      environment.Environment{Name: "test_env"},
+					Releases: []ReleaseSpec{tt.input},
+				},
+				RenderedValues: map[string]interface{}{
+					"chartsDir": "../charts",
+					"flavor":    "minimal",
+				},
+			}
+
+			r, err := state.ExecuteTemplates()
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("unexpected error: want %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			actual := r.Releases[0]
+
+			if actual.Chart != tt.want {
+				t.Errorf("unexpected chart: want %q, got %q", tt.want, actual.Chart)
+			}
+			if actual.ChartTemplate != nil {
+				t.Errorf("expected ChartTemplate to be resolved, got %q", *actual.ChartTemplate)
+			}
+		})
+	}
+}
+
+func TestHelmState_executeTemplates_KubeContextTemplateConnectionFlags(t *testing.T) {
+	state := &HelmState{
+		basePath: ".",
+		ReleaseSetSpec: ReleaseSetSpec{
+			HelmDefaults: HelmSpec{KubeContext: "default"},
+			Env:          environment.Environment{Name: "staging"},
+			Releases: []ReleaseSpec{
+				{
+					Chart:               "test-chart",
+					Name:                "app",
+					KubeContextTemplate: func(i string) *string { return &i }(`cluster-{{ .Environment.Name }}`),
+				},
+			},
+		},
+		RenderedValues: map[string]interface{}{},
+	}
+
+	r, err := state.ExecuteTemplates()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	flags := r.connectionFlags(&exectest.Helm{Helm3: true}, &r.Releases[0])
+
+	if d := cmp.Diff([]string{"--kube-context", "cluster-staging"}, flags); d != "" {
+		t.Errorf("unexpected flags: want (-), got (+):\n%s", d)
+	}
+}
+
+func TestHelmState_executeTemplates_ReleaseValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		releases []ReleaseSpec
+		want     []string
+		wantErr  string
+	}{
+		{
+			name: "reference to a later release",
+			releases: []ReleaseSpec{
+				{
+					Chart:     "test-chart",
+					Name:      `b-{{ (releaseValues "default/a").foo }}`,
+					Namespace: "default",
+					ValuesTemplate: []interface{}{
+						map[interface{}]interface{}{"host": `{{ (releaseValues "default/a").ingress.host }}`},
+					},
+				},
+				{
+					Chart:     "test-chart",
+					Name:      "a",
+					Namespace: "default",
+					Values: []interface{}{
+						map[interface{}]interface{}{"foo": "bar", "ingress": map[interface{}]interface{}{"host": "example.com"}},
+						map[interface{}]interface{}{"foo": "baz"},
+					},
+				},
+			},
+			want: []string{"b-baz", "a"},
+		},
+		{
+			name: "reference to a templated release",
+			releases: []ReleaseSpec{
+				{
+					Chart: "test-chart",
+					Name:  `c-{{ (releaseValues "a-dev").foo }}`,
+				},
+				{
+					Chart: "test-chart",
+					Name:  "a-{{ .Environment.Name }}",
+					Values: []interface{}{
+						map[interface{}]interface{}{"foo": "bar"},
+					},
+				},
+			},
+			want: []string{"c-bar", "a-dev"},
+		},
+		{
+			name: "missing release",
+			releases: []ReleaseSpec{
+				{
+					Chart: "test-chart",
+					Name:  `b-{{ (releaseValues "default/a").foo }}`,
+				},
+			},
+			wantErr: `releaseValues: release "default/a" not found`,
+		},
+		{
+			name: "cyclic references",
+			releases: []ReleaseSpec{
+				{
+					Chart:     "test-chart",
+					Name:      "a",
+					Namespace: "default",
+					ValuesTemplate: []interface{}{
+						map[interface{}]interface{}{"foo": `{{ (releaseValues "default/b").foo }}`},
+					},
+				},
+				{
+					Chart:     "test-chart",
+					Name:      "b",
+					Namespace: "default",
+					ValuesTemplate: []interface{}{
+						map[interface{}]interface{}{"foo": `{{ (releaseValues "default/a").foo }}`},
+					},
+				},
+			},
+			wantErr: "cyclic references between releases: default/a -> default/b -> default/a",
+		},
+	}
+
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			state := &HelmState{
+				basePath: ".",
+				ReleaseSetSpec: ReleaseSetSpec{
+					Env:      environment.Environment{Name: "dev"},
+					Releases: tt.releases,
+				},
+				logger:         logger,
+				readFile:       os.ReadFile,
+				removeFile:     os.Remove,
+				valsRuntime:    valsRuntime,
+				RenderedValues: map[string]interface{}{},
+			}
+
+			r, err := state.ExecuteTemplates()
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("unexpected error: want %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var names []string
+			for _, r := range r.Releases {
+				names = append(names, r.Name)
+			}
+
+			if d := cmp.Diff(tt.want, names); d != "" {
+				t.Errorf("unexpected release names: want (-), got (+):\n%s", d)
+			}
+		})
+	}
+}
@@ -51,6 +51,46 @@ func (st *HelmState) scatterGather(concurrency int, items int, produceInputs fun
 	waitGroup.Wait()
 }
 
+// kubeContextSemaphores limits the number of the releases processed concurrently for each kube context,
+// while the releases for different kube contexts are still processed in parallel up to the global concurrency.
+type kubeContextSemaphores struct {
+	limit int
+
+	mu   sync.Mutex
+	sems map[string]chan struct{}
+}
+
+// newKubeContextSemaphores returns the semaphores limiting each kube context to ConcurrencyPerContext releases.
+// No limit is applied when ConcurrencyPerContext is 0.
+func (st *HelmState) newKubeContextSemaphores() *kubeContextSemaphores {
+	return &kubeContextSemaphores{
+		limit: st.ConcurrencyPerContext,
+		sems:  map[string]chan struct{}{},
+	}
+}
+
+// acquire blocks until a release for the kube context can be processed within the limit,
+// and returns the function to be called once the release is processed.
+func (s *kubeContextSemaphores) acquire(kubeContext string) func() {
+	if s.limit <= 0 {
+		return func() {}
+	}
+
+	s.mu.Lock()
+	sem, ok := s.sems[kubeContext]
+	if !ok {
+		sem = make(chan struct{}, s.limit)
+		s.sems[kubeContext] = sem
+	}
+	s.mu.Unlock()
+
+	sem <- struct{}{}
+
+	return func() {
+		<-sem
+	}
+}
+
 func (st *HelmState) scatterGatherReleases(helm helmexec.Interface, concurrency int,
 	do func(ReleaseSpec, int) error) []error {
 
@@ -66,6 +106,8 @@ func (st *HelmState) iterateOnReleases(helm helmexec.Interface, concurrency int,
 	releases := make(chan ReleaseSpec)
 	results := make(chan result)
 
+	semaphores := st.newKubeContextSemaphores()
+
 	st.scatterGather(
 		concurrency,
 		inputsSize,
@@ -77,7 +119,9 @@ func (st *HelmState) iterateOnReleases(helm helmexec.Interface, concurrency int,
 		},
 		func(id int) {
 			for release := range releases {
+				done := semaphores.acquire(st.kubeContext(&release))
 				err := do(release, id)
+				done()
 				st.logger.Debugf("release %q processed", release.Name)
 				results <- result{release: release, err: err}
 			}
@@ -139,9 +183,20 @@ func SortedReleaseGroups(releases []Release, opts PlanOptions) ([][]Release, err
 }
 
 func GroupReleasesByDependency(releases []Release, opts PlanOptions) ([][]Release, error) {
+	specs := make([]ReleaseSpec, len(releases))
+	for i, r := range releases {
+		specs[i] = r.ReleaseSpec
+	}
+
+	if err := detectNeedsCycle(specs); err != nil {
+		return nil, err
+	}
+
 	idToReleases := map[string][]Release{}
 	idToIndex := map[string]int{}
 
+	after := afterDependencies(releases, opts.SelectedReleases)
+
 	d := dag.New()
 	for i, r := range releases {
 
@@ -155,6 +210,7 @@ func GroupReleasesByDependency(releases []Release, opts PlanOptions) ([][]Releas
 			n := r.Needs[i]
 			needs = append(needs, n)
 		}
+		needs = append(needs, after[i]...)
 		d.Add(id, dag.Dependencies(needs))
 	}
 
@@ -270,3 +326,217 @@ func GroupReleasesByDependency(releases []Release, opts PlanOptions) ([][]Releas
 
 	return result, nil
 }
+
+// afterDependencies returns the `after` entries of each release, keyed by the index of the release, that are added to the
+// dependencies of the release for ordering.
+//
+// An entry is honored only when both the release and the referenced release are selected, so that `after` never makes
+// helmfile fail on or include unselected releases.
+// An entry that would form a cycle with `needs` or the `after` entries honored so far is ignored,
+// so that `needs` take precedence over `after`, and `after` entries of releases defined earlier take precedence over the later ones.
+func afterDependencies(releases []Release, selectedReleases []ReleaseSpec) map[int][]string {
+	selected := map[string]bool{}
+	if len(selectedReleases) > 0 {
+		for i := range selectedReleases {
+			selected[ReleaseToID(&selectedReleases[i])] = true
+		}
+	} else {
+		for i := range releases {
+			selected[ReleaseToID(&releases[i].ReleaseSpec)] = true
+		}
+	}
+
+	deps := map[string][]string{}
+	for i := range releases {
+		id := ReleaseToID(&releases[i].ReleaseSpec)
+		deps[id] = append(deps[id], releases[i].Needs...)
+	}
+
+	// dependsOn returns true when the release `from` depends on the release `to` directly or transitively
+	dependsOn := func(from, to string) bool {
+		visited := map[string]bool{}
+
+		var visit func(id string) bool
+
+		visit = func(id string) bool {
+			if id == to {
+				return true
+			}
+			visited[id] = true
+			for _, dep := range deps[id] {
+				if !visited[dep] && visit(dep) {
+					return true
+				}
+			}
+			return false
+		}
+
+		return visit(from)
+	}
+
+	result := map[int][]string{}
+
+	for i := range releases {
+		id := ReleaseToID(&releases[i].ReleaseSpec)
+		if !selected[id] {
+			continue
+		}
+
+		for _, a := range releases[i].After {
+			if a == id || !selected[a] || dependsOn(a, id) {
+				continue
+			}
+
+			deps[id] = append(deps[id], a)
+			result[i] = append(result[i], a)
+		}
+	}
+
+	return result
+}
+
+// CheckNeedsCycles returns an error when the releases depend on each other directly or transitively via `needs`.
+//
+// It is called before running any helm command, so that helmfile fails fast with a readable error
+// rather than after repositories are synced and charts are prepared.
+func (st *HelmState) CheckNeedsCycles() error {
+	releases, err := expandNeedsSelectors(st.GetReleasesWithOverrides(), st.CommonLabels)
+	if err != nil {
+		return err
+	}
+
+	return detectNeedsCycle(releases)
+}
+
+// NeedsByReleaseID returns the IDs of the releases each release of the state needs, keyed by the ID of the release.
+//
+// Needs by label selectors and glob patterns are expanded into the IDs of the matching releases of the state.
+func (st *HelmState) NeedsByReleaseID() (map[string][]string, error) {
+	releases, err := expandNeedsSelectors(st.GetReleasesWithOverrides(), st.CommonLabels)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string][]string{}
+
+	for i := range releases {
+		id := ReleaseToID(&releases[i])
+		result[id] = append(result[id], releases[i].Needs...)
+	}
+
+	return result, nil
+}
+
+// RetainReleases narrows down the releases of the state to the ones with the given IDs.
+//
+// Needs by label selectors and glob patterns are expanded into release IDs beforehand, as the releases they match may be gone.
+func (st *HelmState) RetainReleases(ids map[string]bool) error {
+	releases, err := expandNeedsSelectors(st.GetReleasesWithOverrides(), st.CommonLabels)
+	if err != nil {
+		return err
+	}
+
+	var retained []ReleaseSpec
+	for i := range releases {
+		if ids[ReleaseToID(&releases[i])] {
+			retained = append(retained, releases[i])
+		}
+	}
+
+	st.Releases = retained
+
+	return nil
+}
+
+// RemoveNeeds removes the `needs` entries referring to any of the releases with the given IDs from the releases of the state.
+//
+// It is used by --global-needs to drop the needs on the releases processed in the other groups, which are honored by the order of the groups instead.
+func (st *HelmState) RemoveNeeds(ids map[string]bool) {
+	for i := range st.Releases {
+		release := &st.Releases[i]
+
+		resolved := *release
+		st.ApplyOverrides(&resolved)
+
+		var needs []string
+		for j, n := range release.Needs {
+			if !ids[resolved.Needs[j]] {
+				needs = append(needs, n)
+			}
+		}
+
+		release.Needs = needs
+	}
+}
+
+// detectNeedsCycle returns an error naming the IDs of the releases participating in a dependency cycle in cycle order,
+// like `cycle detected: default//a -> default//b -> default//a`.
+//
+// Releases are visited in the order of definitions and needs in the order of declarations so that the reported cycle is stable.
+// Needs referring to undefined releases are ignored here, as they are reported while planning.
+func detectNeedsCycle(releases []ReleaseSpec) error {
+	var ids []string
+	needs := map[string][]string{}
+
+	for i := range releases {
+		id := ReleaseToID(&releases[i])
+		if _, ok := needs[id]; !ok {
+			ids = append(ids, id)
+			needs[id] = []string{}
+		}
+		needs[id] = append(needs[id], releases[i].Needs...)
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := map[string]int{}
+
+	var path []string
+
+	var visit func(id string) []string
+
+	visit = func(id string) []string {
+		state[id] = visiting
+		path = append(path, id)
+
+		for _, n := range needs[id] {
+			if _, defined := needs[n]; !defined {
+				continue
+			}
+
+			switch state[n] {
+			case visiting:
+				for i := range path {
+					if path[i] == n {
+						return append(append([]string{}, path[i:]...), n)
+					}
+				}
+			case unvisited:
+				if cycle := visit(n); cycle != nil {
+					return cycle
+				}
+			}
+		}
+
+		path = path[:len(path)-1]
+		state[id] = visited
+
+		return nil
+	}
+
+	for _, id := range ids {
+		if state[id] != unvisited {
+			continue
+		}
+
+		if cycle := visit(id); cycle != nil {
+			return fmt.Errorf("cycle detected: %s", strings.Join(cycle, " -> "))
+		}
+	}
+
+	return nil
+}
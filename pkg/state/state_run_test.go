@@ -0,0 +1,391 @@
+package state
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/roboll/helmfile/pkg/exectest"
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+func TestDetectNeedsCycle(t *testing.T) {
+	testcases := []struct {
+		name     string
+		releases []ReleaseSpec
+		wantErr  string
+	}{
+		{
+			name: "no cycle",
+			releases: []ReleaseSpec{
+				{Name: "a", KubeContext: "default", Needs: []string{"default//b"}},
+				{Name: "b", KubeContext: "default", Needs: []string{"default//c"}},
+				{Name: "c", KubeContext: "default"},
+			},
+		},
+		{
+			name: "2-node cycle",
+			releases: []ReleaseSpec{
+				{Name: "a", KubeContext: "default", Needs: []string{"default//b"}},
+				{Name: "b", KubeContext: "default", Needs: []string{"default//a"}},
+			},
+			wantErr: "cycle detected: default//a -> default//b -> default//a",
+		},
+		{
+			name: "3-node cycle",
+			releases: []ReleaseSpec{
+				{Name: "a", KubeContext: "default", Needs: []string{"default//b"}},
+				{Name: "b", KubeContext: "default", Needs: []string{"default//c"}},
+				{Name: "c", KubeContext: "default", Needs: []string{"default//a"}},
+			},
+			wantErr: "cycle detected: default//a -> default//b -> default//c -> default//a",
+		},
+		{
+			name: "cycle not including the first release",
+			releases: []ReleaseSpec{
+				{Name: "a", Namespace: "ns", Needs: []string{"ns/b"}},
+				{Name: "b", Namespace: "ns", Needs: []string{"ns/c"}},
+				{Name: "c", Namespace: "ns", Needs: []string{"ns/b"}},
+			},
+			wantErr: "cycle detected: ns/b -> ns/c -> ns/b",
+		},
+		{
+			name: "undefined needs are ignored",
+			releases: []ReleaseSpec{
+				{Name: "a", Needs: []string{"undefined"}},
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := detectNeedsCycle(tc.releases)
+
+			var got string
+			if err != nil {
+				got = err.Error()
+			}
+
+			if got != tc.wantErr {
+				t.Errorf("unexpected error: want %q, got %q", tc.wantErr, got)
+			}
+		})
+	}
+}
+
+func TestPlanReleases_NeedsCycle(t *testing.T) {
+	testcases := []struct {
+		name      string
+		helmfile  string
+		selectors []string
+		wantErr   string
+	}{
+		{
+			name: "2-node cycle",
+			helmfile: `
+releases:
+- name: a
+  chart: stable/a
+  needs:
+  - b
+- name: b
+  chart: stable/b
+  needs:
+  - a
+`,
+			wantErr: "cycle detected: a -> b -> a",
+		},
+		{
+			name: "3-node cycle",
+			helmfile: `
+releases:
+- name: a
+  chart: stable/a
+  needs:
+  - b
+- name: b
+  chart: stable/b
+  needs:
+  - c
+- name: c
+  chart: stable/c
+  needs:
+  - a
+`,
+			wantErr: "cycle detected: a -> b -> c -> a",
+		},
+		{
+			name: "cycle only among transitive needs of the selected release",
+			helmfile: `
+releases:
+- name: app
+  chart: stable/app
+  needs:
+  - a
+- name: a
+  chart: stable/a
+  needs:
+  - b
+- name: b
+  chart: stable/b
+  needs:
+  - a
+- name: other
+  chart: stable/other
+`,
+			selectors: []string{"name=app"},
+			wantErr:   "cycle detected: a -> b -> a",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			state := stateTestEnv{
+				Files: map[string]string{
+					"/helmfile.yaml": tc.helmfile,
+				},
+				WorkDir: "/",
+			}.MustLoadState(t, "/helmfile.yaml", "default")
+
+			state.Selectors = tc.selectors
+
+			if err := state.CheckNeedsCycles(); err == nil || err.Error() != tc.wantErr {
+				t.Errorf("unexpected error from CheckNeedsCycles: want %q, got %v", tc.wantErr, err)
+			}
+
+			_, err := state.PlanReleases(PlanOptions{IncludeTransitiveNeeds: true})
+			if err == nil || err.Error() != tc.wantErr {
+				t.Errorf("unexpected error from PlanReleases: want %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestPlanReleases_After(t *testing.T) {
+	testcases := []struct {
+		name      string
+		helmfile  string
+		selectors []string
+		want      [][]string
+	}{
+		{
+			name: "ordered after the selected release",
+			helmfile: `
+releases:
+- name: b
+  chart: stable/b
+  after:
+  - a
+- name: a
+  chart: stable/a
+`,
+			want: [][]string{{"a"}, {"b"}},
+		},
+		{
+			name: "unselected release is neither required nor included",
+			helmfile: `
+releases:
+- name: b
+  chart: stable/b
+  after:
+  - a
+- name: a
+  chart: stable/a
+`,
+			selectors: []string{"name=b"},
+			want:      [][]string{{"b"}},
+		},
+		{
+			name: "undefined release is ignored",
+			helmfile: `
+releases:
+- name: b
+  chart: stable/b
+  after:
+  - c
+- name: a
+  chart: stable/a
+`,
+			want: [][]string{{"b", "a"}},
+		},
+		{
+			name: "needs take precedence over conflicting after",
+			helmfile: `
+releases:
+- name: a
+  chart: stable/a
+  needs:
+  - b
+- name: b
+  chart: stable/b
+  after:
+  - a
+`,
+			want: [][]string{{"b"}, {"a"}},
+		},
+		{
+			name: "earlier after takes precedence over conflicting later after",
+			helmfile: `
+releases:
+- name: a
+  chart: stable/a
+  after:
+  - b
+- name: b
+  chart: stable/b
+  after:
+  - a
+`,
+			want: [][]string{{"b"}, {"a"}},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			state := stateTestEnv{
+				Files: map[string]string{
+					"/helmfile.yaml": tc.helmfile,
+				},
+				WorkDir: "/",
+			}.MustLoadState(t, "/helmfile.yaml", "default")
+
+			state.Selectors = tc.selectors
+
+			selected, err := state.GetSelectedReleasesWithOverrides(false)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			groups, err := state.PlanReleases(PlanOptions{SelectedReleases: selected})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var got [][]string
+			for _, g := range groups {
+				var names []string
+				for _, r := range g {
+					names = append(names, r.Name)
+				}
+				got = append(got, names)
+			}
+
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("unexpected groups: want (-), got (+):\n%s", d)
+			}
+		})
+	}
+}
+
+// concurrencyTrackingHelm records the maximum number of the concurrent syncs per kube context
+type concurrencyTrackingHelm struct {
+	*exectest.Helm
+
+	kubeContexts map[string]string
+
+	mu      sync.Mutex
+	running map[string]int
+	max     map[string]int
+}
+
+func (helm *concurrencyTrackingHelm) SyncRelease(context helmexec.HelmContext, name, chart string, flags ...string) error {
+	kubeContext := helm.kubeContexts[name]
+
+	helm.mu.Lock()
+	helm.running[kubeContext]++
+	if helm.running[kubeContext] > helm.max[kubeContext] {
+		helm.max[kubeContext] = helm.running[kubeContext]
+	}
+	helm.mu.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	helm.mu.Lock()
+	helm.running[kubeContext]--
+	helm.mu.Unlock()
+
+	return helm.Helm.SyncRelease(context, name, chart, flags...)
+}
+
+func TestHelmState_SyncReleases_ConcurrencyPerContext(t *testing.T) {
+	testcases := []struct {
+		name                  string
+		concurrencyPerContext int
+		wantMax               map[string]int
+	}{
+		{
+			name:    "unlimited",
+			wantMax: map[string]int{"c1": 4, "c2": 2},
+		},
+		{
+			name:                  "1 per context",
+			concurrencyPerContext: 1,
+			wantMax:               map[string]int{"c1": 1, "c2": 1},
+		},
+		{
+			name:                  "2 per context",
+			concurrencyPerContext: 2,
+			wantMax:               map[string]int{"c1": 2, "c2": 2},
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			kubeContexts := map[string]string{}
+			var releases []ReleaseSpec
+			for _, kc := range []struct {
+				name     string
+				releases int
+			}{{"c1", 4}, {"c2", 2}} {
+				for j := 0; j < kc.releases; j++ {
+					name := fmt.Sprintf("%s-app%d", kc.name, j)
+					kubeContexts[name] = kc.name
+					releases = append(releases, ReleaseSpec{Name: name, Chart: "stable/app", KubeContext: kc.name})
+				}
+			}
+
+			st := &HelmState{
+				ReleaseSetSpec: ReleaseSetSpec{
+					Releases:              releases,
+					ConcurrencyPerContext: tc.concurrencyPerContext,
+				},
+				logger:         logger,
+				valsRuntime:    valsRuntime,
+				RenderedValues: map[string]interface{}{},
+			}
+
+			helm := &concurrencyTrackingHelm{
+				Helm: &exectest.Helm{
+					Lists:         map[exectest.ListKey]string{},
+					Helm3:         true,
+					ReleasesMutex: &sync.Mutex{},
+					ChartsMutex:   &sync.Mutex{},
+					ListsMutex:    &sync.Mutex{},
+				},
+				kubeContexts: kubeContexts,
+				running:      map[string]int{},
+				max:          map[string]int{},
+			}
+
+			affectedReleases := AffectedReleases{}
+			if errs := st.SyncReleases(&affectedReleases, helm, []string{}, len(releases), &SyncOpts{}); len(errs) > 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+
+			if len(affectedReleases.Upgraded) != len(releases) {
+				t.Errorf("unexpected number of upgraded releases: want %d, got %d", len(releases), len(affectedReleases.Upgraded))
+			}
+
+			for kc, want := range tc.wantMax {
+				if got := helm.max[kc]; got > want {
+					t.Errorf("too many concurrent syncs in %s: want at most %d, got %d", kc, want, got)
+				}
+			}
+		})
+	}
+}
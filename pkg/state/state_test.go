@@ -1,18 +1,26 @@
 package state
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/Masterminds/semver/v3"
+	"github.com/google/go-cmp/cmp"
+	"github.com/roboll/helmfile/pkg/environment"
+	"github.com/roboll/helmfile/pkg/event"
 	"github.com/roboll/helmfile/pkg/exectest"
 	"github.com/roboll/helmfile/pkg/helmexec"
 	"github.com/roboll/helmfile/pkg/testhelper"
 	"github.com/variantdev/vals"
+	"gopkg.in/yaml.v2"
 )
 
 var logger = helmexec.NewLogger(os.Stdout, "warn")
@@ -153,7 +161,7 @@ func TestHelmState_flagsForUpgrade(t *testing.T) {
 	enable := true
 	disable := false
 
-	some := func(v int) *int {
+	some := func(v Duration) *Duration {
 		return &v
 	}
 
@@ -394,6 +402,87 @@ func TestHelmState_flagsForUpgrade(t *testing.T) {
 				"--namespace", "test-namespace",
 			},
 		},
+		{
+			name: "wait-timeout",
+			defaults: HelmSpec{
+				Timeout: 0,
+			},
+			release: &ReleaseSpec{
+				Chart:       "test/chart",
+				Version:     "0.1",
+				Wait:        &enable,
+				Timeout:     some(123),
+				WaitTimeout: some(600),
+				Name:        "test-charts",
+				Namespace:   "test-namespace",
+			},
+			want: []string{
+				"--version", "0.1",
+				"--wait",
+				"--timeout", "600",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name: "wait-timeout-from-default",
+			defaults: HelmSpec{
+				Wait:        true,
+				Timeout:     123,
+				WaitTimeout: 600,
+			},
+			release: &ReleaseSpec{
+				Chart:     "test/chart",
+				Version:   "0.1",
+				Name:      "test-charts",
+				Namespace: "test-namespace",
+			},
+			want: []string{
+				"--version", "0.1",
+				"--wait",
+				"--timeout", "600",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name: "wait-timeout-smaller-than-timeout",
+			defaults: HelmSpec{
+				Timeout: 0,
+			},
+			release: &ReleaseSpec{
+				Chart:       "test/chart",
+				Version:     "0.1",
+				Wait:        &enable,
+				Timeout:     some(900),
+				WaitTimeout: some(600),
+				Name:        "test-charts",
+				Namespace:   "test-namespace",
+			},
+			want: []string{
+				"--version", "0.1",
+				"--wait",
+				"--timeout", "900",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name: "wait-timeout-without-wait",
+			defaults: HelmSpec{
+				Timeout: 0,
+			},
+			release: &ReleaseSpec{
+				Chart:       "test/chart",
+				Version:     "0.1",
+				Timeout:     some(123),
+				WaitTimeout: some(600),
+				Name:        "test-charts",
+				Namespace:   "test-namespace",
+			},
+			want: []string{
+				"--version", "0.1",
+				"--timeout", "123",
+				"--namespace", "test-namespace",
+			},
+		},
 		{
 			name: "timeout-from-default",
 			defaults: HelmSpec{
@@ -516,6 +605,72 @@ func TestHelmState_flagsForUpgrade(t *testing.T) {
 				"--namespace", "test-namespace",
 			},
 		},
+		{
+			name:     "reuse-values",
+			defaults: HelmSpec{},
+			release: &ReleaseSpec{
+				Chart:       "test/chart",
+				Version:     "0.1",
+				ReuseValues: &enable,
+				Name:        "test-charts",
+				Namespace:   "test-namespace",
+			},
+			want: []string{
+				"--version", "0.1",
+				"--reuse-values",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name: "reset-values-from-default",
+			defaults: HelmSpec{
+				ResetValues: true,
+			},
+			release: &ReleaseSpec{
+				Chart:     "test/chart",
+				Version:   "0.1",
+				Name:      "test-charts",
+				Namespace: "test-namespace",
+			},
+			want: []string{
+				"--version", "0.1",
+				"--reset-values",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name: "reuse-values-override-default",
+			defaults: HelmSpec{
+				ResetValues: true,
+			},
+			release: &ReleaseSpec{
+				Chart:       "test/chart",
+				Version:     "0.1",
+				ReuseValues: &enable,
+				ResetValues: &disable,
+				Name:        "test-charts",
+				Namespace:   "test-namespace",
+			},
+			want: []string{
+				"--version", "0.1",
+				"--reuse-values",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name: "reuse-values-and-reset-values",
+			defaults: HelmSpec{
+				ResetValues: true,
+			},
+			release: &ReleaseSpec{
+				Chart:       "test/chart",
+				Version:     "0.1",
+				ReuseValues: &enable,
+				Name:        "test-charts",
+				Namespace:   "test-namespace",
+			},
+			wantErr: `releases[].reuseValues and releases[].resetValues are mutually exclusive, but both are enabled for release "test-charts"`,
+		},
 		{
 			name:     "tiller",
 			defaults: HelmSpec{},
@@ -608,6 +763,102 @@ func TestHelmState_flagsForUpgrade(t *testing.T) {
 				"--namespace", "test-namespace",
 			},
 		},
+		{
+			name:    "release-labels-helm3.13",
+			version: semver.MustParse("3.13.0"),
+			release: &ReleaseSpec{
+				Chart:         "test/chart",
+				Version:       "0.1",
+				Name:          "test-charts",
+				Namespace:     "test-namespace",
+				ReleaseLabels: map[string]string{"team": "web", "owner": "alice"},
+			},
+			want: []string{
+				"--version", "0.1",
+				"--create-namespace",
+				"--labels", "owner=alice,team=web",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name:    "release-labels-helm3.12",
+			version: semver.MustParse("3.12.0"),
+			release: &ReleaseSpec{
+				Chart:         "test/chart",
+				Version:       "0.1",
+				Name:          "test-charts",
+				Namespace:     "test-namespace",
+				ReleaseLabels: map[string]string{"team": "web"},
+			},
+			wantErr: "releases[].releaseLabels requires Helm 3.13.0 or greater",
+		},
+		{
+			name:    "take-ownership-helm3.17",
+			version: semver.MustParse("3.17.0"),
+			release: &ReleaseSpec{
+				Chart:         "test/chart",
+				Version:       "0.1",
+				Name:          "test-charts",
+				Namespace:     "test-namespace",
+				TakeOwnership: &enable,
+			},
+			want: []string{
+				"--version", "0.1",
+				"--take-ownership",
+				"--create-namespace",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name: "take-ownership-from-default-helm3.17",
+			defaults: HelmSpec{
+				TakeOwnership: true,
+			},
+			version: semver.MustParse("3.17.0"),
+			release: &ReleaseSpec{
+				Chart:     "test/chart",
+				Version:   "0.1",
+				Name:      "test-charts",
+				Namespace: "test-namespace",
+			},
+			want: []string{
+				"--version", "0.1",
+				"--take-ownership",
+				"--create-namespace",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name: "take-ownership-release-override-disabled-helm3.17",
+			defaults: HelmSpec{
+				TakeOwnership: true,
+			},
+			version: semver.MustParse("3.17.0"),
+			release: &ReleaseSpec{
+				Chart:         "test/chart",
+				Version:       "0.1",
+				Name:          "test-charts",
+				Namespace:     "test-namespace",
+				TakeOwnership: &disable,
+			},
+			want: []string{
+				"--version", "0.1",
+				"--create-namespace",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name:    "take-ownership-helm3.16",
+			version: semver.MustParse("3.16.4"),
+			release: &ReleaseSpec{
+				Chart:         "test/chart",
+				Version:       "0.1",
+				Name:          "test-charts",
+				Namespace:     "test-namespace",
+				TakeOwnership: &enable,
+			},
+			wantErr: "releases[].takeOwnership requires Helm 3.17.0 or greater",
+		},
 		{
 			name: "create-namespace-disabled-helm3.2",
 			defaults: HelmSpec{
@@ -684,6 +935,113 @@ func TestHelmState_flagsForUpgrade(t *testing.T) {
 			},
 			wantErr: "releases[].createNamespace requires Helm 3.2.0 or greater",
 		},
+		{
+			name: "set-string",
+			defaults: HelmSpec{
+				Verify:          false,
+				CreateNamespace: &disable,
+			},
+			release: &ReleaseSpec{
+				Chart:     "test/chart",
+				Version:   "0.1",
+				Verify:    &disable,
+				Name:      "test-charts",
+				Namespace: "test-namespace",
+				SetValues: []SetValue{
+					{Name: "replicas", Value: "1"},
+				},
+				SetStringValues: []SetValue{
+					{Name: "image.tag", Value: "0123"},
+					{Name: "args", Values: []string{"true", "1,2"}},
+				},
+			},
+			want: []string{
+				"--version", "0.1",
+				"--namespace", "test-namespace",
+				"--set", "replicas=1",
+				"--set-string", "image.tag=0123",
+				"--set-string", "args={true,1\\,2}",
+			},
+		},
+		{
+			name: "post-renderer",
+			defaults: HelmSpec{
+				Verify:          false,
+				CreateNamespace: &disable,
+			},
+			version: semver.MustParse("3.7.0"),
+			release: &ReleaseSpec{
+				Chart:            "test/chart",
+				Version:          "0.1",
+				Verify:           &disable,
+				Name:             "test-charts",
+				Namespace:        "test-namespace",
+				PostRenderer:     "./bin/renderer.sh",
+				PostRendererArgs: []string{"--foo", "bar"},
+			},
+			want: []string{
+				"--version", "0.1",
+				"--post-renderer", "bin/renderer.sh",
+				"--post-renderer-args", "--foo",
+				"--post-renderer-args", "bar",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name: "post-renderer-from-defaults",
+			defaults: HelmSpec{
+				Verify:          false,
+				CreateNamespace: &disable,
+				PostRenderer:    "kustomize-renderer",
+			},
+			version: semver.MustParse("3.1.0"),
+			release: &ReleaseSpec{
+				Chart:     "test/chart",
+				Version:   "0.1",
+				Verify:    &disable,
+				Name:      "test-charts",
+				Namespace: "test-namespace",
+			},
+			want: []string{
+				"--version", "0.1",
+				"--post-renderer", "kustomize-renderer",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name: "post-renderer-unsupported",
+			defaults: HelmSpec{
+				Verify: false,
+			},
+			version: semver.MustParse("2.16.0"),
+			release: &ReleaseSpec{
+				Chart:        "test/chart",
+				Version:      "0.1",
+				Verify:       &disable,
+				Name:         "test-charts",
+				Namespace:    "test-namespace",
+				PostRenderer: "./bin/renderer.sh",
+			},
+			wantErr: "releases[].postRenderer requires Helm 3.1.0 or greater",
+		},
+		{
+			name: "post-renderer-args-unsupported",
+			defaults: HelmSpec{
+				Verify:          false,
+				CreateNamespace: &disable,
+			},
+			version: semver.MustParse("3.6.0"),
+			release: &ReleaseSpec{
+				Chart:            "test/chart",
+				Version:          "0.1",
+				Verify:           &disable,
+				Name:             "test-charts",
+				Namespace:        "test-namespace",
+				PostRenderer:     "./bin/renderer.sh",
+				PostRendererArgs: []string{"--foo"},
+			},
+			wantErr: "releases[].postRendererArgs requires Helm 3.7.0 or greater",
+		},
 	}
 	for i := range tests {
 		tt := tests[i]
@@ -715,8 +1073,89 @@ func TestHelmState_flagsForUpgrade(t *testing.T) {
 	}
 }
 
-func Test_isLocalChart(t *testing.T) {
-	type args struct {
+func TestHelmState_flagsForTemplate_PostRenderer(t *testing.T) {
+	release := &ReleaseSpec{
+		Chart:            "test/chart",
+		Name:             "test-charts",
+		Namespace:        "test-namespace",
+		PostRenderer:     "bin/renderer.sh",
+		PostRendererArgs: []string{"--foo"},
+	}
+
+	state := &HelmState{
+		basePath: "/path/to",
+		ReleaseSetSpec: ReleaseSetSpec{
+			Releases: []ReleaseSpec{*release},
+		},
+		valsRuntime: valsRuntime,
+	}
+	helm := &exectest.Helm{
+		Helm3:   true,
+		Version: semver.MustParse("3.7.0"),
+	}
+
+	args, _, err := state.flagsForTemplate(helm, release, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{
+		"--post-renderer", "/path/to/bin/renderer.sh",
+		"--post-renderer-args", "--foo",
+		"--namespace", "test-namespace",
+	}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("flagsForTemplate returned = %v, want %v", args, want)
+	}
+}
+
+func TestHelmState_flagsFor_SetFileWithValuesPathPrefix(t *testing.T) {
+	release := &ReleaseSpec{
+		Chart:            "test/chart",
+		Name:             "test-charts",
+		Namespace:        "test-namespace",
+		ValuesPathPrefix: "envs/prod/",
+		SetValues: []SetValue{
+			{Name: "config", File: "rel/path"},
+		},
+	}
+
+	state := &HelmState{
+		basePath: "/path/to",
+		ReleaseSetSpec: ReleaseSetSpec{
+			Releases: []ReleaseSpec{*release},
+		},
+		valsRuntime: valsRuntime,
+	}
+	helm := &exectest.Helm{
+		Helm3:   true,
+		Version: semver.MustParse("3.7.0"),
+	}
+
+	want := []string{
+		"--namespace", "test-namespace",
+		"--set-file", "config=/path/to/envs/prod/rel/path",
+	}
+
+	template, _, err := state.flagsForTemplate(helm, release, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d := cmp.Diff(want, template); d != "" {
+		t.Errorf("unexpected flags for template: want (-), got (+):\n%s", d)
+	}
+
+	upgrade, _, err := state.flagsForUpgrade(helm, release, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d := cmp.Diff(append([]string{"--create-namespace"}, want...), upgrade); d != "" {
+		t.Errorf("unexpected flags for upgrade: want (-), got (+):\n%s", d)
+	}
+}
+
+func Test_isLocalChart(t *testing.T) {
+	type args struct {
 		chart string
 	}
 	tests := []struct {
@@ -983,6 +1422,33 @@ func TestHelmState_SyncRepos(t *testing.T) {
 			helm: &exectest.Helm{},
 			want: []string{"name", "http://example.com/", "", "", "", "", "", "", "", "true"},
 		},
+		{
+			name: "repository with credentialsRef map",
+			repos: []RepositorySpec{
+				{
+					Name: "name",
+					URL:  "http://example.com/",
+					CredentialsRef: &RepositoryCredentialsRef{
+						Username: "ref+file://testdata/repo-credentials.yaml#/username",
+						Password: "ref+file://testdata/repo-credentials.yaml#/password",
+					},
+				},
+			},
+			helm: &exectest.Helm{},
+			want: []string{"name", "http://example.com/", "", "", "", "ref_user", "ref_password", "", "", ""},
+		},
+		{
+			name: "repository with credentialsRef yielding both username and password",
+			repos: []RepositorySpec{
+				{
+					Name:           "name",
+					URL:            "http://example.com/",
+					CredentialsRef: &RepositoryCredentialsRef{Ref: "ref+file://testdata/repo-credentials.json"},
+				},
+			},
+			helm: &exectest.Helm{},
+			want: []string{"name", "http://example.com/", "", "", "", "ref_user", "ref_password", "", "", ""},
+		},
 	}
 	for i := range tests {
 		tt := tests[i]
@@ -997,6 +1463,7 @@ func TestHelmState_SyncRepos(t *testing.T) {
 				ReleaseSetSpec: ReleaseSetSpec{
 					Repositories: tt.repos,
 				},
+				valsRuntime: valsRuntime,
 			}
 			if _, _ = state.SyncRepos(tt.helm, map[string]bool{}); !reflect.DeepEqual(tt.helm.Repo, tt.want) {
 				t.Errorf("HelmState.SyncRepos() for [%s] = %v, want %v", tt.name, tt.helm.Repo, tt.want)
@@ -1009,6 +1476,7 @@ func TestHelmState_SyncReleases(t *testing.T) {
 	tests := []struct {
 		name          string
 		releases      []ReleaseSpec
+		opts          *SyncOpts
 		helm          *exectest.Helm
 		wantReleases  []exectest.Release
 		wantErrorMsgs []string
@@ -1102,6 +1570,83 @@ func TestHelmState_SyncReleases(t *testing.T) {
 			helm:         &exectest.Helm{},
 			wantReleases: []exectest.Release{{Name: "releaseName", Flags: []string{"--set", "foo.bar[0]={A,B}"}}},
 		},
+		{
+			name: "reuse-values and reset-values",
+			releases: []ReleaseSpec{
+				{
+					Name:        "releaseName",
+					Chart:       "foo",
+					ReuseValues: boolValue(true),
+					ResetValues: boolValue(true),
+				},
+			},
+			helm: &exectest.Helm{},
+			wantErrorMsgs: []string{
+				`failed processing release releaseName: releases[].reuseValues and releases[].resetValues are mutually exclusive, but both are enabled for release "releaseName"`,
+			},
+		},
+		{
+			name: "atomic and cleanup-on-fail forced from the command-line",
+			releases: []ReleaseSpec{
+				{
+					Name:  "releaseName",
+					Chart: "foo",
+				},
+			},
+			opts:         &SyncOpts{Atomic: true, CleanupOnFail: true},
+			helm:         &exectest.Helm{},
+			wantReleases: []exectest.Release{{Name: "releaseName", Flags: []string{"--atomic", "--cleanup-on-fail"}}},
+		},
+		{
+			name: "atomic from the command-line overrides the release",
+			releases: []ReleaseSpec{
+				{
+					Name:   "releaseName",
+					Chart:  "foo",
+					Atomic: boolValue(false),
+				},
+			},
+			opts:         &SyncOpts{Atomic: true},
+			helm:         &exectest.Helm{},
+			wantReleases: []exectest.Release{{Name: "releaseName", Flags: []string{"--atomic"}}},
+		},
+		{
+			name: "atomic from the release without the command-line flag",
+			releases: []ReleaseSpec{
+				{
+					Name:   "releaseName",
+					Chart:  "foo",
+					Atomic: boolValue(true),
+				},
+			},
+			helm:         &exectest.Helm{},
+			wantReleases: []exectest.Release{{Name: "releaseName", Flags: []string{"--atomic"}}},
+		},
+		{
+			name: "create-namespace from the release",
+			releases: []ReleaseSpec{
+				{
+					Name:            "releaseName",
+					Chart:           "foo",
+					CreateNamespace: boolValue(true),
+				},
+			},
+			helm:         &exectest.Helm{Helm3: true, Version: semver.MustParse("3.7.0")},
+			wantReleases: []exectest.Release{{Name: "releaseName", Flags: []string{"--create-namespace"}}},
+		},
+		{
+			name: "no-create-namespace from the command-line overrides the release",
+			releases: []ReleaseSpec{
+				{
+					Name:            "releaseName",
+					Chart:           "foo",
+					CreateNamespace: boolValue(true),
+				},
+			},
+			opts:         &SyncOpts{NoCreateNamespace: true},
+			helm:         &exectest.Helm{Helm3: true, Version: semver.MustParse("3.7.0")},
+			wantReleases: []exectest.Release{{Name: "releaseName", Flags: []string{}}},
+		},
 	}
 	for i := range tests {
 		tt := tests[i]
@@ -1114,7 +1659,11 @@ func TestHelmState_SyncReleases(t *testing.T) {
 				valsRuntime:    valsRuntime,
 				RenderedValues: map[string]interface{}{},
 			}
-			if errs := state.SyncReleases(&AffectedReleases{}, tt.helm, []string{}, 1); len(errs) > 0 {
+			var opts []SyncOpt
+			if tt.opts != nil {
+				opts = append(opts, tt.opts)
+			}
+			if errs := state.SyncReleases(&AffectedReleases{}, tt.helm, []string{}, 1, opts...); len(errs) > 0 {
 				if len(errs) != len(tt.wantErrorMsgs) {
 					t.Fatalf("Unexpected errors: %v\nExpected: %v", errs, tt.wantErrorMsgs)
 				}
@@ -1395,6 +1944,313 @@ func TestHelmState_SyncReleasesAffectedRealeases(t *testing.T) {
 	}
 }
 
+func TestHelmState_SyncReleases_VerboseSummary(t *testing.T) {
+	yes := true
+
+	for _, verbose := range []bool{true, false} {
+		verbose := verbose
+
+		t.Run(fmt.Sprintf("verbose=%t", verbose), func(t *testing.T) {
+			state := &HelmState{
+				ReleaseSetSpec: ReleaseSetSpec{
+					Releases: []ReleaseSpec{
+						{
+							Name:  "foo",
+							Chart: "stable/foo",
+							Wait:  &yes,
+						},
+						{
+							Name:  "bar",
+							Chart: "stable/bar",
+						},
+					},
+				},
+				logger:         logger,
+				valsRuntime:    valsRuntime,
+				RenderedValues: map[string]interface{}{},
+			}
+
+			helm := &exectest.Helm{
+				Lists: map[exectest.ListKey]string{},
+			}
+
+			affectedReleases := AffectedReleases{Verbose: verbose}
+			if errs := state.SyncReleases(&affectedReleases, helm, []string{}, 1); len(errs) > 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+
+			for id, wait := range map[string]bool{"foo": true, "bar": false} {
+				md, ok := affectedReleases.Metadata[id]
+				if !ok {
+					t.Fatalf("missing metadata for %s: %v", id, affectedReleases.Metadata)
+				}
+				if md.Wait != wait {
+					t.Errorf("unexpected wait for %s: want %t, got %t", id, wait, md.Wait)
+				}
+				if md.Duration <= 0 {
+					t.Errorf("unexpected duration for %s: %v", id, md.Duration)
+				}
+			}
+
+			var buf bytes.Buffer
+			affectedReleases.DisplayAffectedReleases(helmexec.NewLogger(&buf, "info"))
+
+			summary := buf.String()
+
+			for _, s := range []string{"WAIT", "DURATION", "true", "false"} {
+				if strings.Contains(summary, s) != verbose {
+					t.Errorf("summary should contain %q only when verbose=%t:\n%s", s, verbose, summary)
+				}
+			}
+		})
+	}
+}
+
+func TestHelmState_SyncReleases_PostSyncStatus(t *testing.T) {
+	state := &HelmState{
+		ReleaseSetSpec: ReleaseSetSpec{
+			Releases: []ReleaseSpec{
+				{
+					Name:      "foo",
+					Chart:     "stable/foo",
+					Namespace: "default",
+				},
+				{
+					Name:      "bar",
+					Chart:     "stable/bar",
+					Namespace: "default",
+				},
+			},
+		},
+		logger:         logger,
+		valsRuntime:    valsRuntime,
+		RenderedValues: map[string]interface{}{},
+	}
+
+	helm := &exectest.Helm{
+		Lists: map[exectest.ListKey]string{},
+		Statuses: map[string]string{
+			"foo": `{"name":"foo","namespace":"default","version":2,"info":{"status":"deployed"}}`,
+			"bar": `{"name":"bar","namespace":"default","version":3,"info":{"status":"failed"}}`,
+		},
+		Helm3: true,
+	}
+
+	affectedReleases := AffectedReleases{}
+	if errs := state.SyncReleases(&affectedReleases, helm, []string{}, 1, &SyncOpts{PostSyncStatus: true}); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	for id, status := range map[string]string{"default/foo": "deployed", "default/bar": "failed"} {
+		md, ok := affectedReleases.Metadata[id]
+		if !ok {
+			t.Fatalf("missing metadata for %s: %v", id, affectedReleases.Metadata)
+		}
+		if md.Status != status {
+			t.Errorf("unexpected status for %s: want %q, got %q", id, status, md.Status)
+		}
+	}
+
+	var buf bytes.Buffer
+	affectedReleases.DisplayAffectedReleases(helmexec.NewLogger(&buf, "info"))
+
+	summary := buf.String()
+
+	if !strings.Contains(summary, "STATUS") {
+		t.Errorf("summary should contain the status column:\n%s", summary)
+	}
+
+	_, notDeployed, ok := strings.Cut(summary, "UPDATED RELEASES NOT DEPLOYED:")
+	if !ok {
+		t.Fatalf("summary should highlight the releases not deployed:\n%s", summary)
+	}
+	if !regexp.MustCompile(`(?m)^bar\s+failed$`).MatchString(notDeployed) {
+		t.Errorf("release bar should be highlighted as failed:\n%s", summary)
+	}
+	if strings.Contains(notDeployed, "foo") {
+		t.Errorf("release foo should not be highlighted:\n%s", summary)
+	}
+}
+
+func TestHelmState_SyncReleases_NoPostSyncStatus(t *testing.T) {
+	state := &HelmState{
+		ReleaseSetSpec: ReleaseSetSpec{
+			Releases: []ReleaseSpec{
+				{
+					Name:  "foo",
+					Chart: "stable/foo",
+				},
+			},
+		},
+		logger:         logger,
+		valsRuntime:    valsRuntime,
+		RenderedValues: map[string]interface{}{},
+	}
+
+	helm := &exectest.Helm{
+		Lists: map[exectest.ListKey]string{},
+		Helm3: true,
+	}
+
+	affectedReleases := AffectedReleases{}
+	if errs := state.SyncReleases(&affectedReleases, helm, []string{}, 1); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	// helm status must not be run, as the mock records it as a release
+	if len(helm.Releases) != 1 {
+		t.Errorf("unexpected helm calls: %v", helm.Releases)
+	}
+
+	var buf bytes.Buffer
+	affectedReleases.DisplayAffectedReleases(helmexec.NewLogger(&buf, "info"))
+
+	if strings.Contains(buf.String(), "STATUS") {
+		t.Errorf("summary should not contain the status column:\n%s", buf.String())
+	}
+}
+
+func TestAffectedReleases_DisplayAffectedReleases_Color(t *testing.T) {
+	tests := []struct {
+		name      string
+		color     bool
+		wantColor bool
+	}{
+		{
+			name: "never",
+		},
+		{
+			name:      "always",
+			color:     true,
+			wantColor: true,
+		},
+	}
+
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			affectedReleases := AffectedReleases{
+				Upgraded: []*ReleaseSpec{{Name: "foo", Chart: "stable/foo"}},
+				Deleted:  []*ReleaseSpec{{Name: "bar", Chart: "stable/bar"}},
+				Failed:   []*ReleaseSpec{{Name: "baz", Chart: "stable/baz"}},
+				Color:    tt.color,
+			}
+
+			var buf bytes.Buffer
+			affectedReleases.DisplayAffectedReleases(helmexec.NewLogger(&buf, "info"))
+			summary := buf.String()
+
+			for _, header := range []string{"UPDATED RELEASES:", "DELETED RELEASES:", "FAILED RELEASES:"} {
+				if !strings.Contains(summary, header) {
+					t.Errorf("summary should contain %q:\n%s", header, summary)
+				}
+			}
+
+			if hasColor := strings.Contains(summary, "\x1b["); hasColor != tt.wantColor {
+				t.Errorf("unexpected color codes in the summary: want %v, got %v:\n%q", tt.wantColor, hasColor, summary)
+			}
+		})
+	}
+}
+
+func TestHelmState_SyncReleases_FailFast(t *testing.T) {
+	tests := []struct {
+		name         string
+		failFast     bool
+		wantReleases []string
+	}{
+		{
+			name:         "attempts all releases by default",
+			wantReleases: []string{"second"},
+		},
+		{
+			name:     "stops on the first failure with fail-fast",
+			failFast: true,
+		},
+	}
+
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			state := &HelmState{
+				ReleaseSetSpec: ReleaseSetSpec{
+					Releases: []ReleaseSpec{
+						{
+							Name:  "error-first",
+							Chart: "stable/foo",
+						},
+						{
+							Name:  "second",
+							Chart: "stable/bar",
+						},
+					},
+				},
+				logger:         logger,
+				valsRuntime:    valsRuntime,
+				RenderedValues: map[string]interface{}{},
+			}
+
+			helm := &exectest.Helm{
+				Lists: map[exectest.ListKey]string{},
+				Helm3: true,
+			}
+
+			affectedReleases := AffectedReleases{}
+			errs := state.SyncReleases(&affectedReleases, helm, []string{}, 1, &SyncOpts{FailFast: tt.failFast})
+			if len(errs) != 1 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+
+			var synced []string
+			for _, r := range helm.Releases {
+				synced = append(synced, r.Name)
+			}
+
+			if d := cmp.Diff(tt.wantReleases, synced); d != "" {
+				t.Errorf("unexpected releases synced: want (-), got (+):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestHelmState_SyncReleases_Reason(t *testing.T) {
+	state := &HelmState{
+		ReleaseSetSpec: ReleaseSetSpec{
+			Releases: []ReleaseSpec{
+				{
+					Name:  "foo",
+					Chart: "stable/foo",
+				},
+			},
+		},
+		logger:         logger,
+		valsRuntime:    valsRuntime,
+		RenderedValues: map[string]interface{}{},
+	}
+
+	helm := &exectest.Helm{
+		Lists: map[exectest.ListKey]string{},
+		Helm3: true,
+	}
+
+	affectedReleases := AffectedReleases{}
+	if errs := state.SyncReleases(&affectedReleases, helm, []string{}, 1, &SyncOpts{Reason: "JIRA-123: bump image"}); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	if len(helm.Releases) != 1 {
+		t.Fatalf("unexpected releases synced: %v", helm.Releases)
+	}
+
+	flags := helm.Releases[0].Flags
+	for i, f := range flags {
+		if f == "--description" && i+1 < len(flags) && flags[i+1] == "JIRA-123: bump image" {
+			return
+		}
+	}
+	t.Errorf("the reason should be passed as --description: %q", flags)
+}
+
 func testEq(a []*ReleaseSpec, b []*exectest.Release) bool {
 
 	// If one is nil, the other must also be nil.
@@ -1604,12 +2460,266 @@ func TestHelmState_DiffReleases(t *testing.T) {
 				valsRuntime:    valsRuntime,
 				RenderedValues: map[string]interface{}{},
 			}
-			_, errs := state.DiffReleases(tt.helm, []string{}, 1, false, false, []string{}, false, false, false, false)
+			_, errs := state.DiffReleases(tt.helm, []string{}, 1, false, false, []string{}, false, false, false, false)
+			if len(errs) > 0 {
+				t.Errorf("unexpected error: %v", errs)
+			}
+			if !reflect.DeepEqual(tt.helm.Diffed, tt.wantReleases) {
+				t.Errorf("HelmState.DiffReleases() for [%s] = %v, want %v", tt.name, tt.helm.Releases, tt.wantReleases)
+			}
+		})
+	}
+}
+
+func TestHelmState_DiffReleases_FailFast(t *testing.T) {
+	tests := []struct {
+		name       string
+		failFast   bool
+		wantDiffed []string
+	}{
+		{
+			name:       "attempts all releases by default",
+			wantDiffed: []string{"first", "second"},
+		},
+		{
+			name:       "stops on the first failure with fail-fast",
+			failFast:   true,
+			wantDiffed: []string{"first"},
+		},
+	}
+
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			state := &HelmState{
+				ReleaseSetSpec: ReleaseSetSpec{
+					Releases: []ReleaseSpec{
+						{
+							Name:  "first",
+							Chart: "stable/foo",
+						},
+						{
+							Name:  "second",
+							Chart: "stable/bar",
+						},
+					},
+				},
+				logger:         logger,
+				valsRuntime:    valsRuntime,
+				RenderedValues: map[string]interface{}{},
+			}
+
+			// Every diff fails as no diff is expected
+			helm := &exectest.Helm{
+				FailOnUnexpectedDiff: true,
+				Helm3:                true,
+			}
+
+			_, errs := state.DiffReleases(helm, []string{}, 1, false, false, []string{}, false, false, false, false, &DiffOpts{FailFast: tt.failFast})
+			if len(errs) != len(tt.wantDiffed) {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+
+			var diffed []string
+			for _, r := range helm.Diffed {
+				diffed = append(diffed, r.Name)
+			}
+
+			if d := cmp.Diff(tt.wantDiffed, diffed); d != "" {
+				t.Errorf("unexpected releases diffed: want (-), got (+):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestHelmState_DiffReleases_SkipDiffOnInstall(t *testing.T) {
+	tests := []struct {
+		name              string
+		skipDiffOnInstall bool
+		wantDiffed        []string
+		wantChanged       []string
+	}{
+		{
+			name:        "release-level only",
+			wantDiffed:  []string{"diffed"},
+			wantChanged: []string{"skipped"},
+		},
+		{
+			name:              "global flag forces it on for all the releases",
+			skipDiffOnInstall: true,
+			wantChanged:       []string{"diffed", "skipped"},
+		},
+	}
+
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			state := &HelmState{
+				ReleaseSetSpec: ReleaseSetSpec{
+					Releases: []ReleaseSpec{
+						{
+							Name:  "diffed",
+							Chart: "stable/foo",
+						},
+						{
+							Name:              "skipped",
+							Chart:             "stable/huge",
+							SkipDiffOnInstall: boolValue(true),
+						},
+					},
+				},
+				logger:         logger,
+				valsRuntime:    valsRuntime,
+				RenderedValues: map[string]interface{}{},
+			}
+
+			// Both releases are newly installed, as helm list returns nothing for them
+			helm := &exectest.Helm{
+				Lists: map[exectest.ListKey]string{},
+				Diffs: map[exectest.DiffKey]error{
+					{Name: "diffed", Chart: "stable/foo", Flags: "--reset-values"}: nil,
+				},
+				Helm3: true,
+			}
+
+			// The releases to be installed without diffs are reported as changed with the exit code 2
+			changed, errs := state.DiffReleases(helm, []string{}, 1, false, false, []string{}, false, false, false, false, &DiffOpts{SkipDiffOnInstall: tt.skipDiffOnInstall})
+			for _, err := range errs {
+				if relErr, ok := err.(*ReleaseError); !ok || relErr.Code != 2 {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+
+			var diffed []string
+			for _, r := range helm.Diffed {
+				diffed = append(diffed, r.Name)
+			}
+
+			if d := cmp.Diff(tt.wantDiffed, diffed); d != "" {
+				t.Errorf("unexpected releases diffed: want (-), got (+):\n%s", d)
+			}
+
+			var names []string
+			for _, r := range changed {
+				names = append(names, r.Name)
+			}
+			sort.Strings(names)
+
+			if d := cmp.Diff(tt.wantChanged, names); d != "" {
+				t.Errorf("unexpected releases to be installed: want (-), got (+):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestHelmState_DiffReleases_ServerSideDiff(t *testing.T) {
+	tests := []struct {
+		name              string
+		defaults          HelmSpec
+		serverSideDiff    *bool
+		opts              *DiffOpts
+		helmVersion       string
+		diffPluginVersion string
+		wantFlags         []string
+	}{
+		{
+			name:              "disabled",
+			helmVersion:       "3.13.0",
+			diffPluginVersion: "3.9.0",
+			wantFlags:         []string{},
+		},
+		{
+			name:              "enabled on release",
+			serverSideDiff:    boolValue(true),
+			helmVersion:       "3.13.0",
+			diffPluginVersion: "3.9.0",
+			wantFlags:         []string{"--dry-run=server"},
+		},
+		{
+			name:              "enabled in helmDefaults",
+			defaults:          HelmSpec{ServerSideDiff: true},
+			helmVersion:       "3.14.2",
+			diffPluginVersion: "3.9.4",
+			wantFlags:         []string{"--dry-run=server"},
+		},
+		{
+			name:              "disabled on release overriding helmDefaults",
+			defaults:          HelmSpec{ServerSideDiff: true},
+			serverSideDiff:    boolValue(false),
+			helmVersion:       "3.13.0",
+			diffPluginVersion: "3.9.0",
+			wantFlags:         []string{},
+		},
+		{
+			name:              "enabled by the option overriding release",
+			serverSideDiff:    boolValue(false),
+			opts:              &DiffOpts{ServerSideDiff: true},
+			helmVersion:       "3.13.0",
+			diffPluginVersion: "3.9.0",
+			wantFlags:         []string{"--dry-run=server"},
+		},
+		{
+			name:              "helm too old",
+			serverSideDiff:    boolValue(true),
+			helmVersion:       "3.12.3",
+			diffPluginVersion: "3.9.0",
+			wantFlags:         []string{},
+		},
+		{
+			name:              "helm-diff too old",
+			serverSideDiff:    boolValue(true),
+			helmVersion:       "3.13.0",
+			diffPluginVersion: "3.8.1",
+			wantFlags:         []string{},
+		},
+		{
+			name:           "helm-diff version unknown",
+			serverSideDiff: boolValue(true),
+			helmVersion:    "3.13.0",
+			wantFlags:      []string{},
+		},
+	}
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			state := &HelmState{
+				ReleaseSetSpec: ReleaseSetSpec{
+					HelmDefaults: tt.defaults,
+					Releases: []ReleaseSpec{
+						{
+							Name:           "releaseName",
+							Chart:          "foo",
+							ServerSideDiff: tt.serverSideDiff,
+						},
+					},
+				},
+				logger:         logger,
+				valsRuntime:    valsRuntime,
+				RenderedValues: map[string]interface{}{},
+			}
+
+			helm := &exectest.Helm{
+				Helm3:   true,
+				Version: semver.MustParse(tt.helmVersion),
+				Lists:   map[exectest.ListKey]string{},
+			}
+			if tt.diffPluginVersion != "" {
+				helm.DiffPluginVersion = semver.MustParse(tt.diffPluginVersion)
+			}
+
+			var opts []DiffOpt
+			if tt.opts != nil {
+				opts = append(opts, tt.opts)
+			}
+
+			_, errs := state.DiffReleases(helm, []string{}, 1, false, false, []string{}, false, false, false, false, opts...)
 			if len(errs) > 0 {
-				t.Errorf("unexpected error: %v", errs)
+				t.Fatalf("unexpected error: %v", errs)
 			}
-			if !reflect.DeepEqual(tt.helm.Diffed, tt.wantReleases) {
-				t.Errorf("HelmState.DiffReleases() for [%s] = %v, want %v", tt.name, tt.helm.Releases, tt.wantReleases)
+
+			want := []exectest.Release{{Name: "releaseName", Flags: tt.wantFlags}}
+			if !reflect.DeepEqual(helm.Diffed, want) {
+				t.Errorf("unexpected diffs: got %v, want %v", helm.Diffed, want)
 			}
 		})
 	}
@@ -2113,6 +3223,102 @@ func TestHelmState_TestReleasesNoCleanUp(t *testing.T) {
 	}
 }
 
+func TestHelmState_TestReleasesFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		helm    *exectest.Helm
+		timeout int
+		options []TestOption
+		want    []string
+		wantErr string
+	}{
+		{
+			name:    "logs and timeout",
+			helm:    &exectest.Helm{Helm3: true, Version: semver.MustParse("3.6.0")},
+			timeout: 60,
+			options: []TestOption{Logs(true)},
+			want:    []string{"--namespace", "myns", "--logs", "--timeout", "60s"},
+		},
+		{
+			name:    "filter with logs and timeout",
+			helm:    &exectest.Helm{Helm3: true, Version: semver.MustParse("3.6.0")},
+			timeout: 60,
+			options: []TestOption{Logs(true), Filter("mytest")},
+			want:    []string{"--namespace", "myns", "--logs", "--filter", "name=mytest", "--timeout", "60s"},
+		},
+		{
+			name:    "filter with the release timeout",
+			helm:    &exectest.Helm{Helm3: true, Version: semver.MustParse("3.7.1")},
+			timeout: EmptyTimeout,
+			options: []TestOption{Filter("mytest")},
+			want:    []string{"--namespace", "myns", "--filter", "name=mytest", "--timeout", "120s"},
+		},
+		{
+			name:    "filter on old helm 3",
+			helm:    &exectest.Helm{Helm3: true, Version: semver.MustParse("3.5.4")},
+			timeout: 60,
+			options: []TestOption{Filter("mytest")},
+			wantErr: "--filter requires helm 3.6.0 or greater",
+		},
+		{
+			name:    "filter on helm 2",
+			helm:    &exectest.Helm{Version: semver.MustParse("2.17.0")},
+			timeout: 60,
+			options: []TestOption{Filter("mytest")},
+			wantErr: "--filter requires helm 3.6.0 or greater",
+		},
+		{
+			name:    "parallel on helm 2",
+			helm:    &exectest.Helm{Version: semver.MustParse("2.17.0")},
+			timeout: 60,
+			options: []TestOption{Logs(true), Parallel(true)},
+			want:    []string{"--logs", "--parallel", "--timeout", "60"},
+		},
+		{
+			name:    "parallel on helm 3",
+			helm:    &exectest.Helm{Helm3: true, Version: semver.MustParse("3.6.0")},
+			timeout: 60,
+			options: []TestOption{Parallel(true)},
+			wantErr: "--parallel is not supported by helm 3. Use --concurrency to test multiple releases concurrently instead",
+		},
+	}
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			releaseTimeout := Duration(120)
+			state := &HelmState{
+				ReleaseSetSpec: ReleaseSetSpec{
+					Releases: []ReleaseSpec{
+						{
+							Name:      "releaseA",
+							Namespace: "myns",
+							Timeout:   &releaseTimeout,
+						},
+					},
+				},
+				logger: logger,
+			}
+			errs := state.TestReleases(tt.helm, false, tt.timeout, 1, tt.options...)
+			if tt.wantErr != "" {
+				if len(errs) != 1 || errs[0].Error() != tt.wantErr {
+					t.Fatalf("unexpected errors: want %q, got %v", tt.wantErr, errs)
+				}
+				if len(tt.helm.Releases) != 0 {
+					t.Errorf("unexpected tests run: %v", tt.helm.Releases)
+				}
+				return
+			}
+			if len(errs) > 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			want := []exectest.Release{{Name: "releaseA", Flags: tt.want}}
+			if !reflect.DeepEqual(tt.helm.Releases, want) {
+				t.Errorf("HelmState.TestReleases() = %v, want %v", tt.helm.Releases, want)
+			}
+		})
+	}
+}
+
 func TestHelmState_NoReleaseMatched(t *testing.T) {
 	releases := []ReleaseSpec{
 		{
@@ -2377,3 +3583,467 @@ func TestReverse(t *testing.T) {
 		}
 	}
 }
+
+func TestFilterOutputLines(t *testing.T) {
+	output := `default, myapp, ConfigMap (v1) has changed:
+  # Source: myapp/templates/configmap.yaml
+  apiVersion: v1
+  kind: ConfigMap
+-   foo: bar
++   foo: baz
+  # Source: myapp/templates/secret.yaml
+`
+
+	regexps, err := compileRegexps([]string{`^\s*# Source:`})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := `default, myapp, ConfigMap (v1) has changed:
+  apiVersion: v1
+  kind: ConfigMap
+-   foo: bar
++   foo: baz
+`
+
+	if got := filterOutputLines(output, regexps); got != want {
+		t.Errorf("unexpected output: want:\n%s\ngot:\n%s", want, got)
+	}
+
+	if got := filterOutputLines(output, nil); got != output {
+		t.Errorf("unexpected output without regexps: want:\n%s\ngot:\n%s", output, got)
+	}
+
+	if _, err := compileRegexps([]string{`(`}); err == nil {
+		t.Errorf("expected error not returned for the invalid regex")
+	}
+}
+
+func TestHelmState_TriggerPresyncEvent_TemplatedArgs(t *testing.T) {
+	runner := &adoptTestRunner{}
+
+	st := &HelmState{
+		basePath: "/path/to",
+		FilePath: "/path/to/helmfile.yaml",
+		ReleaseSetSpec: ReleaseSetSpec{
+			HelmDefaults: HelmSpec{KubeContext: "default-context"},
+			Env:          environment.Environment{Name: "prod"},
+		},
+		RenderedValues: map[string]interface{}{"region": "us-east-1"},
+		logger:         logger,
+		runner:         runner,
+	}
+
+	release := &ReleaseSpec{
+		Name:      "myapp",
+		Namespace: "myns",
+		Hooks: []event.Hook{
+			{
+				Name:    "{{ .Release.Name }}-wait",
+				Events:  []string{"presync"},
+				Command: "{{ .Values.region | printf \"./%s/wait.sh\" }}",
+				Args: []string{
+					"{{ .Release.Namespace }}",
+					"{{ .Namespace }}",
+					"{{ .KubeContext }}",
+					"{{ .StateValues.region }}",
+					"{{ .Environment.Name }}",
+					"{{ .HelmfileCommand }}",
+					`{{ "{{" }} .NotRendered }}`,
+				},
+			},
+		},
+	}
+
+	executed, err := st.triggerPresyncEvent(release, "sync")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !executed {
+		t.Fatal("the presync hook wasn't executed")
+	}
+
+	want := []string{"./us-east-1/wait.sh myns myns default-context us-east-1 prod sync {{ .NotRendered }}"}
+	if d := cmp.Diff(want, runner.commands); d != "" {
+		t.Errorf("unexpected commands: want (-), got (+):\n%s", d)
+	}
+}
+
+func TestHelmState_NoHooks(t *testing.T) {
+	runner := &adoptTestRunner{}
+
+	release := &ReleaseSpec{
+		Chart:     "test/chart",
+		Name:      "test-charts",
+		Namespace: "test-namespace",
+		Hooks: []event.Hook{
+			{
+				Name:    "wait",
+				Events:  []string{"prepare", "presync"},
+				Command: "./wait.sh",
+			},
+		},
+	}
+
+	st := &HelmState{
+		basePath: "/path/to",
+		FilePath: "/path/to/helmfile.yaml",
+		ReleaseSetSpec: ReleaseSetSpec{
+			Releases: []ReleaseSpec{*release},
+			Hooks: []event.Hook{
+				{
+					Name:    "global",
+					Events:  []string{"prepare"},
+					Command: "./global.sh",
+				},
+			},
+			NoHooks: true,
+		},
+		RenderedValues: map[string]interface{}{},
+		logger:         logger,
+		runner:         runner,
+		valsRuntime:    valsRuntime,
+	}
+
+	executed, err := st.triggerPresyncEvent(release, "sync")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if executed {
+		t.Error("the presync hook was executed")
+	}
+
+	executed, err = st.TriggerGlobalPrepareEvent("sync")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if executed {
+		t.Error("the global prepare hook was executed")
+	}
+
+	if len(runner.commands) > 0 {
+		t.Errorf("unexpected commands: %v", runner.commands)
+	}
+
+	helm := &exectest.Helm{
+		Helm3:   true,
+		Version: semver.MustParse("3.7.0"),
+	}
+
+	upgrade, _, err := st.flagsForUpgrade(helm, release, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	diff, _, err := st.flagsForDiff(helm, release, false, false, nil, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	template, _, err := st.flagsForTemplate(helm, release, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for cmd, flags := range map[string][]string{"upgrade": upgrade, "diff": diff, "template": template} {
+		if !hasFlag(flags, "--no-hooks") {
+			t.Errorf("--no-hooks is missing in the flags for %s: %v", cmd, flags)
+		}
+	}
+}
+
+func TestHelmState_flagsForDiff_CRDs(t *testing.T) {
+	enable := true
+	disable := false
+
+	tests := []struct {
+		name        string
+		includeCRDs *bool
+		want        []string
+	}{
+		{
+			name: "default",
+			want: []string{
+				"--version", "0.1",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name:        "include-crds",
+			includeCRDs: &enable,
+			want: []string{
+				"--version", "0.1",
+				"--include-crds",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name:        "skip-crds",
+			includeCRDs: &disable,
+			want: []string{
+				"--version", "0.1",
+				"--skip-crds",
+				"--namespace", "test-namespace",
+			},
+		},
+	}
+
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			release := &ReleaseSpec{
+				Chart:     "test/chart",
+				Version:   "0.1",
+				Name:      "test-charts",
+				Namespace: "test-namespace",
+			}
+
+			st := &HelmState{
+				basePath: "./",
+				ReleaseSetSpec: ReleaseSetSpec{
+					Releases: []ReleaseSpec{*release},
+				},
+				logger:      logger,
+				valsRuntime: valsRuntime,
+			}
+
+			args, _, err := st.flagsForDiff(&exectest.Helm{}, release, false, false, tt.includeCRDs, 0)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if d := cmp.Diff(tt.want, args); d != "" {
+				t.Errorf("unexpected flags: want (-), got (+):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestHelmState_WriteReleasesValues_Set(t *testing.T) {
+	dir := t.TempDir()
+
+	state := &HelmState{
+		basePath: dir,
+		FilePath: filepath.Join(dir, "helmfile.yaml"),
+		ReleaseSetSpec: ReleaseSetSpec{
+			Releases: []ReleaseSpec{
+				{
+					Name:  "foo",
+					Chart: "stable/foo",
+					Values: []interface{}{
+						map[string]interface{}{
+							"list": []interface{}{
+								map[string]interface{}{"foo": "a", "bar": "b"},
+								map[string]interface{}{"foo": "c"},
+							},
+							"map": map[string]interface{}{"x": 1, "y": 2},
+						},
+					},
+					SetValues: []SetValue{
+						{Name: "map.x", Value: "3"},
+					},
+					SetStringValues: []SetValue{
+						{Name: "map.z", Value: "true"},
+					},
+				},
+			},
+		},
+		logger:         logger,
+		readFile:       ioutil.ReadFile,
+		removeFile:     os.Remove,
+		glob:           filepath.Glob,
+		valsRuntime:    valsRuntime,
+		RenderedValues: map[string]interface{}{},
+	}
+
+	opts := &WriteValuesOpts{
+		Set:                []string{"list[0].foo=bar", "list[2]=d", "enabled=true"},
+		OutputFileTemplate: filepath.Join(dir, "{{ .Release.Name }}.yaml"),
+	}
+
+	if errs := state.WriteReleasesValues(&exectest.Helm{}, nil, opts); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	bs, err := ioutil.ReadFile(filepath.Join(dir, "foo.yaml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The item at the index of the existing list is replaced field by field, and the rest of the list is kept as is
+	want := `enabled: true
+list:
+- bar: b
+  foo: bar
+- foo: c
+- d
+map:
+  x: 3
+  "y": 2
+  z: "true"
+`
+	if d := cmp.Diff(want, string(bs)); d != "" {
+		t.Errorf("unexpected values: want (-), got (+):\n%s", d)
+	}
+}
+
+func TestHelmState_WriteReleasesValues_MergeValuesStrategy(t *testing.T) {
+	tests := []struct {
+		strategy   string
+		want       string
+		wantValues int
+		wantErr    string
+	}{
+		{
+			strategy: "",
+			want: `list:
+- c
+map:
+  nested:
+    x: 1
+    "y": 3
+  z: 4
+`,
+			wantValues: 2,
+		},
+		{
+			strategy: "deep",
+			want: `list:
+- c
+map:
+  nested:
+    x: 1
+    "y": 3
+  z: 4
+`,
+			wantValues: 2,
+		},
+		{
+			strategy: "override",
+			want: `list:
+- c
+map:
+  nested:
+    "y": 3
+`,
+			wantValues: 1,
+		},
+		{
+			strategy: "append-arrays",
+			want: `list:
+- a
+- b
+- c
+map:
+  nested:
+    x: 1
+    "y": 3
+  z: 4
+`,
+			wantValues: 1,
+		},
+		{
+			strategy: "replace",
+			wantErr:  `unsupported merge values strategy "replace": it must be one of deep, override, or append-arrays`,
+		},
+	}
+
+	for i := range tests {
+		tt := tests[i]
+
+		t.Run(tt.strategy, func(t *testing.T) {
+			dir := t.TempDir()
+
+			state := &HelmState{
+				basePath: dir,
+				FilePath: filepath.Join(dir, "helmfile.yaml"),
+				ReleaseSetSpec: ReleaseSetSpec{
+					MergeValuesStrategy: tt.strategy,
+					Releases: []ReleaseSpec{
+						{
+							Name:  "foo",
+							Chart: "stable/foo",
+							Values: []interface{}{
+								map[string]interface{}{
+									"list": []interface{}{"a", "b"},
+									"map": map[string]interface{}{
+										"nested": map[string]interface{}{"x": 1, "y": 2},
+										"z":      4,
+									},
+								},
+								map[string]interface{}{
+									"list": []interface{}{"c"},
+									"map": map[string]interface{}{
+										"nested": map[string]interface{}{"y": 3},
+									},
+								},
+							},
+						},
+					},
+				},
+				logger:         logger,
+				readFile:       ioutil.ReadFile,
+				removeFile:     os.Remove,
+				glob:           filepath.Glob,
+				valsRuntime:    valsRuntime,
+				RenderedValues: map[string]interface{}{},
+			}
+
+			opts := &WriteValuesOpts{
+				OutputFileTemplate: filepath.Join(dir, "{{ .Release.Name }}.yaml"),
+			}
+
+			errs := state.WriteReleasesValues(&exectest.Helm{}, nil, opts)
+			if tt.wantErr != "" {
+				if len(errs) != 1 || !strings.Contains(errs[0].Error(), tt.wantErr) {
+					t.Fatalf("unexpected errors: want %q, got %v", tt.wantErr, errs)
+				}
+				return
+			}
+			if len(errs) > 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+
+			bs, err := ioutil.ReadFile(filepath.Join(dir, "foo.yaml"))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if d := cmp.Diff(tt.want, string(bs)); d != "" {
+				t.Errorf("unexpected values: want (-), got (+):\n%s", d)
+			}
+
+			// helm is given the values merged the same way, unless helm merges them the same way by itself
+			flags, files, err := state.namespaceAndValuesFlags(&exectest.Helm{}, &state.Releases[0], 0)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer state.removeFiles(files)
+
+			var valuesFiles []string
+			for i := range flags {
+				if flags[i] == "--values" {
+					valuesFiles = append(valuesFiles, flags[i+1])
+				}
+			}
+
+			if len(valuesFiles) != tt.wantValues {
+				t.Fatalf("unexpected number of values files: want %d, got %v", tt.wantValues, valuesFiles)
+			}
+
+			merged, err := state.mergeValuesFiles(valuesFiles)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got, err := yaml.Marshal(merged)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if d := cmp.Diff(tt.want, string(got)); d != "" {
+				t.Errorf("unexpected values given to helm: want (-), got (+):\n%s", d)
+			}
+		})
+	}
+}
@@ -35,6 +35,20 @@ func (st *Storage) resolveFile(missingFileHandler *string, tpe, path string) ([]
 		return nil, false, err
 	}
 
+	if len(files) == 0 {
+		skip, err := st.handleMissingFile(missingFileHandler, path,
+			fmt.Errorf("%s matching \"%s\" does not exist in \"%s\"", title, path, st.basePath),
+			fmt.Sprintf("skipping missing %s matching \"%s\"", title, path),
+		)
+		return nil, skip, err
+	}
+
+	return files, false, nil
+}
+
+// handleMissingFile either returns notFound or logs skipping according to the missingFileHandler.
+// It returns true when the missing file should be skipped.
+func (st *Storage) handleMissingFile(missingFileHandler *string, path string, notFound error, skipping string) (bool, error) {
 	var handlerId string
 
 	if missingFileHandler != nil {
@@ -43,31 +57,27 @@ func (st *Storage) resolveFile(missingFileHandler *string, tpe, path string) ([]
 		handlerId = MissingFileHandlerError
 	}
 
-	if len(files) == 0 {
-		switch handlerId {
-		case MissingFileHandlerError:
-			return nil, false, fmt.Errorf("%s matching \"%s\" does not exist in \"%s\"", title, path, st.basePath)
-		case MissingFileHandlerWarn:
-			st.logger.Warnf("skipping missing %s matching \"%s\"", title, path)
-			return nil, true, nil
-		case MissingFileHandlerInfo:
-			st.logger.Infof("skipping missing %s matching \"%s\"", title, path)
-			return nil, true, nil
-		case MissingFileHandlerDebug:
-			st.logger.Debugf("skipping missing %s matching \"%s\"", title, path)
-			return nil, true, nil
-		default:
-			available := []string{
-				MissingFileHandlerError,
-				MissingFileHandlerWarn,
-				MissingFileHandlerInfo,
-				MissingFileHandlerDebug,
-			}
-			return nil, false, fmt.Errorf("invalid missing file handler \"%s\" while processing \"%s\" in \"%s\": it must be one of %s", handlerId, path, st.FilePath, available)
+	switch handlerId {
+	case MissingFileHandlerError:
+		return false, notFound
+	case MissingFileHandlerWarn:
+		st.logger.Warnf(skipping)
+		return true, nil
+	case MissingFileHandlerInfo:
+		st.logger.Infof(skipping)
+		return true, nil
+	case MissingFileHandlerDebug:
+		st.logger.Debugf(skipping)
+		return true, nil
+	default:
+		available := []string{
+			MissingFileHandlerError,
+			MissingFileHandlerWarn,
+			MissingFileHandlerInfo,
+			MissingFileHandlerDebug,
 		}
+		return false, fmt.Errorf("invalid missing file handler \"%s\" while processing \"%s\" in \"%s\": it must be one of %s", handlerId, path, st.FilePath, available)
 	}
-
-	return files, false, nil
 }
 
 func (st *Storage) ExpandPaths(globPattern string) ([]string, error) {
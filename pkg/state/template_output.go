@@ -0,0 +1,111 @@
+package state
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// writeCombinedManifests concatenates all the manifests written by `helm template --output-dir` under dir into the single file,
+// separating each document by `---`.
+//
+// CRDs written by `--include-crds` come first so that the file can be applied as-is.
+// Hidden files and helper partials whose names start with `_` are skipped.
+func writeCombinedManifests(dir, file string) error {
+	var crds, manifests []string
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name := info.Name()
+
+		if info.IsDir() {
+			if path != dir && strings.HasPrefix(name, ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
+			return nil
+		}
+
+		switch filepath.Ext(name) {
+		case ".yaml", ".yml":
+		default:
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		if isCRDManifestPath(rel) {
+			crds = append(crds, path)
+		} else {
+			manifests = append(manifests, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(crds)
+	sort.Strings(manifests)
+
+	buf := &bytes.Buffer{}
+
+	for _, path := range append(crds, manifests...) {
+		bs, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		content := strings.TrimSpace(string(bs))
+		content = strings.TrimPrefix(content, "---")
+		content = strings.TrimSpace(content)
+
+		if content == "" {
+			continue
+		}
+
+		buf.WriteString("---\n")
+		buf.WriteString(content)
+		buf.WriteString("\n")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, buf.Bytes(), 0644)
+}
+
+// isCRDManifestPath returns true when the path relative to the helm output directory is under the `crds` directory of a chart
+func isCRDManifestPath(rel string) bool {
+	for _, c := range strings.Split(filepath.ToSlash(rel), "/") {
+		if c == "crds" {
+			return true
+		}
+	}
+	return false
+}
+
+func (st *HelmState) writeCombinedReleaseManifests(release *ReleaseSpec, dir, outputFileTemplate string) error {
+	outputFile, err := st.GenerateOutputFilePath(release, outputFileTemplate)
+	if err != nil {
+		return err
+	}
+
+	st.logger.Debugf("Writing the combined manifests of release %q to: %s\n", release.Name, outputFile)
+
+	return writeCombinedManifests(dir, outputFile)
+}
@@ -0,0 +1,66 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWriteCombinedManifests(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"mychart/templates/service.yaml":              "---\n# Source: mychart/templates/service.yaml\nkind: Service\n",
+		"mychart/templates/deployment.yaml":           "---\n# Source: mychart/templates/deployment.yaml\nkind: Deployment\n---\n# Source: mychart/templates/deployment.yaml\nkind: ConfigMap\n",
+		"mychart/templates/empty.yaml":                "---\n",
+		"mychart/templates/_helpers.yaml":             "kind: Helper\n",
+		"mychart/templates/.hidden.yaml":              "kind: Hidden\n",
+		"mychart/crds/crd.yaml":                       "kind: CustomResourceDefinition\n",
+		"mychart/charts/sub/templates/configmap.yaml": "---\n# Source: mychart/charts/sub/templates/configmap.yaml\nkind: ConfigMap\n",
+		"mychart/charts/sub/templates/NOTES.txt":      "notes",
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := filepath.Join(t.TempDir(), "out", "myrelease.yaml")
+
+	if err := writeCombinedManifests(dir, out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `---
+kind: CustomResourceDefinition
+---
+# Source: mychart/charts/sub/templates/configmap.yaml
+kind: ConfigMap
+---
+# Source: mychart/templates/deployment.yaml
+kind: Deployment
+---
+# Source: mychart/templates/deployment.yaml
+kind: ConfigMap
+---
+# Source: mychart/templates/service.yaml
+kind: Service
+`
+
+	if d := cmp.Diff(want, string(got)); d != "" {
+		t.Errorf("unexpected combined manifests: want (-), got (+):\n%s", d)
+	}
+}
@@ -0,0 +1,121 @@
+package state
+
+import (
+	"sync"
+	"time"
+)
+
+// The phases of a helmfile run recorded by Timings
+const (
+	TimingPhaseRepos   = "repos"
+	TimingPhasePrepare = "prepare"
+	TimingPhaseDiff    = "diff"
+	TimingPhaseSync    = "sync"
+	TimingPhaseHooks   = "hooks"
+)
+
+// Timings records the wall-clock time spent in each phase of a helmfile run, and in each release within the phase.
+//
+// A nil *Timings records nothing, so that the instrumentation costs next to nothing unless it is enabled with --timings.
+type Timings struct {
+	mu sync.Mutex
+
+	phases []*PhaseTiming
+}
+
+// PhaseTiming is the time spent in a phase, summed over all the runs of the phase, like the diffs of multiple state files.
+type PhaseTiming struct {
+	Phase    string          `json:"phase"`
+	Duration time.Duration   `json:"-"`
+	Seconds  float64         `json:"seconds"`
+	Releases []ReleaseTiming `json:"releases,omitempty"`
+}
+
+// ReleaseTiming is the time spent for a release within a phase
+type ReleaseTiming struct {
+	ID       string        `json:"id"`
+	Duration time.Duration `json:"-"`
+	Seconds  float64       `json:"seconds"`
+}
+
+func NewTimings() *Timings {
+	return &Timings{}
+}
+
+// Track starts measuring the phase, and returns the function to stop it.
+func (t *Timings) Track(phase string) func() {
+	if t == nil {
+		return func() {}
+	}
+
+	start := time.Now()
+
+	return func() {
+		t.add(phase, "", time.Since(start))
+	}
+}
+
+// TrackRelease starts measuring the release within the phase, and returns the function to stop it.
+// The time is recorded only for the release. Use Track to record the time of the phase as a whole.
+func (t *Timings) TrackRelease(phase, id string) func() {
+	if t == nil {
+		return func() {}
+	}
+
+	start := time.Now()
+
+	return func() {
+		t.add(phase, id, time.Since(start))
+	}
+}
+
+func (t *Timings) add(phase, id string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var p *PhaseTiming
+	for _, pt := range t.phases {
+		if pt.Phase == phase {
+			p = pt
+			break
+		}
+	}
+	if p == nil {
+		p = &PhaseTiming{Phase: phase}
+		t.phases = append(t.phases, p)
+	}
+
+	if id == "" {
+		p.Duration += d
+		p.Seconds = p.Duration.Seconds()
+		return
+	}
+
+	for i := range p.Releases {
+		if p.Releases[i].ID == id {
+			p.Releases[i].Duration += d
+			p.Releases[i].Seconds = p.Releases[i].Duration.Seconds()
+			return
+		}
+	}
+
+	p.Releases = append(p.Releases, ReleaseTiming{ID: id, Duration: d, Seconds: d.Seconds()})
+}
+
+// Phases returns the recorded phases in the order they were first recorded
+func (t *Timings) Phases() []PhaseTiming {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	phases := make([]PhaseTiming, len(t.phases))
+	for i, p := range t.phases {
+		phases[i] = *p
+		phases[i].Releases = append([]ReleaseTiming(nil), p.Releases...)
+	}
+
+	return phases
+}
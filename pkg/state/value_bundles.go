@@ -0,0 +1,44 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+)
+
+// valueBundleRefPrefix is the prefix of the entries of `valuesFrom` like `@shared/common-values`, which reference the value bundles by name
+const valueBundleRefPrefix = "@"
+
+// ExpandValuesFrom prepends the values entries of the value bundles referenced by the `valuesFrom` of each release to its `values`,
+// in the order of the references, so that the release-specific values override the ones of the bundles.
+// valuesFrom is cleared once expanded, so that the state can be expanded more than once.
+func (st *HelmState) ExpandValuesFrom() error {
+	for i := range st.Releases {
+		release := &st.Releases[i]
+
+		if len(release.ValuesFrom) == 0 {
+			continue
+		}
+
+		var values []interface{}
+
+		for _, ref := range release.ValuesFrom {
+			if !strings.HasPrefix(ref, valueBundleRefPrefix) {
+				return fmt.Errorf("%s: valuesFrom entry %q of release %q must reference a value bundle like %s<name>", st.FilePath, ref, release.Name, valueBundleRefPrefix)
+			}
+
+			name := strings.TrimPrefix(ref, valueBundleRefPrefix)
+
+			bundle, ok := st.ValueBundles[name]
+			if !ok {
+				return fmt.Errorf("%s: valuesFrom entry %q of release %q references the value bundle %q, which is not defined in valueBundles", st.FilePath, ref, release.Name, name)
+			}
+
+			values = append(values, bundle...)
+		}
+
+		release.Values = append(values, release.Values...)
+		release.ValuesFrom = nil
+	}
+
+	return nil
+}
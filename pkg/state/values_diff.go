@@ -0,0 +1,323 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+	"github.com/roboll/helmfile/pkg/maputil"
+	"github.com/roboll/helmfile/pkg/tmpl"
+	"gopkg.in/yaml.v2"
+)
+
+const redactedValue = "<redacted>"
+
+type valuesChange struct {
+	key     string
+	oldVal  interface{}
+	newVal  interface{}
+	removed bool
+	added   bool
+}
+
+// diffReleaseValues compares the merged values helmfile would pass to `helm upgrade` for the release
+// against the user-supplied values of the deployed release obtained via `helm get values`,
+// and writes the differences to w in the `namespace, name` header style of helm-diff.
+// It returns true when any difference has been found, including when the release is not installed yet.
+func (st *HelmState) diffReleaseValues(helm helmexec.Interface, release *ReleaseSpec, additionalValues, set []string, suppressSecrets bool, workerIndex int, w io.Writer) (bool, error) {
+	vanillaFiles, err := st.generateVanillaValuesFiles(release)
+	if err != nil {
+		return false, err
+	}
+	defer st.removeFiles(vanillaFiles)
+
+	secretFiles, err := st.generateSecretValuesFiles(helm, release, workerIndex)
+	if err != nil {
+		return false, err
+	}
+	defer st.removeFiles(secretFiles)
+
+	strategy, err := st.mergeValuesStrategy()
+	if err != nil {
+		return false, err
+	}
+
+	desired, err := st.mergeValuesFilesWithStrategy(append(append([]string{}, vanillaFiles...), secretFiles...), strategy)
+	if err != nil {
+		return false, err
+	}
+
+	// The additional values files are given to helm as separate --values flags, which helm deep-merges
+	additional, err := st.mergeValuesFiles(additionalValues)
+	if err != nil {
+		return false, err
+	}
+
+	if err := mergeValues(desired, additional, MergeValuesStrategyDeep); err != nil {
+		return false, err
+	}
+
+	// helm get values returns the values given with --set as well, which would otherwise be shown as removed
+	desired, err = st.applySetValues(desired, release, set)
+	if err != nil {
+		return false, err
+	}
+
+	sensitive := map[string]struct{}{}
+	if suppressSecrets {
+		secrets, err := st.mergeValuesFiles(secretFiles)
+		if err != nil {
+			return false, err
+		}
+		for k := range flattenValues(secrets) {
+			sensitive[k] = struct{}{}
+		}
+
+		refs, err := st.valsRefKeys(release)
+		if err != nil {
+			return false, err
+		}
+		for k := range refs {
+			sensitive[k] = struct{}{}
+		}
+	}
+
+	namespace := release.Namespace
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	context := st.createHelmContext(release, workerIndex)
+
+	installed, err := st.isReleaseInstalled(context, helm, *release)
+	if err != nil {
+		return false, err
+	}
+
+	if !installed {
+		fmt.Fprintf(w, "%s, %s, values has been added (new release):\n", namespace, release.Name)
+		writeValuesChanges(w, diffValues(nil, desired), sensitive)
+		return true, nil
+	}
+
+	flags := st.connectionFlags(helm, release)
+	if helm.IsHelm3() && release.Namespace != "" {
+		flags = append(flags, "--namespace", release.Namespace)
+	}
+
+	out, err := helm.GetValues(context, release.Name, flags...)
+	if err != nil {
+		return false, err
+	}
+
+	deployed := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(out), &deployed); err != nil {
+		return false, fmt.Errorf("unmarshalling values of the deployed release %s: %w", release.Name, err)
+	}
+
+	changes := diffValues(deployed, desired)
+	if len(changes) == 0 {
+		return false, nil
+	}
+
+	fmt.Fprintf(w, "%s, %s, values has changed:\n", namespace, release.Name)
+	writeValuesChanges(w, changes, sensitive)
+
+	return true, nil
+}
+
+// valsRefKeys returns the flattened keys of the release values that are resolved from vals references like `ref+vault://...`.
+func (st *HelmState) valsRefKeys(release *ReleaseSpec) (map[string]struct{}, error) {
+	keys := map[string]struct{}{}
+
+	for _, v := range release.Values {
+		var raw interface{}
+
+		switch typedValue := v.(type) {
+		case string:
+			path := st.storage().normalizePath(release.ValuesPathPrefix + typedValue)
+			paths, skip, err := st.storage().resolveFile(release.MissingFileHandler, "values", path)
+			if err != nil {
+				return nil, err
+			}
+			if skip || len(paths) != 1 {
+				continue
+			}
+
+			r := tmpl.NewFileRenderer(st.readFile, filepath.Dir(paths[0]), st.newReleaseTemplateData(release))
+			bs, err := r.RenderToBytes(paths[0])
+			if err != nil {
+				return nil, err
+			}
+
+			m := map[string]interface{}{}
+			if err := yaml.Unmarshal(bs, &m); err != nil {
+				return nil, err
+			}
+			raw = m
+		default:
+			raw = typedValue
+		}
+
+		for k, v := range flattenValues(raw) {
+			if s, ok := v.(string); ok && strings.HasPrefix(s, "ref+") {
+				keys[k] = struct{}{}
+			}
+		}
+	}
+
+	return keys, nil
+}
+
+// flattenValues flattens nested maps into a map keyed by dot-separated paths.
+// Non-map values, including lists and empty maps, are kept as leaves.
+func flattenValues(v interface{}) map[string]interface{} {
+	flat := map[string]interface{}{}
+	flattenValuesInto(flat, "", v)
+	return flat
+}
+
+func flattenValuesInto(flat map[string]interface{}, prefix string, v interface{}) {
+	children := map[string]interface{}{}
+
+	switch typed := v.(type) {
+	case map[string]interface{}:
+		for k, c := range typed {
+			children[k] = c
+		}
+	case map[interface{}]interface{}:
+		for k, c := range typed {
+			children[fmt.Sprintf("%v", k)] = c
+		}
+	default:
+		if prefix != "" {
+			flat[prefix] = v
+		}
+		return
+	}
+
+	if len(children) == 0 {
+		if prefix != "" {
+			flat[prefix] = v
+		}
+		return
+	}
+
+	for k, c := range children {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		flattenValuesInto(flat, key, c)
+	}
+}
+
+// diffValues returns the changes required to turn the old values into the new values, sorted by key.
+func diffValues(oldValues, newValues map[string]interface{}) []valuesChange {
+	oldFlat := flattenValues(oldValues)
+	newFlat := flattenValues(newValues)
+
+	var changes []valuesChange
+
+	for k, o := range oldFlat {
+		n, ok := newFlat[k]
+		if !ok {
+			changes = append(changes, valuesChange{key: k, oldVal: o, removed: true})
+		} else if !reflect.DeepEqual(normalizeNumbers(o), normalizeNumbers(n)) {
+			changes = append(changes, valuesChange{key: k, oldVal: o, newVal: n})
+		}
+	}
+
+	for k, n := range newFlat {
+		if _, ok := oldFlat[k]; !ok {
+			changes = append(changes, valuesChange{key: k, newVal: n, added: true})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].key < changes[j].key
+	})
+
+	return changes
+}
+
+// normalizeNumbers converts the integers in v to int64, as the values parsed from --set are int64
+// whereas the ones unmarshalled from YAML are int
+func normalizeNumbers(v interface{}) interface{} {
+	switch typed := v.(type) {
+	case int:
+		return int64(typed)
+	case int32:
+		return int64(typed)
+	case uint64:
+		return int64(typed)
+	case []interface{}:
+		normalized := make([]interface{}, len(typed))
+		for i, e := range typed {
+			normalized[i] = normalizeNumbers(e)
+		}
+		return normalized
+	case map[string]interface{}:
+		normalized := make(map[string]interface{}, len(typed))
+		for k, e := range typed {
+			normalized[k] = normalizeNumbers(e)
+		}
+		return normalized
+	case map[interface{}]interface{}:
+		normalized := make(map[interface{}]interface{}, len(typed))
+		for k, e := range typed {
+			normalized[k] = normalizeNumbers(e)
+		}
+		return normalized
+	}
+
+	return v
+}
+
+func writeValuesChanges(w io.Writer, changes []valuesChange, sensitive map[string]struct{}) {
+	format := func(key string, v interface{}) string {
+		if _, ok := sensitive[key]; ok {
+			return redactedValue
+		}
+		return formatValue(v)
+	}
+
+	for _, c := range changes {
+		switch {
+		case c.added:
+			fmt.Fprintf(w, "+ %s: %s\n", c.key, format(c.key, c.newVal))
+		case c.removed:
+			fmt.Fprintf(w, "- %s: %s\n", c.key, format(c.key, c.oldVal))
+		default:
+			fmt.Fprintf(w, "- %s: %s\n", c.key, format(c.key, c.oldVal))
+			fmt.Fprintf(w, "+ %s: %s\n", c.key, format(c.key, c.newVal))
+		}
+	}
+}
+
+func formatValue(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string, bool, int, int64, float64:
+		return fmt.Sprintf("%v", v)
+	}
+
+	// Render lists and empty maps on a single line so that every change fits in a line
+	m, err := maputil.CastKeysToStrings(map[string]interface{}{"v": v})
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+
+	bs, err := json.Marshal(m["v"])
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+
+	return string(bs)
+}
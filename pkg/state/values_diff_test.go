@@ -0,0 +1,126 @@
+package state
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"gopkg.in/yaml.v2"
+
+	"github.com/roboll/helmfile/pkg/exectest"
+)
+
+func TestDiffValues(t *testing.T) {
+	tests := []struct {
+		name      string
+		deployed  string
+		desired   string
+		sensitive map[string]struct{}
+		want      string
+	}{
+		{
+			name:     "no changes",
+			deployed: "image:\n  tag: 1.0.0\n",
+			desired:  "image:\n  tag: 1.0.0\n",
+			want:     "",
+		},
+		{
+			name:     "added, removed and changed keys",
+			deployed: "image:\n  tag: 1.0.0\nreplicas: 2\ndebug: true\n",
+			desired:  "image:\n  tag: 1.1.0\n  repository: nginx\nreplicas: 2\n",
+			want: `- debug: true
++ image.repository: nginx
+- image.tag: 1.0.0
++ image.tag: 1.1.0
+`,
+		},
+		{
+			name:     "lists are compared as a whole",
+			deployed: "hosts:\n- a\n- b\n",
+			desired:  "hosts:\n- a\n",
+			want: `- hosts: ["a","b"]
++ hosts: ["a"]
+`,
+		},
+		{
+			name:      "sensitive values are redacted",
+			deployed:  "db:\n  password: foo\n",
+			desired:   "db:\n  password: bar\n",
+			sensitive: map[string]struct{}{"db.password": {}},
+			want: `- db.password: <redacted>
++ db.password: <redacted>
+`,
+		},
+		{
+			name:    "new release",
+			desired: "a: 1\nb:\n  c: x\n",
+			want: `+ a: 1
++ b.c: x
+`,
+		},
+	}
+
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			var deployed, desired map[string]interface{}
+			if err := yaml.Unmarshal([]byte(tt.deployed), &deployed); err != nil {
+				t.Fatal(err)
+			}
+			if err := yaml.Unmarshal([]byte(tt.desired), &desired); err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			writeValuesChanges(&buf, diffValues(deployed, desired), tt.sensitive)
+
+			if d := cmp.Diff(tt.want, buf.String()); d != "" {
+				t.Errorf("unexpected output: want (-), got (+):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestHelmState_DiffReleases_ValuesOnly_SetValues(t *testing.T) {
+	state := &HelmState{
+		ReleaseSetSpec: ReleaseSetSpec{
+			Releases: []ReleaseSpec{
+				{
+					Name:   "foo",
+					Chart:  "stable/foo",
+					Values: []interface{}{map[interface{}]interface{}{"replicas": 1}},
+					SetValues: []SetValue{
+						{Name: "image.tag", Value: "v1"},
+					},
+					SetStringValues: []SetValue{
+						{Name: "version", Value: "1.0"},
+					},
+				},
+			},
+		},
+		logger:         logger,
+		valsRuntime:    valsRuntime,
+		readFile:       os.ReadFile,
+		removeFile:     os.Remove,
+		RenderedValues: map[string]interface{}{},
+	}
+
+	// The deployed values include the ones given with --set, --set-string and the --set of the command-line
+	helm := &exectest.Helm{
+		FailOnUnexpectedDiff: true,
+		FailOnUnexpectedList: true,
+		Helm3:                true,
+		Lists: map[exectest.ListKey]string{
+			{Filter: "^foo$", Flags: "--uninstalling--deployed--failed--pending"}: "foo\tdefault\t1\t2021-01-01 00:00:00\tdeployed\tfoo-1.0.0\t1.0.0\n",
+		},
+		Values: map[string]string{
+			"foo": "replicas: 2\nimage:\n  tag: v1\nversion: \"1.0\"\n",
+		},
+	}
+
+	_, errs := state.DiffReleases(helm, []string{}, 1, true, false, []string{}, false, false, false, false, &DiffOpts{ValuesOnly: true, Set: []string{"replicas=2"}})
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+}
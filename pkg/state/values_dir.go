@@ -0,0 +1,91 @@
+package state
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// recursiveValuesDirSuffix is the suffix of a values entry that opts into merging
+// all the values files found under the directory, including its subdirectories.
+const recursiveValuesDirSuffix = "/**"
+
+var valuesDirFileSuffixes = []string{".yaml", ".yml", ".yaml.gotmpl", ".yml.gotmpl", ".jsonnet"}
+
+// resolveValuesFiles resolves a `values` entry to the files to be merged in order.
+//
+// An entry that resolves to a directory expands to the values files contained in it, sorted in lexical order,
+// so that it results in the same values as listing the files individually.
+// Only the files directly under the directory are used unless the entry ends with `/**`.
+func (st *HelmState) resolveValuesFiles(missingFileHandler *string, entry string) ([]string, bool, error) {
+	if strings.HasSuffix(entry, recursiveValuesDirSuffix) {
+		dir := st.storage().normalizePath(strings.TrimSuffix(entry, recursiveValuesDirSuffix))
+		return st.resolveValuesDir(missingFileHandler, entry, dir, true)
+	}
+
+	if dir := st.storage().normalizePath(entry); st.directoryExistsAt(dir) {
+		return st.resolveValuesDir(missingFileHandler, entry, dir, false)
+	}
+
+	paths, skip, err := st.storage().resolveFile(missingFileHandler, "values", entry)
+	if err != nil || skip {
+		return nil, skip, err
+	}
+
+	if len(paths) > 1 {
+		return nil, false, fmt.Errorf("glob patterns in release values and secrets is not supported yet. please submit a feature request if necessary")
+	}
+
+	return paths, false, nil
+}
+
+func (st *HelmState) resolveValuesDir(missingFileHandler *string, entry, dir string, recursive bool) ([]string, bool, error) {
+	var files []string
+
+	pattern := dir
+	for {
+		pattern = filepath.Join(pattern, "*")
+
+		matches, err := st.glob(pattern)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed processing %s: %v", entry, err)
+		}
+
+		if len(matches) == 0 {
+			break
+		}
+
+		for _, m := range matches {
+			if isValuesDirFile(m) && !st.directoryExistsAt(m) {
+				files = append(files, m)
+			}
+		}
+
+		if !recursive {
+			break
+		}
+	}
+
+	if len(files) == 0 {
+		skip, err := st.storage().handleMissingFile(missingFileHandler, entry,
+			fmt.Errorf("values directory \"%s\" contains no values files", dir),
+			fmt.Sprintf("skipping values directory \"%s\" that contains no values files", dir),
+		)
+		return nil, skip, err
+	}
+
+	sort.Strings(files)
+
+	return files, false, nil
+}
+
+func isValuesDirFile(path string) bool {
+	for _, suffix := range valuesDirFileSuffixes {
+		if strings.HasSuffix(path, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,101 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/roboll/helmfile/pkg/testhelper"
+)
+
+func TestHelmState_LoadYAMLForEmbedding_ValuesDirectory(t *testing.T) {
+	files := map[string]string{
+		"/path/to/values/b.yaml":          "name: b\nb: true\n",
+		"/path/to/values/a.yaml":          "name: a\na: true\n",
+		"/path/to/values/README.md":       "not values",
+		"/path/to/values/nested/c.yaml":   "name: c\n",
+		"/path/to/values/nested/d/e.yaml": "name: e\n",
+		"/path/to/empty/README.md":        "not values",
+	}
+
+	warn := MissingFileHandlerWarn
+
+	testcases := []struct {
+		name               string
+		entry              string
+		missingFileHandler *string
+		want               []interface{}
+		wantErr            string
+	}{
+		{
+			name:  "non-recursive",
+			entry: "values",
+			want: []interface{}{
+				map[string]interface{}{"name": "a", "a": true},
+				map[string]interface{}{"name": "b", "b": true},
+			},
+		},
+		{
+			name:  "trailing slash",
+			entry: "values/",
+			want: []interface{}{
+				map[string]interface{}{"name": "a", "a": true},
+				map[string]interface{}{"name": "b", "b": true},
+			},
+		},
+		{
+			name:  "recursive",
+			entry: "values/**",
+			want: []interface{}{
+				map[string]interface{}{"name": "a", "a": true},
+				map[string]interface{}{"name": "b", "b": true},
+				map[string]interface{}{"name": "c"},
+				map[string]interface{}{"name": "e"},
+			},
+		},
+		{
+			name:    "empty directory",
+			entry:   "empty",
+			wantErr: `values directory "/path/to/empty" contains no values files`,
+		},
+		{
+			name:               "empty directory with warn handler",
+			entry:              "empty",
+			missingFileHandler: &warn,
+		},
+		{
+			name:    "missing recursive directory",
+			entry:   "missing/**",
+			wantErr: `values directory "/path/to/missing" contains no values files`,
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			st := injectFs(&HelmState{
+				basePath:       "/path/to",
+				FilePath:       "/path/to/helmfile.yaml",
+				logger:         logger,
+				valsRuntime:    valsRuntime,
+				RenderedValues: map[string]interface{}{},
+			}, testhelper.NewTestFs(files))
+
+			got, err := st.LoadYAMLForEmbedding(&ReleaseSpec{Name: "foo"}, []interface{}{tc.entry}, tc.missingFileHandler, "")
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("unexpected error: want %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("unexpected result: want (-), got (+):\n%s", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package state
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+	"github.com/roboll/helmfile/pkg/maputil"
+)
+
+const valuesSchemaFile = "values.schema.json"
+
+// validateValuesSchema validates the values of the release against the values.schema.json of the chart at chartPath.
+//
+// The validated values are the chart's default values merged with the release's values and secrets files,
+// in the same order as helm merges them. `set` entries are left to helm, as they need helm's parser to be typed correctly.
+// It only warns when the chart has no schema or isn't available locally.
+func (st *HelmState) validateValuesSchema(helm helmexec.Interface, release *ReleaseSpec, chartPath string, workerIndex int) error {
+	if !st.directoryExistsAt(chartPath) {
+		st.logger.Warnf("release %q: skipping values schema validation: chart %q is not a local directory", release.Name, chartPath)
+		return nil
+	}
+
+	schemaPath := filepath.Join(chartPath, valuesSchemaFile)
+
+	exists, err := st.fileExists(schemaPath)
+	if err != nil {
+		return fmt.Errorf("release %q: %w", release.Name, err)
+	}
+
+	if !exists {
+		st.logger.Warnf("release %q: skipping values schema validation: chart %q has no %s", release.Name, chartPath, valuesSchemaFile)
+		return nil
+	}
+
+	var files []string
+
+	defaultsPath := filepath.Join(chartPath, "values.yaml")
+	if exists, err := st.fileExists(defaultsPath); err != nil {
+		return fmt.Errorf("release %q: %w", release.Name, err)
+	} else if exists {
+		files = append(files, defaultsPath)
+	}
+
+	generatedFiles, err := st.generateValuesFiles(helm, release, workerIndex)
+	defer st.removeFiles(generatedFiles)
+	if err != nil {
+		return fmt.Errorf("release %q: %w", release.Name, err)
+	}
+
+	merged, err := st.mergeValuesFiles(append(files, generatedFiles...))
+	if err != nil {
+		return fmt.Errorf("release %q: %w", release.Name, err)
+	}
+
+	values, err := maputil.CastKeysToStrings(merged)
+	if err != nil {
+		return fmt.Errorf("release %q: %w", release.Name, err)
+	}
+
+	schema, err := st.readFile(schemaPath)
+	if err != nil {
+		return fmt.Errorf("release %q: reading %s: %w", release.Name, schemaPath, err)
+	}
+
+	result, err := gojsonschema.Validate(gojsonschema.NewBytesLoader(schema), gojsonschema.NewGoLoader(values))
+	if err != nil {
+		return fmt.Errorf("release %q: validating values against %s: %w", release.Name, schemaPath, err)
+	}
+
+	if !result.Valid() {
+		var errs []string
+		for _, e := range result.Errors() {
+			errs = append(errs, fmt.Sprintf("- %s", e))
+		}
+		sort.Strings(errs)
+
+		return fmt.Errorf("release %q: values don't meet the specifications of the schema in %s:\n%s", release.Name, schemaPath, strings.Join(errs, "\n"))
+	}
+
+	st.logger.Debugf("release %q: values are valid against %s", release.Name, schemaPath)
+
+	return nil
+}
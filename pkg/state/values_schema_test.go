@@ -0,0 +1,151 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/roboll/helmfile/pkg/exectest"
+)
+
+func TestHelmState_PrepareCharts_ValidateValues(t *testing.T) {
+	const schema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "type": "object",
+  "required": ["image"],
+  "properties": {
+    "image": {
+      "type": "object",
+      "required": ["repository", "tag"],
+      "properties": {
+        "repository": {"type": "string"},
+        "tag": {"type": "string"}
+      }
+    }
+  }
+}
+`
+
+	testcases := []struct {
+		name           string
+		schema         bool
+		values         string
+		validateValues bool
+		releaseSetting *bool
+		wantErr        string
+	}{
+		{
+			name:           "valid",
+			schema:         true,
+			values:         "image:\n  tag: v1\n",
+			validateValues: true,
+		},
+		{
+			name:           "missing required field",
+			schema:         true,
+			values:         "image:\n  repository: null\n",
+			validateValues: true,
+			wantErr: `release "myapp": values don't meet the specifications of the schema in %s/values.schema.json:
+- image.repository: Invalid type. Expected: string, given: null
+- image: tag is required`,
+		},
+		{
+			name:           "disabled by release",
+			schema:         true,
+			values:         "image:\n  repository: null\n",
+			validateValues: true,
+			releaseSetting: boolValue(false),
+		},
+		{
+			name:           "enabled by release",
+			schema:         true,
+			values:         "image:\n  repository: null\n  tag: v1\n",
+			releaseSetting: boolValue(true),
+			wantErr: `release "myapp": values don't meet the specifications of the schema in %s/values.schema.json:
+- image.repository: Invalid type. Expected: string, given: null`,
+		},
+		{
+			name:           "disabled",
+			schema:         true,
+			values:         "image:\n  repository: null\n",
+			validateValues: false,
+		},
+		{
+			name:           "no schema",
+			schema:         false,
+			values:         "image:\n  repository: null\n",
+			validateValues: true,
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			chart := filepath.Join(dir, "chart")
+
+			files := map[string]string{
+				filepath.Join(chart, "Chart.yaml"):  "apiVersion: v2\nname: mychart\nversion: 0.1.0\n",
+				filepath.Join(chart, "values.yaml"): "image:\n  repository: myapp\n",
+				filepath.Join(dir, "values.yaml"):   tc.values,
+			}
+			if tc.schema {
+				files[filepath.Join(chart, "values.schema.json")] = schema
+			}
+
+			if err := os.MkdirAll(chart, 0755); err != nil {
+				t.Fatal(err)
+			}
+			for f, c := range files {
+				if err := os.WriteFile(f, []byte(c), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			state := &HelmState{
+				basePath: dir,
+				FilePath: filepath.Join(dir, "helmfile.yaml"),
+				ReleaseSetSpec: ReleaseSetSpec{
+					Releases: []ReleaseSpec{
+						{
+							Name:                 "myapp",
+							Chart:                chart,
+							Values:               []interface{}{"values.yaml"},
+							ValidateValuesSchema: tc.releaseSetting,
+						},
+					},
+				},
+				logger:      logger,
+				valsRuntime: valsRuntime,
+				readFile:    os.ReadFile,
+				removeFile:  os.Remove,
+				glob:        filepath.Glob,
+				fileExists: func(f string) (bool, error) {
+					_, err := os.Stat(f)
+					return err == nil, nil
+				},
+				directoryExistsAt: directoryExistsAt,
+				RenderedValues:    map[string]interface{}{},
+			}
+
+			_, errs := state.PrepareCharts(&exectest.Helm{Helm3: true}, dir, 1, "sync", ChartPrepareOptions{
+				SkipDeps:       true,
+				ValidateValues: tc.validateValues,
+			})
+
+			if tc.wantErr == "" {
+				if len(errs) > 0 {
+					t.Fatalf("unexpected errors: %v", errs)
+				}
+				return
+			}
+
+			want := strings.Replace(tc.wantErr, "%s", chart, 1)
+			if len(errs) != 1 || errs[0].Error() != want {
+				t.Fatalf("unexpected errors: want %q, got %v", want, errs)
+			}
+		})
+	}
+}
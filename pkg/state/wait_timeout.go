@@ -0,0 +1,48 @@
+package state
+
+import (
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+// waitTimeout returns the timeout for helm to wait for the release to be ready with --wait.
+// It's the larger of waitTimeout and timeout, so that waitTimeout never shortens the timeout of the other operations,
+// and waitTimeout as is when timeout isn't set. Both default to the ones in helmDefaults.
+func (st *HelmState) waitTimeout(release *ReleaseSpec) Duration {
+	timeout := st.HelmDefaults.Timeout
+	if release.Timeout != nil {
+		timeout = *release.Timeout
+	}
+
+	waitTimeout := st.HelmDefaults.WaitTimeout
+	if release.WaitTimeout != nil {
+		waitTimeout = *release.WaitTimeout
+	}
+
+	if waitTimeout > timeout {
+		return waitTimeout
+	}
+
+	return timeout
+}
+
+func (st *HelmState) waitTimeoutFlags(helm helmexec.Interface, release *ReleaseSpec) []string {
+	return durationTimeoutFlags(helm, st.waitTimeout(release))
+}
+
+// withWaitTimeout replaces the value of --timeout in the flags of the release with the wait timeout, or appends --timeout when missing.
+// It's used when --wait is enabled by the sync and apply commands, after the flags of the release are built without it.
+func (st *HelmState) withWaitTimeout(flags []string, helm helmexec.Interface, release *ReleaseSpec) []string {
+	timeoutFlags := st.waitTimeoutFlags(helm, release)
+	if len(timeoutFlags) == 0 {
+		return flags
+	}
+
+	for i := 0; i < len(flags)-1; i++ {
+		if flags[i] == "--timeout" {
+			flags[i+1] = timeoutFlags[1]
+			return flags
+		}
+	}
+
+	return append(flags, timeoutFlags...)
+}
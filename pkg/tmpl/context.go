@@ -1,7 +1,11 @@
 package tmpl
 
+import "text/template"
+
 type Context struct {
 	preRender bool
 	basePath  string
 	readFile  func(string) ([]byte, error)
+	// funcs are the template functions available in addition to the built-in ones
+	funcs template.FuncMap
 }
@@ -0,0 +1,74 @@
+package tmpl
+
+import (
+	"text/template/parse"
+)
+
+// FieldRefs returns the chains of the fields of the template data referenced by the template content,
+// like `[Values charts repo]` for `{{ .Values.charts.repo }}` and `{{ $.Values.charts.repo }}`.
+// The fields referenced within `range` and `with` are returned as written, although they are relative to the changed dot.
+func (r *FileRenderer) FieldRefs(content []byte) ([][]string, error) {
+	t, err := r.Context.newTemplate().Parse(string(content))
+	if err != nil {
+		return nil, err
+	}
+
+	var refs [][]string
+
+	for _, tt := range t.Templates() {
+		if tt.Tree != nil {
+			refs = appendFieldRefs(refs, tt.Tree.Root)
+		}
+	}
+
+	return refs, nil
+}
+
+func appendFieldRefs(refs [][]string, node parse.Node) [][]string {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return refs
+		}
+		for _, c := range n.Nodes {
+			refs = appendFieldRefs(refs, c)
+		}
+	case *parse.ActionNode:
+		refs = appendFieldRefs(refs, n.Pipe)
+	case *parse.IfNode:
+		refs = appendBranchFieldRefs(refs, &n.BranchNode)
+	case *parse.RangeNode:
+		refs = appendBranchFieldRefs(refs, &n.BranchNode)
+	case *parse.WithNode:
+		refs = appendBranchFieldRefs(refs, &n.BranchNode)
+	case *parse.TemplateNode:
+		refs = appendFieldRefs(refs, n.Pipe)
+	case *parse.PipeNode:
+		if n == nil {
+			return refs
+		}
+		for _, c := range n.Cmds {
+			refs = appendFieldRefs(refs, c)
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			refs = appendFieldRefs(refs, a)
+		}
+	case *parse.FieldNode:
+		refs = append(refs, n.Ident)
+	case *parse.VariableNode:
+		if len(n.Ident) > 1 && n.Ident[0] == "$" {
+			refs = append(refs, n.Ident[1:])
+		}
+	case *parse.ChainNode:
+		refs = appendFieldRefs(refs, n.Node)
+	}
+
+	return refs
+}
+
+func appendBranchFieldRefs(refs [][]string, n *parse.BranchNode) [][]string {
+	refs = appendFieldRefs(refs, n.Pipe)
+	refs = appendFieldRefs(refs, n.List)
+	return appendFieldRefs(refs, n.ElseList)
+}
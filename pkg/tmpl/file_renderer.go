@@ -6,6 +6,7 @@ import (
 
 	"fmt"
 	"strings"
+	"text/template"
 )
 
 type FileRenderer struct {
@@ -37,6 +38,12 @@ func NewFirstPassRenderer(basePath string, data interface{}) *FileRenderer {
 	}
 }
 
+// WithFuncs makes the additional template functions available to the templates rendered by the renderer
+func (r *FileRenderer) WithFuncs(funcs template.FuncMap) *FileRenderer {
+	r.Context.funcs = funcs
+	return r
+}
+
 func (r *FileRenderer) RenderTemplateFileToBuffer(file string) (*bytes.Buffer, error) {
 	content, err := r.ReadFile(file)
 	if err != nil {
@@ -48,10 +55,17 @@ func (r *FileRenderer) RenderTemplateFileToBuffer(file string) (*bytes.Buffer, e
 
 // RenderToBytes loads the content of the file.
 // If its extension is `gotmpl` it treats the content as a go template and renders it.
+// If its extension is `jsonnet` it evaluates the content as jsonnet and returns the resulting JSON.
 func (r *FileRenderer) RenderToBytes(path string) ([]byte, error) {
 	var yamlBytes []byte
 	splits := strings.Split(path, ".")
-	if len(splits) > 0 && splits[len(splits)-1] == "gotmpl" {
+	if len(splits) > 0 && splits[len(splits)-1] == "jsonnet" {
+		jsonBytes, err := r.RenderJsonnetToBytes(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to evaluate [%s], because of %v", path, err)
+		}
+		yamlBytes = jsonBytes
+	} else if len(splits) > 0 && splits[len(splits)-1] == "gotmpl" {
 		yamlBuf, err := r.RenderTemplateFileToBuffer(path)
 		if err != nil {
 			return nil, fmt.Errorf("failed to render [%s], because of %v", path, err)
@@ -65,3 +65,73 @@ func TestRenderToBytes_Yaml(t *testing.T) {
 		t.Errorf("unexpected result: expected=%v, actual=%v", expected, actual)
 	}
 }
+
+func TestRenderToBytes_Jsonnet(t *testing.T) {
+	valuesJsonnetContent := `local lib = import 'lib.libsonnet';
+{
+  foo: lib.upper(std.extVar('Values').bar),
+  env: std.extVar('Environment').Name,
+}
+`
+	libContent := `{ upper(s):: std.asciiUpper(s) }`
+	expected := `{
+   "env": "production",
+   "foo": "BAR"
+}
+`
+	valuesFile := "values.jsonnet"
+	libFile := "lib.libsonnet"
+	data := map[string]interface{}{
+		"Environment": environment.Environment{Name: "production"},
+		"Values":      map[string]interface{}{"bar": "bar"},
+	}
+	r := NewFileRenderer(func(filename string) ([]byte, error) {
+		switch filename {
+		case valuesFile:
+			return []byte(valuesJsonnetContent), nil
+		case libFile:
+			return []byte(libContent), nil
+		}
+		return nil, fmt.Errorf("unexpected filename: expected=%v or %v, actual=%s", valuesFile, libFile, filename)
+	}, "", data)
+	buf, err := r.RenderToBytes(valuesFile)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	actual := string(buf)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected result: expected=%v, actual=%v", expected, actual)
+	}
+}
+
+func TestFieldRefs(t *testing.T) {
+	content := `releases:
+- name: {{ .Release.Name }}
+  chart: {{ .Values.charts.repo }}/app
+  version: {{ $.Environment.Values.app.version | quote }}
+{{- if .Values.enabled }}
+  namespace: {{ (.Values.ns).name }}
+{{- end }}
+{{- range $i, $v := .StateValues.extra }}
+  {{ $i }}: {{ $v }}
+{{- end }}
+`
+	r := NewFirstPassRenderer("", emptyEnvTmplData)
+
+	refs, err := r.FieldRefs([]byte(content))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := [][]string{
+		{"Release", "Name"},
+		{"Values", "charts", "repo"},
+		{"Environment", "Values", "app", "version"},
+		{"Values", "enabled"},
+		{"Values", "ns"},
+		{"StateValues", "extra"},
+	}
+	if !reflect.DeepEqual(refs, expected) {
+		t.Errorf("unexpected result: expected=%v, actual=%v", expected, refs)
+	}
+}
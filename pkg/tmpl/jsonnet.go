@@ -0,0 +1,134 @@
+package tmpl
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+
+	"github.com/google/go-jsonnet"
+	"github.com/roboll/helmfile/pkg/maputil"
+)
+
+// jsonnetExtVars is the list of template data fields exposed to jsonnet as external variables,
+// so that `std.extVar("Values")` in a jsonnet file is equivalent to `.Values` in a gotmpl file.
+var jsonnetExtVars = []string{"Environment", "Values"}
+
+// RenderJsonnetToBytes evaluates the jsonnet file and returns the resulting JSON document.
+// The JSON output is a valid YAML document, so that it can be consumed as a values file as-is.
+func (r *FileRenderer) RenderJsonnetToBytes(path string) ([]byte, error) {
+	content, err := r.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	vm := jsonnet.MakeVM()
+	vm.Importer(&jsonnetImporter{readFile: r.ReadFile, basePath: r.Context.basePath})
+
+	for _, name := range jsonnetExtVars {
+		v, ok := lookupField(r.Data, name)
+		if !ok {
+			continue
+		}
+
+		code, err := toJsonnetCode(v)
+		if err != nil {
+			return nil, fmt.Errorf("passing %s to jsonnet: %v", name, err)
+		}
+
+		vm.ExtCode(name, code)
+	}
+
+	out, err := vm.EvaluateAnonymousSnippet(path, string(content))
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(out), nil
+}
+
+// lookupField returns the value of the named field or key of the template data, which is usually a struct.
+func lookupField(data interface{}, name string) (interface{}, bool) {
+	v := reflect.ValueOf(data)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, false
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		f := v.FieldByName(name)
+		if !f.IsValid() || !f.CanInterface() {
+			return nil, false
+		}
+		return f.Interface(), true
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, false
+		}
+		e := v.MapIndex(reflect.ValueOf(name))
+		if !e.IsValid() {
+			return nil, false
+		}
+		return e.Interface(), true
+	}
+
+	return nil, false
+}
+
+func toJsonnetCode(v interface{}) (string, error) {
+	// Expose struct fields like `Environment.Name` under the same names as in go templates
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Struct {
+		fields := map[string]interface{}{}
+		for i := 0; i < rv.NumField(); i++ {
+			if f := rv.Type().Field(i); f.PkgPath == "" {
+				fields[f.Name] = rv.Field(i).Interface()
+			}
+		}
+		v = fields
+	}
+
+	// yaml.v2 produces map[interface{}]interface{} that encoding/json is unable to marshal
+	m, err := maputil.CastKeysToStrings(map[string]interface{}{"v": v})
+	if err != nil {
+		return "", err
+	}
+
+	bs, err := json.Marshal(m["v"])
+	if err != nil {
+		return "", err
+	}
+
+	return string(bs), nil
+}
+
+// jsonnetImporter resolves jsonnet imports relative to the importing file, and then to the base path,
+// reading files in the same way as the other renderers do.
+type jsonnetImporter struct {
+	readFile func(string) ([]byte, error)
+	basePath string
+}
+
+func (i *jsonnetImporter) Import(importedFrom, importedPath string) (jsonnet.Contents, string, error) {
+	candidates := []string{importedPath}
+	if !filepath.IsAbs(importedPath) {
+		candidates = []string{
+			filepath.Join(filepath.Dir(importedFrom), importedPath),
+			filepath.Join(i.basePath, importedPath),
+		}
+	}
+
+	var lastErr error
+	for _, c := range candidates {
+		bs, err := i.readFile(c)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return jsonnet.MakeContents(string(bs)), c, nil
+	}
+
+	return jsonnet.Contents{}, "", fmt.Errorf("importing %s: %v", importedPath, lastErr)
+}